@@ -0,0 +1,42 @@
+// Package authkeys fetches the authorized keys of downstream users for the
+// ssh proxy from the directories most deployments keep them in.
+//
+// LDAP reads the sshPublicKey attribute of directory entries. HTTP fetches
+// keys from an HTTPS endpoint, caching them and revalidating them with
+// ETags; GitHub and GitLab return an HTTP for the user keys those services
+// publish. Each implements Source, which Hook and ContextHook adapt to
+// ssh.ProxyConfig.FetchAuthorizedKeysHook and
+// FetchAuthorizedKeysContextHook.
+package authkeys
+
+import (
+	"context"
+	"errors"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrUnknownUser is returned for users a Source has no entry for.
+var ErrUnknownUser = errors.New("authkeys: unknown user")
+
+// Source looks up authorized keys.
+type Source interface {
+	// AuthorizedKeys returns the keys of username in the format of
+	// OpenSSH's authorized_keys file.
+	AuthorizedKeys(ctx context.Context, username string) ([]byte, error)
+}
+
+// Hook returns s as an ssh.ProxyConfig.FetchAuthorizedKeysHook.
+func Hook(s Source) func(username string) ([]byte, error) {
+	return func(username string) ([]byte, error) {
+		return s.AuthorizedKeys(context.Background(), username)
+	}
+}
+
+// ContextHook returns s as an
+// ssh.ProxyConfig.FetchAuthorizedKeysContextHook.
+func ContextHook(s Source) func(ctx context.Context, meta ssh.HookMetadata) ([]byte, error) {
+	return func(ctx context.Context, meta ssh.HookMetadata) ([]byte, error) {
+		return s.AuthorizedKeys(ctx, meta.User)
+	}
+}
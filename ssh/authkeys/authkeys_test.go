@@ -0,0 +1,150 @@
+package authkeys
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const aliceKeys = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOtZ2Pqk1sJ4Hvtk7c4bU5Lrdo9rIkC5Z6yBqzPxX4Vw alice\n"
+
+// fakeKeys serves the keys of alice with an ETag.
+type fakeKeys struct {
+	mu          sync.Mutex
+	fail        bool
+	status      int
+	requests    int
+	notModified int
+	paths       []string
+}
+
+func (f *fakeKeys) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	f.paths = append(f.paths, r.URL.EscapedPath())
+	switch {
+	case f.status != 0:
+		w.WriteHeader(f.status)
+	case f.fail:
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case r.URL.Path != "/alice.keys":
+		w.WriteHeader(http.StatusNotFound)
+	case r.Header.Get("If-None-Match") == `"v1"`:
+		f.notModified++
+		w.WriteHeader(http.StatusNotModified)
+	default:
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(aliceKeys))
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	f := &fakeKeys{}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	now := time.Unix(1e9, 0)
+	h := GitLab(srv.URL + "/")
+	h.Clock = func() time.Time { return now }
+
+	lookup := func(user string) ([]byte, error) {
+		return h.AuthorizedKeys(context.Background(), user)
+	}
+	for i := 0; i < 2; i++ {
+		if keys, err := lookup("alice"); err != nil || string(keys) != aliceKeys {
+			t.Fatalf("got %q, %v, want the keys of alice", keys, err)
+		}
+	}
+	if f.requests != 1 {
+		t.Errorf("got %d requests within the TTL, want 1", f.requests)
+	}
+
+	now = now.Add(h.TTL)
+	if keys, err := lookup("alice"); err != nil || string(keys) != aliceKeys {
+		t.Fatalf("revalidated: got %q, %v", keys, err)
+	}
+	if f.notModified != 1 {
+		t.Errorf("got %d revalidations, want 1", f.notModified)
+	}
+
+	now = now.Add(h.TTL)
+	f.fail = true
+	if keys, err := lookup("alice"); err != nil || string(keys) != aliceKeys {
+		t.Errorf("server down: got %q, %v, want the cached keys", keys, err)
+	}
+	if _, err := lookup("bob"); err == nil {
+		t.Error("server down: got keys of an uncached user")
+	}
+	f.fail = false
+	if _, err := lookup("bob/../alice"); err != ErrUnknownUser {
+		t.Errorf("got %v for an unknown user, want ErrUnknownUser", err)
+	}
+	if got, want := f.paths[len(f.paths)-1], "/bob%2F..%2Falice.keys"; got != want {
+		t.Errorf("requested %s, want %s", got, want)
+	}
+}
+
+func TestHTTPMaxStale(t *testing.T) {
+	f := &fakeKeys{}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	now := time.Unix(1e9, 0)
+	h := GitLab(srv.URL)
+	h.MaxStale = time.Hour
+	h.Clock = func() time.Time { return now }
+	lookup := func() error {
+		_, err := h.AuthorizedKeys(context.Background(), "alice")
+		return err
+	}
+	if err := lookup(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.fail = true
+	now = now.Add(h.TTL + h.MaxStale - time.Second)
+	if err := lookup(); err != nil {
+		t.Errorf("server down within MaxStale: %v", err)
+	}
+	now = now.Add(2 * time.Second)
+	if err := lookup(); err == nil {
+		t.Error("server down beyond MaxStale: got the cached keys")
+	}
+
+	for _, status := range []int{http.StatusForbidden, http.StatusGone} {
+		f.fail, f.status = false, 0
+		now = now.Add(h.TTL)
+		if err := lookup(); err != nil {
+			t.Fatal(err)
+		}
+		f.status = status
+		now = now.Add(h.TTL)
+		if err := lookup(); err == nil {
+			t.Errorf("status %d: got the cached keys", status)
+		}
+		f.status = http.StatusServiceUnavailable
+		if err := lookup(); err == nil {
+			t.Errorf("status %d: keys still cached", status)
+		}
+	}
+}
+
+func TestHook(t *testing.T) {
+	srv := httptest.NewServer(&fakeKeys{})
+	defer srv.Close()
+	h := &HTTP{URL: srv.URL + "/{user}.keys"}
+	keys, err := Hook(h)("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err := ssh.ParseAuthorizedKey(keys); err != nil {
+		t.Errorf("ParseAuthorizedKey: %v", err)
+	}
+	if _, err := ContextHook(h)(context.Background(), ssh.HookMetadata{User: "alice"}); err != nil {
+		t.Errorf("ContextHook: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package authkeys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxKeysSize bounds the responses read by HTTP.
+const maxKeysSize = 1 << 20
+
+// DefaultMaxStale is used if HTTP.MaxStale is zero.
+const DefaultMaxStale = time.Hour
+
+// errDenied is returned for 403 responses.
+var errDenied = errors.New("authkeys: access to the keys denied")
+
+var defaultHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// HTTP fetches authorized keys from an HTTPS endpoint, which answers with
+// the keys of a user in the format of authorized_keys, or 404 for unknown
+// users. Keys are cached for TTL and then revalidated with the ETag or
+// Last-Modified of the response. If a request fails, the cached keys are
+// used until it succeeds, but no longer than MaxStale after they expired.
+// A 403 or 410 response drops them at once. It is safe for concurrent use.
+type HTTP struct {
+	// URL is the endpoint, in which "{user}" is replaced with the
+	// escaped username, such as "https://keys.example.com/{user}".
+	URL string
+
+	// Header is added to every request, for example for an Authorization.
+	Header http.Header
+
+	// TTL is how long keys are used before they are revalidated. If
+	// zero, they are revalidated on every lookup.
+	TTL time.Duration
+
+	// MaxStale is how long expired keys are still used while requests
+	// fail, after which lookups fail too. If zero, DefaultMaxStale is
+	// used; if negative, expired keys are never used.
+	MaxStale time.Duration
+
+	// HTTPClient is used for requests. If nil, a client with a timeout of
+	// ten seconds is used.
+	HTTPClient *http.Client
+
+	// Clock returns the current time. If nil, time.Now is used.
+	Clock func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]*cachedKeys
+}
+
+// cachedKeys are the keys of one user and the validators of the response
+// they came with.
+type cachedKeys struct {
+	keys         []byte
+	etag         string
+	lastModified string
+	expiry       time.Time
+}
+
+// GitHub returns an HTTP for the public keys of GitHub users, whose
+// usernames must be those of the proxy.
+func GitHub() *HTTP {
+	return &HTTP{URL: "https://github.com/{user}.keys", TTL: 5 * time.Minute}
+}
+
+// GitLab returns an HTTP for the public keys of the users of the GitLab
+// instance at baseURL, such as "https://gitlab.com".
+func GitLab(baseURL string) *HTTP {
+	return &HTTP{URL: strings.TrimRight(baseURL, "/") + "/{user}.keys", TTL: 5 * time.Minute}
+}
+
+func (h *HTTP) maxStale() time.Duration {
+	if h.MaxStale == 0 {
+		return DefaultMaxStale
+	}
+	if h.MaxStale < 0 {
+		return 0
+	}
+	return h.MaxStale
+}
+
+func (h *HTTP) now() time.Time {
+	if h.Clock != nil {
+		return h.Clock()
+	}
+	return time.Now()
+}
+
+// AuthorizedKeys implements Source.
+func (h *HTTP) AuthorizedKeys(ctx context.Context, username string) ([]byte, error) {
+	h.mu.Lock()
+	cached := h.cache[username]
+	h.mu.Unlock()
+	if cached != nil && h.now().Before(cached.expiry) {
+		return cached.keys, nil
+	}
+
+	fetched, err := h.fetch(ctx, username, cached)
+	if err == ErrUnknownUser || err == errDenied {
+		h.mu.Lock()
+		delete(h.cache, username)
+		h.mu.Unlock()
+		return nil, err
+	}
+	if err != nil {
+		if cached != nil && h.now().Before(cached.expiry.Add(h.maxStale())) {
+			return cached.keys, nil
+		}
+		return nil, err
+	}
+	h.mu.Lock()
+	if h.cache == nil {
+		h.cache = make(map[string]*cachedKeys)
+	}
+	h.cache[username] = fetched
+	h.mu.Unlock()
+	return fetched.keys, nil
+}
+
+// fetch requests the keys of username, revalidating cached if set.
+func (h *HTTP) fetch(ctx context.Context, username string, cached *cachedKeys) (*cachedKeys, error) {
+	req, err := http.NewRequest("GET", strings.Replace(h.URL, "{user}", url.PathEscape(username), -1), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range h.Header {
+		req.Header[k] = v
+	}
+	if cached != nil {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+
+	hc := h.HTTPClient
+	if hc == nil {
+		hc = defaultHTTPClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	expiry := h.now().Add(h.TTL)
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		return &cachedKeys{keys: cached.keys, etag: cached.etag, lastModified: cached.lastModified, expiry: expiry}, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return nil, ErrUnknownUser
+	case resp.StatusCode == http.StatusForbidden:
+		return nil, errDenied
+	case resp.StatusCode/100 != 2:
+		return nil, fmt.Errorf("authkeys: %s: %s", req.URL.Host, resp.Status)
+	}
+	keys, err := io.ReadAll(io.LimitReader(resp.Body, maxKeysSize))
+	if err != nil {
+		return nil, err
+	}
+	return &cachedKeys{
+		keys:         keys,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		expiry:       expiry,
+	}, nil
+}
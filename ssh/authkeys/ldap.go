@@ -0,0 +1,420 @@
+package authkeys
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// LDAP looks up authorized keys in the entries of users in an LDAP
+// directory, by default in the sshPublicKey attribute of the
+// ldapPublicKey schema of OpenSSH-LPK. Each lookup opens a connection, so
+// keys are never stale; ssh.ProxyConfig.BackendState can cache them.
+type LDAP struct {
+	// Addr is the address of the server, such as "ldap.example.com:636".
+	Addr string
+
+	// TLSConfig, if set, makes connections use TLS (LDAPS) with it.
+	TLSConfig *tls.Config
+
+	// BindDN and BindPassword authenticate the searches with a simple
+	// bind. If BindDN is empty, searches are anonymous.
+	BindDN       string
+	BindPassword string
+
+	// BaseDN is searched for users, such as "ou=people,dc=example,dc=com".
+	BaseDN string
+
+	// UserAttribute holds the username. If empty, "uid" is used.
+	UserAttribute string
+
+	// ObjectClass, if set, is required of the entries of users, such as
+	// "ldapPublicKey".
+	ObjectClass string
+
+	// KeyAttribute holds the keys. If empty, "sshPublicKey" is used.
+	KeyAttribute string
+
+	// Timeout limits each lookup. If zero, 10 seconds are used.
+	Timeout time.Duration
+
+	// Dial, if set, connects to Addr in place of a net.Dialer.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// LDAPError is a result other than success returned by the server.
+type LDAPError struct {
+	Op         string
+	ResultCode int
+	Message    string
+}
+
+func (e *LDAPError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("authkeys: ldap %s: result code %d", e.Op, e.ResultCode)
+	}
+	return fmt.Sprintf("authkeys: ldap %s: result code %d: %s", e.Op, e.ResultCode, e.Message)
+}
+
+var errMalformedLDAP = errors.New("authkeys: malformed ldap message")
+
+// Tags of the BER encoding of LDAP messages (RFC 4511).
+const (
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x30
+	tagSet         = 0x31
+
+	tagBindRequest       = 0x60
+	tagBindResponse      = 0x61
+	tagUnbindRequest     = 0x42
+	tagSearchRequest     = 0x63
+	tagSearchResultEntry = 0x64
+	tagSearchResultDone  = 0x65
+	tagSimpleAuth        = 0x80
+	tagFilterAnd         = 0xa0
+	tagFilterEquality    = 0xa3
+)
+
+const (
+	ldapSuccess          = 0
+	ldapNoSuchObject     = 32
+	scopeWholeSubtree    = 2
+	maxLDAPMessageSize   = 1 << 20
+	defaultLDAPTimeout   = 10 * time.Second
+	defaultUserAttribute = "uid"
+	defaultKeyAttribute  = "sshPublicKey"
+	// ldapSizeLimit is enough entries to tell that a search is ambiguous.
+	ldapSizeLimit = 2
+)
+
+// AuthorizedKeys implements Source.
+func (l *LDAP) AuthorizedKeys(ctx context.Context, username string) ([]byte, error) {
+	timeout := l.Timeout
+	if timeout <= 0 {
+		timeout = defaultLDAPTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	dial := l.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, "tcp", l.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if l.TLSConfig != nil {
+		config := l.TLSConfig
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName, _, _ = net.SplitHostPort(l.Addr)
+		}
+		conn = tls.Client(conn, config)
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	c := &ldapConn{conn: conn, r: bufio.NewReader(conn)}
+	if l.BindDN != "" {
+		if err := c.bind(l.BindDN, l.BindPassword); err != nil {
+			return nil, err
+		}
+	}
+	keys, err := c.search(l.BaseDN, l.filter(username), l.keyAttribute())
+	if err != nil {
+		return nil, err
+	}
+	c.unbind()
+	return keys, nil
+}
+
+func (l *LDAP) keyAttribute() string {
+	if l.KeyAttribute == "" {
+		return defaultKeyAttribute
+	}
+	return l.KeyAttribute
+}
+
+// filter returns the search filter for the entry of username.
+func (l *LDAP) filter(username string) []byte {
+	attr := l.UserAttribute
+	if attr == "" {
+		attr = defaultUserAttribute
+	}
+	user := ber(tagFilterEquality, ber(tagOctetString, []byte(attr)), ber(tagOctetString, []byte(username)))
+	if l.ObjectClass == "" {
+		return user
+	}
+	class := ber(tagFilterEquality, ber(tagOctetString, []byte("objectClass")), ber(tagOctetString, []byte(l.ObjectClass)))
+	return ber(tagFilterAnd, class, user)
+}
+
+// ldapConn is a connection to an LDAP server.
+type ldapConn struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	msgID int
+}
+
+// send sends op in a new message.
+func (c *ldapConn) send(op []byte) error {
+	c.msgID++
+	_, err := c.conn.Write(ber(tagSequence, berInt(tagInteger, c.msgID), op))
+	return err
+}
+
+// receive returns the tag and content of the operation of the next
+// message, which must answer the last one sent.
+func (c *ldapConn) receive() (byte, []byte, error) {
+	tag, msg, err := readBER(c.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if tag != tagSequence {
+		return 0, nil, errMalformedLDAP
+	}
+	tag, id, msg, err := parseBER(msg)
+	if err != nil || tag != tagInteger || parseInt(id) != c.msgID {
+		return 0, nil, errMalformedLDAP
+	}
+	tag, op, _, err := parseBER(msg)
+	if err != nil {
+		return 0, nil, err
+	}
+	return tag, op, nil
+}
+
+func (c *ldapConn) bind(dn, password string) error {
+	if err := c.send(ber(tagBindRequest, berInt(tagInteger, 3), ber(tagOctetString, []byte(dn)), ber(tagSimpleAuth, []byte(password)))); err != nil {
+		return err
+	}
+	tag, op, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if tag != tagBindResponse {
+		return errMalformedLDAP
+	}
+	return checkResult("bind", op)
+}
+
+// search returns the values of attr of the only entry below base that
+// matches filter, one per line.
+func (c *ldapConn) search(base string, filter []byte, attr string) ([]byte, error) {
+	if err := c.send(ber(tagSearchRequest,
+		ber(tagOctetString, []byte(base)),
+		berInt(tagEnumerated, scopeWholeSubtree),
+		berInt(tagEnumerated, 0), // never dereference aliases
+		berInt(tagInteger, ldapSizeLimit),
+		berInt(tagInteger, 0),
+		ber(tagBoolean, []byte{0}),
+		filter,
+		ber(tagSequence, ber(tagOctetString, []byte(attr))),
+	)); err != nil {
+		return nil, err
+	}
+	var keys bytes.Buffer
+	entries := 0
+	for {
+		tag, op, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case tagSearchResultEntry:
+			entries++
+			values, err := parseEntry(op, attr)
+			if err != nil {
+				return nil, err
+			}
+			for _, v := range values {
+				keys.Write(bytes.TrimSpace(v))
+				keys.WriteByte('\n')
+			}
+		case tagSearchResultDone:
+			if entries > 1 {
+				return nil, errors.New("authkeys: ldap search matched several entries")
+			}
+			if err := checkResult("search", op); err != nil {
+				if e, ok := err.(*LDAPError); ok && e.ResultCode == ldapNoSuchObject {
+					return nil, ErrUnknownUser
+				}
+				return nil, err
+			}
+			if entries == 0 {
+				return nil, ErrUnknownUser
+			}
+			return keys.Bytes(), nil
+		}
+		// Search result references are not followed.
+	}
+}
+
+func (c *ldapConn) unbind() {
+	c.send(ber(tagUnbindRequest))
+}
+
+// checkResult returns an LDAPError unless the LDAPResult in op reports
+// success.
+func checkResult(name string, op []byte) error {
+	tag, code, rest, err := parseBER(op)
+	if err != nil || tag != tagEnumerated {
+		return errMalformedLDAP
+	}
+	if parseInt(code) == ldapSuccess {
+		return nil
+	}
+	e := &LDAPError{Op: name, ResultCode: parseInt(code)}
+	if _, _, rest, err = parseBER(rest); err == nil {
+		if _, msg, _, err := parseBER(rest); err == nil {
+			e.Message = string(msg)
+		}
+	}
+	return e
+}
+
+// parseEntry returns the values of attr in the SearchResultEntry op.
+func parseEntry(op []byte, attr string) ([][]byte, error) {
+	_, _, rest, err := parseBER(op)
+	if err != nil {
+		return nil, err
+	}
+	tag, attrs, _, err := parseBER(rest)
+	if err != nil || tag != tagSequence {
+		return nil, errMalformedLDAP
+	}
+	for len(attrs) > 0 {
+		var a []byte
+		if tag, a, attrs, err = parseBER(attrs); err != nil || tag != tagSequence {
+			return nil, errMalformedLDAP
+		}
+		_, name, a, err := parseBER(a)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.EqualFold(string(name), attr) {
+			continue
+		}
+		_, set, _, err := parseBER(a)
+		if err != nil {
+			return nil, err
+		}
+		var values [][]byte
+		for len(set) > 0 {
+			var v []byte
+			if _, v, set, err = parseBER(set); err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	}
+	return nil, nil
+}
+
+// ber returns the encoding of the elements in contents with tag.
+func ber(tag byte, contents ...[]byte) []byte {
+	n := 0
+	for _, c := range contents {
+		n += len(c)
+	}
+	b := []byte{tag}
+	if n < 0x80 {
+		b = append(b, byte(n))
+	} else {
+		var l []byte
+		for m := n; m > 0; m >>= 8 {
+			l = append([]byte{byte(m)}, l...)
+		}
+		b = append(append(b, 0x80|byte(len(l))), l...)
+	}
+	for _, c := range contents {
+		b = append(b, c...)
+	}
+	return b
+}
+
+// berInt returns the encoding of the non-negative n with tag.
+func berInt(tag byte, n int) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(n)}, b...)
+		n >>= 8
+		if n == 0 {
+			break
+		}
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return ber(tag, b)
+}
+
+func parseInt(b []byte) int {
+	n := 0
+	for _, c := range b {
+		n = n<<8 | int(c)
+	}
+	return n
+}
+
+// parseBER splits the first element off b. Lengths may use more bytes
+// than needed, as some servers send.
+func parseBER(b []byte) (tag byte, content, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errMalformedLDAP
+	}
+	tag, n, b := b[0], int(b[1]), b[2:]
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 4 || len(b) < size {
+			return 0, nil, nil, errMalformedLDAP
+		}
+		n = parseInt(b[:size])
+		b = b[size:]
+	}
+	if n > len(b) {
+		return 0, nil, nil, errMalformedLDAP
+	}
+	return tag, b[:n], b[n:], nil
+}
+
+// readBER reads an element from r.
+func readBER(r *bufio.Reader) (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(head[1])
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 4 {
+			return 0, nil, errMalformedLDAP
+		}
+		l := make([]byte, size)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return 0, nil, err
+		}
+		n = parseInt(l)
+	}
+	if n > maxLDAPMessageSize {
+		return 0, nil, errMalformedLDAP
+	}
+	content := make([]byte, n)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return 0, nil, err
+	}
+	return head[0], content, nil
+}
@@ -0,0 +1,117 @@
+package authkeys
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+// fakeLDAP serves binds and searches for the uid of alice, who has two
+// keys, on one connection.
+type fakeLDAP struct {
+	dn     string
+	filter []byte
+}
+
+func (f *fakeLDAP) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		tag, msg, err := readBER(r)
+		if err != nil || tag != tagSequence {
+			return
+		}
+		_, id, msg, _ := parseBER(msg)
+		tag, op, _, _ := parseBER(msg)
+		reply := func(ops ...[]byte) {
+			for _, op := range ops {
+				c.Write(ber(tagSequence, ber(tagInteger, id), op))
+			}
+		}
+		result := func(tag byte, code int) []byte {
+			return ber(tag, berInt(tagEnumerated, code), ber(tagOctetString), ber(tagOctetString))
+		}
+		switch tag {
+		case tagBindRequest:
+			_, _, rest, _ := parseBER(op)
+			_, dn, rest, _ := parseBER(rest)
+			_, password, _, _ := parseBER(rest)
+			f.dn = string(dn)
+			if string(password) != "secret" {
+				reply(result(tagBindResponse, 49))
+				continue
+			}
+			reply(result(tagBindResponse, ldapSuccess))
+		case tagSearchRequest:
+			// The filter follows six fields.
+			f.filter = op
+			for i := 0; i < 6; i++ {
+				_, _, f.filter, _ = parseBER(f.filter)
+			}
+			if !containsBytes(f.filter, "alice") {
+				reply(result(tagSearchResultDone, ldapSuccess))
+				continue
+			}
+			entry := ber(tagSearchResultEntry,
+				ber(tagOctetString, []byte("uid=alice,ou=people,dc=example,dc=com")),
+				ber(tagSequence, ber(tagSequence,
+					ber(tagOctetString, []byte("sshPublicKey")),
+					ber(tagSet, ber(tagOctetString, []byte("ssh-ed25519 AAAA1 alice@laptop")), ber(tagOctetString, []byte("ssh-rsa AAAA2 alice@desktop\n"))),
+				)),
+			)
+			reply(entry, result(tagSearchResultDone, ldapSuccess))
+		case tagUnbindRequest:
+			return
+		}
+	}
+}
+
+func containsBytes(b []byte, s string) bool {
+	for i := 0; i+len(s) <= len(b); i++ {
+		if string(b[i:i+len(s)]) == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLDAP(t *testing.T) {
+	f := &fakeLDAP{}
+	l := &LDAP{
+		BindDN:       "cn=proxy,dc=example,dc=com",
+		BindPassword: "secret",
+		BaseDN:       "ou=people,dc=example,dc=com",
+		ObjectClass:  "ldapPublicKey",
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c1, c2 := net.Pipe()
+			go f.serve(c2)
+			return c1, nil
+		},
+	}
+
+	keys, err := l.AuthorizedKeys(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "ssh-ed25519 AAAA1 alice@laptop\nssh-rsa AAAA2 alice@desktop\n"; string(keys) != want {
+		t.Errorf("got keys %q, want %q", keys, want)
+	}
+	if f.dn != l.BindDN {
+		t.Errorf("bound as %q, want %q", f.dn, l.BindDN)
+	}
+	if tag, _, _, _ := parseBER(f.filter); tag != tagFilterAnd || !containsBytes(f.filter, "ldapPublicKey") {
+		t.Errorf("got filter %x, want objectClass and uid", f.filter)
+	}
+
+	if _, err := l.AuthorizedKeys(context.Background(), "bob"); err != ErrUnknownUser {
+		t.Errorf("got %v for an unknown user, want ErrUnknownUser", err)
+	}
+
+	l.BindPassword = "wrong"
+	var ldapErr *LDAPError
+	if _, err := l.AuthorizedKeys(context.Background(), "alice"); !errors.As(err, &ldapErr) || ldapErr.ResultCode != 49 {
+		t.Errorf("got %v for a wrong password, want result code 49", err)
+	}
+}
@@ -29,6 +29,15 @@ func (c *connection) clientAuthenticate(config *ClientConfig) error {
 	if err != nil {
 		return err
 	}
+	// The server may send SSH_MSG_EXT_INFO first, since we opted in to it.
+	if packet[0] == msgExtInfo {
+		if _, err := parseExtInfo(packet); err != nil {
+			return err
+		}
+		if packet, err = c.transport.readPacket(); err != nil {
+			return err
+		}
+	}
 	var serviceAccept serviceAcceptMsg
 	if err := Unmarshal(packet, &serviceAccept); err != nil {
 		return err
@@ -12,6 +12,7 @@ import (
 	"log"
 	"net"
 	"sync"
+	"time"
 )
 
 // debugHandshake, if set, prints messages sent and received.  Key
@@ -57,6 +58,8 @@ type handshakeTransport struct {
 	// On read error, incoming is closed, and readError is set.
 	incoming  chan []byte
 	readError error
+	// readDone is closed when the read loop exits.
+	readDone chan struct{}
 
 	mu             sync.Mutex
 	writeError     error
@@ -92,6 +95,10 @@ type handshakeTransport struct {
 	writePacketsLeft uint32
 	writeBytesLeft   int64
 
+	// rekeyTimer requests a key exchange once config.RekeyInterval has
+	// passed since the last one. It is only used by kexLoop.
+	rekeyTimer *time.Timer
+
 	// The session ID or nil if first kex did not complete yet.
 	sessionID []byte
 }
@@ -107,6 +114,7 @@ func newHandshakeTransport(conn keyingTransport, config *Config, clientVersion,
 		serverVersion: serverVersion,
 		clientVersion: clientVersion,
 		incoming:      make(chan []byte, chanSize),
+		readDone:      make(chan struct{}),
 		requestKex:    make(chan struct{}, 1),
 		startKex:      make(chan *pendingKex, 1),
 
@@ -139,6 +147,7 @@ func newClientTransport(conn keyingTransport, clientVersion, serverVersion []byt
 func newServerTransport(conn keyingTransport, clientVersion, serverVersion []byte, config *ServerConfig) *handshakeTransport {
 	t := newHandshakeTransport(conn, &config.Config, clientVersion, serverVersion)
 	t.hostKeys = config.hostKeys
+	t.hostKeyAlgorithms = config.HostKeyAlgorithms
 	go t.readLoop()
 	go t.kexLoop()
 	return t
@@ -207,6 +216,8 @@ func (t *handshakeTransport) readLoop() {
 		t.incoming <- p
 	}
 
+	close(t.readDone)
+
 	// Stop writers too.
 	t.recordWriteError(t.readError)
 
@@ -256,6 +267,17 @@ func (t *handshakeTransport) resetWriteThresholds() {
 	}
 }
 
+func (t *handshakeTransport) resetRekeyTimer() {
+	if t.config.RekeyInterval <= 0 {
+		return
+	}
+	if t.rekeyTimer == nil {
+		t.rekeyTimer = time.AfterFunc(t.config.RekeyInterval, t.requestKeyExchange)
+		return
+	}
+	t.rekeyTimer.Reset(t.config.RekeyInterval)
+}
+
 func (t *handshakeTransport) kexLoop() {
 
 write:
@@ -306,6 +328,7 @@ write:
 		t.sentInitMsg = nil
 
 		t.resetWriteThresholds()
+		t.resetRekeyTimer()
 
 		// we have completed the key exchange. Since the
 		// reader is still blocked, it is safe to clear out
@@ -340,6 +363,10 @@ write:
 		t.mu.Unlock()
 	}
 
+	if t.rekeyTimer != nil {
+		t.rekeyTimer.Stop()
+	}
+
 	// drain startKex channel. We don't service t.requestKex
 	// because nobody does blocking sends there.
 	go func() {
@@ -433,6 +460,27 @@ func (t *handshakeTransport) readOnePacket(first bool) ([]byte, error) {
 }
 
 // sendKexInit sends a key change message.
+// serverHostKeyAlgos returns the host key algorithms a server announces for
+// its host keys, restricted to allowed unless that is nil.
+func serverHostKeyAlgos(hostKeys []Signer, allowed []string) []string {
+	var algos []string
+	for _, k := range hostKeys {
+		keyAlgos := []string{k.PublicKey().Type()}
+		switch keyAlgos[0] {
+		case KeyAlgoRSA:
+			keyAlgos = []string{SigAlgoRSASHA2512, SigAlgoRSASHA2256, SigAlgoRSA}
+		case CertAlgoRSAv01:
+			keyAlgos = []string{CertSigAlgoRSASHA2512v01, CertSigAlgoRSASHA2256v01, CertSigAlgoRSAv01}
+		}
+		for _, algo := range keyAlgos {
+			if allowed == nil || contains(allowed, algo) {
+				algos = append(algos, algo)
+			}
+		}
+	}
+	return algos
+}
+
 func (t *handshakeTransport) sendKexInit() error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -455,18 +503,18 @@ func (t *handshakeTransport) sendKexInit() error {
 	}
 	io.ReadFull(rand.Reader, msg.Cookie[:])
 
-	if len(t.hostKeys) > 0 {
-		for _, k := range t.hostKeys {
-			algo := k.PublicKey().Type()
-			switch algo {
-			case KeyAlgoRSA:
-				msg.ServerHostKeyAlgos = append(msg.ServerHostKeyAlgos, []string{SigAlgoRSASHA2512, SigAlgoRSASHA2256, SigAlgoRSA}...)
-			case CertAlgoRSAv01:
-				msg.ServerHostKeyAlgos = append(msg.ServerHostKeyAlgos, []string{CertSigAlgoRSASHA2512v01, CertSigAlgoRSASHA2256v01, CertSigAlgoRSAv01}...)
-			default:
-				msg.ServerHostKeyAlgos = append(msg.ServerHostKeyAlgos, algo)
-			}
-		}
+	isClient := len(t.hostKeys) == 0
+	if isClient && t.sessionID == nil {
+		// Opt in to SSH_MSG_EXT_INFO, so the server tells which signature
+		// algorithms it accepts for public key authentication. See RFC 8308,
+		// section 2.1.
+		msg.KexAlgos = make([]string, 0, len(t.config.KeyExchanges)+1)
+		msg.KexAlgos = append(msg.KexAlgos, t.config.KeyExchanges...)
+		msg.KexAlgos = append(msg.KexAlgos, extInfoClient)
+	}
+
+	if !isClient {
+		msg.ServerHostKeyAlgos = serverHostKeyAlgos(t.hostKeys, t.hostKeyAlgorithms)
 	} else {
 		msg.ServerHostKeyAlgos = t.hostKeyAlgorithms
 	}
@@ -531,6 +579,14 @@ func (t *handshakeTransport) Close() error {
 	return t.conn.Close()
 }
 
+// negotiatedAlgorithms returns the algorithms agreed in the last key
+// exchange, or nil before the first one completed.
+func (t *handshakeTransport) negotiatedAlgorithms() *algorithms {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.algorithms
+}
+
 func (t *handshakeTransport) enterKeyExchange(otherInitPacket []byte) error {
 	if debugHandshake {
 		log.Printf("%s entered key exchange", t.id())
@@ -558,11 +614,13 @@ func (t *handshakeTransport) enterKeyExchange(otherInitPacket []byte) error {
 		magics.serverKexInit = otherInitPacket
 	}
 
-	var err error
-	t.algorithms, err = findAgreedAlgorithms(isClient, clientInit, serverInit)
+	algs, err := findAgreedAlgorithms(isClient, clientInit, serverInit)
 	if err != nil {
 		return err
 	}
+	t.mu.Lock()
+	t.algorithms = algs
+	t.mu.Unlock()
 
 	// We don't send FirstKexFollows, but we handle receiving it.
 	//
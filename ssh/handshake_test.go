@@ -16,6 +16,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 type testChecker struct {
@@ -307,6 +308,28 @@ func TestHandshakeAutoRekeyWrite(t *testing.T) {
 	<-done
 }
 
+func TestHandshakeRekeyInterval(t *testing.T) {
+	checker := &syncChecker{called: make(chan int, 10)}
+	clientConf := &ClientConfig{HostKeyCallback: checker.Check}
+	clientConf.RekeyInterval = 10 * time.Millisecond
+	trC, trS, err := handshakePair(clientConf, "addr", false)
+	if err != nil {
+		t.Fatalf("handshakePair: %v", err)
+	}
+	defer trC.Close()
+	defer trS.Close()
+
+	// The first call is for the initial kex; the idle connection then
+	// has to rekey by itself.
+	for i := 0; i < 3; i++ {
+		select {
+		case <-checker.called:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("got %d key exchanges, want 3", i)
+		}
+	}
+}
+
 type syncChecker struct {
 	waitCall chan int
 	called   chan int
@@ -0,0 +1,686 @@
+// Package sntrup761 implements the Streamlined NTRU Prime 761 key
+// encapsulation mechanism, as used by the sntrup761x25519-sha512@openssh.com
+// key exchange.
+//
+// It is a port of the public domain reference implementation from SUPERCOP
+// that OpenSSH ships in sntrup761.c, and keeps its structure and names, but
+// reduces products less often. The arithmetic avoids data dependent branches
+// and table lookups.
+//
+// See https://ntruprime.cr.yp.to/.
+package sntrup761
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	p   = 761
+	q   = 4591
+	w   = 286
+	q12 = (q - 1) / 2
+
+	hashBytes    = 32
+	smallBytes   = (p + 3) / 4
+	rqBytes      = 1158
+	roundedBytes = 1007
+	inputsBytes  = smallBytes
+
+	// PublicKeySize is the size of an encoded public key.
+	PublicKeySize = rqBytes
+	// PrivateKeySize is the size of an encoded private key, which also
+	// holds the public key.
+	PrivateKeySize = 2*smallBytes + PublicKeySize + inputsBytes + hashBytes
+	// CiphertextSize is the size of an encapsulated key.
+	CiphertextSize = roundedBytes + hashBytes
+	// SharedKeySize is the size of the shared key.
+	SharedKeySize = hashBytes
+)
+
+var (
+	errPublicKeySize  = errors.New("sntrup761: invalid public key size")
+	errPrivateKeySize = errors.New("sntrup761: invalid private key size")
+	errCiphertextSize = errors.New("sntrup761: invalid ciphertext size")
+)
+
+// small is an element of F3 in {-1, 0, 1}, Fq an element of Fq in
+// {-q12, ..., q12}.
+type (
+	small = int8
+	fq    = int16
+)
+
+// uint32DivmodUint14 returns x/m and x%m for 0 < m < 16384 in constant time.
+func uint32DivmodUint14(x uint32, m uint16) (uint32, uint16) {
+	v := uint32(0x80000000) / uint32(m)
+	var quot uint32
+
+	qpart := uint32((uint64(x) * uint64(v)) >> 31)
+	x -= qpart * uint32(m)
+	quot += qpart
+
+	qpart = uint32((uint64(x) * uint64(v)) >> 31)
+	x -= qpart * uint32(m)
+	quot += qpart
+
+	x -= uint32(m)
+	quot++
+	mask := -(x >> 31)
+	x += mask & uint32(m)
+	quot += mask
+
+	return quot, uint16(x)
+}
+
+func uint32ModUint14(x uint32, m uint16) uint16 {
+	_, r := uint32DivmodUint14(x, m)
+	return r
+}
+
+// int16NonzeroMask returns 0 if x is 0, else -1.
+func int16NonzeroMask(x int16) int {
+	v := uint32(uint16(x))
+	v = -v
+	v >>= 31
+	return -int(v)
+}
+
+// int16NegativeMask returns -1 if x is negative, else 0.
+func int16NegativeMask(x int16) int {
+	return -int(uint16(x) >> 15)
+}
+
+// fqFreeze reduces x, with |x| < 2^25, to Fq. The compiler turns divisions
+// by constants into multiplications, which take constant time.
+func fqFreeze(x int32) fq {
+	return fq(int32(uint32(x+q12+q<<13)%q) - q12)
+}
+
+// f3Freeze reduces x, with |x| < 2^25, to F3.
+func f3Freeze(x int32) small {
+	return small(int32(uint32(x+1+3<<24)%3) - 1)
+}
+
+// fqRecip returns 1/a1 in Fq.
+func fqRecip(a1 fq) fq {
+	ai := a1
+	for i := 1; i < q-2; i++ {
+		ai = fqFreeze(int32(a1) * int32(ai))
+	}
+	return ai
+}
+
+// minmax orders a and b in constant time.
+func minmax(a, b *uint32) {
+	d := (int64(*b) - int64(*a)) >> 63
+	c := uint32(d) & (*a ^ *b)
+	*a ^= c
+	*b ^= c
+}
+
+// sortUint32 sorts x with Batcher's merge exchange network, whose sequence of
+// comparisons only depends on the length of x (Knuth, TAOCP 5.2.2,
+// algorithm M).
+func sortUint32(x []uint32) {
+	n := len(x)
+	if n < 2 {
+		return
+	}
+	t := 1
+	for 1<<t < n {
+		t++
+	}
+	for pp := 1 << (t - 1); pp > 0; pp >>= 1 {
+		qq, r, d := 1<<(t-1), 0, pp
+		for {
+			for i := 0; i < n-d; i++ {
+				if i&pp == r {
+					minmax(&x[i], &x[i+d])
+				}
+			}
+			if qq == pp {
+				break
+			}
+			d, qq, r = qq-pp, qq>>1, pp
+		}
+	}
+}
+
+// r3Mult returns f*g in R3 = F3[x]/(x^p-x-1). Unlike the reference code, the
+// products are summed before they are reduced; the sums fit in an int32.
+func r3Mult(f, g *[p]small) (h [p]small) {
+	var fg [p + p - 1]small
+	for i := 0; i < p; i++ {
+		var result int32
+		for j := 0; j <= i; j++ {
+			result += int32(f[j]) * int32(g[i-j])
+		}
+		fg[i] = f3Freeze(result)
+	}
+	for i := p; i < p+p-1; i++ {
+		var result int32
+		for j := i - p + 1; j < p; j++ {
+			result += int32(f[j]) * int32(g[i-j])
+		}
+		fg[i] = f3Freeze(result)
+	}
+	for i := p + p - 2; i >= p; i-- {
+		fg[i-p] = f3Freeze(int32(fg[i-p]) + int32(fg[i]))
+		fg[i-p+1] = f3Freeze(int32(fg[i-p+1]) + int32(fg[i]))
+	}
+	copy(h[:], fg[:p])
+	return h
+}
+
+// r3Recip sets out to 1/in in R3. It returns 0 on success, else -1.
+func r3Recip(out, in *[p]small) int {
+	var f, g, v, r [p + 1]small
+	r[0] = 1
+	f[0] = 1
+	f[p-1], f[p] = -1, -1
+	for i := 0; i < p; i++ {
+		g[p-1-i] = in[i]
+	}
+
+	delta := 1
+	for loop := 0; loop < 2*p-1; loop++ {
+		for i := p; i > 0; i-- {
+			v[i] = v[i-1]
+		}
+		v[0] = 0
+
+		sign := -int(g[0]) * int(f[0])
+		swap := int16NegativeMask(int16(-delta)) & int16NonzeroMask(int16(g[0]))
+		delta ^= swap & (delta ^ -delta)
+		delta++
+
+		for i := 0; i < p+1; i++ {
+			t := small(swap) & (f[i] ^ g[i])
+			f[i] ^= t
+			g[i] ^= t
+			t = small(swap) & (v[i] ^ r[i])
+			v[i] ^= t
+			r[i] ^= t
+		}
+
+		for i := 0; i < p+1; i++ {
+			g[i] = f3Freeze(int32(g[i]) + int32(sign)*int32(f[i]))
+		}
+		for i := 0; i < p+1; i++ {
+			r[i] = f3Freeze(int32(r[i]) + int32(sign)*int32(v[i]))
+		}
+
+		for i := 0; i < p; i++ {
+			g[i] = g[i+1]
+		}
+		g[p] = 0
+	}
+
+	sign := f[0]
+	for i := 0; i < p; i++ {
+		out[i] = sign * v[p-1-i]
+	}
+	return int16NonzeroMask(int16(delta))
+}
+
+// rqMultSmall returns f*g in Rq = Fq[x]/(x^p-x-1).
+func rqMultSmall(f *[p]fq, g *[p]small) (h [p]fq) {
+	var fg [p + p - 1]fq
+	for i := 0; i < p; i++ {
+		var result int32
+		for j := 0; j <= i; j++ {
+			result += int32(f[j]) * int32(g[i-j])
+		}
+		fg[i] = fqFreeze(result)
+	}
+	for i := p; i < p+p-1; i++ {
+		var result int32
+		for j := i - p + 1; j < p; j++ {
+			result += int32(f[j]) * int32(g[i-j])
+		}
+		fg[i] = fqFreeze(result)
+	}
+	for i := p + p - 2; i >= p; i-- {
+		fg[i-p] = fqFreeze(int32(fg[i-p]) + int32(fg[i]))
+		fg[i-p+1] = fqFreeze(int32(fg[i-p+1]) + int32(fg[i]))
+	}
+	copy(h[:], fg[:p])
+	return h
+}
+
+// rqMult3 returns 3f in Rq.
+func rqMult3(f *[p]fq) (h [p]fq) {
+	for i := 0; i < p; i++ {
+		h[i] = fqFreeze(3 * int32(f[i]))
+	}
+	return h
+}
+
+// rqRecip3 sets out to 1/(3*in) in Rq. It returns 0 on success, else -1.
+func rqRecip3(out *[p]fq, in *[p]small) int {
+	var f, g, v, r [p + 1]fq
+	r[0] = fqRecip(3)
+	f[0] = 1
+	f[p-1], f[p] = -1, -1
+	for i := 0; i < p; i++ {
+		g[p-1-i] = fq(in[i])
+	}
+
+	delta := 1
+	for loop := 0; loop < 2*p-1; loop++ {
+		for i := p; i > 0; i-- {
+			v[i] = v[i-1]
+		}
+		v[0] = 0
+
+		swap := int16NegativeMask(int16(-delta)) & int16NonzeroMask(g[0])
+		delta ^= swap & (delta ^ -delta)
+		delta++
+
+		for i := 0; i < p+1; i++ {
+			t := fq(swap) & (f[i] ^ g[i])
+			f[i] ^= t
+			g[i] ^= t
+			t = fq(swap) & (v[i] ^ r[i])
+			v[i] ^= t
+			r[i] ^= t
+		}
+
+		f0, g0 := int32(f[0]), int32(g[0])
+		for i := 0; i < p+1; i++ {
+			g[i] = fqFreeze(f0*int32(g[i]) - g0*int32(f[i]))
+		}
+		for i := 0; i < p+1; i++ {
+			r[i] = fqFreeze(f0*int32(r[i]) - g0*int32(v[i]))
+		}
+
+		for i := 0; i < p; i++ {
+			g[i] = g[i+1]
+		}
+		g[p] = 0
+	}
+
+	scale := fqRecip(f[0])
+	for i := 0; i < p; i++ {
+		out[i] = fqFreeze(int32(scale) * int32(v[p-1-i]))
+	}
+	return int16NonzeroMask(int16(delta))
+}
+
+// round rounds every coefficient of a to the nearest multiple of 3.
+func round(a *[p]fq) (out [p]fq) {
+	for i := 0; i < p; i++ {
+		out[i] = a[i] - fq(f3Freeze(int32(a[i])))
+	}
+	return out
+}
+
+// encode writes R, with 0 <= R[i] < M[i] < 16384, to out and returns the
+// remainder of out.
+func encode(out []byte, R, M []uint16) []byte {
+	if len(R) == 1 {
+		r, m := R[0], M[0]
+		for m > 1 {
+			out[0] = byte(r)
+			out = out[1:]
+			r >>= 8
+			m = (m + 255) >> 8
+		}
+		return out
+	}
+	R2 := make([]uint16, (len(R)+1)/2)
+	M2 := make([]uint16, (len(R)+1)/2)
+	i := 0
+	for ; i < len(R)-1; i += 2 {
+		m0 := uint32(M[i])
+		r := uint32(R[i]) + uint32(R[i+1])*m0
+		m := uint32(M[i+1]) * m0
+		for m >= 16384 {
+			out[0] = byte(r)
+			out = out[1:]
+			r >>= 8
+			m = (m + 255) >> 8
+		}
+		R2[i/2] = uint16(r)
+		M2[i/2] = uint16(m)
+	}
+	if i < len(R) {
+		R2[i/2] = R[i]
+		M2[i/2] = M[i]
+	}
+	return encode(out, R2, M2)
+}
+
+// decode reads len(out) values with out[i] < M[i] from S and returns the
+// remainder of S.
+func decode(out []uint16, S []byte, M []uint16) []byte {
+	n := len(out)
+	if n == 1 {
+		switch {
+		case M[0] == 1:
+			out[0] = 0
+		case M[0] <= 256:
+			out[0] = uint32ModUint14(uint32(S[0]), M[0])
+			S = S[1:]
+		default:
+			out[0] = uint32ModUint14(uint32(S[0])+uint32(S[1])<<8, M[0])
+			S = S[2:]
+		}
+		return S
+	}
+	R2 := make([]uint16, (n+1)/2)
+	M2 := make([]uint16, (n+1)/2)
+	bottomr := make([]uint16, n/2)
+	bottomt := make([]uint32, n/2)
+	i := 0
+	for ; i < n-1; i += 2 {
+		m := uint32(M[i]) * uint32(M[i+1])
+		switch {
+		case m > 256*16383:
+			bottomt[i/2] = 256 * 256
+			bottomr[i/2] = uint16(S[0]) + 256*uint16(S[1])
+			S = S[2:]
+			M2[i/2] = uint16((((m + 255) >> 8) + 255) >> 8)
+		case m >= 16384:
+			bottomt[i/2] = 256
+			bottomr[i/2] = uint16(S[0])
+			S = S[1:]
+			M2[i/2] = uint16((m + 255) >> 8)
+		default:
+			bottomt[i/2] = 1
+			bottomr[i/2] = 0
+			M2[i/2] = uint16(m)
+		}
+	}
+	if i < n {
+		M2[i/2] = M[i]
+	}
+	S = decode(R2, S, M2)
+	for i = 0; i < n-1; i += 2 {
+		r := uint32(bottomr[i/2]) + bottomt[i/2]*uint32(R2[i/2])
+		r1, r0 := uint32DivmodUint14(r, M[i])
+		out[i] = r0
+		out[i+1] = uint32ModUint14(r1, M[i+1]) // only needed for invalid inputs
+	}
+	if i < n {
+		out[i] = R2[i/2]
+	}
+	return S
+}
+
+func smallEncode(s []byte, f *[p]small) {
+	for i := 0; i < p/4; i++ {
+		x := f[4*i] + 1
+		x += (f[4*i+1] + 1) << 2
+		x += (f[4*i+2] + 1) << 4
+		x += (f[4*i+3] + 1) << 6
+		s[i] = byte(x)
+	}
+	s[p/4] = byte(f[p-1] + 1)
+}
+
+func smallDecode(f *[p]small, s []byte) {
+	for i := 0; i < p/4; i++ {
+		x := s[i]
+		f[4*i] = small(x&3) - 1
+		x >>= 2
+		f[4*i+1] = small(x&3) - 1
+		x >>= 2
+		f[4*i+2] = small(x&3) - 1
+		x >>= 2
+		f[4*i+3] = small(x&3) - 1
+	}
+	f[p-1] = small(s[p/4]&3) - 1
+}
+
+func rqEncode(s []byte, r *[p]fq) {
+	var R, M [p]uint16
+	for i := 0; i < p; i++ {
+		R[i] = uint16(r[i] + q12)
+		M[i] = q
+	}
+	encode(s, R[:], M[:])
+}
+
+func rqDecode(r *[p]fq, s []byte) {
+	var R, M [p]uint16
+	for i := 0; i < p; i++ {
+		M[i] = q
+	}
+	decode(R[:], s, M[:])
+	for i := 0; i < p; i++ {
+		r[i] = fq(R[i]) - q12
+	}
+}
+
+func roundedEncode(s []byte, r *[p]fq) {
+	var R, M [p]uint16
+	for i := 0; i < p; i++ {
+		R[i] = uint16(((int32(r[i]) + q12) * 10923) >> 15)
+		M[i] = (q + 2) / 3
+	}
+	encode(s, R[:], M[:])
+}
+
+func roundedDecode(r *[p]fq, s []byte) {
+	var R, M [p]uint16
+	for i := 0; i < p; i++ {
+		M[i] = (q + 2) / 3
+	}
+	decode(R[:], s, M[:])
+	for i := 0; i < p; i++ {
+		r[i] = fq(R[i])*3 - q12
+	}
+}
+
+func urandom32(rand io.Reader) (uint32, error) {
+	var c [4]byte
+	if _, err := io.ReadFull(rand, c[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(c[:]), nil
+}
+
+// smallRandom returns a random element of R3.
+func smallRandom(rand io.Reader) (out [p]small, err error) {
+	for i := 0; i < p; i++ {
+		x, err := urandom32(rand)
+		if err != nil {
+			return out, err
+		}
+		out[i] = small(int32(((x&0x3fffffff)*3)>>30) - 1)
+	}
+	return out, nil
+}
+
+// shortRandom returns a random element of R3 with exactly w nonzero
+// coefficients.
+func shortRandom(rand io.Reader) (out [p]small, err error) {
+	var L [p]uint32
+	for i := 0; i < p; i++ {
+		if L[i], err = urandom32(rand); err != nil {
+			return out, err
+		}
+	}
+	for i := 0; i < w; i++ {
+		L[i] &= ^uint32(1)
+	}
+	for i := w; i < p; i++ {
+		L[i] = (L[i] & ^uint32(2)) | 1
+	}
+	sortUint32(L[:])
+	for i := 0; i < p; i++ {
+		out[i] = small(L[i]&3) - 1
+	}
+	return out, nil
+}
+
+// weightwMask returns 0 if r has weight w, else -1.
+func weightwMask(r *[p]small) int {
+	weight := 0
+	for i := 0; i < p; i++ {
+		weight += int(r[i] & 1)
+	}
+	return int16NonzeroMask(int16(weight - w))
+}
+
+// keyGen returns a public key h and the private key (f, 1/g).
+func keyGen(rand io.Reader) (h [p]fq, f, ginv [p]small, err error) {
+	var g [p]small
+	for {
+		if g, err = smallRandom(rand); err != nil {
+			return h, f, ginv, err
+		}
+		if r3Recip(&ginv, &g) == 0 {
+			break
+		}
+	}
+	if f, err = shortRandom(rand); err != nil {
+		return h, f, ginv, err
+	}
+	var finv [p]fq
+	rqRecip3(&finv, &f) // always works
+	return rqMultSmall(&finv, &g), f, ginv, nil
+}
+
+// encrypt returns the ciphertext of r under the public key h.
+func encrypt(r *[p]small, h *[p]fq) [p]fq {
+	hr := rqMultSmall(h, r)
+	return round(&hr)
+}
+
+// decrypt returns the plaintext of c under the private key (f, ginv).
+func decrypt(c *[p]fq, f, ginv *[p]small) (r [p]small) {
+	cf := rqMultSmall(c, f)
+	cf3 := rqMult3(&cf)
+	var e [p]small
+	for i := 0; i < p; i++ {
+		e[i] = f3Freeze(int32(cf3[i]))
+	}
+	ev := r3Mult(&e, ginv)
+
+	mask := small(weightwMask(&ev)) // 0 if weight w, else -1
+	for i := 0; i < w; i++ {
+		r[i] = ((ev[i] ^ 1) & ^mask) ^ 1
+	}
+	for i := w; i < p; i++ {
+		r[i] = ev[i] & ^mask
+	}
+	return r
+}
+
+// hashPrefix returns the first 32 bytes of SHA-512 of b followed by in.
+func hashPrefix(out []byte, b byte, in []byte) {
+	h := sha512.New()
+	h.Write([]byte{b})
+	h.Write(in)
+	copy(out, h.Sum(nil)[:hashBytes])
+}
+
+// hashConfirm returns the confirmation hash of the encoded input rEnc, for a
+// public key whose hash is cache.
+func hashConfirm(out, rEnc, cache []byte) {
+	var x [2 * hashBytes]byte
+	hashPrefix(x[:hashBytes], 3, rEnc)
+	copy(x[hashBytes:], cache)
+	hashPrefix(out, 2, x[:])
+}
+
+// hashSession returns the session key for the encoded input y and the
+// ciphertext z.
+func hashSession(b byte, y, z []byte) []byte {
+	var x [hashBytes + CiphertextSize]byte
+	hashPrefix(x[:hashBytes], 3, y)
+	copy(x[hashBytes:], z)
+	k := make([]byte, SharedKeySize)
+	hashPrefix(k, b, x[:])
+	return k
+}
+
+// hide encrypts r to the public key pk and appends the confirmation hash.
+func hide(c, rEnc []byte, r *[p]small, pk, cache []byte) {
+	smallEncode(rEnc, r)
+	var h [p]fq
+	rqDecode(&h, pk)
+	ct := encrypt(r, &h)
+	roundedEncode(c, &ct)
+	hashConfirm(c[roundedBytes:], rEnc, cache)
+}
+
+// GenerateKey returns a new key pair.
+func GenerateKey(rand io.Reader) (publicKey, privateKey []byte, err error) {
+	h, f, v, err := keyGen(rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	pk := make([]byte, PublicKeySize)
+	rqEncode(pk, &h)
+
+	sk := make([]byte, PrivateKeySize)
+	smallEncode(sk, &f)
+	smallEncode(sk[smallBytes:], &v)
+	rest := sk[2*smallBytes:]
+	copy(rest, pk)
+	rest = rest[PublicKeySize:]
+	if _, err := io.ReadFull(rand, rest[:inputsBytes]); err != nil {
+		return nil, nil, err
+	}
+	hashPrefix(rest[inputsBytes:], 4, pk)
+	return pk, sk, nil
+}
+
+// Encapsulate returns a random shared key and its ciphertext for publicKey.
+func Encapsulate(rand io.Reader, publicKey []byte) (ciphertext, sharedKey []byte, err error) {
+	if len(publicKey) != PublicKeySize {
+		return nil, nil, errPublicKeySize
+	}
+	var cache [hashBytes]byte
+	hashPrefix(cache[:], 4, publicKey)
+	r, err := shortRandom(rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	var rEnc [inputsBytes]byte
+	c := make([]byte, CiphertextSize)
+	hide(c, rEnc[:], &r, publicKey, cache[:])
+	return c, hashSession(1, rEnc[:], c), nil
+}
+
+// Decapsulate returns the shared key of ciphertext. A ciphertext that was not
+// made for privateKey yields an unrelated key rather than an error.
+func Decapsulate(privateKey, ciphertext []byte) (sharedKey []byte, err error) {
+	if len(privateKey) != PrivateKeySize {
+		return nil, errPrivateKeySize
+	}
+	if len(ciphertext) != CiphertextSize {
+		return nil, errCiphertextSize
+	}
+	pk := privateKey[2*smallBytes:][:PublicKeySize]
+	rho := privateKey[2*smallBytes+PublicKeySize:][:inputsBytes]
+	cache := privateKey[2*smallBytes+PublicKeySize+inputsBytes:]
+
+	var f, v [p]small
+	smallDecode(&f, privateKey)
+	smallDecode(&v, privateKey[smallBytes:])
+	var c [p]fq
+	roundedDecode(&c, ciphertext)
+	r := decrypt(&c, &f, &v)
+
+	var rEnc [inputsBytes]byte
+	cnew := make([]byte, CiphertextSize)
+	hide(cnew, rEnc[:], &r, pk, cache)
+
+	// mask is 0 if the ciphertexts match, else -1.
+	var diff uint16
+	for i := range cnew {
+		diff |= uint16(ciphertext[i] ^ cnew[i])
+	}
+	mask := byte(int(1&((diff-1)>>8)) - 1)
+	for i := range rEnc {
+		rEnc[i] ^= mask & (rEnc[i] ^ rho[i])
+	}
+	return hashSession(1+mask, rEnc[:], ciphertext), nil
+}
@@ -0,0 +1,181 @@
+package sntrup761
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"sort"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	pk, sk, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pk) != PublicKeySize || len(sk) != PrivateKeySize {
+		t.Fatalf("got key sizes %d and %d", len(pk), len(sk))
+	}
+	for i := 0; i < 3; i++ {
+		c, k, err := Encapsulate(rand.Reader, pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k2, err := Decapsulate(sk, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(k, k2) {
+			t.Fatalf("decapsulated key %x, want %x", k2, k)
+		}
+
+		// Tampered ciphertexts are implicitly rejected.
+		c[i*100] ^= 1
+		k3, err := Decapsulate(sk, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(k, k3) {
+			t.Error("tampered ciphertext yields the shared key")
+		}
+	}
+}
+
+func TestSizes(t *testing.T) {
+	if _, _, err := Encapsulate(rand.Reader, make([]byte, PublicKeySize-1)); err != errPublicKeySize {
+		t.Errorf("got error %v for a short public key", err)
+	}
+	if _, err := Decapsulate(make([]byte, PrivateKeySize), make([]byte, CiphertextSize+1)); err != errCiphertextSize {
+		t.Errorf("got error %v for a long ciphertext", err)
+	}
+	if _, err := Decapsulate(make([]byte, PrivateKeySize-1), make([]byte, CiphertextSize)); err != errPrivateKeySize {
+		t.Errorf("got error %v for a short private key", err)
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	var r, r2 [p]fq
+	for i := range r {
+		n, _ := rand.Int(rand.Reader, big.NewInt(q))
+		r[i] = fq(n.Int64()) - q12
+	}
+	s := make([]byte, rqBytes)
+	rqEncode(s, &r)
+	rqDecode(&r2, s)
+	if r != r2 {
+		t.Error("Rq encoding does not round trip")
+	}
+
+	rounded := round(&r)
+	s = make([]byte, roundedBytes)
+	roundedEncode(s, &rounded)
+	roundedDecode(&r2, s)
+	if rounded != r2 {
+		t.Error("rounded encoding does not round trip")
+	}
+}
+
+func TestSortUint32(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 3, 17, 64, p} {
+		x := make([]uint32, n)
+		for i := range x {
+			n, _ := rand.Int(rand.Reader, big.NewInt(1<<32))
+			x[i] = uint32(n.Uint64())
+		}
+		want := append([]uint32{}, x...)
+		sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+		sortUint32(x)
+		for i := range x {
+			if x[i] != want[i] {
+				t.Fatalf("n=%d: sorted %v, want %v", n, x, want)
+			}
+		}
+	}
+}
+
+func TestDivmod(t *testing.T) {
+	for _, m := range []uint16{1, 3, q, (q + 2) / 3, 16383} {
+		for _, x := range []uint32{0, 1, 2, 4590, 0x7fffffff, 0x80000000, 0xffffffff} {
+			quot, rem := uint32DivmodUint14(x, m)
+			if quot != x/uint32(m) || uint32(rem) != x%uint32(m) {
+				t.Errorf("uint32DivmodUint14(%d, %d) = %d, %d", x, m, quot, rem)
+			}
+		}
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	for _, x := range []int32{-1<<25 + 1, -3000000, -q, -q12 - 1, -1, 0, 1, q12, q12 + 1, 1<<25 - 1} {
+		want := ((x % q) + q) % q
+		if want > q12 {
+			want -= q
+		}
+		if got := fqFreeze(x); int32(got) != want {
+			t.Errorf("fqFreeze(%d) = %d, want %d", x, got, want)
+		}
+		want = ((x % 3) + 3) % 3
+		if want > 1 {
+			want -= 3
+		}
+		if got := f3Freeze(x); int32(got) != want {
+			t.Errorf("f3Freeze(%d) = %d, want %d", x, got, want)
+		}
+	}
+}
+
+// testRand is a deterministic stream of SHA-512 blocks of a counter.
+type testRand struct {
+	counter uint64
+	buf     []byte
+}
+
+func (r *testRand) Read(b []byte) (int, error) {
+	for i := range b {
+		if len(r.buf) == 0 {
+			var c [8]byte
+			binary.BigEndian.PutUint64(c[:], r.counter)
+			r.counter++
+			h := sha512.Sum512(c[:])
+			r.buf = h[:]
+		}
+		b[i], r.buf = r.buf[0], r.buf[1:]
+	}
+	return len(b), nil
+}
+
+// TestVectors pins the outputs for a fixed random stream. They were recorded
+// from this implementation, whose encapsulation the key exchange tests in
+// golang.org/x/crypto/ssh/test check against the OpenSSH client, so that
+// changes to key generation, encoding and decapsulation are caught too.
+func TestVectors(t *testing.T) {
+	rand := &testRand{}
+	pk, sk, err := GenerateKey(rand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, k, err := Encapsulate(rand, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k2, err := Decapsulate(sk, c); err != nil || !bytes.Equal(k, k2) {
+		t.Fatalf("decapsulated key %x, %v; want %x", k2, err, k)
+	}
+	for _, v := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"public key", pk, "b5bd6c4df13813cd187309bc06301fcc2f182addba6bbca44e96921de81fce25"},
+		{"private key", sk, "eddbc8a23b82c4564dc21eaa92b10486aa37dc54ce3ff4eb9240f873fb073b9a"},
+		{"ciphertext", c, "b14fa4e016f11542b1e73a65557b55347e0fd569c5dc1dce72a683f8544d6df3"},
+		{"shared key", k, "0d435030ce274512e2c1c5ba4e01dfa6d0b93ac3a01a1300f681fd0aad4675f4"},
+	} {
+		if got := fmt.Sprintf("%x", sha256.Sum256(v.data)); got != v.want {
+			t.Errorf("SHA-256 of the %s is %s, want %s", v.name, got, v.want)
+		}
+	}
+}
@@ -17,15 +17,18 @@ import (
 	"math/big"
 
 	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ssh/internal/sntrup761"
 )
 
 const (
-	kexAlgoDH1SHA1          = "diffie-hellman-group1-sha1"
-	kexAlgoDH14SHA1         = "diffie-hellman-group14-sha1"
-	kexAlgoECDH256          = "ecdh-sha2-nistp256"
-	kexAlgoECDH384          = "ecdh-sha2-nistp384"
-	kexAlgoECDH521          = "ecdh-sha2-nistp521"
-	kexAlgoCurve25519SHA256 = "curve25519-sha256@libssh.org"
+	kexAlgoDH1SHA1                = "diffie-hellman-group1-sha1"
+	kexAlgoDH14SHA1               = "diffie-hellman-group14-sha1"
+	kexAlgoECDH256                = "ecdh-sha2-nistp256"
+	kexAlgoECDH384                = "ecdh-sha2-nistp384"
+	kexAlgoECDH521                = "ecdh-sha2-nistp521"
+	kexAlgoCurve25519SHA256       = "curve25519-sha256"
+	kexAlgoCurve25519SHA256LibSSH = "curve25519-sha256@libssh.org"
+	kexAlgoSNTRUP761X25519SHA512  = "sntrup761x25519-sha512@openssh.com"
 
 	// For the following kex only the client half contains a production
 	// ready implementation. The server half only consists of a minimal
@@ -410,12 +413,15 @@ func init() {
 	kexAlgoMap[kexAlgoECDH384] = &ecdh{elliptic.P384()}
 	kexAlgoMap[kexAlgoECDH256] = &ecdh{elliptic.P256()}
 	kexAlgoMap[kexAlgoCurve25519SHA256] = &curve25519sha256{}
+	kexAlgoMap[kexAlgoCurve25519SHA256LibSSH] = &curve25519sha256{}
+	kexAlgoMap[kexAlgoSNTRUP761X25519SHA512] = &sntrup761x25519sha512{}
 	kexAlgoMap[kexAlgoDHGEXSHA1] = &dhGEXSHA{hashFunc: crypto.SHA1}
 	kexAlgoMap[kexAlgoDHGEXSHA256] = &dhGEXSHA{hashFunc: crypto.SHA256}
 }
 
-// curve25519sha256 implements the curve25519-sha256@libssh.org key
-// agreement protocol, as described in
+// curve25519sha256 implements the curve25519-sha256 key agreement protocol of
+// RFC 8731, which is also known by its original name
+// curve25519-sha256@libssh.org, as described in
 // https://git.libssh.org/projects/libssh.git/tree/doc/curve25519-sha256@libssh.org.txt
 type curve25519sha256 struct{}
 
@@ -549,6 +555,143 @@ func (kex *curve25519sha256) Server(c packetConn, rand io.Reader, magics *handsh
 	}, nil
 }
 
+// sntrup761x25519sha512 implements the sntrup761x25519-sha512@openssh.com
+// hybrid key agreement of OpenSSH, which combines the Streamlined NTRU Prime
+// KEM with curve25519 so that recorded sessions stay confidential even if
+// either of them is broken. The public values are the concatenation of the
+// KEM's public key or ciphertext with the curve25519 public key, and the
+// shared secret is the SHA-512 hash of both shared keys, encoded as a string.
+type sntrup761x25519sha512 struct{}
+
+// sntrupSharedSecret returns the encoded shared secret of the KEM key and the
+// curve25519 secret.
+func sntrupSharedSecret(kemKey []byte, secret *[32]byte) []byte {
+	h := crypto.SHA512.New()
+	h.Write(kemKey)
+	h.Write(secret[:])
+	digest := h.Sum(nil)
+	K := make([]byte, stringLength(len(digest)))
+	marshalString(K, digest)
+	return K
+}
+
+func (kex *sntrup761x25519sha512) Client(c packetConn, rand io.Reader, magics *handshakeMagics) (*kexResult, error) {
+	pk, sk, err := sntrup761.GenerateKey(rand)
+	if err != nil {
+		return nil, err
+	}
+	var kp curve25519KeyPair
+	if err := kp.generate(rand); err != nil {
+		return nil, err
+	}
+	clientPub := append(pk, kp.pub[:]...)
+	if err := c.writePacket(Marshal(&kexECDHInitMsg{clientPub})); err != nil {
+		return nil, err
+	}
+
+	packet, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	var reply kexECDHReplyMsg
+	if err = Unmarshal(packet, &reply); err != nil {
+		return nil, err
+	}
+	if len(reply.EphemeralPubKey) != sntrup761.CiphertextSize+32 {
+		return nil, errors.New("ssh: peer's sntrup761x25519 public value has wrong length")
+	}
+
+	kemKey, err := sntrup761.Decapsulate(sk, reply.EphemeralPubKey[:sntrup761.CiphertextSize])
+	if err != nil {
+		return nil, err
+	}
+	var servPub, secret [32]byte
+	copy(servPub[:], reply.EphemeralPubKey[sntrup761.CiphertextSize:])
+	curve25519.ScalarMult(&secret, &kp.priv, &servPub)
+	if subtle.ConstantTimeCompare(secret[:], curve25519Zeros[:]) == 1 {
+		return nil, errors.New("ssh: peer's curve25519 public value has wrong order")
+	}
+
+	h := crypto.SHA512.New()
+	magics.write(h)
+	writeString(h, reply.HostKey)
+	writeString(h, clientPub)
+	writeString(h, reply.EphemeralPubKey)
+	K := sntrupSharedSecret(kemKey, &secret)
+	h.Write(K)
+
+	return &kexResult{
+		H:         h.Sum(nil),
+		K:         K,
+		HostKey:   reply.HostKey,
+		Signature: reply.Signature,
+		Hash:      crypto.SHA512,
+	}, nil
+}
+
+func (kex *sntrup761x25519sha512) Server(c packetConn, rand io.Reader, magics *handshakeMagics, priv Signer) (*kexResult, error) {
+	packet, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	var kexInit kexECDHInitMsg
+	if err = Unmarshal(packet, &kexInit); err != nil {
+		return nil, err
+	}
+	if len(kexInit.ClientPubKey) != sntrup761.PublicKeySize+32 {
+		return nil, errors.New("ssh: peer's sntrup761x25519 public value has wrong length")
+	}
+
+	ciphertext, kemKey, err := sntrup761.Encapsulate(rand, kexInit.ClientPubKey[:sntrup761.PublicKeySize])
+	if err != nil {
+		return nil, err
+	}
+	var kp curve25519KeyPair
+	if err := kp.generate(rand); err != nil {
+		return nil, err
+	}
+	var clientPub, secret [32]byte
+	copy(clientPub[:], kexInit.ClientPubKey[sntrup761.PublicKeySize:])
+	curve25519.ScalarMult(&secret, &kp.priv, &clientPub)
+	if subtle.ConstantTimeCompare(secret[:], curve25519Zeros[:]) == 1 {
+		return nil, errors.New("ssh: peer's curve25519 public value has wrong order")
+	}
+
+	hostKeyBytes := priv.PublicKey().Marshal()
+	serverPub := append(ciphertext, kp.pub[:]...)
+
+	h := crypto.SHA512.New()
+	magics.write(h)
+	writeString(h, hostKeyBytes)
+	writeString(h, kexInit.ClientPubKey)
+	writeString(h, serverPub)
+	K := sntrupSharedSecret(kemKey, &secret)
+	h.Write(K)
+
+	H := h.Sum(nil)
+
+	sig, err := signAndMarshal(priv, rand, H)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := kexECDHReplyMsg{
+		EphemeralPubKey: serverPub,
+		HostKey:         hostKeyBytes,
+		Signature:       sig,
+	}
+	if err := c.writePacket(Marshal(&reply)); err != nil {
+		return nil, err
+	}
+	return &kexResult{
+		H:         H,
+		K:         K,
+		HostKey:   hostKeyBytes,
+		Signature: sig,
+		Hash:      crypto.SHA512,
+	}, nil
+}
+
 // dhGEXSHA implements the diffie-hellman-group-exchange-sha1 and
 // diffie-hellman-group-exchange-sha256 key agreement protocols,
 // as described in RFC 4419
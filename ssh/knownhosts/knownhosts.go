@@ -20,6 +20,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -435,6 +436,83 @@ func New(files ...string) (ssh.HostKeyCallback, error) {
 	return certChecker.CheckHostKey, nil
 }
 
+// LearnFunc persists the key of a host that is not in the database
+// yet. The address is the hostname passed to the host key callback, or
+// the remote address if that is empty.
+type LearnFunc func(address string, remote net.Addr, key ssh.PublicKey) error
+
+type tofu struct {
+	mu      sync.Mutex
+	db      *hostKeyDB
+	checker ssh.CertChecker
+	learn   LearnFunc
+	learned int
+}
+
+// NewTOFU is like New, but trusts hosts on first use: the key of a
+// host for which the files have no key is passed to learn and, unless
+// learn fails, accepted. Learned keys are remembered, so later
+// connections with another key fail with a KeyError. Keys with
+// @revoked markers are never learned, nor are host certificates,
+// which need a @cert-authority line.
+func NewTOFU(learn LearnFunc, files ...string) (ssh.HostKeyCallback, error) {
+	t := &tofu{db: newHostKeyDB(), learn: learn}
+	for _, fn := range files {
+		f, err := os.Open(fn)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := t.db.Read(f, fn); err != nil {
+			return nil, err
+		}
+	}
+	t.checker.IsHostAuthority = t.db.IsHostAuthority
+	t.checker.IsRevoked = t.db.IsRevoked
+	t.checker.HostKeyFallback = t.db.check
+	return t.check, nil
+}
+
+func (t *tofu) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err := t.checker.CheckHostKey(hostname, remote, key)
+	if keyErr, ok := err.(*KeyError); !ok || len(keyErr.Want) > 0 {
+		return err
+	}
+
+	address := hostname
+	if address == "" {
+		address = remote.String()
+	}
+	if err := t.learn(address, remote, key); err != nil {
+		return err
+	}
+	t.learned++
+	return t.db.parseLine([]byte(Line([]string{address}, key)), "(learned)", t.learned)
+}
+
+// AppendFile returns a LearnFunc for NewTOFU that appends learned keys
+// to the given known_hosts file, creating it if necessary. If hash is
+// set, the hostnames are hashed as by HashHostname.
+func AppendFile(filename string, hash bool) LearnFunc {
+	return func(address string, remote net.Addr, key ssh.PublicKey) error {
+		line := Line([]string{address}, key)
+		if hash {
+			line = HashHostname(Normalize(address)) + " " + serialize(key)
+		}
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := f.WriteString(line + "\n"); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+}
+
 // Normalize normalizes an address into the form used in known_hosts
 func Normalize(address string) string {
 	host, port, err := net.SplitHostPort(address)
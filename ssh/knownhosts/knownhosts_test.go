@@ -6,9 +6,13 @@ package knownhosts
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	"golang.org/x/crypto/ssh"
@@ -354,3 +358,67 @@ func TestHashedHostkeyCheck(t *testing.T) {
 		t.Errorf("got error %v, want %v", got, want)
 	}
 }
+
+func TestTOFU(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(fn, []byte("@revoked * "+ecKeyStr+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var learned []string
+	appendFile := AppendFile(fn, true)
+	cb, err := NewTOFU(func(address string, remote net.Addr, key ssh.PublicKey) error {
+		learned = append(learned, address)
+		return appendFile(address, remote, key)
+	}, fn)
+	if err != nil {
+		t.Fatalf("NewTOFU: %v", err)
+	}
+
+	if err := cb("server.org:22", testAddr, edKey); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := cb("server.org:22", testAddr, edKey); err != nil {
+		t.Errorf("second use: %v", err)
+	}
+	if err := cb("server.org:22", testAddr, alternateEdKey); err == nil {
+		t.Error("accepted a changed key")
+	} else if keyErr, ok := err.(*KeyError); !ok || len(keyErr.Want) != 1 {
+		t.Errorf("got error %v for a changed key, want a mismatch", err)
+	}
+	if _, ok := cb("other.org:22", testAddr, ecKey).(*RevokedError); !ok {
+		t.Error("revoked key was not rejected")
+	}
+	if !reflect.DeepEqual(learned, []string{"server.org:22"}) {
+		t.Errorf("learned %q, want only server.org:22", learned)
+	}
+
+	// The key was persisted with a hashed hostname.
+	contents, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(contents)), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[1], "|1|") {
+		t.Errorf("got known_hosts %q, want a hashed entry appended", contents)
+	}
+	cb, err = New(fn)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := cb("server.org:22", testAddr, edKey); err != nil {
+		t.Errorf("persisted key: %v", err)
+	}
+}
+
+func TestTOFULearnError(t *testing.T) {
+	cb, err := NewTOFU(func(string, net.Addr, ssh.PublicKey) error {
+		return errors.New("read-only")
+	})
+	if err != nil {
+		t.Fatalf("NewTOFU: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := cb("server.org:22", testAddr, edKey); err == nil || err.Error() != "read-only" {
+			t.Errorf("got %v, want the error of the LearnFunc", err)
+		}
+	}
+}
@@ -141,6 +141,41 @@ type serviceAcceptMsg struct {
 	Service string `sshtype:"6"`
 }
 
+// See RFC 8308, section 2.3.
+const msgExtInfo = 7
+
+type extInfoMsg struct {
+	NumExtensions uint32 `sshtype:"7"`
+	Payload       []byte `ssh:"rest"`
+}
+
+// extInfoClient is the pseudo key exchange algorithm by which a client
+// signals that it accepts SSH_MSG_EXT_INFO.
+const extInfoClient = "ext-info-c"
+
+// parseExtInfo returns the extensions of an SSH_MSG_EXT_INFO packet by name.
+func parseExtInfo(packet []byte) (map[string][]byte, error) {
+	var msg extInfoMsg
+	if err := Unmarshal(packet, &msg); err != nil {
+		return nil, err
+	}
+	extensions := make(map[string][]byte)
+	rest := msg.Payload
+	for i := uint32(0); i < msg.NumExtensions; i++ {
+		name, r, ok := parseString(rest)
+		if !ok {
+			return nil, parseError(msgExtInfo)
+		}
+		value, r, ok := parseString(r)
+		if !ok {
+			return nil, parseError(msgExtInfo)
+		}
+		extensions[string(name)] = value
+		rest = r
+	}
+	return extensions, nil
+}
+
 // See RFC 4252, section 5.
 const msgUserAuthRequest = 50
 
@@ -0,0 +1,325 @@
+// Package proxyaudit implements an append-only audit log for sshr-style
+// proxies, for example as the sink of ssh.ProxyConfig.AuthLogHook.
+//
+// Records are written to numbered segment files in a directory. Every
+// record carries a SHA-256 hash chained to the previous record, and full
+// segments are sealed with a checksum of their contents and made read-only.
+// Verify checks a log offline, so that modifying, reordering or removing
+// records, or removing or altering a segment other than the newest, is
+// detected.
+//
+// The hashes are not keyed, so they only protect against accounts that
+// cannot write the log. The account running the proxy can rewrite any
+// record, recompute the chain and seals and make the files read-only
+// again. Anchoring the chain head outside the host, for example by
+// timestamping it as package proxytsa does, makes such rewrites of the
+// anchored records detectable, and also covers dropping the newest records,
+// which cannot be detected locally.
+package proxyaudit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DefaultSegmentSize is the size after which a segment is sealed.
+const DefaultSegmentSize = 64 << 20
+
+// reasonTruncated is the CorruptError reason for a partial last line.
+const reasonTruncated = "truncated line"
+
+// segmentPattern names the segment files; segments are numbered from 1.
+const segmentPattern = "segment-%08d.log"
+
+// CorruptError reports where verification of a log failed.
+type CorruptError struct {
+	Segment string
+	// Line is the 1-based line number, or 0 if the error concerns the
+	// whole segment.
+	Line   int
+	Reason string
+}
+
+func (e *CorruptError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("proxyaudit: %s: %s", e.Segment, e.Reason)
+	}
+	return fmt.Sprintf("proxyaudit: %s:%d: %s", e.Segment, e.Line, e.Reason)
+}
+
+// Summary describes a verified log.
+type Summary struct {
+	Segments int
+	Records  uint64
+	// Head is the hash of the last record.
+	Head [sha256.Size]byte
+}
+
+// recordHash computes the chain hash of a record.
+func recordHash(prev [sha256.Size]byte, seq uint64, data []byte) [sha256.Size]byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], seq)
+	h := sha256.New()
+	h.Write(prev[:])
+	h.Write(b[:])
+	h.Write(data)
+	var out [sha256.Size]byte
+	copy(out[:], h.Sum(nil))
+	return out
+}
+
+// logState is the result of scanning a log directory.
+type logState struct {
+	Summary
+	// sealed is set if the newest segment is sealed, or there is none.
+	sealed bool
+	// segment is the content hash and size of the newest segment.
+	segment hash.Hash
+	size    int64
+	// torn is set if the newest segment ends in a partial record, as left
+	// by a crash during Append. size excludes it.
+	torn bool
+}
+
+func segmentName(dir string, n int) string {
+	return filepath.Join(dir, fmt.Sprintf(segmentPattern, n))
+}
+
+// scan reads the log in dir. If repair is set, a partial record at the end
+// of an unsealed newest segment is tolerated and reported in torn.
+func scan(dir string, repair bool) (*logState, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "segment-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	st := &logState{sealed: true}
+	for i, name := range names {
+		if name != segmentName(dir, i+1) {
+			return nil, &CorruptError{Segment: filepath.Base(name), Reason: fmt.Sprintf("expected segment %d", i+1)}
+		}
+		if !st.sealed {
+			return nil, &CorruptError{Segment: filepath.Base(names[i-1]), Reason: "segment is not sealed but is not the newest"}
+		}
+		if err := st.scanSegment(name); err != nil {
+			ce, ok := err.(*CorruptError)
+			torn := ok && ce.Reason == reasonTruncated && !st.sealed && i == len(names)-1
+			if !repair || !torn {
+				return nil, err
+			}
+			st.torn = true
+		}
+		st.Segments++
+	}
+	return st, nil
+}
+
+func (st *logState) scanSegment(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	base := filepath.Base(name)
+	st.segment = sha256.New()
+	st.size = 0
+	st.sealed = false
+
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		text, err := r.ReadBytes('\n')
+		if err == io.EOF && len(text) == 0 {
+			return nil
+		}
+		if err == io.EOF {
+			return &CorruptError{Segment: base, Line: line, Reason: reasonTruncated}
+		}
+		if err != nil {
+			return err
+		}
+		if st.sealed {
+			return &CorruptError{Segment: base, Line: line, Reason: "data after seal"}
+		}
+		corrupt := func(reason string) error {
+			return &CorruptError{Segment: base, Line: line, Reason: reason}
+		}
+
+		fields := bytes.Split(bytes.TrimSuffix(text, []byte("\n")), []byte(" "))
+		switch {
+		case len(fields) == 4 && string(fields[0]) == "r":
+			seq, err := strconv.ParseUint(string(fields[1]), 10, 64)
+			if err != nil || seq != st.Records+1 {
+				return corrupt("out of sequence record")
+			}
+			data, err := base64.StdEncoding.DecodeString(string(fields[3]))
+			if err != nil {
+				return corrupt("malformed record data")
+			}
+			h := recordHash(st.Head, seq, data)
+			if hex.EncodeToString(h[:]) != string(fields[2]) {
+				return corrupt("record hash mismatch")
+			}
+			st.Records, st.Head = seq, h
+
+		case len(fields) == 2 && string(fields[0]) == "s":
+			if hex.EncodeToString(st.segment.Sum(nil)) != string(fields[1]) {
+				return corrupt("segment checksum mismatch")
+			}
+			st.sealed = true
+
+		default:
+			return corrupt("malformed line")
+		}
+		st.segment.Write(text)
+		st.size += int64(len(text))
+	}
+}
+
+// Verify checks the log in dir. A partial record left by a crash is
+// reported until Open truncates it.
+func Verify(dir string) (*Summary, error) {
+	st, err := scan(dir, false)
+	if err != nil {
+		return nil, err
+	}
+	return &st.Summary, nil
+}
+
+// Log appends records to the log in a directory. It is safe for concurrent
+// use.
+type Log struct {
+	// SegmentSize is the size after which a segment is sealed. If zero,
+	// DefaultSegmentSize is used.
+	SegmentSize int64
+
+	dir string
+
+	mu sync.Mutex
+	st *logState
+	f  *os.File
+}
+
+// Open verifies the log in dir, creating the directory if needed, and
+// prepares it for appending. An unsealed newest segment is continued; a
+// partial record at its end, left by a crash, is truncated.
+func Open(dir string) (*Log, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	st, err := scan(dir, true)
+	if err != nil {
+		return nil, err
+	}
+	if st.torn {
+		if err := os.Truncate(segmentName(dir, st.Segments), st.size); err != nil {
+			return nil, err
+		}
+		st.torn = false
+	}
+	l := &Log{dir: dir, st: st}
+	if !st.sealed {
+		l.f, err = os.OpenFile(segmentName(dir, st.Segments), os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Append writes a record to the log. The record is synced to disk before
+// Append returns.
+func (l *Log) Append(record []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		f, err := os.OpenFile(segmentName(l.dir, l.st.Segments+1), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		l.f = f
+		l.st.Segments++
+		l.st.segment = sha256.New()
+		l.st.size = 0
+		l.st.sealed = false
+	}
+
+	seq := l.st.Records + 1
+	h := recordHash(l.st.Head, seq, record)
+	line := fmt.Sprintf("r %d %x %s\n", seq, h, base64.StdEncoding.EncodeToString(record))
+	if err := l.write(line); err != nil {
+		return err
+	}
+	l.st.Records, l.st.Head = seq, h
+
+	size := l.SegmentSize
+	if size <= 0 {
+		size = DefaultSegmentSize
+	}
+	if l.st.size >= size {
+		return l.seal()
+	}
+	return nil
+}
+
+func (l *Log) write(line string) error {
+	if _, err := l.f.WriteString(line); err != nil {
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.st.segment.Write([]byte(line))
+	l.st.size += int64(len(line))
+	return nil
+}
+
+// Seal seals the current segment, if any. The next record starts a new one.
+func (l *Log) Seal() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seal()
+}
+
+func (l *Log) seal() error {
+	if l.f == nil {
+		return nil
+	}
+	if err := l.write(fmt.Sprintf("s %x\n", l.st.segment.Sum(nil))); err != nil {
+		return err
+	}
+	name := l.f.Name()
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	l.f = nil
+	l.st.sealed = true
+	return os.Chmod(name, 0400)
+}
+
+// Head returns the number of records in the log and the hash of the last
+// one, for example to be timestamped externally.
+func (l *Log) Head() (uint64, [sha256.Size]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.st.Records, l.st.Head
+}
+
+// Close seals the current segment and closes the log.
+func (l *Log) Close() error {
+	return l.Seal()
+}
@@ -0,0 +1,150 @@
+package proxyaudit
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// writeTestLog writes n records to a fresh log with small segments.
+func writeTestLog(t *testing.T, n int) string {
+	dir := t.TempDir()
+	l, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	l.SegmentSize = 200
+	for i := 0; i < n; i++ {
+		if err := l.Append([]byte(fmt.Sprintf("login user%d", i))); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return dir
+}
+
+func TestLogVerify(t *testing.T) {
+	dir := writeTestLog(t, 10)
+	s, err := Verify(dir)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if s.Records != 10 || s.Segments < 2 {
+		t.Errorf("got %d records in %d segments, want 10 in several", s.Records, s.Segments)
+	}
+
+	fi, err := os.Stat(segmentName(dir, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm()&0222 != 0 {
+		t.Errorf("sealed segment has mode %v", fi.Mode())
+	}
+}
+
+func TestLogContinues(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	l.Append([]byte("one"))
+	// Simulate a restart without sealing.
+	l.f.Close()
+
+	l, err = Open(dir)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	l.Append([]byte("two"))
+	l.Close()
+
+	s, err := Verify(dir)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if s.Records != 2 || s.Segments != 1 {
+		t.Errorf("got %d records in %d segments, want 2 in 1", s.Records, s.Segments)
+	}
+}
+
+func TestLogTampering(t *testing.T) {
+	for name, tamper := range map[string]func(t *testing.T, dir string){
+		"modified record": func(t *testing.T, dir string) {
+			rewrite(t, segmentName(dir, 1), func(b []byte) []byte {
+				return bytes.Replace(b, []byte("bG9naW4gdXNlcjA="), []byte("bG9naW4gdXNlcjk="), 1)
+			})
+		},
+		"removed record": func(t *testing.T, dir string) {
+			rewrite(t, segmentName(dir, 1), func(b []byte) []byte {
+				return b[bytes.IndexByte(b, '\n')+1:]
+			})
+		},
+		"removed segment": func(t *testing.T, dir string) {
+			if err := os.Remove(segmentName(dir, 2)); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"truncated segment": func(t *testing.T, dir string) {
+			rewrite(t, segmentName(dir, 1), func(b []byte) []byte {
+				return b[:len(b)-5]
+			})
+		},
+	} {
+		dir := writeTestLog(t, 10)
+		tamper(t, dir)
+		if _, err := Verify(dir); err == nil {
+			t.Errorf("%s: not detected", name)
+		} else if _, ok := err.(*CorruptError); !ok {
+			t.Errorf("%s: got %v, want a CorruptError", name, err)
+		}
+		if _, err := Open(dir); err == nil {
+			t.Errorf("%s: Open succeeded on a corrupt log", name)
+		}
+	}
+}
+
+func rewrite(t *testing.T, name string, fn func([]byte) []byte) {
+	os.Chmod(name, 0600)
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, fn(b), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogRecoversTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	l.Append([]byte("one"))
+	// Simulate a crash in the middle of writing a record.
+	l.f.WriteString("r 2 0123")
+	l.f.Close()
+
+	if _, err := Verify(dir); err == nil {
+		t.Error("Verify accepted a partial record")
+	}
+	l, err = Open(dir)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	l.Append([]byte("two"))
+	l.Close()
+
+	s, err := Verify(dir)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if s.Records != 2 || s.Segments != 1 {
+		t.Errorf("got %d records in %d segments, want 2 in 1", s.Records, s.Segments)
+	}
+}
@@ -0,0 +1,330 @@
+// Package proxydial dials upstream hosts through SOCKS5 (RFC 1928) and
+// HTTP CONNECT proxies, for proxies whose upstream hosts are only reachable
+// through another egress proxy.
+//
+// Its dialers implement ssh.ContextDialer. Set one as
+// ssh.ProxyConfig.UpstreamDialer, or as the Dialer of the ssh.UpstreamRoute
+// of the hosts behind the egress proxy. Host names are resolved by the
+// egress proxy.
+package proxydial
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// FromURL returns a dialer for the proxy at u: "socks5://host:port" or
+// "socks5h://host:port" for SOCKS5, "http://host:port" or
+// "https://host:port" for HTTP CONNECT. Credentials in u authenticate to
+// the proxy. The proxy is dialed with forward, or a net.Dialer if nil.
+func FromURL(u *url.URL, forward ssh.ContextDialer) (ssh.ContextDialer, error) {
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		d := &SOCKS5{Addr: hostPort(u, "1080"), Forward: forward}
+		if u.User != nil {
+			d.Username = u.User.Username()
+			d.Password, _ = u.User.Password()
+		}
+		return d, nil
+	case "http", "https":
+		return &HTTPConnect{URL: u, Forward: forward}, nil
+	}
+	return nil, fmt.Errorf("proxydial: unsupported proxy scheme %q", u.Scheme)
+}
+
+// hostPort returns the address of u, with port def if it has none.
+func hostPort(u *url.URL, def string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), def)
+}
+
+func dialForward(ctx context.Context, forward ssh.ContextDialer, addr string) (net.Conn, error) {
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+	return forward.DialContext(ctx, "tcp", addr)
+}
+
+// handshake runs fn on c, which is closed if fn fails or ctx is done first.
+func handshake(ctx context.Context, c net.Conn, fn func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+		defer c.SetDeadline(time.Time{})
+	}
+	done := make(chan struct{})
+	cancelled := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+			close(cancelled)
+		case <-done:
+		}
+	}()
+	err := fn()
+	close(done)
+	select {
+	case <-cancelled:
+		return ctx.Err()
+	default:
+	}
+	if err != nil {
+		c.Close()
+	}
+	return err
+}
+
+// SOCKS5 dials through a SOCKS5 proxy.
+type SOCKS5 struct {
+	// Addr is the host and port of the proxy.
+	Addr string
+	// Username and Password, if Username is set, authenticate to the
+	// proxy (RFC 1929).
+	Username string
+	Password string
+	// Forward dials the proxy. If nil, a net.Dialer is used.
+	Forward ssh.ContextDialer
+}
+
+// SOCKS5 methods, commands and address types.
+const (
+	socksVersion        = 5
+	socksNoAuth         = 0
+	socksPasswordAuth   = 2
+	socksNoAcceptable   = 0xff
+	socksConnect        = 1
+	socksAddrIPv4       = 1
+	socksAddrDomainName = 3
+	socksAddrIPv6       = 4
+)
+
+var socksReplies = []string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// DialContext connects to addr through the proxy. network must be "tcp".
+func (d *SOCKS5) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("proxydial: SOCKS5 cannot dial %s", network)
+	}
+	req, err := socksConnectRequest(addr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := dialForward(ctx, d.Forward, d.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := handshake(ctx, c, func() error { return d.connect(c, req) }); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// socksConnectRequest returns the CONNECT request for addr.
+func socksConnectRequest(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxydial: invalid port in %q", addr)
+	}
+	req := []byte{socksVersion, socksConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("proxydial: host name %q too long", host)
+		}
+		req = append(req, socksAddrDomainName, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socksAddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socksAddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	return append(req, byte(port>>8), byte(port)), nil
+}
+
+func (d *SOCKS5) connect(c net.Conn, req []byte) error {
+	method := byte(socksNoAuth)
+	if d.Username != "" {
+		method = socksPasswordAuth
+	}
+	if _, err := c.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+	var buf [4]byte
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != socksVersion {
+		return fmt.Errorf("proxydial: unexpected SOCKS version %d", buf[0])
+	}
+	if buf[1] != method {
+		return errors.New("proxydial: SOCKS5 proxy refused the authentication method")
+	}
+	if method == socksPasswordAuth {
+		if len(d.Username) > 255 || len(d.Password) > 255 {
+			return errors.New("proxydial: SOCKS5 credentials too long")
+		}
+		auth := []byte{1, byte(len(d.Username))}
+		auth = append(auth, d.Username...)
+		auth = append(auth, byte(len(d.Password)))
+		auth = append(auth, d.Password...)
+		if _, err := c.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c, buf[:2]); err != nil {
+			return err
+		}
+		if buf[1] != 0 {
+			return errors.New("proxydial: SOCKS5 authentication failed")
+		}
+	}
+
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c, buf[:4]); err != nil {
+		return err
+	}
+	if rep := int(buf[1]); rep != 0 {
+		msg := "unknown error"
+		if rep < len(socksReplies) {
+			msg = socksReplies[rep]
+		}
+		return fmt.Errorf("proxydial: SOCKS5 connect failed: %s", msg)
+	}
+	// Skip the bound address.
+	var skip int
+	switch buf[3] {
+	case socksAddrIPv4:
+		skip = net.IPv4len
+	case socksAddrIPv6:
+		skip = net.IPv6len
+	case socksAddrDomainName:
+		if _, err := io.ReadFull(c, buf[:1]); err != nil {
+			return err
+		}
+		skip = int(buf[0])
+	default:
+		return fmt.Errorf("proxydial: unknown SOCKS5 address type %d", buf[3])
+	}
+	_, err := io.CopyN(io.Discard, c, int64(skip+2))
+	return err
+}
+
+// HTTPConnect dials through an HTTP proxy with the CONNECT method.
+type HTTPConnect struct {
+	// URL of the proxy, with scheme "http" or "https". Its user
+	// information, if any, is sent as basic authentication.
+	URL *url.URL
+	// Header is added to the CONNECT requests.
+	Header http.Header
+	// TLSConfig is used for "https" proxies.
+	TLSConfig *tls.Config
+	// Forward dials the proxy. If nil, a net.Dialer is used.
+	Forward ssh.ContextDialer
+}
+
+// DialContext connects to addr through the proxy. network must be "tcp".
+func (d *HTTPConnect) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("proxydial: HTTP CONNECT cannot dial %s", network)
+	}
+	def := "80"
+	if d.URL.Scheme == "https" {
+		def = "443"
+	}
+	c, err := dialForward(ctx, d.Forward, hostPort(d.URL, def))
+	if err != nil {
+		return nil, err
+	}
+	if d.URL.Scheme == "https" {
+		conf := d.TLSConfig.Clone()
+		if conf == nil {
+			conf = &tls.Config{}
+		}
+		if conf.ServerName == "" {
+			conf.ServerName = d.URL.Hostname()
+		}
+		c = tls.Client(c, conf)
+	}
+	var br *bufio.Reader
+	err = handshake(ctx, c, func() error {
+		br, err = d.connect(c, addr)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if br.Buffered() > 0 {
+		// The upstream already spoke, for example its SSH version.
+		return &bufferedConn{Conn: c, r: br}, nil
+	}
+	return c, nil
+}
+
+func (d *HTTPConnect) connect(c net.Conn, addr string) (*bufio.Reader, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	for k, v := range d.Header {
+		req.Header[k] = v
+	}
+	if u := d.URL.User; u != nil {
+		password, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+password)))
+	}
+	if err := req.Write(c); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxydial: HTTP CONNECT to %s failed: %s", addr, resp.Status)
+	}
+	return br, nil
+}
+
+// bufferedConn reads what was buffered while reading the CONNECT response
+// before reading from Conn.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,167 @@
+package proxydial
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// listen serves every connection to a new local listener with fn.
+func listen(t *testing.T, fn func(c net.Conn)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go fn(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// greeter writes a banner like an SSH server and then echoes.
+func greeter(c net.Conn) {
+	defer c.Close()
+	io.WriteString(c, "SSH-2.0-upstream\r\n")
+	io.Copy(c, c)
+}
+
+// socksServer is a minimal SOCKS5 proxy that requires user and password,
+// resolving "upstream" to target.
+func socksServer(target string) func(c net.Conn) {
+	return func(c net.Conn) {
+		defer c.Close()
+		buf := make([]byte, 512)
+		io.ReadFull(c, buf[:3])
+		if buf[2] != socksPasswordAuth {
+			c.Write([]byte{5, socksNoAcceptable})
+			return
+		}
+		c.Write([]byte{5, socksPasswordAuth})
+		io.ReadFull(c, buf[:2])
+		user := make([]byte, buf[1])
+		io.ReadFull(c, user)
+		io.ReadFull(c, buf[:1])
+		pass := make([]byte, buf[0])
+		io.ReadFull(c, pass)
+		if string(user) != "alice" || string(pass) != "secret" {
+			c.Write([]byte{1, 1})
+			return
+		}
+		c.Write([]byte{1, 0})
+
+		io.ReadFull(c, buf[:5])
+		host := make([]byte, buf[4])
+		io.ReadFull(c, host)
+		io.ReadFull(c, buf[:2])
+		port := binary.BigEndian.Uint16(buf)
+		if buf[3] != socksAddrDomainName || string(host) != "upstream" || port != 22 {
+			c.Write([]byte{5, 4, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		u, err := net.Dial("tcp", target)
+		if err != nil {
+			c.Write([]byte{5, 5, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer u.Close()
+		c.Write([]byte{5, 0, 0, socksAddrIPv4, 127, 0, 0, 1, 0, 22})
+		go io.Copy(u, c)
+		io.Copy(c, u)
+	}
+}
+
+// connectServer is a minimal HTTP CONNECT proxy for "upstream:22".
+func connectServer(target string) func(c net.Conn) {
+	return func(c net.Conn) {
+		defer c.Close()
+		br := bufio.NewReader(c)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		if req.Method != http.MethodConnect || req.Host != "upstream:22" {
+			io.WriteString(c, "HTTP/1.1 403 Forbidden\r\n\r\n")
+			return
+		}
+		if user, pass, ok := parseProxyAuth(req); !ok || user != "alice" || pass != "secret" {
+			io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return
+		}
+		u, err := net.Dial("tcp", target)
+		if err != nil {
+			io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+			return
+		}
+		defer u.Close()
+		// The upstream's banner arrives with the response.
+		banner := make([]byte, 18)
+		io.ReadFull(u, banner)
+		c.Write(append([]byte("HTTP/1.1 200 Connection established\r\n\r\n"), banner...))
+		go io.Copy(u, br)
+		io.Copy(c, u)
+	}
+}
+
+func parseProxyAuth(req *http.Request) (string, string, bool) {
+	r := &http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}
+	return r.BasicAuth()
+}
+
+func checkTunnel(t *testing.T, c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	if line, err := br.ReadString('\n'); err != nil || line != "SSH-2.0-upstream\r\n" {
+		t.Fatalf("got banner %q, %v", line, err)
+	}
+	io.WriteString(c, "ping\n")
+	if line, err := br.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Errorf("got echo %q, %v", line, err)
+	}
+}
+
+func TestDialers(t *testing.T) {
+	target := listen(t, greeter)
+	socks := listen(t, socksServer(target))
+	connect := listen(t, connectServer(target))
+
+	for _, proxy := range []string{
+		"socks5://alice:secret@" + socks,
+		"http://alice:secret@" + connect,
+	} {
+		u, _ := url.Parse(proxy)
+		d, err := FromURL(u, nil)
+		if err != nil {
+			t.Fatalf("FromURL(%s): %v", proxy, err)
+		}
+		c, err := d.DialContext(context.Background(), "tcp", "upstream:22")
+		if err != nil {
+			t.Fatalf("%s: %v", u.Scheme, err)
+		}
+		checkTunnel(t, c)
+		if _, err := d.DialContext(context.Background(), "tcp", "elsewhere:22"); err == nil {
+			t.Errorf("%s: dialed a refused destination", u.Scheme)
+		}
+
+		u.User = url.UserPassword("alice", "wrong")
+		d, _ = FromURL(u, nil)
+		if _, err := d.DialContext(context.Background(), "tcp", "upstream:22"); err == nil {
+			t.Errorf("%s: dialed with wrong credentials", u.Scheme)
+		}
+	}
+
+	if _, err := FromURL(&url.URL{Scheme: "ftp", Host: "proxy"}, nil); err == nil {
+		t.Error("FromURL accepted an ftp proxy")
+	}
+}
@@ -0,0 +1,208 @@
+package proxykms
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// AWSCredentials are the credentials of an IAM principal.
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is set for temporary credentials.
+	SessionToken string
+}
+
+// AWS opens asymmetric signing keys of AWS KMS.
+type AWS struct {
+	// Region of the keys, such as "eu-west-1".
+	Region string
+
+	// Credentials returns the credentials to sign requests with. It is
+	// called for every request, so it may refresh temporary credentials.
+	Credentials func() (AWSCredentials, error)
+
+	// Endpoint of the KMS API. If empty, the regional endpoint is used.
+	Endpoint string
+
+	// HTTPClient is used for requests, each of which times out after ten
+	// seconds. If nil, a client with that timeout is used.
+	HTTPClient *http.Client
+
+	// Clock returns the current time. If nil, time.Now is used.
+	Clock func() time.Time
+}
+
+// awsSigningAlgorithms maps the signing algorithms of AWS KMS to hashes.
+var awsSigningAlgorithms = map[string]crypto.Hash{
+	"RSASSA_PKCS1_V1_5_SHA_256": crypto.SHA256,
+	"RSASSA_PKCS1_V1_5_SHA_512": crypto.SHA512,
+	"ECDSA_SHA_256":             crypto.SHA256,
+	"ECDSA_SHA_384":             crypto.SHA384,
+	"ECDSA_SHA_512":             crypto.SHA512,
+}
+
+type awsKey struct {
+	a     *AWS
+	id    string
+	pub   crypto.PublicKey
+	algos []string
+	// kmsAlgos maps hashes to the KMS signing algorithm to request.
+	kmsAlgos map[crypto.Hash]string
+}
+
+// Open returns the key with the given ID, ARN or alias.
+func (a *AWS) Open(keyID string) (Key, error) {
+	var out struct {
+		PublicKey         []byte
+		KeyUsage          string
+		SigningAlgorithms []string
+	}
+	if err := a.call("GetPublicKey", struct{ KeyId string }{keyID}, &out); err != nil {
+		return nil, err
+	}
+	if out.KeyUsage != "SIGN_VERIFY" {
+		return nil, fmt.Errorf("proxykms: key %s has usage %s", keyID, out.KeyUsage)
+	}
+	pub, err := x509.ParsePKIXPublicKey(out.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &awsKey{a: a, id: keyID, pub: pub, kmsAlgos: make(map[crypto.Hash]string)}
+	hashes := make(map[crypto.Hash]bool)
+	for _, algo := range out.SigningAlgorithms {
+		if hash, ok := awsSigningAlgorithms[algo]; ok {
+			hashes[hash] = true
+			k.kmsAlgos[hash] = algo
+		}
+	}
+	k.algos = algorithmsFor(pub, hashes)
+	return k, nil
+}
+
+func (k *awsKey) Public() crypto.PublicKey { return k.pub }
+func (k *awsKey) Algorithms() []string     { return k.algos }
+
+func (k *awsKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	algo, ok := k.kmsAlgos[opts.HashFunc()]
+	if !ok {
+		return nil, fmt.Errorf("proxykms: key %s cannot sign %v digests", k.id, opts.HashFunc())
+	}
+	var out struct{ Signature []byte }
+	err := k.a.call("Sign", struct {
+		KeyId            string
+		Message          []byte
+		MessageType      string
+		SigningAlgorithm string
+	}{k.id, digest, "DIGEST", algo}, &out)
+	return out.Signature, err
+}
+
+func (a *AWS) now() time.Time {
+	if a.Clock != nil {
+		return a.Clock()
+	}
+	return time.Now()
+}
+
+// call invokes an action of the KMS JSON API.
+func (a *AWS) call(action string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	endpoint := a.Endpoint
+	if endpoint == "" {
+		endpoint = "https://kms." + a.Region + ".amazonaws.com/"
+	}
+	req, cancel, err := newRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	creds, err := a.Credentials()
+	if err != nil {
+		return err
+	}
+	signAWSRequest(req, body, creds, a.Region, "kms", a.now())
+
+	resp, err := httpClient(a.HTTPClient).Do(req)
+	if err != nil {
+		return err
+	}
+	b, err := readBody("kms "+action, resp)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// signAWSRequest adds a Signature Version 4 authorization to req, which
+// must have no query and carry only the headers set by call.
+func signAWSRequest(req *http.Request, body []byte, creds AWSCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	// Headers in the sorted order of their lower case names.
+	names := []string{"content-type", "host", "x-amz-date"}
+	if creds.SessionToken != "" {
+		names = append(names, "x-amz-security-token")
+	}
+	names = append(names, "x-amz-target")
+	var canonicalHeaders, signedHeaders string
+	for i, name := range names {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders += name + ":" + value + "\n"
+		if i > 0 {
+			signedHeaders += ";"
+		}
+		signedHeaders += name
+	}
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := req.Method + "\n" + path + "\n\n" +
+		canonicalHeaders + "\n" + signedHeaders + "\n" + sha256Hex(body)
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
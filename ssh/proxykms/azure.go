@@ -0,0 +1,196 @@
+package proxykms
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+)
+
+const azureAPIVersion = "7.4"
+
+// Azure opens keys of Azure Key Vault or Managed HSM.
+type Azure struct {
+	// VaultURL is the URL of the vault, such as
+	// "https://example.vault.azure.net".
+	VaultURL string
+
+	// Token returns a Microsoft Entra ID access token for the vault.
+	Token func() (string, error)
+
+	// HTTPClient is used for requests, each of which times out after ten
+	// seconds. If nil, a client with that timeout is used.
+	HTTPClient *http.Client
+}
+
+var azureCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+type azureKey struct {
+	a    *Azure
+	path string
+	pub  crypto.PublicKey
+	// jwsAlgos maps hashes to the JWS algorithm to request.
+	jwsAlgos map[crypto.Hash]string
+	algos    []string
+}
+
+// Open returns the key with the given name. If version is empty, the
+// current version is used.
+func (a *Azure) Open(name, version string) (Key, error) {
+	path := "keys/" + name
+	if version != "" {
+		path += "/" + version
+	}
+	var out struct {
+		Key struct {
+			Kty string   `json:"kty"`
+			Ops []string `json:"key_ops"`
+			N   string   `json:"n"`
+			E   string   `json:"e"`
+			Crv string   `json:"crv"`
+			X   string   `json:"x"`
+			Y   string   `json:"y"`
+		} `json:"key"`
+	}
+	if err := a.call("GET", path, nil, &out); err != nil {
+		return nil, err
+	}
+	jwk := out.Key
+	k := &azureKey{a: a, path: path, jwsAlgos: make(map[crypto.Hash]string)}
+	dec := base64.RawURLEncoding
+
+	switch strings.TrimSuffix(jwk.Kty, "-HSM") {
+	case "RSA":
+		n, err := dec.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := dec.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		k.pub = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		k.jwsAlgos[crypto.SHA256] = "RS256"
+		k.jwsAlgos[crypto.SHA512] = "RS512"
+	case "EC":
+		curve, ok := azureCurves[jwk.Crv]
+		if !ok {
+			return nil, fmt.Errorf("proxykms: key %s has unsupported curve %s", name, jwk.Crv)
+		}
+		x, err := dec.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := dec.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		k.pub = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		k.jwsAlgos[crypto.SHA256] = "ES256"
+		k.jwsAlgos[crypto.SHA384] = "ES384"
+		k.jwsAlgos[crypto.SHA512] = "ES512"
+	default:
+		return nil, fmt.Errorf("proxykms: key %s has unsupported type %s", name, jwk.Kty)
+	}
+
+	canSign := jwk.Ops == nil
+	for _, op := range jwk.Ops {
+		canSign = canSign || op == "sign"
+	}
+	if !canSign {
+		return nil, fmt.Errorf("proxykms: key %s does not permit signing", name)
+	}
+	hashes := make(map[crypto.Hash]bool)
+	for hash := range k.jwsAlgos {
+		hashes[hash] = true
+	}
+	k.algos = algorithmsFor(k.pub, hashes)
+	return k, nil
+}
+
+func (k *azureKey) Public() crypto.PublicKey { return k.pub }
+func (k *azureKey) Algorithms() []string     { return k.algos }
+
+func (k *azureKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	alg, ok := k.jwsAlgos[opts.HashFunc()]
+	if !ok {
+		return nil, fmt.Errorf("proxykms: key %s cannot sign %v digests", k.path, opts.HashFunc())
+	}
+	in := map[string]string{
+		"alg":   alg,
+		"value": base64.RawURLEncoding.EncodeToString(digest),
+	}
+	var out struct {
+		Value string `json:"value"`
+	}
+	if err := k.a.call("POST", k.path+"/sign", in, &out); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(out.Value)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := k.pub.(*ecdsa.PublicKey); !ok {
+		return sig, nil
+	}
+
+	// Key Vault returns the concatenation of r and s, but crypto.Signer
+	// implementations return them encoded in ASN.1.
+	if len(sig) == 0 || len(sig)%2 != 0 {
+		return nil, errors.New("proxykms: malformed ECDSA signature")
+	}
+	half := len(sig) / 2
+	return asn1.Marshal(struct{ R, S *big.Int }{
+		new(big.Int).SetBytes(sig[:half]),
+		new(big.Int).SetBytes(sig[half:]),
+	})
+}
+
+func (a *Azure) call(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	url := strings.TrimRight(a.VaultURL, "/") + "/" + path + "?api-version=" + azureAPIVersion
+	req, cancel, err := newRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	token, err := a.Token()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := httpClient(a.HTTPClient).Do(req)
+	if err != nil {
+		return err
+	}
+	b, err := readBody("keyvault "+path, resp)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
@@ -0,0 +1,139 @@
+package proxykms
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// GCP opens asymmetric signing key versions of Google Cloud KMS.
+type GCP struct {
+	// Token returns an OAuth 2.0 access token with the cloudkms scope.
+	Token func() (string, error)
+
+	// Endpoint of the KMS API. If empty, https://cloudkms.googleapis.com
+	// is used.
+	Endpoint string
+
+	// HTTPClient is used for requests, each of which times out after ten
+	// seconds. If nil, a client with that timeout is used.
+	HTTPClient *http.Client
+}
+
+// gcpAlgorithms maps the PKCS #1 v1.5 and ECDSA algorithms of Cloud KMS to
+// their hashes. Every key version is bound to one algorithm.
+var gcpAlgorithms = map[string]crypto.Hash{
+	"RSA_SIGN_PKCS1_2048_SHA256": crypto.SHA256,
+	"RSA_SIGN_PKCS1_3072_SHA256": crypto.SHA256,
+	"RSA_SIGN_PKCS1_4096_SHA256": crypto.SHA256,
+	"RSA_SIGN_PKCS1_4096_SHA512": crypto.SHA512,
+	"EC_SIGN_P256_SHA256":        crypto.SHA256,
+	"EC_SIGN_P384_SHA384":        crypto.SHA384,
+}
+
+var gcpDigestFields = map[crypto.Hash]string{
+	crypto.SHA256: "sha256",
+	crypto.SHA384: "sha384",
+	crypto.SHA512: "sha512",
+}
+
+type gcpKey struct {
+	g     *GCP
+	name  string
+	pub   crypto.PublicKey
+	hash  crypto.Hash
+	algos []string
+}
+
+// Open returns the key version with the given resource name, such as
+// "projects/p/locations/global/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1".
+func (g *GCP) Open(name string) (Key, error) {
+	var out struct {
+		Pem       string `json:"pem"`
+		Algorithm string `json:"algorithm"`
+	}
+	if err := g.call("GET", name+"/publicKey", nil, &out); err != nil {
+		return nil, err
+	}
+	hash, ok := gcpAlgorithms[out.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("proxykms: key %s has unsupported algorithm %s", name, out.Algorithm)
+	}
+	block, _ := pem.Decode([]byte(out.Pem))
+	if block == nil {
+		return nil, errors.New("proxykms: malformed public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &gcpKey{
+		g:     g,
+		name:  name,
+		pub:   pub,
+		hash:  hash,
+		algos: algorithmsFor(pub, map[crypto.Hash]bool{hash: true}),
+	}, nil
+}
+
+func (k *gcpKey) Public() crypto.PublicKey { return k.pub }
+func (k *gcpKey) Algorithms() []string     { return k.algos }
+
+func (k *gcpKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != k.hash {
+		return nil, fmt.Errorf("proxykms: key %s cannot sign %v digests", k.name, opts.HashFunc())
+	}
+	in := map[string]interface{}{
+		"digest": map[string][]byte{gcpDigestFields[k.hash]: digest},
+	}
+	var out struct {
+		Signature []byte `json:"signature"`
+	}
+	err := k.g.call("POST", k.name+":asymmetricSign", in, &out)
+	return out.Signature, err
+}
+
+func (g *GCP) call(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	endpoint := g.Endpoint
+	if endpoint == "" {
+		endpoint = "https://cloudkms.googleapis.com"
+	}
+	req, cancel, err := newRequest(method, strings.TrimRight(endpoint, "/")+"/v1/"+path, body)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	token, err := g.Token()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := httpClient(g.HTTPClient).Do(req)
+	if err != nil {
+		return err
+	}
+	b, err := readBody("cloudkms "+path, resp)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
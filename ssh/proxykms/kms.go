@@ -0,0 +1,146 @@
+// Package proxykms provides signers for the ssh proxy whose private keys are
+// held by a cloud key management service: AWS KMS, Google Cloud KMS or Azure
+// Key Vault. The upstream master or user keys then never exist on the proxy
+// host; every signature is made by the service.
+//
+// Open a key with AWS.Open, GCP.Open or Azure.Open and pass it to NewSigner.
+// The resulting signer fits ssh.ProxyConfig.FetchSignerHook. Because KMS keys
+// cannot sign with SHA-1, RSA keys sign with rsa-sha2-512 or rsa-sha2-256,
+// whichever the key supports.
+//
+// The services are called through their REST APIs. Callers supply the
+// credentials: AWS access keys, or OAuth bearer tokens for Google Cloud and
+// Azure, typically from the instance's metadata service.
+package proxykms
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Key is a key held by a KMS. Its Sign method is called with a digest and
+// returns a PKCS #1 v1.5 signature for RSA keys or an ASN.1 encoded
+// signature for ECDSA keys, as crypto.Signer requires.
+type Key interface {
+	crypto.Signer
+
+	// Algorithms returns the SSH signature algorithms the key can make,
+	// most preferred first.
+	Algorithms() []string
+}
+
+// signer is an ssh.MultiAlgorithmSigner for a Key.
+type signer struct {
+	ssh.AlgorithmSigner
+	algos []string
+}
+
+// NewSigner returns an ssh.Signer that signs with k.
+func NewSigner(k Key) (ssh.Signer, error) {
+	algos := k.Algorithms()
+	if len(algos) == 0 {
+		return nil, errors.New("proxykms: key supports no SSH signature algorithm")
+	}
+	s, err := ssh.NewSignerFromSigner(k)
+	if err != nil {
+		return nil, err
+	}
+	as, ok := s.(ssh.AlgorithmSigner)
+	if !ok {
+		return nil, fmt.Errorf("proxykms: unsupported key type %T", k.Public())
+	}
+	return &signer{as, algos}, nil
+}
+
+func (s *signer) Algorithms() []string { return s.algos }
+
+func (s *signer) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, s.algos[0])
+}
+
+// rsaAlgorithms returns the SSH algorithms for RSA keys supporting the given
+// hashes.
+func rsaAlgorithms(sha512, sha256 bool) []string {
+	var algos []string
+	if sha512 {
+		algos = append(algos, ssh.SigAlgoRSASHA2512)
+	}
+	if sha256 {
+		algos = append(algos, ssh.SigAlgoRSASHA2256)
+	}
+	return algos
+}
+
+// algorithmsFor returns the SSH algorithms a key that can sign with the given
+// hashes supports.
+func algorithmsFor(pub crypto.PublicKey, hashes map[crypto.Hash]bool) []string {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return rsaAlgorithms(hashes[crypto.SHA512], hashes[crypto.SHA256])
+	case *ecdsa.PublicKey:
+		// SSH fixes the hash of each curve.
+		var algo string
+		var hash crypto.Hash
+		switch pub.Curve {
+		case elliptic.P256():
+			algo, hash = ssh.KeyAlgoECDSA256, crypto.SHA256
+		case elliptic.P384():
+			algo, hash = ssh.KeyAlgoECDSA384, crypto.SHA384
+		case elliptic.P521():
+			algo, hash = ssh.KeyAlgoECDSA521, crypto.SHA512
+		}
+		if hashes[hash] {
+			return []string{algo}
+		}
+	}
+	return nil
+}
+
+// requestTimeout bounds every call to a service, because signatures are
+// made while a login waits for them.
+var requestTimeout = 10 * time.Second
+
+var defaultHTTPClient = &http.Client{Timeout: requestTimeout}
+
+func httpClient(c *http.Client) *http.Client {
+	if c == nil {
+		return defaultHTTPClient
+	}
+	return c
+}
+
+// newRequest is like http.NewRequest, but the request is cancelled after
+// requestTimeout. cancel must be called once the response was read.
+func newRequest(method, url string, body io.Reader) (req *http.Request, cancel context.CancelFunc, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	req, err = http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return req, cancel, nil
+}
+
+// readBody reads a response body and turns unsuccessful responses into
+// errors.
+func readBody(what string, resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("proxykms: %s: %s: %s", what, resp.Status, body)
+	}
+	return body, nil
+}
@@ -0,0 +1,242 @@
+package proxykms
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/testdata"
+)
+
+func testKey(t *testing.T, name string) crypto.Signer {
+	k, err := ssh.ParseRawPrivateKey(testdata.PEMBytes[name])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k.(crypto.Signer)
+}
+
+// checkSigner signs with s and verifies the signature, which must have the
+// given format.
+func checkSigner(t *testing.T, s ssh.Signer, format string) {
+	t.Helper()
+	data := []byte("sign me")
+	sig, err := s.Sign(rand.Reader, data)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if sig.Format != format {
+		t.Errorf("got signature format %q, want %q", sig.Format, format)
+	}
+	if err := s.PublicKey().Verify(data, sig); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestAWS(t *testing.T) {
+	priv := testKey(t, "rsa")
+	der, err := x509.MarshalPKIXPublicKey(priv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/20240301/eu-west-1/kms/aws4_request, SignedHeaders=content-type;host;x-amz-date;x-amz-security-token;x-amz-target, Signature=") {
+			t.Errorf("unexpected authorization %q", auth)
+		}
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.GetPublicKey":
+			writeJSON(w, map[string]interface{}{
+				"PublicKey":         der,
+				"KeyUsage":          "SIGN_VERIFY",
+				"SigningAlgorithms": []string{"RSASSA_PSS_SHA_256", "RSASSA_PKCS1_V1_5_SHA_256", "RSASSA_PKCS1_V1_5_SHA_512"},
+			})
+		case "TrentService.Sign":
+			var in struct {
+				Message          []byte
+				MessageType      string
+				SigningAlgorithm string
+			}
+			json.NewDecoder(r.Body).Decode(&in)
+			if in.MessageType != "DIGEST" || in.SigningAlgorithm != "RSASSA_PKCS1_V1_5_SHA_512" {
+				t.Errorf("unexpected sign request %+v", in)
+			}
+			sig, _ := priv.Sign(rand.Reader, in.Message, crypto.SHA512)
+			writeJSON(w, map[string]interface{}{"Signature": sig})
+		default:
+			http.Error(w, "unknown action", http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	a := &AWS{
+		Region:   "eu-west-1",
+		Endpoint: srv.URL,
+		Credentials: func() (AWSCredentials, error) {
+			return AWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "token"}, nil
+		},
+		Clock: func() time.Time { return now },
+	}
+	k, err := a.Open("alias/proxy")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	s, err := NewSigner(k)
+	if err != nil {
+		t.Fatalf("NewSigner: %v", err)
+	}
+	ms, ok := s.(ssh.MultiAlgorithmSigner)
+	if !ok || len(ms.Algorithms()) != 2 {
+		t.Fatalf("got algorithms %v, want rsa-sha2-512 and rsa-sha2-256", ms.Algorithms())
+	}
+	checkSigner(t, s, ssh.SigAlgoRSASHA2512)
+}
+
+func TestGCP(t *testing.T) {
+	priv := testKey(t, "ecdsa")
+	der, err := x509.MarshalPKIXPublicKey(priv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const name = "projects/p/locations/global/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer gcp-token" {
+			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/" + name + "/publicKey":
+			writeJSON(w, map[string]string{
+				"pem":       string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+				"algorithm": "EC_SIGN_P256_SHA256",
+			})
+		case "/v1/" + name + ":asymmetricSign":
+			var in struct {
+				Digest struct {
+					SHA256 []byte `json:"sha256"`
+				} `json:"digest"`
+			}
+			json.NewDecoder(r.Body).Decode(&in)
+			sig, _ := priv.Sign(rand.Reader, in.Digest.SHA256, crypto.SHA256)
+			writeJSON(w, map[string][]byte{"signature": sig})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	g := &GCP{Endpoint: srv.URL, Token: func() (string, error) { return "gcp-token", nil }}
+	k, err := g.Open(name)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	s, err := NewSigner(k)
+	if err != nil {
+		t.Fatalf("NewSigner: %v", err)
+	}
+	checkSigner(t, s, ssh.KeyAlgoECDSA256)
+}
+
+func TestAzure(t *testing.T) {
+	rsaKey := testKey(t, "rsa").(*rsa.PrivateKey)
+	ecKey := testKey(t, "ecdsa").(*ecdsa.PrivateKey)
+	enc := base64.RawURLEncoding
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("api-version") != azureAPIVersion {
+			t.Errorf("got api-version %q", r.URL.Query().Get("api-version"))
+		}
+		switch r.URL.Path {
+		case "/keys/rsa":
+			writeJSON(w, map[string]interface{}{"key": map[string]interface{}{
+				"kty": "RSA-HSM", "key_ops": []string{"sign", "verify"},
+				"n": enc.EncodeToString(rsaKey.N.Bytes()), "e": enc.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+			}})
+		case "/keys/ec/v2":
+			writeJSON(w, map[string]interface{}{"key": map[string]interface{}{
+				"kty": "EC", "crv": "P-256",
+				"x": enc.EncodeToString(ecKey.X.Bytes()), "y": enc.EncodeToString(ecKey.Y.Bytes()),
+			}})
+		case "/keys/rsa/sign", "/keys/ec/v2/sign":
+			var in struct {
+				Alg   string `json:"alg"`
+				Value string `json:"value"`
+			}
+			json.NewDecoder(r.Body).Decode(&in)
+			digest, _ := enc.DecodeString(in.Value)
+			var sig []byte
+			switch in.Alg {
+			case "RS512":
+				sig, _ = rsaKey.Sign(rand.Reader, digest, crypto.SHA512)
+			case "ES256":
+				r, s, _ := ecdsa.Sign(rand.Reader, ecKey, digest)
+				sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+			default:
+				t.Errorf("unexpected algorithm %q", in.Alg)
+			}
+			writeJSON(w, map[string]string{"value": enc.EncodeToString(sig)})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	a := &Azure{VaultURL: srv.URL, Token: func() (string, error) { return "azure-token", nil }}
+	for _, tc := range []struct{ name, version, format string }{
+		{"rsa", "", ssh.SigAlgoRSASHA2512},
+		{"ec", "v2", ssh.KeyAlgoECDSA256},
+	} {
+		k, err := a.Open(tc.name, tc.version)
+		if err != nil {
+			t.Fatalf("Open(%s): %v", tc.name, err)
+		}
+		s, err := NewSigner(k)
+		if err != nil {
+			t.Fatalf("NewSigner(%s): %v", tc.name, err)
+		}
+		checkSigner(t, s, tc.format)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	defer func(d time.Duration) { requestTimeout = d }(requestTimeout)
+	requestTimeout = 50 * time.Millisecond
+	stalled := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stalled
+	}))
+	defer srv.Close()
+	defer close(stalled)
+
+	g := &GCP{Endpoint: srv.URL, Token: func() (string, error) { return "gcp-token", nil }}
+	done := make(chan error, 1)
+	go func() {
+		_, err := g.Open("projects/p/locations/global/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Open succeeded against a stalled service")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request to a stalled service did not time out")
+	}
+}
@@ -0,0 +1,332 @@
+// Package proxyredis implements the shared state interfaces of the ssh
+// proxy (ssh.RateLimiter, ssh.BanList, ssh.SessionRegistry and
+// ssh.HookCache) on top of Redis, so that a horizontally scaled fleet of
+// proxies enforces limits and lists sessions consistently across nodes.
+// SessionRegistry also implements ssh.SessionTerminator using publish and
+// subscribe, so sessions can be terminated from any node, and
+// LeaderElector implements ssh.LeaderElector for ssh.JobScheduler.
+//
+// The package contains its own minimal RESP client, which is sufficient for
+// the handful of commands it issues.
+package proxyredis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Error is an error reply sent by the Redis server.
+type Error string
+
+func (e Error) Error() string { return "redis: " + string(e) }
+
+// errNil is returned by readReply for a nil bulk string or array.
+var errNil = errors.New("redis: nil reply")
+
+const defaultTimeout = 5 * time.Second
+
+// Subscriptions are restored after a delay that starts at minBackoff and
+// doubles with every failed attempt, up to maxBackoff.
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+// Client sends commands to a Redis server over a single connection, which
+// is re-established after network errors. It is safe for concurrent use;
+// commands are issued one at a time.
+type Client struct {
+	// Prefix is prepended to every key. It defaults to "sshr:".
+	Prefix string
+	// Timeout bounds each command, so that a hung server does not block
+	// the logins waiting for the connection. It defaults to five seconds.
+	Timeout time.Duration
+
+	// ErrorHook, if non-nil, is called with the errors of work done in the
+	// background: lost subscriptions and failed attempts to restore them,
+	// and failures to refresh the sessions of a SessionRegistry.
+	ErrorHook func(error)
+
+	dial func() (net.Conn, error)
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// NewClient returns a client for the Redis server at addr. The connection
+// is established by the first command.
+func NewClient(addr string) *Client {
+	return NewClientWithDialer(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", addr, 10*time.Second)
+	})
+}
+
+// NewClientWithDialer returns a client that uses dial to connect, for
+// example to add TLS or authentication.
+func NewClientWithDialer(dial func() (net.Conn, error)) *Client {
+	return &Client{Prefix: "sshr:", Timeout: defaultTimeout, dial: dial}
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return defaultTimeout
+	}
+	return c.Timeout
+}
+
+// Close closes the current connection, if any.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+func (c *Client) key(parts ...string) string {
+	k := c.Prefix
+	for i, p := range parts {
+		if i > 0 {
+			k += ":"
+		}
+		k += p
+	}
+	return k
+}
+
+// Do sends a command and returns its reply, which is a string, an int64, a
+// []interface{} or nil for nil replies. Error replies are returned as Error.
+func (c *Client) Do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		conn, err := c.dial()
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+		c.r = bufio.NewReader(conn)
+	}
+
+	reply, err := c.roundTrip(args)
+	if err != nil {
+		if _, ok := err.(Error); !ok && err != errNil {
+			c.conn.Close()
+			c.conn = nil
+		}
+	}
+	if err == errNil {
+		return nil, nil
+	}
+	return reply, err
+}
+
+func (c *Client) roundTrip(args []string) (interface{}, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout())); err != nil {
+		return nil, err
+	}
+	buf := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, a := range args {
+		buf = append(buf, fmt.Sprintf("$%d\r\n", len(a))...)
+		buf = append(buf, a...)
+		buf = append(buf, "\r\n"...)
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return readReply(c.r)
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: malformed reply line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errNil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errNil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			item, err := readReply(r)
+			if err != nil && err != errNil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", line[0])
+}
+
+func (c *Client) int(args ...string) (int64, error) {
+	reply, err := c.Do(args...)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected reply %v to %s", reply, args[0])
+	}
+	return n, nil
+}
+
+func millis(d time.Duration) string {
+	ms := d.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	return strconv.FormatInt(ms, 10)
+}
+
+func (c *Client) reportError(err error) {
+	if c.ErrorHook != nil {
+		c.ErrorHook(err)
+	}
+}
+
+// subscribe opens a dedicated connection subscribed to channel and calls fn
+// with the payload of every message published to it, until stop is called.
+// If the connection is lost, it is re-established with backoff; messages
+// published in the meantime are lost.
+func (c *Client) subscribe(channel string, fn func(payload string)) (stop func(), err error) {
+	conn, r, err := c.subscribeConn(channel)
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	done := make(chan struct{})
+	go func() {
+		for {
+			err := readMessages(r, fn)
+			select {
+			case <-done:
+				return
+			default:
+			}
+			c.reportError(fmt.Errorf("redis: subscription to %s lost: %v", channel, err))
+
+			for delay := minBackoff; ; delay *= 2 {
+				if delay > maxBackoff {
+					delay = maxBackoff
+				}
+				select {
+				case <-done:
+					return
+				case <-time.After(delay):
+				}
+				var newConn net.Conn
+				newConn, r, err = c.subscribeConn(channel)
+				if err == nil {
+					mu.Lock()
+					conn = newConn
+					mu.Unlock()
+					break
+				}
+				c.reportError(fmt.Errorf("redis: resubscribing to %s: %v", channel, err))
+			}
+			// stop may have closed the previous connection meanwhile.
+			select {
+			case <-done:
+				conn.Close()
+				return
+			default:
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			mu.Lock()
+			conn.Close()
+			mu.Unlock()
+		})
+	}, nil
+}
+
+// subscribeConn dials a connection subscribed to channel.
+func (c *Client) subscribeConn(channel string) (net.Conn, *bufio.Reader, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	sub := &Client{dial: c.dial, Timeout: c.Timeout, conn: conn, r: bufio.NewReader(conn)}
+	if _, err := sub.roundTrip([]string{"SUBSCRIBE", channel}); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	// Messages may take arbitrarily long to arrive.
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, sub.r, nil
+}
+
+// readMessages calls fn with the payload of every message read from r, until
+// reading fails.
+func readMessages(r *bufio.Reader, fn func(payload string)) error {
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return err
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 3 || items[0] != "message" {
+			continue
+		}
+		if payload, ok := items[2].(string); ok {
+			fn(payload)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package proxyredis
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// RateLimiter implements ssh.RateLimiter with a fixed window counter per
+// key.
+type RateLimiter struct {
+	c      *Client
+	limit  int64
+	window time.Duration
+}
+
+// NewRateLimiter returns a limiter that allows limit events per key in each
+// window.
+func NewRateLimiter(c *Client, limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{c: c, limit: int64(limit), window: window}
+}
+
+// rateScript counts an event and starts the window with the first one, in
+// one step, so that a counter never outlives its window.
+const rateScript = `local n = redis.call("INCR", KEYS[1]) if n == 1 then redis.call("PEXPIRE", KEYS[1], ARGV[1]) end return n`
+
+// Allow implements ssh.RateLimiter.
+func (l *RateLimiter) Allow(key string) (bool, error) {
+	n, err := l.c.int("EVAL", rateScript, "1", l.c.key("rate", key), millis(l.window))
+	if err != nil {
+		return false, err
+	}
+	return n <= l.limit, nil
+}
+
+// BanList implements ssh.BanList. Bans expire on their own.
+type BanList struct {
+	c *Client
+}
+
+// NewBanList returns a ban list stored through c.
+func NewBanList(c *Client) *BanList {
+	return &BanList{c: c}
+}
+
+// Ban bans key for the given duration.
+func (b *BanList) Ban(key string, d time.Duration) error {
+	_, err := b.c.Do("SET", b.c.key("ban", key), "1", "PX", millis(d))
+	return err
+}
+
+// Unban lifts a ban on key.
+func (b *BanList) Unban(key string) error {
+	_, err := b.c.Do("DEL", b.c.key("ban", key))
+	return err
+}
+
+// Banned implements ssh.BanList.
+func (b *BanList) Banned(key string) (bool, error) {
+	n, err := b.c.int("EXISTS", b.c.key("ban", key))
+	return n > 0, err
+}
+
+// DefaultSessionTTL is used if SessionRegistry.TTL is zero.
+const DefaultSessionTTL = time.Minute
+
+// registerScript stores a session and its expiry in one step.
+const registerScript = `redis.call("HSET", KEYS[1], ARGV[1], ARGV[2]) return redis.call("ZADD", KEYS[2], ARGV[3], ARGV[1])`
+
+// unregisterScript removes a session and its expiry in one step.
+const unregisterScript = `redis.call("ZREM", KEYS[2], ARGV[1]) return redis.call("HDEL", KEYS[1], ARGV[1])`
+
+// listScript removes the sessions that expired before ARGV[1] and returns
+// the others.
+const listScript = `for _, id in ipairs(redis.call("ZRANGEBYSCORE", KEYS[2], "-inf", ARGV[1])) do redis.call("HDEL", KEYS[1], id) redis.call("ZREM", KEYS[2], id) end return redis.call("HVALS", KEYS[1])`
+
+// SessionRegistry implements ssh.SessionRegistry with a single hash holding
+// the sessions of all nodes. Each session expires TTL after it was
+// registered; the registry refreshes the sessions it registered until they
+// are unregistered, so that those of a crashed node expire.
+type SessionRegistry struct {
+	// TTL is how long a session outlives its last refresh. If zero,
+	// DefaultSessionTTL is used.
+	TTL time.Duration
+
+	c *Client
+
+	mu         sync.Mutex
+	local      map[string]bool
+	refreshing bool
+}
+
+// NewSessionRegistry returns a session registry stored through c.
+func NewSessionRegistry(c *Client) *SessionRegistry {
+	return &SessionRegistry{c: c}
+}
+
+func (s *SessionRegistry) ttl() time.Duration {
+	if s.TTL <= 0 {
+		return DefaultSessionTTL
+	}
+	return s.TTL
+}
+
+func expiryScore(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
+
+// Register implements ssh.SessionRegistry.
+func (s *SessionRegistry) Register(info ssh.SessionInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	_, err = s.c.Do("EVAL", registerScript, "2", s.c.key("sessions"), s.c.key("sessions", "expiry"),
+		info.ID, string(data), expiryScore(time.Now().Add(s.ttl())))
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.local == nil {
+		s.local = make(map[string]bool)
+	}
+	s.local[info.ID] = true
+	if !s.refreshing {
+		s.refreshing = true
+		go s.refresh()
+	}
+	return nil
+}
+
+// refresh extends the expiry of the local sessions until there are none.
+func (s *SessionRegistry) refresh() {
+	ticker := time.NewTicker(s.ttl() / 3)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.Lock()
+		if len(s.local) == 0 {
+			s.refreshing = false
+			s.mu.Unlock()
+			return
+		}
+		args := []string{"ZADD", s.c.key("sessions", "expiry"), "XX"}
+		score := expiryScore(time.Now().Add(s.ttl()))
+		for id := range s.local {
+			args = append(args, score, id)
+		}
+		s.mu.Unlock()
+
+		if _, err := s.c.Do(args...); err != nil {
+			s.c.reportError(fmt.Errorf("redis: refreshing sessions: %v", err))
+		}
+	}
+}
+
+// Unregister implements ssh.SessionRegistry.
+func (s *SessionRegistry) Unregister(id string) error {
+	s.mu.Lock()
+	delete(s.local, id)
+	s.mu.Unlock()
+	_, err := s.c.Do("EVAL", unregisterScript, "2", s.c.key("sessions"), s.c.key("sessions", "expiry"), id)
+	return err
+}
+
+// ListSessions implements ssh.SessionRegistry.
+func (s *SessionRegistry) ListSessions() ([]ssh.SessionInfo, error) {
+	reply, err := s.c.Do("EVAL", listScript, "2", s.c.key("sessions"), s.c.key("sessions", "expiry"), expiryScore(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected reply %v to HVALS", reply)
+	}
+
+	var sessions []ssh.SessionInfo
+	for _, item := range items {
+		data, ok := item.(string)
+		if !ok {
+			continue
+		}
+		var info ssh.SessionInfo
+		if err := json.Unmarshal([]byte(data), &info); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, info)
+	}
+	return sessions, nil
+}
+
+// HookCache implements ssh.HookCache.
+type HookCache struct {
+	c *Client
+}
+
+// NewHookCache returns a hook cache stored through c.
+func NewHookCache(c *Client) *HookCache {
+	return &HookCache{c: c}
+}
+
+// Get implements ssh.HookCache.
+func (h *HookCache) Get(key string) ([]byte, bool, error) {
+	reply, err := h.c.Do("GET", h.c.key("cache", key))
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+	data, ok := reply.(string)
+	if !ok {
+		return nil, false, fmt.Errorf("redis: unexpected reply %v to GET", reply)
+	}
+	return []byte(data), true, nil
+}
+
+// Set implements ssh.HookCache.
+func (h *HookCache) Set(key string, value []byte, ttl time.Duration) error {
+	_, err := h.c.Do("SET", h.c.key("cache", key), string(value), "PX", millis(ttl))
+	return err
+}
+
+// Install makes conf use the Redis backed shared state. authLimit and
+// authWindow configure the rate limiter for authentication attempts.
+func Install(conf *ssh.ProxyConfig, c *Client, authLimit int, authWindow time.Duration) {
+	conf.AuthRateLimiter = NewRateLimiter(c, authLimit, authWindow)
+	conf.BanList = NewBanList(c)
+	conf.SessionRegistry = NewSessionRegistry(c)
+	conf.HookCache = NewHookCache(c)
+}
+
+// RequestTermination implements ssh.SessionTerminator by publishing id on
+// the channel of node.
+func (s *SessionRegistry) RequestTermination(node, id string) error {
+	_, err := s.c.Do("PUBLISH", s.c.key("terminate", node), id)
+	return err
+}
+
+// SubscribeTerminations implements ssh.SessionTerminator.
+func (s *SessionRegistry) SubscribeTerminations(node string, fn func(id string)) (stop func(), err error) {
+	return s.c.subscribe(s.c.key("terminate", node), fn)
+}
+
+// renewScript extends a lease only if it is still held by the caller.
+const renewScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) else return 0 end`
+
+// releaseScript deletes a lease only if it is still held by the caller.
+const releaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`
+
+// LeaderElector implements ssh.LeaderElector with one key per lease.
+type LeaderElector struct {
+	c *Client
+}
+
+// NewLeaderElector returns a leader elector stored through c.
+func NewLeaderElector(c *Client) *LeaderElector {
+	return &LeaderElector{c: c}
+}
+
+// Acquire implements ssh.LeaderElector.
+func (l *LeaderElector) Acquire(name, node string, ttl time.Duration) (bool, error) {
+	k := l.c.key("leader", name)
+	reply, err := l.c.Do("SET", k, node, "NX", "PX", millis(ttl))
+	if err != nil {
+		return false, err
+	}
+	if reply != nil {
+		return true, nil
+	}
+	n, err := l.c.int("EVAL", renewScript, "1", k, node, millis(ttl))
+	return n == 1, err
+}
+
+// Release implements ssh.LeaderElector.
+func (l *LeaderElector) Release(name, node string) error {
+	_, err := l.c.Do("EVAL", releaseScript, "1", l.c.key("leader", name), node)
+	return err
+}
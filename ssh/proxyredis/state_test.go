@@ -0,0 +1,432 @@
+package proxyredis
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeRedis is an in-memory server implementing the commands used by this
+// package. Expiry is not implemented.
+type fakeRedis struct {
+	mu          sync.Mutex
+	values      map[string]string
+	hashes      map[string]map[string]string
+	zsets       map[string]map[string]int64
+	subscribers map[string][]*fakeConn
+}
+
+// fakeConn serializes writes from the serving and publishing goroutines.
+type fakeConn struct {
+	mu sync.Mutex
+	net.Conn
+}
+
+func (c *fakeConn) write(s string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.Conn.Write([]byte(s))
+	return err
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{
+		values:      make(map[string]string),
+		hashes:      make(map[string]map[string]string),
+		zsets:       make(map[string]map[string]int64),
+		subscribers: make(map[string][]*fakeConn),
+	}
+}
+
+// client returns a Client connected to f over an in-memory pipe.
+func (f *fakeRedis) client() *Client {
+	return NewClientWithDialer(func() (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		go f.serve(c1)
+		return c2, nil
+	})
+}
+
+func (f *fakeRedis) serve(nc net.Conn) {
+	defer nc.Close()
+	c := &fakeConn{Conn: nc}
+	r := bufio.NewReader(c)
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return
+		}
+		items := reply.([]interface{})
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i] = item.(string)
+		}
+		if strings.ToUpper(args[0]) == "SUBSCRIBE" {
+			f.mu.Lock()
+			f.subscribers[args[1]] = append(f.subscribers[args[1]], c)
+			f.mu.Unlock()
+			if err := c.write("*3\r\n" + bulk("subscribe") + bulk(args[1]) + ":1\r\n"); err != nil {
+				return
+			}
+			continue
+		}
+		if err := c.write(f.exec(args)); err != nil {
+			return
+		}
+	}
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func (f *fakeRedis) exec(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "INCR":
+		return f.incr(args[1])
+	case "SET":
+		if len(args) > 3 && strings.ToUpper(args[3]) == "NX" {
+			if _, ok := f.values[args[1]]; ok {
+				return "$-1\r\n"
+			}
+		}
+		f.values[args[1]] = args[2]
+		return "+OK\r\n"
+	case "EVAL":
+		// Only the counter script of RateLimiter and the
+		// compare-and-renew and compare-and-delete scripts of
+		// LeaderElector are supported.
+		switch args[1] {
+		case rateScript:
+			return f.incr(args[3])
+		case registerScript:
+			f.hset(args[3], args[5], args[6])
+			f.zadd(args[4], args[5], args[7])
+			return ":1\r\n"
+		case unregisterScript:
+			delete(f.zsets[args[4]], args[5])
+			delete(f.hashes[args[3]], args[5])
+			return ":1\r\n"
+		case listScript:
+			var now int64
+			fmt.Sscan(args[5], &now)
+			for id, expiry := range f.zsets[args[4]] {
+				if expiry <= now {
+					delete(f.hashes[args[3]], id)
+					delete(f.zsets[args[4]], id)
+				}
+			}
+			return f.hvals(args[3])
+		}
+		key, owner := args[3], args[4]
+		if f.values[key] != owner {
+			return ":0\r\n"
+		}
+		if args[1] == releaseScript {
+			delete(f.values, key)
+		}
+		return ":1\r\n"
+	case "GET":
+		v, ok := f.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(v)
+	case "DEL":
+		delete(f.values, args[1])
+		return ":1\r\n"
+	case "EXISTS":
+		if _, ok := f.values[args[1]]; ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "PUBLISH":
+		subs := f.subscribers[args[1]]
+		for _, sub := range subs {
+			go sub.write("*3\r\n" + bulk("message") + bulk(args[1]) + bulk(args[2]))
+		}
+		return fmt.Sprintf(":%d\r\n", len(subs))
+	case "ZADD":
+		// Only updates of existing members, with XX, are supported.
+		z := f.zsets[args[1]]
+		for i := 3; i+1 < len(args); i += 2 {
+			if _, ok := z[args[i+1]]; ok {
+				f.zadd(args[1], args[i+1], args[i])
+			}
+		}
+		return ":0\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+// The helpers below implement commands for exec. f.mu must be held.
+
+func (f *fakeRedis) hset(key, field, value string) {
+	h, ok := f.hashes[key]
+	if !ok {
+		h = make(map[string]string)
+		f.hashes[key] = h
+	}
+	h[field] = value
+}
+
+func (f *fakeRedis) hvals(key string) string {
+	h := f.hashes[key]
+	out := fmt.Sprintf("*%d\r\n", len(h))
+	for _, v := range h {
+		out += bulk(v)
+	}
+	return out
+}
+
+func (f *fakeRedis) zadd(key, member, score string) {
+	z, ok := f.zsets[key]
+	if !ok {
+		z = make(map[string]int64)
+		f.zsets[key] = z
+	}
+	var n int64
+	fmt.Sscan(score, &n)
+	z[member] = n
+}
+
+// incr implements INCR.
+func (f *fakeRedis) incr(key string) string {
+	var n int
+	fmt.Sscan(f.values[key], &n)
+	n++
+	f.values[key] = fmt.Sprint(n)
+	return fmt.Sprintf(":%d\r\n", n)
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(newFakeRedis().client(), 2, time.Minute)
+	for i, want := range []bool{true, true, false} {
+		ok, err := l.Allow("user:alice")
+		if err != nil {
+			t.Fatalf("Allow: %v", err)
+		}
+		if ok != want {
+			t.Errorf("attempt %d: got %v, want %v", i, ok, want)
+		}
+	}
+	if ok, _ := l.Allow("user:bob"); !ok {
+		t.Error("limit for alice applied to bob")
+	}
+}
+
+func TestBanList(t *testing.T) {
+	b := NewBanList(newFakeRedis().client())
+	if banned, err := b.Banned("ip:192.0.2.1"); err != nil || banned {
+		t.Fatalf("Banned before Ban = %v, %v", banned, err)
+	}
+	b.Ban("ip:192.0.2.1", time.Hour)
+	if banned, _ := b.Banned("ip:192.0.2.1"); !banned {
+		t.Error("banned key not reported")
+	}
+	b.Unban("ip:192.0.2.1")
+	if banned, _ := b.Banned("ip:192.0.2.1"); banned {
+		t.Error("unbanned key still reported")
+	}
+}
+
+func TestSessionRegistry(t *testing.T) {
+	f := newFakeRedis()
+	node1 := NewSessionRegistry(f.client())
+	node2 := NewSessionRegistry(f.client())
+
+	node1.Register(ssh.SessionInfo{ID: "a", Node: "node1", User: "alice"})
+	node2.Register(ssh.SessionInfo{ID: "b", Node: "node2", User: "bob"})
+
+	sessions, err := node1.ListSessions()
+	if err != nil {
+		t.Fatalf("ListSessions: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("got %d sessions, want 2", len(sessions))
+	}
+
+	node2.Unregister("b")
+	sessions, _ = node1.ListSessions()
+	if len(sessions) != 1 || sessions[0].User != "alice" {
+		t.Errorf("after Unregister got %v", sessions)
+	}
+}
+
+func TestHookCache(t *testing.T) {
+	h := NewHookCache(newFakeRedis().client())
+	if _, ok, err := h.Get("authorized_keys:alice"); ok || err != nil {
+		t.Fatalf("Get on empty cache = %v, %v", ok, err)
+	}
+	h.Set("authorized_keys:alice", []byte("keys"), time.Minute)
+	data, ok, err := h.Get("authorized_keys:alice")
+	if err != nil || !ok || string(data) != "keys" {
+		t.Errorf("Get = %q, %v, %v", data, ok, err)
+	}
+}
+
+func TestClientErrorReply(t *testing.T) {
+	c := newFakeRedis().client()
+	_, err := c.Do("NOSUCHCOMMAND")
+	if _, ok := err.(Error); !ok {
+		t.Fatalf("got %v, want an Error", err)
+	}
+	if _, err := c.Do("GET", "x"); err != nil {
+		t.Errorf("connection unusable after error reply: %v", err)
+	}
+}
+
+func TestSessionTermination(t *testing.T) {
+	r := NewSessionRegistry(newFakeRedis().client())
+	got := make(chan string, 1)
+	stop, err := r.SubscribeTerminations("node2", func(id string) { got <- id })
+	if err != nil {
+		t.Fatalf("SubscribeTerminations: %v", err)
+	}
+	defer stop()
+
+	if err := r.RequestTermination("node2", "abc"); err != nil {
+		t.Fatalf("RequestTermination: %v", err)
+	}
+	select {
+	case id := <-got:
+		if id != "abc" {
+			t.Errorf("got termination of %q, want %q", id, "abc")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("termination request not delivered")
+	}
+}
+
+// dropSubscribers closes the connections of all subscribers.
+func (f *fakeRedis) dropSubscribers() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for channel, subs := range f.subscribers {
+		for _, sub := range subs {
+			sub.Close()
+		}
+		delete(f.subscribers, channel)
+	}
+}
+
+func TestSessionTerminationResubscribes(t *testing.T) {
+	f := newFakeRedis()
+	c := f.client()
+	lost := make(chan error, 10)
+	c.ErrorHook = func(err error) { lost <- err }
+	r := NewSessionRegistry(c)
+	got := make(chan string, 10)
+	stop, err := r.SubscribeTerminations("node2", func(id string) { got <- id })
+	if err != nil {
+		t.Fatalf("SubscribeTerminations: %v", err)
+	}
+	defer stop()
+
+	f.dropSubscribers()
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lost subscription not reported")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := r.RequestTermination("node2", "abc"); err != nil {
+			t.Fatalf("RequestTermination: %v", err)
+		}
+		select {
+		case <-got:
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("termination requests not delivered after the connection was lost")
+		}
+	}
+}
+
+func TestSessionRegistryExpiry(t *testing.T) {
+	f := newFakeRedis()
+	crashed := NewSessionRegistry(f.client())
+	crashed.TTL = 30 * time.Millisecond
+	live := NewSessionRegistry(f.client())
+	live.TTL = 30 * time.Millisecond
+	crashed.Register(ssh.SessionInfo{ID: "a", Node: "node1", User: "alice"})
+	live.Register(ssh.SessionInfo{ID: "b", Node: "node2", User: "bob"})
+	defer live.Unregister("b")
+	// A crashed node no longer refreshes its sessions.
+	crashed.mu.Lock()
+	crashed.local = nil
+	crashed.mu.Unlock()
+
+	time.Sleep(100 * time.Millisecond)
+	sessions, err := live.ListSessions()
+	if err != nil {
+		t.Fatalf("ListSessions: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != "b" {
+		t.Errorf("got sessions %v, want only the refreshed one", sessions)
+	}
+}
+
+func TestLeaderElector(t *testing.T) {
+	l := NewLeaderElector(newFakeRedis().client())
+	for _, tc := range []struct {
+		node string
+		want bool
+	}{
+		{"node1", true},
+		{"node2", false},
+		{"node1", true},
+	} {
+		ok, err := l.Acquire("health", tc.node, time.Minute)
+		if err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+		if ok != tc.want {
+			t.Errorf("Acquire for %s = %v, want %v", tc.node, ok, tc.want)
+		}
+	}
+
+	l.Release("health", "node2")
+	if ok, _ := l.Acquire("health", "node2", time.Minute); ok {
+		t.Error("release by a non-leader dropped the lease")
+	}
+	l.Release("health", "node1")
+	if ok, _ := l.Acquire("health", "node2", time.Minute); !ok {
+		t.Error("lease not acquired after release")
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	c := NewClientWithDialer(func() (net.Conn, error) {
+		// The server reads the command but never replies.
+		c1, c2 := net.Pipe()
+		go bufio.NewReader(c1).WriteTo(ioutil.Discard)
+		return c2, nil
+	})
+	c.Timeout = 50 * time.Millisecond
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Do("GET", "x")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("command to a hung server succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("command to a hung server did not time out")
+	}
+}
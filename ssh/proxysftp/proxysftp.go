@@ -0,0 +1,289 @@
+// Package proxysftp parses the SFTP protocol, in version 3 as specified by
+// draft-ietf-secsh-filexfer-02 and implemented by OpenSSH, for proxies that
+// inspect the file transfers they relay, such as the SFTP relay configured
+// with ssh.ProxyConfig.SFTP.
+//
+// Parse decodes a single packet of either direction. The data of READ
+// responses and WRITE requests is not decoded, so that a proxy only needs
+// to keep the first bytes of those packets to account for the transfer.
+package proxysftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Packet types.
+const (
+	TypeInit          = 1
+	TypeVersion       = 2
+	TypeOpen          = 3
+	TypeClose         = 4
+	TypeRead          = 5
+	TypeWrite         = 6
+	TypeLstat         = 7
+	TypeFstat         = 8
+	TypeSetstat       = 9
+	TypeFsetstat      = 10
+	TypeOpendir       = 11
+	TypeReaddir       = 12
+	TypeRemove        = 13
+	TypeMkdir         = 14
+	TypeRmdir         = 15
+	TypeRealpath      = 16
+	TypeStat          = 17
+	TypeRename        = 18
+	TypeReadlink      = 19
+	TypeSymlink       = 20
+	TypeStatus        = 101
+	TypeHandle        = 102
+	TypeData          = 103
+	TypeName          = 104
+	TypeAttrs         = 105
+	TypeExtended      = 200
+	TypeExtendedReply = 201
+)
+
+// Status codes of STATUS responses.
+const (
+	StatusOK               = 0
+	StatusEOF              = 1
+	StatusNoSuchFile       = 2
+	StatusPermissionDenied = 3
+	StatusFailure          = 4
+	StatusBadMessage       = 5
+	StatusNoConnection     = 6
+	StatusConnectionLost   = 7
+	StatusOpUnsupported    = 8
+)
+
+// Flags of OPEN requests.
+const (
+	FlagRead      = 0x01
+	FlagWrite     = 0x02
+	FlagAppend    = 0x04
+	FlagCreate    = 0x08
+	FlagTruncate  = 0x10
+	FlagExclusive = 0x20
+)
+
+// MaxPacketLength is the largest packet length accepted, as by OpenSSH.
+const MaxPacketLength = 256 * 1024
+
+// Packet is a decoded packet. Only the fields of its type are set.
+type Packet struct {
+	Type byte
+	// ID is the request ID. INIT and VERSION packets carry the protocol
+	// version in it instead.
+	ID uint32
+
+	// Paths are the path arguments of requests, in the order they are
+	// sent: the old and new path of renames, and for symlinks the target
+	// first and the link second, as OpenSSH sends them.
+	Paths []string
+	// Handle is the file handle of requests on open files and of HANDLE
+	// responses.
+	Handle string
+	// Flags are the flags of OPEN requests.
+	Flags uint32
+	// Offset and Length are the offset and length of READ and WRITE
+	// requests. For WRITE requests and DATA responses, Length is the
+	// length of the data.
+	Offset uint64
+	Length uint32
+
+	// Extension is the name of EXTENDED requests.
+	Extension string
+
+	// Status and Message are the code and message of STATUS responses.
+	Status  uint32
+	Message string
+	// Names are the file names of NAME responses.
+	Names []string
+}
+
+// The extensions of OpenSSH and the arguments they take.
+var (
+	twoPathExtensions = map[string]bool{
+		"posix-rename@openssh.com": true,
+		"hardlink@openssh.com":     true,
+	}
+	pathExtensions = map[string]bool{
+		"statvfs@openssh.com":     true,
+		"lsetstat@openssh.com":    true,
+		"expand-path@openssh.com": true,
+	}
+	handleExtensions = map[string]bool{
+		"fstatvfs@openssh.com": true,
+		"fsync@openssh.com":    true,
+	}
+)
+
+// KnownExtension reports whether Parse decodes the arguments of the
+// extension name. The arguments of other extensions are not decoded.
+func KnownExtension(name string) bool {
+	return twoPathExtensions[name] || pathExtensions[name] || handleExtensions[name] || name == "limits@openssh.com"
+}
+
+var errShort = errors.New("proxysftp: packet too short")
+
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) uint32() uint32 {
+	if d.err != nil || len(d.b) < 4 {
+		d.err = errShort
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.b)
+	d.b = d.b[4:]
+	return v
+}
+
+func (d *decoder) uint64() uint64 {
+	hi := uint64(d.uint32())
+	return hi<<32 | uint64(d.uint32())
+}
+
+func (d *decoder) string() string {
+	n := d.uint32()
+	if d.err != nil || uint32(len(d.b)) < n {
+		d.err = errShort
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
+
+// Parse decodes a packet without its length field, that is starting with
+// the type. The data of WRITE requests and DATA responses need not be
+// present; only its length is decoded.
+func Parse(b []byte) (*Packet, error) {
+	if len(b) == 0 {
+		return nil, errShort
+	}
+	p := &Packet{Type: b[0]}
+	d := &decoder{b: b[1:]}
+	p.ID = d.uint32()
+	switch p.Type {
+	case TypeInit, TypeVersion:
+		// Extensions follow, which are not needed.
+	case TypeOpen:
+		p.Paths = []string{d.string()}
+		p.Flags = d.uint32()
+	case TypeClose, TypeFstat, TypeFsetstat, TypeReaddir, TypeHandle:
+		p.Handle = d.string()
+	case TypeRead, TypeWrite:
+		p.Handle = d.string()
+		p.Offset = d.uint64()
+		p.Length = d.uint32()
+	case TypeLstat, TypeSetstat, TypeOpendir, TypeRemove, TypeMkdir, TypeRmdir, TypeRealpath, TypeStat, TypeReadlink:
+		p.Paths = []string{d.string()}
+	case TypeRename, TypeSymlink:
+		p.Paths = []string{d.string(), d.string()}
+	case TypeExtended:
+		p.Extension = d.string()
+		switch {
+		case twoPathExtensions[p.Extension]:
+			p.Paths = []string{d.string(), d.string()}
+		case pathExtensions[p.Extension]:
+			p.Paths = []string{d.string()}
+		case handleExtensions[p.Extension]:
+			p.Handle = d.string()
+		}
+	case TypeStatus:
+		p.Status = d.uint32()
+		// Servers implementing older drafts omit the message.
+		if len(d.b) > 0 {
+			p.Message = d.string()
+		}
+	case TypeData:
+		p.Length = d.uint32()
+	case TypeName:
+		n := d.uint32()
+		// Each name takes at least 12 bytes; the count is not trusted
+		// further than that.
+		if d.err == nil && uint64(n)*12 > uint64(len(d.b)) {
+			d.err = errShort
+		}
+		for i := uint32(0); i < n && d.err == nil; i++ {
+			name := d.string()
+			d.string() // long name
+			if d.err == nil {
+				p.Names = append(p.Names, name)
+			}
+			skipAttrs(d)
+		}
+	case TypeAttrs, TypeExtendedReply:
+	default:
+		return nil, fmt.Errorf("proxysftp: unknown packet type %d", p.Type)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return p, nil
+}
+
+// Attribute flags, which tell the fields present in attributes.
+const (
+	attrSize        = 0x00000001
+	attrUIDGID      = 0x00000002
+	attrPermissions = 0x00000004
+	attrACModTime   = 0x00000008
+	attrExtended    = 0x80000000
+)
+
+func skipAttrs(d *decoder) {
+	flags := d.uint32()
+	if flags&attrSize != 0 {
+		d.uint64()
+	}
+	if flags&attrUIDGID != 0 {
+		d.uint64()
+	}
+	if flags&attrPermissions != 0 {
+		d.uint32()
+	}
+	if flags&attrACModTime != 0 {
+		d.uint64()
+	}
+	if flags&attrExtended != 0 {
+		n := d.uint32()
+		for i := uint32(0); i < n && d.err == nil; i++ {
+			d.string()
+			d.string()
+		}
+	}
+}
+
+type encoder []byte
+
+func (e encoder) uint32(v uint32) encoder {
+	return append(e, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e encoder) string(s string) encoder {
+	return append(e.uint32(uint32(len(s))), s...)
+}
+
+func (e encoder) packet() []byte {
+	binary.BigEndian.PutUint32(e, uint32(len(e)-4))
+	return e
+}
+
+// MarshalStatus returns a STATUS response, including its length field.
+func MarshalStatus(id, status uint32, message string) []byte {
+	e := encoder{0, 0, 0, 0, TypeStatus}
+	return e.uint32(id).uint32(status).string(message).string("").packet()
+}
+
+// MarshalExtended returns an EXTENDED request, including its length field.
+// data holds the encoded arguments of the extension.
+func MarshalExtended(id uint32, name string, data []byte) []byte {
+	e := encoder{0, 0, 0, 0, TypeExtended}
+	return append(e.uint32(id).string(name), data...).packet()
+}
@@ -0,0 +1,83 @@
+package proxysftp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func packet(typ byte, fields ...interface{}) []byte {
+	e := encoder{0, 0, 0, 0, typ}
+	for _, f := range fields {
+		switch f := f.(type) {
+		case string:
+			e = e.string(f)
+		case uint32:
+			e = e.uint32(f)
+		case uint64:
+			e = e.uint32(uint32(f >> 32)).uint32(uint32(f))
+		}
+	}
+	return e.packet()
+}
+
+func TestParse(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		b    []byte
+		want Packet
+	}{
+		{"open", packet(TypeOpen, uint32(1), "/a", uint32(FlagRead|FlagWrite), uint32(0)),
+			Packet{Type: TypeOpen, ID: 1, Paths: []string{"/a"}, Flags: FlagRead | FlagWrite}},
+		{"rename", packet(TypeRename, uint32(2), "a", "b"),
+			Packet{Type: TypeRename, ID: 2, Paths: []string{"a", "b"}}},
+		{"write", packet(TypeWrite, uint32(3), "h", uint64(1<<33), "data"),
+			Packet{Type: TypeWrite, ID: 3, Handle: "h", Offset: 1 << 33, Length: 4}},
+		// Only the length of the data is needed.
+		{"write header", packet(TypeWrite, uint32(4), "h", uint64(0), uint32(1000)),
+			Packet{Type: TypeWrite, ID: 4, Handle: "h", Length: 1000}},
+		{"extended", packet(TypeExtended, uint32(5), "hardlink@openssh.com", "a", "b"),
+			Packet{Type: TypeExtended, ID: 5, Extension: "hardlink@openssh.com", Paths: []string{"a", "b"}}},
+		{"unknown extension", packet(TypeExtended, uint32(6), "copy-data", "h1"),
+			Packet{Type: TypeExtended, ID: 6, Extension: "copy-data"}},
+		{"status", MarshalStatus(7, StatusNoSuchFile, "No such file"),
+			Packet{Type: TypeStatus, ID: 7, Status: StatusNoSuchFile, Message: "No such file"}},
+		{"short status", packet(TypeStatus, uint32(8), uint32(StatusEOF)),
+			Packet{Type: TypeStatus, ID: 8, Status: StatusEOF}},
+		{"name", packet(TypeName, uint32(9), uint32(2), "x", "-rw x", uint32(attrSize), uint64(5), "y", "y", uint32(0)),
+			Packet{Type: TypeName, ID: 9, Names: []string{"x", "y"}}},
+	} {
+		got, err := Parse(tt.b[4:])
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, *got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, b := range [][]byte{
+		nil,
+		{TypeOpen},
+		packet(TypeOpen, uint32(1), uint32(100))[4:],
+		packet(TypeRename, uint32(1), "a")[4:],
+		packet(TypeName, uint32(1), uint32(1<<30))[4:],
+		{99, 0, 0, 0, 1},
+	} {
+		if p, err := Parse(b); err == nil {
+			t.Errorf("Parse(%x) = %+v, want error", b, p)
+		}
+	}
+}
+
+func TestMarshalExtended(t *testing.T) {
+	got, err := Parse(MarshalExtended(10, "limits@openssh.com", nil)[4:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != TypeExtended || got.ID != 10 || got.Extension != "limits@openssh.com" {
+		t.Errorf("got %+v", got)
+	}
+}
@@ -0,0 +1,133 @@
+package proxysrv
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNSDiscovery looks up the SRV records of services, such as
+// "_ssh._tcp.example.com", with a recursive resolver. Instances are cached
+// for the lowest TTL of the records.
+type DNSDiscovery struct {
+	// Server is the address of the resolver, such as "127.0.0.1:53".
+	Server string
+
+	// Dial connects to the resolver. If nil, a net.Dialer is used.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Lookup implements Discovery. Truncated answers are retried over TCP.
+func (d *DNSDiscovery) Lookup(ctx context.Context, service string) ([]Target, time.Duration, error) {
+	if service == "" || service[len(service)-1] != '.' {
+		service += "."
+	}
+	qname, err := dnsmessage.NewName(service)
+	if err != nil {
+		return nil, 0, err
+	}
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, 0, err
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:]), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	answer, err := d.exchange(ctx, "udp", packed)
+	if err == nil && answer.Header.Truncated {
+		answer, err = d.exchange(ctx, "tcp", packed)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if answer.Header.ID != query.Header.ID || !answer.Header.Response {
+		return nil, 0, errors.New("proxysrv: unexpected DNS response")
+	}
+	switch answer.Header.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+	default:
+		return nil, 0, fmt.Errorf("proxysrv: DNS lookup of %s failed: %v", service, answer.Header.RCode)
+	}
+
+	var targets []Target
+	var ttl uint32
+	for _, rr := range answer.Answers {
+		srv, ok := rr.Body.(*dnsmessage.SRVResource)
+		if !ok {
+			continue
+		}
+		if len(targets) == 0 || rr.Header.TTL < ttl {
+			ttl = rr.Header.TTL
+		}
+		targets = append(targets, Target{
+			Host:     strings.TrimSuffix(srv.Target.String(), "."),
+			Port:     int(srv.Port),
+			Priority: srv.Priority,
+			Weight:   srv.Weight,
+		})
+	}
+	return targets, time.Duration(ttl) * time.Second, nil
+}
+
+func (d *DNSDiscovery) exchange(ctx context.Context, network string, query []byte) (*dnsmessage.Message, error) {
+	dial := d.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	c, err := dial(ctx, network, d.Server)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+
+	var buf []byte
+	if network == "tcp" {
+		msg := make([]byte, 2+len(query))
+		binary.BigEndian.PutUint16(msg, uint16(len(query)))
+		copy(msg[2:], query)
+		if _, err := c.Write(msg); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(c, length[:]); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := c.Write(query); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, 65535)
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = buf[:n]
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(buf); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
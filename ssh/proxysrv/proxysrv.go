@@ -0,0 +1,231 @@
+// Package proxysrv resolves upstream hosts from service discovery, so that
+// upstream hosts can be added, moved and removed without reconfiguring the
+// proxy.
+//
+// A Resolver looks up the instances of a service with a Discovery, caches
+// them for as long as the Discovery allows, and orders them by priority
+// and weight as for DNS SRV records (RFC 2782). Its RouteUpstream method
+// fits ssh.ProxyConfig.RouteUpstreamHook and its FindUpstream method
+// ssh.ProxyConfig.FindUpstreamHook. DNSDiscovery looks up SRV records,
+// such as _ssh._tcp.example.com; registries such as Consul or etcd can
+// implement Discovery themselves, and push changes they watch with
+// Resolver.Update.
+package proxysrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Target is an instance of a service.
+type Target struct {
+	Host     string
+	Port     int
+	Priority uint16
+	Weight   uint16
+}
+
+// Discovery looks up the instances of services.
+type Discovery interface {
+	// Lookup returns the instances of service and how long they may be
+	// cached.
+	Lookup(ctx context.Context, service string) ([]Target, time.Duration, error)
+}
+
+// ErrNoTargets is returned when a service has no instances.
+var ErrNoTargets = errors.New("proxysrv: service has no instances")
+
+// Resolver resolves upstream hosts from a Discovery. It is safe for
+// concurrent use.
+type Resolver struct {
+	Discovery Discovery
+
+	// Name is the service looked up for every user, unless Service is set.
+	Name string
+
+	// Service, if non-nil, returns the service to look up for a user.
+	Service func(username string) string
+
+	// MinTTL and MaxTTL, if non-zero, bound how long lookups are cached.
+	// If a lookup fails, the expired instances are used until it succeeds.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+
+	// Timeout of a lookup. If zero, 5 seconds are used.
+	Timeout time.Duration
+
+	// now and intn are replaced in tests.
+	now  func() time.Time
+	intn func(n int) int
+
+	mu    sync.Mutex
+	cache map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	targets []Target
+	expires time.Time
+}
+
+func (r *Resolver) timeNow() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
+
+// Update replaces the cached instances of service, for example when a
+// watch on a registry fires.
+func (r *Resolver) Update(service string, targets []Target, ttl time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cache == nil {
+		r.cache = make(map[string]*cacheEntry)
+	}
+	r.cache[service] = &cacheEntry{
+		targets: append([]Target(nil), targets...),
+		expires: r.timeNow().Add(r.boundTTL(ttl)),
+	}
+}
+
+func (r *Resolver) boundTTL(ttl time.Duration) time.Duration {
+	if r.MinTTL > 0 && ttl < r.MinTTL {
+		ttl = r.MinTTL
+	}
+	if r.MaxTTL > 0 && ttl > r.MaxTTL {
+		ttl = r.MaxTTL
+	}
+	return ttl
+}
+
+// Lookup returns the instances of service, from the cache if they have
+// not expired.
+func (r *Resolver) Lookup(ctx context.Context, service string) ([]Target, error) {
+	r.mu.Lock()
+	entry := r.cache[service]
+	r.mu.Unlock()
+	if entry != nil && r.timeNow().Before(entry.expires) {
+		return entry.targets, nil
+	}
+
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	targets, ttl, err := r.Discovery.Lookup(ctx, service)
+	if err != nil {
+		if entry != nil {
+			return entry.targets, nil
+		}
+		return nil, fmt.Errorf("proxysrv: looking up %s: %v", service, err)
+	}
+	r.Update(service, targets, ttl)
+	return targets, nil
+}
+
+// resolve returns the instances of the service of username in the order
+// they should be tried.
+func (r *Resolver) resolve(ctx context.Context, username string) ([]Target, error) {
+	service := r.Name
+	if r.Service != nil {
+		service = r.Service(username)
+	}
+	targets, err := r.Lookup(ctx, service)
+	if err != nil {
+		return nil, err
+	}
+	// A single target of "." means the service is not available.
+	if len(targets) == 0 || len(targets) == 1 && (targets[0].Host == "" || targets[0].Host == ".") {
+		return nil, ErrNoTargets
+	}
+	intn := r.intn
+	if intn == nil {
+		intn = rand.Intn
+	}
+	return order(targets, intn), nil
+}
+
+// RouteUpstream fits ssh.ProxyConfig.RouteUpstreamHook. The route is to
+// the first instance, with the following ones on the same port as
+// fallbacks.
+func (r *Resolver) RouteUpstream(ctx context.Context, meta ssh.HookMetadata) (*ssh.UpstreamRoute, error) {
+	targets, err := r.resolve(ctx, meta.User)
+	if err != nil {
+		return nil, err
+	}
+	route := &ssh.UpstreamRoute{Host: targets[0].Host, Port: targets[0].Port}
+	for _, t := range targets[1:] {
+		if t.Port == route.Port {
+			route.Fallbacks = append(route.Fallbacks, t.Host)
+		}
+	}
+	return route, nil
+}
+
+// FindUpstream fits ssh.ProxyConfig.FindUpstreamHook. It returns the hosts
+// of all instances, which ProxyServer tries in turn; their ports are
+// ignored in favor of ProxyConfig.DestinationPort.
+func (r *Resolver) FindUpstream(username string) (string, error) {
+	targets, err := r.resolve(context.Background(), username)
+	if err != nil {
+		return "", err
+	}
+	hosts := make([]string, len(targets))
+	for i, t := range targets {
+		hosts[i] = t.Host
+	}
+	return strings.Join(hosts, " "), nil
+}
+
+// order sorts targets by ascending priority and, within a priority, picks
+// them at random in proportion to their weight (RFC 2782).
+func order(targets []Target, intn func(n int) int) []Target {
+	remaining := append([]Target(nil), targets...)
+	ordered := make([]Target, 0, len(targets))
+	for len(remaining) > 0 {
+		// Collect the instances of the lowest remaining priority.
+		prio := remaining[0].Priority
+		for _, t := range remaining {
+			if t.Priority < prio {
+				prio = t.Priority
+			}
+		}
+		var group, rest []Target
+		for _, t := range remaining {
+			if t.Priority == prio {
+				group = append(group, t)
+			} else {
+				rest = append(rest, t)
+			}
+		}
+		for len(group) > 0 {
+			total := 0
+			for _, t := range group {
+				total += int(t.Weight)
+			}
+			i := 0
+			if total > 0 {
+				n := intn(total)
+				for n >= int(group[i].Weight) {
+					n -= int(group[i].Weight)
+					i++
+				}
+			} else {
+				i = intn(len(group))
+			}
+			ordered = append(ordered, group[i])
+			group = append(group[:i], group[i+1:]...)
+		}
+		remaining = rest
+	}
+	return ordered
+}
@@ -0,0 +1,155 @@
+package proxysrv
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type fakeDiscovery struct {
+	targets []Target
+	ttl     time.Duration
+	err     error
+	lookups int
+}
+
+func (d *fakeDiscovery) Lookup(ctx context.Context, service string) ([]Target, time.Duration, error) {
+	d.lookups++
+	return d.targets, d.ttl, d.err
+}
+
+func TestOrder(t *testing.T) {
+	targets := []Target{
+		{Host: "backup", Priority: 20, Weight: 1},
+		{Host: "a", Priority: 10, Weight: 1},
+		{Host: "b", Priority: 10, Weight: 3},
+	}
+	// With the largest draw, the last host of the heaviest share wins.
+	got := order(targets, func(n int) int { return n - 1 })
+	var hosts []string
+	for _, t := range got {
+		hosts = append(hosts, t.Host)
+	}
+	if want := []string{"b", "a", "backup"}; !reflect.DeepEqual(hosts, want) {
+		t.Errorf("got %v, want %v", hosts, want)
+	}
+	got = order(targets, func(n int) int { return 0 })
+	if got[0].Host != "a" || got[2].Host != "backup" {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestResolverCache(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	d := &fakeDiscovery{targets: []Target{{Host: "db1", Port: 2222}}, ttl: time.Minute}
+	r := &Resolver{Discovery: d, Name: "_ssh._tcp.db", MinTTL: 10 * time.Second, now: func() time.Time { return now }}
+
+	for i := 0; i < 2; i++ {
+		route, err := r.RouteUpstream(context.Background(), ssh.HookMetadata{User: "alice"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if route.Host != "db1" || route.Port != 2222 {
+			t.Errorf("got route to %s", route.Address())
+		}
+	}
+	if d.lookups != 1 {
+		t.Errorf("got %d lookups within the TTL, want 1", d.lookups)
+	}
+
+	// Expired instances are used while lookups fail.
+	now = now.Add(2 * time.Minute)
+	d.targets, d.err = nil, errors.New("registry down")
+	if host, err := r.FindUpstream("alice"); err != nil || host != "db1" {
+		t.Errorf("got %q, %v, want the expired instance", host, err)
+	}
+	if d.lookups != 2 {
+		t.Errorf("got %d lookups, want 2", d.lookups)
+	}
+
+	// TTLs are raised to MinTTL.
+	d.err, d.ttl = nil, 0
+	d.targets = []Target{{Host: "db2", Port: 22}, {Host: "db3", Port: 22}}
+	r.intn = func(n int) int { return 0 }
+	if host, err := r.FindUpstream("alice"); err != nil || host != "db2 db3" {
+		t.Errorf("got %q, %v, want the new instances", host, err)
+	}
+	now = now.Add(5 * time.Second)
+	r.FindUpstream("alice")
+	if d.lookups != 3 {
+		t.Errorf("got %d lookups within MinTTL, want 3", d.lookups)
+	}
+
+	r.Update("_ssh._tcp.db", []Target{{Host: "."}}, time.Hour)
+	if _, err := r.FindUpstream("alice"); err != ErrNoTargets {
+		t.Errorf("got %v, want ErrNoTargets", err)
+	}
+}
+
+// serveDNS answers SRV queries over UDP with records.
+func serveDNS(t *testing.T, records []dnsmessage.SRVResource, ttls []uint32) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var q dnsmessage.Message
+			if err := q.Unpack(buf[:n]); err != nil {
+				t.Errorf("Unpack: %v", err)
+				return
+			}
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: q.Header.ID, Response: true, RecursionAvailable: true},
+				Questions: q.Questions,
+			}
+			for i := range records {
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{
+					Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: ttls[i]},
+					Body:   &records[i],
+				})
+			}
+			b, err := resp.Pack()
+			if err != nil {
+				t.Errorf("Pack: %v", err)
+				return
+			}
+			pc.WriteTo(b, from)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestDNSDiscovery(t *testing.T) {
+	server := serveDNS(t, []dnsmessage.SRVResource{
+		{Priority: 10, Weight: 5, Port: 2222, Target: dnsmessage.MustNewName("db1.example.com.")},
+		{Priority: 20, Weight: 0, Port: 22, Target: dnsmessage.MustNewName("db2.example.com.")},
+	}, []uint32{300, 60})
+	d := &DNSDiscovery{Server: server}
+	targets, ttl, err := d.Lookup(context.Background(), "_ssh._tcp.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Target{
+		{Host: "db1.example.com", Port: 2222, Priority: 10, Weight: 5},
+		{Host: "db2.example.com", Port: 22, Priority: 20},
+	}
+	if !reflect.DeepEqual(targets, want) {
+		t.Errorf("got %+v, want %+v", targets, want)
+	}
+	if ttl != time.Minute {
+		t.Errorf("got TTL %v, want the lowest, 1m", ttl)
+	}
+}
@@ -0,0 +1,141 @@
+package proxysshfp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const typeSSHFP dnsmessage.Type = 44
+
+// flagAD is the authenticated data bit of the DNS header (RFC 4035), which
+// dnsmessage does not expose. It is set in queries to ask for the bit in
+// the answer (RFC 6840, section 5.7).
+const flagAD = 0x20
+
+// DNSResolver looks up SSHFP records with a recursive resolver. Answers
+// are only reported as authenticated if the resolver validates DNSSEC and
+// sets the AD bit, so it should be reached over a trusted path, such as a
+// resolver on the local host.
+type DNSResolver struct {
+	// Server is the address of the resolver, such as "127.0.0.1:53".
+	Server string
+
+	// Dial connects to the resolver. If nil, a net.Dialer is used.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// LookupSSHFP implements Resolver. Truncated answers are retried over TCP.
+func (r *DNSResolver) LookupSSHFP(ctx context.Context, name string) ([]Record, bool, error) {
+	if name == "" || name[len(name)-1] != '.' {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, false, err
+	}
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, false, err
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:]), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: typeSSHFP, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, false, err
+	}
+	packed[3] |= flagAD
+
+	answer, err := r.exchange(ctx, "udp", packed)
+	if err == nil && answer.msg.Header.Truncated {
+		answer, err = r.exchange(ctx, "tcp", packed)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if answer.msg.Header.ID != query.Header.ID || !answer.msg.Header.Response {
+		return nil, false, errors.New("proxysshfp: unexpected DNS response")
+	}
+	switch answer.msg.Header.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+	default:
+		return nil, false, fmt.Errorf("proxysshfp: DNS lookup of %s failed: %v", name, answer.msg.Header.RCode)
+	}
+
+	var records []Record
+	for _, rr := range answer.msg.Answers {
+		u, ok := rr.Body.(*dnsmessage.UnknownResource)
+		if !ok || rr.Header.Type != typeSSHFP || len(u.Data) < 2 {
+			continue
+		}
+		records = append(records, Record{
+			Algorithm:       u.Data[0],
+			FingerprintType: u.Data[1],
+			Fingerprint:     append([]byte(nil), u.Data[2:]...),
+		})
+	}
+	return records, answer.authenticated, nil
+}
+
+type dnsAnswer struct {
+	msg           dnsmessage.Message
+	authenticated bool
+}
+
+func (r *DNSResolver) exchange(ctx context.Context, network string, query []byte) (*dnsAnswer, error) {
+	dial := r.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	c, err := dial(ctx, network, r.Server)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+
+	var buf []byte
+	if network == "tcp" {
+		msg := make([]byte, 2+len(query))
+		binary.BigEndian.PutUint16(msg, uint16(len(query)))
+		copy(msg[2:], query)
+		if _, err := c.Write(msg); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(c, length[:]); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := c.Write(query); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, 65535)
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = buf[:n]
+	}
+
+	answer := &dnsAnswer{}
+	if err := answer.msg.Unpack(buf); err != nil {
+		return nil, err
+	}
+	answer.authenticated = len(buf) > 3 && buf[3]&flagAD != 0
+	return answer, nil
+}
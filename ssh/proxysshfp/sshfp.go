@@ -0,0 +1,168 @@
+// Package proxysshfp verifies the host keys of upstream servers against
+// SSHFP records in DNS (RFC 4255), for fleets that are too large or too
+// dynamic for a curated known_hosts file.
+//
+// A Verifier looks up the records with a Resolver and accepts a host key
+// whose fingerprint is listed for the host. Its Check method fits
+// ssh.ProxyConfig.UpstreamHostKeyCallback, which passes the name of the
+// upstream host rather than its address. DNSResolver queries a recursive
+// resolver that validates DNSSEC; other sources, such as an inventory
+// service, can implement Resolver themselves.
+package proxysshfp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Algorithm numbers of SSHFP records.
+const (
+	AlgorithmRSA     = 1
+	AlgorithmDSA     = 2
+	AlgorithmECDSA   = 3
+	AlgorithmEd25519 = 4
+)
+
+// Fingerprint types of SSHFP records.
+const (
+	FingerprintSHA1   = 1
+	FingerprintSHA256 = 2
+)
+
+// Record is an SSHFP record.
+type Record struct {
+	Algorithm       uint8
+	FingerprintType uint8
+	Fingerprint     []byte
+}
+
+// NewRecord returns the record of key with the given fingerprint type. It
+// fails for key types that have no SSHFP algorithm number.
+func NewRecord(key ssh.PublicKey, fingerprintType uint8) (Record, error) {
+	algo := keyAlgorithm(key)
+	if algo == 0 {
+		return Record{}, fmt.Errorf("proxysshfp: no SSHFP algorithm for %s keys", key.Type())
+	}
+	fp := fingerprint(key, fingerprintType)
+	if fp == nil {
+		return Record{}, fmt.Errorf("proxysshfp: unknown fingerprint type %d", fingerprintType)
+	}
+	return Record{Algorithm: algo, FingerprintType: fingerprintType, Fingerprint: fp}, nil
+}
+
+func keyAlgorithm(key ssh.PublicKey) uint8 {
+	switch key.Type() {
+	case ssh.KeyAlgoRSA:
+		return AlgorithmRSA
+	case ssh.KeyAlgoDSA:
+		return AlgorithmDSA
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		return AlgorithmECDSA
+	case ssh.KeyAlgoED25519:
+		return AlgorithmEd25519
+	}
+	return 0
+}
+
+func fingerprint(key ssh.PublicKey, fingerprintType uint8) []byte {
+	switch fingerprintType {
+	case FingerprintSHA1:
+		sum := sha1.Sum(key.Marshal())
+		return sum[:]
+	case FingerprintSHA256:
+		sum := sha256.Sum256(key.Marshal())
+		return sum[:]
+	}
+	return nil
+}
+
+// Resolver looks up SSHFP records.
+type Resolver interface {
+	// LookupSSHFP returns the SSHFP records of the fully qualified name,
+	// and whether the answer was authenticated with DNSSEC. A name without
+	// records is not an error.
+	LookupSSHFP(ctx context.Context, name string) (records []Record, authenticated bool, err error)
+}
+
+// ErrNoRecords is returned by Verifier.Check if the host has no usable
+// SSHFP records for a key of its type and the Verifier has no Fallback.
+var ErrNoRecords = errors.New("proxysshfp: no SSHFP records for the host key")
+
+// Verifier checks host keys against SSHFP records.
+type Verifier struct {
+	Resolver Resolver
+
+	// AuthenticatedOnly ignores answers that were not authenticated with
+	// DNSSEC, as if the host had no records.
+	AuthenticatedOnly bool
+
+	// Fallback, if non-nil, checks the keys of hosts without usable
+	// records, for example with a known_hosts file. Keys that contradict
+	// the records are rejected without calling it.
+	Fallback ssh.HostKeyCallback
+
+	// Timeout of a lookup. If zero, 5 seconds are used.
+	Timeout time.Duration
+}
+
+// Check is an ssh.HostKeyCallback. The hostname must be a name rather
+// than an IP address for records to be found. Host certificates are
+// checked by the fingerprint of their key.
+func (v *Verifier) Check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	host, _, err := net.SplitHostPort(hostname)
+	if err != nil {
+		host = hostname
+	}
+	hostKey := key
+	if cert, ok := key.(*ssh.Certificate); ok {
+		hostKey = cert.Key
+	}
+
+	var records []Record
+	if net.ParseIP(host) == nil {
+		timeout := v.Timeout
+		if timeout == 0 {
+			timeout = 5 * time.Second
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		var authenticated bool
+		records, authenticated, err = v.Resolver.LookupSSHFP(ctx, host)
+		if err != nil {
+			return fmt.Errorf("proxysshfp: looking up %s: %v", host, err)
+		}
+		if v.AuthenticatedOnly && !authenticated {
+			records = nil
+		}
+	}
+
+	// Only records of the key's algorithm and of known fingerprint types
+	// are used; a host may publish others for keys it also has.
+	usable := false
+	algo := keyAlgorithm(hostKey)
+	for _, r := range records {
+		fp := fingerprint(hostKey, r.FingerprintType)
+		if r.Algorithm != algo || fp == nil {
+			continue
+		}
+		if bytes.Equal(fp, r.Fingerprint) {
+			return nil
+		}
+		usable = true
+	}
+	if usable {
+		return fmt.Errorf("proxysshfp: host key of %s does not match its SSHFP records", host)
+	}
+	if v.Fallback != nil {
+		return v.Fallback(hostname, remote, key)
+	}
+	return ErrNoRecords
+}
@@ -0,0 +1,179 @@
+package proxysshfp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/testdata"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func testKey(t *testing.T, name string) ssh.PublicKey {
+	s, err := ssh.ParsePrivateKey(testdata.PEMBytes[name])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.PublicKey()
+}
+
+func testRecord(t *testing.T, key ssh.PublicKey, fingerprintType uint8) Record {
+	r, err := NewRecord(key, fingerprintType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+type fakeResolver struct {
+	records       map[string][]Record
+	authenticated bool
+}
+
+func (r *fakeResolver) LookupSSHFP(ctx context.Context, name string) ([]Record, bool, error) {
+	return r.records[name], r.authenticated, nil
+}
+
+func TestVerifier(t *testing.T) {
+	rsaKey, ecKey, edKey := testKey(t, "rsa"), testKey(t, "ecdsa"), testKey(t, "ed25519")
+	resolver := &fakeResolver{records: map[string][]Record{
+		"db1.internal": {testRecord(t, rsaKey, FingerprintSHA256), testRecord(t, ecKey, FingerprintSHA1)},
+		"db2.internal": {{Algorithm: AlgorithmRSA, FingerprintType: FingerprintSHA256, Fingerprint: make([]byte, 32)}},
+	}, authenticated: true}
+	fallbackCalls := 0
+	v := &Verifier{Resolver: resolver, AuthenticatedOnly: true, Fallback: func(string, net.Addr, ssh.PublicKey) error {
+		fallbackCalls++
+		return errors.New("unknown host")
+	}}
+	addr := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 22}
+
+	for _, key := range []ssh.PublicKey{rsaKey, ecKey} {
+		if err := v.Check("db1.internal:22", addr, key); err != nil {
+			t.Errorf("%s: %v", key.Type(), err)
+		}
+	}
+	// There are no ed25519 records, so the fallback decides.
+	if err := v.Check("db1.internal:22", addr, edKey); err == nil || fallbackCalls != 1 {
+		t.Errorf("got %v after %d fallback calls, want the fallback's error", err, fallbackCalls)
+	}
+
+	if err := v.Check("db2.internal:22", addr, rsaKey); err == nil || fallbackCalls != 1 {
+		t.Errorf("got %v, want a mismatch without calling the fallback", err)
+	}
+
+	resolver.authenticated = false
+	if err := v.Check("db1.internal:22", addr, rsaKey); err == nil || fallbackCalls != 2 {
+		t.Errorf("got %v, want unauthenticated records ignored", err)
+	}
+	v.AuthenticatedOnly = false
+	if err := v.Check("db1.internal:22", addr, rsaKey); err != nil {
+		t.Errorf("unauthenticated records: %v", err)
+	}
+
+	v.Fallback = nil
+	if err := v.Check("10.0.0.1:22", addr, rsaKey); err != ErrNoRecords {
+		t.Errorf("got %v for an IP address, want ErrNoRecords", err)
+	}
+}
+
+// serveDNS answers SSHFP queries for db1.internal with records on udp and,
+// if truncate is set, only sends truncated answers over UDP so that the
+// client retries over TCP on the same port.
+func serveDNS(t *testing.T, records []Record, truncate bool) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	answer := func(query []byte, truncated bool) []byte {
+		var q dnsmessage.Message
+		if err := q.Unpack(query); err != nil {
+			t.Errorf("Unpack: %v", err)
+			return nil
+		}
+		if query[3]&flagAD == 0 {
+			t.Error("query does not ask for the AD bit")
+		}
+		resp := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: q.Header.ID, Response: true, RecursionAvailable: true, Truncated: truncated},
+			Questions: q.Questions,
+		}
+		if !truncated {
+			for _, r := range records {
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{
+					Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Type: typeSSHFP, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.UnknownResource{Type: typeSSHFP, Data: append([]byte{r.Algorithm, r.FingerprintType}, r.Fingerprint...)},
+				})
+			}
+		}
+		b, err := resp.Pack()
+		if err != nil {
+			t.Errorf("Pack: %v", err)
+			return nil
+		}
+		b[3] |= flagAD
+		return b
+	}
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(answer(buf[:n], truncate), from)
+		}
+	}()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			var length [2]byte
+			if _, err := io.ReadFull(c, length[:]); err == nil {
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(c, query); err == nil {
+					b := answer(query, false)
+					binary.BigEndian.PutUint16(length[:], uint16(len(b)))
+					c.Write(append(length[:], b...))
+				}
+			}
+			c.Close()
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestDNSResolver(t *testing.T) {
+	want := []Record{testRecord(t, testKey(t, "rsa"), FingerprintSHA256), testRecord(t, testKey(t, "ed25519"), FingerprintSHA1)}
+	for _, truncate := range []bool{false, true} {
+		r := &DNSResolver{Server: serveDNS(t, want, truncate)}
+		got, authenticated, err := r.LookupSSHFP(context.Background(), "db1.internal")
+		if err != nil {
+			t.Fatalf("truncate %v: LookupSSHFP: %v", truncate, err)
+		}
+		if !authenticated {
+			t.Errorf("truncate %v: answer not authenticated", truncate)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("truncate %v: got %d records, want %d", truncate, len(got), len(want))
+		}
+		for i := range want {
+			if got[i].Algorithm != want[i].Algorithm || got[i].FingerprintType != want[i].FingerprintType || string(got[i].Fingerprint) != string(want[i].Fingerprint) {
+				t.Errorf("truncate %v: record %d = %+v, want %+v", truncate, i, got[i], want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// Package proxystore implements a small embedded store for sshr-style
+// proxies. It keeps users' authorized keys and upstream private keys, their
+// upstream routes, bans and access grants in a single file, and exposes them
+// through the hooks of ssh.ProxyConfig, so that single-binary deployments do
+// not need an external backend.
+package proxystore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrUnknownUser is returned by the hooks for users without a record.
+var ErrUnknownUser = errors.New("proxystore: unknown user")
+
+// BannedError is returned by FindUpstream for a banned user.
+type BannedError struct {
+	User  string
+	Until time.Time
+}
+
+func (e *BannedError) Error() string {
+	if e.Until.IsZero() {
+		return fmt.Sprintf("proxystore: user %q is banned", e.User)
+	}
+	return fmt.Sprintf("proxystore: user %q is banned until %v", e.User, e.Until)
+}
+
+// NotGrantedError is returned by FindUpstream if a user's route points at a
+// host the user has no grant for.
+type NotGrantedError struct {
+	User string
+	Host string
+}
+
+func (e *NotGrantedError) Error() string {
+	return fmt.Sprintf("proxystore: user %q has no grant for %q", e.User, e.Host)
+}
+
+// User is the record kept for a single username.
+type User struct {
+	// AuthorizedKeys holds the user's keys in authorized_keys format.
+	AuthorizedKeys []byte `json:"authorized_keys,omitempty"`
+
+	// PrivateKey is the PEM encoded key used to authenticate upstream.
+	PrivateKey []byte `json:"private_key,omitempty"`
+
+	// Route is the upstream host the user is sent to.
+	Route string `json:"route,omitempty"`
+
+	// Grants lists the upstream hosts the user may be routed to. If empty,
+	// any route is allowed.
+	Grants []string `json:"grants,omitempty"`
+
+	// Banned is set if the user may not log in. BannedUntil, if non-zero,
+	// lifts the ban automatically.
+	Banned      bool      `json:"banned,omitempty"`
+	BannedUntil time.Time `json:"banned_until,omitempty"`
+}
+
+// Store is a file backed user database. Every modification is written to
+// disk before the modifying method returns. It is safe for concurrent use.
+type Store struct {
+	path string
+
+	// now is used for ban expiry; replaced in tests.
+	now func() time.Time
+
+	mu    sync.RWMutex
+	users map[string]*User
+}
+
+// Open loads the store kept at path. A missing file yields an empty store
+// that is created on the first modification.
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:  path,
+		now:   time.Now,
+		users: make(map[string]*User),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.users); err != nil {
+		return nil, fmt.Errorf("proxystore: %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// User returns a copy of the record for username.
+func (s *Store) User(username string) (User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[username]
+	if !ok {
+		return User{}, false
+	}
+	return *u, true
+}
+
+// Update calls fn with the record for username, creating it if needed, and
+// persists the result. If fn returns an error the store is left unchanged.
+func (s *Store) Update(username string, fn func(*User) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u := &User{}
+	if old, ok := s.users[username]; ok {
+		*u = *old
+	}
+	if err := fn(u); err != nil {
+		return err
+	}
+
+	old, existed := s.users[username]
+	s.users[username] = u
+	if err := s.save(); err != nil {
+		if existed {
+			s.users[username] = old
+		} else {
+			delete(s.users, username)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes the record for username.
+func (s *Store) Delete(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.users[username]
+	if !ok {
+		return nil
+	}
+	delete(s.users, username)
+	if err := s.save(); err != nil {
+		s.users[username] = old
+		return err
+	}
+	return nil
+}
+
+// save atomically replaces the store file. s.mu must be held.
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.users, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// FetchAuthorizedKeys implements ssh.ProxyConfig.FetchAuthorizedKeysHook.
+func (s *Store) FetchAuthorizedKeys(username string) ([]byte, error) {
+	u, ok := s.User(username)
+	if !ok || len(u.AuthorizedKeys) == 0 {
+		return nil, ErrUnknownUser
+	}
+	return u.AuthorizedKeys, nil
+}
+
+// FetchPrivateKey implements ssh.ProxyConfig.FetchPrivateKeyHook.
+func (s *Store) FetchPrivateKey(username string) ([]byte, error) {
+	u, ok := s.User(username)
+	if !ok || len(u.PrivateKey) == 0 {
+		return nil, ErrUnknownUser
+	}
+	return u.PrivateKey, nil
+}
+
+// FindUpstream implements ssh.ProxyConfig.FindUpstreamHook. It refuses
+// banned users and routes that are not covered by the user's grants.
+func (s *Store) FindUpstream(username string) (string, error) {
+	u, ok := s.User(username)
+	if !ok || u.Route == "" {
+		return "", ErrUnknownUser
+	}
+	if u.Banned && (u.BannedUntil.IsZero() || s.now().Before(u.BannedUntil)) {
+		return "", &BannedError{User: username, Until: u.BannedUntil}
+	}
+	if len(u.Grants) == 0 {
+		return u.Route, nil
+	}
+	for _, host := range u.Grants {
+		if host == u.Route {
+			return u.Route, nil
+		}
+	}
+	return "", &NotGrantedError{User: username, Host: u.Route}
+}
+
+// Install sets the hooks of conf to use the store.
+func (s *Store) Install(conf *ssh.ProxyConfig) {
+	conf.FindUpstreamHook = s.FindUpstream
+	conf.FetchAuthorizedKeysHook = s.FetchAuthorizedKeys
+	conf.FetchPrivateKeyHook = s.FetchPrivateKey
+}
@@ -0,0 +1,103 @@
+package proxystore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempStore(t *testing.T) (*Store, string) {
+	dir, err := ioutil.TempDir("", "proxystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "users.json")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return s, path
+}
+
+func TestStorePersistence(t *testing.T) {
+	s, path := tempStore(t)
+	err := s.Update("alice", func(u *User) error {
+		u.AuthorizedKeys = []byte("ssh-ed25519 AAAA alice\n")
+		u.Route = "db1"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("store file has mode %v, want 0600", fi.Mode().Perm())
+	}
+
+	s2, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	keys, err := s2.FetchAuthorizedKeys("alice")
+	if err != nil || string(keys) != "ssh-ed25519 AAAA alice\n" {
+		t.Errorf("FetchAuthorizedKeys = %q, %v", keys, err)
+	}
+	if host, err := s2.FindUpstream("alice"); err != nil || host != "db1" {
+		t.Errorf("FindUpstream = %q, %v", host, err)
+	}
+	if _, err := s2.FetchPrivateKey("alice"); err != ErrUnknownUser {
+		t.Errorf("FetchPrivateKey without a key: got %v, want ErrUnknownUser", err)
+	}
+}
+
+func TestStoreUpdateError(t *testing.T) {
+	s, _ := tempStore(t)
+	boom := errors.New("boom")
+	if err := s.Update("bob", func(u *User) error { return boom }); err != boom {
+		t.Fatalf("Update: got %v, want %v", err, boom)
+	}
+	if _, ok := s.User("bob"); ok {
+		t.Error("failed update created a record")
+	}
+}
+
+func TestStoreBansAndGrants(t *testing.T) {
+	s, _ := tempStore(t)
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	s.Update("carol", func(u *User) error {
+		u.Route = "prod"
+		u.Grants = []string{"staging"}
+		return nil
+	})
+	var notGranted *NotGrantedError
+	if _, err := s.FindUpstream("carol"); !errors.As(err, &notGranted) {
+		t.Errorf("route without grant: got %v, want NotGrantedError", err)
+	}
+
+	s.Update("carol", func(u *User) error {
+		u.Grants = append(u.Grants, "prod")
+		u.Banned = true
+		u.BannedUntil = now.Add(time.Hour)
+		return nil
+	})
+	var banned *BannedError
+	if _, err := s.FindUpstream("carol"); !errors.As(err, &banned) {
+		t.Errorf("banned user: got %v, want BannedError", err)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if host, err := s.FindUpstream("carol"); err != nil || host != "prod" {
+		t.Errorf("after ban expiry: FindUpstream = %q, %v", host, err)
+	}
+}
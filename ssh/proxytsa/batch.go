@@ -0,0 +1,157 @@
+package proxytsa
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"sync"
+	"time"
+)
+
+// Receipt binds a batch of audit records to a time-stamp token.
+type Receipt struct {
+	// Seq numbers the receipts of a Batcher, starting at 1.
+	Seq uint64
+	// Records is the number of records covered.
+	Records int
+	// Previous is the Digest of the preceding receipt, or all zeros.
+	Previous [sha256.Size]byte
+	// Digest is SHA256(Previous || SHA256(records)) and was submitted to
+	// the Timestamper. Each record is hashed as its length as a 32-bit
+	// big-endian integer followed by its bytes.
+	Digest [sha256.Size]byte
+	Token  *Token
+}
+
+// Batcher accumulates audit records and obtains a token for them on every
+// Flush. Because each digest covers the previous one, the receipts form a
+// chain and a dropped batch is detectable. Records of a batch whose
+// submission fails are carried over into the next one.
+type Batcher struct {
+	// Timestamper issues the tokens.
+	Timestamper Timestamper
+
+	// Hook is called with every receipt. It should persist the receipt
+	// next to the audit records it covers.
+	Hook func(Receipt)
+
+	// flushMu serializes flushes, which submit without holding mu so
+	// that Add does not wait for the Timestamper.
+	flushMu sync.Mutex
+
+	mu      sync.Mutex
+	records hash.Hash
+	n       int
+	// pending holds the encoded records added while a batch is being
+	// submitted, to carry them over if the submission fails.
+	pending  []byte
+	inflight bool
+	seq      uint64
+	prev     [sha256.Size]byte
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// Add appends a record to the current batch.
+func (b *Batcher) Add(record []byte) {
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(record)))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.records == nil {
+		b.records = sha256.New()
+	}
+	b.records.Write(l[:])
+	b.records.Write(record)
+	b.n++
+	if b.inflight {
+		b.pending = append(append(b.pending, l[:]...), record...)
+	}
+}
+
+// Flush submits the current batch, if it is not empty, and passes the
+// receipt to Hook. Records added meanwhile go into the next batch.
+func (b *Batcher) Flush() error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	if b.n == 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	records, n, prev := b.records, b.n, b.prev
+	b.records, b.n, b.inflight = sha256.New(), 0, true
+	b.mu.Unlock()
+
+	h := sha256.New()
+	h.Write(prev[:])
+	h.Write(records.Sum(nil))
+	var digest [sha256.Size]byte
+	copy(digest[:], h.Sum(nil))
+
+	token, err := b.Timestamper.Timestamp(digest)
+
+	b.mu.Lock()
+	pending := b.pending
+	b.pending, b.inflight = nil, false
+	if err != nil {
+		// Carry the batch over, followed by the records added meanwhile.
+		records.Write(pending)
+		b.records, b.n = records, n+b.n
+		b.mu.Unlock()
+		return err
+	}
+	b.seq++
+	r := Receipt{Seq: b.seq, Records: n, Previous: prev, Digest: digest, Token: token}
+	b.prev = digest
+	b.mu.Unlock()
+
+	if b.Hook != nil {
+		b.Hook(r)
+	}
+	return nil
+}
+
+// Start flushes every interval until Stop is called. Errors are passed to
+// errorHook if it is non-nil.
+func (b *Batcher) Start(interval time.Duration, errorHook func(error)) {
+	b.mu.Lock()
+	if b.stop != nil {
+		b.mu.Unlock()
+		return
+	}
+	b.stop, b.done = make(chan struct{}), make(chan struct{})
+	stop, done := b.stop, b.done
+	b.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if err := b.Flush(); err != nil && errorHook != nil {
+				errorHook(err)
+			}
+		}
+	}()
+}
+
+// Stop stops periodic flushing and submits the remaining records.
+func (b *Batcher) Stop() error {
+	b.mu.Lock()
+	stop, done := b.stop, b.done
+	b.stop, b.done = nil, nil
+	b.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	return b.Flush()
+}
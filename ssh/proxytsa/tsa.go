@@ -0,0 +1,213 @@
+// Package proxytsa obtains independently verifiable timestamps for the audit
+// records of the ssh proxy. A Batcher accumulates records, for example the
+// events reported to ssh.ProxyConfig.AuthLogHook and TranscriptHook, and
+// periodically submits a digest of them to a Timestamper. Client is a
+// Timestamper for RFC 3161 time-stamping authorities; other services, such
+// as transparency logs, can implement the interface themselves.
+//
+// The package checks that a time-stamp token covers the submitted digest,
+// but does not verify the authority's signature on it. Receipts keep the
+// complete token so that it can be verified offline by standard tooling.
+package proxytsa
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// Token is a time-stamp token issued for a digest.
+type Token struct {
+	// Time is the time at which the authority asserts the digest existed.
+	Time time.Time
+	// Serial is the serial number assigned by the authority.
+	Serial *big.Int
+	// DER is the complete encoded token.
+	DER []byte
+}
+
+// A Timestamper obtains a token for a SHA-256 digest.
+type Timestamper interface {
+	Timestamp(digest [sha256.Size]byte) (*Token, error)
+}
+
+var (
+	oidSHA256     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidTSTInfo    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+)
+
+type algorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type messageImprint struct {
+	HashAlgorithm algorithmIdentifier
+	HashedMessage []byte
+}
+
+type timeStampReq struct {
+	Version        int
+	MessageImprint messageImprint
+	ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+	Nonce          *big.Int              `asn1:"optional"`
+	CertReq        bool                  `asn1:"optional,default:false"`
+}
+
+type pkiStatusInfo struct {
+	Status       int
+	StatusString []string       `asn1:"optional,utf8"`
+	FailInfo     asn1.BitString `asn1:"optional"`
+}
+
+type timeStampResp struct {
+	Status         pkiStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type encapsulatedContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     []byte `asn1:"explicit,optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	EncapContentInfo encapsulatedContentInfo
+}
+
+type accuracy struct {
+	Seconds int `asn1:"optional"`
+	Millis  int `asn1:"optional,tag:0"`
+	Micros  int `asn1:"optional,tag:1"`
+}
+
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time `asn1:"generalized"`
+	Accuracy       accuracy  `asn1:"optional"`
+	Ordering       bool      `asn1:"optional,default:false"`
+	Nonce          *big.Int  `asn1:"optional"`
+}
+
+// PKI status values of RFC 3161 that indicate a token was granted.
+const (
+	statusGranted         = 0
+	statusGrantedWithMods = 1
+)
+
+// Client requests time-stamp tokens from an RFC 3161 authority over HTTP.
+type Client struct {
+	// URL of the authority.
+	URL string
+
+	// Policy, if set, is the TSA policy requested.
+	Policy asn1.ObjectIdentifier
+
+	// HTTPClient is used for requests. If nil, a client with a timeout of
+	// 30 seconds is used.
+	HTTPClient *http.Client
+}
+
+var defaultHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// Timestamp implements Timestamper.
+func (c *Client) Timestamp(digest [sha256.Size]byte) (*Token, error) {
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	req, err := asn1.Marshal(timeStampReq{
+		Version: 1,
+		MessageImprint: messageImprint{
+			HashAlgorithm: algorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+			HashedMessage: digest[:],
+		},
+		ReqPolicy: c.Policy,
+		Nonce:     nonce,
+		CertReq:   true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = defaultHTTPClient
+	}
+	resp, err := hc.Post(c.URL, "application/timestamp-query", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxytsa: authority returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parseResponse(body, digest, nonce)
+}
+
+// parseResponse extracts the token from a TimeStampResp and checks that it
+// was issued for digest and nonce.
+func parseResponse(der []byte, digest [sha256.Size]byte, nonce *big.Int) (*Token, error) {
+	var resp timeStampResp
+	if _, err := asn1.Unmarshal(der, &resp); err != nil {
+		return nil, fmt.Errorf("proxytsa: malformed response: %v", err)
+	}
+	if s := resp.Status.Status; s != statusGranted && s != statusGrantedWithMods {
+		return nil, fmt.Errorf("proxytsa: request rejected with status %d %q", s, resp.Status.StatusString)
+	}
+	if len(resp.TimeStampToken.FullBytes) == 0 {
+		return nil, errors.New("proxytsa: response carries no token")
+	}
+
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(resp.TimeStampToken.FullBytes, &ci); err != nil {
+		return nil, fmt.Errorf("proxytsa: malformed token: %v", err)
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, errors.New("proxytsa: token is not signed data")
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("proxytsa: malformed signed data: %v", err)
+	}
+	if !sd.EncapContentInfo.EContentType.Equal(oidTSTInfo) {
+		return nil, errors.New("proxytsa: token does not contain TSTInfo")
+	}
+	var info tstInfo
+	if _, err := asn1.Unmarshal(sd.EncapContentInfo.EContent, &info); err != nil {
+		return nil, fmt.Errorf("proxytsa: malformed TSTInfo: %v", err)
+	}
+
+	if !info.MessageImprint.HashAlgorithm.Algorithm.Equal(oidSHA256) || !bytes.Equal(info.MessageImprint.HashedMessage, digest[:]) {
+		return nil, errors.New("proxytsa: token was issued for a different digest")
+	}
+	if info.Nonce == nil || info.Nonce.Cmp(nonce) != 0 {
+		return nil, errors.New("proxytsa: token nonce does not match the request")
+	}
+	return &Token{
+		Time:   info.GenTime,
+		Serial: info.SerialNumber,
+		DER:    resp.TimeStampToken.FullBytes,
+	}, nil
+}
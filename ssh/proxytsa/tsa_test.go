@@ -0,0 +1,209 @@
+package proxytsa
+
+import (
+	"crypto/sha256"
+	"encoding/asn1"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testGenTime = time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// newTestAuthority returns a server answering time-stamp requests with
+// unsigned tokens. tamper, if non-nil, may modify the TSTInfo before it is
+// encoded.
+func newTestAuthority(t *testing.T, status int, tamper func(*tstInfo)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req timeStampReq
+		if _, err := asn1.Unmarshal(body, &req); err != nil {
+			t.Errorf("malformed request: %v", err)
+			return
+		}
+		resp := timeStampResp{Status: pkiStatusInfo{Status: status}}
+		if status == statusGranted {
+			info := tstInfo{
+				Version:        1,
+				Policy:         asn1.ObjectIdentifier{1, 2, 3},
+				MessageImprint: req.MessageImprint,
+				SerialNumber:   big.NewInt(42),
+				GenTime:        testGenTime,
+				Nonce:          req.Nonce,
+			}
+			if tamper != nil {
+				tamper(&info)
+			}
+			resp.TimeStampToken = asn1.RawValue{FullBytes: encodeToken(t, info)}
+		}
+		der, err := asn1.Marshal(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Header().Set("Content-Type", "application/timestamp-reply")
+		w.Write(der)
+	}))
+}
+
+func encodeToken(t *testing.T, info tstInfo) []byte {
+	infoDER, err := asn1.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, err := asn1.Marshal(signedData{
+		Version:          3,
+		DigestAlgorithms: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true},
+		EncapContentInfo: encapsulatedContentInfo{EContentType: oidTSTInfo, EContent: infoDER},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// contentInfo cannot be marshaled directly, as encoding/asn1 does not
+	// apply the explicit tag to a RawValue with FullBytes.
+	oid, _ := asn1.Marshal(oidSignedData)
+	content, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sd})
+	token, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: append(oid, content...)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestClientTimestamp(t *testing.T) {
+	srv := newTestAuthority(t, statusGranted, nil)
+	defer srv.Close()
+
+	token, err := (&Client{URL: srv.URL}).Timestamp(sha256.Sum256([]byte("audit")))
+	if err != nil {
+		t.Fatalf("Timestamp: %v", err)
+	}
+	if !token.Time.Equal(testGenTime) || token.Serial.Int64() != 42 || len(token.DER) == 0 {
+		t.Errorf("got token %+v", token)
+	}
+}
+
+func TestClientRejectsMismatchedToken(t *testing.T) {
+	for name, tamper := range map[string]func(*tstInfo){
+		"digest": func(info *tstInfo) { info.MessageImprint.HashedMessage = make([]byte, sha256.Size) },
+		"nonce":  func(info *tstInfo) { info.Nonce = big.NewInt(1) },
+	} {
+		srv := newTestAuthority(t, statusGranted, tamper)
+		if _, err := (&Client{URL: srv.URL}).Timestamp(sha256.Sum256([]byte("audit"))); err == nil {
+			t.Errorf("token with wrong %s accepted", name)
+		}
+		srv.Close()
+	}
+}
+
+func TestClientRejectedStatus(t *testing.T) {
+	srv := newTestAuthority(t, 2, nil)
+	defer srv.Close()
+	if _, err := (&Client{URL: srv.URL}).Timestamp(sha256.Sum256([]byte("audit"))); err == nil {
+		t.Error("rejected request returned a token")
+	}
+}
+
+type testTimestamper struct {
+	fail    bool
+	digests [][sha256.Size]byte
+}
+
+func (ts *testTimestamper) Timestamp(digest [sha256.Size]byte) (*Token, error) {
+	if ts.fail {
+		return nil, errors.New("unavailable")
+	}
+	ts.digests = append(ts.digests, digest)
+	return &Token{Time: testGenTime}, nil
+}
+
+func TestBatcherChain(t *testing.T) {
+	ts := &testTimestamper{}
+	var receipts []Receipt
+	b := &Batcher{Timestamper: ts, Hook: func(r Receipt) { receipts = append(receipts, r) }}
+
+	if err := b.Flush(); err != nil || len(ts.digests) != 0 {
+		t.Fatalf("empty batch submitted: %v", err)
+	}
+	b.Add([]byte("login alice"))
+	b.Flush()
+
+	ts.fail = true
+	b.Add([]byte("login bob"))
+	if err := b.Flush(); err == nil {
+		t.Fatal("Flush succeeded with a failing timestamper")
+	}
+	ts.fail = false
+	b.Add([]byte("logout bob"))
+	if err := b.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+
+	if len(receipts) != 2 {
+		t.Fatalf("got %d receipts, want 2", len(receipts))
+	}
+	if receipts[1].Records != 2 {
+		t.Errorf("records of the failed batch not carried over: got %d records", receipts[1].Records)
+	}
+	if receipts[1].Previous != receipts[0].Digest || receipts[1].Seq != 2 {
+		t.Error("receipts are not chained")
+	}
+}
+
+// blockingTimestamper blocks each request until release is closed, then
+// fails it.
+type blockingTimestamper struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (ts *blockingTimestamper) Timestamp(digest [sha256.Size]byte) (*Token, error) {
+	ts.started <- struct{}{}
+	<-ts.release
+	return nil, errors.New("unavailable")
+}
+
+func TestBatcherAddDuringFlush(t *testing.T) {
+	ts := &blockingTimestamper{started: make(chan struct{}, 1), release: make(chan struct{})}
+	b := &Batcher{Timestamper: ts}
+	b.Add([]byte("login alice"))
+	flushed := make(chan error, 1)
+	go func() { flushed <- b.Flush() }()
+	<-ts.started
+
+	added := make(chan struct{})
+	go func() {
+		b.Add([]byte("login bob"))
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Add blocked behind the timestamper")
+	}
+	close(ts.release)
+	if err := <-flushed; err == nil {
+		t.Fatal("Flush succeeded with a failing timestamper")
+	}
+
+	// Both records are carried over, in order.
+	ok := &testTimestamper{}
+	b.Timestamper = ok
+	var receipt Receipt
+	b.Hook = func(r Receipt) { receipt = r }
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	want := &Batcher{Timestamper: &testTimestamper{}}
+	want.Add([]byte("login alice"))
+	want.Add([]byte("login bob"))
+	want.Hook = func(r Receipt) {
+		if r.Digest != receipt.Digest || receipt.Records != 2 {
+			t.Errorf("got receipt for %d records with digest %x, want 2 with %x", receipt.Records, receipt.Digest, r.Digest)
+		}
+	}
+	want.Flush()
+}
@@ -66,6 +66,10 @@ type ServerConfig struct {
 
 	hostKeys []Signer
 
+	// HostKeyAlgorithms, if set, restricts the host key algorithms
+	// announced for the keys added with AddHostKey.
+	HostKeyAlgorithms []string
+
 	// NoClientAuth is true if clients are allowed to connect without
 	// authenticating.
 	NoClientAuth bool
@@ -117,6 +121,21 @@ type ServerConfig struct {
 	// GSSAPIWithMICConfig includes gssapi server and callback, which if both non-nil, is used
 	// when gssapi-with-mic authentication is selected (RFC 4462 section 3).
 	GSSAPIWithMICConfig *GSSAPIWithMICConfig
+
+	// PreHandshakeHook, if non-nil, is called with the raw connection
+	// before the version exchange. It may return a wrapping connection
+	// to use instead, for example to measure traffic or to annotate the
+	// connection, or an error to reject the connection, which is then
+	// closed.
+	PreHandshakeHook func(c net.Conn) (net.Conn, error)
+
+	// HostKeySelectionHook, if non-nil, is called after the version
+	// exchange to choose the host keys offered on the connection, for
+	// example by its local address or by routing information that
+	// PreHandshakeHook attached to the connection, so that one server
+	// can present the identities of several hosts. A nil result keeps
+	// the keys added with AddHostKey; an error aborts the handshake.
+	HostKeySelectionHook func(c net.Conn, clientVersion []byte) ([]Signer, error)
 }
 
 // AddHostKey adds a private key as a host key. If an existing host
@@ -200,6 +219,15 @@ func NewServerConn(c net.Conn, config *ServerConfig) (*ServerConn, <-chan NewCha
 		}
 	}
 
+	if config.PreHandshakeHook != nil {
+		wrapped, err := config.PreHandshakeHook(c)
+		if err != nil {
+			c.Close()
+			return nil, nil, nil, err
+		}
+		c = wrapped
+	}
+
 	s := &connection{
 		sshConn: sshConn{conn: c},
 	}
@@ -224,7 +252,7 @@ func signAndMarshal(k Signer, rand io.Reader, data []byte) ([]byte, error) {
 
 // handshake performs key exchange and user authentication.
 func (c *connection) serverHandshake(config *ServerConfig) (*Permissions, error) {
-	if len(config.hostKeys) == 0 {
+	if len(config.hostKeys) == 0 && config.HostKeySelectionHook == nil {
 		return nil, errors.New("ssh: server has no host keys")
 	}
 
@@ -244,6 +272,9 @@ func (c *connection) serverHandshake(config *ServerConfig) (*Permissions, error)
 	if err != nil {
 		return nil, err
 	}
+	if err := config.selectHostKeys(c.sshConn.conn, c.clientVersion); err != nil {
+		return nil, err
+	}
 
 	tr := newTransport(c.sshConn.conn, config.Rand, false /* not client */)
 	c.transport = newServerTransport(tr, c.clientVersion, c.serverVersion, config)
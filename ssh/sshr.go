@@ -5,22 +5,27 @@
 package ssh
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
-	"os"
-	"path"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type userFile string
 
 var (
 	userAuthorizedKeysFile userFile = "authorized_keys"
-	userPrivateKeyFile     userFile = "id_rsa"
+	userPrivateKeyFile     userFile = "private key"
 )
 
+var errMasterKeyURI = errors.New("ssh: MasterKeyPath is a PKCS #11 URI; open the key and set MasterKeySigner instead")
+
 type AuthType int
 
 type ProxyConfig struct {
@@ -28,16 +33,257 @@ type ProxyConfig struct {
 	ServerConfig    *ServerConfig
 	ClientConfig    *ClientConfig
 	DestinationPort int
-	// Specify upstream host by SSH username
+	// Algorithms offered to downstream clients and upstream servers, for example to restrict the
+	// downstream to a FIPS profile while old appliances upstream keep legacy ciphers. Set them in
+	// ServerConfig and ClientConfig with ApplyAlgorithms.
+	DownstreamAlgorithms *Algorithms
+	UpstreamAlgorithms   *Algorithms
+	// Rekey thresholds of the downstream and upstream legs, for policies that require new keys every
+	// so many bytes or minutes. Set them in ServerConfig and ClientConfig with ApplyRekey.
+	DownstreamRekey *RekeyPolicy
+	UpstreamRekey   *RekeyPolicy
+	// Offer the algorithms of a staged rollout to a share of the downstream connections of ProxyServer,
+	// on top of those of ServerConfig, and record how their handshakes fare.
+	AlgorithmRollout *AlgorithmRollout
+	// Render the version strings announced to downstream clients by ProxyServer and to upstream servers,
+	// in place of ServerConfig.ServerVersion and the ClientVersion of the route's ClientConfig.
+	VersionTemplate *VersionTemplate
+	// Verify the host keys of upstream servers in place of the HostKeyCallback of the route's
+	// ClientConfig. It is called with the route's host and port, so known_hosts entries match by name;
+	// see knownhosts.New, and knownhosts.NewTOFU to persist the keys of hosts seen for the first time.
+	UpstreamHostKeyCallback HostKeyCallback
+	// Dial upstream hosts with this dialer, unless the route sets one, for example to reach them
+	// through an egress proxy with package proxydial. If nil, they are dialed directly.
+	UpstreamDialer ContextDialer
+	// Log in to jump hosts with this config, unless they set their own. If nil, ClientConfig is used with
+	// the master keys.
+	JumpClientConfig *ClientConfig
+	// Specify upstream host by SSH username. The host may be preceded by jump hosts it is reached
+	// through, as in OpenSSH's ProxyJump: "[user@]jump[:port],...,host". Space-separated hosts,
+	// such as the members of an HA pair, are tried in order by ProxyServer: "host1 host2".
 	FindUpstreamHook func(username string) (string, error)
-	// Fetch authorized_keys to confirm registration of the client's public key.
+	// Fetch authorized_keys to confirm registration of the client's public key. The cert-authority,
+	// principals, from, expiry-time and forwarding options are honored; entries with options the
+	// proxy cannot enforce, such as command, never match.
 	FetchAuthorizedKeysHook func(username string) ([]byte, error)
 	// Fetch the private key used when sshr performs public key authentication as a client user
 	// to the upstream host
 	FetchPrivateKeyHook func(username string) ([]byte, error)
+	// Fetch a signer in place of the private key, for example from agent.NewClient or an HSM, so that
+	// the key never has to be handed to the proxy. Takes precedence over FetchPrivateKeyHook.
+	FetchSignerHook func(username string) (Signer, error)
+	// Variants of the hooks above that take precedence when set and also get the metadata of the
+	// downstream connection. Their context is cancelled when the downstream connection drops or the
+	// context passed to AuthenticateProxyConnContext ends. HookCache keys their results by user only.
+	// Hooks that take only a username do not get the metadata; see HookMetadata.
+	FindUpstreamContextHook        func(ctx context.Context, meta HookMetadata) (string, error)
+	FetchAuthorizedKeysContextHook func(ctx context.Context, meta HookMetadata) ([]byte, error)
+	FetchPrivateKeyContextHook     func(ctx context.Context, meta HookMetadata) ([]byte, error)
+	// Route a downstream user to an upstream host, port and username in one call. Takes precedence
+	// over the FindUpstream hooks in RouteUpstream.
+	RouteUpstreamHook func(ctx context.Context, meta HookMetadata) (*UpstreamRoute, error)
+	// Verify downstream passwords before they are forwarded upstream. A non-empty result replaces the
+	// password sent upstream; an error rejects the attempt without contacting the upstream.
+	VerifyPasswordHook func(ctx context.Context, meta HookMetadata, password []byte) (string, error)
+	// CAs trusted to sign downstream user certificates. A certificate signed by one of them is accepted
+	// for the principals it lists, without an entry in the authorized keys.
+	TrustedUserCAs []PublicKey
+	// Map the principals of a verified downstream certificate to the upstream username, unless the
+	// route sets one. An empty result keeps the default username; an error rejects the certificate.
+	// Servers do not allow the username to change, so until a certificate is verified, requests that
+	// would be bridged as "none" are answered by the proxy, advertising only publickey.
+	CertUserHook func(username string, cert *Certificate) (string, error)
+	// Translate a downstream username to the upstream account, for example "alice@proxy" to "a.smith".
+	// If nil, the downstream username is used upstream.
+	MapUpstreamUserHook func(username string) (string, error)
+	// Resolve the home directory searched when FetchAuthorizedKeysHook or FetchPrivateKeyHook is nil,
+	// for users that are not in the local user database. If nil, os/user is consulted, then HomeLayout.Home.
+	HomeDirHook func(username string) (string, error)
+	// Where the key files are found in home directories, and how strictly their permissions are checked.
+	HomeLayout HomeLayout
+	// When the upstream rejects the re-signed public key but accepts passwords, called with the upstream
+	// username for a password (e.g. from a vault) to retry with. Returning an error passes the rejection
+	// on to the downstream. methods is nil if the upstream did not advertise its methods yet.
+	UpstreamPasswordHook func(username string, methods []string) (string, error)
+	// Variant of UpstreamPasswordHook that takes precedence when set and also gets the metadata of the
+	// downstream connection, whose User is the downstream username.
+	UpstreamPasswordContextHook func(ctx context.Context, meta HookMetadata, username string, methods []string) (string, error)
+	// Log every user that authenticated to the proxy in to the upstream with the password from
+	// UpstreamPasswordHook, so the upstream credentials are never disclosed. Downstream passwords must
+	// be accepted by VerifyPasswordHook first; without it they are forwarded unchanged.
+	InjectUpstreamPassword bool
+	// Send a "none" request to the upstream before bridging, so re-signed keys are only tried if the
+	// upstream accepts them, and UpstreamPasswordHook is used directly if it only accepts passwords.
+	ProbeUpstreamMethods bool
+	// Accept ssh-dss keys from downstream clients that cannot be upgraded. LegacyKeyHook, if set,
+	// is called whenever one is used.
+	AllowDSA      bool
+	LegacyKeyHook func(username string, key PublicKey)
 	// When using only the master key when sending requests to the upstream server, set A to true.
 	UseMasterKey  bool
 	MasterKeyPath string
+	// The master key as a signer, for example backed by a PKCS #11 module, an HSM or a TPM, so it does
+	// not have to be stored on disk. Takes precedence over MasterKeyPath.
+	MasterKeySigner Signer
+	// Further master keys, tried in order when the upstream rejects the previous one. During a key
+	// rotation, set the new key as the master key and keep the old one here until every upstream
+	// trusts the new key.
+	MasterKeys []Signer
+	// Choose the master keys by the upstream host, from the route or DestinationHost, for example to
+	// give production and staging fleets different proxy identities. The keys are tried in order; an
+	// empty result falls back to the master keys above.
+	MasterKeyHook func(host string) ([]Signer, error)
+	// Issue a short-lived certificate for a fresh key to log in to the upstream as username, for
+	// example with UpstreamCA.Sign. Replaces FetchPrivateKeyHook unless routes choose another strategy.
+	CertSignerHook func(username string, key PublicKey) (*Certificate, error)
+	// Assign the session of an authenticated user to a QoS class. If nil, every session is QoSInteractive.
+	QoSClassHook func(username string) QoSClass
+	// When set, the bandwidth of all sessions is shared between QoS classes by the throttler, separately in each direction.
+	QoS *QoSThrottler
+	// When set, sessions are throttled to the per-connection and per-user caps it chooses.
+	Bandwidth *BandwidthThrottler
+	// Called with the result of every downstream authentication attempt. err is nil on success.
+	AuthLogHook func(username, method string, err error)
+	// When set, called once the upstream accepted the user, before the downstream client is told. An error
+	// rejects the login, for example while a just-in-time access request awaits approval.
+	OnAuthSuccess func(p *ProxyConn, result AuthResult) error
+	// When set, called with every failed downstream authentication attempt but "none". An error disconnects
+	// the client instead of letting it try again.
+	OnAuthFailure func(p *ProxyConn, result AuthResult, err error) error
+	// When set, users the upstream accepted are held until it returns, for example once an on-call engineer
+	// approved the access. An error rejects the login, with its message as the reason. Held clients are sent
+	// keepalives every ApprovalKeepalive (15 seconds if unset) and rejected after ApprovalTimeout (five minutes
+	// if unset); HandshakeTimeouts.Auth includes the wait.
+	ApprovalHook      func(ctx context.Context, req ApprovalRequest) error
+	ApprovalTimeout   time.Duration
+	ApprovalKeepalive time.Duration
+	// Receives structured events about connections, authentication attempts and hook failures.
+	Logger Logger
+	// Receives typed audit events about authentication and sessions, for example to feed a SIEM.
+	AuditCallback func(ev AuditEvent)
+	// When set, the handshake, routing, authentication and relay phases are traced as spans.
+	TracerProvider TracerProvider
+	// When set, local and remote port forwards are restricted by the policy.
+	Forwarding *ForwardingPolicy
+	// Whether agent forwarding is relayed, refused, or answered by AgentHook with an agent the proxy
+	// controls, for example agent.ServeAgent of a keyring holding only the keys the user may use.
+	AgentForwarding AgentForwarding
+	AgentHook       func(p *ProxyConn, channel io.ReadWriteCloser) error
+	// Refuse X11 forwarding, or decide per user with X11Hook, which takes precedence. Requests are
+	// reported to AuditCallback as AuditX11Forwarding events.
+	DenyX11Forwarding bool
+	X11Hook           func(username string) error
+	// Called with every exec and subsystem request, which it may rewrite; an error refuses the request.
+	// Commands are reported to AuditCallback as AuditCommand events.
+	CommandHook func(req *CommandRequest) error
+	// Called with every environment variable the client sets, whose value it may rewrite; an error
+	// refuses the variable. AllowEnv returns a hook that allows a list of names.
+	EnvHook func(req *EnvRequest) error
+	// Called with every pty-req and window-change request, which it may rewrite, for example to cap the
+	// terminal size; an error refuses the request.
+	PTYHook func(req *PTYRequest) error
+	// When set, channel opens and requests are decoded and allowed, refused or rewritten by the policy;
+	// otherwise packets are relayed without looking into them.
+	ChannelPolicy *ChannelPolicy
+	// When set, sftp subsystem sessions are inspected: operations are logged and may be confined to a
+	// directory or refused by the policy.
+	SFTP *SFTPPolicy
+	// When set, files copied with scp are reported to AuditCallback and may be refused by the policy.
+	SCP *SCPPolicy
+	// When set, the terminal output of sessions with a pty is recorded, and also the input with RecordInput.
+	Recorder    Recorder
+	RecordInput bool
+	// When set with Recorder, the input is recorded as with RecordInput, except what is typed at prompts
+	// matching PasswordPrompt (DefaultPasswordPrompt if nil), which is redacted.
+	RecordKeystrokes bool
+	PasswordPrompt   *regexp.Regexp
+	// When set, authentication results, sessions and relayed bytes are counted for monitoring.
+	Metrics *ProxyMetrics
+	// When set, successful attempts are only reported to AuthLogHook and AuditCallback at the sampled rate.
+	AuditSampler *AuditSampler
+	// When set, hook results are remembered and served while the hook backends announce maintenance.
+	BackendState *HookBackendState
+	// NodeName identifies this proxy instance in the shared SessionRegistry.
+	NodeName string
+	// When set, ProxyServer refuses connections from source addresses it does not allow before the handshake.
+	AccessControl *AccessControl
+	// Shared state consulted before authenticating a downstream user, keyed by user and source IP.
+	AuthRateLimiter RateLimiter
+	BanList         BanList
+	// When set, failed authentication attempts are recorded by user and source IP, delaying further
+	// attempts and locking out those with too many failures.
+	AuthLockout AuthLockout
+	// Downstream clients are disconnected after MaxAuthTries failed authentication attempts, like
+	// OpenSSH's sshd. Zero means no limit.
+	MaxAuthTries int
+	// When set, established sessions are registered for the lifetime of ProxyConn.Wait.
+	SessionRegistry SessionRegistry
+	// When set, sessions of this node can be listed and terminated, also from other nodes.
+	Sessions *SessionManager
+	// When set, users with pinned keys may only authenticate with one of those keys.
+	KeyPins *KeyPins
+	// When set, logins and running sessions are scored by an external anomaly engine.
+	Anomaly *AnomalyScorer
+	// When set, ProxyConn.StepUp re-challenges users through their terminal with this hook.
+	StepUpHook func(username string, challenge KeyboardInteractiveChallenge) error
+	// How long users have to answer a step-up challenge (two minutes if unset).
+	StepUpTimeout time.Duration
+	// When set with StepUpHook, pty sessions without input for this long are locked until the user answers the challenge.
+	IdleLockAfter time.Duration
+	// Sessions without channel data in either direction for IdleTimeout, or running for MaxSessionDuration,
+	// are disconnected. Interactive sessions are warned TimeoutWarning before.
+	IdleTimeout        time.Duration
+	MaxSessionDuration time.Duration
+	TimeoutWarning     time.Duration
+	// When set, keepalive@openssh.com requests are sent to the downstream client and the upstream server every
+	// KeepaliveInterval, and the session is torn down once KeepaliveCountMax (three if unset) go unanswered.
+	KeepaliveInterval time.Duration
+	KeepaliveCountMax int
+	// When set, downstream clients that ProxyServer refuses after the handshake are sent the banner and
+	// disconnect message this hook maps the error to, for example with DefaultDisconnectMessage.
+	DisconnectHook func(err error) DisconnectMessage
+	// Phases of the downstream and upstream handshakes that exceed these limits fail with a
+	// HandshakeTimeoutError.
+	HandshakeTimeouts HandshakeTimeouts
+	// When set, the head of each session's transcript hash chain is reported every TranscriptInterval (one minute if unset) and at the end of the session,
+	// to this hook and to AuditCallback as an AuditTranscriptHead event. Setting only TranscriptInterval reports the heads to AuditCallback alone.
+	// See TranscriptChain for what the chain covers and how it is verified.
+	TranscriptHook     func(head TranscriptHead)
+	TranscriptInterval time.Duration
+	// When set, downstream users must also pass this keyboard-interactive challenge. It follows a key,
+	// certificate or password the proxy accepted itself, before the request is bridged upstream; requests
+	// left to the upstream, such as passwords without VerifyPasswordHook, get it once the upstream accepted
+	// them, and a failure then ends the connection. Rejected requests never get it.
+	SecondFactorHook func(username string, challenge KeyboardInteractiveChallenge) error
+	// When set, matching logins are exempt from SecondFactorHook.
+	MFAExemptions *MFAExemptions
+	// When set, returns the Policy of each user, for example with Policies.Lookup, when authentication
+	// starts. Users without a policy are refused.
+	PolicyHook func(username string) (*Policy, error)
+	// When set, the string it returns, if not empty, is shown to the downstream client before its first
+	// authentication attempt is bridged, for example a legal notice or a message of the day for conn.User().
+	// ServerConfig.BannerCallback is not used by the proxy.
+	BannerCallback func(conn ConnMetadata) string
+	// When set, banners of the upstream server are not relayed to the downstream client.
+	SuppressUpstreamBanners bool
+	// When set, banners of the upstream server are relayed as the string it returns instead, for example with
+	// internal hostnames stripped, and dropped if it is empty.
+	UpstreamBannerHook func(username, host, banner string) string
+	// When set and closed, new downstream sessions are refused with its banner.
+	Maintenance *MaintenanceGate
+	// When set, upstream authentication outcomes are counted per canary variant.
+	Canary *CanaryRouter
+	// When set, session snapshots are written here if a proxy goroutine panics.
+	SnapshotWriter io.Writer
+	// When set, the messages relayed for matching sessions are traced to its sink.
+	Trace *TracePolicy
+	// When set, results of the fetch hooks are cached for HookCacheTTL (one minute if unset). Private keys
+	// are not: the cache is shared with other nodes and readable by whoever can read its store.
+	HookCache    HookCache
+	HookCacheTTL time.Duration
+	// When set, results of the fetch hooks are also cached in memory, in front of HookCache, and concurrent
+	// fetches for a user share one hook call.
+	KeyCache *KeyCache
 }
 
 type ProxyConn struct {
@@ -45,73 +291,213 @@ type ProxyConn struct {
 	DestinationHost string
 	Upstream        *connection
 	Downstream      *connection
+	// Route, if set, is the route the upstream was dialed by. Its user and
+	// authentication strategy are applied to the upstream login.
+	Route *UpstreamRoute
+	// QoSClass is the class the session was assigned to after authentication.
+	QoSClass QoSClass
+
+	config *ProxyConfig
+	info   SessionInfo
+	// ctx is passed to the context hooks during authentication.
+	ctx context.Context
+	// spanCtx carries the parent of the authentication and relay spans.
+	spanCtx context.Context
+	// mappedUser is the upstream username from MapUpstreamUserHook if there
+	// is no Route.
+	mappedUser string
+	// announcedUser is the username of the first request sent upstream,
+	// which servers do not allow to change.
+	announcedUser string
+
+	// Bytes relayed in each direction, accessed atomically.
+	bytesUpstream   int64
+	bytesDownstream int64
+
+	channels channelTable
+	grab     inputGrab
+	// Time of the last input from the downstream client in UnixNano, accessed atomically.
+	lastInput int64
+	// Time of the last channel data in either direction in UnixNano, accessed atomically.
+	lastActivity int64
+	// Replies owed by the upstream and the downstream to global requests,
+	// tracked when keepalives are sent.
+	upstreamReplies   globalReplies
+	downstreamReplies globalReplies
+
+	transcript *TranscriptChain
+	agents     agentChannels
+	// x11Requested is set to 1 once an x11-req was allowed, accessed
+	// atomically.
+	x11Requested int32
+
+	// downstreamKey is the public key the downstream user authenticated with.
+	downstreamKey PublicKey
+	// attemptKey and attemptMethod are the public key, if any, and the
+	// method of the authentication request being handled.
+	attemptKey       PublicKey
+	attemptMethod    string
+	secondFactorDone bool
+	// firstFactorVerified is set if the proxy itself accepted the request
+	// being handled, as opposed to leaving it to the upstream.
+	firstFactorVerified bool
+	// authFailures counts the failed downstream authentication attempts.
+	authFailures int
+	// securityKey are the flags and counter of the signature of the
+	// authenticating security key, if any.
+	securityKey *skFields
+	// policy is the Policy of the user from PolicyHook, if any.
+	policy *Policy
+	// restrictions are the options of the authorized_keys entry of
+	// downstreamKey that restrict the session.
+	restrictions keyRestrictions
+
+	// bridgedMethod is the method of the request being bridged upstream. It is
+	// only "publickey" for re-signed requests. upstreamFailure is the
+	// upstream's rejection of it.
+	bridgedMethod   string
+	upstreamFailure *UpstreamAuthError
+	// upstreamMethods are the methods the upstream advertised, nil if unknown.
+	upstreamMethods []string
+	// upstreamSigAlgs are the signature algorithms the upstream accepts,
+	// from its server-sig-algs extension, or nil if it sent none.
+	upstreamSigAlgs []string
+	// spareSigners are tried in turn when the upstream rejects the
+	// re-signed request.
+	spareSigners []Signer
+
+	// State for snapshots, accessed atomically.
+	phase             int32
+	lastUpstreamMsg   uint32
+	lastDownstreamMsg uint32
 }
 
 func (p *ProxyConn) handleAuthMsg(msg *userAuthRequestMsg, proxyConf *ProxyConfig) (*userAuthRequestMsg, error) {
 	username := msg.User
+	p.restrictions = keyRestrictions{}
+	p.securityKey = nil
+	p.spareSigners = nil
+	p.firstFactorVerified = false
+	if p.policy != nil && !p.policy.allowsMethod(msg.Method) {
+		if err := p.Downstream.transport.writePacket(Marshal(&userAuthFailureMsg{Methods: p.policy.Methods})); err != nil {
+			return nil, err
+		}
+		return nil, errProxyAuthFailed
+	}
+	// Other methods would bypass the pins.
+	if msg.Method != "publickey" && p.pinnedToKeys() {
+		if err := p.Downstream.transport.writePacket(Marshal(&userAuthFailureMsg{Methods: []string{"publickey"}})); err != nil {
+			return nil, err
+		}
+		return nil, errProxyAuthFailed
+	}
 	switch msg.Method {
 	case "publickey":
-		if proxyConf.FetchAuthorizedKeysHook == nil {
-			proxyConf.FetchAuthorizedKeysHook = fetchAuthorizedKeysFromHomeDir
-		}
-
 		downStreamPublicKey, isQuery, sig, err := parsePublicKeyMsg(msg)
 		if err != nil {
 			break
 		}
+		isDSA := keyAlgoOf(downStreamPublicKey.Type()) == KeyAlgoDSA
+		if isDSA && !proxyConf.AllowDSA {
+			break
+		}
 
 		if isQuery {
-			if err := p.sendOKMsg(downStreamPublicKey); err != nil {
+			if err := p.sendOKMsg(publicKeyMsgAlgo(msg), downStreamPublicKey); err != nil {
 				return nil, err
 			}
 			return nil, nil
 		}
 
-		authKeys, err := proxyConf.FetchAuthorizedKeysHook(username)
-		if err != nil {
-			return noneAuthMsg(username), nil
-		}
+		var opts *keyOptions
+		if cert, isCert := downStreamPublicKey.(*Certificate); isCert && len(proxyConf.TrustedUserCAs) > 0 {
+			if err := p.checkUserCert(username, cert); err != nil {
+				return noneAuthMsg(username), nil
+			}
+			p.restrictions = certRestrictions(cert)
+		} else {
+			authKeys, err := proxyConf.BackendState.fetch(hookAuthorizedKeys, username, authorizedKeysHook(p.ctx, proxyConf, p.hookMetadata(downStreamPublicKey)))
+			if err != nil {
+				return noneAuthMsg(username), nil
+			}
 
-		ok, err := checkPublicKeyRegistration(authKeys, downStreamPublicKey)
-		if err != nil || !ok {
-			return noneAuthMsg(username), nil
+			opts, err = p.matchAuthorizedKeys(username, authKeys, downStreamPublicKey)
+			if err != nil || opts == nil {
+				return noneAuthMsg(username), nil
+			}
+			p.restrictions = opts.keyRestrictions
+			if cert, isCert := downStreamPublicKey.(*Certificate); isCert {
+				p.restrictions = p.restrictions.merge(certRestrictions(cert))
+			}
 		}
 
-		ok, err = p.VerifySignature(msg, downStreamPublicKey, sig)
+		ok, err := p.VerifySignature(msg, downStreamPublicKey, sig)
 		if err != nil || !ok {
 			break
 		}
+		if isSecurityKey(downStreamPublicKey) {
+			skf, err := checkSecurityKeySig(downStreamPublicKey, opts, sig)
+			if err != nil {
+				p.log(LogInfo, "security key signature rejected", "error", err)
+				break
+			}
+			p.securityKey = skf
+		}
 
-		privateBytes, err := fetchPrivateKey(proxyConf, p.User)
-		if err != nil {
-			break
+		if proxyConf.KeyPins != nil {
+			if err := proxyConf.KeyPins.check(username, downStreamPublicKey); err != nil {
+				break
+			}
+		}
+		p.downstreamKey = downStreamPublicKey
+		p.firstFactorVerified = true
+		if isDSA && proxyConf.LegacyKeyHook != nil {
+			proxyConf.LegacyKeyHook(username, downStreamPublicKey)
 		}
 
-		signer, err := ParsePrivateKey(privateBytes)
-		if err != nil || signer == nil {
+		if p.injectPassword() {
+			if req := p.passwordRequest(); req != nil {
+				return req, nil
+			}
 			break
 		}
 
-		authMethod := PublicKeys(signer)
-		f, ok := authMethod.(publicKeyCallback)
-		if !ok {
+		// Re-signing is pointless if the upstream does not take keys.
+		if !p.upstreamAccepts("publickey") {
+			if req := p.upstreamPasswordRequest(); req != nil {
+				return req, nil
+			}
 			break
 		}
 
-		signers, err := f()
+		signers, err := p.upstreamSigners()
 		if err != nil || len(signers) == 0 {
 			break
 		}
 
-		for _, signer := range signers {
-			msg, err = p.signAgain(username, msg, signer)
+		msg, err = p.signAgain(p.upstreamUser(), msg, signers[0])
+		if err != nil {
+			break
+		}
+		p.spareSigners = signers[1:]
+		return msg, nil
+
+	case "none":
+		// The probe already learned that the upstream needs authentication.
+		if proxyConf.ProbeUpstreamMethods && p.upstreamMethods != nil {
+			return nil, p.Downstream.transport.writePacket(downstreamFailure(userAuthFailureMsg{Methods: p.upstreamMethods}))
+		}
+		return msg, nil
+
+	case "password":
+		if proxyConf.VerifyPasswordHook != nil {
+			req, err := p.verifyPassword(msg)
 			if err != nil {
 				break
 			}
-			return msg, nil
+			p.firstFactorVerified = true
+			return req, nil
 		}
-
-	case "password":
 		// In the case of password authentication,
 		// since authentication is left up to the upstream server,
 		// it suffices to flow the packet as it is.
@@ -121,51 +507,34 @@ func (p *ProxyConn) handleAuthMsg(msg *userAuthRequestMsg, proxyConf *ProxyConfi
 		return msg, nil
 	}
 
-	err := p.sendFailureMsg(msg.Method)
-	return nil, err
-}
-
-func checkPublicKeyRegistration(authKeys []byte, publicKey PublicKey) (bool, error) {
-	publicKeyData := publicKey.Marshal()
-
-	var err error
-	var authorizedPublicKey PublicKey
-	for len(authKeys) > 0 {
-		authorizedPublicKey, _, _, authKeys, err = ParseAuthorizedKey(authKeys)
-		if err != nil {
-			return false, err
-		}
-
-		if bytes.Equal(authorizedPublicKey.Marshal(), publicKeyData) {
-			return true, nil
-		}
+	if err := p.sendFailureMsg(msg.Method); err != nil {
+		return nil, err
 	}
-	return false, nil
+	return nil, errProxyAuthFailed
 }
 
-func fetchAuthorizedKeysFromHomeDir(username string) ([]byte, error) {
-	authKeys, err := userAuthorizedKeysFile.read(username)
+func fetchAuthorizedKeysFromHomeDir(proxyConf *ProxyConfig, username string) ([]byte, error) {
+	authKeys, err := userAuthorizedKeysFile.read(proxyConf, username)
 	if err != nil {
 		return nil, err
 	}
 	return authKeys, nil
 }
 
-func fetchPrivateKey(proxyConf *ProxyConfig, username string) ([]byte, error) {
+func fetchPrivateKey(ctx context.Context, proxyConf *ProxyConfig, meta HookMetadata, useMasterKey bool) ([]byte, error) {
+	username := meta.User
 	var privateBytes []byte
 	var err error
-	if proxyConf.UseMasterKey {
-		privateBytes, err = ioutil.ReadFile(proxyConf.MasterKeyPath)
-		if err != nil {
-			return nil, err
+	if useMasterKey {
+		if strings.HasPrefix(proxyConf.MasterKeyPath, "pkcs11:") {
+			return nil, errMasterKeyURI
 		}
-	} else if proxyConf.FetchPrivateKeyHook == nil {
-		privateBytes, err = fetchPrivateKeyFromHomeDir(username)
+		privateBytes, err = ioutil.ReadFile(proxyConf.MasterKeyPath)
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		privateBytes, err = proxyConf.FetchPrivateKeyHook(username)
+		privateBytes, err = proxyConf.BackendState.fetch(hookPrivateKey, username, privateKeyHook(ctx, proxyConf, meta))
 		if err != nil {
 			return nil, err
 		}
@@ -173,41 +542,46 @@ func fetchPrivateKey(proxyConf *ProxyConfig, username string) ([]byte, error) {
 	return privateBytes, nil
 }
 
-func fetchPrivateKeyFromHomeDir(username string) ([]byte, error) {
-	privateBytes, err := userPrivateKeyFile.read(username)
+// upstreamSigners returns the signers that re-sign requests of the verified
+// downstream user for the upstream, in the order they are tried.
+func (p *ProxyConn) upstreamSigners() ([]Signer, error) {
+	var signer Signer
+	var err error
+	switch p.upstreamAuth() {
+	case UpstreamAuthMasterKey:
+		return p.config.masterKeys(p.ctx, p.upstreamHost())
+	case UpstreamAuthCert:
+		signer, err = newCertSigner(p.config, p.upstreamUser())
+	default:
+		if p.config.FetchSignerHook != nil {
+			signer, err = p.config.FetchSignerHook(p.User)
+			break
+		}
+		var privateBytes []byte
+		privateBytes, err = fetchPrivateKey(p.ctx, p.config, p.hookMetadata(p.downstreamKey), false)
+		if err == nil {
+			signer, err = ParsePrivateKey(privateBytes)
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
-	return privateBytes, nil
+	return []Signer{signer}, nil
 }
 
-func (file userFile) checkPermission(user string) error {
-	filename := userSpecFile(user, string(file))
-	f, err := os.Open(filename)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	fi, err := f.Stat()
+func fetchPrivateKeyFromHomeDir(proxyConf *ProxyConfig, username string) ([]byte, error) {
+	privateBytes, err := userPrivateKeyFile.read(proxyConf, username)
 	if err != nil {
-		return err
-	}
-
-	if fi.Mode().Perm()&0077 != 0 {
-		return fmt.Errorf("%v's perm is too open", filename)
+		return nil, err
 	}
-
-	return nil
-}
-
-func userSpecFile(username, file string) string {
-	return path.Join("/home", username, "/.ssh", file)
+	return privateBytes, nil
 }
 
-func (p *ProxyConn) sendOKMsg(key PublicKey) error {
+// sendOKMsg accepts a publickey query for key, echoing the algorithm it
+// announced as clients expect.
+func (p *ProxyConn) sendOKMsg(algo string, key PublicKey) error {
 	okMsg := userAuthPubKeyOkMsg{
-		Algo:   key.Type(),
+		Algo:   algo,
 		PubKey: key.Marshal(),
 	}
 
@@ -221,15 +595,21 @@ func (p *ProxyConn) sendFailureMsg(method string) error {
 	return p.Downstream.transport.writePacket(Marshal(&failureMsg))
 }
 
-func (file userFile) read(username string) ([]byte, error) {
-	return ioutil.ReadFile(userSpecFile(username, string(file)))
-}
-
 func (p *ProxyConn) VerifySignature(msg *userAuthRequestMsg, publicKey PublicKey, sig *Signature) (bool, error) {
 	if !isAcceptableAlgo(sig.Format) {
 		return false, fmt.Errorf("ssh: algorithm %q not accepted", sig.Format)
 	}
-	signedData := buildDataSignedForAuth(p.Downstream.transport.getSessionID(), *msg, []byte(publicKey.Type()), publicKey.Marshal())
+	if !sigFormatMatchesKey(sig.Format, publicKey.Type()) {
+		return false, fmt.Errorf("ssh: signature type %q for key type %q", sig.Format, publicKey.Type())
+	}
+	// A client announcing an rsa-sha2 algorithm must sign with it, not
+	// with SHA-1 or the other hash.
+	algo := publicKeyMsgAlgo(msg)
+	if sigAlgo := keyAlgoOf(algo); isRSASHA2(sigAlgo) && sig.Format != sigAlgo {
+		return false, fmt.Errorf("ssh: signature type %q for algorithm %q", sig.Format, algo)
+	}
+	// The signed data includes the announced algorithm, not the key type.
+	signedData := buildDataSignedForAuth(p.Downstream.transport.getSessionID(), *msg, []byte(algo), publicKey.Marshal())
 
 	if err := publicKey.Verify(signedData, sig); err != nil {
 		return false, nil
@@ -238,17 +618,74 @@ func (p *ProxyConn) VerifySignature(msg *userAuthRequestMsg, publicKey PublicKey
 	return true, nil
 }
 
+// keyAlgoOf returns the algorithm of the key in a certificate of type
+// keyType, or keyType itself for plain keys.
+func keyAlgoOf(keyType string) string {
+	for keyAlgo, certAlgo := range certAlgoNames {
+		if certAlgo == keyType {
+			return keyAlgo
+		}
+	}
+	return keyType
+}
+
+func isRSASHA2(algo string) bool {
+	return algo == SigAlgoRSASHA2256 || algo == SigAlgoRSASHA2512
+}
+
+// sigFormatMatchesKey reports whether format is a signature format of keys
+// of type keyType. RSA keys sign with SHA-1 or SHA-2, all others with their
+// own type only.
+func sigFormatMatchesKey(format, keyType string) bool {
+	keyAlgo := keyAlgoOf(keyType)
+	if keyAlgo == KeyAlgoRSA {
+		return format == SigAlgoRSA || isRSASHA2(format)
+	}
+	return format == keyAlgo
+}
+
+// algoMatchesKey reports whether the algorithm announced in a publickey
+// request is consistent with the type of the key blob. RSA keys and
+// certificates may be announced with their rsa-sha2 algorithms (RFC 8332).
+func algoMatchesKey(algo, keyType string) bool {
+	return algo == keyType || algo == requestAlgo(keyType, keyAlgoOf(algo))
+}
+
+// isAcceptableRequestAlgo reports whether algo may be announced in a
+// publickey request, including the rsa-sha2 algorithms of RSA certificates.
+func isAcceptableRequestAlgo(algo string) bool {
+	return isAcceptableAlgo(algo) || algo == CertSigAlgoRSASHA2256v01 || algo == CertSigAlgoRSASHA2512v01
+}
+
+// publicKeyMsgAlgo returns the algorithm announced in a publickey request.
+func publicKeyMsgAlgo(msg *userAuthRequestMsg) string {
+	if len(msg.Payload) < 1 {
+		return ""
+	}
+	algo, _, _ := parseString(msg.Payload[1:])
+	return string(algo)
+}
+
 func (p *ProxyConn) signAgain(user string, msg *userAuthRequestMsg, signer Signer) (*userAuthRequestMsg, error) {
 	rand := p.Upstream.transport.config.Rand
 	sessionID := p.Upstream.transport.getSessionID()
 	upStreamPublicKey := signer.PublicKey()
 	upStreamPublicKeyData := upStreamPublicKey.Marshal()
+	sigAlgo := p.upstreamSigAlgo(signer)
+	algo := requestAlgo(upStreamPublicKey.Type(), sigAlgo)
 
-	sign, err := signer.Sign(rand, buildDataSignedForAuth(sessionID, userAuthRequestMsg{
+	data := buildDataSignedForAuth(sessionID, userAuthRequestMsg{
 		User:    user,
 		Service: serviceSSH,
 		Method:  "publickey",
-	}, []byte(upStreamPublicKey.Type()), upStreamPublicKeyData))
+	}, []byte(algo), upStreamPublicKeyData)
+	var sign *Signature
+	var err error
+	if as, ok := signer.(AlgorithmSigner); ok && sigAlgo != "" {
+		sign, err = as.SignWithAlgorithm(rand, data, sigAlgo)
+	} else {
+		sign, err = signer.Sign(rand, data)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -263,7 +700,7 @@ func (p *ProxyConn) signAgain(user string, msg *userAuthRequestMsg, signer Signe
 		Service:  serviceSSH,
 		Method:   "publickey",
 		HasSig:   true,
-		Algoname: upStreamPublicKey.Type(),
+		Algoname: algo,
 		PubKey:   upStreamPublicKeyData,
 		Sig:      sig,
 	}
@@ -276,15 +713,102 @@ func (p *ProxyConn) signAgain(user string, msg *userAuthRequestMsg, signer Signe
 	return msg, nil
 }
 
-func (p *ProxyConn) Wait() error {
-	c := make(chan error, 1)
+func (p *ProxyConn) Wait() (err error) {
+	defer p.dumpOnPanic()
+	c := make(chan error, 2)
+
+	var up, down []*tokenBucket
+	if p.config != nil && p.config.QoS != nil {
+		qup, qdown := p.config.QoS.join(p.QoSClass)
+		defer p.config.QoS.leave(p.QoSClass)
+		up, down = append(up, qup), append(down, qdown)
+	}
+	if p.config != nil && p.config.Bandwidth != nil {
+		bup, bdown := p.config.Bandwidth.join(p.User, p.DestinationHost)
+		defer p.config.Bandwidth.leave(p.User)
+		up, down = append(up, bup...), append(down, bdown...)
+	}
+
+	p.info = p.sessionInfo()
+	atomic.StoreInt32(&p.phase, phaseRelay)
+	defer atomic.StoreInt32(&p.phase, phaseClosed)
+	if p.config != nil && p.config.SessionRegistry != nil {
+		if err := p.config.SessionRegistry.Register(p.info); err != nil {
+			p.Close()
+			return err
+		}
+		defer p.config.SessionRegistry.Unregister(p.info.ID)
+	}
+	if p.config != nil && p.config.Sessions != nil {
+		p.config.Sessions.track(p)
+		defer p.config.Sessions.untrack(p)
+	}
+	if p.config != nil && p.config.Metrics != nil {
+		p.config.Metrics.track(p)
+		defer p.config.Metrics.untrack(p)
+	}
+
+	spanCtx := p.spanCtx
+	if spanCtx == nil {
+		spanCtx = context.Background()
+	}
+	_, span := p.config.startSpan(spanCtx, spanRelay, SpanAttribute{"ssh.user", p.User}, SpanAttribute{"ssh.upstream.host", p.DestinationHost})
+	p.log(LogInfo, "session started")
+	p.audit(AuditEvent{Type: AuditSessionStart})
+	defer func() {
+		up, down := atomic.LoadInt64(&p.bytesUpstream), atomic.LoadInt64(&p.bytesDownstream)
+		span.SetAttributes(SpanAttribute{"ssh.bytes_upstream", up}, SpanAttribute{"ssh.bytes_downstream", down})
+		endSpan(span, err)
+		p.log(LogInfo, "session ended", "bytes_upstream", up, "bytes_downstream", down, "error", err)
+		p.audit(AuditEvent{Type: AuditSessionEnd, Err: err, BytesUpstream: up, BytesDownstream: down})
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	if p.config != nil && p.config.Anomaly != nil {
+		go p.config.Anomaly.watch(p, done)
+	}
+	if p.config != nil && (p.config.TranscriptHook != nil || p.config.TranscriptInterval > 0) {
+		interval := p.config.TranscriptInterval
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		p.transcript = NewTranscriptChain(p.info.ID)
+		go p.watchTranscript(interval, done)
+	}
+	if p.config != nil && p.config.StepUpHook != nil && p.config.IdleLockAfter > 0 {
+		atomic.StoreInt64(&p.lastInput, time.Now().UnixNano())
+		go p.watchIdle(p.config.IdleLockAfter, done)
+	}
+	if p.config != nil && (p.config.IdleTimeout > 0 || p.config.MaxSessionDuration > 0) {
+		atomic.StoreInt64(&p.lastActivity, time.Now().UnixNano())
+		go p.watchTimeouts(done)
+	}
+	if p.keepalives() {
+		go p.watchKeepalives(done)
+	}
+
+	if p.config != nil && p.config.Recorder != nil {
+		defer p.stopRecordings()
+	}
+	if p.config != nil && p.config.AgentForwarding == AgentLocal {
+		defer p.closeAgents()
+	}
+	if p.config != nil && p.config.SFTP != nil {
+		defer p.finishSFTP()
+	}
+	if p.config != nil && p.config.SCP != nil {
+		defer p.finishSCP()
+	}
 
 	go func() {
-		c <- piping(p.Upstream.transport, p.Downstream.transport)
+		defer p.dumpOnPanic()
+		c <- p.piping(p.Upstream.transport, p.Downstream.transport, toUpstream, up, &p.bytesUpstream)
 	}()
 
 	go func() {
-		c <- piping(p.Downstream.transport, p.Upstream.transport)
+		defer p.dumpOnPanic()
+		c <- p.piping(p.Downstream.transport, p.Upstream.transport, toDownstream, down, &p.bytesDownstream)
 	}()
 
 	defer p.Close()
@@ -310,6 +834,49 @@ func (p *ProxyConn) checkBridgeAuthWithNoBanner(packet []byte) (bool, error) {
 
 		msgType := packet[0]
 
+		switch msgType {
+		case msgExtInfo:
+			// Servers may update their extensions right before
+			// SSH_MSG_USERAUTH_SUCCESS; they are not meant for the
+			// downstream, which did not negotiate them with the proxy.
+			extensions, err := parseExtInfo(packet)
+			if err != nil {
+				return false, err
+			}
+			p.setUpstreamExtensions(extensions)
+			continue
+		case msgUserAuthBanner:
+			if err := p.relayUpstreamBanner(packet); err != nil {
+				return false, err
+			}
+			continue
+		case msgUserAuthSuccess:
+			if !p.firstFactorVerified {
+				if err := p.secondFactor(p.attemptMethod); err != nil {
+					if err == errSecondFactorFailed {
+						p.logAuth("keyboard-interactive", err)
+						p.disconnect(disconnectNoMoreAuthMethodsAvailable, "second factor authentication failed")
+					}
+					return false, err
+				}
+			}
+			if err := p.approveSession(p.attemptMethod); err != nil {
+				return false, err
+			}
+		case msgUserAuthFailure:
+			retry, forward, err := p.upstreamRejected(packet)
+			if err != nil {
+				return false, err
+			}
+			if retry != nil {
+				if err := p.Upstream.transport.writePacket(retry); err != nil {
+					return false, err
+				}
+				continue
+			}
+			packet = forward
+		}
+
 		if err = p.Downstream.transport.writePacket(packet); err != nil {
 			return false, err
 		}
@@ -317,8 +884,15 @@ func (p *ProxyConn) checkBridgeAuthWithNoBanner(packet []byte) (bool, error) {
 		switch msgType {
 		case msgUserAuthSuccess:
 			return true, nil
-		case msgUserAuthBanner:
-			continue
+		case msgUserAuthInfoRequest:
+			// Prompts of the upstream, for example for a one-time password,
+			// are answered by the downstream user.
+			if p.bridgedMethod == "keyboard-interactive" {
+				if err := p.relayInfoResponse(); err != nil {
+					return false, err
+				}
+				continue
+			}
 		case msgUserAuthFailure:
 		default:
 		}
@@ -327,27 +901,184 @@ func (p *ProxyConn) checkBridgeAuthWithNoBanner(packet []byte) (bool, error) {
 	}
 }
 
+// approveSession runs the checks that may still reject a user after the
+// upstream accepted the authentication with method. A rejected user is
+// disconnected.
+func (p *ProxyConn) approveSession(method string) error {
+	if p.config.Anomaly != nil && p.config.Anomaly.scoreAuth(p, time.Now()) != AnomalyAllow {
+		p.disconnect(disconnectByApplication, "login rejected by policy")
+		return errAnomalyRejected
+	}
+	if p.config.OnAuthSuccess != nil {
+		if err := p.config.OnAuthSuccess(p, p.authResult(method)); err != nil {
+			p.disconnect(disconnectByApplication, "login rejected by policy")
+			return &proxyError{cause: ErrAuthRejected, detail: "OnAuthSuccess", err: err}
+		}
+	}
+	if p.config.ApprovalHook != nil {
+		return p.awaitApproval(p.authResult(method))
+	}
+	return nil
+}
+
 func (p *ProxyConn) AuthenticateProxyConn(initUserAuthMsg *userAuthRequestMsg, proxyConf *ProxyConfig) error {
-	err := p.Upstream.sendAuthReq()
+	return p.AuthenticateProxyConnContext(context.Background(), initUserAuthMsg, proxyConf)
+}
+
+// AuthenticateProxyConnContext is like AuthenticateProxyConn. The context
+// hooks of proxyConf get a context derived from ctx that is also cancelled
+// when the downstream connection drops.
+func (p *ProxyConn) AuthenticateProxyConnContext(ctx context.Context, initUserAuthMsg *userAuthRequestMsg, proxyConf *ProxyConfig) (err error) {
+	p.spanCtx = ctx
+	ctx, span := proxyConf.startSpan(ctx, spanAuthenticate, SpanAttribute{"ssh.user", p.User}, SpanAttribute{"ssh.upstream.host", p.DestinationHost})
+	defer func() { endSpan(span, err) }()
+	phases := startPhases(ctx, p.Downstream.NetConn(), p.Upstream.NetConn())
+	// The connections outlive the deadline of ctx.
+	phases.restore = time.Time{}
+	phases.begin("auth", proxyConf.HandshakeTimeouts.Auth)
+	defer func() { err = phases.end(err) }()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-p.Downstream.transport.readDone:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	p.ctx = withHookMetadata(ctx, p.hookMetadata(nil))
+
+	p.config = proxyConf
+	atomic.StoreInt32(&p.phase, phaseAuth)
+	defer p.dumpOnPanic()
+
+	if proxyConf.Maintenance != nil {
+		if err := p.checkMaintenance(proxyConf.Maintenance); err != nil {
+			return err
+		}
+	}
+
+	if err := p.checkSharedLimits(initUserAuthMsg.User); err != nil {
+		return err
+	}
+
+	if proxyConf.PolicyHook != nil {
+		if err := p.applyPolicy(); err != nil {
+			return err
+		}
+	}
+
+	if err := p.sendBanner(); err != nil {
+		return err
+	}
+
+	if p.Route == nil {
+		user, err := proxyConf.mapUpstreamUser(p.User)
+		if err != nil {
+			return err
+		}
+		p.mappedUser = user
+	}
+
+	extensions, err := p.Upstream.sendAuthReq()
 	if err != nil {
 		return err
 	}
+	p.setUpstreamExtensions(extensions)
+
+	if proxyConf.ProbeUpstreamMethods {
+		ok, err := p.probeUpstream()
+		if err != nil {
+			return err
+		}
+		if ok && !p.pinnedToKeys() {
+			// The upstream needs no authentication, which bridging a "none"
+			// request to it would have revealed as well.
+			if err := p.approveSession("none"); err != nil {
+				return err
+			}
+			if err := p.Downstream.transport.writePacket([]byte{msgUserAuthSuccess}); err != nil {
+				return err
+			}
+			if proxyConf.QoSClassHook != nil {
+				p.QoSClass = proxyConf.QoSClassHook(p.User)
+			}
+			return nil
+		}
+	}
 
 	userAuthMsg := initUserAuthMsg
 	for {
+		// As in sshd, the user may not change between requests: keys are
+		// checked for the requested user, but the upstream login is p.User's.
+		if userAuthMsg.User != p.User || userAuthMsg.Service != serviceSSH {
+			p.disconnect(disconnectProtocolError, "change of username or service not allowed")
+			return errUserChanged
+		}
+		method := userAuthMsg.Method
+		var failure error
+		p.logAuthAttempt(userAuthMsg)
 		userAuthMsg, err = p.handleAuthMsg(userAuthMsg, proxyConf)
 		if err != nil {
-			fmt.Println(err)
+			if err != errProxyAuthFailed {
+				p.log(LogError, "authentication hook failed", "method", method, "error", err)
+			}
+			p.logAuth(method, err)
+			failure = err
+		}
+
+		// Requests the proxy did not verify get the second factor once the
+		// upstream accepted them, so that it is no oracle for the codes.
+		if userAuthMsg != nil && p.firstFactorVerified {
+			if err := p.secondFactor(method); err != nil {
+				if err != errSecondFactorFailed {
+					return err
+				}
+				p.logAuth("keyboard-interactive", err)
+				userAuthMsg = nil
+				failure = err
+			}
+		}
+
+		if userAuthMsg != nil && userAuthMsg.Method == "none" && p.holdUpstreamUser() {
+			if err := p.Downstream.transport.writePacket(downstreamFailure(userAuthFailureMsg{Methods: p.upstreamMethods})); err != nil {
+				return err
+			}
+			p.logAuth(method, errProxyAuthFailed)
+			userAuthMsg = nil
+			failure = errProxyAuthFailed
 		}
 
 		if userAuthMsg != nil {
+			userAuthMsg.User = p.upstreamUser()
+			if p.announcedUser == "" {
+				p.announcedUser = userAuthMsg.User
+			}
+			p.bridgedMethod, p.upstreamFailure = userAuthMsg.Method, nil
 			isSuccess, err := p.checkBridgeAuthWithNoBanner(Marshal(userAuthMsg))
 			if err != nil {
 				return err
 			}
+			if proxyConf.Canary != nil && method != "none" {
+				proxyConf.Canary.recordAuth(p.DestinationHost, isSuccess)
+			}
 			if isSuccess {
+				span.SetAttributes(SpanAttribute{"ssh.auth.method", method})
+				p.logAuth(method, nil)
+				p.authSucceeded()
+				if proxyConf.QoSClassHook != nil {
+					p.QoSClass = proxyConf.QoSClassHook(p.User)
+				}
 				return nil
 			}
+			failure = p.upstreamAuthError()
+			p.logAuth(method, failure)
+		}
+
+		if failure != nil {
+			if err := p.authFailed(method, failure); err != nil {
+				return err
+			}
 		}
 
 		var packet []byte
@@ -355,6 +1086,9 @@ func (p *ProxyConn) AuthenticateProxyConn(initUserAuthMsg *userAuthRequestMsg, p
 		for {
 			// Read next msg after a failure
 			if packet, err = p.Downstream.transport.readPacket(); err != nil {
+				if failure != nil {
+					return &proxyError{cause: ErrAuthRejected, detail: "client disconnected", err: err}
+				}
 				return err
 			}
 
@@ -391,7 +1125,7 @@ func parsePublicKeyMsg(userAuthReq *userAuthRequestMsg) (PublicKey, bool, *Signa
 		return nil, false, nil, parseError(msgUserAuthRequest)
 	}
 	algo := string(algoBytes)
-	if !isAcceptableAlgo(algo) {
+	if !isAcceptableRequestAlgo(algo) {
 		return nil, false, nil, fmt.Errorf("ssh: algorithm %q not accepted", algo)
 	}
 
@@ -404,6 +1138,9 @@ func parsePublicKeyMsg(userAuthReq *userAuthRequestMsg) (PublicKey, bool, *Signa
 	if err != nil {
 		return nil, false, nil, err
 	}
+	if !algoMatchesKey(algo, publicKey.Type()) {
+		return nil, false, nil, fmt.Errorf("ssh: algorithm %q for key type %q", algo, publicKey.Type())
+	}
 
 	var sig *Signature
 	if !isQuery {
@@ -416,14 +1153,99 @@ func parsePublicKeyMsg(userAuthReq *userAuthRequestMsg) (PublicKey, bool, *Signa
 	return publicKey, isQuery, sig, nil
 }
 
-func piping(dst, src packetConn) error {
+func (p *ProxyConn) piping(dst, src packetConn, dir relayDirection, buckets []*tokenBucket, counter *int64) error {
 	for {
-		p, err := src.readPacket()
+		packet, err := src.readPacket()
 		if err != nil {
 			return err
 		}
+		atomic.AddInt64(counter, int64(len(packet)))
+		if packet[0] == msgChannelData || packet[0] == msgChannelExtendedData {
+			atomic.StoreInt64(&p.lastActivity, time.Now().UnixNano())
+		}
+		if dir == toUpstream {
+			atomic.StoreUint32(&p.lastUpstreamMsg, uint32(packet[0]))
+		} else {
+			atomic.StoreUint32(&p.lastDownstreamMsg, uint32(packet[0]))
+		}
+		if p.keepalives() && p.filterKeepaliveReply(dir, packet) {
+			continue
+		}
+		if p.filterRestricted(dir, packet) {
+			continue
+		}
+		if p.forwarding() != nil && p.filterForwarding(dir, packet) {
+			continue
+		}
+		if p.config != nil && p.config.AgentForwarding != AgentPassThrough && p.filterAgent(dir, packet) {
+			continue
+		}
+		if p.config != nil && p.filterX11(dir, packet) {
+			continue
+		}
+		if p.config != nil && (p.config.CommandHook != nil || p.config.AuditCallback != nil) {
+			if packet = p.filterCommand(dir, packet); packet == nil {
+				continue
+			}
+		}
+		if p.config != nil && p.config.EnvHook != nil {
+			if packet = p.filterEnv(dir, packet); packet == nil {
+				continue
+			}
+		}
+		if p.config != nil && p.config.PTYHook != nil {
+			if packet = p.filterPTY(dir, packet); packet == nil {
+				continue
+			}
+		}
+		if p.config != nil && p.config.ChannelPolicy != nil {
+			if packet = p.applyChannelPolicy(dir, packet); packet == nil {
+				continue
+			}
+		}
+		if p.config != nil && p.config.SFTP != nil {
+			if packet, err = p.filterSFTP(dir, packet); err != nil {
+				return err
+			}
+			if packet == nil {
+				continue
+			}
+		}
+		if p.config != nil && p.config.SCP != nil {
+			if packet, err = p.filterSCP(dir, packet); err != nil {
+				return err
+			}
+			if packet == nil {
+				continue
+			}
+		}
+		p.record(dir, packet)
+		p.channels.observe(dir, packet)
+		if p.config != nil && p.config.Trace != nil {
+			p.config.Trace.trace(p, dir, packet)
+		}
+
+		if dir == toUpstream && p.divert(packet) {
+			continue
+		}
+		if dir == toDownstream && packet[0] == msgChannelWindowAdjust && !p.channels.withholdAdjust(dir, packet) {
+			continue
+		}
+		p.recordTranscript(dir, packet)
+		if dir == toDownstream {
+			p.grab.hold()
+		}
 
-		if err := dst.writePacket(p); err != nil {
+		if buckets != nil {
+			waitBuckets(buckets, len(packet))
+		}
+
+		if p.keepalives() && packet[0] == msgGlobalRequest {
+			err = p.replies(dir).send(dst, packet, false)
+		} else {
+			err = dst.writePacket(packet)
+		}
+		if err != nil {
 			return err
 		}
 	}
@@ -438,15 +1260,32 @@ func noneAuthMsg(user string) *userAuthRequestMsg {
 }
 
 func NewDownstreamConn(c net.Conn, config *ServerConfig) (*connection, error) {
+	return NewDownstreamConnContext(context.Background(), c, config, HandshakeTimeouts{})
+}
+
+// NewDownstreamConnContext is like NewDownstreamConn, but the connection is
+// closed if ctx is done or a phase of the handshake exceeds its timeout
+// before the handshake completes.
+func NewDownstreamConnContext(ctx context.Context, c net.Conn, config *ServerConfig, timeouts HandshakeTimeouts) (*connection, error) {
 	fullConf := *config
 	fullConf.SetDefaults()
 
+	if config.PreHandshakeHook != nil {
+		wrapped, err := config.PreHandshakeHook(c)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c = wrapped
+	}
+
 	conn := &connection{
 		sshConn: sshConn{conn: c},
 	}
 
-	_, err := conn.serverHandshakeWithNoAuth(&fullConf)
-	if err != nil {
+	phases := startPhases(ctx, c)
+	_, err := conn.serverHandshakeWithNoAuth(&fullConf, phases, timeouts)
+	if err = phases.end(err); err != nil {
 		c.Close()
 		return nil, err
 	}
@@ -454,7 +1293,20 @@ func NewDownstreamConn(c net.Conn, config *ServerConfig) (*connection, error) {
 	return conn, nil
 }
 
+// NetConn returns the underlying network connection, which is the one
+// returned by ServerConfig.PreHandshakeHook if it wrapped the connection.
+func (c *connection) NetConn() net.Conn {
+	return c.sshConn.conn
+}
+
 func NewUpstreamConn(c net.Conn, config *ClientConfig) (*connection, error) {
+	return NewUpstreamConnContext(context.Background(), c, config, HandshakeTimeouts{})
+}
+
+// NewUpstreamConnContext is like NewUpstreamConn, but the connection is
+// closed if ctx is done or a phase of the handshake exceeds its timeout
+// before the handshake completes.
+func NewUpstreamConnContext(ctx context.Context, c net.Conn, config *ClientConfig, timeouts HandshakeTimeouts) (*connection, error) {
 	fullConf := *config
 	fullConf.SetDefaults()
 
@@ -462,7 +1314,9 @@ func NewUpstreamConn(c net.Conn, config *ClientConfig) (*connection, error) {
 		sshConn: sshConn{conn: c},
 	}
 
-	if err := conn.clientHandshakeWithNoAuth(c.RemoteAddr().String(), &fullConf); err != nil {
+	phases := startPhases(ctx, c)
+	err := conn.clientHandshakeWithNoAuth(c.RemoteAddr().String(), &fullConf, phases, timeouts)
+	if err = phases.end(err); err != nil {
 		c.Close()
 		return nil, err
 	}
@@ -470,17 +1324,28 @@ func NewUpstreamConn(c net.Conn, config *ClientConfig) (*connection, error) {
 	return conn, nil
 }
 
-func (c *connection) sendAuthReq() error {
+// sendAuthReq requests the userauth service. It returns the extensions the
+// server sent before accepting, if any.
+func (c *connection) sendAuthReq() (map[string][]byte, error) {
 	if err := c.transport.writePacket(Marshal(&serviceRequestMsg{serviceUserAuth})); err != nil {
-		return err
+		return nil, err
 	}
 
 	packet, err := c.transport.readPacket()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	var extensions map[string][]byte
+	if packet[0] == msgExtInfo {
+		if extensions, err = parseExtInfo(packet); err != nil {
+			return nil, err
+		}
+		if packet, err = c.transport.readPacket(); err != nil {
+			return nil, err
+		}
 	}
 	var serviceAccept serviceAcceptMsg
-	return Unmarshal(packet, &serviceAccept)
+	return extensions, Unmarshal(packet, &serviceAccept)
 }
 
 func (c *connection) GetAuthRequestMsg() (*userAuthRequestMsg, error) {
@@ -500,18 +1365,20 @@ func (c *connection) GetAuthRequestMsg() (*userAuthRequestMsg, error) {
 	return &userAuthReq, nil
 }
 
-func (c *connection) clientHandshakeWithNoAuth(dialAddress string, config *ClientConfig) error {
+func (c *connection) clientHandshakeWithNoAuth(dialAddress string, config *ClientConfig, phases *handshakePhases, timeouts HandshakeTimeouts) error {
 	c.clientVersion = []byte(packageVersion)
 	if config.ClientVersion != "" {
 		c.clientVersion = []byte(config.ClientVersion)
 	}
 
 	var err error
+	phases.begin("version", timeouts.Version)
 	c.serverVersion, err = exchangeVersions(c.sshConn.conn, c.clientVersion)
 	if err != nil {
 		return err
 	}
 
+	phases.begin("kex", timeouts.KeyExchange)
 	c.transport = newClientTransport(
 		newTransport(c.sshConn.conn, config.Rand, true /* is client */),
 		c.clientVersion, c.serverVersion, config, dialAddress, c.sshConn.RemoteAddr())
@@ -524,8 +1391,8 @@ func (c *connection) clientHandshakeWithNoAuth(dialAddress string, config *Clien
 	return nil
 }
 
-func (c *connection) serverHandshakeWithNoAuth(config *ServerConfig) (*Permissions, error) {
-	if len(config.hostKeys) == 0 {
+func (c *connection) serverHandshakeWithNoAuth(config *ServerConfig, phases *handshakePhases, timeouts HandshakeTimeouts) (*Permissions, error) {
+	if len(config.hostKeys) == 0 && config.HostKeySelectionHook == nil {
 		return nil, errors.New("ssh: server has no host keys")
 	}
 
@@ -535,11 +1402,17 @@ func (c *connection) serverHandshakeWithNoAuth(config *ServerConfig) (*Permissio
 	} else {
 		c.serverVersion = []byte("SSH-2.0-sshr")
 	}
+	phases.begin("version", timeouts.Version)
 	c.clientVersion, err = exchangeVersions(c.sshConn.conn, c.serverVersion)
 	if err != nil {
 		return nil, err
 	}
 
+	phases.begin("kex", timeouts.KeyExchange)
+	if err := config.selectHostKeys(c.sshConn.conn, c.clientVersion); err != nil {
+		return nil, err
+	}
+
 	tr := newTransport(c.sshConn.conn, config.Rand, false /* not client */)
 	c.transport = newServerTransport(tr, c.clientVersion, c.serverVersion, config)
 
@@ -0,0 +1,93 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ErrAccessDenied is returned for downstream connections refused by an
+// AccessControl.
+var ErrAccessDenied = errors.New("ssh: source address not allowed")
+
+// AccessControl decides by their source address which downstream
+// connections are served. It is consulted before the version exchange, so
+// that blocked clients, such as scanners, are rejected without the cost of
+// a key exchange. Set it as ProxyConfig.AccessControl, or as the
+// PreHandshakeHook of a ServerConfig passed to NewDownstreamConn.
+type AccessControl struct {
+	// Deny lists networks whose connections are refused. Allow, if set,
+	// lists the only networks whose connections are served. Deny takes
+	// precedence.
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+
+	// Hook, if non-nil, decides about the connections the lists allow,
+	// for example by a reputation service. An error refuses the
+	// connection.
+	Hook func(addr net.Addr) error
+}
+
+// ParseCIDRs parses networks in CIDR notation for AccessControl. Plain
+// addresses are taken as networks of a single address.
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("ssh: invalid address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Check returns ErrAccessDenied, or the error of Hook, if connections from
+// addr are not allowed.
+func (a *AccessControl) Check(addr net.Addr) error {
+	ip := net.ParseIP(sourceHost(addr))
+	if ip == nil {
+		return ErrAccessDenied
+	}
+	if containsIP(a.Deny, ip) {
+		return ErrAccessDenied
+	}
+	if len(a.Allow) > 0 && !containsIP(a.Allow, ip) {
+		return ErrAccessDenied
+	}
+	if a.Hook != nil {
+		return a.Hook(addr)
+	}
+	return nil
+}
+
+// PreHandshakeHook checks the remote address of c, for use as
+// ServerConfig.PreHandshakeHook.
+func (a *AccessControl) PreHandshakeHook(c net.Conn) (net.Conn, error) {
+	if err := a.Check(c.RemoteAddr()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
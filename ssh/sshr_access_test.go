@@ -0,0 +1,101 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func mustParseCIDRs(t *testing.T, cidrs ...string) []*net.IPNet {
+	nets, err := ParseCIDRs(cidrs...)
+	if err != nil {
+		t.Fatalf("ParseCIDRs: %v", err)
+	}
+	return nets
+}
+
+func TestAccessControlCheck(t *testing.T) {
+	errHook := errors.New("hook")
+	a := &AccessControl{
+		Allow: mustParseCIDRs(t, "10.0.0.0/8", "2001:db8::/32", "192.0.2.7"),
+		Deny:  mustParseCIDRs(t, "10.1.0.0/16"),
+		Hook: func(addr net.Addr) error {
+			if addr.(*net.TCPAddr).IP.Equal(net.ParseIP("10.0.0.99")) {
+				return errHook
+			}
+			return nil
+		},
+	}
+	for _, tc := range []struct {
+		ip   string
+		want error
+	}{
+		{"10.2.3.4", nil},
+		{"2001:db8::1", nil},
+		{"192.0.2.7", nil},
+		{"192.0.2.8", ErrAccessDenied},
+		{"10.1.2.3", ErrAccessDenied},
+		{"10.0.0.99", errHook},
+	} {
+		addr := &net.TCPAddr{IP: net.ParseIP(tc.ip), Port: 2222}
+		if err := a.Check(addr); err != tc.want {
+			t.Errorf("Check(%s): got %v, want %v", tc.ip, err, tc.want)
+		}
+	}
+
+	if _, err := ParseCIDRs("10.0.0.0/33"); err == nil {
+		t.Error("ParseCIDRs accepted an invalid prefix")
+	}
+}
+
+func TestProxyServerAccessControl(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ac   *AccessControl
+		want error
+	}{
+		{"denied", &AccessControl{Deny: mustParseCIDRs(t, "127.0.0.0/8")}, ErrAccessDenied},
+		{"allowed", &AccessControl{Allow: mustParseCIDRs(t, "127.0.0.1")}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			proxyConf := newTestProxyConfig()
+			proxyConf.FindUpstreamHook = func(username string) (string, error) { return "upstream", nil }
+			proxyConf.AccessControl = tc.ac
+			failed := make(chan error, 1)
+			s := &ProxyServer{
+				Config: proxyConf,
+				Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					u1, u2, err := netPipe()
+					if err != nil {
+						return nil, err
+					}
+					go serveTestUpstream(u1, newTestUpstreamConfig())
+					return u2, nil
+				},
+				ErrorHook: func(c net.Conn, err error) { failed <- err },
+			}
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go s.Serve(l)
+			defer s.Close()
+
+			client, err := dialTestProxyServer(l.Addr().String())
+			if tc.want == nil {
+				if err != nil {
+					t.Fatalf("Dial: %v", err)
+				}
+				client.Close()
+				return
+			}
+			if err == nil {
+				t.Fatal("denied source connected")
+			}
+			if err := <-failed; err != tc.want {
+				t.Errorf("got error %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,304 @@
+package ssh
+
+import (
+	"io"
+	"sync"
+)
+
+// AgentForwarding is what the proxy does with agent forwarding.
+type AgentForwarding int
+
+const (
+	// AgentPassThrough relays agent forwarding between the downstream
+	// client and the upstream unchanged.
+	AgentPassThrough AgentForwarding = iota
+	// AgentBlock refuses agent forwarding, so the user's agent is never
+	// reachable from the upstream.
+	AgentBlock
+	// AgentLocal lets the upstream use an agent the proxy controls instead
+	// of the user's: agent channels the upstream opens are answered by
+	// ProxyConfig.AgentHook and never reach the downstream client.
+	AgentLocal
+)
+
+// Channels answered by the proxy get IDs from this value upwards, far above
+// the IDs that clients allocate, so that the upstream's packets for them
+// can be told apart from those for the downstream client.
+const agentChannelBase = 0xf0000000
+
+// The window and packet size the proxy offers on agent channels, enough
+// for any agent message.
+const (
+	agentWindowSize = 256 * 1024
+	agentMaxPacket  = 32 * 1024
+)
+
+// agentChannels are the agent channels of a ProxyConn that the proxy
+// answers itself.
+type agentChannels struct {
+	mu     sync.Mutex
+	nextID uint32
+	byID   map[uint32]*agentChannel
+}
+
+// agentChannel is an auth-agent@openssh.com channel opened by the upstream
+// and terminated by the proxy. It implements io.ReadWriteCloser for the
+// AgentHook.
+type agentChannel struct {
+	p        *ProxyConn
+	localID  uint32
+	remoteID uint32
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  []byte
+	eof  bool
+	// closed is set once either side closed the channel and sentClose
+	// once the proxy sent its close.
+	closed    bool
+	sentClose bool
+	// The window the upstream granted the proxy and the bytes the hook
+	// read that the upstream has not been granted again.
+	remoteWindow uint32
+	maxPacket    uint32
+	consumed     uint32
+}
+
+func (c *agentChannel) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	for len(c.buf) == 0 && !c.eof && !c.closed {
+		c.cond.Wait()
+	}
+	if len(c.buf) == 0 {
+		c.mu.Unlock()
+		return 0, io.EOF
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	c.consumed += uint32(n)
+	var adjust uint32
+	if c.consumed >= agentWindowSize/2 && !c.closed {
+		adjust, c.consumed = c.consumed, 0
+	}
+	c.mu.Unlock()
+	if adjust > 0 {
+		c.p.Upstream.transport.writePacket(Marshal(&windowAdjustMsg{PeersID: c.remoteID, AdditionalBytes: adjust}))
+	}
+	return n, nil
+}
+
+func (c *agentChannel) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		c.mu.Lock()
+		for c.remoteWindow == 0 && !c.closed {
+			c.cond.Wait()
+		}
+		if c.closed {
+			c.mu.Unlock()
+			return written, io.EOF
+		}
+		n := uint32(len(b))
+		if n > c.remoteWindow {
+			n = c.remoteWindow
+		}
+		if n > c.maxPacket {
+			n = c.maxPacket
+		}
+		c.remoteWindow -= n
+		c.mu.Unlock()
+
+		if err := c.p.Upstream.transport.writePacket(Marshal(&channelDataMsg{PeersID: c.remoteID, Length: n, Rest: b[:n]})); err != nil {
+			return written, err
+		}
+		written += int(n)
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close closes the channel towards the upstream.
+func (c *agentChannel) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	sendClose := !c.sentClose
+	c.sentClose = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	if sendClose {
+		return c.p.Upstream.transport.writePacket(Marshal(&channelCloseMsg{PeersID: c.remoteID}))
+	}
+	return nil
+}
+
+// handle processes a packet the upstream sent to the channel.
+func (c *agentChannel) handle(packet []byte) {
+	var reply []byte
+	forget := false
+	c.mu.Lock()
+	switch packet[0] {
+	case msgChannelData:
+		var msg channelDataMsg
+		if Unmarshal(packet, &msg) == nil && len(c.buf)+len(msg.Rest) <= agentWindowSize {
+			c.buf = append(c.buf, msg.Rest...)
+		}
+	case msgChannelWindowAdjust:
+		var msg windowAdjustMsg
+		if Unmarshal(packet, &msg) == nil {
+			c.remoteWindow += msg.AdditionalBytes
+		}
+	case msgChannelEOF:
+		c.eof = true
+	case msgChannelClose:
+		c.closed = true
+		if !c.sentClose {
+			c.sentClose = true
+			reply = Marshal(&channelCloseMsg{PeersID: c.remoteID})
+		}
+		forget = true
+	case msgChannelRequest:
+		var msg channelRequestMsg
+		if Unmarshal(packet, &msg) == nil && msg.WantReply {
+			reply = Marshal(&channelRequestFailureMsg{PeersID: c.remoteID})
+		}
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	if forget {
+		c.p.agents.mu.Lock()
+		delete(c.p.agents.byID, c.localID)
+		c.p.agents.mu.Unlock()
+	}
+	if reply != nil {
+		c.p.Upstream.transport.writePacket(reply)
+	}
+}
+
+// filterAgent applies ProxyConfig.AgentForwarding to a packet relayed in
+// direction dir. It reports whether the packet was consumed.
+func (p *ProxyConn) filterAgent(dir relayDirection, packet []byte) bool {
+	mode := p.config.AgentForwarding
+	switch {
+	case packet[0] == msgChannelRequest && dir == toUpstream && mode == AgentBlock:
+		var msg channelRequestMsg
+		if Unmarshal(packet, &msg) != nil || msg.Request != "auth-agent-req@openssh.com" {
+			return false
+		}
+		if msg.WantReply {
+			p.channels.mu.Lock()
+			ch, ok := p.channels.byUpstream[msg.PeersID]
+			p.channels.mu.Unlock()
+			if ok {
+				p.Downstream.transport.writePacket(Marshal(&channelRequestFailureMsg{PeersID: ch.downstreamID}))
+			}
+		}
+		return true
+
+	case packet[0] == msgChannelOpen && dir == toDownstream && mode != AgentPassThrough:
+		var msg channelOpenMsg
+		if Unmarshal(packet, &msg) != nil || msg.ChanType != "auth-agent@openssh.com" {
+			return false
+		}
+		if mode == AgentBlock || p.config.AgentHook == nil {
+			p.Upstream.transport.writePacket(Marshal(&channelOpenFailureMsg{
+				PeersID: msg.PeersID,
+				Reason:  Prohibited,
+				Message: "agent forwarding denied by policy",
+			}))
+			return true
+		}
+		p.serveAgent(msg)
+		return true
+
+	case dir == toDownstream && mode == AgentLocal && packet[0] >= msgChannelWindowAdjust && packet[0] <= msgChannelFailure:
+		id, ok := recipient(packet)
+		if !ok || id < agentChannelBase {
+			return false
+		}
+		p.agents.mu.Lock()
+		c := p.agents.byID[id]
+		p.agents.mu.Unlock()
+		// Clients may use high IDs too.
+		if c == nil {
+			return false
+		}
+		c.handle(packet)
+		return true
+
+	case packet[0] == msgChannelOpen && dir == toUpstream && mode == AgentLocal:
+		// The upstream's packets for a channel whose ID an agent channel
+		// already has could not be told apart.
+		var msg channelOpenMsg
+		if Unmarshal(packet, &msg) != nil {
+			return false
+		}
+		p.agents.mu.Lock()
+		_, inUse := p.agents.byID[msg.PeersID]
+		p.agents.mu.Unlock()
+		if !inUse {
+			return false
+		}
+		p.Downstream.transport.writePacket(Marshal(&channelOpenFailureMsg{
+			PeersID: msg.PeersID,
+			Reason:  ResourceShortage,
+			Message: "channel ID in use",
+		}))
+		return true
+	}
+	return false
+}
+
+// serveAgent accepts an agent channel the upstream opened and runs the
+// AgentHook on it.
+func (p *ProxyConn) serveAgent(msg channelOpenMsg) {
+	p.agents.mu.Lock()
+	if p.agents.byID == nil {
+		p.agents.byID = make(map[uint32]*agentChannel)
+	}
+	// Skip IDs the downstream client uses.
+	id := agentChannelBase + p.agents.nextID
+	for p.agents.byID[id] != nil || p.channels.downstreamUses(id) {
+		p.agents.nextID++
+		id = agentChannelBase + p.agents.nextID
+	}
+	c := &agentChannel{
+		p:            p,
+		localID:      id,
+		remoteID:     msg.PeersID,
+		remoteWindow: msg.PeersWindow,
+		maxPacket:    msg.MaxPacketSize,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	p.agents.nextID++
+	p.agents.byID[c.localID] = c
+	p.agents.mu.Unlock()
+
+	err := p.Upstream.transport.writePacket(Marshal(&channelOpenConfirmMsg{
+		PeersID:       c.remoteID,
+		MyID:          c.localID,
+		MyWindow:      agentWindowSize,
+		MaxPacketSize: agentMaxPacket,
+	}))
+	if err != nil {
+		return
+	}
+	go func() {
+		defer c.Close()
+		if err := p.config.AgentHook(p, c); err != nil && err != io.EOF {
+			p.log(LogWarn, "agent hook failed", "error", err)
+		}
+	}()
+}
+
+// closeAgents ends the agent channels when the connection closes.
+func (p *ProxyConn) closeAgents() {
+	p.agents.mu.Lock()
+	defer p.agents.mu.Unlock()
+	for id, c := range p.agents.byID {
+		c.mu.Lock()
+		c.closed, c.sentClose = true, true
+		c.cond.Broadcast()
+		c.mu.Unlock()
+		delete(p.agents.byID, id)
+	}
+}
@@ -0,0 +1,154 @@
+package ssh
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newAgentTestProxy runs a ProxyServer whose upstream opens an agent
+// channel once a session asks for agent forwarding, or right away if the
+// request is refused, and reports the reply to "ping" or the error.
+func newAgentTestProxy(t *testing.T, proxyConf *ProxyConfig) (string, <-chan string) {
+	proxyConf.DestinationPort = 22
+	proxyConf.FindUpstreamHook = func(username string) (string, error) {
+		return "upstream", nil
+	}
+	upstreamConf := newTestUpstreamConfig()
+	results := make(chan string, 1)
+	useAgent := func(conn *ServerConn) {
+		ch, reqs, err := conn.OpenChannel("auth-agent@openssh.com", nil)
+		if err != nil {
+			results <- err.Error()
+			return
+		}
+		go DiscardRequests(reqs)
+		defer ch.Close()
+		ch.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(ch, buf); err != nil {
+			results <- err.Error()
+			return
+		}
+		results <- string(buf)
+	}
+	_, addr := serveTestProxy(t, proxyConf, func(c net.Conn) {
+		conn, chans, reqs, err := NewServerConn(c, upstreamConf)
+		if err != nil {
+			return
+		}
+		go DiscardRequests(reqs)
+		for newCh := range chans {
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer ch.Close()
+				timeout := time.After(time.Second)
+				for {
+					select {
+					case req, ok := <-reqs:
+						if !ok {
+							return
+						}
+						req.Reply(req.Type == "auth-agent-req@openssh.com", nil)
+						if req.Type == "auth-agent-req@openssh.com" {
+							useAgent(conn)
+						}
+					case <-timeout:
+						useAgent(conn)
+						timeout = nil
+					}
+				}
+			}()
+		}
+	})
+	return addr, results
+}
+
+func requestAgent(t *testing.T, addr string) (*Client, bool) {
+	client, err := dialTestProxyServer(addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	go func() {
+		for newCh := range client.HandleChannelOpen("auth-agent@openssh.com") {
+			t.Error("agent channel reached the downstream client")
+			newCh.Reject(Prohibited, "test")
+		}
+	}()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	t.Cleanup(func() { session.Close() })
+	ok, err := session.SendRequest("auth-agent-req@openssh.com", true, nil)
+	if err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+	return client, ok
+}
+
+func waitAgentResult(t *testing.T, results <-chan string) string {
+	select {
+	case r := <-results:
+		return r
+	case <-time.After(10 * time.Second):
+		t.Fatal("upstream did not use the agent")
+	}
+	return ""
+}
+
+func TestProxyAgentLocal(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.AgentForwarding = AgentLocal
+	proxyConf.AgentHook = func(p *ProxyConn, ch io.ReadWriteCloser) error {
+		if p.User != "testuser" {
+			return errors.New("unexpected user")
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(ch, buf); err != nil {
+			return err
+		}
+		if string(buf) != "ping" {
+			return errors.New("unexpected request")
+		}
+		_, err := ch.Write([]byte("pong"))
+		return err
+	}
+	addr, results := newAgentTestProxy(t, proxyConf)
+	if _, ok := requestAgent(t, addr); !ok {
+		t.Fatal("agent forwarding refused")
+	}
+	if got := waitAgentResult(t, results); got != "pong" {
+		t.Errorf("upstream got %q, want the proxy's answer", got)
+	}
+}
+
+func TestProxyAgentBlock(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.AgentForwarding = AgentBlock
+	addr, results := newAgentTestProxy(t, proxyConf)
+	if _, ok := requestAgent(t, addr); ok {
+		t.Error("agent forwarding request was relayed")
+	}
+	if got := waitAgentResult(t, results); got == "pong" {
+		t.Error("upstream reached an agent")
+	}
+}
+
+func TestProxyAgentLocalHighClientIDs(t *testing.T) {
+	p := &ProxyConn{config: &ProxyConfig{AgentForwarding: AgentLocal}}
+	packet := Marshal(&channelDataMsg{
+		PeersID: agentChannelBase + 5,
+		Length:  4,
+		Rest:    []byte("data"),
+	})
+	if p.filterAgent(toDownstream, packet) {
+		t.Error("data for a client channel in the agent range was consumed")
+	}
+}
@@ -0,0 +1,93 @@
+package ssh
+
+import (
+	"errors"
+	"strings"
+)
+
+// Algorithms restricts the algorithms the proxy offers on one side. Nil
+// lists keep those of the side's ServerConfig or ClientConfig.
+type Algorithms struct {
+	Ciphers      []string
+	KeyExchanges []string
+	MACs         []string
+	// HostKeys are the host key algorithms announced for the proxy's host
+	// keys downstream, or accepted from upstream servers.
+	HostKeys []string
+}
+
+// restrict returns c with the lists that are set in a.
+func (a *Algorithms) restrict(c Config) Config {
+	if a == nil {
+		return c
+	}
+	if a.Ciphers != nil {
+		c.Ciphers = a.Ciphers
+	}
+	if a.KeyExchanges != nil {
+		c.KeyExchanges = a.KeyExchanges
+	}
+	if a.MACs != nil {
+		c.MACs = a.MACs
+	}
+	return c
+}
+
+// hostKeys returns the host key algorithms of a, or else fallback.
+func (a *Algorithms) hostKeys(fallback []string) []string {
+	if a == nil || a.HostKeys == nil {
+		return fallback
+	}
+	return a.HostKeys
+}
+
+// algorithmProblems checks the algorithms the proxy offers on both sides,
+// after applying DownstreamAlgorithms and UpstreamAlgorithms.
+func (conf *ProxyConfig) algorithmProblems() (failures, warnings []string) {
+	if c := conf.ServerConfig; c != nil {
+		failures, warnings = algorithmProblems("downstream", conf.DownstreamAlgorithms.restrict(c.Config))
+		// Keys chosen by HostKeySelectionHook are only known per connection.
+		hostKeyAlgos := serverHostKeyAlgos(c.hostKeys, conf.DownstreamAlgorithms.hostKeys(c.HostKeyAlgorithms))
+		if len(hostKeyAlgos) == 0 && (len(c.hostKeys) > 0 || c.HostKeySelectionHook == nil) {
+			failures = append(failures, "downstream: no host key algorithm matches the host keys")
+		}
+	} else if conf.DownstreamAlgorithms != nil {
+		failures = append(failures, "downstream: DownstreamAlgorithms is set without a ServerConfig")
+	}
+
+	if c := conf.ClientConfig; c != nil {
+		f, w := algorithmProblems("upstream", conf.UpstreamAlgorithms.restrict(c.Config))
+		failures, warnings = append(failures, f...), append(warnings, w...)
+		if hostKeys := conf.UpstreamAlgorithms.hostKeys(c.HostKeyAlgorithms); hostKeys != nil {
+			if len(hostKeys) == 0 {
+				failures = append(failures, "upstream: no host key algorithm configured")
+			}
+			for _, algo := range hostKeys {
+				if !contains(supportedHostKeyAlgos, algo) {
+					failures = append(failures, "upstream: unsupported host key algorithm \""+algo+"\"")
+				}
+			}
+		}
+	} else if conf.UpstreamAlgorithms != nil {
+		failures = append(failures, "upstream: UpstreamAlgorithms is set without a ClientConfig")
+	}
+	return failures, warnings
+}
+
+// ApplyAlgorithms checks DownstreamAlgorithms and UpstreamAlgorithms and sets
+// them in ServerConfig and ClientConfig. Call it once before connections are
+// proxied; nothing is changed if it returns an error.
+func (conf *ProxyConfig) ApplyAlgorithms() error {
+	if failures, _ := conf.algorithmProblems(); len(failures) > 0 {
+		return errors.New("ssh: invalid algorithms: " + strings.Join(failures, "; "))
+	}
+	if a := conf.DownstreamAlgorithms; a != nil {
+		conf.ServerConfig.Config = a.restrict(conf.ServerConfig.Config)
+		conf.ServerConfig.HostKeyAlgorithms = a.hostKeys(conf.ServerConfig.HostKeyAlgorithms)
+	}
+	if a := conf.UpstreamAlgorithms; a != nil {
+		conf.ClientConfig.Config = a.restrict(conf.ClientConfig.Config)
+		conf.ClientConfig.HostKeyAlgorithms = a.hostKeys(conf.ClientConfig.HostKeyAlgorithms)
+	}
+	return nil
+}
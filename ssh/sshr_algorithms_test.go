@@ -0,0 +1,68 @@
+package ssh
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProxyApplyAlgorithms(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.DownstreamAlgorithms = &Algorithms{
+		Ciphers:      []string{gcmCipherID},
+		KeyExchanges: []string{kexAlgoCurve25519SHA256},
+		HostKeys:     []string{SigAlgoRSASHA2512},
+	}
+	proxyConf.UpstreamAlgorithms = &Algorithms{Ciphers: []string{aes128cbcID}}
+	if err := proxyConf.ApplyAlgorithms(); err != nil {
+		t.Fatalf("ApplyAlgorithms: %v", err)
+	}
+	if failures, warnings := proxyConf.algorithmProblems(); len(failures) > 0 || len(warnings) != 1 {
+		t.Errorf("got failures %q and warnings %q, want one warning for %s", failures, warnings, aes128cbcID)
+	}
+
+	upstreamConf := newTestUpstreamConfig()
+	upstreamConf.Ciphers = []string{aes128cbcID}
+	client, res, err := dialTestProxy(t, proxyConf, upstreamConf, &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	client.Close()
+
+	clientConf := &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	}
+	clientConf.Ciphers = []string{"aes128-ctr"}
+	if _, _, err := dialTestProxy(t, proxyConf, upstreamConf, clientConf); err == nil {
+		t.Error("downstream negotiated a cipher outside DownstreamAlgorithms")
+	}
+}
+
+func TestProxyApplyAlgorithmsInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		downstream *Algorithms
+		upstream   *Algorithms
+		want       string
+	}{
+		{"cipher", &Algorithms{Ciphers: []string{"aes256-cbc"}}, nil, `downstream: unsupported cipher "aes256-cbc"`},
+		{"host keys", &Algorithms{HostKeys: []string{KeyAlgoED25519}}, nil, "downstream: no host key algorithm matches"},
+		{"server kex", &Algorithms{KeyExchanges: []string{kexAlgoDHGEXSHA256}}, nil, "downstream: unsupported key exchange"},
+		{"empty", nil, &Algorithms{MACs: []string{}}, "upstream: no MAC configured"},
+		{"upstream host keys", nil, &Algorithms{HostKeys: []string{"ssh-foo"}}, `upstream: unsupported host key algorithm "ssh-foo"`},
+	} {
+		proxyConf := newTestProxyConfig()
+		proxyConf.DownstreamAlgorithms = tc.downstream
+		proxyConf.UpstreamAlgorithms = tc.upstream
+		err := proxyConf.ApplyAlgorithms()
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got error %v, want %q", tc.name, err, tc.want)
+		}
+		if proxyConf.ServerConfig.Ciphers != nil || proxyConf.ServerConfig.HostKeyAlgorithms != nil || proxyConf.ClientConfig.MACs != nil {
+			t.Errorf("%s: configs changed despite the error", tc.name)
+		}
+	}
+}
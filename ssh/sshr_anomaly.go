@@ -0,0 +1,185 @@
+package ssh
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errAnomalyRejected is returned when the anomaly hook rejects a login.
+var errAnomalyRejected = errors.New("ssh: login rejected by anomaly scoring")
+
+// AnomalyPhase tells an anomaly hook when it is being invoked.
+type AnomalyPhase int
+
+const (
+	// AnomalyPhaseAuth is used once the user has authenticated, before the
+	// session is established.
+	AnomalyPhaseAuth AnomalyPhase = iota
+	// AnomalyPhaseSession is used periodically during the session.
+	AnomalyPhaseSession
+)
+
+// AnomalyAction is the verdict of an anomaly hook.
+type AnomalyAction int
+
+const (
+	// AnomalyAllow lets the login or session continue.
+	AnomalyAllow AnomalyAction = iota
+	// AnomalyStepUp asks for the user to be re-challenged with
+	// ProxyConn.StepUp. At authentication time, and for sessions that
+	// cannot be challenged, it is treated like AnomalyTerminate.
+	AnomalyStepUp
+	// AnomalyTerminate rejects the login or ends the session.
+	AnomalyTerminate
+)
+
+// AnomalyFeatures describes the behavior of a user for an anomaly engine.
+type AnomalyFeatures struct {
+	Phase           AnomalyPhase
+	User            string
+	DestinationHost string
+	RemoteAddr      string
+	Time            time.Time
+
+	// NewDestination is set if the user has not been seen connecting to
+	// DestinationHost before.
+	NewDestination bool
+
+	// UnusualHour is set if the user has an established login history
+	// and rarely logs in at the hour of Time.
+	UnusualHour bool
+
+	// Session counters; zero during AnomalyPhaseAuth.
+	SessionDuration time.Duration
+	BytesUpstream   int64
+	BytesDownstream int64
+
+	// IntervalBytes is the traffic in both directions since the previous
+	// invocation. VolumeSpike is set if it exceeds SpikeFactor times the
+	// average of the earlier intervals.
+	IntervalBytes int64
+	VolumeSpike   bool
+}
+
+// AnomalyScorer computes behavioral features for logins and sessions and
+// passes them to an external anomaly engine through Hook. The login history
+// it needs is kept in memory.
+type AnomalyScorer struct {
+	// Hook is called at authentication time and every Interval during a
+	// session.
+	Hook func(f AnomalyFeatures) AnomalyAction
+
+	// Interval between session evaluations. If zero, one minute is used.
+	Interval time.Duration
+
+	// SpikeFactor is the ratio over the average interval volume that
+	// counts as a spike. If zero, 4 is used.
+	SpikeFactor float64
+
+	mu           sync.Mutex
+	destinations map[string]map[string]bool
+	hours        map[string]*[24]int
+}
+
+// minLoginHistory is the number of logins after which UnusualHour is
+// reported for a user.
+const minLoginHistory = 20
+
+func (a *AnomalyScorer) interval() time.Duration {
+	if a.Interval > 0 {
+		return a.Interval
+	}
+	return time.Minute
+}
+
+func (a *AnomalyScorer) spikeFactor() float64 {
+	if a.SpikeFactor > 0 {
+		return a.SpikeFactor
+	}
+	return 4
+}
+
+// scoreAuth records a login and evaluates it.
+func (a *AnomalyScorer) scoreAuth(p *ProxyConn, now time.Time) AnomalyAction {
+	f := AnomalyFeatures{
+		Phase:           AnomalyPhaseAuth,
+		User:            p.User,
+		DestinationHost: p.DestinationHost,
+		RemoteAddr:      p.Downstream.RemoteAddr().String(),
+		Time:            now,
+	}
+
+	a.mu.Lock()
+	if a.destinations == nil {
+		a.destinations = make(map[string]map[string]bool)
+		a.hours = make(map[string]*[24]int)
+	}
+	if a.destinations[p.User] == nil {
+		a.destinations[p.User] = make(map[string]bool)
+		a.hours[p.User] = new([24]int)
+	}
+	f.NewDestination = !a.destinations[p.User][p.DestinationHost]
+	a.destinations[p.User][p.DestinationHost] = true
+
+	hours := a.hours[p.User]
+	total := 0
+	for _, n := range hours {
+		total += n
+	}
+	// An hour is unusual if less than 5% of earlier logins happened in it.
+	f.UnusualHour = total >= minLoginHistory && hours[now.Hour()]*20 < total
+	hours[now.Hour()]++
+	a.mu.Unlock()
+
+	return a.Hook(f)
+}
+
+// watch evaluates the session every interval until done is closed, and
+// challenges or ends the session if the hook asks for it.
+func (a *AnomalyScorer) watch(p *ProxyConn, done <-chan struct{}) {
+	ticker := time.NewTicker(a.interval())
+	defer ticker.Stop()
+
+	start := time.Now()
+	var lastTotal int64
+	var intervals int64
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			up, down := atomic.LoadInt64(&p.bytesUpstream), atomic.LoadInt64(&p.bytesDownstream)
+			total := up + down
+			f := AnomalyFeatures{
+				Phase:           AnomalyPhaseSession,
+				User:            p.User,
+				DestinationHost: p.DestinationHost,
+				RemoteAddr:      p.Downstream.RemoteAddr().String(),
+				Time:            now,
+				SessionDuration: now.Sub(start),
+				BytesUpstream:   up,
+				BytesDownstream: down,
+				IntervalBytes:   total - lastTotal,
+			}
+			if intervals > 0 {
+				avg := float64(lastTotal) / float64(intervals)
+				f.VolumeSpike = float64(f.IntervalBytes) > a.spikeFactor()*avg && f.IntervalBytes > 0
+			}
+			lastTotal = total
+			intervals++
+
+			switch a.Hook(f) {
+			case AnomalyAllow:
+			case AnomalyStepUp:
+				if p.StepUp() != nil {
+					return
+				}
+			default:
+				p.disconnect(disconnectByApplication, "session terminated by policy")
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package ssh
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAnomalyScorerFeatures(t *testing.T) {
+	var got []AnomalyFeatures
+	a := &AnomalyScorer{Hook: func(f AnomalyFeatures) AnomalyAction {
+		got = append(got, f)
+		return AnomalyAllow
+	}}
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	p := &ProxyConn{User: "alice", DestinationHost: "db1", Downstream: &connection{sshConn: sshConn{conn: c1}}}
+
+	noon := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < minLoginHistory; i++ {
+		a.scoreAuth(p, noon)
+	}
+	a.scoreAuth(p, noon.Add(-9*time.Hour))
+
+	if !got[0].NewDestination || got[1].NewDestination {
+		t.Errorf("NewDestination = %v, %v; want true, false", got[0].NewDestination, got[1].NewDestination)
+	}
+	if got[minLoginHistory-1].UnusualHour {
+		t.Error("usual hour reported as unusual")
+	}
+	if !got[minLoginHistory].UnusualHour {
+		t.Error("login at 3am after a history of noon logins not reported as unusual")
+	}
+}
+
+func TestProxyAnomalyRejectsLogin(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.Anomaly = &AnomalyScorer{Hook: func(f AnomalyFeatures) AnomalyAction {
+		return AnomalyTerminate
+	}}
+	_, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err == nil {
+		t.Fatal("login rejected by the anomaly hook succeeded")
+	}
+	if res.err != errAnomalyRejected {
+		t.Errorf("proxy error: got %v, want %v", res.err, errAnomalyRejected)
+	}
+}
+
+func TestProxyAnomalyTerminatesSession(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.Anomaly = &AnomalyScorer{
+		Interval: 10 * time.Millisecond,
+		Hook: func(f AnomalyFeatures) AnomalyAction {
+			if f.Phase == AnomalyPhaseSession && f.BytesDownstream > 0 {
+				return AnomalyTerminate
+			}
+			return AnomalyAllow
+		},
+	}
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+	runHello(t, client)
+
+	done := make(chan error, 1)
+	go func() { done <- client.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not terminated by the anomaly hook")
+	}
+}
@@ -0,0 +1,116 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	defaultApprovalTimeout   = 5 * time.Minute
+	defaultApprovalKeepalive = 15 * time.Second
+)
+
+// errApprovalEnded is returned by ApprovalRequest.Notify once the user is no
+// longer held.
+var errApprovalEnded = errors.New("ssh: approval wait has ended")
+
+// ApprovalRequest describes a login held for ProxyConfig.ApprovalHook.
+type ApprovalRequest struct {
+	// User is the downstream username.
+	User string
+	AuthResult
+
+	n *approvalNotifier
+}
+
+// Notify shows message to the held user as a banner, for example
+// "waiting for approval by the on-call engineer".
+func (r ApprovalRequest) Notify(message string) error {
+	return r.n.notify(message)
+}
+
+type approvalNotifier struct {
+	mu    sync.Mutex
+	p     *ProxyConn
+	ended bool
+}
+
+func (n *approvalNotifier) notify(message string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ended {
+		return errApprovalEnded
+	}
+	return n.p.Downstream.transport.writePacket(Marshal(&userAuthBannerMsg{Message: message}))
+}
+
+func (n *approvalNotifier) keepalive() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.p.Downstream.transport.writePacket([]byte{msgIgnore, 0, 0, 0, 0})
+}
+
+func (n *approvalNotifier) end() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.ended = true
+}
+
+// awaitApproval holds p, whose user the upstream accepted with the
+// authentication described by result, until ApprovalHook approves it. The
+// downstream client is kept alive meanwhile, and disconnected with the
+// reason if the login is rejected or not approved in time.
+func (p *ProxyConn) awaitApproval(result AuthResult) error {
+	conf := p.config
+	timeout := conf.ApprovalTimeout
+	if timeout <= 0 {
+		timeout = defaultApprovalTimeout
+	}
+	interval := conf.ApprovalKeepalive
+	if interval <= 0 {
+		interval = defaultApprovalKeepalive
+	}
+	ctx, cancel := context.WithTimeout(p.ctx, timeout)
+	defer cancel()
+
+	n := &approvalNotifier{p: p}
+	defer n.end()
+	p.log(LogInfo, "awaiting access approval", "method", result.Method)
+	done := make(chan error, 1)
+	go func() { done <- conf.ApprovalHook(ctx, ApprovalRequest{User: p.User, AuthResult: result, n: n}) }()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			if err != nil && ctx.Err() != nil {
+				return p.approvalTimedOut(ctx)
+			}
+			if err != nil {
+				p.log(LogWarn, "access not approved", "error", err)
+				p.disconnect(disconnectByApplication, "access not approved: "+err.Error())
+				return &proxyError{cause: ErrAuthRejected, detail: "access not approved", err: err}
+			}
+			return nil
+		case <-ticker.C:
+			if err := n.keepalive(); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return p.approvalTimedOut(ctx)
+		}
+	}
+}
+
+// approvalTimedOut rejects p once ctx, the approval context, is done.
+func (p *ProxyConn) approvalTimedOut(ctx context.Context) error {
+	if err := p.ctx.Err(); err != nil {
+		return err
+	}
+	p.log(LogWarn, "access approval timed out")
+	p.disconnect(disconnectByApplication, "access approval timed out")
+	return &proxyError{cause: ErrAuthRejected, detail: "access approval timed out", err: ctx.Err()}
+}
@@ -0,0 +1,71 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyApprovalHook(t *testing.T) {
+	var banner string
+	clientConf := &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+		BannerCallback: func(message string) error {
+			banner = message
+			return nil
+		},
+	}
+	proxyConf := newTestProxyConfig()
+	proxyConf.ApprovalKeepalive = 10 * time.Millisecond
+	proxyConf.ApprovalHook = func(ctx context.Context, req ApprovalRequest) error {
+		if err := req.Notify("waiting for approval of " + req.User + "\r\n"); err != nil {
+			return err
+		}
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	}
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), clientConf)
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+	if want := "waiting for approval of testuser\r\n"; banner != want {
+		t.Errorf("got banner %q, want %q", banner, want)
+	}
+	if got := runHello(t, client); got != "hello" {
+		t.Errorf("got output %q, want %q", got, "hello")
+	}
+
+	proxyConf.ApprovalHook = func(ctx context.Context, req ApprovalRequest) error {
+		return errors.New("denied by the on-call engineer")
+	}
+	_, res, err = dialTestProxy(t, proxyConf, newTestUpstreamConfig(), clientConf)
+	if err == nil || !strings.Contains(err.Error(), "denied by the on-call engineer") {
+		t.Errorf("client: got %v, want the rejection reason", err)
+	}
+	if !errors.Is(res.err, ErrAuthRejected) {
+		t.Errorf("proxy error: got %v, want ErrAuthRejected", res.err)
+	}
+}
+
+func TestProxyApprovalTimeout(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.ApprovalTimeout = 50 * time.Millisecond
+	proxyConf.ApprovalHook = func(ctx context.Context, req ApprovalRequest) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	_, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("client: got %v, want an approval timeout", err)
+	}
+	if !errors.Is(res.err, ErrAuthRejected) {
+		t.Errorf("proxy error: got %v, want ErrAuthRejected", res.err)
+	}
+}
@@ -0,0 +1,241 @@
+package ssh
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// errProxyAuthFailed is reported to AuthLogHook when the proxy itself rejects
+// a downstream authentication request.
+var errProxyAuthFailed error = authRejectedError("ssh: proxy rejected authentication")
+
+// errUserChanged ends authentication when a request names another user or
+// service than the first.
+var errUserChanged error = authRejectedError("ssh: change of username or service not allowed")
+
+// errUpstreamAuthRejected is reported to AuthLogHook when the upstream server
+// refuses the bridged authentication request.
+var errUpstreamAuthRejected error = authRejectedError("ssh: upstream rejected authentication")
+
+// AuditSampler thins out audit events about successful authentications for
+// high-volume users. Failures are never sampled. Percentages are applied
+// deterministically: with 10 percent, exactly one in ten successes is
+// emitted. A per-user percentage takes precedence over a per-route one.
+type AuditSampler struct {
+	// SuccessPercent is the percentage of successes that are emitted when
+	// neither the user nor the route has an override.
+	SuccessPercent int
+
+	// UserPercent overrides SuccessPercent for specific usernames.
+	UserPercent map[string]int
+
+	// RoutePercent overrides SuccessPercent for specific upstream hosts.
+	RoutePercent map[string]int
+
+	mu       sync.Mutex
+	counters map[string]uint64
+}
+
+// sample reports whether an audit event should be emitted.
+func (s *AuditSampler) sample(username, route string, success bool) bool {
+	if !success {
+		return true
+	}
+
+	key, percent := "", s.SuccessPercent
+	if pct, ok := s.RoutePercent[route]; ok {
+		key, percent = "route:"+route, pct
+	}
+	if pct, ok := s.UserPercent[username]; ok {
+		key, percent = "user:"+username, pct
+	}
+	if percent >= 100 {
+		return true
+	}
+	if percent <= 0 {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.counters == nil {
+		s.counters = make(map[string]uint64)
+	}
+	n := s.counters[key]
+	s.counters[key] = n + 1
+	return n*uint64(percent)/100 != (n+1)*uint64(percent)/100
+}
+
+// AuditEventType is the kind of an AuditEvent.
+type AuditEventType int
+
+const (
+	// AuditAuthAttempt is emitted for every downstream authentication
+	// request other than "none" and public key queries.
+	AuditAuthAttempt AuditEventType = iota
+	AuditAuthSuccess
+	AuditAuthFailure
+	// AuditUpstreamDialError is emitted by ProxyServer when the upstream
+	// cannot be reached.
+	AuditUpstreamDialError
+	// AuditSessionStart and AuditSessionEnd enclose ProxyConn.Wait.
+	AuditSessionStart
+	AuditSessionEnd
+	// AuditX11Forwarding is emitted for every x11-req request, with Err
+	// set if the proxy refused it.
+	AuditX11Forwarding
+	// AuditCommand is emitted for every exec and subsystem request, with
+	// the command after CommandHook and Err set if the proxy refused it.
+	AuditCommand
+	// AuditSCPTransfer is emitted for every file copied with scp, with
+	// Err set if the proxy refused it or it was not copied completely.
+	AuditSCPTransfer
+	// AuditUpstreamFailover is emitted by ProxyServer when the user is
+	// logged in to a fallback upstream host, with Err set to the failure of
+	// the previous candidate.
+	AuditUpstreamFailover
+	// AuditTranscriptHead is emitted with every head of the transcript
+	// hash chain of a session; see ProxyConfig.TranscriptHook.
+	AuditTranscriptHead
+)
+
+func (t AuditEventType) String() string {
+	switch t {
+	case AuditAuthAttempt:
+		return "auth_attempt"
+	case AuditAuthSuccess:
+		return "auth_success"
+	case AuditAuthFailure:
+		return "auth_failure"
+	case AuditUpstreamDialError:
+		return "upstream_dial_error"
+	case AuditSessionStart:
+		return "session_start"
+	case AuditSessionEnd:
+		return "session_end"
+	case AuditX11Forwarding:
+		return "x11_forwarding"
+	case AuditCommand:
+		return "command"
+	case AuditSCPTransfer:
+		return "scp_transfer"
+	case AuditUpstreamFailover:
+		return "upstream_failover"
+	case AuditTranscriptHead:
+		return "transcript_head"
+	}
+	return "AuditEventType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// AuditEvent is passed to ProxyConfig.AuditCallback. Fields that do not
+// apply to the event type are zero.
+type AuditEvent struct {
+	Type AuditEventType
+	Time time.Time
+
+	// User is the downstream username and RemoteAddr the address of the
+	// downstream client.
+	User       string
+	RemoteAddr net.Addr
+	// Upstream is the upstream host.
+	Upstream string
+
+	// Method is the authentication method of the AuthAttempt, AuthSuccess
+	// and AuthFailure events. For the "publickey" method, KeyFingerprint
+	// is the SHA256 fingerprint of the downstream key.
+	Method         string
+	KeyFingerprint string
+
+	// Command is the command or subsystem of a Command event.
+	Command string
+	// Transfer is the file of an SCPTransfer event.
+	Transfer *SCPTransfer
+	// Transcript is the head of a TranscriptHead event.
+	Transcript *TranscriptHead
+
+	// Err is the cause of AuthFailure and UpstreamDialError events, the
+	// error that ended the session for SessionEnd, the reason a request
+	// was refused for X11Forwarding and Command, and the reason a file was
+	// refused or not copied completely for SCPTransfer.
+	Err error
+
+	// The bytes relayed to the upstream and to the downstream during the
+	// session, for SessionEnd.
+	BytesUpstream   int64
+	BytesDownstream int64
+}
+
+// audit passes ev to the AuditCallback of conf, if any.
+func (conf *ProxyConfig) audit(ev AuditEvent) {
+	if conf == nil || conf.AuditCallback == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	conf.AuditCallback(ev)
+}
+
+// audit fills in the fields of ev that describe p and emits it.
+func (p *ProxyConn) audit(ev AuditEvent) {
+	if p.config == nil || p.config.AuditCallback == nil {
+		return
+	}
+	ev.User = p.User
+	ev.RemoteAddr = p.Downstream.RemoteAddr()
+	ev.Upstream = p.DestinationHost
+	if ev.Method == "publickey" && p.attemptKey != nil {
+		ev.KeyFingerprint = FingerprintSHA256(p.attemptKey)
+	}
+	p.config.audit(ev)
+}
+
+// logAuthAttempt reports a downstream authentication request before it is
+// handled.
+func (p *ProxyConn) logAuthAttempt(msg *userAuthRequestMsg) {
+	p.attemptKey, p.attemptMethod = nil, msg.Method
+	if msg.Method == "none" {
+		return
+	}
+	if msg.Method == "publickey" {
+		key, isQuery, _, err := parsePublicKeyMsg(msg)
+		if err == nil && isQuery {
+			return
+		}
+		p.attemptKey = key
+	}
+	p.log(LogDebug, "authentication attempt", "method", msg.Method)
+	p.audit(AuditEvent{Type: AuditAuthAttempt, Method: msg.Method})
+}
+
+// logAuth reports the outcome of a downstream authentication attempt to the
+// Logger, the AuditCallback and the AuthLogHook, the latter two subject to
+// the AuditSampler.
+func (p *ProxyConn) logAuth(method string, err error) {
+	conf := p.config
+	if conf == nil || method == "none" {
+		return
+	}
+	if err == nil {
+		p.log(LogInfo, "authentication succeeded", "method", method)
+	} else {
+		p.log(LogWarn, "authentication failed", "method", method, "error", err)
+	}
+	conf.Metrics.observeAuth(p.DestinationHost, method, err == nil)
+	if conf.AuthLogHook == nil && conf.AuditCallback == nil {
+		return
+	}
+	if conf.AuditSampler != nil && !conf.AuditSampler.sample(p.User, p.DestinationHost, err == nil) {
+		return
+	}
+	if err == nil {
+		p.audit(AuditEvent{Type: AuditAuthSuccess, Method: method})
+	} else {
+		p.audit(AuditEvent{Type: AuditAuthFailure, Method: method, Err: err})
+	}
+	if conf.AuthLogHook != nil {
+		conf.AuthLogHook(p.User, method, err)
+	}
+}
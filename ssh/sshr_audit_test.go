@@ -0,0 +1,163 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAuditSamplerPercent(t *testing.T) {
+	s := &AuditSampler{
+		SuccessPercent: 10,
+		UserPercent:    map[string]int{"ci": 0, "root": 100},
+		RoutePercent:   map[string]int{"backup": 50},
+	}
+
+	count := func(user, route string, success bool) int {
+		n := 0
+		for i := 0; i < 100; i++ {
+			if s.sample(user, route, success) {
+				n++
+			}
+		}
+		return n
+	}
+
+	for _, tc := range []struct {
+		user, route string
+		success     bool
+		want        int
+	}{
+		{"alice", "web", true, 10},
+		{"alice", "backup", true, 50},
+		{"ci", "backup", true, 0},
+		{"ci", "backup", false, 100},
+		{"root", "web", true, 100},
+	} {
+		if got := count(tc.user, tc.route, tc.success); got != tc.want {
+			t.Errorf("sample(%q, %q, %v): emitted %d of 100, want %d", tc.user, tc.route, tc.success, got, tc.want)
+		}
+	}
+}
+
+func TestProxyAuthLogHook(t *testing.T) {
+	type entry struct {
+		method string
+		ok     bool
+	}
+	var got []entry
+
+	proxyConf := newTestProxyConfig()
+	proxyConf.AuthLogHook = func(username, method string, err error) {
+		got = append(got, entry{method, err == nil})
+	}
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{
+			PublicKeys(testSigners["ed25519"]),
+			Password(upstreamPassword),
+		},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	client.Close()
+
+	want := []entry{{"publickey", false}, {"password", true}}
+	if len(got) != len(want) {
+		t.Fatalf("got log %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("entry %d: got %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestProxyAuditCallback(t *testing.T) {
+	events := make(chan AuditEvent, 20)
+	proxyConf := newTestProxyConfig()
+	proxyConf.DestinationPort = 22
+	proxyConf.FindUpstreamHook = func(username string) (string, error) {
+		return "upstream", nil
+	}
+	proxyConf.AuditCallback = func(ev AuditEvent) { events <- ev }
+	s, addr, _ := newTestProxyServer(t, proxyConf)
+	defer s.Close()
+
+	client, err := Dial("tcp", addr, &ClientConfig{
+		User:            "testuser",
+		Auth:            []AuthMethod{PublicKeys(testSigners["ed25519"], testSigners["ecdsa"])},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	runHello(t, client)
+	client.Close()
+
+	wantFP := map[string]string{"ed25519": FingerprintSHA256(testPublicKeys["ed25519"]), "ecdsa": FingerprintSHA256(testPublicKeys["ecdsa"])}
+	want := []struct {
+		typ AuditEventType
+		key string
+	}{
+		{AuditAuthAttempt, "ed25519"},
+		{AuditAuthFailure, "ed25519"},
+		{AuditAuthAttempt, "ecdsa"},
+		{AuditAuthSuccess, "ecdsa"},
+		{AuditSessionStart, ""},
+		{AuditCommand, ""},
+		{AuditSessionEnd, ""},
+	}
+	for i, w := range want {
+		var ev AuditEvent
+		select {
+		case ev = <-events:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("event %d: timed out waiting for %v", i, w.typ)
+		}
+		if ev.Type != w.typ || ev.User != "testuser" || ev.Upstream != "upstream" || ev.RemoteAddr == nil || ev.Time.IsZero() {
+			t.Errorf("event %d: got %+v, want %v", i, ev, w.typ)
+		}
+		if ev.KeyFingerprint != wantFP[w.key] {
+			t.Errorf("event %d: got fingerprint %q, want that of %q", i, ev.KeyFingerprint, w.key)
+		}
+		if (ev.Type == AuditAuthFailure) != (ev.Err != nil) && ev.Type != AuditSessionEnd {
+			t.Errorf("event %d: %v with error %v", i, ev.Type, ev.Err)
+		}
+		if ev.Type == AuditSessionEnd && (ev.BytesUpstream == 0 || ev.BytesDownstream == 0) {
+			t.Errorf("session end without byte counts: %+v", ev)
+		}
+	}
+}
+
+func TestProxyAuditUpstreamDialError(t *testing.T) {
+	events := make(chan AuditEvent, 10)
+	proxyConf := newTestProxyConfig()
+	proxyConf.DestinationPort = 22
+	proxyConf.FindUpstreamHook = func(username string) (string, error) {
+		return "upstream", nil
+	}
+	proxyConf.AuditCallback = func(ev AuditEvent) { events <- ev }
+	dialErr := errors.New("connection refused")
+	s, addr, _ := newTestProxyServer(t, proxyConf)
+	s.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, dialErr
+	}
+	defer s.Close()
+
+	if client, err := dialTestProxyServer(addr); err == nil {
+		client.Close()
+		t.Fatal("logged in without an upstream")
+	}
+	select {
+	case ev := <-events:
+		if ev.Type != AuditUpstreamDialError || ev.Err != dialErr || ev.User != "testuser" || ev.Upstream != "upstream" {
+			t.Errorf("got %+v, want an upstream dial error", ev)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no audit event")
+	}
+}
@@ -0,0 +1,306 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// keyRestrictions are the forwarding restrictions of the authorized_keys
+// entry or user certificate that authenticated a session. They are
+// enforced on the relayed session by filterRestricted.
+type keyRestrictions struct {
+	noPortForwarding  bool
+	noAgentForwarding bool
+	noX11Forwarding   bool
+	noPty             bool
+}
+
+// merge returns the restrictions of both r and o.
+func (r keyRestrictions) merge(o keyRestrictions) keyRestrictions {
+	return keyRestrictions{
+		noPortForwarding:  r.noPortForwarding || o.noPortForwarding,
+		noAgentForwarding: r.noAgentForwarding || o.noAgentForwarding,
+		noX11Forwarding:   r.noX11Forwarding || o.noX11Forwarding,
+		noPty:             r.noPty || o.noPty,
+	}
+}
+
+// keyOptions are the parsed options of an authorized_keys entry.
+type keyOptions struct {
+	keyRestrictions
+	certAuthority bool
+	from          string
+	principals    []string
+	expiry        time.Time
+	// noTouchRequired and verifyRequired relax and tighten the flags
+	// required of security key signatures.
+	noTouchRequired bool
+	verifyRequired  bool
+}
+
+// Options that restrict a session in ways the proxy cannot enforce. Entries
+// carrying them never match.
+var unenforceableKeyOptions = map[string]bool{
+	"command":      true,
+	"permitopen":   true,
+	"permitlisten": true,
+	"tunnel":       true,
+}
+
+// expiryTimeLayouts are the formats of the expiry-time option.
+var expiryTimeLayouts = []string{"20060102", "200601021504", "20060102150405"}
+
+func parseExpiryTime(v string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(v, "Z") || strings.HasSuffix(v, "z") {
+		v, loc = v[:len(v)-1], time.UTC
+	}
+	for _, layout := range expiryTimeLayouts {
+		if len(v) == len(layout) {
+			return time.ParseInLocation(layout, v, loc)
+		}
+	}
+	return time.Time{}, fmt.Errorf("ssh: invalid expiry-time %q", v)
+}
+
+// parseKeyOptions parses the options returned by ParseAuthorizedKey.
+func parseKeyOptions(options []string) (*keyOptions, error) {
+	opts := &keyOptions{}
+	for _, option := range options {
+		name, value := option, ""
+		if i := strings.IndexByte(option, '='); i >= 0 {
+			name, value = option[:i], option[i+1:]
+			if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+				value = strings.Replace(value[1:len(value)-1], `\"`, `"`, -1)
+			}
+		}
+		name = strings.ToLower(name)
+		if unenforceableKeyOptions[name] {
+			return nil, fmt.Errorf("ssh: key option %q is not supported by the proxy", name)
+		}
+
+		switch name {
+		case "cert-authority":
+			opts.certAuthority = true
+		case "from":
+			opts.from = value
+		case "principals":
+			opts.principals = strings.Split(value, ",")
+		case "expiry-time":
+			t, err := parseExpiryTime(value)
+			if err != nil {
+				return nil, err
+			}
+			opts.expiry = t
+		case noTouchRequiredOption:
+			opts.noTouchRequired = true
+		case verifyRequiredOption:
+			opts.verifyRequired = true
+		case "restrict":
+			opts.keyRestrictions = keyRestrictions{true, true, true, true}
+		case "no-port-forwarding":
+			opts.noPortForwarding = true
+		case "port-forwarding":
+			opts.noPortForwarding = false
+		case "no-agent-forwarding":
+			opts.noAgentForwarding = true
+		case "agent-forwarding":
+			opts.noAgentForwarding = false
+		case "no-x11-forwarding":
+			opts.noX11Forwarding = true
+		case "x11-forwarding":
+			opts.noX11Forwarding = false
+		case "no-pty":
+			opts.noPty = true
+		case "pty":
+			opts.noPty = false
+		}
+	}
+	return opts, nil
+}
+
+// matchPattern reports whether s matches an OpenSSH pattern, in which '*'
+// matches any run of characters and '?' any single character.
+func matchPattern(s, pattern string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchPattern(s[i:], pattern[1:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		s, pattern = s[1:], pattern[1:]
+	}
+	return len(s) == 0
+}
+
+// matchFrom reports whether the client address matches the pattern list of a
+// from option. Patterns are IP wildcards or CIDR blocks, and a match of a
+// pattern negated with '!' rejects the address.
+func matchFrom(addr net.Addr, patterns string) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	matched := false
+	for _, pattern := range strings.Split(patterns, ",") {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		var m bool
+		if strings.Contains(pattern, "/") {
+			_, ipNet, err := net.ParseCIDR(pattern)
+			m = err == nil && ipNet.Contains(tcpAddr.IP)
+		} else {
+			m = matchPattern(tcpAddr.IP.String(), pattern)
+		}
+		if m && negated {
+			return false
+		}
+		matched = matched || m
+	}
+	return matched
+}
+
+// matchAuthorizedKeys returns the options of the first entry of authKeys that
+// authorizes key for username, honoring cert-authority, principals, from and
+// expiry-time, or nil if there is none.
+func (p *ProxyConn) matchAuthorizedKeys(username string, authKeys []byte, key PublicKey) (*keyOptions, error) {
+	keyData := key.Marshal()
+	cert, isCert := key.(*Certificate)
+	now := time.Now()
+
+	for len(authKeys) > 0 {
+		entry, _, options, rest, err := ParseAuthorizedKey(authKeys)
+		if err != nil {
+			return nil, err
+		}
+		authKeys = rest
+
+		opts, err := parseKeyOptions(options)
+		if err != nil {
+			continue
+		}
+		if opts.certAuthority {
+			if !isCert || !bytes.Equal(cert.SignatureKey.Marshal(), entry.Marshal()) {
+				continue
+			}
+		} else if !bytes.Equal(entry.Marshal(), keyData) {
+			continue
+		}
+		if !opts.expiry.IsZero() && !now.Before(opts.expiry) {
+			continue
+		}
+		if opts.from != "" && !matchFrom(p.Downstream.RemoteAddr(), opts.from) {
+			continue
+		}
+		if opts.certAuthority {
+			principals := opts.principals
+			if principals == nil {
+				principals = []string{username}
+			}
+			if p.acceptUserCert(cert, principals) != nil {
+				continue
+			}
+		}
+		return opts, nil
+	}
+	return nil, ErrNoAuthorizedKey
+}
+
+// filterRestricted rejects a packet relayed in direction dir that asks for
+// something the authenticating key's restrictions forbid, answering it in
+// place of the peer. It reports whether the packet was consumed.
+func (p *ProxyConn) filterRestricted(dir relayDirection, packet []byte) bool {
+	r := p.restrictions
+	if r == (keyRestrictions{}) || len(packet) == 0 {
+		return false
+	}
+	sender := p.Downstream.transport
+	if dir == toDownstream {
+		sender = p.Upstream.transport
+	}
+
+	switch packet[0] {
+	case msgGlobalRequest:
+		var msg globalRequestMsg
+		if dir != toUpstream || Unmarshal(packet, &msg) != nil {
+			return false
+		}
+		if !r.noPortForwarding || msg.Type != "tcpip-forward" && msg.Type != "streamlocal-forward@openssh.com" {
+			return false
+		}
+		if msg.WantReply {
+			sender.writePacket([]byte{msgRequestFailure})
+		}
+		return true
+
+	case msgChannelOpen:
+		var msg channelOpenMsg
+		if Unmarshal(packet, &msg) != nil {
+			return false
+		}
+		denied := false
+		switch msg.ChanType {
+		case "direct-tcpip", "forwarded-tcpip", "direct-streamlocal@openssh.com", "forwarded-streamlocal@openssh.com":
+			denied = r.noPortForwarding
+		case "auth-agent@openssh.com":
+			denied = r.noAgentForwarding
+		case "x11":
+			denied = r.noX11Forwarding
+		}
+		if !denied {
+			return false
+		}
+		sender.writePacket(Marshal(&channelOpenFailureMsg{
+			PeersID: msg.PeersID,
+			Reason:  Prohibited,
+			Message: "restricted by authorized_keys options",
+		}))
+		return true
+
+	case msgChannelRequest:
+		var msg channelRequestMsg
+		if dir != toUpstream || Unmarshal(packet, &msg) != nil {
+			return false
+		}
+		denied := false
+		switch msg.Request {
+		case "auth-agent-req@openssh.com":
+			denied = r.noAgentForwarding
+		case "x11-req":
+			denied = r.noX11Forwarding
+		case "pty-req":
+			denied = r.noPty
+		}
+		if !denied {
+			return false
+		}
+		if msg.WantReply {
+			// The recipient is the upstream's ID; the failure goes to the
+			// downstream end of the channel.
+			p.channels.mu.Lock()
+			ch, ok := p.channels.byUpstream[msg.PeersID]
+			p.channels.mu.Unlock()
+			if ok {
+				sender.writePacket(Marshal(&channelRequestFailureMsg{PeersID: ch.downstreamID}))
+			}
+		}
+		return true
+	}
+	return false
+}
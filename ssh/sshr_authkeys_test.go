@@ -0,0 +1,145 @@
+package ssh
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseKeyOptions(t *testing.T) {
+	opts, err := parseKeyOptions([]string{`restrict`, `pty`, `from="10.0.0.0/8,!10.1.*"`, `expiry-time="20300101Z"`})
+	if err != nil {
+		t.Fatalf("parseKeyOptions: %v", err)
+	}
+	want := keyRestrictions{noPortForwarding: true, noAgentForwarding: true, noX11Forwarding: true}
+	if opts.keyRestrictions != want {
+		t.Errorf("got restrictions %+v, want %+v", opts.keyRestrictions, want)
+	}
+	if opts.from != "10.0.0.0/8,!10.1.*" {
+		t.Errorf("got from %q", opts.from)
+	}
+	if !opts.expiry.Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("got expiry %v", opts.expiry)
+	}
+	for _, bad := range []string{`command="ls"`, `expiry-time="2030"`} {
+		if _, err := parseKeyOptions([]string{bad}); err == nil {
+			t.Errorf("%s: parsed without error", bad)
+		}
+	}
+}
+
+func TestMatchFrom(t *testing.T) {
+	for _, tc := range []struct {
+		ip       string
+		patterns string
+		want     bool
+	}{
+		{"10.2.3.4", "10.0.0.0/8", true},
+		{"10.1.3.4", "10.0.0.0/8,!10.1.*", false},
+		{"192.0.2.7", "192.0.2.?", true},
+		{"192.0.2.17", "192.0.2.?", false},
+		{"127.0.0.1", "10.*", false},
+	} {
+		addr := &net.TCPAddr{IP: net.ParseIP(tc.ip), Port: 22}
+		if got := matchFrom(addr, tc.patterns); got != tc.want {
+			t.Errorf("matchFrom(%s, %q) = %v, want %v", tc.ip, tc.patterns, got, tc.want)
+		}
+	}
+}
+
+// authorizedTestKey returns an authorized_keys line for key
+// with the given options.
+func authorizedTestKey(key PublicKey, options string) []byte {
+	line := string(MarshalAuthorizedKey(key))
+	if options != "" {
+		line = options + " " + line
+	}
+	return []byte(line)
+}
+
+func TestProxyAuthorizedKeyOptions(t *testing.T) {
+	future := time.Now().Add(time.Hour).Format("200601021504")
+	past := time.Now().Add(-time.Hour).Format("200601021504")
+	for _, tc := range []struct {
+		options string
+		ok      bool
+	}{
+		{`from="127.0.0.1"`, true},
+		{`from="!127.0.0.1,*"`, false},
+		{`expiry-time="` + future + `"`, true},
+		{`expiry-time="` + past + `"`, false},
+		{`command="/bin/true"`, false},
+	} {
+		proxyConf := newTestProxyConfig()
+		proxyConf.FetchAuthorizedKeysHook = func(username string) ([]byte, error) {
+			return authorizedTestKey(testPublicKeys["ecdsa"], tc.options), nil
+		}
+		client, _, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+			User: "testuser",
+			Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+		})
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: got error %v, want success %v", tc.options, err, tc.ok)
+		}
+		if err == nil {
+			client.Close()
+		}
+	}
+}
+
+func TestProxyAuthorizedCertAuthority(t *testing.T) {
+	for _, tc := range []struct {
+		options string
+		ok      bool
+	}{
+		{`cert-authority`, true},
+		{`cert-authority,principals="ops,admin"`, false},
+		{`cert-authority,principals="ops,testuser"`, true},
+	} {
+		proxyConf := newTestProxyConfig()
+		proxyConf.FetchAuthorizedKeysHook = func(username string) ([]byte, error) {
+			return authorizedTestKey(testPublicKeys["ecdsa"], tc.options), nil
+		}
+		client, _, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+			User: "testuser",
+			Auth: []AuthMethod{PublicKeys(newTestUserCert(t, nil))},
+		})
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: got error %v, want success %v", tc.options, err, tc.ok)
+		}
+		if err == nil {
+			client.Close()
+		}
+	}
+}
+
+func TestProxyKeyRestrictionsEnforced(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.FetchAuthorizedKeysHook = func(username string) ([]byte, error) {
+		return authorizedTestKey(testPublicKeys["ecdsa"], "no-port-forwarding,no-pty"), nil
+	}
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+
+	if _, err := client.Dial("tcp", "192.0.2.1:80"); err == nil || !strings.Contains(err.Error(), "restricted") {
+		t.Errorf("direct-tcpip: got error %v, want a restriction", err)
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+	if err := session.RequestPty("xterm", 24, 80, nil); err == nil {
+		t.Error("pty-req succeeded despite no-pty")
+	}
+	if got := runHello(t, client); got != "hello" {
+		t.Errorf("got output %q, want %q", got, "hello")
+	}
+}
@@ -0,0 +1,30 @@
+package ssh
+
+// AuthResult describes a downstream authentication attempt to
+// ProxyConfig.OnAuthSuccess and OnAuthFailure.
+type AuthResult struct {
+	// Upstream is the host the user is bridged to.
+	Upstream string
+	// Route is the route the upstream was dialed by, if any.
+	Route *UpstreamRoute
+	// Method is the downstream authentication method, "none" if the
+	// upstream required no authentication.
+	Method string
+	// KeyFingerprint is the SHA256 fingerprint of the downstream key for
+	// the "publickey" method.
+	KeyFingerprint string
+	// SecurityKeyCounter is the signature counter of a downstream security
+	// key, which clones of the key may fail to advance, or 0.
+	SecurityKeyCounter uint32
+}
+
+func (p *ProxyConn) authResult(method string) AuthResult {
+	r := AuthResult{Upstream: p.DestinationHost, Route: p.Route, Method: method}
+	if method == "publickey" && p.attemptKey != nil {
+		r.KeyFingerprint = FingerprintSHA256(p.attemptKey)
+	}
+	if p.securityKey != nil {
+		r.SecurityKeyCounter = p.securityKey.Counter
+	}
+	return r
+}
@@ -0,0 +1,58 @@
+package ssh
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestProxyOnAuthSuccess(t *testing.T) {
+	clientConf := &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	}
+	proxyConf := newTestProxyConfig()
+	var result AuthResult
+	proxyConf.OnAuthSuccess = func(p *ProxyConn, r AuthResult) error {
+		result = r
+		return nil
+	}
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), clientConf)
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	client.Close()
+	if want := FingerprintSHA256(testPublicKeys["ecdsa"]); result.Method != "publickey" || result.KeyFingerprint != want {
+		t.Errorf("got %+v, want publickey with %s", result, want)
+	}
+
+	pending := errors.New("access request pending approval")
+	proxyConf.OnAuthSuccess = func(p *ProxyConn, r AuthResult) error { return pending }
+	if _, res, err = dialTestProxy(t, proxyConf, newTestUpstreamConfig(), clientConf); err == nil {
+		t.Fatal("login rejected by OnAuthSuccess succeeded")
+	}
+	if !errors.Is(res.err, ErrAuthRejected) || !errors.Is(res.err, pending) {
+		t.Errorf("proxy error: got %v, want ErrAuthRejected wrapping %v", res.err, pending)
+	}
+}
+
+func TestProxyOnAuthFailure(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	var failures int
+	proxyConf.OnAuthFailure = func(p *ProxyConn, r AuthResult, err error) error {
+		failures++
+		if !errors.Is(err, ErrAuthRejected) {
+			t.Errorf("got failure %v, want ErrAuthRejected", err)
+		}
+		return errors.New("abort")
+	}
+	_, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ed25519"]), PublicKeys(testSigners["ecdsa"])},
+	})
+	if err == nil {
+		t.Fatal("login after an aborted attempt succeeded")
+	}
+	if failures != 1 || !errors.Is(res.err, ErrAuthRejected) {
+		t.Errorf("got %d failures and proxy error %v, want one failure and ErrAuthRejected", failures, res.err)
+	}
+}
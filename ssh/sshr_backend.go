@@ -0,0 +1,197 @@
+package ssh
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// hookKind distinguishes the hook results remembered by HookBackendState.
+type hookKind int
+
+const (
+	hookAuthorizedKeys hookKind = iota
+	hookPrivateKey
+)
+
+type hookCacheKey struct {
+	kind     hookKind
+	username string
+}
+
+type hookResult struct {
+	data    []byte
+	fetched time.Time
+}
+
+// DefaultBackendMaxAge is used if HookBackendState.MaxAge is zero.
+const DefaultBackendMaxAge = 24 * time.Hour
+
+// HookBackendState lets the backends behind the ProxyConfig hooks announce
+// planned maintenance. While a state is attached to a ProxyConfig, the last
+// successful result of the authorized keys hooks is remembered. During
+// maintenance the proxy serves those results instead of calling the hooks,
+// so logins of known users keep working while the control plane is down.
+// Private keys are only remembered when fetched by Prefetch or during
+// maintenance, and are forgotten when it ends.
+type HookBackendState struct {
+	// DegradedModeHook, if non-nil, is called when the proxy enters or
+	// leaves degraded mode because of backend maintenance.
+	DegradedModeHook func(degraded bool, reason string)
+
+	// MaxAge is how long results are remembered. If zero,
+	// DefaultBackendMaxAge is used.
+	MaxAge time.Duration
+
+	mu          sync.Mutex
+	maintenance bool
+	reason      string
+	results     map[hookCacheKey]hookResult
+	// swept is when old results were last removed.
+	swept time.Time
+}
+
+// BeginMaintenance switches the proxy to degraded mode: hooks are no longer
+// called for users whose results are known. reason is passed to
+// DegradedModeHook.
+func (s *HookBackendState) BeginMaintenance(reason string) {
+	s.mu.Lock()
+	s.maintenance = true
+	s.reason = reason
+	s.mu.Unlock()
+
+	if s.DegradedModeHook != nil {
+		s.DegradedModeHook(true, reason)
+	}
+}
+
+// EndMaintenance returns the proxy to calling the hooks for every login.
+func (s *HookBackendState) EndMaintenance() {
+	s.mu.Lock()
+	s.maintenance = false
+	s.reason = ""
+	for key := range s.results {
+		if key.kind == hookPrivateKey {
+			delete(s.results, key)
+		}
+	}
+	s.mu.Unlock()
+
+	if s.DegradedModeHook != nil {
+		s.DegradedModeHook(false, "")
+	}
+}
+
+// InMaintenance reports whether maintenance was announced, and its reason.
+func (s *HookBackendState) InMaintenance() (bool, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maintenance, s.reason
+}
+
+// Prefetch calls the fetch hooks of conf for the given users and remembers
+// the results, so they can be served during an upcoming maintenance. It
+// returns the first error encountered, after trying every user.
+func (s *HookBackendState) Prefetch(conf *ProxyConfig, usernames []string) error {
+	var firstErr error
+	for _, username := range usernames {
+		if _, err := s.refresh(hookAuthorizedKeys, username, authorizedKeysHook(context.Background(), conf, HookMetadata{}), true); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if conf.upstreamAuth() != UpstreamAuthUserKey || conf.FetchSignerHook != nil {
+			continue
+		}
+		if _, err := s.refresh(hookPrivateKey, username, privateKeyHook(context.Background(), conf, HookMetadata{}), true); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// fetch returns the result of hook for username. During maintenance a
+// remembered result is returned without calling hook. s may be nil, in which
+// case hook is simply called.
+func (s *HookBackendState) fetch(kind hookKind, username string, hook func(string) ([]byte, error)) ([]byte, error) {
+	if s == nil {
+		return hook(username)
+	}
+
+	key := hookCacheKey{kind, username}
+	s.mu.Lock()
+	result, ok := s.results[key]
+	maintenance := s.maintenance
+	ok = ok && time.Since(result.fetched) < s.maxAge()
+	s.mu.Unlock()
+
+	if maintenance && ok {
+		return result.data, nil
+	}
+	return s.refresh(kind, username, hook, kind != hookPrivateKey || maintenance)
+}
+
+func (s *HookBackendState) maxAge() time.Duration {
+	if s.MaxAge <= 0 {
+		return DefaultBackendMaxAge
+	}
+	return s.MaxAge
+}
+
+// refresh calls hook and remembers its result if remember is set.
+func (s *HookBackendState) refresh(kind hookKind, username string, hook func(string) ([]byte, error), remember bool) ([]byte, error) {
+	data, err := hook(username)
+	if err != nil || !remember {
+		return data, err
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	if s.results == nil {
+		s.results = make(map[hookCacheKey]hookResult)
+	}
+	if now.Sub(s.swept) > s.maxAge() {
+		for key, result := range s.results {
+			if now.Sub(result.fetched) >= s.maxAge() {
+				delete(s.results, key)
+			}
+		}
+		s.swept = now
+	}
+	s.results[hookCacheKey{kind, username}] = hookResult{data, now}
+	s.mu.Unlock()
+	return data, nil
+}
+
+// authorizedKeysHook returns the hook that fetches authorized keys for the
+// connection described by meta. The username it is called with overrides
+// meta.User.
+func authorizedKeysHook(ctx context.Context, conf *ProxyConfig, meta HookMetadata) func(string) ([]byte, error) {
+	hook := conf.FetchAuthorizedKeysHook
+	if conf.FetchAuthorizedKeysContextHook != nil {
+		hook = func(username string) ([]byte, error) {
+			meta.User = username
+			return conf.FetchAuthorizedKeysContextHook(ctx, meta)
+		}
+	} else if hook == nil {
+		hook = func(username string) ([]byte, error) {
+			return fetchAuthorizedKeysFromHomeDir(conf, username)
+		}
+	}
+	return cachedHook(conf, "authorized_keys:", hook)
+}
+
+// privateKeyHook is like authorizedKeysHook for private keys.
+func privateKeyHook(ctx context.Context, conf *ProxyConfig, meta HookMetadata) func(string) ([]byte, error) {
+	hook := conf.FetchPrivateKeyHook
+	if conf.FetchPrivateKeyContextHook != nil {
+		hook = func(username string) ([]byte, error) {
+			meta.User = username
+			return conf.FetchPrivateKeyContextHook(ctx, meta)
+		}
+	} else if hook == nil {
+		hook = func(username string) ([]byte, error) {
+			return fetchPrivateKeyFromHomeDir(conf, username)
+		}
+	}
+	// Private keys stay out of the shared HookCache.
+	return localCachedHook(conf, "private_key:", hook)
+}
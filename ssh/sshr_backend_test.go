@@ -0,0 +1,116 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHookBackendStateMaintenance(t *testing.T) {
+	var events []bool
+	state := &HookBackendState{
+		DegradedModeHook: func(degraded bool, reason string) {
+			events = append(events, degraded)
+		},
+	}
+
+	calls := 0
+	backendUp := true
+	conf := &ProxyConfig{
+		BackendState: state,
+		FetchAuthorizedKeysHook: func(username string) ([]byte, error) {
+			calls++
+			if !backendUp {
+				return nil, errors.New("backend down")
+			}
+			return []byte("keys for " + username), nil
+		},
+		FetchPrivateKeyHook: func(username string) ([]byte, error) {
+			return []byte("key for " + username), nil
+		},
+	}
+
+	if err := state.Prefetch(conf, []string{"alice"}); err != nil {
+		t.Fatalf("Prefetch: %v", err)
+	}
+	state.BeginMaintenance("planned upgrade")
+	backendUp = false
+
+	if ok, reason := state.InMaintenance(); !ok || reason != "planned upgrade" {
+		t.Errorf("InMaintenance = %v, %q", ok, reason)
+	}
+
+	data, err := state.fetch(hookAuthorizedKeys, "alice", authorizedKeysHook(context.Background(), conf, HookMetadata{}))
+	if err != nil || string(data) != "keys for alice" {
+		t.Errorf("fetch during maintenance = %q, %v", data, err)
+	}
+	if calls != 1 {
+		t.Errorf("hook called %d times, want 1", calls)
+	}
+
+	if _, err := state.fetch(hookAuthorizedKeys, "bob", authorizedKeysHook(context.Background(), conf, HookMetadata{})); err == nil {
+		t.Error("fetch for unknown user during maintenance succeeded")
+	}
+
+	state.EndMaintenance()
+	backendUp = true
+	if _, err := state.fetch(hookAuthorizedKeys, "alice", authorizedKeysHook(context.Background(), conf, HookMetadata{})); err != nil {
+		t.Errorf("fetch after maintenance: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("hook called %d times, want 3", calls)
+	}
+
+	if len(events) != 2 || !events[0] || events[1] {
+		t.Errorf("got degraded mode events %v, want [true false]", events)
+	}
+}
+
+func TestHookBackendStateForgets(t *testing.T) {
+	state := &HookBackendState{}
+	conf := &ProxyConfig{
+		BackendState: state,
+		FetchAuthorizedKeysHook: func(username string) ([]byte, error) {
+			return []byte("keys for " + username), nil
+		},
+		FetchPrivateKeyHook: func(username string) ([]byte, error) {
+			return []byte("key for " + username), nil
+		},
+	}
+	remembered := func(kind hookKind, username string) bool {
+		state.mu.Lock()
+		defer state.mu.Unlock()
+		_, ok := state.results[hookCacheKey{kind, username}]
+		return ok
+	}
+
+	state.fetch(hookPrivateKey, "alice", privateKeyHook(context.Background(), conf, HookMetadata{}))
+	if remembered(hookPrivateKey, "alice") {
+		t.Error("private key remembered outside maintenance")
+	}
+
+	state.Prefetch(conf, []string{"alice"})
+	state.BeginMaintenance("planned upgrade")
+	state.EndMaintenance()
+	if remembered(hookPrivateKey, "alice") {
+		t.Error("private key remembered after maintenance")
+	}
+	if !remembered(hookAuthorizedKeys, "alice") {
+		t.Error("authorized keys forgotten after maintenance")
+	}
+
+	state.MaxAge = time.Millisecond
+	time.Sleep(10 * time.Millisecond)
+	state.BeginMaintenance("planned upgrade")
+	conf.FetchAuthorizedKeysHook = func(username string) ([]byte, error) {
+		return nil, errors.New("backend down")
+	}
+	if _, err := state.fetch(hookAuthorizedKeys, "alice", authorizedKeysHook(context.Background(), conf, HookMetadata{})); err == nil {
+		t.Error("result older than MaxAge served")
+	}
+	state.fetch(hookAuthorizedKeys, "bob", func(string) ([]byte, error) { return []byte("keys"), nil })
+	if remembered(hookAuthorizedKeys, "alice") {
+		t.Error("result older than MaxAge kept")
+	}
+}
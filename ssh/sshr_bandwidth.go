@@ -0,0 +1,94 @@
+package ssh
+
+import (
+	"sync"
+	"time"
+)
+
+// BandwidthLimit caps the bytes per second relayed in each direction, to
+// the upstream and to the downstream client. Zero leaves a direction
+// unlimited.
+type BandwidthLimit struct {
+	Upstream   int64
+	Downstream int64
+}
+
+// BandwidthLimits are the caps of a proxied session. Connection caps the
+// session alone and User all sessions of its user through the throttler
+// together.
+type BandwidthLimits struct {
+	Connection BandwidthLimit
+	User       BandwidthLimit
+}
+
+// BandwidthThrottler rate limits the relayed traffic of sessions by the
+// caps its hook chooses for their user and upstream host, so that a bulk
+// transfer cannot saturate the uplink of the proxy. Throttled sessions
+// stop reading, which makes the peer wait for the channel window.
+type BandwidthThrottler struct {
+	hook func(username, upstream string) BandwidthLimits
+
+	mu    sync.Mutex
+	users map[string]*userBandwidth
+}
+
+// userBandwidth are the buckets shared by the sessions of a user.
+type userBandwidth struct {
+	up, down *tokenBucket
+	sessions int
+}
+
+// NewBandwidthThrottler returns a throttler that limits every session to
+// the caps hook returns when the session starts.
+func NewBandwidthThrottler(hook func(username, upstream string) BandwidthLimits) *BandwidthThrottler {
+	return &BandwidthThrottler{hook: hook, users: make(map[string]*userBandwidth)}
+}
+
+// join returns the buckets the traffic of a session to the upstream and to
+// the downstream must draw from. The caller must call leave when the
+// session ends.
+func (t *BandwidthThrottler) join(username, upstream string) (up, down []*tokenBucket) {
+	limits := t.hook(username, upstream)
+	if limits.Connection.Upstream > 0 {
+		up = append(up, newTokenBucket(limits.Connection.Upstream))
+	}
+	if limits.Connection.Downstream > 0 {
+		down = append(down, newTokenBucket(limits.Connection.Downstream))
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u, ok := t.users[username]
+	if !ok {
+		u = &userBandwidth{up: newTokenBucket(0), down: newTokenBucket(0)}
+		t.users[username] = u
+	}
+	u.sessions++
+	// The caps chosen for the latest session apply to all of the user's.
+	u.up.setRate(limits.User.Upstream)
+	u.down.setRate(limits.User.Downstream)
+	return append(up, u.up), append(down, u.down)
+}
+
+func (t *BandwidthThrottler) leave(username string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if u, ok := t.users[username]; ok {
+		if u.sessions--; u.sessions <= 0 {
+			delete(t.users, username)
+		}
+	}
+}
+
+// waitBuckets blocks until n bytes may be sent through all of buckets.
+func waitBuckets(buckets []*tokenBucket, n int) {
+	var d time.Duration
+	for _, b := range buckets {
+		if r := b.reserve(n); r > d {
+			d = r
+		}
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
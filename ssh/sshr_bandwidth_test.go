@@ -0,0 +1,51 @@
+package ssh
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBandwidthThrottler(t *testing.T) {
+	th := NewBandwidthThrottler(func(username, upstream string) BandwidthLimits {
+		limits := BandwidthLimits{User: BandwidthLimit{Upstream: 1000}}
+		if upstream == "backup.internal" {
+			limits.Connection.Downstream = 500
+		}
+		return limits
+	})
+
+	up1, down1 := th.join("alice", "web.internal")
+	if len(up1) != 1 || up1[0].rate != 1000 || len(down1) != 1 || down1[0].rate != 0 {
+		t.Fatalf("got buckets %v, %v", up1, down1)
+	}
+	up2, down2 := th.join("alice", "backup.internal")
+	if len(up2) != 1 || up2[0] != up1[0] {
+		t.Errorf("sessions of the same user do not share the upstream bucket")
+	}
+	if len(down2) != 2 || down2[0].rate != 500 || down2[1] != down1[0] {
+		t.Errorf("got downstream buckets %v, want the connection's and the user's", down2)
+	}
+	if up3, _ := th.join("bob", "web.internal"); up3[0] == up1[0] {
+		t.Errorf("sessions of different users share a bucket")
+	}
+
+	th.leave("alice")
+	th.leave("alice")
+	if _, ok := th.users["alice"]; ok {
+		t.Errorf("buckets of alice kept after all sessions ended")
+	}
+	if _, ok := th.users["bob"]; !ok {
+		t.Errorf("buckets of bob dropped while a session runs")
+	}
+}
+
+func TestWaitBuckets(t *testing.T) {
+	fast, slow := newTokenBucket(1<<20), newTokenBucket(1<<19)
+	fast.tokens, slow.tokens = 0, 0
+	start := time.Now()
+	waitBuckets([]*tokenBucket{fast, slow, newTokenBucket(0)}, 1<<16)
+	// The slowest bucket decides: 1/8 of a second.
+	if d := time.Since(start); d < 100*time.Millisecond || d > time.Second {
+		t.Errorf("waited %v, want about 125ms", d)
+	}
+}
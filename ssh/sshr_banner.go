@@ -0,0 +1,34 @@
+package ssh
+
+// sendBanner shows the downstream client the banner from
+// ProxyConfig.BannerCallback, if any, before its authentication is bridged.
+func (p *ProxyConn) sendBanner() error {
+	if p.config.BannerCallback == nil {
+		return nil
+	}
+	msg := p.config.BannerCallback(p.Downstream)
+	if msg == "" {
+		return nil
+	}
+	return p.Downstream.transport.writePacket(Marshal(&userAuthBannerMsg{Message: msg}))
+}
+
+// relayUpstreamBanner relays the banner in packet from the upstream to the
+// downstream client, unless ProxyConfig suppresses or replaces it.
+func (p *ProxyConn) relayUpstreamBanner(packet []byte) error {
+	if p.config.SuppressUpstreamBanners {
+		return nil
+	}
+	if p.config.UpstreamBannerHook != nil {
+		var msg userAuthBannerMsg
+		if err := Unmarshal(packet, &msg); err != nil {
+			return err
+		}
+		msg.Message = p.config.UpstreamBannerHook(p.User, p.DestinationHost, msg.Message)
+		if msg.Message == "" {
+			return nil
+		}
+		packet = Marshal(&msg)
+	}
+	return p.Downstream.transport.writePacket(packet)
+}
@@ -0,0 +1,67 @@
+package ssh
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProxyBannerCallback(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.BannerCallback = func(conn ConnMetadata) string {
+		return "authorized use only, " + conn.User() + "\r\n"
+	}
+	var banner string
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+		BannerCallback: func(message string) error {
+			banner = message
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+	if want := "authorized use only, testuser\r\n"; banner != want {
+		t.Errorf("got banner %q, want %q", banner, want)
+	}
+}
+
+func TestProxyUpstreamBanners(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		suppress bool
+		hook     func(username, host, banner string) string
+		want     string
+	}{
+		{name: "relayed", want: "welcome to db1.internal\r\n"},
+		{name: "suppressed", suppress: true},
+		{name: "replaced", hook: func(username, host, banner string) string {
+			return strings.Replace(banner, "db1.internal", "the database", 1)
+		}, want: "welcome to the database\r\n"},
+		{name: "dropped", hook: func(username, host, banner string) string { return "" }},
+	} {
+		proxyConf := newTestProxyConfig()
+		proxyConf.SuppressUpstreamBanners = tc.suppress
+		proxyConf.UpstreamBannerHook = tc.hook
+		upstreamConf := newTestUpstreamConfig()
+		upstreamConf.BannerCallback = func(conn ConnMetadata) string { return "welcome to db1.internal\r\n" }
+		var banner string
+		client, res, err := dialTestProxy(t, proxyConf, upstreamConf, &ClientConfig{
+			User: "testuser",
+			Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+			BannerCallback: func(message string) error {
+				banner = message
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatalf("%s: client: %v, proxy: %v", tc.name, err, res.err)
+		}
+		client.Close()
+		if banner != tc.want {
+			t.Errorf("%s: got banner %q, want %q", tc.name, banner, tc.want)
+		}
+	}
+}
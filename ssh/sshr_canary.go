@@ -0,0 +1,142 @@
+package ssh
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// CanaryRoute moves a share of the users routed to an upstream host to a new
+// one.
+type CanaryRoute struct {
+	// From is the current upstream host, as returned by FindUpstreamHook.
+	From string
+	// To is the new upstream host.
+	To string
+	// Percent of the users of From that are sent to To. Users are assigned
+	// by a hash of their name, so each user stays on one variant, and
+	// raising Percent only moves additional users.
+	Percent int
+	// ClientConfig, if non-nil, is used to authenticate to To instead of
+	// ProxyConfig.ClientConfig.
+	ClientConfig *ClientConfig
+}
+
+// CanaryVariantStats counts the logins of one variant of a route.
+type CanaryVariantStats struct {
+	Routed       int64
+	AuthSuccess  int64
+	AuthRejected int64
+}
+
+// CanaryStats are the per-variant counters of a route.
+type CanaryStats struct {
+	Old CanaryVariantStats
+	New CanaryVariantStats
+}
+
+// CanaryRouter splits routes between old and new upstream hosts for gradual
+// backend migrations. It is safe for concurrent use.
+type CanaryRouter struct {
+	mu     sync.Mutex
+	routes map[string]CanaryRoute
+	stats  map[string]*CanaryStats
+}
+
+// SetRoute adds a route or replaces the route with the same From.
+func (r *CanaryRouter) SetRoute(route CanaryRoute) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.routes == nil {
+		r.routes = make(map[string]CanaryRoute)
+		r.stats = make(map[string]*CanaryStats)
+	}
+	r.routes[route.From] = route
+	if r.stats[route.From] == nil {
+		r.stats[route.From] = &CanaryStats{}
+	}
+}
+
+// RemoveRoute stops splitting the route of from. Its counters are kept.
+func (r *CanaryRouter) RemoveRoute(from string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.routes, from)
+}
+
+// Stats returns the counters of the route of from.
+func (r *CanaryRouter) Stats(from string) CanaryStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s := r.stats[from]; s != nil {
+		return *s
+	}
+	return CanaryStats{}
+}
+
+// canaryBucket maps a username to a percentile.
+func canaryBucket(username string) int {
+	h := fnv.New32a()
+	h.Write([]byte(username))
+	return int(h.Sum32() % 100)
+}
+
+// Wrap returns a FindUpstreamHook that sends the canary share of the users
+// of each route to its new host.
+func (r *CanaryRouter) Wrap(find func(username string) (string, error)) func(username string) (string, error) {
+	return func(username string) (string, error) {
+		host, err := find(username)
+		if err != nil {
+			return host, err
+		}
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		route, ok := r.routes[host]
+		if !ok {
+			return host, nil
+		}
+		stats := r.stats[host]
+		if canaryBucket(username) < route.Percent {
+			stats.New.Routed++
+			return route.To, nil
+		}
+		stats.Old.Routed++
+		return host, nil
+	}
+}
+
+// ClientConfig returns the config to authenticate to host with: the one of
+// the route whose new host is host, if it has one, or else fallback.
+func (r *CanaryRouter) ClientConfig(host string, fallback *ClientConfig) *ClientConfig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, route := range r.routes {
+		if route.To == host && route.ClientConfig != nil {
+			return route.ClientConfig
+		}
+	}
+	return fallback
+}
+
+// recordAuth counts the outcome of an upstream authentication to host.
+func (r *CanaryRouter) recordAuth(host string, success bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for from, route := range r.routes {
+		var v *CanaryVariantStats
+		switch host {
+		case route.To:
+			v = &r.stats[from].New
+		case from:
+			v = &r.stats[from].Old
+		default:
+			continue
+		}
+		if success {
+			v.AuthSuccess++
+		} else {
+			v.AuthRejected++
+		}
+		return
+	}
+}
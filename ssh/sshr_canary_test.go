@@ -0,0 +1,70 @@
+package ssh
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCanaryRouterSplit(t *testing.T) {
+	r := &CanaryRouter{}
+	r.SetRoute(CanaryRoute{From: "old", To: "new", Percent: 30})
+	find := r.Wrap(func(username string) (string, error) { return "old", nil })
+
+	moved := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		user := fmt.Sprintf("user%d", i)
+		host, _ := find(user)
+		moved[user] = host == "new"
+		if again, _ := find(user); again != host {
+			t.Fatalf("%s routed to %s, then to %s", user, host, again)
+		}
+	}
+	stats := r.Stats("old")
+	if stats.New.Routed < 400 || stats.New.Routed > 800 {
+		t.Errorf("%d of 2000 logins routed to the canary, want about 600", stats.New.Routed)
+	}
+
+	r.SetRoute(CanaryRoute{From: "old", To: "new", Percent: 60})
+	for user, wasMoved := range moved {
+		if host, _ := find(user); wasMoved && host != "new" {
+			t.Errorf("raising the percentage moved %s back", user)
+		}
+	}
+
+	r.RemoveRoute("old")
+	if host, _ := find("user1"); host != "old" {
+		t.Errorf("removed route still applied: got %s", host)
+	}
+}
+
+func TestCanaryRouterClientConfig(t *testing.T) {
+	fallback, canary := &ClientConfig{User: "old"}, &ClientConfig{User: "new"}
+	r := &CanaryRouter{}
+	r.SetRoute(CanaryRoute{From: "old", To: "new", Percent: 10, ClientConfig: canary})
+	if r.ClientConfig("new", fallback) != canary {
+		t.Error("canary host does not use the route's ClientConfig")
+	}
+	if r.ClientConfig("old", fallback) != fallback {
+		t.Error("old host does not use the fallback ClientConfig")
+	}
+}
+
+func TestProxyCanaryStats(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.Canary = &CanaryRouter{}
+	proxyConf.Canary.SetRoute(CanaryRoute{From: "old", To: "upstream", Percent: 100})
+
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{Password(upstreamPassword)},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	client.Close()
+
+	stats := proxyConf.Canary.Stats("old")
+	if stats.New.AuthSuccess != 1 || stats.New.AuthRejected != 0 || stats.Old.AuthSuccess != 0 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
@@ -0,0 +1,101 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var (
+	errUpstreamUserChanged = errors.New("ssh: certificate maps to another upstream user than already announced")
+	errCertNoPrincipals    = errors.New("ssh: certificate lacks principal list")
+)
+
+// holdUpstreamUser reports whether nothing may be sent upstream yet, because
+// CertUserHook may still pick the upstream username.
+func (p *ProxyConn) holdUpstreamUser() bool {
+	return p.config.CertUserHook != nil && p.announcedUser == ""
+}
+
+// isTrustedUserCA reports whether key is one of TrustedUserCAs.
+func (conf *ProxyConfig) isTrustedUserCA(key PublicKey) bool {
+	data := key.Marshal()
+	for _, ca := range conf.TrustedUserCAs {
+		if bytes.Equal(ca.Marshal(), data) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUserCert checks a downstream user certificate like sshd does for
+// TrustedUserCAKeys: it must be signed by a trusted CA and list username as a
+// principal. Unlike for cert-authority entries, which CertChecker lets match
+// any principal, an empty principal list is rejected.
+func (p *ProxyConn) checkUserCert(username string, cert *Certificate) error {
+	if !p.config.isTrustedUserCA(cert.SignatureKey) {
+		return errors.New("ssh: certificate signed by unrecognized authority")
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		return errCertNoPrincipals
+	}
+	return p.acceptUserCert(cert, []string{username})
+}
+
+// acceptUserCert checks a user certificate whose authority is trusted: it
+// must list one of principals, be within its validity window and allow the
+// client's source address. Certificates with other critical options, such
+// as force-command, are rejected, since the proxy cannot enforce them.
+// CertUserHook then picks the upstream username.
+func (p *ProxyConn) acceptUserCert(cert *Certificate, principals []string) error {
+	if cert.CertType != UserCert {
+		return fmt.Errorf("ssh: cert has type %d", cert.CertType)
+	}
+	checker := CertChecker{
+		SupportedCriticalOptions: []string{sourceAddressCriticalOption, verifyRequiredOption},
+	}
+	var err error
+	for _, principal := range principals {
+		if err = checker.CheckCert(principal, cert); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if addrs, ok := cert.CriticalOptions[sourceAddressCriticalOption]; ok {
+		if err := checkSourceAddress(p.Downstream.RemoteAddr(), addrs); err != nil {
+			return err
+		}
+	}
+
+	if p.config.CertUserHook == nil {
+		return nil
+	}
+	user, err := p.config.CertUserHook(p.User, cert)
+	if err != nil || user == "" {
+		return err
+	}
+	// Servers disconnect clients that change the username during
+	// authentication.
+	if p.announcedUser != "" && user != p.announcedUser {
+		return errUpstreamUserChanged
+	}
+	p.mappedUser = user
+	return nil
+}
+
+// certRestrictions returns the restrictions of a user certificate, which
+// like sshd permits only what its permit-* extensions list.
+func certRestrictions(cert *Certificate) keyRestrictions {
+	permits := func(ext string) bool {
+		_, ok := cert.Extensions[ext]
+		return ok
+	}
+	return keyRestrictions{
+		noPortForwarding:  !permits("permit-port-forwarding"),
+		noAgentForwarding: !permits("permit-agent-forwarding"),
+		noX11Forwarding:   !permits("permit-X11-forwarding"),
+		noPty:             !permits("permit-pty"),
+	}
+}
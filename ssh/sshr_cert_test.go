@@ -0,0 +1,150 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestUserCert returns a signer for a user certificate of the ed25519
+// test key, signed by the ecdsa test key.
+func newTestUserCert(t *testing.T, modify func(*Certificate)) Signer {
+	cert := &Certificate{
+		Key:             testPublicKeys["ed25519"],
+		CertType:        UserCert,
+		ValidPrincipals: []string{"testuser"},
+		ValidBefore:     CertTimeInfinity,
+	}
+	if modify != nil {
+		modify(cert)
+	}
+	if err := cert.SignCert(rand.Reader, testSigners["ecdsa"]); err != nil {
+		t.Fatalf("SignCert: %v", err)
+	}
+	signer, err := NewCertSigner(cert, testSigners["ed25519"])
+	if err != nil {
+		t.Fatalf("NewCertSigner: %v", err)
+	}
+	return signer
+}
+
+func TestProxyUserCert(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.TrustedUserCAs = []PublicKey{testPublicKeys["ecdsa"]}
+
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(newTestUserCert(t, nil))},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+	if got := runHello(t, client); got != "hello" {
+		t.Errorf("got output %q, want %q", got, "hello")
+	}
+}
+
+func TestProxyUserCertRejected(t *testing.T) {
+	past := uint64(time.Now().Add(-time.Hour).Unix())
+	for name, modify := range map[string]func(*Certificate){
+		"principal":     func(c *Certificate) { c.ValidPrincipals = []string{"root"} },
+		"no principals": func(c *Certificate) { c.ValidPrincipals = nil },
+		"expired":       func(c *Certificate) { c.ValidBefore = past },
+		"host":          func(c *Certificate) { c.CertType = HostCert },
+		"source": func(c *Certificate) {
+			c.CriticalOptions = map[string]string{sourceAddressCriticalOption: "192.0.2.0/24"}
+		},
+		"option": func(c *Certificate) {
+			c.CriticalOptions = map[string]string{"force-command": "true"}
+		},
+	} {
+		proxyConf := newTestProxyConfig()
+		proxyConf.TrustedUserCAs = []PublicKey{testPublicKeys["ecdsa"]}
+		if _, _, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+			User: "testuser",
+			Auth: []AuthMethod{PublicKeys(newTestUserCert(t, modify))},
+		}); err == nil {
+			t.Errorf("%s: login succeeded", name)
+		}
+	}
+
+	proxyConf := newTestProxyConfig()
+	proxyConf.TrustedUserCAs = []PublicKey{testPublicKeys["rsa"]}
+	if _, _, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(newTestUserCert(t, nil))},
+	}); err == nil {
+		t.Error("untrusted CA: login succeeded")
+	}
+}
+
+func TestProxyCertUserHook(t *testing.T) {
+	var upstreamUser string
+	upstreamConf := newTestUpstreamConfig()
+	upstreamConf.AuthLogCallback = func(conn ConnMetadata, method string, err error) {
+		upstreamUser = conn.User()
+	}
+	proxyConf := newTestProxyConfig()
+	proxyConf.TrustedUserCAs = []PublicKey{testPublicKeys["ecdsa"]}
+	proxyConf.CertUserHook = func(username string, cert *Certificate) (string, error) {
+		return cert.KeyId, nil
+	}
+
+	client, res, err := dialTestProxy(t, proxyConf, upstreamConf, &ClientConfig{
+		User: "alice",
+		Auth: []AuthMethod{PublicKeys(newTestUserCert(t, func(c *Certificate) {
+			c.KeyId = "testuser"
+			c.ValidPrincipals = []string{"alice"}
+		}))},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	client.Close()
+	if upstreamUser != "testuser" {
+		t.Errorf("upstream user %q, want %q", upstreamUser, "testuser")
+	}
+}
+
+func TestProxyUserCertRestrictions(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		extensions map[string]string
+		restricted bool
+	}{
+		{"no extensions", nil, true},
+		{"permit-port-forwarding", map[string]string{"permit-port-forwarding": ""}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			proxyConf := newTestProxyConfig()
+			proxyConf.TrustedUserCAs = []PublicKey{testPublicKeys["ecdsa"]}
+			client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+				User: "testuser",
+				Auth: []AuthMethod{PublicKeys(newTestUserCert(t, func(c *Certificate) { c.Extensions = tc.extensions }))},
+			})
+			if err != nil {
+				t.Fatalf("client: %v, proxy: %v", err, res.err)
+			}
+			defer client.Close()
+
+			_, err = client.Dial("tcp", "192.0.2.1:80")
+			if restricted := err != nil && strings.Contains(err.Error(), "restricted"); restricted != tc.restricted {
+				t.Errorf("direct-tcpip: got error %v, want restricted %v", err, tc.restricted)
+			}
+		})
+	}
+}
+
+func TestCertRestrictionsMerge(t *testing.T) {
+	cert := &Certificate{Permissions: Permissions{Extensions: map[string]string{
+		"permit-pty":              "",
+		"permit-agent-forwarding": "",
+	}}}
+	opts := keyRestrictions{noPty: true}
+	want := keyRestrictions{noPortForwarding: true, noX11Forwarding: true, noPty: true}
+	if got := opts.merge(certRestrictions(cert)); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
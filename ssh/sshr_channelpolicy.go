@@ -0,0 +1,169 @@
+package ssh
+
+import (
+	"bytes"
+)
+
+// ChannelOpen describes a channel being opened through the proxy. A
+// ChannelPolicy may change Host, Port, OriginHost, OriginPort and ExtraData
+// before the request is forwarded.
+type ChannelOpen struct {
+	// Type is the channel type, such as "session", "direct-tcpip" or
+	// "forwarded-tcpip".
+	Type string
+	// FromUpstream is set for channels opened by the upstream, such as
+	// forwarded-tcpip and auth-agent@openssh.com.
+	FromUpstream bool
+
+	// For direct-tcpip channels, Host and Port are the destination the
+	// client asks the upstream to connect to; for forwarded-tcpip
+	// channels, the address of the remote forward that accepted the
+	// connection. OriginHost and OriginPort are the source of the
+	// connection in both cases.
+	Host       string
+	Port       uint32
+	OriginHost string
+	OriginPort uint32
+
+	// ExtraData is the type specific data of channels of other types.
+	ExtraData []byte
+}
+
+// ChannelRequest describes a request on a channel opened through the
+// proxy, such as "exec" or "env". A ChannelPolicy may change Type and
+// Payload before the request is forwarded.
+type ChannelRequest struct {
+	// ChannelType is the type of the channel, or "" if it is not known.
+	ChannelType string
+	// FromUpstream is set for requests the upstream sends, such as
+	// "exit-status".
+	FromUpstream bool
+
+	Type      string
+	WantReply bool
+	Payload   []byte
+}
+
+// execPayload is the payload of "exec" and "subsystem" requests.
+type execPayload struct {
+	Command string
+}
+
+// Command returns the command of an "exec" request or the name of a
+// "subsystem" request.
+func (r *ChannelRequest) Command() (string, bool) {
+	var msg execPayload
+	if r.Type != "exec" && r.Type != "subsystem" || Unmarshal(r.Payload, &msg) != nil {
+		return "", false
+	}
+	return msg.Command, true
+}
+
+// SetCommand replaces the command of an "exec" request or the name of a
+// "subsystem" request.
+func (r *ChannelRequest) SetCommand(command string) {
+	r.Payload = Marshal(&execPayload{command})
+}
+
+// ChannelPolicy inspects the channels of proxied sessions. Its callbacks
+// allow what they return nil for and refuse the rest, with the error
+// message for refused channels; they may also modify the request. Without
+// a ChannelPolicy, packets are relayed without being decoded.
+type ChannelPolicy struct {
+	// Open is called for every channel being opened by either side.
+	Open func(p *ProxyConn, open *ChannelOpen) error
+	// Request is called for every channel request sent by either side.
+	Request func(p *ProxyConn, req *ChannelRequest) error
+}
+
+// tcpipOpenData is the type specific data of direct-tcpip and
+// forwarded-tcpip channels.
+type tcpipOpenData struct {
+	Host       string
+	Port       uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+// applyChannelPolicy passes channel opens and requests relayed in direction
+// dir to the ChannelPolicy. A refused one is answered in place of the peer.
+// It returns the packet to forward, which the policy may have rewritten, or
+// nil if the packet was consumed.
+func (p *ProxyConn) applyChannelPolicy(dir relayDirection, packet []byte) []byte {
+	policy := p.config.ChannelPolicy
+	sender := p.Downstream.transport
+	if dir == toDownstream {
+		sender = p.Upstream.transport
+	}
+
+	switch packet[0] {
+	case msgChannelOpen:
+		var msg channelOpenMsg
+		if policy.Open == nil || Unmarshal(packet, &msg) != nil {
+			return packet
+		}
+		open := &ChannelOpen{Type: msg.ChanType, FromUpstream: dir == toDownstream}
+		var data tcpipOpenData
+		isTCPIP := (msg.ChanType == "direct-tcpip" || msg.ChanType == "forwarded-tcpip") && Unmarshal(msg.TypeSpecificData, &data) == nil
+		if isTCPIP {
+			open.Host, open.Port, open.OriginHost, open.OriginPort = data.Host, data.Port, data.OriginHost, data.OriginPort
+		} else {
+			open.ExtraData = append([]byte(nil), msg.TypeSpecificData...)
+		}
+		if err := policy.Open(p, open); err != nil {
+			sender.writePacket(Marshal(&channelOpenFailureMsg{
+				PeersID: msg.PeersID,
+				Reason:  Prohibited,
+				Message: err.Error(),
+			}))
+			return nil
+		}
+		extra := open.ExtraData
+		if isTCPIP {
+			extra = Marshal(&tcpipOpenData{open.Host, open.Port, open.OriginHost, open.OriginPort})
+		}
+		if bytes.Equal(extra, msg.TypeSpecificData) {
+			return packet
+		}
+		msg.TypeSpecificData = extra
+		return Marshal(&msg)
+
+	case msgChannelRequest:
+		var msg channelRequestMsg
+		if policy.Request == nil || Unmarshal(packet, &msg) != nil {
+			return packet
+		}
+		p.channels.mu.Lock()
+		ch := p.channels.byUpstream[msg.PeersID]
+		if dir == toDownstream {
+			ch = p.channels.byDownstream[msg.PeersID]
+		}
+		p.channels.mu.Unlock()
+		req := &ChannelRequest{
+			FromUpstream: dir == toDownstream,
+			Type:         msg.Request,
+			WantReply:    msg.WantReply,
+			Payload:      append([]byte(nil), msg.RequestSpecificData...),
+		}
+		if ch != nil {
+			req.ChannelType = ch.chanType
+		}
+		if err := policy.Request(p, req); err != nil {
+			if msg.WantReply && ch != nil {
+				// The failure goes to the sender's end of the channel.
+				id := ch.downstreamID
+				if dir == toDownstream {
+					id = ch.upstreamID
+				}
+				sender.writePacket(Marshal(&channelRequestFailureMsg{PeersID: id}))
+			}
+			return nil
+		}
+		if req.Type == msg.Request && bytes.Equal(req.Payload, msg.RequestSpecificData) {
+			return packet
+		}
+		msg.Request, msg.RequestSpecificData = req.Type, req.Payload
+		return Marshal(&msg)
+	}
+	return packet
+}
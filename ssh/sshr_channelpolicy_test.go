@@ -0,0 +1,118 @@
+package ssh
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProxyChannelPolicyRequest(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	proxyConf := newTestProxyConfig()
+	proxyConf.DestinationPort = 22
+	proxyConf.FindUpstreamHook = func(username string) (string, error) {
+		return "upstream", nil
+	}
+	proxyConf.ChannelPolicy = &ChannelPolicy{
+		Request: func(p *ProxyConn, req *ChannelRequest) error {
+			mu.Lock()
+			requests = append(requests, req.ChannelType+":"+req.Type)
+			mu.Unlock()
+			if cmd, ok := req.Command(); ok && strings.HasPrefix(cmd, "rm ") {
+				return errors.New("denied")
+			}
+			return nil
+		},
+	}
+	s, addr, _ := newTestProxyServer(t, proxyConf)
+	defer s.Close()
+	client, err := dialTestProxyServer(addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	if out := runHello(t, client); out != "hello" {
+		t.Errorf("got %q from an allowed exec", out)
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+	if err := session.Start("rm -rf /"); err == nil {
+		t.Error("denied exec request succeeded")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"session:exec", "session:exit-status", "session:exec"}
+	if strings.Join(requests, " ") != strings.Join(want, " ") {
+		t.Errorf("policy saw %v, want %v", requests, want)
+	}
+}
+
+func TestProxyChannelPolicyOpen(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.DestinationPort = 22
+	proxyConf.FindUpstreamHook = func(username string) (string, error) {
+		return "upstream", nil
+	}
+	proxyConf.ChannelPolicy = &ChannelPolicy{
+		Open: func(p *ProxyConn, open *ChannelOpen) error {
+			if open.Type != "direct-tcpip" || open.FromUpstream {
+				return nil
+			}
+			if open.Host == "forbidden.internal" {
+				return errors.New("destination not allowed")
+			}
+			open.Host = "rewritten.internal"
+			return nil
+		},
+	}
+
+	// The upstream reports the destinations it is asked to connect to.
+	opened := make(chan tcpipOpenData, 2)
+	upstreamConf := newTestUpstreamConfig()
+	_, addr := serveTestProxy(t, proxyConf, func(c net.Conn) {
+		_, chans, reqs, err := NewServerConn(c, upstreamConf)
+		if err != nil {
+			return
+		}
+		go DiscardRequests(reqs)
+		for newCh := range chans {
+			var data tcpipOpenData
+			Unmarshal(newCh.ExtraData(), &data)
+			opened <- data
+			newCh.Reject(ConnectionFailed, "no route")
+		}
+	})
+	client, err := dialTestProxyServer(addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	_, err = client.Dial("tcp", "forbidden.internal:80")
+	if err == nil || !strings.Contains(err.Error(), "destination not allowed") {
+		t.Errorf("got %v, want the policy's refusal", err)
+	}
+	if _, err := client.Dial("tcp", "db.internal:5432"); err == nil {
+		t.Error("upstream accepted the channel")
+	}
+	select {
+	case data := <-opened:
+		if data.Host != "rewritten.internal" || data.Port != 5432 {
+			t.Errorf("upstream was asked for %s:%d", data.Host, data.Port)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("channel open not forwarded")
+	}
+	if len(opened) != 0 {
+		t.Error("refused channel open was forwarded")
+	}
+}
@@ -0,0 +1,299 @@
+package ssh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+)
+
+// relayDirection tells in which direction a relayed packet travels.
+type relayDirection int
+
+const (
+	toUpstream relayDirection = iota
+	toDownstream
+)
+
+// proxyChannel is a channel opened through the proxy, as learned from the
+// relayed packets.
+type proxyChannel struct {
+	chanType string
+
+	// The IDs each side chose for its end of the channel. Packets sent to
+	// the upstream carry upstreamID as recipient, and vice versa.
+	downstreamID uint32
+	upstreamID   uint32
+	// The largest data packet each side accepts on the channel.
+	downstreamMaxPacket uint32
+	upstreamMaxPacket   uint32
+
+	// pty is set once the downstream client requested a pty.
+	pty bool
+
+	// injected counts bytes the proxy itself sent to the downstream
+	// client on this channel. Window adjustments the client sends for them
+	// must not reach the upstream, which never sent those bytes.
+	// injectedUp counts the same towards the upstream.
+	injected   uint32
+	injectedUp uint32
+
+	// recording is the recording of an interactive session, if any.
+	recording *channelRecording
+	// sftp and scp inspect the session if it runs the sftp subsystem or
+	// scp.
+	sftp *sftpRelay
+	scp  *scpRelay
+}
+
+// channelTable tracks the channels of a ProxyConn without otherwise
+// interfering with the relayed packets.
+type channelTable struct {
+	mu sync.Mutex
+
+	// pendingDown and pendingUp hold channels waiting for confirmation,
+	// keyed by the ID chosen by the side that opened them.
+	pendingDown map[uint32]*proxyChannel
+	pendingUp   map[uint32]*proxyChannel
+
+	byDownstream map[uint32]*proxyChannel
+	byUpstream   map[uint32]*proxyChannel
+}
+
+func (t *channelTable) init() {
+	if t.byDownstream == nil {
+		t.pendingDown = make(map[uint32]*proxyChannel)
+		t.pendingUp = make(map[uint32]*proxyChannel)
+		t.byDownstream = make(map[uint32]*proxyChannel)
+		t.byUpstream = make(map[uint32]*proxyChannel)
+	}
+}
+
+// recipient returns the recipient channel ID of a channel message.
+func recipient(packet []byte) (uint32, bool) {
+	if len(packet) < 5 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(packet[1:5]), true
+}
+
+// observe updates the table with a packet relayed in direction dir.
+func (t *channelTable) observe(dir relayDirection, packet []byte) {
+	if len(packet) == 0 || packet[0] < msgChannelOpen || packet[0] > msgChannelFailure {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.init()
+
+	switch packet[0] {
+	case msgChannelOpen:
+		var msg channelOpenMsg
+		if err := Unmarshal(packet, &msg); err != nil {
+			return
+		}
+		ch := &proxyChannel{chanType: msg.ChanType}
+		if dir == toUpstream {
+			ch.downstreamID = msg.PeersID
+			ch.downstreamMaxPacket = msg.MaxPacketSize
+			t.pendingDown[msg.PeersID] = ch
+		} else {
+			ch.upstreamID = msg.PeersID
+			ch.upstreamMaxPacket = msg.MaxPacketSize
+			t.pendingUp[msg.PeersID] = ch
+		}
+
+	case msgChannelOpenConfirm:
+		var msg channelOpenConfirmMsg
+		if err := Unmarshal(packet, &msg); err != nil {
+			return
+		}
+		if dir == toDownstream {
+			if ch, ok := t.pendingDown[msg.PeersID]; ok {
+				delete(t.pendingDown, msg.PeersID)
+				ch.upstreamID = msg.MyID
+				ch.upstreamMaxPacket = msg.MaxPacketSize
+				t.add(ch)
+			}
+		} else if ch, ok := t.pendingUp[msg.PeersID]; ok {
+			delete(t.pendingUp, msg.PeersID)
+			ch.downstreamID = msg.MyID
+			ch.downstreamMaxPacket = msg.MaxPacketSize
+			t.add(ch)
+		}
+
+	case msgChannelOpenFailure:
+		id, _ := recipient(packet)
+		if dir == toDownstream {
+			delete(t.pendingDown, id)
+		} else {
+			delete(t.pendingUp, id)
+		}
+
+	case msgChannelRequest:
+		var msg channelRequestMsg
+		if dir != toUpstream || Unmarshal(packet, &msg) != nil {
+			return
+		}
+		if ch, ok := t.byUpstream[msg.PeersID]; ok && msg.Request == "pty-req" {
+			ch.pty = true
+		}
+
+	case msgChannelClose:
+		id, _ := recipient(packet)
+		var ch *proxyChannel
+		if dir == toUpstream {
+			ch = t.byUpstream[id]
+		} else {
+			ch = t.byDownstream[id]
+		}
+		if ch != nil {
+			delete(t.byUpstream, ch.upstreamID)
+			delete(t.byDownstream, ch.downstreamID)
+		}
+	}
+}
+
+// add registers a confirmed channel. t.mu must be held.
+func (t *channelTable) add(ch *proxyChannel) {
+	t.byDownstream[ch.downstreamID] = ch
+	t.byUpstream[ch.upstreamID] = ch
+}
+
+// downstreamUses reports whether the downstream client has a channel with
+// the given ID open or being opened.
+func (t *channelTable) downstreamUses(id uint32) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, pending := t.pendingDown[id]
+	_, open := t.byDownstream[id]
+	return pending || open
+}
+
+// interactive returns an open session channel with a pty, or nil.
+func (t *channelTable) interactive() *proxyChannel {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, ch := range t.byDownstream {
+		if ch.chanType == "session" && ch.pty {
+			return ch
+		}
+	}
+	return nil
+}
+
+// idle reports whether no channel is open or being opened.
+func (t *channelTable) idle() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.byDownstream) == 0 && len(t.pendingDown) == 0 && len(t.pendingUp) == 0
+}
+
+// withholdAdjust rewrites a window adjustment relayed in direction dir so
+// that it does not cover bytes injected by the proxy. It reports whether
+// anything remains to be forwarded.
+func (t *channelTable) withholdAdjust(dir relayDirection, packet []byte) bool {
+	var msg windowAdjustMsg
+	if err := Unmarshal(packet, &msg); err != nil {
+		return true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ch, ok := t.byUpstream[msg.PeersID]
+	if dir == toDownstream {
+		ch, ok = t.byDownstream[msg.PeersID]
+	}
+	if !ok {
+		return true
+	}
+	injected := &ch.injected
+	if dir == toDownstream {
+		injected = &ch.injectedUp
+	}
+	if *injected == 0 {
+		return true
+	}
+	if msg.AdditionalBytes <= *injected {
+		*injected -= msg.AdditionalBytes
+		return false
+	}
+	binary.BigEndian.PutUint32(packet[5:9], msg.AdditionalBytes-*injected)
+	*injected = 0
+	return true
+}
+
+// writeToChannel sends data to the downstream end of ch as if it came from
+// the upstream.
+func (p *ProxyConn) writeToChannel(ch *proxyChannel, data []byte) error {
+	p.channels.mu.Lock()
+	ch.injected += uint32(len(data))
+	p.channels.mu.Unlock()
+
+	return p.Downstream.transport.writePacket(Marshal(&channelDataMsg{
+		PeersID: ch.downstreamID,
+		Length:  uint32(len(data)),
+		Rest:    data,
+	}))
+}
+
+// writeToUpstream sends data to the upstream end of ch as if it came from
+// the downstream client.
+func (p *ProxyConn) writeToUpstream(ch *proxyChannel, data []byte) error {
+	p.channels.mu.Lock()
+	ch.injectedUp += uint32(len(data))
+	p.channels.mu.Unlock()
+
+	return p.Upstream.transport.writePacket(Marshal(&channelDataMsg{
+		PeersID: ch.upstreamID,
+		Length:  uint32(len(data)),
+		Rest:    data,
+	}))
+}
+
+// rewriteData returns the packet to forward for a channel data packet of ch
+// relayed in direction dir whose data in is replaced by out. The window of
+// bytes that are dropped is returned to the sender, and bytes that are
+// added count as injected. Data beyond the largest packet the receiver
+// accepts is sent ahead in separate packets. It returns nil if there is
+// nothing left to forward.
+func (p *ProxyConn) rewriteData(dir relayDirection, ch *proxyChannel, packet, in, out []byte) ([]byte, error) {
+	if bytes.Equal(in, out) {
+		return packet, nil
+	}
+	sender, receiver := p.Downstream.transport, p.Upstream.transport
+	senderID, receiverID, limit := ch.downstreamID, ch.upstreamID, int(ch.upstreamMaxPacket)
+	injected := &ch.injectedUp
+	if dir == toDownstream {
+		sender, receiver = receiver, sender
+		senderID, receiverID, limit = ch.upstreamID, ch.downstreamID, int(ch.downstreamMaxPacket)
+		injected = &ch.injected
+	}
+	if len(out) < len(in) {
+		// The receiver never sees these bytes, so the window they took up
+		// is returned to the sender here.
+		if err := sender.writePacket(Marshal(&windowAdjustMsg{
+			PeersID:         senderID,
+			AdditionalBytes: uint32(len(in) - len(out)),
+		})); err != nil {
+			return nil, err
+		}
+	} else {
+		p.channels.mu.Lock()
+		*injected += uint32(len(out) - len(in))
+		p.channels.mu.Unlock()
+	}
+	if len(out) == 0 {
+		return nil, nil
+	}
+	if limit <= 0 {
+		limit = len(in)
+	}
+	for len(out) > limit {
+		if err := receiver.writePacket(Marshal(&channelDataMsg{PeersID: receiverID, Length: uint32(limit), Rest: out[:limit]})); err != nil {
+			return nil, err
+		}
+		out = out[limit:]
+	}
+	return Marshal(&channelDataMsg{PeersID: receiverID, Length: uint32(len(out)), Rest: out}), nil
+}
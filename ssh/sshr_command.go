@@ -0,0 +1,51 @@
+package ssh
+
+// CommandRequest is an "exec" or "subsystem" request passed to
+// ProxyConfig.CommandHook.
+type CommandRequest struct {
+	User     string
+	Upstream string
+	// Subsystem is set for subsystem requests, whose name is in Command.
+	Subsystem bool
+	// Command is the command to run. The hook may change it.
+	Command string
+}
+
+// filterCommand passes the exec and subsystem requests of the downstream
+// client to the CommandHook and reports them as AuditCommand events. It
+// returns the packet to forward, with the command as rewritten by the hook,
+// or nil if the request was refused and answered in place of the upstream.
+func (p *ProxyConn) filterCommand(dir relayDirection, packet []byte) []byte {
+	if dir != toUpstream || packet[0] != msgChannelRequest {
+		return packet
+	}
+	var msg channelRequestMsg
+	if Unmarshal(packet, &msg) != nil || msg.Request != "exec" && msg.Request != "subsystem" {
+		return packet
+	}
+	var payload execPayload
+	if Unmarshal(msg.RequestSpecificData, &payload) != nil {
+		return packet
+	}
+	req := &CommandRequest{
+		User:      p.User,
+		Upstream:  p.DestinationHost,
+		Subsystem: msg.Request == "subsystem",
+		Command:   payload.Command,
+	}
+	var err error
+	if p.config.CommandHook != nil {
+		err = p.config.CommandHook(req)
+	}
+	p.audit(AuditEvent{Type: AuditCommand, Command: req.Command, Err: err})
+	if err != nil {
+		p.log(LogInfo, "command refused", "command", payload.Command, "error", err)
+		p.failRequest(&msg)
+		return nil
+	}
+	if req.Command == payload.Command {
+		return packet
+	}
+	msg.RequestSpecificData = Marshal(&execPayload{req.Command})
+	return Marshal(&msg)
+}
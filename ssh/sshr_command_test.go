@@ -0,0 +1,103 @@
+package ssh
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyCommandHook(t *testing.T) {
+	events := make(chan AuditEvent, 10)
+	proxyConf := newTestProxyConfig()
+	proxyConf.DestinationPort = 22
+	proxyConf.FindUpstreamHook = func(username string) (string, error) {
+		return "backup.internal", nil
+	}
+	proxyConf.AuditCallback = func(ev AuditEvent) {
+		if ev.Type == AuditCommand {
+			events <- ev
+		}
+	}
+	proxyConf.CommandHook = func(req *CommandRequest) error {
+		if req.User != "testuser" || req.Upstream != "backup.internal" {
+			return errors.New("unexpected request")
+		}
+		if !strings.HasPrefix(req.Command, "rsync --server ") {
+			return errors.New("only rsync is allowed")
+		}
+		req.Command = strings.Replace(req.Command, " --delete", "", 1)
+		return nil
+	}
+
+	// The upstream echoes the commands it runs.
+	upstreamConf := newTestUpstreamConfig()
+	_, addr := serveTestProxy(t, proxyConf, func(c net.Conn) {
+		_, chans, reqs, err := NewServerConn(c, upstreamConf)
+		if err != nil {
+			return
+		}
+		go DiscardRequests(reqs)
+		for newCh := range chans {
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer ch.Close()
+				for req := range reqs {
+					var cmd execPayload
+					if req.Type != "exec" || Unmarshal(req.Payload, &cmd) != nil {
+						req.Reply(false, nil)
+						continue
+					}
+					req.Reply(true, nil)
+					ch.Write([]byte(cmd.Command))
+					ch.SendRequest("exit-status", false, Marshal(exitStatusMsg{0}))
+					return
+				}
+			}()
+		}
+	})
+	client, err := dialTestProxyServer(addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	out, err := session.Output("rsync --server --delete . /backup")
+	if err != nil {
+		t.Fatalf("rsync: %v", err)
+	}
+	if want := "rsync --server . /backup"; string(out) != want {
+		t.Errorf("upstream ran %q, want %q", out, want)
+	}
+
+	session, err = client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	if err := session.Start("rm -rf /backup"); err == nil {
+		t.Error("refused command started")
+	}
+	session.Close()
+
+	for _, want := range []struct {
+		command string
+		refused bool
+	}{{"rsync --server . /backup", false}, {"rm -rf /backup", true}} {
+		select {
+		case ev := <-events:
+			if ev.Command != want.command || (ev.Err != nil) != want.refused || ev.User != "testuser" {
+				t.Errorf("got event %+v, want command %q refused %v", ev, want.command, want.refused)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no audit event for %q", want.command)
+		}
+	}
+}
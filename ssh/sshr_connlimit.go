@@ -0,0 +1,123 @@
+package ssh
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrTooManyConnections is passed to ProxyServer.ErrorHook for connections
+// refused by MaxConns, MaxConnsPerSourceIP or MaxConnsPerUser.
+var ErrTooManyConnections = errors.New("ssh: too many connections")
+
+// refuseTimeout bounds the handshake with a refused client, which only
+// serves to tell it why it is disconnected.
+const refuseTimeout = 10 * time.Second
+
+// connLimits counts the connections admitted by a ProxyServer.
+type connLimits struct {
+	total   int
+	perIP   map[string]int
+	perUser map[string]int
+	// users holds the user each connection counts against.
+	users map[net.Conn]string
+}
+
+// sourceIP returns the host part of the remote address of c.
+func sourceIP(c net.Conn) string {
+	addr := c.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// admit counts c against MaxConns and MaxConnsPerSourceIP. It reports false,
+// without counting c, if either limit is reached.
+func (s *ProxyServer) admit(c net.Conn) bool {
+	ip := sourceIP(c)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := &s.limits
+	if s.MaxConns > 0 && l.total >= s.MaxConns {
+		return false
+	}
+	if s.MaxConnsPerSourceIP > 0 && l.perIP[ip] >= s.MaxConnsPerSourceIP {
+		return false
+	}
+	if l.perIP == nil {
+		l.perIP = make(map[string]int)
+	}
+	l.total++
+	l.perIP[ip]++
+	return true
+}
+
+// admitUser counts the admitted connection c against MaxConnsPerUser. It
+// reports false, without counting c, if the limit is reached.
+func (s *ProxyServer) admitUser(c net.Conn, user string) bool {
+	if s.MaxConnsPerUser <= 0 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := &s.limits
+	if l.perUser[user] >= s.MaxConnsPerUser {
+		return false
+	}
+	if l.perUser == nil {
+		l.perUser = make(map[string]int)
+		l.users = make(map[net.Conn]string)
+	}
+	l.perUser[user]++
+	l.users[c] = user
+	return true
+}
+
+// release uncounts the admitted connection c.
+func (s *ProxyServer) release(c net.Conn) {
+	ip := sourceIP(c)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := &s.limits
+	l.total--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+	if user, ok := l.users[c]; ok {
+		delete(l.users, c)
+		if l.perUser[user]--; l.perUser[user] <= 0 {
+			delete(l.perUser, user)
+		}
+	}
+}
+
+// refuse tells the client on c that there are too many connections, within
+// refuseTimeout, and closes c.
+func (s *ProxyServer) refuse(c net.Conn) {
+	conf := s.config()
+	if !s.allowed(conf, c) {
+		return
+	}
+	timeout := refuseTimeout
+	if s.HandshakeTimeout > 0 && s.HandshakeTimeout < timeout {
+		timeout = s.HandshakeTimeout
+	}
+	c.SetDeadline(time.Now().Add(timeout))
+	downstream, err := NewDownstreamConn(c, conf.ServerConfig)
+	if err == nil {
+		disconnectTooMany(downstream)
+	}
+	c.Close()
+	s.fail(conf, c, ErrTooManyConnections)
+}
+
+// disconnectTooMany sends the downstream a disconnect message for
+// ErrTooManyConnections and closes it.
+func disconnectTooMany(downstream *connection) {
+	downstream.transport.writePacket(Marshal(&disconnectMsg{
+		Reason:  disconnectTooManyConnections,
+		Message: "too many connections",
+	}))
+	downstream.transport.Close()
+}
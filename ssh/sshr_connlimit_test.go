@@ -0,0 +1,67 @@
+package ssh
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyServerMaxConns(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		set  func(s *ProxyServer)
+	}{
+		{"total", func(s *ProxyServer) { s.MaxConns = 1 }},
+		{"per source IP", func(s *ProxyServer) { s.MaxConnsPerSourceIP = 1 }},
+		{"per user", func(s *ProxyServer) { s.MaxConnsPerUser = 1 }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			proxyConf := newTestProxyConfig()
+			proxyConf.FindUpstreamHook = func(username string) (string, error) { return "upstream", nil }
+			s := &ProxyServer{
+				Config: proxyConf,
+				Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					u1, u2, err := netPipe()
+					if err != nil {
+						return nil, err
+					}
+					go serveTestUpstream(u1, newTestUpstreamConfig())
+					return u2, nil
+				},
+			}
+			tc.set(s)
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go s.Serve(l)
+			defer s.Close()
+			addr := l.Addr().String()
+
+			client, err := dialTestProxyServer(addr)
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			_, err = dialTestProxyServer(addr)
+			if err == nil || !strings.Contains(err.Error(), "too many connections") {
+				t.Errorf("second connection: got %v, want too many connections", err)
+			}
+
+			// The slot is free again once the first connection ends.
+			client.Close()
+			for i := 0; ; i++ {
+				client, err = dialTestProxyServer(addr)
+				if err == nil {
+					client.Close()
+					break
+				}
+				if i == 100 {
+					t.Fatalf("Dial after close: %v", err)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package ssh
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// upstreamDialer returns the function that dials the upstream of route,
+// or its first jump host, with the dial options of s.
+func (s *ProxyServer) upstreamDialer(route *UpstreamRoute) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dial := s.Dial
+	if dial == nil && route.Dialer != nil {
+		dial = route.Dialer.DialContext
+	}
+	if dial == nil {
+		dial = (&net.Dialer{KeepAlive: s.UpstreamKeepAlive}).DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		backoff := s.DialBackoff
+		if backoff <= 0 {
+			backoff = 100 * time.Millisecond
+		}
+		for retry := 0; ; retry++ {
+			attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+			if s.DialTimeout > 0 {
+				attemptCtx, cancel = context.WithTimeout(ctx, s.DialTimeout)
+			}
+			c, err := dial(attemptCtx, network, addr)
+			cancel()
+			if err == nil {
+				s.setTCPOptions(c)
+				return c, nil
+			}
+			if retry >= s.DialRetries || ctx.Err() != nil {
+				return nil, err
+			}
+			t := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return nil, err
+			case <-t.C:
+			}
+			backoff *= 2
+		}
+	}
+}
+
+// setTCPOptions applies the TCP options of s to an upstream connection.
+func (s *ProxyServer) setTCPOptions(c net.Conn) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if s.UpstreamKeepAlive > 0 {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(s.UpstreamKeepAlive)
+	} else if s.UpstreamKeepAlive < 0 {
+		tc.SetKeepAlive(false)
+	}
+	if s.UpstreamNagle {
+		tc.SetNoDelay(false)
+	}
+}
@@ -0,0 +1,88 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUpstreamDialRetries(t *testing.T) {
+	failures := 2
+	attempts := 0
+	s := &ProxyServer{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			attempts++
+			if attempts <= failures {
+				return nil, errors.New("connection refused")
+			}
+			c1, c2 := net.Pipe()
+			c1.Close()
+			return c2, nil
+		},
+		DialRetries: 2,
+		DialBackoff: time.Millisecond,
+	}
+	route := &UpstreamRoute{Host: "upstream", Port: 22}
+	c, err := s.upstreamDialer(route)(context.Background(), "tcp", route.Address())
+	if err != nil {
+		t.Fatalf("dial after %d attempts: %v", attempts, err)
+	}
+	c.Close()
+
+	attempts, failures = 0, 3
+	if _, err := s.upstreamDialer(route)(context.Background(), "tcp", route.Address()); err == nil || attempts != 3 {
+		t.Errorf("got %v after %d attempts, want an error after 3", err, attempts)
+	}
+}
+
+func TestUpstreamDialTimeout(t *testing.T) {
+	attempts := 0
+	s := &ProxyServer{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			attempts++
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+		DialTimeout: 10 * time.Millisecond,
+		DialRetries: 1,
+		DialBackoff: time.Millisecond,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	route := &UpstreamRoute{Host: "upstream", Port: 22}
+	if _, err := s.upstreamDialer(route)(ctx, "tcp", route.Address()); err == nil || attempts != 2 {
+		t.Errorf("got %v after %d attempts, want a timeout after 2", err, attempts)
+	}
+}
+
+func TestProxyServerHungUpstream(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.FindUpstreamHook = func(username string) (string, error) { return "upstream", nil }
+	s := &ProxyServer{
+		Config: proxyConf,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			// The upstream accepts, but never speaks.
+			_, c2, err := netPipe()
+			return c2, err
+		},
+		HandshakeTimeout:       time.Minute,
+		UpstreamAttemptTimeout: 100 * time.Millisecond,
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	start := time.Now()
+	if client, err := dialTestProxyServer(l.Addr().String()); err == nil {
+		client.Close()
+		t.Fatal("logged in to a hung upstream")
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("login failed after %v", d)
+	}
+}
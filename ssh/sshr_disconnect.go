@@ -0,0 +1,51 @@
+package ssh
+
+import "errors"
+
+// DisconnectMessage is what a refused downstream client is told. A zero
+// DisconnectMessage sends nothing.
+type DisconnectMessage struct {
+	// Banner, if set, is shown to the user before the disconnect, as by
+	// the Banner of OpenSSH's sshd.
+	Banner string
+	// Reason is a disconnect reason code of RFC 4253, section 11.1, and
+	// Message its description. ssh clients print both.
+	Reason  uint32
+	Message string
+}
+
+// DefaultDisconnectMessage describes errors that match ErrNoUpstream,
+// ErrUpstreamUnreachable, ErrHostKeyMismatch and ErrAuthRejected to users
+// without revealing details. Other errors get a zero DisconnectMessage.
+func DefaultDisconnectMessage(err error) DisconnectMessage {
+	switch {
+	case errors.Is(err, ErrNoUpstream):
+		return DisconnectMessage{Reason: disconnectNoMoreAuthMethodsAvailable, Message: "no such user"}
+	case errors.Is(err, ErrUpstreamUnreachable):
+		return DisconnectMessage{Reason: disconnectServiceNotAvailable, Message: "upstream host unavailable, try again later"}
+	case errors.Is(err, ErrHostKeyMismatch):
+		return DisconnectMessage{Reason: disconnectServiceNotAvailable, Message: "upstream host could not be verified"}
+	case errors.Is(err, ErrAuthRejected):
+		return DisconnectMessage{Reason: disconnectNoMoreAuthMethodsAvailable, Message: "authentication failed"}
+	}
+	return DisconnectMessage{}
+}
+
+// refuse sends downstream the message conf.DisconnectHook maps err to. The
+// downstream has requested the userauth service, so a banner may be sent.
+func (conf *ProxyConfig) refuse(downstream *connection, err error) {
+	if conf.DisconnectHook == nil {
+		return
+	}
+	m := conf.DisconnectHook(err)
+	if m.Banner != "" {
+		downstream.transport.writePacket(Marshal(&userAuthBannerMsg{Message: m.Banner}))
+	}
+	if m.Message != "" || m.Reason != 0 {
+		reason := m.Reason
+		if reason == 0 {
+			reason = disconnectByApplication
+		}
+		downstream.transport.writePacket(Marshal(&disconnectMsg{Reason: reason, Message: m.Message}))
+	}
+}
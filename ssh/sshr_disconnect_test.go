@@ -0,0 +1,59 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestProxyServerDisconnectHook(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.FindUpstreamHook = func(username string) (string, error) {
+		if username != "testuser" {
+			return "", errors.New("unknown user")
+		}
+		return "upstream", nil
+	}
+	proxyConf.DisconnectHook = func(err error) DisconnectMessage {
+		m := DefaultDisconnectMessage(err)
+		if errors.Is(err, ErrUpstreamUnreachable) {
+			m.Banner = "db is down for maintenance\r\n"
+		}
+		return m
+	}
+	s := &ProxyServer{
+		Config: proxyConf,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+		},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	for _, tc := range []struct {
+		user, banner, message string
+	}{
+		{"nobody", "", "no such user"},
+		{"testuser", "db is down for maintenance\r\n", "upstream host unavailable"},
+	} {
+		var banner string
+		_, err := Dial("tcp", l.Addr().String(), &ClientConfig{
+			User:            tc.user,
+			Auth:            []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+			HostKeyCallback: InsecureIgnoreHostKey(),
+			BannerCallback:  func(message string) error { banner = message; return nil },
+		})
+		if err == nil || !strings.Contains(err.Error(), tc.message) {
+			t.Errorf("%s: got %v, want a disconnect with %q", tc.user, err, tc.message)
+		}
+		if banner != tc.banner {
+			t.Errorf("%s: got banner %q, want %q", tc.user, banner, tc.banner)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DoctorStatus is the outcome of a DoctorCheck.
+type DoctorStatus int
+
+const (
+	DoctorOK DoctorStatus = iota
+	DoctorWarning
+	DoctorFailed
+	// DoctorSkipped is used for checks that do not apply to the
+	// configuration or depend on a failed check.
+	DoctorSkipped
+)
+
+func (s DoctorStatus) String() string {
+	switch s {
+	case DoctorOK:
+		return "ok"
+	case DoctorWarning:
+		return "warning"
+	case DoctorFailed:
+		return "failed"
+	case DoctorSkipped:
+		return "skipped"
+	}
+	return "DoctorStatus(" + strconv.Itoa(int(s)) + ")"
+}
+
+// DoctorCheck is the result of one self-test.
+type DoctorCheck struct {
+	Name    string
+	Status  DoctorStatus
+	Details []string
+}
+
+// DoctorReport lists the results of Doctor.
+type DoctorReport struct {
+	Checks []DoctorCheck
+}
+
+// OK reports whether no check failed.
+func (r *DoctorReport) OK() bool {
+	for _, c := range r.Checks {
+		if c.Status == DoctorFailed {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *DoctorReport) String() string {
+	var b strings.Builder
+	for _, c := range r.Checks {
+		fmt.Fprintf(&b, "%-16s %s\n", c.Name, c.Status)
+		for _, d := range c.Details {
+			fmt.Fprintf(&b, "    %s\n", d)
+		}
+	}
+	return b.String()
+}
+
+// DoctorConfig configures Doctor.
+type DoctorConfig struct {
+	Proxy *ProxyConfig
+
+	// SampleUser is the user whose hooks are exercised and whose upstream
+	// is dialed.
+	SampleUser string
+
+	// Dial connects to the upstream. If nil, a net.Dialer is used.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// legacyAlgos are supported but should only be enabled for old peers.
+var legacyAlgos = map[string]bool{
+	"arcfour256": true, "arcfour128": true, "arcfour": true,
+	aes128cbcID: true, tripledescbcID: true,
+	kexAlgoDH1SHA1: true, kexAlgoDHGEXSHA1: true,
+	"hmac-sha1-96": true,
+}
+
+// Doctor exercises a proxy configuration before it takes traffic: it checks
+// the host keys and algorithm lists, calls the fetch hooks for the sample
+// user, parses their results and completes a handshake with the user's
+// upstream.
+func Doctor(ctx context.Context, cfg *DoctorConfig) *DoctorReport {
+	d := &doctor{cfg: cfg, conf: cfg.Proxy}
+	d.checkConfig()
+	d.checkAlgorithms()
+	route := d.checkFindUpstream(ctx)
+	d.checkAuthorizedKeys(ctx)
+	d.checkPrivateKey(ctx, route)
+	d.checkUpstream(ctx, route)
+	return &d.report
+}
+
+type doctor struct {
+	cfg    *DoctorConfig
+	conf   *ProxyConfig
+	report DoctorReport
+}
+
+func (d *doctor) add(name string, status DoctorStatus, details ...string) {
+	d.report.Checks = append(d.report.Checks, DoctorCheck{Name: name, Status: status, Details: details})
+}
+
+func (d *doctor) checkConfig() {
+	var problems []string
+	if d.conf.ServerConfig == nil {
+		problems = append(problems, "ServerConfig is not set")
+	} else if len(d.conf.ServerConfig.hostKeys) == 0 && d.conf.ServerConfig.HostKeySelectionHook == nil {
+		problems = append(problems, "ServerConfig has no host keys")
+	}
+	if d.conf.ClientConfig == nil {
+		problems = append(problems, "ClientConfig is not set")
+	} else if d.conf.ClientConfig.HostKeyCallback == nil && d.conf.UpstreamHostKeyCallback == nil {
+		problems = append(problems, "ClientConfig has no HostKeyCallback")
+	}
+	if t := d.conf.VersionTemplate; t != nil {
+		for _, leg := range []string{"downstream", "upstream"} {
+			if _, err := t.Version(leg); err != nil {
+				problems = append(problems, "VersionTemplate: "+err.Error())
+				break
+			}
+		}
+	}
+	if c := d.conf.ServerConfig; c != nil && c.ServerVersion != "" {
+		if err := ValidateVersion(c.ServerVersion); err != nil {
+			problems = append(problems, "ServerVersion: "+err.Error())
+		}
+	}
+	if c := d.conf.ClientConfig; c != nil && c.ClientVersion != "" {
+		if err := ValidateVersion(c.ClientVersion); err != nil {
+			problems = append(problems, "ClientVersion: "+err.Error())
+		}
+	}
+	if d.conf.DestinationPort <= 0 || d.conf.DestinationPort > 65535 {
+		problems = append(problems, fmt.Sprintf("DestinationPort %d is invalid", d.conf.DestinationPort))
+	}
+	if len(problems) > 0 {
+		d.add("config", DoctorFailed, problems...)
+		return
+	}
+	d.add("config", DoctorOK)
+}
+
+// algorithmProblems checks the algorithm lists of c, which are announced to
+// peers on the given side.
+func algorithmProblems(side string, c Config) (failures, warnings []string) {
+	// SetDefaults silently drops unknown ciphers, so the lists are
+	// defaulted here instead.
+	ciphers, kexes, macs := c.Ciphers, c.KeyExchanges, c.MACs
+	if ciphers == nil {
+		ciphers = preferredCiphers
+	}
+	if kexes == nil {
+		kexes = preferredKexAlgos
+	}
+	if macs == nil {
+		macs = supportedMACs
+	}
+
+	// Legacy algorithms are only reported if they were enabled explicitly.
+	check := func(kind string, list []string, explicit bool, known func(string) bool) {
+		if len(list) == 0 {
+			failures = append(failures, fmt.Sprintf("%s: no %s configured", side, kind))
+		}
+		for _, algo := range list {
+			switch {
+			case !known(algo):
+				failures = append(failures, fmt.Sprintf("%s: unsupported %s %q", side, kind, algo))
+			case explicit && legacyAlgos[algo]:
+				warnings = append(warnings, fmt.Sprintf("%s: legacy %s %q enabled", side, kind, algo))
+			}
+		}
+	}
+	check("cipher", ciphers, c.Ciphers != nil, func(a string) bool { return cipherModes[a] != nil })
+	check("key exchange", kexes, c.KeyExchanges != nil, func(a string) bool {
+		_, forbidden := serverForbiddenKexAlgos[a]
+		return kexAlgoMap[a] != nil && !(side == "downstream" && forbidden)
+	})
+	check("MAC", macs, c.MACs != nil, func(a string) bool { return macModes[a] != nil })
+	return failures, warnings
+}
+
+func (d *doctor) checkAlgorithms() {
+	failures, warnings := d.conf.algorithmProblems()
+	switch {
+	case len(failures) > 0:
+		d.add("algorithms", DoctorFailed, append(failures, warnings...)...)
+	case len(warnings) > 0:
+		d.add("algorithms", DoctorWarning, warnings...)
+	default:
+		d.add("algorithms", DoctorOK)
+	}
+}
+
+func (d *doctor) checkFindUpstream(ctx context.Context) *UpstreamRoute {
+	if d.conf.FindUpstreamHook == nil && d.conf.FindUpstreamContextHook == nil && d.conf.RouteUpstreamHook == nil {
+		d.add("find_upstream", DoctorSkipped, "FindUpstreamHook is not set")
+		return nil
+	}
+	route, err := d.conf.RouteUpstream(ctx, HookMetadata{User: d.cfg.SampleUser})
+	if err != nil {
+		d.add("find_upstream", DoctorFailed, err.Error())
+		return nil
+	}
+	d.add("find_upstream", DoctorOK, fmt.Sprintf("%s is routed to %s@%s", d.cfg.SampleUser, route.User, route.Address()))
+	return route
+}
+
+func (d *doctor) checkAuthorizedKeys(ctx context.Context) {
+	keys, err := authorizedKeysHook(ctx, d.conf, HookMetadata{})(d.cfg.SampleUser)
+	if err != nil {
+		d.add("authorized_keys", DoctorFailed, err.Error())
+		return
+	}
+	n := 0
+	for len(keys) > 0 {
+		var rest []byte
+		var options []string
+		_, _, options, rest, err = ParseAuthorizedKey(keys)
+		if err == nil {
+			_, err = parseKeyOptions(options)
+		}
+		if err != nil {
+			break
+		}
+		keys = rest
+		n++
+	}
+	switch {
+	case err != nil:
+		d.add("authorized_keys", DoctorFailed, fmt.Sprintf("entry %d: %v", n+1, err))
+	case n == 0:
+		d.add("authorized_keys", DoctorWarning, "no keys authorized for "+d.cfg.SampleUser)
+	default:
+		d.add("authorized_keys", DoctorOK, fmt.Sprintf("%d keys", n))
+	}
+}
+
+func (d *doctor) checkPrivateKey(ctx context.Context, route *UpstreamRoute) {
+	switch d.conf.upstreamAuth() {
+	case UpstreamAuthPassword:
+		d.add("private_key", DoctorSkipped, "upstream passwords are injected")
+		return
+	case UpstreamAuthCert:
+		if _, err := newCertSigner(d.conf, d.cfg.SampleUser); err != nil {
+			d.add("cert_signer", DoctorFailed, err.Error())
+			return
+		}
+		d.add("cert_signer", DoctorOK)
+		return
+	case UpstreamAuthMasterKey:
+		var host string
+		if route != nil {
+			host = route.Host
+		}
+		signers, err := d.conf.masterKeys(ctx, host)
+		switch {
+		case err != nil:
+			d.add("private_key", DoctorFailed, err.Error())
+		case len(signers) > 1:
+			d.add("private_key", DoctorOK, fmt.Sprintf("%d master keys", len(signers)))
+		default:
+			d.add("private_key", DoctorOK)
+		}
+		return
+	case UpstreamAuthUserKey:
+		if d.conf.FetchSignerHook != nil {
+			if _, err := d.conf.FetchSignerHook(d.cfg.SampleUser); err != nil {
+				d.add("signer", DoctorFailed, err.Error())
+				return
+			}
+			d.add("signer", DoctorOK)
+			return
+		}
+	}
+	der, err := fetchPrivateKey(ctx, d.conf, HookMetadata{User: d.cfg.SampleUser}, d.conf.UseMasterKey)
+	if err == nil {
+		_, err = ParsePrivateKey(der)
+	}
+	if err != nil {
+		d.add("private_key", DoctorFailed, err.Error())
+		return
+	}
+	d.add("private_key", DoctorOK)
+}
+
+func (d *doctor) checkUpstream(ctx context.Context, route *UpstreamRoute) {
+	if route == nil || route.ClientConfig == nil {
+		d.add("upstream", DoctorSkipped, "no upstream to dial")
+		return
+	}
+	dial := d.cfg.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	addr := route.Address()
+	c, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		d.add("upstream", DoctorFailed, err.Error())
+		return
+	}
+	defer c.Close()
+	if _, ok := ctx.Deadline(); !ok {
+		c.SetDeadline(time.Now().Add(time.Minute))
+	}
+	conn, err := NewUpstreamConnContext(ctx, c, route.ClientConfig, HandshakeTimeouts{})
+	if err == nil {
+		err = conn.transport.Close()
+	} else if ctx.Err() != nil {
+		err = fmt.Errorf("%v during handshake", ctx.Err())
+	}
+	if err != nil {
+		d.add("upstream", DoctorFailed, addr+": "+err.Error())
+		return
+	}
+	d.add("upstream", DoctorOK, "handshake with "+addr+" succeeded")
+}
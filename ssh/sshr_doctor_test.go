@@ -0,0 +1,72 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func doctorTestConfig() *DoctorConfig {
+	proxyConf := newTestProxyConfig()
+	proxyConf.DestinationPort = 22
+	proxyConf.FindUpstreamHook = func(username string) (string, error) {
+		return "upstream.example", nil
+	}
+	return &DoctorConfig{
+		Proxy:      proxyConf,
+		SampleUser: "testuser",
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr != "upstream.example:22" {
+				return nil, errors.New("unexpected address " + addr)
+			}
+			c1, c2, err := netPipe()
+			if err != nil {
+				return nil, err
+			}
+			go serveTestUpstream(c1, newTestUpstreamConfig())
+			return c2, nil
+		},
+	}
+}
+
+func checkStatus(t *testing.T, report *DoctorReport, name string, want DoctorStatus) {
+	t.Helper()
+	for _, c := range report.Checks {
+		if c.Name == name {
+			if c.Status != want {
+				t.Errorf("%s: got %v %q, want %v", name, c.Status, c.Details, want)
+			}
+			return
+		}
+	}
+	t.Errorf("%s: check missing", name)
+}
+
+func TestDoctorHealthyConfig(t *testing.T) {
+	report := Doctor(context.Background(), doctorTestConfig())
+	if !report.OK() {
+		t.Fatalf("healthy configuration reported as broken:\n%s", report)
+	}
+	for _, name := range []string{"config", "algorithms", "find_upstream", "authorized_keys", "private_key", "upstream"} {
+		checkStatus(t, report, name, DoctorOK)
+	}
+}
+
+func TestDoctorFindsProblems(t *testing.T) {
+	cfg := doctorTestConfig()
+	cfg.Proxy.ServerConfig = &ServerConfig{Config: Config{Ciphers: []string{"aes128-ctr", "arcfour"}}}
+	cfg.Proxy.ClientConfig.Ciphers = []string{"no-such-cipher"}
+	cfg.Proxy.FetchPrivateKeyHook = func(username string) ([]byte, error) {
+		return []byte("not a key"), nil
+	}
+
+	report := Doctor(context.Background(), cfg)
+	if report.OK() {
+		t.Fatalf("broken configuration reported as healthy:\n%s", report)
+	}
+	checkStatus(t, report, "config", DoctorFailed)
+	checkStatus(t, report, "algorithms", DoctorFailed)
+	checkStatus(t, report, "private_key", DoctorFailed)
+	checkStatus(t, report, "upstream", DoctorFailed)
+}
@@ -0,0 +1,72 @@
+package ssh
+
+import (
+	"errors"
+	"strings"
+)
+
+// EnvRequest is an "env" request passed to ProxyConfig.EnvHook.
+type EnvRequest struct {
+	User string
+	Name string
+	// Value is the value to set. The hook may change it.
+	Value string
+}
+
+var errEnvDenied = errors.New("ssh: environment variable not allowed")
+
+// AllowEnv returns an EnvHook that refuses the variables whose names match
+// none of patterns. A pattern ending in "*" matches the names it is a prefix
+// of otherwise, so AllowEnv("LANG", "LC_*") allows the locale variables.
+func AllowEnv(patterns ...string) func(req *EnvRequest) error {
+	return func(req *EnvRequest) error {
+		for _, pattern := range patterns {
+			if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern && strings.HasPrefix(req.Name, prefix) || req.Name == pattern {
+				return nil
+			}
+		}
+		return errEnvDenied
+	}
+}
+
+// failRequest answers a channel request of the downstream client that the
+// proxy refused, if the client wants a reply.
+func (p *ProxyConn) failRequest(msg *channelRequestMsg) {
+	if !msg.WantReply {
+		return
+	}
+	p.channels.mu.Lock()
+	ch, ok := p.channels.byUpstream[msg.PeersID]
+	p.channels.mu.Unlock()
+	if ok {
+		p.Downstream.transport.writePacket(Marshal(&channelRequestFailureMsg{PeersID: ch.downstreamID}))
+	}
+}
+
+// filterEnv passes the env requests of the downstream client to the
+// EnvHook. It returns the packet to forward, with the value as rewritten by
+// the hook, or nil if the request was refused.
+func (p *ProxyConn) filterEnv(dir relayDirection, packet []byte) []byte {
+	if dir != toUpstream || packet[0] != msgChannelRequest {
+		return packet
+	}
+	var msg channelRequestMsg
+	if Unmarshal(packet, &msg) != nil || msg.Request != "env" {
+		return packet
+	}
+	var env setenvRequest
+	if Unmarshal(msg.RequestSpecificData, &env) != nil {
+		return packet
+	}
+	req := &EnvRequest{User: p.User, Name: env.Name, Value: env.Value}
+	if err := p.config.EnvHook(req); err != nil {
+		p.log(LogDebug, "environment variable refused", "name", env.Name, "error", err)
+		p.failRequest(&msg)
+		return nil
+	}
+	if req.Value == env.Value {
+		return packet
+	}
+	msg.RequestSpecificData = Marshal(&setenvRequest{env.Name, req.Value})
+	return Marshal(&msg)
+}
@@ -0,0 +1,94 @@
+package ssh
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// serveRequestRecorder serves a proxy whose upstream accepts every channel
+// request and passes it to the returned channel.
+func serveRequestRecorder(t *testing.T, proxyConf *ProxyConfig) (string, <-chan *Request) {
+	proxyConf.DestinationPort = 22
+	proxyConf.FindUpstreamHook = func(username string) (string, error) {
+		return "upstream", nil
+	}
+	requests := make(chan *Request, 10)
+	upstreamConf := newTestUpstreamConfig()
+	_, addr := serveTestProxy(t, proxyConf, func(c net.Conn) {
+		_, chans, reqs, err := NewServerConn(c, upstreamConf)
+		if err != nil {
+			return
+		}
+		go DiscardRequests(reqs)
+		for newCh := range chans {
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer ch.Close()
+				for req := range reqs {
+					req.Reply(true, nil)
+					requests <- req
+				}
+			}()
+		}
+	})
+	return addr, requests
+}
+
+func nextRequest(t *testing.T, requests <-chan *Request) *Request {
+	t.Helper()
+	select {
+	case req := <-requests:
+		return req
+	case <-time.After(10 * time.Second):
+		t.Fatal("upstream got no request")
+	}
+	return nil
+}
+
+func TestProxyEnvHook(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	allow := AllowEnv("LANG", "LC_*", "TZ")
+	proxyConf.EnvHook = func(req *EnvRequest) error {
+		if req.Name == "TZ" {
+			req.Value = "UTC"
+		}
+		return allow(req)
+	}
+	addr, requests := serveRequestRecorder(t, proxyConf)
+	client, err := dialTestProxyServer(addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+
+	for _, env := range []struct {
+		name, value string
+		allowed     bool
+	}{
+		{"LD_PRELOAD", "/tmp/evil.so", false},
+		{"LANG", "en_US.UTF-8", true},
+		{"LC_ALL", "C", true},
+		{"LANGUAGE", "en", false},
+		{"TZ", "Europe/Berlin", true},
+	} {
+		if err := session.Setenv(env.name, env.value); (err == nil) != env.allowed {
+			t.Errorf("Setenv(%q): %v, want allowed %v", env.name, err, env.allowed)
+		}
+	}
+	for _, want := range []setenvRequest{{"LANG", "en_US.UTF-8"}, {"LC_ALL", "C"}, {"TZ", "UTC"}} {
+		req := nextRequest(t, requests)
+		var got setenvRequest
+		if req.Type != "env" || Unmarshal(req.Payload, &got) != nil || got != want {
+			t.Errorf("upstream got %s %q, want env %v", req.Type, req.Payload, want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package ssh
+
+import "errors"
+
+// Causes of proxy failures. Errors returned by the proxy match them with
+// errors.Is, so that callers can choose disconnect messages or metrics
+// labels by cause.
+var (
+	// ErrNoUpstream matches failures to find the upstream of a user with
+	// FindUpstreamHook or RouteUpstreamHook in ProxyServer, for example
+	// for unknown users.
+	ErrNoUpstream = errors.New("ssh: no upstream for user")
+
+	// ErrUpstreamUnreachable matches failures to dial the upstream and
+	// connections to it lost during the handshake.
+	ErrUpstreamUnreachable = errors.New("ssh: upstream unreachable")
+
+	// ErrAuthRejected matches authentication failures, whether the proxy
+	// or the upstream rejected the user, and the error of
+	// AuthenticateProxyConn if the client disconnects after one.
+	ErrAuthRejected = errors.New("ssh: authentication rejected")
+
+	// ErrHostKeyMismatch matches upstream host keys rejected by
+	// ProxyConfig.UpstreamHostKeyCallback.
+	ErrHostKeyMismatch = errors.New("ssh: upstream host key rejected")
+
+	// ErrNoAuthorizedKey matches public keys without a usable entry in the
+	// user's authorized keys.
+	ErrNoAuthorizedKey = errors.New("ssh: public key not authorized")
+
+	// ErrPermissionTooOpen matches files in the user's ~/.ssh that others
+	// can access.
+	ErrPermissionTooOpen = errors.New("ssh: file permissions are too open")
+)
+
+// authRejectedError is a kind of authentication failure.
+type authRejectedError string
+
+func (e authRejectedError) Error() string { return string(e) }
+
+func (e authRejectedError) Is(target error) bool { return target == ErrAuthRejected }
+
+// noUpstreamError is an error of the routing hooks, whose message it keeps.
+type noUpstreamError struct {
+	err error
+}
+
+func (e noUpstreamError) Error() string { return e.err.Error() }
+
+func (e noUpstreamError) Is(target error) bool { return target == ErrNoUpstream }
+
+func (e noUpstreamError) Unwrap() error { return e.err }
+
+// proxyError is a failure with cause, which it matches with errors.Is. Its
+// message adds detail and that of err, which it wraps, if set.
+type proxyError struct {
+	cause  error
+	detail string
+	err    error
+}
+
+func (e *proxyError) Error() string {
+	msg := e.cause.Error()
+	if e.detail != "" {
+		msg += ": " + e.detail
+	}
+	if e.err != nil {
+		msg += ": " + e.err.Error()
+	}
+	return msg
+}
+
+func (e *proxyError) Is(target error) bool { return target == e.cause }
+
+func (e *proxyError) Unwrap() error { return e.err }
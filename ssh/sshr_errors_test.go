@@ -0,0 +1,111 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestErrorCauses(t *testing.T) {
+	for _, tc := range []struct {
+		err   error
+		cause error
+	}{
+		{errProxyAuthFailed, ErrAuthRejected},
+		{errLockedOut, ErrAuthRejected},
+		{&UpstreamAuthError{Methods: []string{"password"}}, ErrAuthRejected},
+		{&proxyError{cause: ErrUpstreamUnreachable, err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, ErrUpstreamUnreachable},
+	} {
+		if !errors.Is(tc.err, tc.cause) {
+			t.Errorf("%v does not match %v", tc.err, tc.cause)
+		}
+	}
+	p := &ProxyConn{}
+	if _, err := p.matchAuthorizedKeys("alice", MarshalAuthorizedKey(testPublicKeys["rsa"]), testPublicKeys["ecdsa"]); !errors.Is(err, ErrNoAuthorizedKey) {
+		t.Errorf("got %v for an unlisted key, want ErrNoAuthorizedKey", err)
+	}
+	var netErr net.Error
+	if err := (&proxyError{cause: ErrUpstreamUnreachable, err: &net.OpError{Op: "dial"}}); !errors.As(err, &netErr) {
+		t.Errorf("%v does not wrap the dial error", err)
+	}
+}
+
+func TestPermissionTooOpen(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes do not reflect ACLs on Windows")
+	}
+	home := t.TempDir()
+	if err := os.Mkdir(filepath.Join(home, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(home, ".ssh", "id_rsa"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	proxyConf := &ProxyConfig{HomeDirHook: func(string) (string, error) { return home, nil }}
+	if err := userPrivateKeyFile.checkPermission(proxyConf, "alice"); !errors.Is(err, ErrPermissionTooOpen) {
+		t.Errorf("got %v, want ErrPermissionTooOpen", err)
+	}
+}
+
+// failureCause logs in through a ProxyServer with clientConf and returns
+// the error the server reports.
+func failureCause(t *testing.T, proxyConf *ProxyConfig, dial func(ctx context.Context, network, addr string) (net.Conn, error), clientConf *ClientConfig) error {
+	proxyConf.FindUpstreamHook = func(username string) (string, error) { return "upstream", nil }
+	errs := make(chan error, 1)
+	s := &ProxyServer{
+		Config:    proxyConf,
+		Dial:      dial,
+		ErrorHook: func(c net.Conn, err error) { errs <- err },
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+	if client, err := Dial("tcp", l.Addr().String(), clientConf); err == nil {
+		client.Close()
+		t.Fatal("logged in")
+	}
+	return <-errs
+}
+
+func serveDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	u1, u2, err := netPipe()
+	if err != nil {
+		return nil, err
+	}
+	go serveTestUpstream(u1, newTestUpstreamConfig())
+	return u2, nil
+}
+
+func TestProxyServerErrorCauses(t *testing.T) {
+	clientConf := &ClientConfig{
+		User:            "testuser",
+		Auth:            []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+
+	refuse := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+	}
+	if err := failureCause(t, newTestProxyConfig(), refuse, clientConf); !errors.Is(err, ErrUpstreamUnreachable) {
+		t.Errorf("refused dial: got %v, want ErrUpstreamUnreachable", err)
+	}
+
+	proxyConf := newTestProxyConfig()
+	proxyConf.UpstreamHostKeyCallback = func(string, net.Addr, PublicKey) error { return errors.New("unknown host") }
+	if err := failureCause(t, proxyConf, serveDial, clientConf); !errors.Is(err, ErrHostKeyMismatch) {
+		t.Errorf("rejected host key: got %v, want ErrHostKeyMismatch", err)
+	}
+
+	unauthorized := *clientConf
+	unauthorized.Auth = []AuthMethod{PublicKeys(testSigners["ed25519"])}
+	if err := failureCause(t, newTestProxyConfig(), serveDial, &unauthorized); !errors.Is(err, ErrAuthRejected) {
+		t.Errorf("unauthorized key: got %v, want ErrAuthRejected", err)
+	}
+}
@@ -0,0 +1,71 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+)
+
+// candidates returns the routes to try in order: r, then a copy of r for
+// each of its fallback hosts.
+func (r *UpstreamRoute) candidates(conf *ProxyConfig) []*UpstreamRoute {
+	routes := []*UpstreamRoute{r}
+	for _, host := range r.Fallbacks {
+		route := *r
+		route.Host, route.Fallbacks = host, nil
+		if conf.UpstreamHostKeyCallback != nil && route.ClientConfig != nil {
+			clientConf := *route.ClientConfig
+			clientConf.HostKeyCallback = upstreamHostKeyCallback(conf.UpstreamHostKeyCallback, route.Address())
+			route.ClientConfig = &clientConf
+		}
+		routes = append(routes, &route)
+	}
+	return routes
+}
+
+// upstreamUnavailable tells whether err means the upstream could not be
+// reached, rather than that it was reached and refused the proxy.
+func upstreamUnavailable(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func (s *ProxyServer) failover(route *UpstreamRoute, err error) bool {
+	if s.FailoverHook != nil {
+		return s.FailoverHook(route, err)
+	}
+	return upstreamUnavailable(err)
+}
+
+// connectUpstream connects to the first candidate of route that can be
+// reached and returns the connection and the candidate's route.
+func (s *ProxyServer) connectUpstream(ctx, dialCtx context.Context, conf *ProxyConfig, route *UpstreamRoute, user string, downstream *connection) (*connection, *UpstreamRoute, error) {
+	candidates := route.candidates(conf)
+	var prevErr error
+	for i, r := range candidates {
+		attemptCtx, cancel := dialCtx, context.CancelFunc(func() {})
+		if s.UpstreamAttemptTimeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(dialCtx, s.UpstreamAttemptTimeout)
+		}
+		upstream, err := s.dialUpstream(ctx, attemptCtx, conf, r, user, downstream)
+		cancel()
+		if err == nil {
+			if attemptCtx != dialCtx {
+				deadline, _ := dialCtx.Deadline()
+				upstream.NetConn().SetDeadline(deadline)
+			}
+			if i > 0 {
+				conf.log(LogInfo, "upstream failover", "user", user, "upstream", r.Address(), "candidate", i)
+				conf.audit(AuditEvent{Type: AuditUpstreamFailover, User: user, RemoteAddr: downstream.RemoteAddr(), Upstream: r.Host, Err: prevErr})
+			}
+			return upstream, r, nil
+		}
+		if i == len(candidates)-1 || !s.failover(r, err) {
+			return nil, nil, err
+		}
+		conf.log(LogWarn, "upstream candidate failed", "user", user, "upstream", r.Address(), "error", err)
+		prevErr = err
+	}
+	panic("unreachable")
+}
@@ -0,0 +1,128 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUpstreamUnavailable(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{context.DeadlineExceeded, true},
+		{errors.New("ssh: host key mismatch"), false},
+	} {
+		if got := upstreamUnavailable(tc.err); got != tc.want {
+			t.Errorf("upstreamUnavailable(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestProxyServerUpstreamFailover(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.DestinationPort = 22
+	proxyConf.FindUpstreamHook = func(username string) (string, error) {
+		return "db1 db2 db3", nil
+	}
+	events := make(chan AuditEvent, 16)
+	proxyConf.AuditCallback = func(ev AuditEvent) { events <- ev }
+	s := &ProxyServer{
+		Config: proxyConf,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			switch addr {
+			case "db1:22":
+				return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+			case "db2:22":
+				// Accepts, but never speaks.
+				u1, u2, err := netPipe()
+				if err != nil {
+					return nil, err
+				}
+				go func() {
+					<-ctx.Done()
+					u1.Close()
+				}()
+				return u2, nil
+			}
+			u1, u2, err := netPipe()
+			if err != nil {
+				return nil, err
+			}
+			go serveTestUpstream(u1, newTestUpstreamConfig())
+			return u2, nil
+		},
+		UpstreamAttemptTimeout: 200 * time.Millisecond,
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	client, err := dialTestProxyServer(l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+	if got := runHello(t, client); got != "hello" {
+		t.Errorf("got output %q, want hello", got)
+	}
+	for ev := range events {
+		if ev.Type == AuditUpstreamFailover {
+			if ev.Upstream != "db3" || ev.Err == nil {
+				t.Errorf("got failover to %q after %v, want db3 after an error", ev.Upstream, ev.Err)
+			}
+			break
+		}
+	}
+}
+
+func TestProxyServerNoFailoverOnRefusal(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.DestinationPort = 22
+	proxyConf.FindUpstreamHook = func(username string) (string, error) {
+		return "db1 db2", nil
+	}
+	proxyConf.UpstreamHostKeyCallback = func(hostname string, remote net.Addr, key PublicKey) error {
+		if hostname == "db1:22" {
+			return errors.New("host key mismatch")
+		}
+		return nil
+	}
+	dialed := make(chan string, 2)
+	s := &ProxyServer{
+		Config: proxyConf,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed <- addr
+			u1, u2, err := netPipe()
+			if err != nil {
+				return nil, err
+			}
+			go serveTestUpstream(u1, newTestUpstreamConfig())
+			return u2, nil
+		},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	if client, err := dialTestProxyServer(l.Addr().String()); err == nil {
+		client.Close()
+		t.Fatal("logged in despite a rejected host key")
+	}
+	close(dialed)
+	for addr := range dialed {
+		if addr != "db1:22" {
+			t.Errorf("dialed %s after the host key was rejected", addr)
+		}
+	}
+}
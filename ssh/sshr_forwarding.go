@@ -0,0 +1,148 @@
+package ssh
+
+import (
+	"errors"
+	"net"
+)
+
+// ForwardRequest is a port forwarding request checked by a
+// ForwardingPolicy.
+type ForwardRequest struct {
+	User string
+	// Remote is set for remote forwards (tcpip-forward), where the
+	// upstream listens on Host and Port, and unset for local forwards
+	// (direct-tcpip), where the upstream connects to Host and Port.
+	Remote bool
+	// Unix is set for forwards of Unix sockets, whose path is in Host.
+	Unix bool
+	Host string
+	Port uint32
+}
+
+// ForwardingPolicy restricts the port forwards of proxied sessions, which
+// otherwise reach anything the upstream allows. The options are checked
+// first and Hook, if set, decides about the forwards they allow.
+type ForwardingPolicy struct {
+	// DenyLocal refuses all local forwards and DenyRemote all remote
+	// forwards.
+	DenyLocal  bool
+	DenyRemote bool
+
+	// LocalNetworks and LocalHosts, if either is set, are the only
+	// destinations of local forwards. Destinations given by name do not
+	// match LocalNetworks, as the upstream resolves them. LocalHosts are
+	// host names, or "*.example.com" for any name in a domain.
+	LocalNetworks []*net.IPNet
+	LocalHosts    []string
+
+	// Hook decides per user and destination. Forwards it returns an error
+	// for are refused.
+	Hook func(req ForwardRequest) error
+}
+
+var errForwardingDenied = errors.New("ssh: port forwarding denied by policy")
+
+// check returns an error if req is not allowed.
+func (f *ForwardingPolicy) check(req ForwardRequest) error {
+	if req.Remote && f.DenyRemote || !req.Remote && f.DenyLocal {
+		return errForwardingDenied
+	}
+	if !req.Remote && (len(f.LocalNetworks) > 0 || len(f.LocalHosts) > 0) && !f.allowsDestination(req) {
+		return errForwardingDenied
+	}
+	if f.Hook != nil {
+		return f.Hook(req)
+	}
+	return nil
+}
+
+func (f *ForwardingPolicy) allowsDestination(req ForwardRequest) bool {
+	return !req.Unix && matchesDestination(f.LocalNetworks, f.LocalHosts, req.Host)
+}
+
+// forwardRequestData is the data of tcpip-forward requests.
+type forwardRequestData struct {
+	Host string
+	Port uint32
+}
+
+// filterForwarding refuses the port forwards relayed to the upstream that
+// the ForwardingPolicy does not allow, and forwarded-tcpip channels if
+// remote forwards are denied, answering them in place of the peer. It
+// reports whether the packet was consumed.
+func (p *ProxyConn) filterForwarding(dir relayDirection, packet []byte) bool {
+	policy := p.forwarding()
+	sender := p.Downstream.transport
+	if dir == toDownstream {
+		sender = p.Upstream.transport
+	}
+
+	switch packet[0] {
+	case msgGlobalRequest:
+		var msg globalRequestMsg
+		if dir != toUpstream || Unmarshal(packet, &msg) != nil {
+			return false
+		}
+		req := ForwardRequest{User: p.User, Remote: true}
+		var err error
+		switch msg.Type {
+		case "tcpip-forward":
+			var data forwardRequestData
+			if err = Unmarshal(msg.Data, &data); err == nil {
+				req.Host, req.Port = data.Host, data.Port
+			}
+		case "streamlocal-forward@openssh.com":
+			path, _, ok := parseString(msg.Data)
+			if !ok {
+				err = parseError(msgGlobalRequest)
+			}
+			req.Host, req.Unix = string(path), true
+		default:
+			return false
+		}
+		if err == nil && policy.check(req) == nil {
+			return false
+		}
+		if msg.WantReply {
+			sender.writePacket([]byte{msgRequestFailure})
+		}
+		return true
+
+	case msgChannelOpen:
+		var msg channelOpenMsg
+		if Unmarshal(packet, &msg) != nil {
+			return false
+		}
+		var err error
+		switch {
+		case msg.ChanType == "forwarded-tcpip" || msg.ChanType == "forwarded-streamlocal@openssh.com":
+			if dir == toDownstream && policy.DenyRemote {
+				err = errForwardingDenied
+			}
+		case msg.ChanType == "direct-tcpip" && dir == toUpstream:
+			var data tcpipOpenData
+			if err = Unmarshal(msg.TypeSpecificData, &data); err == nil {
+				err = policy.check(ForwardRequest{User: p.User, Host: data.Host, Port: data.Port})
+			}
+		case msg.ChanType == "direct-streamlocal@openssh.com" && dir == toUpstream:
+			path, _, ok := parseString(msg.TypeSpecificData)
+			if !ok {
+				err = errForwardingDenied
+			} else {
+				err = policy.check(ForwardRequest{User: p.User, Unix: true, Host: string(path)})
+			}
+		default:
+			return false
+		}
+		if err == nil {
+			return false
+		}
+		sender.writePacket(Marshal(&channelOpenFailureMsg{
+			PeersID: msg.PeersID,
+			Reason:  Prohibited,
+			Message: "port forwarding denied by policy",
+		}))
+		return true
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package ssh
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestForwardingPolicyCheck(t *testing.T) {
+	_, tenNet, _ := net.ParseCIDR("10.0.0.0/8")
+	f := &ForwardingPolicy{
+		DenyRemote:    true,
+		LocalNetworks: []*net.IPNet{tenNet},
+		LocalHosts:    []string{"*.internal", "git.example.com"},
+		Hook: func(req ForwardRequest) error {
+			if req.User == "intern" {
+				return errors.New("no forwarding for interns")
+			}
+			return nil
+		},
+	}
+	for _, tt := range []struct {
+		req ForwardRequest
+		ok  bool
+	}{
+		{ForwardRequest{User: "alice", Host: "10.1.2.3", Port: 5432}, true},
+		{ForwardRequest{User: "alice", Host: "192.168.1.1", Port: 22}, false},
+		{ForwardRequest{User: "alice", Host: "db.internal", Port: 5432}, true},
+		{ForwardRequest{User: "alice", Host: "DB.Internal.", Port: 5432}, true},
+		{ForwardRequest{User: "alice", Host: "internal", Port: 5432}, false},
+		{ForwardRequest{User: "alice", Host: "git.example.com", Port: 443}, true},
+		{ForwardRequest{User: "alice", Host: "www.example.com", Port: 443}, false},
+		{ForwardRequest{User: "alice", Unix: true, Host: "/run/docker.sock"}, false},
+		{ForwardRequest{User: "alice", Remote: true, Host: "localhost", Port: 8080}, false},
+		{ForwardRequest{User: "intern", Host: "10.1.2.3", Port: 5432}, false},
+	} {
+		if err := f.check(tt.req); (err == nil) != tt.ok {
+			t.Errorf("%+v: got %v, want allowed %v", tt.req, err, tt.ok)
+		}
+	}
+}
+
+func TestProxyForwardingPolicy(t *testing.T) {
+	var mu sync.Mutex
+	var checked []ForwardRequest
+	_, tenNet, _ := net.ParseCIDR("10.0.0.0/8")
+	proxyConf := newTestProxyConfig()
+	proxyConf.DestinationPort = 22
+	proxyConf.FindUpstreamHook = func(username string) (string, error) {
+		return "upstream", nil
+	}
+	proxyConf.Forwarding = &ForwardingPolicy{
+		LocalNetworks: []*net.IPNet{tenNet},
+		Hook: func(req ForwardRequest) error {
+			mu.Lock()
+			defer mu.Unlock()
+			checked = append(checked, req)
+			return nil
+		},
+	}
+	s, addr, _ := newTestProxyServer(t, proxyConf)
+	defer s.Close()
+	client, err := dialTestProxyServer(addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	// The test upstream accepts every channel.
+	c, err := client.Dial("tcp", "10.0.0.5:5432")
+	if err != nil {
+		t.Fatalf("allowed local forward: %v", err)
+	}
+	c.Close()
+	if _, err := client.Dial("tcp", "192.168.1.1:5432"); err == nil {
+		t.Error("local forward outside LocalNetworks succeeded")
+	}
+	// The test upstream refuses global requests, so only the hook call
+	// tells that the remote forward was passed on.
+	client.Listen("tcp", "127.0.0.1:8080")
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []ForwardRequest{
+		{User: "testuser", Host: "10.0.0.5", Port: 5432},
+		{User: "testuser", Remote: true, Host: "127.0.0.1", Port: 8080},
+	}
+	if len(checked) != len(want) {
+		t.Fatalf("hook saw %+v, want %+v", checked, want)
+	}
+	for i := range want {
+		if checked[i] != want[i] {
+			t.Errorf("request %d: got %+v, want %+v", i, checked[i], want[i])
+		}
+	}
+}
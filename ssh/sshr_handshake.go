@@ -0,0 +1,126 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// HandshakeTimeouts limit the phases of the handshakes with the downstream
+// client and the upstream server. Zero means no limit.
+type HandshakeTimeouts struct {
+	// Version limits the exchange of version strings.
+	Version time.Duration
+	// KeyExchange limits the first key exchange and, downstream, the
+	// request for the userauth service.
+	KeyExchange time.Duration
+	// Auth limits AuthenticateProxyConn, from the first authentication
+	// request until the upstream accepts the user.
+	Auth time.Duration
+}
+
+// HandshakeTimeoutError is returned when a phase of a handshake exceeds its
+// limit in HandshakeTimeouts.
+type HandshakeTimeoutError struct {
+	// Phase is "version", "kex" or "auth".
+	Phase string
+}
+
+func (e *HandshakeTimeoutError) Error() string {
+	return "ssh: " + e.Phase + " phase of the handshake timed out"
+}
+
+// Timeout and Temporary implement net.Error.
+func (e *HandshakeTimeoutError) Timeout() bool   { return true }
+func (e *HandshakeTimeoutError) Temporary() bool { return true }
+
+// handshakePhases sets the deadlines of conns for the phases of a
+// handshake and closes them if ctx is done first. A nil *handshakePhases
+// does nothing.
+type handshakePhases struct {
+	ctx   context.Context
+	conns []net.Conn
+	stop  chan struct{}
+
+	phase   string
+	limited bool // the current phase has its own deadline
+	changed bool // a deadline of conns was changed
+	// restore is the deadline of conns after the handshake, that of ctx
+	// unless changed.
+	restore time.Time
+}
+
+// startPhases watches ctx until the end of the handshake.
+func startPhases(ctx context.Context, conns ...net.Conn) *handshakePhases {
+	h := &handshakePhases{ctx: ctx, conns: conns, stop: make(chan struct{})}
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				for _, c := range conns {
+					c.Close()
+				}
+			case <-h.stop:
+			}
+		}()
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		h.setDeadline(deadline)
+		h.restore = deadline
+	}
+	return h
+}
+
+func (h *handshakePhases) setDeadline(t time.Time) {
+	for _, c := range h.conns {
+		c.SetDeadline(t)
+	}
+	h.changed = true
+}
+
+// begin starts phase, which may take up to timeout if non-zero.
+func (h *handshakePhases) begin(phase string, timeout time.Duration) {
+	if h == nil {
+		return
+	}
+	h.phase = phase
+	deadline, ok := h.ctx.Deadline()
+	h.limited = timeout > 0 && (!ok || time.Now().Add(timeout).Before(deadline))
+	if h.limited {
+		deadline, ok = time.Now().Add(timeout), true
+	}
+	if ok || h.changed {
+		h.setDeadline(deadline)
+	}
+}
+
+// end stops watching ctx, restores the deadline if it was changed and
+// returns err, replaced with the error of ctx or a
+// HandshakeTimeoutError if those caused it.
+func (h *handshakePhases) end(err error) error {
+	if h == nil {
+		return err
+	}
+	close(h.stop)
+	if h.changed {
+		h.setDeadline(h.restore)
+	}
+	if err == nil {
+		return nil
+	}
+	if ctxErr := h.ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		return err
+	}
+	if h.limited {
+		return &HandshakeTimeoutError{Phase: h.phase}
+	}
+	if deadline, ok := h.ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
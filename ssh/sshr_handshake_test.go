@@ -0,0 +1,63 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestHandshakePhaseTimeouts(t *testing.T) {
+	timeouts := HandshakeTimeouts{Version: 50 * time.Millisecond, KeyExchange: 50 * time.Millisecond}
+	for _, tc := range []struct {
+		phase string
+		peer  string
+	}{
+		{"version", ""},
+		{"kex", "SSH-2.0-stuck\r\n"},
+	} {
+		c1, c2, err := netPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(c2, tc.peer)
+		_, err = NewDownstreamConnContext(context.Background(), c1, newTestProxyConfig().ServerConfig, timeouts)
+		var timeoutErr *HandshakeTimeoutError
+		if !errors.As(err, &timeoutErr) || timeoutErr.Phase != tc.phase {
+			t.Errorf("got %v, want a timeout in the %s phase", err, tc.phase)
+		}
+		c2.Close()
+	}
+}
+
+func TestHandshakeContextCancel(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := NewUpstreamConnContext(ctx, c1, newTestProxyConfig().ClientConfig, HandshakeTimeouts{}); err != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestHandshakeTimeoutsReset(t *testing.T) {
+	u1, u2, err := netPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveTestUpstream(u1, newTestUpstreamConfig())
+	timeouts := HandshakeTimeouts{Version: time.Second, KeyExchange: time.Second}
+	upstream, err := NewUpstreamConnContext(context.Background(), u2, newTestProxyConfig().ClientConfig, timeouts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.transport.Close()
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := upstream.sendAuthReq(); err != nil {
+		t.Errorf("connection failed after the handshake timeouts: %v", err)
+	}
+}
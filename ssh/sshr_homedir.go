@@ -0,0 +1,252 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// HomeLayout describes where the proxy finds the authorized keys and
+// private keys of users in their home directories, when
+// FetchAuthorizedKeysHook or FetchPrivateKeyHook is nil. The zero value
+// reads ~/.ssh/authorized_keys and the first of ~/.ssh/id_ed25519, id_ecdsa
+// and id_rsa, without checking their permissions.
+type HomeLayout struct {
+	// Home is the home directory of users that neither HomeDirHook nor
+	// the user database resolve, in which "{user}" is replaced with the
+	// username. If empty, "/Users/{user}" is used on macOS,
+	// "%SystemDrive%\Users\{user}" on Windows and "/home/{user}"
+	// elsewhere.
+	Home string
+
+	// SkipUserLookup skips the user database, so that only HomeDirHook
+	// and Home resolve home directories.
+	SkipUserLookup bool
+
+	// Dir is the directory of the files, relative to the home directory
+	// unless absolute, in which case "{user}" is replaced with the
+	// username, such as "/etc/ssh/keys/{user}". If empty, ".ssh" is used.
+	Dir string
+
+	// AuthorizedKeys are the files whose keys are authorized, all of which
+	// are read, such as "authorized_keys" and "authorized_keys2". If
+	// empty, "authorized_keys" is used.
+	AuthorizedKeys []string
+
+	// PrivateKeys are the files tried in order for the private key used
+	// upstream. If empty, "id_ed25519", "id_ecdsa" and "id_rsa" are tried.
+	PrivateKeys []string
+
+	// Permissions is how the permissions of the files are checked.
+	Permissions PermissionMode
+}
+
+// PermissionMode is how the proxy checks the permissions of key files.
+type PermissionMode int
+
+const (
+	// PermissionsIgnored reads files regardless of their permissions.
+	PermissionsIgnored PermissionMode = iota
+	// PermissionsWarn reads files that are too open but logs a warning.
+	PermissionsWarn
+	// PermissionsStrict refuses files that are too open, as sshd does
+	// with StrictModes: private keys others can access, and authorized
+	// keys or directories of them others can write. On Windows, the ACL
+	// of files may only grant that access to their owner, SYSTEM, the
+	// Administrators and the account of the proxy.
+	PermissionsStrict
+)
+
+// defaultPrivateKeyFiles are tried if HomeLayout.PrivateKeys is empty.
+var defaultPrivateKeyFiles = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// names returns the names of the files of kind file in the layout.
+func (file userFile) names(l *HomeLayout) []string {
+	switch {
+	case file == userAuthorizedKeysFile && len(l.AuthorizedKeys) > 0:
+		return l.AuthorizedKeys
+	case file == userPrivateKeyFile && len(l.PrivateKeys) > 0:
+		return l.PrivateKeys
+	case file == userPrivateKeyFile:
+		return defaultPrivateKeyFiles
+	}
+	return []string{string(file)}
+}
+
+// tooOpen returns the permission bits that make files of kind file too
+// open.
+func (file userFile) tooOpen() os.FileMode {
+	if file == userPrivateKeyFile {
+		return 0077
+	}
+	return 0022
+}
+
+// read returns the contents of the files of kind file of username: the
+// first private key found, or all authorized keys found.
+func (file userFile) read(proxyConf *ProxyConfig, username string) ([]byte, error) {
+	dir, err := userKeyDir(proxyConf, username)
+	if err != nil {
+		return nil, err
+	}
+	if proxyConf.HomeLayout.Permissions == PermissionsStrict {
+		if err := checkMode(dir, 0022); err != nil {
+			return nil, err
+		}
+	}
+	var data []byte
+	var errs fileErrors
+	found := false
+	for _, name := range file.names(&proxyConf.HomeLayout) {
+		b, err := file.readFile(proxyConf, filepath.Join(dir, name))
+		if errors.Is(err, ErrPermissionTooOpen) {
+			return nil, err
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if file == userPrivateKeyFile {
+			return b, nil
+		}
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			data = append(data, '\n')
+		}
+		data = append(data, b...)
+		found = true
+	}
+	if !found {
+		if len(errs) == 1 {
+			return nil, errs[0]
+		}
+		return nil, errs
+	}
+	return data, nil
+}
+
+// fileErrors are the errors of reading each of several files.
+type fileErrors []error
+
+func (e fileErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return "ssh: no key file could be read: " + strings.Join(msgs, "; ")
+}
+
+// Is reports whether all the errors match target, such as os.ErrNotExist.
+func (e fileErrors) Is(target error) bool {
+	for _, err := range e {
+		if !errors.Is(err, target) {
+			return false
+		}
+	}
+	return len(e) > 0
+}
+
+// readFile reads filename, checking its permissions as configured.
+func (file userFile) readFile(proxyConf *ProxyConfig, filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if mode := proxyConf.HomeLayout.Permissions; mode != PermissionsIgnored {
+		open, err := fileTooOpen(f, file.tooOpen())
+		if err != nil {
+			return nil, err
+		}
+		if open {
+			if mode == PermissionsStrict {
+				return nil, &proxyError{cause: ErrPermissionTooOpen, detail: filename}
+			}
+			proxyConf.log(LogWarn, "file permissions are too open", "file", filename)
+		}
+	}
+	return ioutil.ReadAll(f)
+}
+
+// checkPermission returns an error for the files of kind file of user that
+// exist and are too open.
+func (file userFile) checkPermission(proxyConf *ProxyConfig, user string) error {
+	dir, err := userKeyDir(proxyConf, user)
+	if err != nil {
+		return err
+	}
+	for _, name := range file.names(&proxyConf.HomeLayout) {
+		if err := checkMode(filepath.Join(dir, name), file.tooOpen()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkMode returns an error if the permissions of filename include any of
+// tooOpen, or their equivalent on the platform.
+func checkMode(filename string, tooOpen os.FileMode) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	open, err := fileTooOpen(f, tooOpen)
+	if err != nil {
+		return err
+	}
+	if open {
+		return &proxyError{cause: ErrPermissionTooOpen, detail: filename}
+	}
+	return nil
+}
+
+// userKeyDir returns the directory of the key files of username.
+func userKeyDir(proxyConf *ProxyConfig, username string) (string, error) {
+	dir := proxyConf.HomeLayout.Dir
+	if dir == "" {
+		dir = ".ssh"
+	}
+	if filepath.IsAbs(dir) {
+		return expandUser(dir, username)
+	}
+	home, err := homeDir(proxyConf, username)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, dir), nil
+}
+
+// homeDir resolves the home directory of username with HomeDirHook, or else
+// from the user database, falling back to HomeLayout.Home.
+func homeDir(proxyConf *ProxyConfig, username string) (string, error) {
+	if proxyConf.HomeDirHook != nil {
+		home, err := proxyConf.HomeDirHook(username)
+		if err != nil {
+			return "", fmt.Errorf("ssh: resolving home directory of %q: %v", username, err)
+		}
+		return home, nil
+	}
+	if !proxyConf.HomeLayout.SkipUserLookup {
+		if u, err := user.Lookup(username); err == nil && u.HomeDir != "" {
+			return u.HomeDir, nil
+		}
+	}
+	home := proxyConf.HomeLayout.Home
+	if home == "" {
+		home = defaultHome()
+	}
+	return expandUser(home, username)
+}
+
+// expandUser replaces "{user}" in the path template with username, which
+// must not leave the directory it names.
+func expandUser(template, username string) (string, error) {
+	if username == "" || username == "." || username == ".." || strings.ContainsAny(username, "/"+string(filepath.Separator)) {
+		return "", fmt.Errorf("ssh: invalid username %q in path", username)
+	}
+	return strings.Replace(template, "{user}", username, -1), nil
+}
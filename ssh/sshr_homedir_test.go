@@ -0,0 +1,110 @@
+package ssh
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, filename, data string, perm os.FileMode) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, []byte(data), perm); err != nil {
+		t.Fatal(err)
+	}
+	// The umask may have dropped bits of perm.
+	if err := os.Chmod(filename, perm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHomeLayout(t *testing.T) {
+	homes := t.TempDir()
+	writeTestFile(t, filepath.Join(homes, "alice", ".ssh", "authorized_keys"), "key1", 0600)
+	writeTestFile(t, filepath.Join(homes, "alice", ".ssh", "authorized_keys2"), "key2\n", 0600)
+	writeTestFile(t, filepath.Join(homes, "alice", ".ssh", "id_rsa"), "rsa", 0600)
+	proxyConf := &ProxyConfig{HomeLayout: HomeLayout{
+		Home:           filepath.Join(homes, "{user}"),
+		SkipUserLookup: true,
+		AuthorizedKeys: []string{"authorized_keys", "authorized_keys2"},
+		PrivateKeys:    []string{"id_ed25519", "id_rsa"},
+	}}
+
+	if data, err := userAuthorizedKeysFile.read(proxyConf, "alice"); err != nil || string(data) != "key1\nkey2\n" {
+		t.Errorf("authorized keys: got %q, %v", data, err)
+	}
+	if data, err := userPrivateKeyFile.read(proxyConf, "alice"); err != nil || string(data) != "rsa" {
+		t.Errorf("private key: got %q, %v, want the first file found", data, err)
+	}
+	if _, err := userAuthorizedKeysFile.read(proxyConf, "bob"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("user without files: got %v, want not found", err)
+	}
+	if _, err := userAuthorizedKeysFile.read(proxyConf, ".."); err == nil {
+		t.Error("read keys of user \"..\"")
+	}
+
+	keys := t.TempDir()
+	writeTestFile(t, filepath.Join(keys, "carol", "authorized_keys"), "key3", 0600)
+	proxyConf.HomeLayout = HomeLayout{Dir: filepath.Join(keys, "{user}"), SkipUserLookup: true}
+	if data, err := userAuthorizedKeysFile.read(proxyConf, "carol"); err != nil || string(data) != "key3" {
+		t.Errorf("absolute Dir: got %q, %v", data, err)
+	}
+}
+
+func TestHomeLayoutPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes do not reflect ACLs on Windows")
+	}
+	home := t.TempDir()
+	writeTestFile(t, filepath.Join(home, ".ssh", "id_rsa"), "rsa", 0644)
+	writeTestFile(t, filepath.Join(home, ".ssh", "authorized_keys"), "key", 0644)
+	proxyConf := &ProxyConfig{HomeDirHook: func(string) (string, error) { return home, nil }}
+
+	for _, tc := range []struct {
+		mode    PermissionMode
+		file    userFile
+		refused bool
+	}{
+		{PermissionsIgnored, userPrivateKeyFile, false},
+		{PermissionsWarn, userPrivateKeyFile, false},
+		{PermissionsStrict, userPrivateKeyFile, true},
+		{PermissionsStrict, userAuthorizedKeysFile, false},
+	} {
+		proxyConf.HomeLayout.Permissions = tc.mode
+		_, err := tc.file.read(proxyConf, "alice")
+		if refused := errors.Is(err, ErrPermissionTooOpen); refused != tc.refused || !refused && err != nil {
+			t.Errorf("mode %d, %s: got %v, want refused %v", tc.mode, tc.file, err, tc.refused)
+		}
+	}
+
+	if err := os.Chmod(filepath.Join(home, ".ssh", "authorized_keys"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := userAuthorizedKeysFile.read(proxyConf, "alice"); !errors.Is(err, ErrPermissionTooOpen) {
+		t.Errorf("world-writable authorized keys: got %v, want ErrPermissionTooOpen", err)
+	}
+}
+
+func TestDefaultPrivateKeyFiles(t *testing.T) {
+	home := t.TempDir()
+	proxyConf := &ProxyConfig{HomeDirHook: func(string) (string, error) { return home, nil }}
+	_, err := userPrivateKeyFile.read(proxyConf, "alice")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v, want not found", err)
+	}
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		if err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("error %v does not name %s", err, name)
+		}
+	}
+
+	writeTestFile(t, filepath.Join(home, ".ssh", "id_rsa"), "rsa", 0600)
+	writeTestFile(t, filepath.Join(home, ".ssh", "id_ecdsa"), "ecdsa", 0600)
+	if data, err := fetchPrivateKeyFromHomeDir(proxyConf, "alice"); err != nil || string(data) != "ecdsa" {
+		t.Errorf("got %q, %v, want id_ecdsa before id_rsa", data, err)
+	}
+}
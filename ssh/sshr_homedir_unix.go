@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package ssh
+
+import (
+	"os"
+	"runtime"
+)
+
+// defaultHome is the home directory template used if HomeLayout.Home is
+// empty.
+func defaultHome() string {
+	if runtime.GOOS == "darwin" {
+		return "/Users/{user}"
+	}
+	return "/home/{user}"
+}
+
+// fileTooOpen reports whether the permissions of f include any of tooOpen.
+func fileTooOpen(f *os.File, tooOpen os.FileMode) (bool, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	return fi.Mode().Perm()&tooOpen != 0, nil
+}
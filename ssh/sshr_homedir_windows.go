@@ -0,0 +1,121 @@
+//go:build windows
+// +build windows
+
+package ssh
+
+import (
+	"encoding/binary"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// defaultHome is the home directory template used if HomeLayout.Home is
+// empty.
+func defaultHome() string {
+	drive := os.Getenv("SystemDrive")
+	if drive == "" {
+		drive = "C:"
+	}
+	return drive + `\Users\{user}`
+}
+
+// Layout of the access control entries of a DACL, which follow its
+// 8-byte header.
+const (
+	aclHeaderSize        = 8
+	accessAllowedACEType = 0
+	inheritOnlyACE       = 0x08
+
+	fileWriteData  = 0x0002 // or FILE_ADD_FILE for directories
+	fileAppendData = 0x0004 // or FILE_ADD_SUBDIRECTORY
+	writeAccess    = fileWriteData | fileAppendData | windows.WRITE_DAC | windows.WRITE_OWNER |
+		windows.GENERIC_WRITE | windows.GENERIC_ALL
+)
+
+type aceHeader struct {
+	Type  byte
+	Flags byte
+	Size  uint16
+}
+
+type accessAllowedACE struct {
+	Header   aceHeader
+	Mask     uint32
+	SidStart uint32
+}
+
+// fileTooOpen reports whether the DACL of f grants others than its owner,
+// SYSTEM, the Administrators and the account of the proxy the access
+// tooOpen stands for: any access if it includes read permission for the
+// group or others, or else write access.
+func fileTooOpen(f *os.File, tooOpen os.FileMode) (bool, error) {
+	sd, err := windows.GetSecurityInfo(windows.Handle(f.Fd()), windows.SE_FILE_OBJECT,
+		windows.OWNER_SECURITY_INFORMATION|windows.DACL_SECURITY_INFORMATION)
+	if err != nil {
+		return false, err
+	}
+	owner, _, err := sd.Owner()
+	if err != nil {
+		return false, err
+	}
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return false, err
+	}
+	if dacl == nil {
+		// A NULL DACL grants everyone full access.
+		return true, nil
+	}
+	trusted, err := trustedSIDs(owner)
+	if err != nil {
+		return false, err
+	}
+
+	mask := uint32(writeAccess)
+	if tooOpen&0044 != 0 {
+		mask = ^uint32(0)
+	}
+	header := (*[aclHeaderSize]byte)(unsafe.Pointer(dacl))
+	count := binary.LittleEndian.Uint16(header[4:6])
+	offset := uintptr(aclHeaderSize)
+	for i := uint16(0); i < count; i++ {
+		ace := (*accessAllowedACE)(unsafe.Pointer(uintptr(unsafe.Pointer(dacl)) + offset))
+		if ace.Header.Type == accessAllowedACEType && ace.Header.Flags&inheritOnlyACE == 0 && ace.Mask&mask != 0 {
+			sid := (*windows.SID)(unsafe.Pointer(&ace.SidStart))
+			if !containsSID(trusted, sid) {
+				return true, nil
+			}
+		}
+		offset += uintptr(ace.Header.Size)
+	}
+	return false, nil
+}
+
+// trustedSIDs returns the accounts that may access key files: owner,
+// SYSTEM, the Administrators and the account of the proxy.
+func trustedSIDs(owner *windows.SID) ([]*windows.SID, error) {
+	sids := []*windows.SID{owner}
+	for _, t := range []windows.WELL_KNOWN_SID_TYPE{windows.WinLocalSystemSid, windows.WinBuiltinAdministratorsSid} {
+		sid, err := windows.CreateWellKnownSid(t)
+		if err != nil {
+			return nil, err
+		}
+		sids = append(sids, sid)
+	}
+	user, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		return nil, err
+	}
+	return append(sids, user.User.Sid), nil
+}
+
+func containsSID(sids []*windows.SID, sid *windows.SID) bool {
+	for _, s := range sids {
+		if s.Equals(sid) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// HookMetadata describes the downstream connection a ProxyConfig context
+// hook is called for, so decisions can depend on more than the username.
+// The hooks that take a HookMetadata get it: the context variants of the
+// fetch and password hooks, RouteUpstreamHook and VerifyPasswordHook.
+// Hooks that take only a username, such as FindUpstreamHook, do not; the
+// context variants replace them. Other hooks that take a context during
+// authentication, such as ApprovalHook, find it with
+// HookMetadataFromContext.
+type HookMetadata struct {
+	User          string
+	RemoteAddr    net.Addr
+	SessionID     []byte
+	ClientVersion []byte
+	// Key is the public key offered by the downstream client, or nil.
+	Key PublicKey
+}
+
+// HookMetadata returns the metadata of the downstream connection c for req,
+// as returned by GetAuthRequestMsg, to pass to ProxyConfig.FindUpstream.
+func (c *connection) HookMetadata(req *userAuthRequestMsg) HookMetadata {
+	meta := HookMetadata{
+		User:          req.User,
+		RemoteAddr:    c.RemoteAddr(),
+		SessionID:     c.SessionID(),
+		ClientVersion: c.ClientVersion(),
+	}
+	if req.Method == "publickey" {
+		if key, _, _, err := parsePublicKeyMsg(req); err == nil {
+			meta.Key = key
+		}
+	}
+	return meta
+}
+
+func (p *ProxyConn) hookMetadata(key PublicKey) HookMetadata {
+	return HookMetadata{
+		User:          p.User,
+		RemoteAddr:    p.Downstream.RemoteAddr(),
+		SessionID:     p.Downstream.SessionID(),
+		ClientVersion: p.Downstream.ClientVersion(),
+		Key:           key,
+	}
+}
+
+type hookMetadataKey struct{}
+
+func withHookMetadata(ctx context.Context, meta HookMetadata) context.Context {
+	return context.WithValue(ctx, hookMetadataKey{}, meta)
+}
+
+// HookMetadataFromContext returns the metadata of the downstream connection
+// that the context of a hook belongs to, if any.
+func HookMetadataFromContext(ctx context.Context) (HookMetadata, bool) {
+	meta, ok := ctx.Value(hookMetadataKey{}).(HookMetadata)
+	return meta, ok
+}
+
+// FindUpstream returns the upstream host for the connection described by
+// meta from FindUpstreamContextHook or FindUpstreamHook.
+func (conf *ProxyConfig) FindUpstream(ctx context.Context, meta HookMetadata) (string, error) {
+	if conf.FindUpstreamContextHook != nil {
+		return conf.FindUpstreamContextHook(ctx, meta)
+	}
+	if conf.FindUpstreamHook == nil {
+		return "", errors.New("ssh: no FindUpstreamHook configured")
+	}
+	return conf.FindUpstreamHook(meta.User)
+}
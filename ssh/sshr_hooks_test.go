@@ -0,0 +1,100 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"golang.org/x/crypto/ssh/testdata"
+)
+
+func TestProxyFindUpstream(t *testing.T) {
+	type key struct{}
+	conf := &ProxyConfig{
+		FindUpstreamHook: func(username string) (string, error) { return "plain", nil },
+	}
+	if host, err := conf.FindUpstream(context.Background(), HookMetadata{User: "alice"}); err != nil || host != "plain" {
+		t.Errorf("got %q, %v; want the plain hook's host", host, err)
+	}
+	conf.FindUpstreamContextHook = func(ctx context.Context, meta HookMetadata) (string, error) {
+		return ctx.Value(key{}).(string) + "-" + meta.User, nil
+	}
+	ctx := context.WithValue(context.Background(), key{}, "from-context")
+	if host, err := conf.FindUpstream(ctx, HookMetadata{User: "alice"}); err != nil || host != "from-context-alice" {
+		t.Errorf("got %q, %v; want the context hook's host", host, err)
+	}
+}
+
+func TestProxyHookMetadata(t *testing.T) {
+	var keysMeta, privMeta HookMetadata
+	proxyConf := newTestProxyConfig()
+	proxyConf.FetchAuthorizedKeysContextHook = func(ctx context.Context, meta HookMetadata) ([]byte, error) {
+		keysMeta = meta
+		return MarshalAuthorizedKey(testPublicKeys["ecdsa"]), nil
+	}
+	proxyConf.FetchPrivateKeyContextHook = func(ctx context.Context, meta HookMetadata) ([]byte, error) {
+		privMeta = meta
+		return testdata.PEMBytes["rsa"], nil
+	}
+	const version = "SSH-2.0-metadata-test"
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User:          "testuser",
+		Auth:          []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+		ClientVersion: version,
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+
+	for name, meta := range map[string]HookMetadata{"authorized keys": keysMeta, "private key": privMeta} {
+		if meta.User != "testuser" || meta.RemoteAddr == nil || string(meta.ClientVersion) != version {
+			t.Errorf("%s hook: got metadata %+v", name, meta)
+		}
+		if !bytes.Equal(meta.SessionID, res.conn.Downstream.SessionID()) {
+			t.Errorf("%s hook: got session ID %x, want %x", name, meta.SessionID, res.conn.Downstream.SessionID())
+		}
+		if meta.Key == nil || !bytes.Equal(meta.Key.Marshal(), testPublicKeys["ecdsa"].Marshal()) {
+			t.Errorf("%s hook: got key %v, want the offered one", name, meta.Key)
+		}
+	}
+}
+
+func TestProxyUpstreamPasswordContextHook(t *testing.T) {
+	var meta HookMetadata
+	proxyConf := newRejectedKeyProxyConfig()
+	proxyConf.UpstreamPasswordHook = func(username string, methods []string) (string, error) {
+		t.Error("plain hook called although the context hook is set")
+		return "", nil
+	}
+	proxyConf.UpstreamPasswordContextHook = func(ctx context.Context, m HookMetadata, username string, methods []string) (string, error) {
+		meta = m
+		return upstreamPassword, nil
+	}
+	var approvalMeta HookMetadata
+	proxyConf.ApprovalHook = func(ctx context.Context, req ApprovalRequest) error {
+		approvalMeta, _ = HookMetadataFromContext(ctx)
+		return nil
+	}
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+
+	if meta.User != "testuser" || meta.RemoteAddr == nil {
+		t.Errorf("password hook: got metadata %+v", meta)
+	}
+	if meta.Key == nil || !bytes.Equal(meta.Key.Marshal(), testPublicKeys["ecdsa"].Marshal()) {
+		t.Errorf("password hook: got key %v, want the offered one", meta.Key)
+	}
+	if approvalMeta.User != "testuser" || approvalMeta.RemoteAddr == nil {
+		t.Errorf("approval hook: got metadata %+v from the context", approvalMeta)
+	}
+	if got := runHello(t, client); got != "hello" {
+		t.Errorf("got output %q, want %q", got, "hello")
+	}
+}
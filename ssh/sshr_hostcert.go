@@ -0,0 +1,122 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// hostCertCheckInterval is how often a HostCertSigner looks for a rotated
+// certificate file.
+const hostCertCheckInterval = 10 * time.Second
+
+// HostCertSigner presents an OpenSSH host certificate downstream, so that
+// clients with a @cert-authority line in their known_hosts trust the proxy
+// without being prompted. The certificate file is read again when it has
+// changed, checked at most every 10 seconds while handshakes use the
+// signer, so rotated certificates are picked up without a restart. Add it
+// to the ServerConfig with AddHostKey, next to or in place of the plain
+// host key.
+type HostCertSigner struct {
+	key  Signer
+	path string
+
+	checkInterval time.Duration
+
+	mu      sync.Mutex
+	signer  Signer
+	modTime time.Time
+	size    int64
+	checked time.Time
+}
+
+// NewHostCertSigner returns a HostCertSigner for the host key and the
+// certificate of its public key in the file at path, typically
+// /etc/ssh/ssh_host_ed25519_key-cert.pub.
+func NewHostCertSigner(key Signer, path string) (*HostCertSigner, error) {
+	s := &HostCertSigner{key: key, path: path, checkInterval: hostCertCheckInterval}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the certificate file again. If it fails, the previous
+// certificate stays in use. Failures of the automatic reloads are not
+// reported, so call Reload after rotating the file to learn about them.
+func (s *HostCertSigner) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checked = time.Now()
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	return s.load(fi)
+}
+
+func (s *HostCertSigner) load(fi os.FileInfo) error {
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	pub, _, _, _, err := ParseAuthorizedKey(b)
+	if err != nil {
+		return fmt.Errorf("ssh: %s: %v", s.path, err)
+	}
+	cert, ok := pub.(*Certificate)
+	if !ok {
+		return fmt.Errorf("ssh: %s is not a certificate", s.path)
+	}
+	if cert.CertType != HostCert {
+		return fmt.Errorf("ssh: %s is not a host certificate", s.path)
+	}
+	signer, err := NewCertSigner(cert, s.key)
+	if err != nil {
+		return fmt.Errorf("ssh: %s: %v", s.path, err)
+	}
+	s.signer, s.modTime, s.size = signer, fi.ModTime(), fi.Size()
+	return nil
+}
+
+// current returns the signer for the certificate, after reading the file
+// again if it changed since the last check.
+func (s *HostCertSigner) current() Signer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.checked) >= s.checkInterval {
+		s.checked = time.Now()
+		if fi, err := os.Stat(s.path); err == nil && (!fi.ModTime().Equal(s.modTime) || fi.Size() != s.size) {
+			s.load(fi)
+		}
+	}
+	return s.signer
+}
+
+// Certificate returns the certificate currently presented.
+func (s *HostCertSigner) Certificate() *Certificate {
+	return s.current().PublicKey().(*Certificate)
+}
+
+func (s *HostCertSigner) PublicKey() PublicKey {
+	return s.current().PublicKey()
+}
+
+func (s *HostCertSigner) Sign(rand io.Reader, data []byte) (*Signature, error) {
+	return s.key.Sign(rand, data)
+}
+
+// SignWithAlgorithm signs with the given algorithm if the host key is an
+// AlgorithmSigner, which is needed for rsa-sha2 host certificates.
+func (s *HostCertSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*Signature, error) {
+	if as, ok := s.key.(AlgorithmSigner); ok {
+		return as.SignWithAlgorithm(rand, data, algorithm)
+	}
+	if algorithm == "" || algorithm == s.key.PublicKey().Type() {
+		return s.key.Sign(rand, data)
+	}
+	return nil, errors.New("ssh: host key cannot sign with " + algorithm)
+}
@@ -0,0 +1,113 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeHostCert(t *testing.T, path string, key PublicKey, certType uint32, serial uint64) {
+	cert := &Certificate{
+		Key:             key,
+		Serial:          serial,
+		KeyId:           fmt.Sprint(serial),
+		CertType:        certType,
+		ValidPrincipals: []string{"proxy"},
+		ValidBefore:     CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, testSigners["ca"]); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, MarshalAuthorizedKey(cert), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProxyHostCert(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ssh_host_rsa_key-cert.pub")
+	writeHostCert(t, path, testPublicKeys["rsa"], HostCert, 1)
+	signer, err := NewHostCertSigner(testSigners["rsa"], path)
+	if err != nil {
+		t.Fatalf("NewHostCertSigner: %v", err)
+	}
+	signer.checkInterval = 0
+
+	proxyConf := newTestProxyConfig()
+	proxyConf.ServerConfig = &ServerConfig{}
+	proxyConf.ServerConfig.AddHostKey(signer)
+
+	var serials []uint64
+	checker := &CertChecker{
+		IsHostAuthority: func(auth PublicKey, address string) bool {
+			return bytes.Equal(auth.Marshal(), testPublicKeys["ca"].Marshal())
+		},
+	}
+	dial := func() {
+		t.Helper()
+		client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+			User: "testuser",
+			Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+			HostKeyCallback: func(hostname string, remote net.Addr, key PublicKey) error {
+				if cert, ok := key.(*Certificate); ok {
+					serials = append(serials, cert.Serial)
+				}
+				return checker.CheckHostKey(hostname+":22", remote, key)
+			},
+		})
+		if err != nil {
+			t.Fatalf("client: %v, proxy: %v", err, res.err)
+		}
+		client.Close()
+	}
+
+	dial()
+	// Rotate the certificate. The new one has a longer key ID, so the size
+	// changes even if the modification time has a coarse resolution.
+	writeHostCert(t, path, testPublicKeys["rsa"], HostCert, 22)
+	dial()
+	if len(serials) != 2 || serials[0] != 1 || serials[1] != 22 {
+		t.Errorf("got certificate serials %v, want [1 22]", serials)
+	}
+	if got := signer.Certificate().Serial; got != 22 {
+		t.Errorf("got serial %d, want 22", got)
+	}
+}
+
+func TestHostCertSignerInvalid(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name     string
+		key      PublicKey
+		certType uint32
+		want     string
+	}{
+		{"user", testPublicKeys["rsa"], UserCert, "not a host certificate"},
+		{"other key", testPublicKeys["ecdsa"], HostCert, "different public key"},
+	} {
+		path := filepath.Join(dir, tc.name)
+		writeHostCert(t, path, tc.key, tc.certType, 1)
+		if _, err := NewHostCertSigner(testSigners["rsa"], path); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v, want %q", tc.name, err, tc.want)
+		}
+	}
+
+	// A broken rotation keeps the previous certificate.
+	path := filepath.Join(dir, "cert")
+	writeHostCert(t, path, testPublicKeys["rsa"], HostCert, 7)
+	signer, err := NewHostCertSigner(testSigners["rsa"], path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(path, []byte("garbage\n"), 0600)
+	if err := signer.Reload(); err == nil {
+		t.Error("Reload accepted a broken file")
+	}
+	if got := signer.Certificate().Serial; got != 7 {
+		t.Errorf("got serial %d after a failed reload, want 7", got)
+	}
+}
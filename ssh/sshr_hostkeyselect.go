@@ -0,0 +1,25 @@
+package ssh
+
+import (
+	"errors"
+	"net"
+)
+
+// selectHostKeys replaces the host keys of config, the copy made for the
+// connection c, with those chosen by HostKeySelectionHook.
+func (config *ServerConfig) selectHostKeys(c net.Conn, clientVersion []byte) error {
+	if config.HostKeySelectionHook == nil {
+		return nil
+	}
+	keys, err := config.HostKeySelectionHook(c, clientVersion)
+	if err != nil {
+		return err
+	}
+	if keys != nil {
+		config.hostKeys = keys
+	}
+	if len(config.hostKeys) == 0 {
+		return errors.New("ssh: server has no host keys")
+	}
+	return nil
+}
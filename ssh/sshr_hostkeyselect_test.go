@@ -0,0 +1,72 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+// routedConn carries the bastion a connection was routed to, as a
+// PreHandshakeHook that parses a PROXY protocol header might record it.
+type routedConn struct {
+	net.Conn
+	bastion string
+}
+
+func TestProxyHostKeySelectionHook(t *testing.T) {
+	identities := map[string]Signer{"a": testSigners["ecdsa"], "b": testSigners["ed25519"]}
+	bastion := "a"
+	proxyConf := newTestProxyConfig()
+	proxyConf.ServerConfig = &ServerConfig{
+		PreHandshakeHook: func(c net.Conn) (net.Conn, error) {
+			return &routedConn{c, bastion}, nil
+		},
+		HostKeySelectionHook: func(c net.Conn, clientVersion []byte) ([]Signer, error) {
+			key, ok := identities[c.(*routedConn).bastion]
+			if !ok {
+				return nil, errors.New("unknown bastion")
+			}
+			return []Signer{key}, nil
+		},
+	}
+
+	for _, name := range []string{"a", "b"} {
+		bastion = name
+		var got PublicKey
+		client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+			User: "testuser",
+			Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+			HostKeyCallback: func(hostname string, remote net.Addr, key PublicKey) error {
+				got = key
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatalf("%s: client: %v, proxy: %v", name, err, res.err)
+		}
+		client.Close()
+		if want := identities[name].PublicKey(); got == nil || !bytes.Equal(got.Marshal(), want.Marshal()) {
+			t.Errorf("bastion %s presented the wrong host key", name)
+		}
+	}
+}
+
+func TestHostKeySelectionHookError(t *testing.T) {
+	serverConf := &ServerConfig{
+		NoClientAuth: true,
+		HostKeySelectionHook: func(c net.Conn, clientVersion []byte) ([]Signer, error) {
+			return nil, errors.New("unknown bastion")
+		},
+	}
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	go NewClientConn(c2, "", &ClientConfig{HostKeyCallback: InsecureIgnoreHostKey()})
+	if _, _, _, err := NewServerConn(c1, serverConf); err == nil || err.Error() != "unknown bastion" {
+		t.Errorf("got %v, want the error of the hook", err)
+	}
+}
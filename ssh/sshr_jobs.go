@@ -0,0 +1,104 @@
+package ssh
+
+import (
+	"sync"
+	"time"
+)
+
+// LeaderElector grants the lease of a named job to at most one node of a
+// cluster at a time. Implementations are usually backed by the same shared
+// store as the SessionRegistry.
+type LeaderElector interface {
+	// Acquire acquires or renews the lease on name for node, for ttl. It
+	// reports whether node holds the lease afterwards.
+	Acquire(name, node string, ttl time.Duration) (bool, error)
+
+	// Release gives up the lease on name if node holds it.
+	Release(name, node string) error
+}
+
+// JobScheduler runs periodic background jobs, such as health checks or
+// upload retries, on exactly one node of a cluster. Before every run the
+// node must hold the job's lease; a lease that is not renewed expires after
+// two intervals, so another node takes over when the leader goes away.
+type JobScheduler struct {
+	// Elector grants job leases. If nil, every job runs on this node.
+	Elector LeaderElector
+
+	// Node identifies this node to the Elector.
+	Node string
+
+	// ErrorHook, if non-nil, is called when the Elector fails.
+	ErrorHook func(job string, err error)
+
+	mu      sync.Mutex
+	stop    chan struct{}
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// Schedule runs fn every interval, as long as this node is the leader for
+// name. Jobs run until Stop is called.
+func (s *JobScheduler) Schedule(name string, interval time.Duration, fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	if s.stop == nil {
+		s.stop = make(chan struct{})
+	}
+
+	s.wg.Add(1)
+	go s.run(name, interval, fn, s.stop)
+}
+
+func (s *JobScheduler) run(name string, interval time.Duration, fn func(), stop <-chan struct{}) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	leader := false
+	defer func() {
+		if leader {
+			s.Elector.Release(name, s.Node)
+		}
+	}()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if s.Elector != nil {
+			var err error
+			leader, err = s.Elector.Acquire(name, s.Node, 2*interval)
+			if err != nil {
+				leader = false
+				if s.ErrorHook != nil {
+					s.ErrorHook(name, err)
+				}
+			}
+			if !leader {
+				continue
+			}
+		}
+		fn()
+	}
+}
+
+// Stop stops all jobs, releases their leases and waits for running jobs to
+// return.
+func (s *JobScheduler) Stop() {
+	s.mu.Lock()
+	if !s.stopped {
+		s.stopped = true
+		if s.stop != nil {
+			close(s.stop)
+		}
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
@@ -0,0 +1,61 @@
+package ssh
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testElector is an in-memory LeaderElector without lease expiry.
+type testElector struct {
+	mu      sync.Mutex
+	holders map[string]string
+}
+
+func (e *testElector) Acquire(name, node string, ttl time.Duration) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.holders == nil {
+		e.holders = make(map[string]string)
+	}
+	if holder, ok := e.holders[name]; ok && holder != node {
+		return false, nil
+	}
+	e.holders[name] = node
+	return true, nil
+}
+
+func (e *testElector) Release(name, node string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.holders[name] == node {
+		delete(e.holders, name)
+	}
+	return nil
+}
+
+func TestJobSchedulerSingleLeader(t *testing.T) {
+	elector := &testElector{}
+	var runs [2]int32
+	var schedulers [2]*JobScheduler
+	for i := range schedulers {
+		i := i
+		schedulers[i] = &JobScheduler{Elector: elector, Node: string(rune('a' + i))}
+		schedulers[i].Schedule("sync", time.Millisecond, func() {
+			atomic.AddInt32(&runs[i], 1)
+		})
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	a, b := atomic.LoadInt32(&runs[0]), atomic.LoadInt32(&runs[1])
+	schedulers[0].Stop()
+	schedulers[1].Stop()
+
+	if (a == 0) == (b == 0) {
+		t.Errorf("got %d and %d runs, want exactly one node to run the job", a, b)
+	}
+	if len(elector.holders) != 0 {
+		t.Errorf("leases not released on Stop: %v", elector.holders)
+	}
+}
@@ -0,0 +1,163 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JumpHost is a host the upstream is reached through, like a ProxyJump
+// host of OpenSSH: the proxy logs in to it and opens a direct-tcpip channel
+// from it to the next hop.
+type JumpHost struct {
+	Host string
+	// Port is 22 if zero.
+	Port int
+	// User is the route's user if empty.
+	User string
+	// ClientConfig authenticates the proxy to the jump host. If nil,
+	// ProxyConfig.JumpClientConfig is used, or else ProxyConfig.ClientConfig
+	// with the master keys.
+	ClientConfig *ClientConfig
+}
+
+// Address returns the host and port to dial.
+func (j *JumpHost) Address() string {
+	return net.JoinHostPort(j.Host, strconv.Itoa(j.Port))
+}
+
+// parseJumpChain splits a chain of hops in the form of OpenSSH's
+// ProxyJump, "[user@]host[:port],...,target", into its jump hosts and the
+// target.
+func parseJumpChain(chain string) ([]*JumpHost, string, error) {
+	hops := strings.Split(chain, ",")
+	var jumps []*JumpHost
+	for _, hop := range hops[:len(hops)-1] {
+		j := &JumpHost{Host: hop}
+		if i := strings.LastIndex(hop, "@"); i >= 0 {
+			j.User, j.Host = hop[:i], hop[i+1:]
+		}
+		if host, port, err := net.SplitHostPort(j.Host); err == nil {
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				return nil, "", fmt.Errorf("ssh: invalid port in jump host %q", hop)
+			}
+			j.Host, j.Port = host, p
+		}
+		if j.Host == "" {
+			return nil, "", fmt.Errorf("ssh: invalid jump host %q", hop)
+		}
+		jumps = append(jumps, j)
+	}
+	return jumps, hops[len(hops)-1], nil
+}
+
+// setJumpDefaults fills in the unset fields of the jump hosts of route.
+func (conf *ProxyConfig) setJumpDefaults(ctx context.Context, route *UpstreamRoute) {
+	for i, j := range route.Jumps {
+		jump := *j
+		if jump.Port == 0 {
+			jump.Port = 22
+		}
+		if jump.User == "" {
+			jump.User = route.User
+		}
+		if jump.ClientConfig == nil {
+			jump.ClientConfig = conf.jumpClientConfig(ctx, jump.Host)
+		}
+		if jump.ClientConfig != nil {
+			clientConf := *jump.ClientConfig
+			clientConf.User = jump.User
+			if conf.UpstreamHostKeyCallback != nil {
+				clientConf.HostKeyCallback = upstreamHostKeyCallback(conf.UpstreamHostKeyCallback, jump.Address())
+			}
+			jump.ClientConfig = &clientConf
+		}
+		route.Jumps[i] = &jump
+	}
+}
+
+// jumpClientConfig returns the config to log in to the jump host with by
+// default.
+func (conf *ProxyConfig) jumpClientConfig(ctx context.Context, host string) *ClientConfig {
+	if conf.JumpClientConfig != nil {
+		return conf.JumpClientConfig
+	}
+	if conf.ClientConfig == nil {
+		return nil
+	}
+	clientConf := *conf.ClientConfig
+	clientConf.Auth = []AuthMethod{PublicKeysCallback(func() ([]Signer, error) {
+		return conf.masterKeys(ctx, host)
+	})}
+	return &clientConf
+}
+
+var errNoJumpConfig = errors.New("ssh: no client config for jump host")
+
+// Dial connects to the upstream of r with dial, through its jump hosts if
+// it has any. Closing the connection also closes those to the jump hosts.
+func (r *UpstreamRoute) Dial(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error)) (net.Conn, error) {
+	if len(r.Jumps) == 0 {
+		return dial(ctx, "tcp", r.Address())
+	}
+
+	jc := &jumpConn{}
+	next := dial
+	for _, j := range r.Jumps {
+		if j.ClientConfig == nil {
+			jc.closeClients()
+			return nil, errNoJumpConfig
+		}
+		c, err := next(ctx, "tcp", j.Address())
+		if err != nil {
+			jc.closeClients()
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			c.SetDeadline(deadline)
+		}
+		conn, chans, reqs, err := NewClientConn(c, j.Address(), j.ClientConfig)
+		if err != nil {
+			c.Close()
+			jc.closeClients()
+			return nil, fmt.Errorf("ssh: jump host %s: %v", j.Address(), err)
+		}
+		c.SetDeadline(time.Time{})
+		client := NewClient(conn, chans, reqs)
+		jc.clients = append(jc.clients, client)
+		next = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return client.Dial(network, addr)
+		}
+	}
+	c, err := next(ctx, "tcp", r.Address())
+	if err != nil {
+		jc.closeClients()
+		return nil, err
+	}
+	jc.Conn = c
+	return jc, nil
+}
+
+// jumpConn is a connection forwarded through jump hosts.
+type jumpConn struct {
+	net.Conn
+	clients []*Client
+}
+
+func (c *jumpConn) Close() error {
+	err := c.Conn.Close()
+	c.closeClients()
+	return err
+}
+
+// closeClients closes the connections to the jump hosts, the last first.
+func (c *jumpConn) closeClients() {
+	for i := len(c.clients) - 1; i >= 0; i-- {
+		c.clients[i].Close()
+	}
+}
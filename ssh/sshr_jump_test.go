@@ -0,0 +1,111 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseJumpChain(t *testing.T) {
+	jumps, target, err := parseJumpChain("alice@bastion:2222,jump2,db.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*JumpHost{{Host: "bastion", Port: 2222, User: "alice"}, {Host: "jump2"}}
+	if !reflect.DeepEqual(jumps, want) || target != "db.internal" {
+		t.Errorf("got %+v, %q", jumps, target)
+	}
+	if _, _, err := parseJumpChain("bastion:ssh,db.internal"); err == nil {
+		t.Error("parsed a jump host with a named port")
+	}
+}
+
+// serveTestJumpHost accepts a single connection from a user of the ed25519
+// test key and forwards direct-tcpip channels to "upstream:22" to a new
+// serveTestUpstream. The user is sent on users.
+func serveTestJumpHost(c net.Conn, users chan<- string) {
+	config := &ServerConfig{
+		PublicKeyCallback: func(conn ConnMetadata, key PublicKey) (*Permissions, error) {
+			if bytes.Equal(key.Marshal(), testPublicKeys["ed25519"].Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("pubkey not acceptable")
+		},
+	}
+	config.AddHostKey(testSigners["ecdsa"])
+	conn, chans, reqs, err := NewServerConn(c, config)
+	if err != nil {
+		return
+	}
+	users <- conn.User()
+	go DiscardRequests(reqs)
+	for newCh := range chans {
+		var data tcpipOpenData
+		if newCh.ChannelType() != "direct-tcpip" || Unmarshal(newCh.ExtraData(), &data) != nil || data.Host != "upstream" || data.Port != 22 {
+			newCh.Reject(ConnectionFailed, "unknown destination")
+			continue
+		}
+		ch, reqs, err := newCh.Accept()
+		if err != nil {
+			return
+		}
+		go DiscardRequests(reqs)
+		u1, u2, err := netPipe()
+		if err != nil {
+			return
+		}
+		go serveTestUpstream(u1, newTestUpstreamConfig())
+		go func() {
+			defer ch.Close()
+			defer u2.Close()
+			go io.Copy(u2, ch)
+			io.Copy(ch, u2)
+		}()
+	}
+}
+
+func TestProxyServerJumpHosts(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.DestinationPort = 22
+	proxyConf.MasterKeySigner = testSigners["ed25519"]
+	proxyConf.FindUpstreamHook = func(username string) (string, error) {
+		return "jumper@jump1,upstream", nil
+	}
+	users := make(chan string, 1)
+	s := &ProxyServer{
+		Config: proxyConf,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr != "jump1:22" {
+				return nil, errors.New("unreachable")
+			}
+			j1, j2, err := netPipe()
+			if err != nil {
+				return nil, err
+			}
+			go serveTestJumpHost(j1, users)
+			return j2, nil
+		},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	client, err := dialTestProxyServer(l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+	if got := <-users; got != "jumper" {
+		t.Errorf("jump host login as %q, want jumper", got)
+	}
+	if got := runHello(t, client); got != "hello" {
+		t.Errorf("got output %q, want hello", got)
+	}
+}
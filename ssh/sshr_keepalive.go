@@ -0,0 +1,131 @@
+package ssh
+
+import (
+	"sync"
+	"time"
+)
+
+// keepaliveRequest is the global request the proxy probes its peers with.
+const keepaliveRequest = "keepalive@openssh.com"
+
+// globalReplies matches the replies of a peer to the global requests sent to
+// it. Replies come in the order of the requests, so the proxy's keepalives
+// are told apart from the requests it relayed by their position.
+type globalReplies struct {
+	mu sync.Mutex
+	// pending holds, for every request awaiting a reply, whether it is a
+	// keepalive of the proxy.
+	pending []bool
+	// missed counts the keepalives sent since the peer last replied.
+	missed int
+}
+
+// send writes a global request to t, queueing its reply if it wants one.
+func (g *globalReplies) send(t packetConn, packet []byte, keepalive bool) error {
+	var msg globalRequestMsg
+	wantReply := keepalive || Unmarshal(packet, &msg) == nil && msg.WantReply
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := t.writePacket(packet); err != nil {
+		return err
+	}
+	if wantReply {
+		g.pending = append(g.pending, keepalive)
+	}
+	return nil
+}
+
+// probe sends a keepalive to t unless count of them are unanswered already,
+// in which case it reports false.
+func (g *globalReplies) probe(t packetConn, count int) (bool, error) {
+	g.mu.Lock()
+	missed := g.missed
+	g.missed++
+	g.mu.Unlock()
+	if missed >= count {
+		return false, nil
+	}
+	return true, g.send(t, Marshal(&globalRequestMsg{Type: keepaliveRequest, WantReply: true}), true)
+}
+
+// reply records a reply of the peer and reports whether it answers a
+// keepalive, which must not be relayed.
+func (g *globalReplies) reply() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.missed = 0
+	if len(g.pending) == 0 {
+		return false
+	}
+	keepalive := g.pending[0]
+	g.pending = g.pending[1:]
+	return keepalive
+}
+
+// keepalives reports whether the peers are probed with keepalives.
+func (p *ProxyConn) keepalives() bool {
+	return p.config != nil && p.config.KeepaliveInterval > 0
+}
+
+// replies returns the replies owed by the peer packets travelling in dir are
+// sent to.
+func (p *ProxyConn) replies(dir relayDirection) *globalReplies {
+	if dir == toUpstream {
+		return &p.upstreamReplies
+	}
+	return &p.downstreamReplies
+}
+
+// filterKeepaliveReply reports whether packet, relayed in dir, is the reply
+// to a keepalive of the proxy.
+func (p *ProxyConn) filterKeepaliveReply(dir relayDirection, packet []byte) bool {
+	if packet[0] != msgRequestSuccess && packet[0] != msgRequestFailure {
+		return false
+	}
+	// Replies travelling downstream come from the upstream.
+	from := toDownstream
+	if dir == toDownstream {
+		from = toUpstream
+	}
+	return p.replies(from).reply()
+}
+
+// watchKeepalives probes the downstream client and the upstream server every
+// ProxyConfig.KeepaliveInterval, until done is closed. Once KeepaliveCountMax
+// probes of either are unanswered, the peer is considered dead and the
+// session is torn down.
+func (p *ProxyConn) watchKeepalives(done <-chan struct{}) {
+	count := p.config.KeepaliveCountMax
+	if count <= 0 {
+		count = 3
+	}
+	ticker := time.NewTicker(p.config.KeepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		alive, err := p.upstreamReplies.probe(p.Upstream.transport, count)
+		if err != nil {
+			return
+		}
+		if !alive {
+			p.log(LogWarn, "upstream not responding", "keepalives", count)
+			p.disconnect(disconnectByApplication, "upstream not responding")
+			return
+		}
+		alive, err = p.downstreamReplies.probe(p.Downstream.transport, count)
+		if err != nil {
+			return
+		}
+		if !alive {
+			p.log(LogWarn, "client not responding", "keepalives", count)
+			p.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package ssh
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProxyKeepalives(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.KeepaliveInterval = 20 * time.Millisecond
+	proxyConf.KeepaliveCountMax = 2
+	client := dialTimeoutTestProxy(t, proxyConf)
+
+	// The client relays its own keepalives while the proxy probes both ends.
+	for i := 0; i < 10; i++ {
+		if _, _, err := client.SendRequest(keepaliveRequest, true, nil); err != nil {
+			t.Fatalf("SendRequest: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := runHello(t, client); got != "hello" {
+		t.Errorf("got output %q, want %q", got, "hello")
+	}
+}
+
+func TestProxyKeepaliveDeadClient(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.KeepaliveInterval = 20 * time.Millisecond
+	proxyConf.KeepaliveCountMax = 2
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	done := make(chan proxyTestResult, 1)
+	go runTestProxy(c1, proxyConf, newTestUpstreamConfig(), done)
+
+	// The global requests of the proxy are never answered.
+	conn, chans, _, err := NewClientConn(c2, "proxy", &ClientConfig{
+		User:            "testuser",
+		Auth:            []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	go func() {
+		for ch := range chans {
+			ch.Reject(Prohibited, "")
+		}
+	}()
+	if res := <-done; res.err != nil {
+		t.Fatalf("proxy: %v", res.err)
+	}
+
+	c := make(chan error, 1)
+	go func() { c <- conn.Wait() }()
+	select {
+	case <-c:
+	case <-time.After(10 * time.Second):
+		t.Fatal("dead client was not disconnected")
+	}
+}
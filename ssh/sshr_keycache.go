@@ -0,0 +1,114 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// KeyCache caches the results of the authorized keys and private key fetch
+// hooks in memory, so that bursts of logins, for example from CI systems,
+// do not each reach the backing store. Concurrent fetches for the same user
+// share one hook call. Set it as ProxyConfig.KeyCache; the zero value caches
+// results for a minute and does not cache failures.
+type KeyCache struct {
+	// TTL is how long results are cached, one minute if zero.
+	TTL time.Duration
+	// NegativeTTL is how long failures, such as unknown users, are cached.
+	// If zero, they are not.
+	NegativeTTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*keyCacheEntry
+	calls   map[string]*keyCacheCall
+	// gen is incremented by Invalidate and Purge, so that results of
+	// calls in flight are not cached.
+	gen uint64
+}
+
+type keyCacheEntry struct {
+	data   []byte
+	err    error
+	expiry time.Time
+}
+
+// keyCacheCall is a hook call in flight.
+type keyCacheCall struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// Invalidate drops the cached results of username, for example after its
+// keys were rotated.
+func (c *KeyCache) Invalidate(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, prefix := range []string{"authorized_keys:", "private_key:"} {
+		delete(c.entries, prefix+username)
+	}
+	c.gen++
+}
+
+// Purge drops all cached results.
+func (c *KeyCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+	c.gen++
+}
+
+// fetch returns the result of hook for username under key, from the cache
+// if possible.
+func (c *KeyCache) fetch(key, username string, hook func(string) ([]byte, error)) ([]byte, error) {
+	c.mu.Lock()
+	now := time.Now()
+	if e, ok := c.entries[key]; ok {
+		if now.Before(e.expiry) {
+			c.mu.Unlock()
+			return e.data, e.err
+		}
+		delete(c.entries, key)
+	}
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.data, call.err
+	}
+	call := &keyCacheCall{done: make(chan struct{})}
+	if c.calls == nil {
+		c.calls = make(map[string]*keyCacheCall)
+	}
+	c.calls[key] = call
+	gen := c.gen
+	c.mu.Unlock()
+
+	call.data, call.err = hook(username)
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	if ttl := c.ttl(call.err); ttl > 0 && gen == c.gen {
+		if c.entries == nil {
+			c.entries = make(map[string]*keyCacheEntry)
+		}
+		c.entries[key] = &keyCacheEntry{data: call.data, err: call.err, expiry: time.Now().Add(ttl)}
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return call.data, call.err
+}
+
+// ttl returns how long a result with err is cached.
+func (c *KeyCache) ttl(err error) time.Duration {
+	switch {
+	case err == nil && c.TTL > 0:
+		return c.TTL
+	case err == nil:
+		return defaultHookCacheTTL
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		// The failure is that of the login, not of the user.
+		return 0
+	}
+	return c.NegativeTTL
+}
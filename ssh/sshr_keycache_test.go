@@ -0,0 +1,97 @@
+package ssh
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeyCacheSharesCalls(t *testing.T) {
+	c := &KeyCache{}
+	var calls int32
+	release := make(chan struct{})
+	hook := func(username string) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return []byte("keys of " + username), nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if data, err := c.fetch("authorized_keys:alice", "alice", hook); err != nil || string(data) != "keys of alice" {
+				t.Errorf("got %q, %v", data, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if _, err := c.fetch("authorized_keys:alice", "alice", hook); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("hook called %d times, want once", calls)
+	}
+}
+
+func TestKeyCacheNegativeAndInvalidate(t *testing.T) {
+	c := &KeyCache{NegativeTTL: time.Minute}
+	calls := 0
+	unknown := errors.New("unknown user")
+	hook := func(username string) ([]byte, error) {
+		calls++
+		if username == "mallory" {
+			return nil, unknown
+		}
+		return []byte("key"), nil
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.fetch("authorized_keys:mallory", "mallory", hook); err != unknown {
+			t.Errorf("got %v, want %v", err, unknown)
+		}
+		c.fetch("private_key:alice", "alice", hook)
+	}
+	if calls != 2 {
+		t.Errorf("hook called %d times, want twice", calls)
+	}
+
+	c.Invalidate("alice")
+	c.fetch("private_key:alice", "alice", hook)
+	c.fetch("authorized_keys:mallory", "mallory", hook)
+	if calls != 3 {
+		t.Errorf("hook called %d times after Invalidate, want 3", calls)
+	}
+	c.Purge()
+	c.fetch("authorized_keys:mallory", "mallory", hook)
+	if calls != 4 {
+		t.Errorf("hook called %d times after Purge, want 4", calls)
+	}
+}
+
+func TestProxyKeyCache(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.KeyCache = &KeyCache{}
+	var calls int32
+	fetch := proxyConf.FetchAuthorizedKeysHook
+	proxyConf.FetchAuthorizedKeysHook = func(username string) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		return fetch(username)
+	}
+	for i := 0; i < 2; i++ {
+		client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+			User: "testuser",
+			Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+		})
+		if err != nil {
+			t.Fatalf("client: %v, proxy: %v", err, res.err)
+		}
+		client.Close()
+	}
+	if calls != 1 {
+		t.Errorf("FetchAuthorizedKeysHook called %d times, want once", calls)
+	}
+}
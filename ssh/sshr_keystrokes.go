@@ -0,0 +1,86 @@
+package ssh
+
+import (
+	"bytes"
+	"regexp"
+	"sync"
+)
+
+// DefaultPasswordPrompt matches the end of terminal output that asks for a
+// password, such as the prompts of sudo, su, passwd and ssh, also when they
+// echo asterisks.
+var DefaultPasswordPrompt = regexp.MustCompile(`(?i)(password|passphrase|passcode|pin|secret)[^\n]{0,40}[:?][ *]*$`)
+
+// redactedInput is recorded in place of what was typed at a password
+// prompt, so that recordings show the redaction but not the length of the
+// password.
+const redactedInput = "[redacted]"
+
+// keystrokeMaxTail bounds the output kept to match prompts against.
+const keystrokeMaxTail = 256
+
+// keystrokeFilter redacts the input of a recorded session while the output
+// shows a password prompt, until the user ends the line.
+type keystrokeFilter struct {
+	prompt *regexp.Regexp
+
+	mu sync.Mutex
+	// tail is the last line of output, redacting whether it is a prompt
+	// and redacted whether the marker was recorded for it.
+	tail      []byte
+	redacting bool
+	redacted  bool
+}
+
+func newKeystrokeFilter(prompt *regexp.Regexp) *keystrokeFilter {
+	if prompt == nil {
+		prompt = DefaultPasswordPrompt
+	}
+	return &keystrokeFilter{prompt: prompt}
+}
+
+// output follows the terminal output for password prompts.
+func (f *keystrokeFilter) output(data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(data) == 0 {
+		return
+	}
+	if i := bytes.LastIndexAny(data, "\r\n"); i >= 0 {
+		f.tail = f.tail[:0]
+		data = data[i+1:]
+	}
+	f.tail = append(f.tail, data...)
+	if len(f.tail) > keystrokeMaxTail {
+		f.tail = append(f.tail[:0], f.tail[len(f.tail)-keystrokeMaxTail:]...)
+	}
+	prompt := f.prompt.Match(f.tail)
+	if prompt && !f.redacting {
+		f.redacted = false
+	}
+	f.redacting = prompt
+}
+
+// input returns the input to record in place of data.
+func (f *keystrokeFilter) input(data []byte) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.redacting {
+		return data
+	}
+	var out []byte
+	for i, c := range data {
+		switch c {
+		case '\r', '\n', 0x03, 0x04:
+			// Enter, or ^C and ^D to abort the prompt, end the password.
+			f.redacting = false
+			f.tail = f.tail[:0]
+			return append(out, data[i:]...)
+		}
+		if !f.redacted {
+			out = append(out, redactedInput...)
+			f.redacted = true
+		}
+	}
+	return out
+}
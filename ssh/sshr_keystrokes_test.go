@@ -0,0 +1,38 @@
+package ssh
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestKeystrokeFilter(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		prompt *regexp.Regexp
+		// steps alternate between output and the input following it.
+		steps []string
+		want  string
+	}{
+		{"command", nil, []string{"$ ", "ls -l\r"}, "ls -l\r"},
+		{"sudo", nil, []string{"$ ", "sudo -i\r", "[sudo] password for alice: ", "hunter2", "", "\rid\r"},
+			"sudo -i\r[redacted]\rid\r"},
+		{"asterisks", nil, []string{"Password: ", "h", "*", "u", "**", "nter\x03"}, "[redacted]\x03"},
+		{"passphrase", nil, []string{"Enter passphrase for key '/home/alice/.ssh/id_ed25519': ", "secret\r"}, "[redacted]\r"},
+		{"output after prompt", nil, []string{"Password: ", "x\r", "\r\nSorry, try again.\r\n$ ", "whoami\r"}, "[redacted]\rwhoami\r"},
+		{"prompt in last line only", nil, []string{"password: \r\n$ ", "cat /etc/passwd\r"}, "cat /etc/passwd\r"},
+		{"custom prompt", regexp.MustCompile(`Token: $`), []string{"Password: ", "visible\r", "Token: ", "123456\r"}, "visible\r[redacted]\r"},
+	} {
+		f := newKeystrokeFilter(tt.prompt)
+		var got []byte
+		for i, s := range tt.steps {
+			if i%2 == 0 {
+				f.output([]byte(s))
+			} else {
+				got = append(got, f.input([]byte(s))...)
+			}
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: recorded %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
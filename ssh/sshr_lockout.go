@@ -0,0 +1,206 @@
+package ssh
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	errTooManyAuthFailures error = authRejectedError("ssh: too many authentication failures")
+	errLockedOut           error = authRejectedError("ssh: login locked out after repeated failures")
+)
+
+// disconnectTooManyAuthFailures is the reason OpenSSH and ServerConfig
+// give when MaxAuthTries is exceeded.
+const disconnectTooManyAuthFailures = 2
+
+// maxPenaltyDelay caps the delays imposed by FailureLockout.
+const maxPenaltyDelay = 30 * time.Second
+
+// AuthLockout tracks failed downstream authentication attempts,
+// fail2ban-style. Like the limits in ProxyConfig.BanList, users are keyed
+// as "user:<name>" and sources as "ip:<host>". Implementations must be
+// safe for concurrent use; errors deny the login.
+type AuthLockout interface {
+	// Locked reports whether logins identified by key are locked out.
+	Locked(key string) (bool, error)
+	// Fail records a failed attempt of key and returns how long the
+	// proxy waits before it reads the next attempt.
+	Fail(key string) (time.Duration, error)
+	// Succeed forgets the failures of key.
+	Succeed(key string) error
+}
+
+// FailureLockout is an AuthLockout kept in memory. Each failure of a key
+// delays its next attempt, twice as long as the previous one, and a key
+// that fails MaxFailures times within Window is locked out for Lockout.
+// Keys are forgotten once both have passed.
+type FailureLockout struct {
+	MaxFailures int
+	Window      time.Duration
+	Lockout     time.Duration
+	// Delay follows the first failure, doubled with every further one up
+	// to 30 seconds. No delay is imposed if zero.
+	Delay time.Duration
+
+	mu   sync.Mutex
+	keys map[string]*lockoutState
+	// swept is when expired keys were last removed.
+	swept time.Time
+}
+
+type lockoutState struct {
+	failures    int
+	firstFailed time.Time
+	lockedUntil time.Time
+}
+
+// expired reports whether st no longer affects its key.
+func (st *lockoutState) expired(now time.Time, window time.Duration) bool {
+	return now.Sub(st.firstFailed) > window && now.After(st.lockedUntil)
+}
+
+// NewFailureLockout returns a lockout that locks keys out for lockout after
+// maxFailures failures within window.
+func NewFailureLockout(maxFailures int, window, lockout time.Duration) *FailureLockout {
+	return &FailureLockout{
+		MaxFailures: maxFailures,
+		Window:      window,
+		Lockout:     lockout,
+		keys:        make(map[string]*lockoutState),
+	}
+}
+
+// Locked implements AuthLockout.
+func (l *FailureLockout) Locked(key string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st, ok := l.keys[key]
+	return ok && time.Now().Before(st.lockedUntil), nil
+}
+
+// Fail implements AuthLockout.
+func (l *FailureLockout) Fail(key string) (time.Duration, error) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.keys == nil {
+		l.keys = make(map[string]*lockoutState)
+	}
+	// Usernames are chosen by clients, so keys that expired are removed
+	// at most once per window to bound the memory they take.
+	if now.Sub(l.swept) > l.Window {
+		for k, st := range l.keys {
+			if st.expired(now, l.Window) {
+				delete(l.keys, k)
+			}
+		}
+		l.swept = now
+	}
+	st, ok := l.keys[key]
+	if !ok || st.expired(now, l.Window) {
+		st = &lockoutState{firstFailed: now}
+		l.keys[key] = st
+	}
+	st.failures++
+	if l.MaxFailures > 0 && st.failures >= l.MaxFailures {
+		st.lockedUntil = now.Add(l.Lockout)
+	}
+
+	delay := l.Delay
+	for i := 1; i < st.failures && delay < maxPenaltyDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxPenaltyDelay {
+		delay = maxPenaltyDelay
+	}
+	return delay, nil
+}
+
+// Succeed implements AuthLockout.
+func (l *FailureLockout) Succeed(key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.keys, key)
+	return nil
+}
+
+// authFailed counts a failed downstream attempt with method, which failed
+// with err. It reports the failure to OnAuthFailure, records it with the
+// configured AuthLockout, waits for the penalty delay, and disconnects the
+// client once it is locked out or MaxAuthTries attempts failed.
+func (p *ProxyConn) authFailed(method string, err error) error {
+	if method == "none" {
+		return nil
+	}
+	conf := p.config
+	p.authFailures++
+
+	if conf.OnAuthFailure != nil {
+		if err := conf.OnAuthFailure(p, p.authResult(method), err); err != nil {
+			p.disconnect(disconnectNoMoreAuthMethodsAvailable, "authentication aborted")
+			return &proxyError{cause: ErrAuthRejected, detail: "OnAuthFailure", err: err}
+		}
+	}
+
+	if conf.AuthLockout != nil {
+		var delay time.Duration
+		for _, key := range p.lockoutKeys() {
+			d, err := conf.AuthLockout.Fail(key)
+			if err != nil {
+				return err
+			}
+			if d > delay {
+				delay = d
+			}
+		}
+		// The failure may have locked the connection out of further tries.
+		for _, key := range p.lockoutKeys() {
+			locked, err := conf.AuthLockout.Locked(key)
+			if err != nil {
+				return err
+			}
+			if locked {
+				p.log(LogWarn, "login locked out", "key", key)
+				p.Downstream.transport.writePacket(Marshal(&disconnectMsg{
+					Reason:  disconnectTooManyAuthFailures,
+					Message: "too many authentication failures",
+				}))
+				return errLockedOut
+			}
+		}
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-p.ctx.Done():
+				return p.ctx.Err()
+			}
+		}
+	}
+
+	if conf.MaxAuthTries > 0 && p.authFailures >= conf.MaxAuthTries {
+		p.log(LogWarn, "too many authentication failures", "failures", p.authFailures)
+		p.Downstream.transport.writePacket(Marshal(&disconnectMsg{
+			Reason:  disconnectTooManyAuthFailures,
+			Message: "too many authentication failures",
+		}))
+		return errTooManyAuthFailures
+	}
+	return nil
+}
+
+// authSucceeded forgets the failures of the user. Those of the source
+// address are kept, so that one valid account does not shield guessing at
+// others.
+func (p *ProxyConn) authSucceeded() {
+	if p.config.AuthLockout != nil {
+		p.config.AuthLockout.Succeed("user:" + p.User)
+	}
+}
+
+// lockoutKeys returns the keys failures of p are recorded under.
+func (p *ProxyConn) lockoutKeys() []string {
+	return []string{"user:" + p.User, "ip:" + sourceHost(p.Downstream.RemoteAddr())}
+}
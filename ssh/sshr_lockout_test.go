@@ -0,0 +1,111 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProxyMaxAuthTries(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.MaxAuthTries = 2
+	upstreamConf := newTestUpstreamConfig()
+	var tries int32
+	upstreamConf.PasswordCallback = func(conn ConnMetadata, pass []byte) (*Permissions, error) {
+		atomic.AddInt32(&tries, 1)
+		return nil, errors.New("password not acceptable")
+	}
+	_, res, err := dialTestProxy(t, proxyConf, upstreamConf, &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{RetryableAuthMethod(Password("wrong"), 5)},
+	})
+	if err == nil || !strings.Contains(err.Error(), "too many authentication failures") {
+		t.Errorf("client: got %v, want too many authentication failures", err)
+	}
+	if res.err != errTooManyAuthFailures {
+		t.Errorf("proxy: got %v, want %v", res.err, errTooManyAuthFailures)
+	}
+	if n := atomic.LoadInt32(&tries); n != 2 {
+		t.Errorf("upstream got %d attempts, want 2", n)
+	}
+}
+
+func TestProxyAuthLockout(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.AuthLockout = NewFailureLockout(2, time.Minute, time.Minute)
+	dial := func(password string) (*Client, proxyTestResult, error) {
+		return dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+			User: "testuser",
+			Auth: []AuthMethod{Password(password)},
+		})
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err := dial("wrong"); err == nil {
+			t.Fatal("wrong password accepted")
+		}
+	}
+	_, res, err := dial(upstreamPassword)
+	if err == nil {
+		t.Fatal("locked out user connected")
+	}
+	if res.err != errLockedOut {
+		t.Errorf("proxy: got %v, want %v", res.err, errLockedOut)
+	}
+}
+
+func TestProxyAuthLockoutWithinConnection(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.AuthLockout = NewFailureLockout(3, time.Minute, time.Minute)
+	upstreamConf := newTestUpstreamConfig()
+	var tries int32
+	upstreamConf.PasswordCallback = func(conn ConnMetadata, pass []byte) (*Permissions, error) {
+		atomic.AddInt32(&tries, 1)
+		return nil, errors.New("password not acceptable")
+	}
+	_, res, err := dialTestProxy(t, proxyConf, upstreamConf, &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{RetryableAuthMethod(Password("wrong"), 10)},
+	})
+	if err == nil {
+		t.Fatal("wrong password accepted")
+	}
+	if res.err != errLockedOut {
+		t.Errorf("proxy: got %v, want %v", res.err, errLockedOut)
+	}
+	if n := atomic.LoadInt32(&tries); n != 3 {
+		t.Errorf("upstream got %d attempts, want 3", n)
+	}
+}
+
+func TestFailureLockoutDelay(t *testing.T) {
+	l := NewFailureLockout(0, time.Minute, time.Minute)
+	l.Delay = 10 * time.Second
+	for _, want := range []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second} {
+		if got, _ := l.Fail("ip:192.0.2.1"); got != want {
+			t.Errorf("got delay %v, want %v", got, want)
+		}
+	}
+	l.Succeed("ip:192.0.2.1")
+	if got, _ := l.Fail("ip:192.0.2.1"); got != l.Delay {
+		t.Errorf("got delay %v after success, want %v", got, l.Delay)
+	}
+	if locked, _ := l.Locked("ip:192.0.2.1"); locked {
+		t.Error("key locked out without MaxFailures")
+	}
+}
+
+func TestFailureLockoutForgetsExpiredKeys(t *testing.T) {
+	l := NewFailureLockout(2, 10*time.Millisecond, 10*time.Millisecond)
+	for i := 0; i < 100; i++ {
+		l.Fail(fmt.Sprintf("user:random%d", i))
+		l.Fail(fmt.Sprintf("user:random%d", i))
+	}
+	time.Sleep(30 * time.Millisecond)
+	l.Fail("user:alice")
+	if n := len(l.keys); n != 1 {
+		t.Errorf("got %d keys after they expired, want 1", n)
+	}
+}
@@ -0,0 +1,59 @@
+package ssh
+
+import (
+	"strconv"
+)
+
+// LogLevel is the severity of a log event.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
+	case LogError:
+		return "error"
+	}
+	return "LogLevel(" + strconv.Itoa(int(l)) + ")"
+}
+
+// Logger receives the structured events of the proxy. The keyvals
+// alternate between string keys and values, as for log/slog and logr, so
+// adapters are one-liners. Events about a connection carry the keys
+// "user", "remote_addr" and "upstream"; failures carry "error".
+type Logger interface {
+	Log(level LogLevel, msg string, keyvals ...interface{})
+}
+
+// LoggerFunc adapts a function to the Logger interface.
+type LoggerFunc func(level LogLevel, msg string, keyvals ...interface{})
+
+func (f LoggerFunc) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	f(level, msg, keyvals...)
+}
+
+func (conf *ProxyConfig) log(level LogLevel, msg string, keyvals ...interface{}) {
+	if conf != nil && conf.Logger != nil {
+		conf.Logger.Log(level, msg, keyvals...)
+	}
+}
+
+// log logs an event about p with the configured Logger.
+func (p *ProxyConn) log(level LogLevel, msg string, keyvals ...interface{}) {
+	if p.config == nil || p.config.Logger == nil {
+		return
+	}
+	fields := []interface{}{"user", p.User, "remote_addr", p.Downstream.RemoteAddr().String(), "upstream", p.DestinationHost}
+	p.config.Logger.Log(level, msg, append(fields, keyvals...)...)
+}
@@ -0,0 +1,88 @@
+package ssh
+
+import (
+	"sync"
+	"testing"
+)
+
+type testLogEvent struct {
+	level   LogLevel
+	msg     string
+	keyvals map[string]interface{}
+}
+
+type testLogger struct {
+	mu     sync.Mutex
+	events []testLogEvent
+}
+
+func (l *testLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	e := testLogEvent{level: level, msg: msg, keyvals: make(map[string]interface{})}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		e.keyvals[keyvals[i].(string)] = keyvals[i+1]
+	}
+	l.mu.Lock()
+	l.events = append(l.events, e)
+	l.mu.Unlock()
+}
+
+func (l *testLogger) find(msg string) (testLogEvent, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, e := range l.events {
+		if e.msg == msg {
+			return e, true
+		}
+	}
+	return testLogEvent{}, false
+}
+
+func TestProxyLogger(t *testing.T) {
+	logger := &testLogger{}
+	proxyConf := newTestProxyConfig()
+	proxyConf.Logger = logger
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{
+			PublicKeys(testSigners["ed25519"]),
+			Password(upstreamPassword),
+		},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	client.Close()
+
+	for _, want := range []struct {
+		msg    string
+		level  LogLevel
+		method string
+	}{
+		{"authentication attempt", LogDebug, "publickey"},
+		{"authentication failed", LogWarn, "publickey"},
+		{"authentication succeeded", LogInfo, "password"},
+	} {
+		e, ok := logger.find(want.msg)
+		if !ok {
+			t.Errorf("no %q event in %v", want.msg, logger.events)
+			continue
+		}
+		if e.level != want.level || e.keyvals["method"] != want.method || e.keyvals["user"] != "testuser" {
+			t.Errorf("%q: got %v %v, want level %v and method %s", want.msg, e.level, e.keyvals, want.level, want.method)
+		}
+		if _, ok := e.keyvals["remote_addr"]; !ok {
+			t.Errorf("%q: no remote_addr in %v", want.msg, e.keyvals)
+		}
+	}
+	if e, _ := logger.find("authentication failed"); e.keyvals["error"] == nil {
+		t.Errorf("failed attempt logged without an error: %v", e.keyvals)
+	}
+}
+
+func TestLogLevelString(t *testing.T) {
+	for level, want := range map[LogLevel]string{LogDebug: "debug", LogInfo: "info", LogWarn: "warn", LogError: "error", 7: "LogLevel(7)"} {
+		if got := level.String(); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
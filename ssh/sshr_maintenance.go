@@ -0,0 +1,58 @@
+package ssh
+
+import (
+	"errors"
+	"sync"
+)
+
+// errMaintenance is returned by AuthenticateProxyConn while new sessions are
+// refused.
+var errMaintenance = errors.New("ssh: new sessions refused for maintenance")
+
+// MaintenanceGate refuses new downstream sessions during planned upstream
+// maintenance. Refused users are shown a banner; established sessions are
+// not affected. The zero value admits every session.
+type MaintenanceGate struct {
+	mu     sync.Mutex
+	closed bool
+	banner string
+}
+
+// Close refuses new sessions from now on, showing banner to the users, for
+// example "maintenance until 14:00 UTC".
+func (g *MaintenanceGate) Close(banner string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closed = true
+	g.banner = banner
+}
+
+// Open admits new sessions again.
+func (g *MaintenanceGate) Open() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closed = false
+	g.banner = ""
+}
+
+// Closed reports whether new sessions are refused, and the banner shown.
+func (g *MaintenanceGate) Closed() (bool, string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.closed, g.banner
+}
+
+// checkMaintenance refuses the downstream connection of p if g is closed.
+func (p *ProxyConn) checkMaintenance(g *MaintenanceGate) error {
+	closed, banner := g.Closed()
+	if !closed {
+		return nil
+	}
+	if banner != "" {
+		if err := p.Downstream.transport.writePacket(Marshal(&userAuthBannerMsg{Message: banner + "\r\n"})); err != nil {
+			return err
+		}
+	}
+	p.disconnect(disconnectServiceNotAvailable, "new sessions are refused for maintenance")
+	return errMaintenance
+}
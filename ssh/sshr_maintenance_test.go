@@ -0,0 +1,45 @@
+package ssh
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProxyMaintenanceGate(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.Maintenance = &MaintenanceGate{}
+
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+
+	proxyConf.Maintenance.Close("maintenance until 14:00 UTC")
+	var banner string
+	_, res, err = dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+		BannerCallback: func(message string) error {
+			banner = message
+			return nil
+		},
+	})
+	if err == nil {
+		t.Fatal("login during maintenance succeeded")
+	}
+	if res.err != errMaintenance {
+		t.Errorf("proxy error: got %v, want %v", res.err, errMaintenance)
+	}
+	if !strings.Contains(banner, "maintenance until 14:00 UTC") {
+		t.Errorf("got banner %q", banner)
+	}
+
+	// The session established before maintenance keeps working.
+	if got := runHello(t, client); got != "hello" {
+		t.Errorf("got output %q, want %q", got, "hello")
+	}
+}
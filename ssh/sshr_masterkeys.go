@@ -0,0 +1,53 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var errNoMasterKey = errors.New("ssh: no master key configured")
+
+// masterKeys returns the master keys for the upstream host in the order they
+// are tried: those from MasterKeyHook, or else the one from MasterKeySigner or
+// MasterKeyPath, then MasterKeys.
+func (conf *ProxyConfig) masterKeys(ctx context.Context, host string) ([]Signer, error) {
+	if conf.MasterKeyHook != nil {
+		signers, err := conf.MasterKeyHook(host)
+		if err != nil {
+			return nil, fmt.Errorf("ssh: choosing master key for %q: %v", host, err)
+		}
+		if len(signers) > 0 {
+			return signers, nil
+		}
+	}
+
+	var signers []Signer
+	switch {
+	case conf.MasterKeySigner != nil:
+		signers = append(signers, conf.MasterKeySigner)
+	case conf.MasterKeyPath != "":
+		der, err := fetchPrivateKey(ctx, conf, HookMetadata{}, true)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ParsePrivateKey(der)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	signers = append(signers, conf.MasterKeys...)
+	if len(signers) == 0 {
+		return nil, errNoMasterKey
+	}
+	return signers, nil
+}
+
+// upstreamHost returns the host the upstream was dialed at.
+func (p *ProxyConn) upstreamHost() string {
+	if p.Route != nil {
+		return p.Route.Host
+	}
+	return p.DestinationHost
+}
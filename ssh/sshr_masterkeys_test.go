@@ -0,0 +1,72 @@
+package ssh
+
+import (
+	"context"
+	"testing"
+)
+
+func TestProxyMasterKeyRotation(t *testing.T) {
+	// The upstream only trusts the rsa key, which is the old master key.
+	next := &countingSigner{Signer: testSigners["ed25519"]}
+	old := &countingSigner{Signer: testSigners["rsa"]}
+	proxyConf := newTestProxyConfig()
+	proxyConf.UseMasterKey = true
+	proxyConf.MasterKeySigner = next
+	proxyConf.MasterKeys = []Signer{old}
+
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	client.Close()
+	if next.n != 1 || old.n != 1 {
+		t.Errorf("master keys used %d and %d times, want 1 and 1", next.n, old.n)
+	}
+}
+
+func TestMasterKeysEmpty(t *testing.T) {
+	conf := newTestProxyConfig()
+	conf.UseMasterKey = true
+	if _, err := conf.masterKeys(context.Background(), "upstream"); err != errNoMasterKey {
+		t.Errorf("got error %v, want %v", err, errNoMasterKey)
+	}
+}
+
+func TestProxyMasterKeyHook(t *testing.T) {
+	staging := &countingSigner{Signer: testSigners["ed25519"]}
+	prod := &countingSigner{Signer: testSigners["rsa"]}
+	proxyConf := newTestProxyConfig()
+	proxyConf.UseMasterKey = true
+	proxyConf.MasterKeySigner = staging
+	var hosts []string
+	proxyConf.MasterKeyHook = func(host string) ([]Signer, error) {
+		hosts = append(hosts, host)
+		if host == "upstream" {
+			return []Signer{prod}, nil
+		}
+		return nil, nil
+	}
+
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	client.Close()
+	if len(hosts) == 0 || hosts[0] != "upstream" {
+		t.Errorf("hook called for hosts %q, want upstream", hosts)
+	}
+	if prod.n != 1 || staging.n != 0 {
+		t.Errorf("master keys used %d and %d times, want 1 and 0", prod.n, staging.n)
+	}
+
+	keys, err := proxyConf.masterKeys(context.Background(), "staging")
+	if err != nil || len(keys) != 1 || keys[0] != staging {
+		t.Errorf("got master keys %v, %v for an unknown host, want the default", keys, err)
+	}
+}
@@ -0,0 +1,346 @@
+package ssh
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMetricsBuckets are the histogram buckets, in seconds, of the
+// latency metrics if ProxyMetrics.Buckets is nil.
+var DefaultMetricsBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// MetricKind is the type of a Metric.
+type MetricKind int
+
+const (
+	MetricCounter MetricKind = iota
+	MetricGauge
+	MetricHistogram
+)
+
+func (k MetricKind) String() string {
+	switch k {
+	case MetricCounter:
+		return "counter"
+	case MetricGauge:
+		return "gauge"
+	case MetricHistogram:
+		return "histogram"
+	}
+	return "MetricKind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// Metric is one sample of ProxyMetrics, in the data model of Prometheus.
+type Metric struct {
+	Name string
+	Help string
+	Kind MetricKind
+
+	LabelNames  []string
+	LabelValues []string
+
+	// Value is the value of counters and gauges.
+	Value float64
+
+	// Buckets are the upper bounds of the buckets of a histogram and
+	// BucketCounts the cumulative number of observations in each of them.
+	// The +Inf bucket is Count.
+	Buckets      []float64
+	BucketCounts []uint64
+	Sum          float64
+	Count        uint64
+}
+
+// ProxyMetrics collects metrics of the proxy: active sessions,
+// authentication results by method, upstream dial latency and errors,
+// bytes relayed per direction, and the time from accepting a connection
+// until it is logged in upstream. The dial metrics and the handshake
+// duration are only measured by ProxyServer.
+//
+// Metrics are labelled by the group of the upstream host, see HostGroup.
+// WriteTo writes them in the Prometheus text format, to be served on a
+// /metrics endpoint; Metrics returns them for bridging to a
+// prometheus.Collector with MustNewConstMetric and MustNewConstHistogram.
+// It is safe for concurrent use.
+type ProxyMetrics struct {
+	// HostGroup maps an upstream host to the value of the
+	// "upstream_group" label, such as "db" for db-17.internal, so that
+	// the number of series stays low. If nil, or if it returns "", the
+	// group is "default".
+	HostGroup func(host string) string
+
+	// Buckets are the histogram buckets in seconds. If nil,
+	// DefaultMetricsBuckets are used. They must not change after the first
+	// observation.
+	Buckets []float64
+
+	mu         sync.Mutex
+	auth       map[authMetricKey]uint64
+	dialErrors map[string]uint64
+	dial       map[string]*histogram
+	handshake  map[string]*histogram
+	// bytes are the totals of ended sessions by [direction, group].
+	bytes  map[[2]string]uint64
+	active map[*ProxyConn]string
+}
+
+type authMetricKey struct {
+	method, result, group string
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (m *ProxyMetrics) group(host string) string {
+	if m.HostGroup != nil {
+		if g := m.HostGroup(host); g != "" {
+			return g
+		}
+	}
+	return "default"
+}
+
+func (m *ProxyMetrics) buckets() []float64 {
+	if m.Buckets != nil {
+		return m.Buckets
+	}
+	return DefaultMetricsBuckets
+}
+
+func (m *ProxyMetrics) observe(hs *map[string]*histogram, group string, d time.Duration) {
+	if *hs == nil {
+		*hs = make(map[string]*histogram)
+	}
+	buckets := m.buckets()
+	h := (*hs)[group]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(buckets))}
+		(*hs)[group] = h
+	}
+	v := d.Seconds()
+	for i, b := range buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (m *ProxyMetrics) observeAuth(host, method string, success bool) {
+	if m == nil {
+		return
+	}
+	result := "failure"
+	if success {
+		result = "success"
+	}
+	key := authMetricKey{method, result, m.group(host)}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.auth == nil {
+		m.auth = make(map[authMetricKey]uint64)
+	}
+	m.auth[key]++
+}
+
+func (m *ProxyMetrics) observeDial(host string, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	group := m.group(host)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		if m.dialErrors == nil {
+			m.dialErrors = make(map[string]uint64)
+		}
+		m.dialErrors[group]++
+		return
+	}
+	m.observe(&m.dial, group, d)
+}
+
+func (m *ProxyMetrics) observeHandshake(host string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	group := m.group(host)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observe(&m.handshake, group, d)
+}
+
+// track counts p as active until untrack. The bytes it relays are read
+// from its counters until then.
+func (m *ProxyMetrics) track(p *ProxyConn) {
+	if m == nil {
+		return
+	}
+	group := m.group(p.DestinationHost)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.active == nil {
+		m.active = make(map[*ProxyConn]string)
+	}
+	m.active[p] = group
+}
+
+func (m *ProxyMetrics) untrack(p *ProxyConn) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	group, ok := m.active[p]
+	if !ok {
+		return
+	}
+	delete(m.active, p)
+	if m.bytes == nil {
+		m.bytes = make(map[[2]string]uint64)
+	}
+	m.bytes[[2]string{"upstream", group}] += uint64(atomic.LoadInt64(&p.bytesUpstream))
+	m.bytes[[2]string{"downstream", group}] += uint64(atomic.LoadInt64(&p.bytesDownstream))
+}
+
+// Metrics returns the current value of every metric, sorted by name and
+// labels.
+func (m *ProxyMetrics) Metrics() []Metric {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ms []Metric
+	add := func(name, help string, kind MetricKind, labels []string, values []string, v float64) {
+		ms = append(ms, Metric{Name: name, Help: help, Kind: kind, LabelNames: labels, LabelValues: values, Value: v})
+	}
+	addHistograms := func(name, help string, hs map[string]*histogram) {
+		buckets := m.buckets()
+		for group, h := range hs {
+			cum := make([]uint64, len(h.counts))
+			copy(cum, h.counts)
+			ms = append(ms, Metric{
+				Name: name, Help: help, Kind: MetricHistogram,
+				LabelNames: []string{"upstream_group"}, LabelValues: []string{group},
+				Buckets: buckets, BucketCounts: cum, Sum: h.sum, Count: h.count,
+			})
+		}
+	}
+
+	active := make(map[string]int)
+	bytes := make(map[[2]string]uint64)
+	for k, v := range m.bytes {
+		bytes[k] = v
+		// Report groups without sessions as zero rather than dropping them.
+		active[k[1]] += 0
+	}
+	for p, group := range m.active {
+		active[group]++
+		bytes[[2]string{"upstream", group}] += uint64(atomic.LoadInt64(&p.bytesUpstream))
+		bytes[[2]string{"downstream", group}] += uint64(atomic.LoadInt64(&p.bytesDownstream))
+	}
+	for group, n := range active {
+		add("ssh_proxy_active_sessions", "Sessions currently relayed.", MetricGauge,
+			[]string{"upstream_group"}, []string{group}, float64(n))
+	}
+	for k, n := range m.auth {
+		add("ssh_proxy_auth_total", "Downstream authentication attempts by method and result.", MetricCounter,
+			[]string{"method", "result", "upstream_group"}, []string{k.method, k.result, k.group}, float64(n))
+	}
+	for k, n := range bytes {
+		add("ssh_proxy_relayed_bytes_total", "Bytes relayed to the upstream or the downstream.", MetricCounter,
+			[]string{"direction", "upstream_group"}, []string{k[0], k[1]}, float64(n))
+	}
+	for group, n := range m.dialErrors {
+		add("ssh_proxy_upstream_dial_errors_total", "Failed upstream dials.", MetricCounter,
+			[]string{"upstream_group"}, []string{group}, float64(n))
+	}
+	addHistograms("ssh_proxy_upstream_dial_duration_seconds", "Time to connect to the upstream.", m.dial)
+	addHistograms("ssh_proxy_handshake_duration_seconds", "Time from accepting a connection until it is logged in upstream.", m.handshake)
+
+	sort.Slice(ms, func(i, j int) bool {
+		if ms[i].Name != ms[j].Name {
+			return ms[i].Name < ms[j].Name
+		}
+		return strings.Join(ms[i].LabelValues, "\x00") < strings.Join(ms[j].LabelValues, "\x00")
+	})
+	return ms
+}
+
+// WriteTo writes the metrics to w in the Prometheus text exposition
+// format, version 0.0.4.
+func (m *ProxyMetrics) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	last := ""
+	for _, metric := range m.Metrics() {
+		if metric.Name != last {
+			last = metric.Name
+			bw.WriteString("# HELP " + metric.Name + " " + metric.Help + "\n")
+			bw.WriteString("# TYPE " + metric.Name + " " + metric.Kind.String() + "\n")
+		}
+		if metric.Kind != MetricHistogram {
+			writeSample(bw, metric.Name, metric.LabelNames, metric.LabelValues, "", formatMetricValue(metric.Value))
+			continue
+		}
+		for i, b := range metric.Buckets {
+			writeSample(bw, metric.Name+"_bucket", metric.LabelNames, metric.LabelValues, formatMetricValue(b), strconv.FormatUint(metric.BucketCounts[i], 10))
+		}
+		writeSample(bw, metric.Name+"_bucket", metric.LabelNames, metric.LabelValues, "+Inf", strconv.FormatUint(metric.Count, 10))
+		writeSample(bw, metric.Name+"_sum", metric.LabelNames, metric.LabelValues, "", formatMetricValue(metric.Sum))
+		writeSample(bw, metric.Name+"_count", metric.LabelNames, metric.LabelValues, "", strconv.FormatUint(metric.Count, 10))
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, le, value string) {
+	w.WriteString(name)
+	if len(labels) > 0 || le != "" {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(l + `="` + metricLabelEscaper.Replace(values[i]) + `"`)
+		}
+		if le != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(`le="` + le + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteString(" " + value + "\n")
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,95 @@
+package ssh
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyMetrics(t *testing.T) {
+	metrics := &ProxyMetrics{HostGroup: func(host string) string {
+		return strings.TrimRight(host, "0123456789")
+	}}
+	proxyConf := newTestProxyConfig()
+	proxyConf.DestinationPort = 22
+	proxyConf.FindUpstreamHook = func(username string) (string, error) {
+		return "upstream1", nil
+	}
+	proxyConf.Metrics = metrics
+	s, addr, _ := newTestProxyServer(t, proxyConf)
+	closed := make(chan struct{})
+	s.ClosedHook = func(p *ProxyConn, err error) { close(closed) }
+	defer s.Close()
+
+	client, err := Dial("tcp", addr, &ClientConfig{
+		User:            "testuser",
+		Auth:            []AuthMethod{PublicKeys(testSigners["ed25519"], testSigners["ecdsa"])},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	runHello(t, client)
+
+	var buf bytes.Buffer
+	metrics.WriteTo(&buf)
+	for _, want := range []string{
+		"# TYPE ssh_proxy_active_sessions gauge\n",
+		`ssh_proxy_active_sessions{upstream_group="upstream"} 1` + "\n",
+		`ssh_proxy_auth_total{method="publickey",result="failure",upstream_group="upstream"} 1` + "\n",
+		`ssh_proxy_auth_total{method="publickey",result="success",upstream_group="upstream"} 1` + "\n",
+		`ssh_proxy_upstream_dial_duration_seconds_bucket{upstream_group="upstream",le="+Inf"} 1` + "\n",
+		`ssh_proxy_handshake_duration_seconds_count{upstream_group="upstream"} 1` + "\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("metrics lack %q:\n%s", want, buf.String())
+		}
+	}
+
+	client.Close()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("session did not end")
+	}
+	var active, up, down float64
+	for _, m := range metrics.Metrics() {
+		switch {
+		case m.Name == "ssh_proxy_active_sessions":
+			active = m.Value
+		case m.Name == "ssh_proxy_relayed_bytes_total" && m.LabelValues[0] == "upstream":
+			up = m.Value
+		case m.Name == "ssh_proxy_relayed_bytes_total" && m.LabelValues[0] == "downstream":
+			down = m.Value
+		}
+	}
+	if active != 0 || up == 0 || down == 0 {
+		t.Errorf("after the session: %v active, %v bytes up, %v bytes down", active, up, down)
+	}
+}
+
+func TestProxyMetricsHistogram(t *testing.T) {
+	m := &ProxyMetrics{Buckets: []float64{0.1, 1}}
+	m.observeDial("a", 50*time.Millisecond, nil)
+	m.observeDial("a", 500*time.Millisecond, nil)
+	m.observeDial("a", 5*time.Second, nil)
+	m.observeDial("a", 0, errUpstreamAuthRejected)
+
+	var buf bytes.Buffer
+	m.WriteTo(&buf)
+	want := `# HELP ssh_proxy_upstream_dial_duration_seconds Time to connect to the upstream.
+# TYPE ssh_proxy_upstream_dial_duration_seconds histogram
+ssh_proxy_upstream_dial_duration_seconds_bucket{upstream_group="default",le="0.1"} 1
+ssh_proxy_upstream_dial_duration_seconds_bucket{upstream_group="default",le="1"} 2
+ssh_proxy_upstream_dial_duration_seconds_bucket{upstream_group="default",le="+Inf"} 3
+ssh_proxy_upstream_dial_duration_seconds_sum{upstream_group="default"} 5.55
+ssh_proxy_upstream_dial_duration_seconds_count{upstream_group="default"} 3
+# HELP ssh_proxy_upstream_dial_errors_total Failed upstream dials.
+# TYPE ssh_proxy_upstream_dial_errors_total counter
+ssh_proxy_upstream_dial_errors_total{upstream_group="default"} 1
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
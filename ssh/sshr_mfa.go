@@ -0,0 +1,171 @@
+package ssh
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// errSecondFactorFailed is reported to AuthLogHook when a downstream user
+// fails the second factor.
+var errSecondFactorFailed = errors.New("ssh: second factor authentication failed")
+
+// secondFactor asks the downstream client for the second factor once its
+// first authentication method was accepted by the proxy, or by the upstream
+// if the proxy left it to the upstream. method is the name of that method.
+func (p *ProxyConn) secondFactor(method string) error {
+	conf := p.config
+	// The none method only probes for the methods allowed by the upstream.
+	if conf.SecondFactorHook == nil || p.secondFactorDone || method == "none" {
+		return nil
+	}
+	if conf.MFAExemptions != nil && conf.MFAExemptions.exempt(p.User, p.downstreamKey, p.Downstream.RemoteAddr(), time.Now()) {
+		p.secondFactorDone = true
+		return nil
+	}
+
+	if err := p.Downstream.transport.writePacket(Marshal(&userAuthFailureMsg{
+		Methods:        []string{"keyboard-interactive"},
+		PartialSuccess: true,
+	})); err != nil {
+		return err
+	}
+	packet, err := p.Downstream.transport.readPacket()
+	if err != nil {
+		return err
+	}
+	var req userAuthRequestMsg
+	if err := Unmarshal(packet, &req); err != nil {
+		return err
+	}
+
+	if req.Method == "keyboard-interactive" && req.User == p.User {
+		prompter := &sshClientKeyboardInteractive{p.Downstream}
+		if err := conf.SecondFactorHook(p.User, prompter.Challenge); err == nil {
+			p.secondFactorDone = true
+			return nil
+		}
+	}
+
+	if err := p.sendFailureMsg(method); err != nil {
+		return err
+	}
+	return errSecondFactorFailed
+}
+
+// MFAExemption exempts matching downstream logins from the second factor
+// until it expires. Empty criteria match anything, but at least one must be
+// set.
+type MFAExemption struct {
+	User string
+	// Fingerprint is the SHA256 fingerprint of a downstream public key.
+	Fingerprint string
+	// Network contains the source addresses the exemption applies to.
+	Network *net.IPNet
+
+	// Expires is mandatory; exemptions are never permanent.
+	Expires time.Time
+
+	// Reason is recorded for audits.
+	Reason string
+}
+
+func (e *MFAExemption) matches(username string, key PublicKey, addr net.Addr) bool {
+	if e.User != "" && e.User != username {
+		return false
+	}
+	if e.Fingerprint != "" && (key == nil || FingerprintSHA256(key) != e.Fingerprint) {
+		return false
+	}
+	if e.Network != nil {
+		tcp, ok := addr.(*net.TCPAddr)
+		if !ok || !e.Network.Contains(tcp.IP) {
+			return false
+		}
+	}
+	return true
+}
+
+// MFAExemptions is a list of exemptions from ProxyConfig.SecondFactorHook,
+// meant for automation users that cannot answer a challenge. Expired entries
+// are dropped.
+type MFAExemptions struct {
+	// ExerciseHook, if non-nil, is called whenever a login skips the second
+	// factor because of an exemption.
+	ExerciseHook func(username string, e MFAExemption)
+
+	mu   sync.Mutex
+	list []MFAExemption
+}
+
+var (
+	errExemptionExpiry   = errors.New("ssh: MFA exemption needs an expiry")
+	errExemptionCriteria = errors.New("ssh: MFA exemption needs a user, key or network")
+)
+
+// Add adds an exemption.
+func (m *MFAExemptions) Add(e MFAExemption) error {
+	if e.Expires.IsZero() {
+		return errExemptionExpiry
+	}
+	if e.User == "" && e.Fingerprint == "" && e.Network == nil {
+		return errExemptionCriteria
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.list = append(m.list, e)
+	return nil
+}
+
+// Remove removes the exemptions for which fn returns true.
+func (m *MFAExemptions) Remove(fn func(e MFAExemption) bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.list[:0]
+	for _, e := range m.list {
+		if !fn(e) {
+			kept = append(kept, e)
+		}
+	}
+	m.list = kept
+}
+
+// List returns the exemptions that have not expired.
+func (m *MFAExemptions) List() []MFAExemption {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(time.Now())
+	return append([]MFAExemption(nil), m.list...)
+}
+
+// expire drops expired exemptions. m.mu must be held.
+func (m *MFAExemptions) expire(now time.Time) {
+	kept := m.list[:0]
+	for _, e := range m.list {
+		if now.Before(e.Expires) {
+			kept = append(kept, e)
+		}
+	}
+	m.list = kept
+}
+
+// exempt reports whether a login is exempt from the second factor.
+func (m *MFAExemptions) exempt(username string, key PublicKey, addr net.Addr, now time.Time) bool {
+	m.mu.Lock()
+	m.expire(now)
+	var match *MFAExemption
+	for i := range m.list {
+		if m.list[i].matches(username, key, addr) {
+			e := m.list[i]
+			match = &e
+			break
+		}
+	}
+	m.mu.Unlock()
+
+	if match != nil && m.ExerciseHook != nil {
+		m.ExerciseHook(username, *match)
+	}
+	return match != nil
+}
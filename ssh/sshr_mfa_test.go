@@ -0,0 +1,165 @@
+package ssh
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func secondFactorTestConfig() *ProxyConfig {
+	proxyConf := newTestProxyConfig()
+	proxyConf.SecondFactorHook = func(username string, challenge KeyboardInteractiveChallenge) error {
+		answers, err := challenge(username, "", []string{"Code: "}, []bool{false})
+		if err != nil {
+			return err
+		}
+		if answers[0] != "123456" {
+			return errors.New("wrong code")
+		}
+		return nil
+	}
+	return proxyConf
+}
+
+func answerCode(code string) AuthMethod {
+	return KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		return []string{code}, nil
+	})
+}
+
+func TestProxySecondFactor(t *testing.T) {
+	for _, tc := range []struct {
+		code string
+		ok   bool
+	}{
+		{"123456", true},
+		{"000000", false},
+	} {
+		client, res, err := dialTestProxy(t, secondFactorTestConfig(), newTestUpstreamConfig(), &ClientConfig{
+			User: "testuser",
+			Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"]), answerCode(tc.code)},
+		})
+		if !tc.ok {
+			if err == nil {
+				client.Close()
+				t.Errorf("login with code %s succeeded", tc.code)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("client: %v, proxy: %v", err, res.err)
+		}
+		if got := runHello(t, client); got != "hello" {
+			t.Errorf("got output %q, want %q", got, "hello")
+		}
+		client.Close()
+	}
+}
+
+func TestProxySecondFactorRequired(t *testing.T) {
+	_, _, err := dialTestProxy(t, secondFactorTestConfig(), newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err == nil {
+		t.Fatal("login without a second factor succeeded")
+	}
+}
+
+func TestProxyMFAExemption(t *testing.T) {
+	var exercised []string
+	proxyConf := secondFactorTestConfig()
+	proxyConf.MFAExemptions = &MFAExemptions{ExerciseHook: func(username string, e MFAExemption) {
+		exercised = append(exercised, e.Reason)
+	}}
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	if err := proxyConf.MFAExemptions.Add(MFAExemption{
+		Fingerprint: FingerprintSHA256(testPublicKeys["ecdsa"]),
+		Network:     loopback,
+		Expires:     time.Now().Add(time.Hour),
+		Reason:      "backup job",
+	}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	client.Close()
+	if len(exercised) != 1 || exercised[0] != "backup job" {
+		t.Errorf("ExerciseHook calls: %v", exercised)
+	}
+}
+
+func TestMFAExemptionsExpiry(t *testing.T) {
+	var m MFAExemptions
+	if err := m.Add(MFAExemption{User: "backup"}); err != errExemptionExpiry {
+		t.Errorf("exemption without expiry: got %v, want %v", err, errExemptionExpiry)
+	}
+	if err := m.Add(MFAExemption{Expires: time.Now().Add(time.Hour)}); err != errExemptionCriteria {
+		t.Errorf("exemption without criteria: got %v, want %v", err, errExemptionCriteria)
+	}
+
+	now := time.Now()
+	m.Add(MFAExemption{User: "backup", Expires: now.Add(time.Minute)})
+	if !m.exempt("backup", nil, nil, now) {
+		t.Error("active exemption not applied")
+	}
+	if m.exempt("alice", nil, nil, now) {
+		t.Error("exemption applied to another user")
+	}
+	if m.exempt("backup", nil, nil, now.Add(2*time.Minute)) {
+		t.Error("expired exemption applied")
+	}
+	if len(m.List()) != 0 {
+		t.Error("expired exemption still listed")
+	}
+}
+
+func TestProxySecondFactorAfterFirstFactor(t *testing.T) {
+	var challenged int
+	proxyConf := secondFactorTestConfig()
+	hook := proxyConf.SecondFactorHook
+	proxyConf.SecondFactorHook = func(username string, challenge KeyboardInteractiveChallenge) error {
+		challenged++
+		return hook(username, challenge)
+	}
+
+	// Neither an unauthorized key nor a wrong password is challenged.
+	_, _, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ed25519"]), Password("wrong"), answerCode("123456")},
+	})
+	if err == nil {
+		t.Fatal("login with an unauthorized key and a wrong password succeeded")
+	}
+	if challenged != 0 {
+		t.Errorf("second factor asked %d times for rejected requests", challenged)
+	}
+
+	// A password the upstream verifies is.
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{Password(upstreamPassword), answerCode("123456")},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	client.Close()
+	if challenged != 1 {
+		t.Errorf("second factor asked %d times for an accepted password", challenged)
+	}
+
+	_, _, err = dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{Password(upstreamPassword), answerCode("000000")},
+	})
+	if err == nil {
+		t.Error("login with a password and a wrong code succeeded")
+	}
+}
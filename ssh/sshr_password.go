@@ -0,0 +1,53 @@
+package ssh
+
+import "errors"
+
+var (
+	errPasswordChange     = errors.New("ssh: password changes are not supported with VerifyPasswordHook")
+	errNoUpstreamPassword = errors.New("ssh: UpstreamPasswordHook provided no upstream password")
+)
+
+// newPasswordRequest returns a password authentication request.
+func newPasswordRequest(user, password string) *userAuthRequestMsg {
+	return &userAuthRequestMsg{
+		User:    user,
+		Service: serviceSSH,
+		Method:  "password",
+		Payload: Marshal(struct {
+			Reply    bool
+			Password string
+		}{false, password}),
+	}
+}
+
+// verifyPassword checks the password of a downstream password request with
+// VerifyPasswordHook and returns the request to forward upstream. If
+// upstream passwords are injected and the hook did not substitute one, the
+// request carries the password from UpstreamPasswordHook instead.
+func (p *ProxyConn) verifyPassword(msg *userAuthRequestMsg) (*userAuthRequestMsg, error) {
+	payload := msg.Payload
+	if len(payload) < 1 {
+		return nil, parseError(msgUserAuthRequest)
+	}
+	if payload[0] != 0 {
+		return nil, errPasswordChange
+	}
+	password, payload, ok := parseString(payload[1:])
+	if !ok || len(payload) > 0 {
+		return nil, parseError(msgUserAuthRequest)
+	}
+	upstreamPassword, err := p.config.VerifyPasswordHook(p.ctx, p.hookMetadata(nil), password)
+	if err != nil {
+		return nil, err
+	}
+	if upstreamPassword != "" {
+		return newPasswordRequest(msg.User, upstreamPassword), nil
+	}
+	if p.injectPassword() {
+		if req := p.passwordRequest(); req != nil {
+			return req, nil
+		}
+		return nil, errNoUpstreamPassword
+	}
+	return msg, nil
+}
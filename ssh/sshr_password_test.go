@@ -0,0 +1,100 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestProxyVerifyPasswordHook(t *testing.T) {
+	var upstreamAttempts int
+	upstreamConf := newTestUpstreamConfig()
+	upstreamConf.AuthLogCallback = func(conn ConnMetadata, method string, err error) {
+		if method == "password" {
+			upstreamAttempts++
+		}
+	}
+	proxyConf := newTestProxyConfig()
+	proxyConf.VerifyPasswordHook = func(ctx context.Context, meta HookMetadata, password []byte) (string, error) {
+		if meta.User != "testuser" || string(password) != "ldap-secret" {
+			return "", errors.New("invalid credentials")
+		}
+		return upstreamPassword, nil
+	}
+
+	client, res, err := dialTestProxy(t, proxyConf, upstreamConf, &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{Password("ldap-secret")},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+	if got := runHello(t, client); got != "hello" {
+		t.Errorf("got output %q, want %q", got, "hello")
+	}
+	if upstreamAttempts != 1 {
+		t.Errorf("upstream saw %d password attempts, want 1", upstreamAttempts)
+	}
+
+	upstreamAttempts = 0
+	if _, _, err := dialTestProxy(t, proxyConf, upstreamConf, &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{Password(upstreamPassword)},
+	}); err == nil {
+		t.Error("login succeeded with a password the hook rejects")
+	}
+	if upstreamAttempts != 0 {
+		t.Errorf("rejected password reached the upstream %d times", upstreamAttempts)
+	}
+}
+
+func TestProxyVerifyPasswordHookPassthrough(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.VerifyPasswordHook = func(ctx context.Context, meta HookMetadata, password []byte) (string, error) {
+		return "", nil
+	}
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{Password(upstreamPassword)},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	client.Close()
+}
+
+func TestProxyInjectUpstreamPassword(t *testing.T) {
+	var upstreamUsers []string
+	upstreamConf := newTestUpstreamConfig()
+	upstreamConf.AuthLogCallback = func(conn ConnMetadata, method string, err error) {
+		if method == "password" && err == nil {
+			upstreamUsers = append(upstreamUsers, conn.User())
+		}
+	}
+	proxyConf := newTestProxyConfig()
+	proxyConf.InjectUpstreamPassword = true
+	proxyConf.UpstreamPasswordHook = func(username string, methods []string) (string, error) {
+		return upstreamPassword, nil
+	}
+	proxyConf.VerifyPasswordHook = func(ctx context.Context, meta HookMetadata, password []byte) (string, error) {
+		if string(password) != "local-secret" {
+			return "", errors.New("invalid credentials")
+		}
+		return "", nil
+	}
+
+	for _, auth := range []AuthMethod{PublicKeys(testSigners["ecdsa"]), Password("local-secret")} {
+		client, res, err := dialTestProxy(t, proxyConf, upstreamConf, &ClientConfig{
+			User: "testuser",
+			Auth: []AuthMethod{auth},
+		})
+		if err != nil {
+			t.Fatalf("client: %v, proxy: %v", err, res.err)
+		}
+		client.Close()
+	}
+	if len(upstreamUsers) != 2 {
+		t.Errorf("upstream accepted %d injected passwords, want 2", len(upstreamUsers))
+	}
+}
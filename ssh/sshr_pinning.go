@@ -0,0 +1,143 @@
+package ssh
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// errKeyNotPinned is reported when a pinned user authenticates with a key that
+// is not among the user's pins.
+var errKeyNotPinned = errors.New("ssh: public key is not pinned for user")
+
+// KeyPins restricts users to a fixed set of downstream public keys,
+// identified by their SHA256 fingerprints. Users without pins are not
+// restricted unless Learn is set, in which case the first key a user proves
+// possession of is pinned. Keys presented by pinned users that are not
+// pinned are rejected and kept as pending until approved. Pinned users may
+// not authenticate with other methods than "publickey".
+type KeyPins struct {
+	// Learn pins the first key each unpinned user authenticates with.
+	Learn bool
+
+	// PendingHook, if non-nil, is called when a pinned user presents a new
+	// key, which is then waiting for Approve.
+	PendingHook func(username, fingerprint string)
+
+	mu      sync.Mutex
+	pins    map[string]map[string]bool
+	pending map[string]map[string]bool
+}
+
+func addFingerprint(m map[string]map[string]bool, username, fingerprint string) map[string]map[string]bool {
+	if m == nil {
+		m = make(map[string]map[string]bool)
+	}
+	if m[username] == nil {
+		m[username] = make(map[string]bool)
+	}
+	m[username][fingerprint] = true
+	return m
+}
+
+// Pin adds fingerprints to the pins of username.
+func (k *KeyPins) Pin(username string, fingerprints ...string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, fp := range fingerprints {
+		k.pins = addFingerprint(k.pins, username, fp)
+	}
+}
+
+// Unpin removes a fingerprint from the pins of username. A user whose last
+// pin is removed is no longer restricted.
+func (k *KeyPins) Unpin(username, fingerprint string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.pins[username], fingerprint)
+	if len(k.pins[username]) == 0 {
+		delete(k.pins, username)
+	}
+}
+
+// Pins returns the sorted fingerprints pinned for username.
+func (k *KeyPins) Pins(username string) []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return sortedFingerprints(k.pins[username])
+}
+
+// Pending returns the sorted fingerprints awaiting approval for username.
+func (k *KeyPins) Pending(username string) []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return sortedFingerprints(k.pending[username])
+}
+
+// Approve pins a pending fingerprint. It reports whether the fingerprint was
+// pending.
+func (k *KeyPins) Approve(username, fingerprint string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if !k.pending[username][fingerprint] {
+		return false
+	}
+	delete(k.pending[username], fingerprint)
+	if len(k.pending[username]) == 0 {
+		delete(k.pending, username)
+	}
+	k.pins = addFingerprint(k.pins, username, fingerprint)
+	return true
+}
+
+func sortedFingerprints(m map[string]bool) []string {
+	var fps []string
+	for fp := range m {
+		fps = append(fps, fp)
+	}
+	sort.Strings(fps)
+	return fps
+}
+
+// pinned reports whether username has pins, in which case the user may only
+// authenticate with a pinned key.
+func (k *KeyPins) pinned(username string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.pins[username]) > 0
+}
+
+// check reports whether username may authenticate with key. It must only be
+// called once possession of the key has been proven.
+func (k *KeyPins) check(username string, key PublicKey) error {
+	fp := FingerprintSHA256(key)
+
+	k.mu.Lock()
+	pins, pinned := k.pins[username]
+	switch {
+	case pinned && pins[fp]:
+		k.mu.Unlock()
+		return nil
+	case !pinned && !k.Learn:
+		k.mu.Unlock()
+		return nil
+	case !pinned:
+		k.pins = addFingerprint(k.pins, username, fp)
+		k.mu.Unlock()
+		return nil
+	}
+
+	newPending := !k.pending[username][fp]
+	k.pending = addFingerprint(k.pending, username, fp)
+	k.mu.Unlock()
+
+	if newPending && k.PendingHook != nil {
+		k.PendingHook(username, fp)
+	}
+	return errKeyNotPinned
+}
+
+// pinnedToKeys reports whether KeyPins restricts the user to pinned keys.
+func (p *ProxyConn) pinnedToKeys() bool {
+	return p.config.KeyPins != nil && p.config.KeyPins.pinned(p.User)
+}
@@ -0,0 +1,88 @@
+package ssh
+
+import "testing"
+
+func TestKeyPinsLearnAndApprove(t *testing.T) {
+	var pending []string
+	pins := &KeyPins{
+		Learn: true,
+		PendingHook: func(username, fingerprint string) {
+			pending = append(pending, fingerprint)
+		},
+	}
+
+	ecdsa, ed25519 := testPublicKeys["ecdsa"], testPublicKeys["ed25519"]
+	if err := pins.check("alice", ecdsa); err != nil {
+		t.Fatalf("first key rejected: %v", err)
+	}
+	if got := pins.Pins("alice"); len(got) != 1 || got[0] != FingerprintSHA256(ecdsa) {
+		t.Errorf("learned pins = %v", got)
+	}
+
+	if err := pins.check("alice", ed25519); err != errKeyNotPinned {
+		t.Errorf("new key: got %v, want errKeyNotPinned", err)
+	}
+	pins.check("alice", ed25519)
+	if len(pending) != 1 {
+		t.Errorf("PendingHook called %d times, want 1", len(pending))
+	}
+
+	if !pins.Approve("alice", FingerprintSHA256(ed25519)) {
+		t.Fatal("Approve of a pending key failed")
+	}
+	if err := pins.check("alice", ed25519); err != nil {
+		t.Errorf("approved key rejected: %v", err)
+	}
+	if got := pins.Pending("alice"); len(got) != 0 {
+		t.Errorf("pending after approval: %v", got)
+	}
+}
+
+func TestProxyKeyPinning(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.KeyPins = &KeyPins{}
+	proxyConf.KeyPins.Pin("testuser", FingerprintSHA256(testPublicKeys["rsa"]))
+
+	_, _, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err == nil {
+		t.Fatal("authorized but unpinned key was accepted")
+	}
+	if got := proxyConf.KeyPins.Pending("testuser"); len(got) != 1 {
+		t.Errorf("pending keys = %v, want the ecdsa key", got)
+	}
+
+	proxyConf.KeyPins.Approve("testuser", FingerprintSHA256(testPublicKeys["ecdsa"]))
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	client.Close()
+}
+
+func TestProxyKeyPinningDeniesOtherMethods(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.KeyPins = &KeyPins{}
+	clientConf := func() *ClientConfig {
+		return &ClientConfig{
+			User: "testuser",
+			Auth: []AuthMethod{Password(upstreamPassword)},
+		}
+	}
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), clientConf())
+	if err != nil {
+		t.Fatalf("unpinned user: client: %v, proxy: %v", err, res.err)
+	}
+	client.Close()
+
+	proxyConf.KeyPins.Pin("testuser", FingerprintSHA256(testPublicKeys["ecdsa"]))
+	if client, _, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), clientConf()); err == nil {
+		client.Close()
+		t.Fatal("pinned user logged in with a password")
+	}
+}
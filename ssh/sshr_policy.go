@@ -0,0 +1,213 @@
+package ssh
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// ErrPolicyDenied matches logins refused by the Policy of the user or for
+// the lack of one.
+var ErrPolicyDenied = errors.New("ssh: login denied by policy")
+
+// Policy bundles the decisions about the sessions of a user, so that they
+// need not be spread over several hooks. ProxyConfig.PolicyHook returns the
+// Policy of each user when authentication starts. The zero value allows
+// everything.
+type Policy struct {
+	// Methods, if set, are the only downstream authentication methods the
+	// user may try, besides "none".
+	Methods []string
+
+	// UpstreamNetworks and UpstreamHosts, if either is set, are the only
+	// upstreams the user may be bridged to. UpstreamHosts are host names,
+	// or "*.example.com" for any name in a domain; upstreams given by name
+	// do not match UpstreamNetworks.
+	UpstreamNetworks []*net.IPNet
+	UpstreamHosts    []string
+
+	// Forwarding, if set, restricts the port forwards of the user's
+	// sessions in place of ProxyConfig.Forwarding.
+	Forwarding *ForwardingPolicy
+
+	// Windows, if set, are the only times the user may log in.
+	Windows []TimeWindow
+
+	// RequireRecording refuses the user unless ProxyConfig.Recorder is set.
+	RequireRecording bool
+}
+
+// TimeWindow is a daily period, such as business hours.
+type TimeWindow struct {
+	// Days are the days of the window, every day if empty.
+	Days []time.Weekday
+	// Start and End are the offsets from midnight the window opens and
+	// closes at. A window whose End is not after Start spans midnight.
+	Start, End time.Duration
+	// Location is the time zone of the window, UTC if nil.
+	Location *time.Location
+}
+
+// Contains reports whether t is within w. The days of windows spanning
+// midnight are those they open on.
+func (w TimeWindow) Contains(t time.Time) bool {
+	loc := w.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	t = t.In(loc)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	offset := t.Sub(midnight)
+	day := t.Weekday()
+	if w.End <= w.Start {
+		if offset >= w.Start {
+			return w.onDay(day)
+		}
+		return offset < w.End && w.onDay((day+6)%7)
+	}
+	return offset >= w.Start && offset < w.End && w.onDay(day)
+}
+
+func (w TimeWindow) onDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Policies looks up the Policy of users by name or group, for use as
+// ProxyConfig.PolicyHook.
+type Policies struct {
+	// Users are the policies of single users, which take precedence.
+	Users map[string]*Policy
+	// Groups are the policies of groups. A user gets that of the first of
+	// its groups from GroupsHook that has one.
+	Groups     map[string]*Policy
+	GroupsHook func(username string) ([]string, error)
+	// Default is the policy of the other users. If nil, they are refused.
+	Default *Policy
+}
+
+// Lookup returns the policy of username.
+func (ps *Policies) Lookup(username string) (*Policy, error) {
+	if policy, ok := ps.Users[username]; ok {
+		return policy, nil
+	}
+	if ps.GroupsHook != nil && len(ps.Groups) > 0 {
+		groups, err := ps.GroupsHook(username)
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range groups {
+			if policy, ok := ps.Groups[group]; ok {
+				return policy, nil
+			}
+		}
+	}
+	if ps.Default == nil {
+		return nil, ErrPolicyDenied
+	}
+	return ps.Default, nil
+}
+
+// policyError is a login refused by a policy.
+type policyError string
+
+func (e policyError) Error() string { return "ssh: login denied by policy: " + string(e) }
+
+func (e policyError) Is(target error) bool { return target == ErrPolicyDenied }
+
+// check returns an error if the policy refuses p at now.
+func (policy *Policy) check(p *ProxyConn, now time.Time) error {
+	if len(policy.UpstreamNetworks) > 0 || len(policy.UpstreamHosts) > 0 {
+		host := p.DestinationHost
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !matchesDestination(policy.UpstreamNetworks, policy.UpstreamHosts, host) {
+			return policyError("upstream " + p.DestinationHost + " not allowed")
+		}
+	}
+	if len(policy.Windows) > 0 {
+		open := false
+		for _, w := range policy.Windows {
+			if w.Contains(now) {
+				open = true
+				break
+			}
+		}
+		if !open {
+			return policyError("outside of the allowed times")
+		}
+	}
+	if policy.RequireRecording && (p.config == nil || p.config.Recorder == nil) {
+		return policyError("sessions must be recorded")
+	}
+	return nil
+}
+
+// allowsMethod reports whether the policy lets the user try method.
+func (policy *Policy) allowsMethod(method string) bool {
+	return method == "none" || len(policy.Methods) == 0 || contains(policy.Methods, method)
+}
+
+// applyPolicy looks up the policy of p with ProxyConfig.PolicyHook and
+// disconnects the downstream client if it refuses the login.
+func (p *ProxyConn) applyPolicy() error {
+	policy, err := p.config.PolicyHook(p.User)
+	if err == nil && policy == nil {
+		err = ErrPolicyDenied
+	}
+	if err == nil {
+		err = policy.check(p, time.Now())
+	}
+	if err != nil {
+		p.log(LogWarn, "login denied by policy", "error", err)
+		p.disconnect(disconnectNoMoreAuthMethodsAvailable, "login denied by policy")
+		if !errors.Is(err, ErrPolicyDenied) {
+			err = &proxyError{cause: ErrPolicyDenied, err: err}
+		}
+		return err
+	}
+	p.policy = policy
+	return nil
+}
+
+// forwarding returns the ForwardingPolicy of the sessions of p, if any.
+func (p *ProxyConn) forwarding() *ForwardingPolicy {
+	if p.policy != nil && p.policy.Forwarding != nil {
+		return p.policy.Forwarding
+	}
+	if p.config == nil {
+		return nil
+	}
+	return p.config.Forwarding
+}
+
+// matchesDestination reports whether host, an IP address or a name, is in
+// networks or matches hosts, where "*.example.com" matches any name in the
+// domain.
+func matchesDestination(networks []*net.IPNet, hosts []string, host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		for _, n := range networks {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range hosts {
+		pattern = strings.ToLower(pattern)
+		if host == pattern || strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			return true
+		}
+	}
+	return false
+}
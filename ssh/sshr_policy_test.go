@@ -0,0 +1,104 @@
+package ssh
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTimeWindow(t *testing.T) {
+	businessHours := TimeWindow{
+		Days:  []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+		Start: 9 * time.Hour,
+		End:   17 * time.Hour,
+	}
+	night := TimeWindow{Days: []time.Weekday{time.Friday}, Start: 22 * time.Hour, End: 6 * time.Hour}
+	for _, tc := range []struct {
+		w    TimeWindow
+		t    string
+		want bool
+	}{
+		{businessHours, "2024-03-04T09:00:00Z", true},
+		{businessHours, "2024-03-04T17:00:00Z", false},
+		{businessHours, "2024-03-09T12:00:00Z", false},
+		{night, "2024-03-08T23:00:00Z", true},
+		{night, "2024-03-09T05:00:00Z", true},
+		{night, "2024-03-08T05:00:00Z", false},
+	} {
+		ts, err := time.Parse(time.RFC3339, tc.t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tc.w.Contains(ts); got != tc.want {
+			t.Errorf("%+v.Contains(%s) = %v, want %v", tc.w, tc.t, got, tc.want)
+		}
+	}
+}
+
+func TestPoliciesLookup(t *testing.T) {
+	admin, dev := &Policy{}, &Policy{RequireRecording: true}
+	ps := &Policies{
+		Users:  map[string]*Policy{"root": admin},
+		Groups: map[string]*Policy{"dev": dev},
+		GroupsHook: func(username string) ([]string, error) {
+			if username == "alice" {
+				return []string{"staff", "dev"}, nil
+			}
+			return nil, nil
+		},
+	}
+	for _, tc := range []struct {
+		user string
+		want *Policy
+	}{
+		{"root", admin},
+		{"alice", dev},
+	} {
+		if got, err := ps.Lookup(tc.user); err != nil || got != tc.want {
+			t.Errorf("%s: got %p, %v, want %p", tc.user, got, err, tc.want)
+		}
+	}
+	if _, err := ps.Lookup("mallory"); !errors.Is(err, ErrPolicyDenied) {
+		t.Errorf("user without a policy: got %v, want ErrPolicyDenied", err)
+	}
+}
+
+func TestProxyPolicy(t *testing.T) {
+	clientConf := &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	}
+	// A window of a whole other day.
+	otherDay := TimeWindow{Days: []time.Weekday{(time.Now().UTC().Weekday() + 3) % 7}}
+	for _, tc := range []struct {
+		name   string
+		policy *Policy
+		ok     bool
+	}{
+		{"allowed", &Policy{Methods: []string{"publickey"}, UpstreamHosts: []string{"upstream"}}, true},
+		{"method", &Policy{Methods: []string{"password"}}, false},
+		{"upstream", &Policy{UpstreamHosts: []string{"*.example.com"}}, false},
+		{"recording", &Policy{RequireRecording: true}, false},
+		{"window", &Policy{Windows: []TimeWindow{otherDay}}, false},
+		{"none", nil, false},
+	} {
+		proxyConf := newTestProxyConfig()
+		proxyConf.PolicyHook = func(username string) (*Policy, error) { return tc.policy, nil }
+		client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), clientConf)
+		if tc.ok {
+			if err != nil {
+				t.Errorf("%s: client: %v, proxy: %v", tc.name, err, res.err)
+				continue
+			}
+			client.Close()
+			continue
+		}
+		if err == nil {
+			client.Close()
+			t.Errorf("%s: login succeeded", tc.name)
+		}
+		if tc.name != "method" && !errors.Is(res.err, ErrPolicyDenied) {
+			t.Errorf("%s: proxy error: got %v, want ErrPolicyDenied", tc.name, res.err)
+		}
+	}
+}
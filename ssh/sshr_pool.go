@@ -0,0 +1,281 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoHealthyUpstream is returned by UpstreamPool when none of its hosts is
+// healthy.
+var ErrNoHealthyUpstream = errors.New("ssh: no healthy upstream host")
+
+// HealthCheck is how an UpstreamPool checks its hosts.
+type HealthCheck int
+
+const (
+	// HealthCheckTCP connects to the host.
+	HealthCheckTCP HealthCheck = iota
+	// HealthCheckBanner connects and reads the SSH version line.
+	HealthCheckBanner
+)
+
+// PoolStrategy is how an UpstreamPool selects among its healthy hosts.
+type PoolStrategy int
+
+const (
+	// RoundRobin selects the healthy hosts in turn.
+	RoundRobin PoolStrategy = iota
+	// LeastConnections selects the host with the fewest connections, as
+	// counted by Connected and Disconnected. Ties are broken round-robin.
+	LeastConnections
+)
+
+// UpstreamStatus is the state of one host of an UpstreamPool.
+type UpstreamStatus struct {
+	Host    string
+	Healthy bool
+	Conns   int
+	// Err is the error of the last failed check, nil once the host is
+	// healthy again.
+	Err error
+}
+
+// UpstreamPool balances users across interchangeable upstream hosts and
+// skips those that fail health checks. Hosts are healthy until checked.
+// Run it periodically, for example with a JobScheduler, and delegate
+// FindUpstreamHook to FindUpstream or Pick. It is safe for concurrent use.
+type UpstreamPool struct {
+	Check    HealthCheck
+	Strategy PoolStrategy
+
+	// Port of the hosts, usually ProxyConfig.DestinationPort. If zero, 22
+	// is used.
+	Port int
+
+	// Dial connects to the hosts for checks. If nil, a net.Dialer is used.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Timeout of each check. If zero, 5 seconds are used.
+	Timeout time.Duration
+
+	// FailThreshold is the number of consecutive failed checks after which
+	// a host is unhealthy. If zero, 1 is used. One passed check makes it
+	// healthy again.
+	FailThreshold int
+
+	// StatusHook, if non-nil, is called when a host becomes healthy or
+	// unhealthy.
+	StatusHook func(UpstreamStatus)
+
+	mu    sync.Mutex
+	hosts []*UpstreamStatus
+	fails map[string]int
+	next  int
+}
+
+// Add adds hosts to the pool. Hosts already in it are ignored.
+func (p *UpstreamPool) Add(hosts ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, host := range hosts {
+		if p.find(host) == nil {
+			p.hosts = append(p.hosts, &UpstreamStatus{Host: host, Healthy: true})
+		}
+	}
+}
+
+// Remove removes host from the pool.
+func (p *UpstreamPool) Remove(host string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, h := range p.hosts {
+		if h.Host == host {
+			p.hosts = append(p.hosts[:i], p.hosts[i+1:]...)
+			delete(p.fails, host)
+			return
+		}
+	}
+}
+
+func (p *UpstreamPool) find(host string) *UpstreamStatus {
+	for _, h := range p.hosts {
+		if h.Host == host {
+			return h
+		}
+	}
+	return nil
+}
+
+// Status returns the state of every host, in the order they were added.
+func (p *UpstreamPool) Status() []UpstreamStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := make([]UpstreamStatus, len(p.hosts))
+	for i, h := range p.hosts {
+		status[i] = *h
+	}
+	return status
+}
+
+// Pick selects a healthy host.
+func (p *UpstreamPool) Pick() (string, error) {
+	hosts, err := p.pick()
+	if err != nil {
+		return "", err
+	}
+	return hosts[0], nil
+}
+
+// FindUpstream fits FindUpstreamHook. It returns the host selected by Pick
+// followed by the other healthy hosts, which ProxyServer tries in turn if
+// the selected one cannot be reached.
+func (p *UpstreamPool) FindUpstream(username string) (string, error) {
+	hosts, err := p.pick()
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(hosts, " "), nil
+}
+
+// pick returns the healthy hosts, the selected one first.
+func (p *UpstreamPool) pick() ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var healthy []int
+	n := len(p.hosts)
+	for i := 0; i < n; i++ {
+		if j := (p.next + i) % n; p.hosts[j].Healthy {
+			healthy = append(healthy, j)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil, ErrNoHealthyUpstream
+	}
+
+	selected := healthy[0]
+	if p.Strategy == LeastConnections {
+		for _, j := range healthy {
+			if p.hosts[j].Conns < p.hosts[selected].Conns {
+				selected = j
+			}
+		}
+	}
+	p.next = (selected + 1) % n
+	hosts := []string{p.hosts[selected].Host}
+	for _, j := range healthy {
+		if j != selected {
+			hosts = append(hosts, p.hosts[j].Host)
+		}
+	}
+	return hosts, nil
+}
+
+// Connected counts a connection to host. Call it from
+// ProxyServer.AuthenticatedHook with ProxyConn.DestinationHost.
+func (p *UpstreamPool) Connected(host string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if h := p.find(host); h != nil {
+		h.Conns++
+	}
+}
+
+// Disconnected uncounts a connection to host. Call it from
+// ProxyServer.ClosedHook with ProxyConn.DestinationHost.
+func (p *UpstreamPool) Disconnected(host string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if h := p.find(host); h != nil && h.Conns > 0 {
+		h.Conns--
+	}
+}
+
+// Run checks every host once, concurrently. Its signature fits
+// JobScheduler.Schedule.
+func (p *UpstreamPool) Run() {
+	p.mu.Lock()
+	hosts := make([]string, len(p.hosts))
+	for i, h := range p.hosts {
+		hosts[i] = h.Host
+	}
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			p.record(host, p.check(host))
+		}(host)
+	}
+	wg.Wait()
+}
+
+// check runs one health check of host.
+func (p *UpstreamPool) check(host string) error {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	dial := p.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	port := p.Port
+	if port == 0 {
+		port = 22
+	}
+	c, err := dial(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if p.Check == HealthCheckBanner {
+		deadline, _ := ctx.Deadline()
+		c.SetDeadline(deadline)
+		if _, err := readVersion(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// record updates the state of host with the result of a check.
+func (p *UpstreamPool) record(host string, err error) {
+	p.mu.Lock()
+	h := p.find(host)
+	if h == nil {
+		p.mu.Unlock()
+		return
+	}
+	healthy := h.Healthy
+	if err == nil {
+		delete(p.fails, host)
+		h.Healthy, h.Err = true, nil
+	} else {
+		if p.fails == nil {
+			p.fails = make(map[string]int)
+		}
+		p.fails[host]++
+		threshold := p.FailThreshold
+		if threshold <= 0 {
+			threshold = 1
+		}
+		h.Err = err
+		if p.fails[host] >= threshold {
+			h.Healthy = false
+		}
+	}
+	status := *h
+	p.mu.Unlock()
+	if status.Healthy != healthy && p.StatusHook != nil {
+		p.StatusHook(status)
+	}
+}
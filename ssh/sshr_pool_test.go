@@ -0,0 +1,139 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// testPoolDial dials "ssh" to a server sending an SSH banner and "http" to
+// one that does not; other hosts are refused.
+func testPoolDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	switch addr {
+	case "ssh:22":
+		go io.WriteString(c1, "SSH-2.0-upstream\r\n")
+	case "http:22":
+		go func() {
+			io.WriteString(c1, "HTTP/1.1 400 Bad Request\r\n")
+			c1.Close()
+		}()
+	default:
+		c1.Close()
+		c2.Close()
+		return nil, errors.New("connection refused")
+	}
+	return c2, nil
+}
+
+func poolHealth(p *UpstreamPool) map[string]bool {
+	health := make(map[string]bool)
+	for _, s := range p.Status() {
+		health[s.Host] = s.Healthy
+	}
+	return health
+}
+
+func TestUpstreamPoolHealthCheck(t *testing.T) {
+	var mu sync.Mutex
+	var changes []UpstreamStatus
+	p := &UpstreamPool{
+		Dial: testPoolDial,
+		StatusHook: func(s UpstreamStatus) {
+			mu.Lock()
+			changes = append(changes, s)
+			mu.Unlock()
+		},
+	}
+	p.Add("ssh", "http", "down")
+	p.Run()
+	if got := poolHealth(p); !got["ssh"] || !got["http"] || got["down"] {
+		t.Errorf("TCP checks: got %v", got)
+	}
+	if len(changes) != 1 || changes[0].Host != "down" || changes[0].Err == nil {
+		t.Errorf("got status changes %+v", changes)
+	}
+
+	p.Check = HealthCheckBanner
+	p.Run()
+	if got := poolHealth(p); !got["ssh"] || got["http"] || got["down"] {
+		t.Errorf("banner checks: got %v", got)
+	}
+
+	p.FailThreshold = 2
+	p.Remove("http")
+	p.Add("http")
+	p.Run()
+	if got := poolHealth(p); !got["http"] {
+		t.Error("unhealthy after one failed check with FailThreshold 2")
+	}
+	p.Run()
+	if got := poolHealth(p); got["http"] {
+		t.Error("healthy after two failed checks with FailThreshold 2")
+	}
+}
+
+func TestUpstreamPoolSelection(t *testing.T) {
+	p := &UpstreamPool{Dial: testPoolDial}
+	if _, err := p.Pick(); err != ErrNoHealthyUpstream {
+		t.Errorf("empty pool: got %v, want ErrNoHealthyUpstream", err)
+	}
+	p.Add("a", "b", "c")
+	var got []string
+	for i := 0; i < 4; i++ {
+		host, _ := p.Pick()
+		got = append(got, host)
+	}
+	if want := []string{"a", "b", "c", "a"}; !equalStrings(got, want) {
+		t.Errorf("round-robin: got %v, want %v", got, want)
+	}
+
+	p.Strategy = LeastConnections
+	p.Connected("a")
+	p.Connected("b")
+	p.Connected("b")
+	p.Connected("c")
+	if host, _ := p.Pick(); host != "a" && host != "c" {
+		t.Errorf("least connections: got %s", host)
+	}
+	p.Disconnected("c")
+	for i := 0; i < 3; i++ {
+		if host, _ := p.Pick(); host != "c" {
+			t.Errorf("least connections: got %s, want c", host)
+		}
+	}
+
+	p.Strategy = RoundRobin
+	p.Remove("a")
+	p.Remove("b")
+	p.Remove("c")
+	p.Add("down", "ssh", "http")
+	p.Run()
+	got = nil
+	for i := 0; i < 4; i++ {
+		hosts, err := p.FindUpstream("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, hosts)
+	}
+	// Unhealthy hosts are skipped, and the others follow as fallbacks.
+	if want := []string{"ssh http", "http ssh", "ssh http", "http ssh"}; !equalStrings(got, want) {
+		t.Errorf("FindUpstream: got %q, want %q", got, want)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
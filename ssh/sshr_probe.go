@@ -0,0 +1,114 @@
+package ssh
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// ProbeResult describes one synthetic login through the proxy.
+type ProbeResult struct {
+	Started time.Time
+
+	// Durations of the stages that completed.
+	Dial  time.Duration
+	Login time.Duration
+	Exec  time.Duration
+
+	// Stage is "dial", "login", "session" or "exec" if the probe failed in
+	// that stage, and empty on success.
+	Stage string
+	Err   error
+}
+
+// Total returns the duration of all completed stages.
+func (r ProbeResult) Total() time.Duration {
+	return r.Dial + r.Login + r.Exec
+}
+
+// Prober runs synthetic logins through a proxy, as a client would: it dials
+// the proxy, authenticates as a dedicated probe user that is routed to a
+// canary upstream, and runs a command. Run it periodically, for example with
+// a JobScheduler, to detect broken routes or credentials before users do.
+type Prober struct {
+	// Dial connects to the proxy listener.
+	Dial func() (net.Conn, error)
+
+	// Addr is the address passed to NewClientConn for host key checking.
+	Addr string
+
+	// ClientConfig holds the probe user's credentials.
+	ClientConfig *ClientConfig
+
+	// Command run on the upstream. If empty, "true" is used.
+	Command string
+
+	// Timeout for the whole probe. If zero, 30 seconds are used.
+	Timeout time.Duration
+
+	// ResultHook is called with the result of every probe run by Run.
+	ResultHook func(ProbeResult)
+}
+
+var errProbeTimeout = errors.New("ssh: probe timed out")
+
+// Probe runs one synthetic login and returns its result.
+func (p *Prober) Probe() ProbeResult {
+	r := ProbeResult{Started: time.Now()}
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	deadline := r.Started.Add(timeout)
+
+	c, err := p.Dial()
+	r.Dial = time.Since(r.Started)
+	if err != nil {
+		r.Stage, r.Err = "dial", err
+		return r
+	}
+	defer c.Close()
+	c.SetDeadline(deadline)
+
+	fail := func(stage string, err error) ProbeResult {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() || time.Now().After(deadline) {
+			err = errProbeTimeout
+		}
+		r.Stage, r.Err = stage, err
+		return r
+	}
+
+	start := time.Now()
+	conn, chans, reqs, err := NewClientConn(c, p.Addr, p.ClientConfig)
+	if err != nil {
+		return fail("login", err)
+	}
+	client := NewClient(conn, chans, reqs)
+	defer client.Close()
+	r.Login = time.Since(start)
+
+	start = time.Now()
+	session, err := client.NewSession()
+	if err != nil {
+		return fail("session", err)
+	}
+	defer session.Close()
+	cmd := p.Command
+	if cmd == "" {
+		cmd = "true"
+	}
+	if err := session.Run(cmd); err != nil {
+		return fail("exec", err)
+	}
+	r.Exec = time.Since(start)
+	return r
+}
+
+// Run runs a probe and passes the result to ResultHook. Its signature fits
+// JobScheduler.Schedule.
+func (p *Prober) Run() {
+	r := p.Probe()
+	if p.ResultHook != nil {
+		p.ResultHook(r)
+	}
+}
@@ -0,0 +1,61 @@
+package ssh
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func testProber(signer Signer) *Prober {
+	return &Prober{
+		Dial: func() (net.Conn, error) {
+			c1, c2, err := netPipe()
+			if err != nil {
+				return nil, err
+			}
+			go runTestProxy(c1, newTestProxyConfig(), newTestUpstreamConfig(), make(chan proxyTestResult, 1))
+			return c2, nil
+		},
+		Addr: "proxy",
+		ClientConfig: &ClientConfig{
+			User:            "testuser",
+			Auth:            []AuthMethod{PublicKeys(signer)},
+			HostKeyCallback: InsecureIgnoreHostKey(),
+		},
+	}
+}
+
+func TestProberSuccess(t *testing.T) {
+	var results []ProbeResult
+	p := testProber(testSigners["ecdsa"])
+	p.ResultHook = func(r ProbeResult) { results = append(results, r) }
+	p.Run()
+
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	r := results[0]
+	if r.Err != nil {
+		t.Fatalf("probe failed in stage %q: %v", r.Stage, r.Err)
+	}
+	if r.Login <= 0 || r.Exec <= 0 || r.Total() < r.Login+r.Exec {
+		t.Errorf("bad durations: %+v", r)
+	}
+}
+
+func TestProberLoginFailure(t *testing.T) {
+	r := testProber(testSigners["ed25519"]).Probe()
+	if r.Err == nil || r.Stage != "login" {
+		t.Errorf("got stage %q, err %v; want login failure", r.Stage, r.Err)
+	}
+}
+
+func TestProberDialFailure(t *testing.T) {
+	p := testProber(testSigners["ecdsa"])
+	dialErr := errors.New("connection refused")
+	p.Dial = func() (net.Conn, error) { return nil, dialErr }
+	r := p.Probe()
+	if r.Err != dialErr || r.Stage != "dial" {
+		t.Errorf("got stage %q, err %v; want dial failure", r.Stage, r.Err)
+	}
+}
@@ -0,0 +1,241 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyProtocolMode tells whether downstream connections start with a
+// PROXY protocol header, as sent by HAProxy and many L4 load balancers to
+// pass on the address of the original client.
+type ProxyProtocolMode int
+
+const (
+	// ProxyProtocolOff reads no header.
+	ProxyProtocolOff ProxyProtocolMode = iota
+	// ProxyProtocolOptional reads a header if the connection starts with
+	// one.
+	ProxyProtocolOptional
+	// ProxyProtocolRequired refuses connections without a header.
+	ProxyProtocolRequired
+)
+
+var (
+	errProxyHeaderMissing = errors.New("ssh: PROXY protocol header required")
+	errProxyHeaderInvalid = errors.New("ssh: invalid PROXY protocol header")
+	errProxyUntrusted     = errors.New("ssh: PROXY protocol header from untrusted source")
+	errNoTrustedProxies   = errors.New("ssh: PROXY protocol requires trusted proxies")
+)
+
+// proxyHeaderTimeout bounds the time to wait for a PROXY protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature starts version 2 headers.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxProxyV1Header is the longest version 1 header, including CRLF.
+const maxProxyV1Header = 107
+
+// ReadProxyHeader reads the PROXY protocol header, version 1 or 2, that c
+// starts with according to mode. The returned connection reports the
+// addresses of the original client and server, unless the header carries
+// none, such as a health check's. Wrap it in ServerConfig.PreHandshakeHook
+// to use it with NewDownstreamConn. The header is trusted, so c must come
+// from a trusted proxy: any client can claim any address in a header.
+func ReadProxyHeader(c net.Conn, mode ProxyProtocolMode) (net.Conn, error) {
+	pc := newProxyProtocolConn(c, mode, nil)
+	pc.trustAll = true
+	if err := pc.readHeader(); err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// NewProxyProtocolListener returns a listener whose connections read their
+// PROXY protocol header according to mode, when they are first read from
+// or asked for their addresses. Headers are only accepted from the trusted
+// networks, since any client can claim any address in a header; other
+// sources, all of them if trusted is empty, are served with their own
+// address if the header is optional, and refused otherwise.
+func NewProxyProtocolListener(l net.Listener, mode ProxyProtocolMode, trusted []*net.IPNet) net.Listener {
+	return &proxyProtocolListener{Listener: l, mode: mode, trusted: trusted}
+}
+
+type proxyProtocolListener struct {
+	net.Listener
+	mode    ProxyProtocolMode
+	trusted []*net.IPNet
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newProxyProtocolConn(c, l.mode, l.trusted), nil
+}
+
+// proxyProtocolConn is a connection behind a PROXY protocol header.
+type proxyProtocolConn struct {
+	net.Conn
+	mode    ProxyProtocolMode
+	trusted []*net.IPNet
+	// trustAll accepts headers from any source.
+	trustAll bool
+	r        *bufio.Reader
+
+	once          sync.Once
+	err           error
+	remote, local net.Addr
+}
+
+func newProxyProtocolConn(c net.Conn, mode ProxyProtocolMode, trusted []*net.IPNet) *proxyProtocolConn {
+	return &proxyProtocolConn{Conn: c, mode: mode, trusted: trusted, r: bufio.NewReader(c)}
+}
+
+// readHeader reads the header once and returns the error it failed with.
+func (c *proxyProtocolConn) readHeader() error {
+	c.once.Do(func() {
+		if c.mode == ProxyProtocolOff {
+			return
+		}
+		if !c.trustAll {
+			ip := net.ParseIP(sourceHost(c.Conn.RemoteAddr()))
+			if ip == nil || !containsIP(c.trusted, ip) {
+				if c.mode == ProxyProtocolRequired {
+					c.err = errProxyUntrusted
+				}
+				return
+			}
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.local, c.err = parseProxyHeader(c.r, c.mode == ProxyProtocolRequired)
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+	return c.err
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	if c.readHeader() == nil && c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	if c.readHeader() == nil && c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// parseProxyHeader reads a version 1 or 2 header from r and returns the
+// addresses it carries, which are nil for connections without addresses
+// and, unless required, without header.
+func parseProxyHeader(r *bufio.Reader, required bool) (remote, local net.Addr, err error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch first[0] {
+	case 'P':
+		return parseProxyV1(r)
+	case proxyV2Signature[0]:
+		return parseProxyV2(r)
+	}
+	if required {
+		return nil, nil, errProxyHeaderMissing
+	}
+	return nil, nil, nil
+}
+
+func parseProxyV1(r *bufio.Reader) (remote, local net.Addr, err error) {
+	var line []byte
+	for len(line) < maxProxyV1Header {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errProxyHeaderInvalid
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, nil, errProxyHeaderInvalid
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, nil, errProxyHeaderInvalid
+	}
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil || (src.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, nil, errProxyHeaderInvalid
+	}
+	return &net.TCPAddr{IP: src, Port: int(srcPort)}, &net.TCPAddr{IP: dst, Port: int(dstPort)}, nil
+}
+
+func parseProxyV2(r *bufio.Reader) (remote, local net.Addr, err error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Signature) || hdr[12]>>4 != 2 {
+		return nil, nil, errProxyHeaderInvalid
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	switch hdr[12] & 0xf {
+	case 0:
+		// LOCAL, for example a health check of the load balancer.
+		return nil, nil, nil
+	case 1:
+	default:
+		return nil, nil, fmt.Errorf("ssh: unknown PROXY protocol command %d", hdr[12]&0xf)
+	}
+
+	var size int
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		size = net.IPv4len
+	case 0x21: // TCP over IPv6
+		size = net.IPv6len
+	default:
+		// Other transports carry no address a TCP peer can have.
+		return nil, nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, nil, errProxyHeaderInvalid
+	}
+	src := net.IP(append([]byte(nil), body[:size]...))
+	dst := net.IP(append([]byte(nil), body[size:2*size]...))
+	ports := body[2*size:]
+	return &net.TCPAddr{IP: src, Port: int(binary.BigEndian.Uint16(ports))},
+		&net.TCPAddr{IP: dst, Port: int(binary.BigEndian.Uint16(ports[2:]))}, nil
+}
@@ -0,0 +1,171 @@
+package ssh
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+)
+
+// proxyV2Header returns a version 2 PROXY header for TCP over IPv6.
+func proxyV2Header(src, dst net.IP, srcPort, dstPort uint16) []byte {
+	hdr := append([]byte(nil), proxyV2Signature...)
+	hdr = append(hdr, 0x21, 0x21, 0, 36)
+	hdr = append(hdr, src.To16()...)
+	hdr = append(hdr, dst.To16()...)
+	return append(hdr, byte(srcPort>>8), byte(srcPort), byte(dstPort>>8), byte(dstPort))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		header string
+		mode   ProxyProtocolMode
+		remote string
+		ok     bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 203.0.113.9 192.0.2.1 4242 22\r\n", ProxyProtocolRequired, "203.0.113.9:4242", true},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::9 2001:db8::1 4242 22\r\n", ProxyProtocolRequired, "[2001:db8::9]:4242", true},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", ProxyProtocolRequired, "pipe", true},
+		{"v2", string(proxyV2Header(net.ParseIP("2001:db8::9"), net.ParseIP("2001:db8::1"), 4242, 22)), ProxyProtocolRequired, "[2001:db8::9]:4242", true},
+		{"optional without header", "", ProxyProtocolOptional, "pipe", true},
+		{"required without header", "", ProxyProtocolRequired, "", false},
+		{"v1 family mismatch", "PROXY TCP4 2001:db8::9 192.0.2.1 4242 22\r\n", ProxyProtocolRequired, "", false},
+		{"v1 unterminated", "PROXY TCP4 203.0.113.9 192.0.2.1 4242 22\n", ProxyProtocolRequired, "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+			go io.WriteString(c2, tc.header+"SSH-2.0-test\r\n")
+
+			c, err := ReadProxyHeader(c1, tc.mode)
+			if !tc.ok {
+				if err == nil {
+					t.Fatal("header accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadProxyHeader: %v", err)
+			}
+			if got := c.RemoteAddr().String(); got != tc.remote {
+				t.Errorf("got remote address %s, want %s", got, tc.remote)
+			}
+			buf := make([]byte, 14)
+			if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "SSH-2.0-test\r\n" {
+				t.Errorf("got %q, %v after the header", buf, err)
+			}
+		})
+	}
+}
+
+func TestProxyServerProxyProtocol(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.FindUpstreamHook = func(username string) (string, error) { return "upstream", nil }
+	proxyConf.AccessControl = &AccessControl{Allow: mustParseCIDRs(t, "203.0.113.0/24")}
+	remote := make(chan string, 1)
+	s := &ProxyServer{
+		Config: proxyConf,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			u1, u2, err := netPipe()
+			if err != nil {
+				return nil, err
+			}
+			go serveTestUpstream(u1, newTestUpstreamConfig())
+			return u2, nil
+		},
+		AuthenticatedHook: func(p *ProxyConn) { remote <- p.Downstream.RemoteAddr().String() },
+		ProxyProtocol:     ProxyProtocolRequired,
+		TrustedProxies:    mustParseCIDRs(t, "127.0.0.1"),
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "PROXY TCP4 203.0.113.9 192.0.2.1 4242 22\r\n")
+	conn, chans, reqs, err := NewClientConn(c, "proxy", &ClientConfig{
+		User:            "testuser",
+		Auth:            []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	defer NewClient(conn, chans, reqs).Close()
+	if got := <-remote; got != "203.0.113.9:4242" {
+		t.Errorf("got remote address %s, want 203.0.113.9:4242", got)
+	}
+
+	// Without the header, the client is refused.
+	if _, err := dialTestProxyServer(l.Addr().String()); err == nil {
+		t.Error("connection without PROXY header logged in")
+	}
+}
+
+func TestProxyProtocolListenerUntrusted(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		mode    ProxyProtocolMode
+		trusted []*net.IPNet
+	}{
+		{"no trusted proxies", ProxyProtocolOptional, nil},
+		{"untrusted source", ProxyProtocolOptional, mustParseCIDRs(t, "192.0.2.0/24")},
+		{"untrusted source required", ProxyProtocolRequired, mustParseCIDRs(t, "192.0.2.0/24")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			l := NewProxyProtocolListener(inner, tc.mode, tc.trusted)
+			defer l.Close()
+			const header = "PROXY TCP4 203.0.113.9 192.0.2.1 4242 22\r\n"
+			go func() {
+				if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+					io.WriteString(c, header)
+					defer c.Close()
+					io.Copy(io.Discard, c)
+				}
+			}()
+			c, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if got := sourceHost(c.RemoteAddr()); got != "127.0.0.1" {
+				t.Errorf("got remote address %s from an untrusted header", got)
+			}
+			buf := make([]byte, len(header))
+			_, err = io.ReadFull(c, buf)
+			if tc.mode == ProxyProtocolRequired {
+				if err != errProxyUntrusted {
+					t.Errorf("got %v, want %v", err, errProxyUntrusted)
+				}
+				return
+			}
+			if err != nil || string(buf) != header {
+				t.Errorf("got %q, %v; want the header passed through", buf, err)
+			}
+		})
+	}
+}
+
+func TestProxyServerRequiresTrustedProxies(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ProxyServer{Config: newTestProxyConfig(), ProxyProtocol: ProxyProtocolOptional}
+	if err := s.Serve(l); err != errNoTrustedProxies {
+		t.Errorf("got %v, want %v", err, errNoTrustedProxies)
+	}
+}
@@ -0,0 +1,110 @@
+package ssh
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// PTYRequest is a "pty-req" or "window-change" request passed to
+// ProxyConfig.PTYHook. The hook may change the fields, for example to cap
+// the dimensions or to normalize the terminal modes.
+type PTYRequest struct {
+	User string
+	// Resize is set for window-change requests, which only carry the
+	// dimensions.
+	Resize bool
+	Term   string
+	// The dimensions in characters and in pixels.
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+	Modes   TerminalModes
+}
+
+// parseTerminalModes decodes the encoded terminal modes of a pty-req. As
+// RFC 4254 says, parsing stops at opcodes 160 to 255, whose arguments are
+// not defined.
+func parseTerminalModes(b string) TerminalModes {
+	modes := make(TerminalModes)
+	for len(b) >= 5 && b[0] != tty_OP_END && b[0] < 160 {
+		modes[b[0]] = binary.BigEndian.Uint32([]byte(b[1:5]))
+		b = b[5:]
+	}
+	return modes
+}
+
+// marshalTerminalModes encodes modes ordered by opcode.
+func marshalTerminalModes(modes TerminalModes) string {
+	ops := make([]int, 0, len(modes))
+	for op := range modes {
+		ops = append(ops, int(op))
+	}
+	sort.Ints(ops)
+	b := make([]byte, 0, 5*len(ops)+1)
+	for _, op := range ops {
+		b = append(b, byte(op))
+		b = appendU32(b, modes[uint8(op)])
+	}
+	return string(append(b, tty_OP_END))
+}
+
+func equalModes(a, b TerminalModes) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for op, v := range a {
+		if w, ok := b[op]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// filterPTY passes the pty-req and window-change requests of the
+// downstream client to the PTYHook. It returns the packet to forward, as
+// rewritten by the hook, or nil if the request was refused.
+func (p *ProxyConn) filterPTY(dir relayDirection, packet []byte) []byte {
+	if dir != toUpstream || packet[0] != msgChannelRequest {
+		return packet
+	}
+	var msg channelRequestMsg
+	if Unmarshal(packet, &msg) != nil || msg.Request != "pty-req" && msg.Request != "window-change" {
+		return packet
+	}
+	req := &PTYRequest{User: p.User, Resize: msg.Request == "window-change"}
+	var pty ptyRequestMsg
+	if req.Resize {
+		var size ptyWindowChangeMsg
+		if Unmarshal(msg.RequestSpecificData, &size) != nil {
+			return packet
+		}
+		pty = ptyRequestMsg{Columns: size.Columns, Rows: size.Rows, Width: size.Width, Height: size.Height}
+	} else {
+		if Unmarshal(msg.RequestSpecificData, &pty) != nil {
+			return packet
+		}
+		req.Term, req.Modes = pty.Term, parseTerminalModes(pty.Modelist)
+	}
+	req.Columns, req.Rows, req.Width, req.Height = pty.Columns, pty.Rows, pty.Width, pty.Height
+	modes := make(TerminalModes, len(req.Modes))
+	for op, v := range req.Modes {
+		modes[op] = v
+	}
+
+	if err := p.config.PTYHook(req); err != nil {
+		p.log(LogInfo, "pty request refused", "request", msg.Request, "error", err)
+		p.failRequest(&msg)
+		return nil
+	}
+	if req.Columns == pty.Columns && req.Rows == pty.Rows && req.Width == pty.Width && req.Height == pty.Height &&
+		(req.Resize || req.Term == pty.Term && equalModes(req.Modes, modes)) {
+		return packet
+	}
+	if req.Resize {
+		msg.RequestSpecificData = Marshal(&ptyWindowChangeMsg{req.Columns, req.Rows, req.Width, req.Height})
+	} else {
+		msg.RequestSpecificData = Marshal(&ptyRequestMsg{req.Term, req.Columns, req.Rows, req.Width, req.Height, marshalTerminalModes(req.Modes)})
+	}
+	return Marshal(&msg)
+}
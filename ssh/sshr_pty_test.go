@@ -0,0 +1,73 @@
+package ssh
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTerminalModesRoundTrip(t *testing.T) {
+	modes := TerminalModes{ECHO: 0, TTY_OP_ISPEED: 38400, VINTR: 3}
+	got := parseTerminalModes(marshalTerminalModes(modes))
+	if !equalModes(got, modes) {
+		t.Errorf("got %v, want %v", got, modes)
+	}
+	// Parsing stops at undefined opcodes.
+	if got := parseTerminalModes("\x35\x00\x00\x00\x01\xa0\x00\x00\x00\x01\x36\x00\x00\x00\x01\x00"); len(got) != 1 || got[ECHO] != 1 {
+		t.Errorf("got %v, want only ECHO", got)
+	}
+}
+
+func TestProxyPTYHook(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.PTYHook = func(req *PTYRequest) error {
+		if req.Term == "evil" {
+			return errors.New("no such terminal")
+		}
+		if req.Columns > 200 {
+			req.Columns = 200
+		}
+		if req.Rows > 100 {
+			req.Rows = 100
+		}
+		if !req.Resize {
+			req.Term = "xterm"
+			delete(req.Modes, IEXTEN)
+		}
+		return nil
+	}
+	addr, requests := serveRequestRecorder(t, proxyConf)
+	client, err := dialTestProxyServer(addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+
+	if err := session.RequestPty("evil", 24, 80, nil); err == nil {
+		t.Error("refused pty request succeeded")
+	}
+	if err := session.RequestPty("xterm-256color", 500, 80, TerminalModes{ECHO: 1, IEXTEN: 1}); err != nil {
+		t.Fatalf("RequestPty: %v", err)
+	}
+	if err := session.WindowChange(50, 1000); err != nil {
+		t.Fatalf("WindowChange: %v", err)
+	}
+
+	req := nextRequest(t, requests)
+	var pty ptyRequestMsg
+	if req.Type != "pty-req" || Unmarshal(req.Payload, &pty) != nil {
+		t.Fatalf("upstream got %s, want pty-req", req.Type)
+	}
+	if modes := parseTerminalModes(pty.Modelist); pty.Term != "xterm" || pty.Rows != 100 || pty.Columns != 80 || !equalModes(modes, TerminalModes{ECHO: 1}) {
+		t.Errorf("upstream got pty %+v with modes %v", pty, modes)
+	}
+	req = nextRequest(t, requests)
+	var size ptyWindowChangeMsg
+	if req.Type != "window-change" || Unmarshal(req.Payload, &size) != nil || size.Rows != 50 || size.Columns != 200 {
+		t.Errorf("upstream got %s %+v, want window-change to 200x50", req.Type, size)
+	}
+}
@@ -0,0 +1,410 @@
+package ssh
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// RecordingInfo describes a recorded terminal session.
+type RecordingInfo struct {
+	// SessionID is the ID of the ProxyConn and Channel the downstream ID
+	// of the recorded session channel within it.
+	SessionID string
+	Channel   uint32
+
+	User       string
+	Upstream   string
+	RemoteAddr string
+
+	// The terminal type and size from the pty request.
+	Term    string
+	Columns int
+	Rows    int
+
+	Started time.Time
+}
+
+// SessionRecorder receives the terminal data of one recorded session
+// channel. Calls are serialized. elapsed is the time since the recording
+// started.
+type SessionRecorder interface {
+	// Output is called with the data the upstream sent to the terminal,
+	// including stderr.
+	Output(elapsed time.Duration, data []byte) error
+	// Input is called with what the user typed, if ProxyConfig.RecordInput
+	// is set.
+	Input(elapsed time.Duration, data []byte) error
+	// Resize is called when the terminal window changes size.
+	Resize(elapsed time.Duration, columns, rows int) error
+	// Close ends the recording when the channel or the connection closes.
+	Close() error
+}
+
+// Recorder starts the recordings of ProxyConfig.Recorder. Implementations
+// decide where recordings go, such as FileRecorder or one that uploads to
+// object storage, and can format them with NewAsciicastRecorder or
+// NewTypescriptRecorder.
+type Recorder interface {
+	StartRecording(info RecordingInfo) (SessionRecorder, error)
+}
+
+// RecordingFormat is the file format of a FileRecorder.
+type RecordingFormat int
+
+const (
+	// RecordAsciicast writes asciinema v2 files, NAME.cast.
+	RecordAsciicast RecordingFormat = iota
+	// RecordTypescript writes the typescript and timing files of script(1),
+	// NAME.typescript and NAME.timing, for scriptreplay.
+	RecordTypescript
+)
+
+// FileRecorder writes recordings to files in Dir, named after the session
+// ID and channel.
+type FileRecorder struct {
+	Dir    string
+	Format RecordingFormat
+}
+
+// StartRecording implements Recorder.
+func (r *FileRecorder) StartRecording(info RecordingInfo) (SessionRecorder, error) {
+	name := filepath.Join(r.Dir, fmt.Sprintf("%s-%d", info.SessionID, info.Channel))
+	open := func(ext string) (*os.File, error) {
+		return os.OpenFile(name+ext, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	}
+	switch r.Format {
+	case RecordAsciicast:
+		f, err := open(".cast")
+		if err != nil {
+			return nil, err
+		}
+		rec, err := NewAsciicastRecorder(f, info)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return rec, nil
+	case RecordTypescript:
+		ts, err := open(".typescript")
+		if err != nil {
+			return nil, err
+		}
+		timing, err := open(".timing")
+		if err != nil {
+			ts.Close()
+			return nil, err
+		}
+		rec, err := NewTypescriptRecorder(ts, timing, info)
+		if err != nil {
+			ts.Close()
+			timing.Close()
+			return nil, err
+		}
+		return rec, nil
+	}
+	return nil, fmt.Errorf("ssh: unknown recording format %d", r.Format)
+}
+
+// closeAll closes those of ws that are io.Closers, after w is flushed.
+func closeAll(w *bufio.Writer, ws ...io.Writer) error {
+	err := w.Flush()
+	for _, w := range ws {
+		if c, ok := w.(io.Closer); ok {
+			if cerr := c.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+type asciicastRecorder struct {
+	dst io.Writer
+	w   *bufio.Writer
+	// partial holds the start of a UTF-8 sequence split between packets,
+	// per event type.
+	partial map[string][]byte
+}
+
+// NewAsciicastRecorder returns a SessionRecorder that writes an asciinema
+// v2 recording to w. Close closes w if it is an io.Closer.
+func NewAsciicastRecorder(w io.Writer, info RecordingInfo) (SessionRecorder, error) {
+	r := &asciicastRecorder{dst: w, w: bufio.NewWriter(w), partial: make(map[string][]byte)}
+	header := struct {
+		Version   int               `json:"version"`
+		Width     int               `json:"width"`
+		Height    int               `json:"height"`
+		Timestamp int64             `json:"timestamp"`
+		Env       map[string]string `json:"env,omitempty"`
+		Title     string            `json:"title,omitempty"`
+	}{2, info.Columns, info.Rows, info.Started.Unix(), nil, info.User + "@" + info.Upstream}
+	if info.Term != "" {
+		header.Env = map[string]string{"TERM": info.Term}
+	}
+	b, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	r.w.Write(append(b, '\n'))
+	return r, r.w.Flush()
+}
+
+func (r *asciicastRecorder) event(elapsed time.Duration, kind string, data []byte) error {
+	// Asciicast events are JSON strings, so hold back an incomplete UTF-8
+	// sequence at the end until the next packet completes it.
+	data = append(r.partial[kind], data...)
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	r.partial[kind] = append([]byte(nil), data[cut:]...)
+	if cut == 0 {
+		return nil
+	}
+	return r.write(elapsed, kind, string(data[:cut]))
+}
+
+func (r *asciicastRecorder) write(elapsed time.Duration, kind, data string) error {
+	b, err := json.Marshal([]interface{}{elapsed.Seconds(), kind, data})
+	if err != nil {
+		return err
+	}
+	r.w.Write(append(b, '\n'))
+	return r.w.Flush()
+}
+
+func (r *asciicastRecorder) Output(elapsed time.Duration, data []byte) error {
+	return r.event(elapsed, "o", data)
+}
+
+func (r *asciicastRecorder) Input(elapsed time.Duration, data []byte) error {
+	return r.event(elapsed, "i", data)
+}
+
+func (r *asciicastRecorder) Resize(elapsed time.Duration, columns, rows int) error {
+	return r.write(elapsed, "r", strconv.Itoa(columns)+"x"+strconv.Itoa(rows))
+}
+
+func (r *asciicastRecorder) Close() error {
+	return closeAll(r.w, r.dst)
+}
+
+type typescriptRecorder struct {
+	ts, timing   io.Writer
+	tsw, timingw *bufio.Writer
+	last         time.Duration
+}
+
+// NewTypescriptRecorder returns a SessionRecorder that writes the output
+// of the session to typescript and its timing to timing, in the classic
+// format of script(1), to be played back with scriptreplay. Input and
+// window size changes are not recorded. Close closes both writers if they
+// are io.Closers.
+func NewTypescriptRecorder(typescript, timing io.Writer, info RecordingInfo) (SessionRecorder, error) {
+	r := &typescriptRecorder{ts: typescript, timing: timing, tsw: bufio.NewWriter(typescript), timingw: bufio.NewWriter(timing)}
+	fmt.Fprintf(r.tsw, "Script started on %s [TERM=%q COLUMNS=\"%d\" LINES=\"%d\"]\n",
+		info.Started.Format("2006-01-02 15:04:05-07:00"), info.Term, info.Columns, info.Rows)
+	return r, r.tsw.Flush()
+}
+
+func (r *typescriptRecorder) Output(elapsed time.Duration, data []byte) error {
+	fmt.Fprintf(r.timingw, "%.6f %d\n", (elapsed - r.last).Seconds(), len(data))
+	r.last = elapsed
+	r.tsw.Write(data)
+	if err := r.tsw.Flush(); err != nil {
+		return err
+	}
+	return r.timingw.Flush()
+}
+
+func (r *typescriptRecorder) Input(time.Duration, []byte) error { return nil }
+
+func (r *typescriptRecorder) Resize(time.Duration, int, int) error { return nil }
+
+func (r *typescriptRecorder) Close() error {
+	fmt.Fprintf(r.tsw, "\nScript done on %s\n", time.Now().Format("2006-01-02 15:04:05-07:00"))
+	err := closeAll(r.tsw, r.ts)
+	if terr := closeAll(r.timingw, r.timing); err == nil {
+		err = terr
+	}
+	return err
+}
+
+// channelRecording is the recording of a session channel.
+type channelRecording struct {
+	mu      sync.Mutex
+	rec     SessionRecorder
+	started time.Time
+	// keys redacts the input with ProxyConfig.RecordKeystrokes.
+	keys *keystrokeFilter
+	// done is set once the recording failed or was closed.
+	done bool
+}
+
+// do calls f with the recorder unless the recording is done.
+func (r *channelRecording) do(f func(rec SessionRecorder, elapsed time.Duration) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done {
+		return nil
+	}
+	if err := f(r.rec, time.Since(r.started)); err != nil {
+		r.done = true
+		return err
+	}
+	return nil
+}
+
+// record passes the terminal data of interactive session channels to the
+// configured Recorder. It must see packets before the channel table, which
+// forgets channels when they close. Recording failures are logged and the
+// session continues unrecorded.
+func (p *ProxyConn) record(dir relayDirection, packet []byte) {
+	if p.config == nil || p.config.Recorder == nil || len(packet) == 0 {
+		return
+	}
+	id, ok := recipient(packet)
+	if !ok {
+		return
+	}
+	p.channels.mu.Lock()
+	var ch *proxyChannel
+	if dir == toUpstream {
+		ch = p.channels.byUpstream[id]
+	} else {
+		ch = p.channels.byDownstream[id]
+	}
+	var rec *channelRecording
+	if ch != nil {
+		rec = ch.recording
+	}
+	p.channels.mu.Unlock()
+	if ch == nil {
+		return
+	}
+
+	var err error
+	switch {
+	case packet[0] == msgChannelRequest && dir == toUpstream:
+		var msg channelRequestMsg
+		if Unmarshal(packet, &msg) != nil {
+			return
+		}
+		switch {
+		case msg.Request == "pty-req" && rec == nil && ch.chanType == "session":
+			var pty ptyRequestMsg
+			if Unmarshal(msg.RequestSpecificData, &pty) != nil {
+				return
+			}
+			err = p.startRecording(ch, pty)
+		case msg.Request == "window-change" && rec != nil:
+			var size ptyWindowChangeMsg
+			if Unmarshal(msg.RequestSpecificData, &size) != nil {
+				return
+			}
+			err = rec.do(func(r SessionRecorder, elapsed time.Duration) error {
+				return r.Resize(elapsed, int(size.Columns), int(size.Rows))
+			})
+		}
+	case packet[0] == msgChannelData && rec != nil && len(packet) >= 9:
+		data := packet[9:]
+		switch {
+		case rec.keys != nil && dir == toUpstream:
+			data = rec.keys.input(data)
+		case rec.keys != nil:
+			rec.keys.output(data)
+		case dir == toUpstream && !p.config.RecordInput:
+			return
+		}
+		err = rec.do(func(r SessionRecorder, elapsed time.Duration) error {
+			if dir == toUpstream {
+				return r.Input(elapsed, data)
+			}
+			return r.Output(elapsed, data)
+		})
+	case packet[0] == msgChannelExtendedData && rec != nil && dir == toDownstream && len(packet) >= 13:
+		data := packet[13:]
+		if rec.keys != nil {
+			rec.keys.output(data)
+		}
+		err = rec.do(func(r SessionRecorder, elapsed time.Duration) error {
+			return r.Output(elapsed, data)
+		})
+	case packet[0] == msgChannelClose && rec != nil:
+		p.stopRecording(ch)
+	}
+	if err != nil {
+		p.log(LogError, "session recording failed", "channel", ch.downstreamID, "error", err)
+	}
+}
+
+func (p *ProxyConn) startRecording(ch *proxyChannel, pty ptyRequestMsg) error {
+	info := RecordingInfo{
+		SessionID:  p.ID(),
+		Channel:    ch.downstreamID,
+		User:       p.User,
+		Upstream:   p.DestinationHost,
+		RemoteAddr: p.Downstream.RemoteAddr().String(),
+		Term:       pty.Term,
+		Columns:    int(pty.Columns),
+		Rows:       int(pty.Rows),
+		Started:    time.Now(),
+	}
+	rec, err := p.config.Recorder.StartRecording(info)
+	if err != nil {
+		return err
+	}
+	p.channels.mu.Lock()
+	ch.recording = &channelRecording{rec: rec, started: info.Started}
+	if p.config.RecordKeystrokes {
+		ch.recording.keys = newKeystrokeFilter(p.config.PasswordPrompt)
+	}
+	p.channels.mu.Unlock()
+	return nil
+}
+
+// stopRecording closes the recording of ch, if any.
+func (p *ProxyConn) stopRecording(ch *proxyChannel) {
+	p.channels.mu.Lock()
+	rec := ch.recording
+	ch.recording = nil
+	p.channels.mu.Unlock()
+	if rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.done = true
+	if err := rec.rec.Close(); err != nil {
+		p.log(LogError, "session recording failed", "channel", ch.downstreamID, "error", err)
+	}
+}
+
+// stopRecordings closes the recordings of the channels still open when the
+// connection ends.
+func (p *ProxyConn) stopRecordings() {
+	p.channels.mu.Lock()
+	var open []*proxyChannel
+	for _, ch := range p.channels.byDownstream {
+		if ch.recording != nil {
+			open = append(open, ch)
+		}
+	}
+	p.channels.mu.Unlock()
+	for _, ch := range open {
+		p.stopRecording(ch)
+	}
+}
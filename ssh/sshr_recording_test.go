@@ -0,0 +1,144 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyRecording(t *testing.T) {
+	dir := t.TempDir()
+	proxyConf := newTestProxyConfig()
+	proxyConf.DestinationPort = 22
+	proxyConf.FindUpstreamHook = func(username string) (string, error) {
+		return "upstream", nil
+	}
+	proxyConf.Recorder = &FileRecorder{Dir: dir}
+	proxyConf.RecordInput = true
+	s, addr, _ := newTestProxyServer(t, proxyConf)
+	closed := make(chan struct{})
+	s.ClosedHook = func(p *ProxyConn, err error) { close(closed) }
+	defer s.Close()
+
+	client, err := dialTestProxyServer(addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	if err := session.RequestPty("xterm", 24, 80, nil); err != nil {
+		t.Fatalf("RequestPty: %v", err)
+	}
+	stdin, _ := session.StdinPipe()
+	stdout, _ := session.StdoutPipe()
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Shell: %v", err)
+	}
+	stdin.Write([]byte("h\xc3\xa9llo\n"))
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "héllo\n" {
+		t.Fatalf("read %q, %v", line, err)
+	}
+	if err := session.WindowChange(40, 120); err != nil {
+		t.Fatalf("WindowChange: %v", err)
+	}
+	session.Close()
+	client.Close()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("session did not end")
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.cast"))
+	if len(files) != 1 {
+		t.Fatalf("got recordings %v, want one", files)
+	}
+	b, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	var header struct {
+		Version int
+		Width   int
+		Height  int
+		Env     map[string]string
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil {
+		t.Fatalf("header %q: %v", lines[0], err)
+	}
+	if header.Version != 2 || header.Width != 80 || header.Height != 24 || header.Env["TERM"] != "xterm" {
+		t.Errorf("got header %+v", header)
+	}
+	got := make(map[string]string)
+	for _, line := range lines[1:] {
+		var ev []interface{}
+		if err := json.Unmarshal([]byte(line), &ev); err != nil || len(ev) != 3 {
+			t.Fatalf("event %q: %v", line, err)
+		}
+		got[ev[1].(string)] += ev[2].(string)
+	}
+	if got["o"] != "héllo\n" || got["i"] != "héllo\n" || got["r"] != "120x40" {
+		t.Errorf("got events %q", got)
+	}
+}
+
+func TestAsciicastSplitRune(t *testing.T) {
+	var buf bytes.Buffer
+	rec, err := NewAsciicastRecorder(&buf, RecordingInfo{Columns: 80, Rows: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Output(0, []byte("a\xe2\x82"))
+	rec.Output(time.Second, []byte("\xacb"))
+	rec.Close()
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	want := []string{`[0,"o","a"]`, `[1,"o","€b"]`}
+	if len(lines) != 3 || lines[1] != want[0] || lines[2] != want[1] {
+		t.Errorf("got %q, want the header and %q", lines, want)
+	}
+}
+
+type closeRecorder struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestTypescriptRecorder(t *testing.T) {
+	var ts, timing closeRecorder
+	rec, err := NewTypescriptRecorder(&ts, &timing, RecordingInfo{Term: "xterm", Columns: 80, Rows: 24, Started: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Output(500*time.Millisecond, []byte("hello"))
+	rec.Input(time.Second, []byte("ignored"))
+	rec.Output(2*time.Second, []byte("!\n"))
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !ts.closed || !timing.closed {
+		t.Error("writers not closed")
+	}
+	header, _ := bufio.NewReader(bytes.NewReader(ts.Bytes())).ReadString('\n')
+	if want := `Script started on 2026-01-02 03:04:05+00:00 [TERM="xterm" COLUMNS="80" LINES="24"]` + "\n"; header != want {
+		t.Errorf("got header %q, want %q", header, want)
+	}
+	if body := strings.TrimPrefix(ts.String(), header); !strings.HasPrefix(body, "hello!\n\nScript done on ") {
+		t.Errorf("got typescript %q", body)
+	}
+	if want := "0.500000 5\n1.500000 2\n"; timing.String() != want {
+		t.Errorf("got timing %q, want %q", timing.String(), want)
+	}
+}
@@ -0,0 +1,71 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RekeyPolicy sets when the keys of one side of the proxy are renegotiated.
+// Zero fields keep the RekeyThreshold and RekeyInterval of the side's
+// ServerConfig or ClientConfig.
+type RekeyPolicy struct {
+	// Bytes sent or received after which a new key is negotiated. It must
+	// be at least 256.
+	Bytes uint64
+	// Interval after which a new key is negotiated, even if the connection
+	// is idle.
+	Interval time.Duration
+}
+
+// apply returns c with the thresholds that are set in r.
+func (r *RekeyPolicy) apply(c Config) Config {
+	if r == nil {
+		return c
+	}
+	if r.Bytes != 0 {
+		c.RekeyThreshold = r.Bytes
+	}
+	if r.Interval != 0 {
+		c.RekeyInterval = r.Interval
+	}
+	return c
+}
+
+func (r *RekeyPolicy) problems(side string) []string {
+	if r == nil {
+		return nil
+	}
+	var problems []string
+	if r.Bytes != 0 && r.Bytes < minRekeyThreshold {
+		problems = append(problems, fmt.Sprintf("%s: rekey threshold %d is below %d bytes", side, r.Bytes, minRekeyThreshold))
+	}
+	if r.Interval < 0 {
+		problems = append(problems, fmt.Sprintf("%s: negative rekey interval %v", side, r.Interval))
+	}
+	return problems
+}
+
+// ApplyRekey checks DownstreamRekey and UpstreamRekey and sets them in
+// ServerConfig and ClientConfig. Like ApplyAlgorithms, call it once before
+// connections are proxied; nothing is changed if it returns an error.
+func (conf *ProxyConfig) ApplyRekey() error {
+	problems := append(conf.DownstreamRekey.problems("downstream"), conf.UpstreamRekey.problems("upstream")...)
+	if conf.DownstreamRekey != nil && conf.ServerConfig == nil {
+		problems = append(problems, "downstream: DownstreamRekey is set without a ServerConfig")
+	}
+	if conf.UpstreamRekey != nil && conf.ClientConfig == nil {
+		problems = append(problems, "upstream: UpstreamRekey is set without a ClientConfig")
+	}
+	if len(problems) > 0 {
+		return errors.New("ssh: invalid rekey policy: " + strings.Join(problems, "; "))
+	}
+	if conf.DownstreamRekey != nil {
+		conf.ServerConfig.Config = conf.DownstreamRekey.apply(conf.ServerConfig.Config)
+	}
+	if conf.UpstreamRekey != nil {
+		conf.ClientConfig.Config = conf.UpstreamRekey.apply(conf.ClientConfig.Config)
+	}
+	return nil
+}
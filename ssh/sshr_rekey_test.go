@@ -0,0 +1,70 @@
+package ssh
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProxyRekeyInterval(t *testing.T) {
+	var upstreamKex int32
+	proxyConf := newTestProxyConfig()
+	proxyConf.ClientConfig.HostKeyCallback = func(hostname string, remote net.Addr, key PublicKey) error {
+		atomic.AddInt32(&upstreamKex, 1)
+		return nil
+	}
+	proxyConf.DownstreamRekey = &RekeyPolicy{Interval: 10 * time.Millisecond}
+	proxyConf.UpstreamRekey = &RekeyPolicy{Bytes: 1 << 20, Interval: 10 * time.Millisecond}
+	if err := proxyConf.ApplyRekey(); err != nil {
+		t.Fatalf("ApplyRekey: %v", err)
+	}
+	if got := proxyConf.ClientConfig.RekeyThreshold; got != 1<<20 {
+		t.Errorf("got upstream RekeyThreshold %d, want %d", got, 1<<20)
+	}
+
+	downstreamKex := &syncChecker{called: make(chan int, 10)}
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User:            "testuser",
+		Auth:            []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+		HostKeyCallback: downstreamKex.Check,
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+
+	// The proxy starts the key exchanges on both legs, though neither the
+	// client nor the upstream server has a rekey interval.
+	for i := 0; i < 3; i++ {
+		select {
+		case <-downstreamKex.called:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("got %d downstream key exchanges, want 3", i)
+		}
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadInt32(&upstreamKex) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d upstream key exchanges, want 3", atomic.LoadInt32(&upstreamKex))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := runHello(t, client); got != "hello" {
+		t.Errorf("got %q after rekeying, want hello", got)
+	}
+}
+
+func TestProxyApplyRekeyInvalid(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.DownstreamRekey = &RekeyPolicy{Bytes: 100}
+	proxyConf.UpstreamRekey = &RekeyPolicy{Interval: -time.Second}
+	err := proxyConf.ApplyRekey()
+	if err == nil || !strings.Contains(err.Error(), "downstream: rekey threshold 100") || !strings.Contains(err.Error(), "upstream: negative rekey interval") {
+		t.Errorf("got error %v, want both policies rejected", err)
+	}
+	if proxyConf.ServerConfig.RekeyThreshold != 0 || proxyConf.ClientConfig.RekeyInterval != 0 {
+		t.Error("configs changed despite the error")
+	}
+}
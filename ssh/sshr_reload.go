@@ -0,0 +1,86 @@
+package ssh
+
+import (
+	"errors"
+	"sync"
+)
+
+// ProxyKeys are the keys and CAs of a proxy that ReloadableConfig swaps.
+// Nil fields keep those of the base configuration.
+type ProxyKeys struct {
+	// HostKeys replace the host keys added to the ServerConfig.
+	HostKeys []Signer
+	// MasterKeys replace MasterKeys, MasterKeySigner and MasterKeyPath.
+	MasterKeys []Signer
+	// TrustedUserCAs replace ProxyConfig.TrustedUserCAs.
+	TrustedUserCAs []PublicKey
+}
+
+// ReloadableConfig holds the ProxyConfig for new connections and replaces
+// it when Reload loads new keys, for example after a SIGHUP or from a
+// JobScheduler. Connections keep using the config they were started with,
+// so established sessions are not disturbed.
+type ReloadableConfig struct {
+	base *ProxyConfig
+	load func() (*ProxyKeys, error)
+
+	mu   sync.Mutex
+	conf *ProxyConfig
+}
+
+// NewReloadableConfig returns a ReloadableConfig for base, whose keys are
+// loaded by load now and on every Reload. base must not be modified
+// afterwards.
+func NewReloadableConfig(base *ProxyConfig, load func() (*ProxyKeys, error)) (*ReloadableConfig, error) {
+	if base.ServerConfig == nil {
+		return nil, errors.New("ssh: ReloadableConfig needs a ServerConfig")
+	}
+	r := &ReloadableConfig{base: base, load: load}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Config returns the config to use for a new connection, both for
+// NewDownstreamConn and AuthenticateProxyConn.
+func (r *ReloadableConfig) Config() *ProxyConfig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conf
+}
+
+// Reload loads the keys and replaces the config of new connections. If
+// loading fails, the current config stays in use.
+func (r *ReloadableConfig) Reload() error {
+	keys, err := r.load()
+	if err != nil {
+		return err
+	}
+	if keys.HostKeys != nil && len(keys.HostKeys) == 0 {
+		return errors.New("ssh: reloaded config has no host keys")
+	}
+
+	conf := *r.base
+	serverConf := *r.base.ServerConfig
+	conf.ServerConfig = &serverConf
+	if keys.HostKeys != nil {
+		serverConf.hostKeys = nil
+		for _, k := range keys.HostKeys {
+			serverConf.AddHostKey(k)
+		}
+	}
+	if keys.MasterKeys != nil {
+		conf.MasterKeySigner = nil
+		conf.MasterKeyPath = ""
+		conf.MasterKeys = keys.MasterKeys
+	}
+	if keys.TrustedUserCAs != nil {
+		conf.TrustedUserCAs = keys.TrustedUserCAs
+	}
+
+	r.mu.Lock()
+	r.conf = &conf
+	r.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,69 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestProxyReloadableConfig(t *testing.T) {
+	hostKey := testSigners["ecdsa"]
+	var loadErr error
+	r, err := NewReloadableConfig(newTestProxyConfig(), func() (*ProxyKeys, error) {
+		return &ProxyKeys{
+			HostKeys:       []Signer{hostKey},
+			MasterKeys:     []Signer{testSigners["rsa"]},
+			TrustedUserCAs: []PublicKey{testPublicKeys["ca"]},
+		}, loadErr
+	})
+	if err != nil {
+		t.Fatalf("NewReloadableConfig: %v", err)
+	}
+
+	dial := func(want Signer) *Client {
+		t.Helper()
+		var got PublicKey
+		client, res, err := dialTestProxy(t, r.Config(), newTestUpstreamConfig(), &ClientConfig{
+			User: "testuser",
+			Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+			HostKeyCallback: func(hostname string, remote net.Addr, key PublicKey) error {
+				got = key
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatalf("client: %v, proxy: %v", err, res.err)
+		}
+		if !bytes.Equal(got.Marshal(), want.PublicKey().Marshal()) {
+			t.Errorf("got host key %s, want %s", got.Type(), want.PublicKey().Type())
+		}
+		return client
+	}
+
+	first := dial(testSigners["ecdsa"])
+	defer first.Close()
+
+	hostKey = testSigners["ed25519"]
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	second := dial(testSigners["ed25519"])
+	defer second.Close()
+	if got := runHello(t, first); got != "hello" {
+		t.Errorf("got %q on the connection from before the reload, want hello", got)
+	}
+
+	conf := r.Config()
+	if len(conf.MasterKeys) != 1 || len(conf.TrustedUserCAs) != 1 {
+		t.Errorf("got %d master keys and %d CAs, want 1 each", len(conf.MasterKeys), len(conf.TrustedUserCAs))
+	}
+
+	loadErr = errors.New("vault unavailable")
+	if err := r.Reload(); err != loadErr {
+		t.Errorf("got %v, want the error of the loader", err)
+	}
+	if r.Config() != conf {
+		t.Error("a failed reload replaced the config")
+	}
+}
@@ -0,0 +1,157 @@
+package ssh
+
+import (
+	"net"
+	"sync"
+)
+
+// RolloutStats counts downstream handshakes per group of an
+// AlgorithmRollout.
+type RolloutStats struct {
+	TestHandshakes    int64
+	TestFailures      int64
+	ControlHandshakes int64
+	ControlFailures   int64
+}
+
+func failureRate(failures, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(failures) / float64(total)
+}
+
+// AlgorithmRollout offers new algorithms to a share of downstream
+// connections only. If the test group fails its handshakes noticeably more
+// often than the control group, the rollout disables itself, so a client
+// population that chokes on the new algorithms is only briefly affected.
+type AlgorithmRollout struct {
+	// Ciphers, KeyExchanges and MACs are the algorithms being rolled out.
+	// The test group prefers them over the configured ones; the control
+	// group is not offered them at all.
+	Ciphers      []string
+	KeyExchanges []string
+	MACs         []string
+
+	// Percent of the connections that are put into the test group.
+	Percent int
+
+	// MaxExcessFailureRate is the amount by which the failure rate of the
+	// test group may exceed that of the control group, for example 0.05.
+	// It is checked once MinSamples test handshakes have been seen.
+	MaxExcessFailureRate float64
+	MinSamples           int64
+
+	// AlertHook, if non-nil, is called when the rollout disables itself.
+	AlertHook func(stats RolloutStats)
+
+	mu       sync.Mutex
+	n        uint64
+	stats    RolloutStats
+	disabled bool
+}
+
+// NewDownstreamConn is like the package level NewDownstreamConn, but assigns
+// the connection to a group of the rollout and records the outcome of its
+// handshake. ProxyServer does so for ProxyConfig.AlgorithmRollout.
+func (r *AlgorithmRollout) NewDownstreamConn(c net.Conn, config *ServerConfig) (*connection, error) {
+	conf, test := r.serverConfig(config)
+	conn, err := NewDownstreamConn(c, conf)
+	r.record(test, err == nil)
+	return conn, err
+}
+
+// serverConfig returns config with the algorithms of the group the next
+// connection is assigned to, and whether that is the test group.
+func (r *AlgorithmRollout) serverConfig(config *ServerConfig) (*ServerConfig, bool) {
+	test := r.assign()
+	conf := *config
+	conf.Config = r.algorithms(config.Config, test)
+	return &conf, test
+}
+
+// assign reports whether the next connection belongs to the test group.
+// Assignment is deterministic, like AuditSampler, so small samples match
+// Percent exactly.
+func (r *AlgorithmRollout) assign() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.disabled {
+		return false
+	}
+	r.n++
+	return int((r.n*37)%100) < r.Percent
+}
+
+func (r *AlgorithmRollout) algorithms(base Config, test bool) Config {
+	base.SetDefaults()
+	base.Ciphers = rolloutList(base.Ciphers, r.Ciphers, test)
+	base.KeyExchanges = rolloutList(base.KeyExchanges, r.KeyExchanges, test)
+	base.MACs = rolloutList(base.MACs, r.MACs, test)
+	return base
+}
+
+// rolloutList returns base without the algorithms in rollout, preceded by
+// them if test is set.
+func rolloutList(base, rollout []string, test bool) []string {
+	var out []string
+	if test {
+		out = append(out, rollout...)
+	}
+	for _, algo := range base {
+		if !contains(rollout, algo) {
+			out = append(out, algo)
+		}
+	}
+	return out
+}
+
+func (r *AlgorithmRollout) record(test, ok bool) {
+	r.mu.Lock()
+	if test {
+		r.stats.TestHandshakes++
+		if !ok {
+			r.stats.TestFailures++
+		}
+	} else {
+		r.stats.ControlHandshakes++
+		if !ok {
+			r.stats.ControlFailures++
+		}
+	}
+
+	s := r.stats
+	trip := test && !r.disabled && s.TestHandshakes >= r.MinSamples &&
+		failureRate(s.TestFailures, s.TestHandshakes)-failureRate(s.ControlFailures, s.ControlHandshakes) > r.MaxExcessFailureRate
+	if trip {
+		r.disabled = true
+	}
+	r.mu.Unlock()
+
+	if trip && r.AlertHook != nil {
+		r.AlertHook(s)
+	}
+}
+
+// Stats returns the handshake counters.
+func (r *AlgorithmRollout) Stats() RolloutStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// Disabled reports whether the rollout fell back to the control algorithms
+// for every connection.
+func (r *AlgorithmRollout) Disabled() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.disabled
+}
+
+// Reset clears the counters and re-enables a disabled rollout.
+func (r *AlgorithmRollout) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats = RolloutStats{}
+	r.disabled = false
+}
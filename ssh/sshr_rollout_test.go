@@ -0,0 +1,110 @@
+package ssh
+
+import (
+	"net"
+	"testing"
+)
+
+// dialRollout runs a downstream handshake through r with a client that only
+// supports clientCipher.
+func dialRollout(t *testing.T, r *AlgorithmRollout, clientCipher string) error {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{Config: Config{Ciphers: []string{"aes128-ctr"}}}
+	serverConf.AddHostKey(testSigners["rsa"])
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.NewDownstreamConn(c1, serverConf)
+		c1.Close()
+		done <- err
+	}()
+
+	conf := &ClientConfig{
+		User:            "testuser",
+		Config:          Config{Ciphers: []string{clientCipher}},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	// The client cannot authenticate; only the handshake matters.
+	NewClientConn(c2, "proxy", conf)
+	return <-done
+}
+
+func TestAlgorithmRolloutGroups(t *testing.T) {
+	r := &AlgorithmRollout{Ciphers: []string{"chacha20-poly1305@openssh.com"}, Percent: 100, MinSamples: 1000}
+	if err := dialRollout(t, r, "chacha20-poly1305@openssh.com"); err != nil {
+		t.Errorf("test group did not offer the new cipher: %v", err)
+	}
+	r.Percent = 0
+	if err := dialRollout(t, r, "chacha20-poly1305@openssh.com"); err == nil {
+		t.Error("control group offered the new cipher")
+	}
+	if err := dialRollout(t, r, "aes128-ctr"); err != nil {
+		t.Errorf("control group handshake: %v", err)
+	}
+
+	want := RolloutStats{TestHandshakes: 1, ControlHandshakes: 2, ControlFailures: 1}
+	if got := r.Stats(); got != want {
+		t.Errorf("got stats %+v, want %+v", got, want)
+	}
+}
+
+func TestAlgorithmRolloutFallback(t *testing.T) {
+	var alerts int
+	r := &AlgorithmRollout{
+		Percent:              50,
+		MinSamples:           10,
+		MaxExcessFailureRate: 0.1,
+		AlertHook:            func(RolloutStats) { alerts++ },
+	}
+	for i := 0; i < 100 && !r.Disabled(); i++ {
+		test := r.assign()
+		// The test group fails a third of its handshakes.
+		r.record(test, !test || i%3 != 0)
+	}
+	if !r.Disabled() || alerts != 1 {
+		t.Fatalf("rollout not disabled: disabled %v, %d alerts", r.Disabled(), alerts)
+	}
+	for i := 0; i < 10; i++ {
+		if r.assign() {
+			t.Fatal("disabled rollout assigned a connection to the test group")
+		}
+	}
+
+	r.Reset()
+	if r.Disabled() || r.Stats() != (RolloutStats{}) {
+		t.Error("Reset did not re-enable the rollout")
+	}
+}
+
+func TestProxyServerAlgorithmRollout(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.ServerConfig.Ciphers = []string{"aes128-ctr"}
+	proxyConf.FindUpstreamHook = func(username string) (string, error) { return "upstream", nil }
+	proxyConf.AlgorithmRollout = &AlgorithmRollout{Ciphers: []string{"chacha20-poly1305@openssh.com"}, Percent: 100, MinSamples: 1000}
+	s := &ProxyServer{Config: proxyConf, Dial: serveDial}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	client, err := Dial("tcp", l.Addr().String(), &ClientConfig{
+		User:            "testuser",
+		Config:          Config{Ciphers: []string{"chacha20-poly1305@openssh.com"}},
+		Auth:            []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("test group did not offer the new cipher: %v", err)
+	}
+	client.Close()
+	if got, want := proxyConf.AlgorithmRollout.Stats(), (RolloutStats{TestHandshakes: 1}); got != want {
+		t.Errorf("got stats %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,195 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// UpstreamAuth selects how the proxy authenticates downstream users to
+// their upstream.
+type UpstreamAuth int
+
+const (
+	// UpstreamAuthDefault injects the upstream password if
+	// ProxyConfig.InjectUpstreamPassword is set, or else logs in with a
+	// certificate if ProxyConfig.CertSignerHook is set, or re-signs with the
+	// master key if ProxyConfig.UseMasterKey is set, or with the user's key.
+	UpstreamAuthDefault UpstreamAuth = iota
+	// UpstreamAuthUserKey re-signs with the key from FetchPrivateKeyHook.
+	UpstreamAuthUserKey
+	// UpstreamAuthMasterKey re-signs with the master keys.
+	UpstreamAuthMasterKey
+	// UpstreamAuthPassword logs verified downstream keys and passwords in
+	// with the password from UpstreamPasswordHook.
+	UpstreamAuthPassword
+	// UpstreamAuthCert signs with a fresh key certified for the upstream
+	// user by CertSignerHook.
+	UpstreamAuthCert
+)
+
+// UpstreamRoute tells where and as whom a downstream user is logged in.
+type UpstreamRoute struct {
+	Host string
+	// Port is ProxyConfig.DestinationPort if zero.
+	Port int
+	// User is the upstream username. If empty, the downstream username is
+	// used, as mapped by MapUpstreamUserHook.
+	User string
+	// ClientConfig is ProxyConfig.ClientConfig if nil.
+	ClientConfig *ClientConfig
+	Auth         UpstreamAuth
+	// Dialer is ProxyConfig.UpstreamDialer if nil.
+	Dialer ContextDialer
+	// Jumps are the hosts the upstream is reached through, in order. The
+	// first is dialed with Dialer.
+	Jumps []*JumpHost
+	// Fallbacks are hosts tried in order by ProxyServer when Host cannot
+	// be reached, on the same port and through the same jump hosts.
+	Fallbacks []string
+}
+
+// ContextDialer dials network connections. *net.Dialer implements it, as
+// do the dialers of package proxydial, which reach upstream hosts through
+// SOCKS5 and HTTP CONNECT proxies.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Address returns the host and port to dial.
+func (r *UpstreamRoute) Address() string {
+	return net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
+}
+
+// RouteUpstream returns the route for the connection described by meta from
+// RouteUpstreamHook, or else a route to the host returned by FindUpstream.
+// Unset fields of the route are filled in from conf.
+func (conf *ProxyConfig) RouteUpstream(ctx context.Context, meta HookMetadata) (*UpstreamRoute, error) {
+	var route UpstreamRoute
+	ctx, span := conf.startSpan(ctx, spanFindUpstream, SpanAttribute{"ssh.user", meta.User})
+	if conf.RouteUpstreamHook != nil {
+		r, err := conf.RouteUpstreamHook(ctx, meta)
+		if err != nil {
+			endSpan(span, err)
+			return nil, err
+		}
+		route = *r
+	} else {
+		host, err := conf.FindUpstream(ctx, meta)
+		if err != nil {
+			endSpan(span, err)
+			return nil, err
+		}
+		if strings.Contains(host, ",") {
+			if route.Jumps, host, err = parseJumpChain(host); err != nil {
+				endSpan(span, err)
+				return nil, err
+			}
+		}
+		route.Host = host
+		if hosts := strings.Fields(host); len(hosts) > 1 {
+			route.Host, route.Fallbacks = hosts[0], hosts[1:]
+		}
+	}
+	span.SetAttributes(SpanAttribute{"ssh.upstream.host", route.Host})
+	span.End()
+	if route.Port == 0 {
+		route.Port = conf.DestinationPort
+	}
+	if route.User == "" {
+		user, err := conf.mapUpstreamUser(meta.User)
+		if err != nil {
+			return nil, err
+		}
+		route.User = user
+	}
+	if route.ClientConfig == nil {
+		route.ClientConfig = conf.ClientConfig
+	}
+	if route.Dialer == nil {
+		route.Dialer = conf.UpstreamDialer
+	}
+	conf.setJumpDefaults(ctx, &route)
+	if (conf.UpstreamHostKeyCallback != nil || conf.VersionTemplate != nil) && route.ClientConfig != nil {
+		clientConf := *route.ClientConfig
+		if conf.UpstreamHostKeyCallback != nil {
+			clientConf.HostKeyCallback = upstreamHostKeyCallback(conf.UpstreamHostKeyCallback, route.Address())
+		}
+		if conf.VersionTemplate != nil {
+			if err := conf.VersionTemplate.Apply(nil, &clientConf); err != nil {
+				return nil, err
+			}
+		}
+		route.ClientConfig = &clientConf
+	}
+	return &route, nil
+}
+
+// upstreamHostKeyCallback calls cb with address as the hostname.
+// NewUpstreamConn only knows the remote address of the connection.
+func upstreamHostKeyCallback(cb HostKeyCallback, address string) HostKeyCallback {
+	return func(_ string, remote net.Addr, key PublicKey) error {
+		if err := cb(address, remote, key); err != nil {
+			return &proxyError{cause: ErrHostKeyMismatch, detail: address, err: err}
+		}
+		return nil
+	}
+}
+
+func (conf *ProxyConfig) mapUpstreamUser(username string) (string, error) {
+	if conf.MapUpstreamUserHook == nil {
+		return username, nil
+	}
+	user, err := conf.MapUpstreamUserHook(username)
+	if err != nil {
+		return "", fmt.Errorf("ssh: mapping upstream user of %q: %v", username, err)
+	}
+	return user, nil
+}
+
+// upstreamUser returns the username to log in to the upstream with.
+func (p *ProxyConn) upstreamUser() string {
+	if p.Route != nil && p.Route.User != "" {
+		return p.Route.User
+	}
+	if p.mappedUser != "" {
+		return p.mappedUser
+	}
+	return p.User
+}
+
+// upstreamAuth returns the strategy of conf that applies when the route does
+// not choose one.
+func (conf *ProxyConfig) upstreamAuth() UpstreamAuth {
+	switch {
+	case conf.InjectUpstreamPassword:
+		return UpstreamAuthPassword
+	case conf.CertSignerHook != nil:
+		return UpstreamAuthCert
+	case conf.UseMasterKey:
+		return UpstreamAuthMasterKey
+	}
+	return UpstreamAuthUserKey
+}
+
+// upstreamAuth returns how verified downstream users are logged in to the
+// upstream.
+func (p *ProxyConn) upstreamAuth() UpstreamAuth {
+	if p.Route != nil && p.Route.Auth != UpstreamAuthDefault {
+		return p.Route.Auth
+	}
+	return p.config.upstreamAuth()
+}
+
+// useMasterKey reports whether requests are re-signed with the master key.
+func (p *ProxyConn) useMasterKey() bool {
+	return p.upstreamAuth() == UpstreamAuthMasterKey
+}
+
+// injectPassword reports whether authenticated users are logged in to the
+// upstream with the password from UpstreamPasswordHook.
+func (p *ProxyConn) injectPassword() bool {
+	return p.upstreamAuth() == UpstreamAuthPassword
+}
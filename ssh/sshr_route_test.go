@@ -0,0 +1,234 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRouteUpstreamDefaults(t *testing.T) {
+	clientConf := &ClientConfig{}
+	conf := &ProxyConfig{
+		DestinationPort: 22,
+		ClientConfig:    clientConf,
+		FindUpstreamHook: func(username string) (string, error) {
+			return "db1.internal", nil
+		},
+	}
+	route, err := conf.RouteUpstream(context.Background(), HookMetadata{User: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.Address() != "db1.internal:22" || route.User != "alice" || route.ClientConfig != clientConf || route.Auth != UpstreamAuthDefault {
+		t.Errorf("got route %+v", route)
+	}
+
+	conf.RouteUpstreamHook = func(ctx context.Context, meta HookMetadata) (*UpstreamRoute, error) {
+		if meta.User == "nobody" {
+			return nil, errors.New("no route")
+		}
+		return &UpstreamRoute{Host: "db2.internal", Port: 2222, User: "a.smith"}, nil
+	}
+	route, err = conf.RouteUpstream(context.Background(), HookMetadata{User: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.Address() != "db2.internal:2222" || route.User != "a.smith" || route.ClientConfig != clientConf {
+		t.Errorf("got route %+v", route)
+	}
+	if _, err := conf.RouteUpstream(context.Background(), HookMetadata{User: "nobody"}); err == nil {
+		t.Error("got no error for an unroutable user")
+	}
+}
+
+func TestProxyRouteUpstreamUser(t *testing.T) {
+	var upstreamUsers []string
+	upstreamConf := newTestUpstreamConfig()
+	upstreamConf.AuthLogCallback = func(conn ConnMetadata, method string, err error) {
+		upstreamUsers = append(upstreamUsers, conn.User())
+	}
+	proxyConf := newTestProxyConfig()
+	proxyConf.RouteUpstreamHook = func(ctx context.Context, meta HookMetadata) (*UpstreamRoute, error) {
+		return &UpstreamRoute{Host: "upstream", User: "testuser"}, nil
+	}
+	client, res, err := dialTestProxy(t, proxyConf, upstreamConf, &ClientConfig{
+		User: "alice@proxy",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+
+	for _, u := range upstreamUsers {
+		if u != "testuser" {
+			t.Errorf("upstream saw user %q, want testuser", u)
+		}
+	}
+	if got := runHello(t, client); got != "hello" {
+		t.Errorf("got output %q, want %q", got, "hello")
+	}
+}
+
+func TestProxyRoutePasswordStrategy(t *testing.T) {
+	var methods []string
+	upstreamConf := newTestUpstreamConfig()
+	upstreamConf.AuthLogCallback = func(conn ConnMetadata, method string, err error) {
+		methods = append(methods, method)
+	}
+	proxyConf := newTestProxyConfig()
+	proxyConf.FetchPrivateKeyHook = func(username string) ([]byte, error) {
+		t.Error("private key fetched for the password strategy")
+		return nil, errors.New("unused")
+	}
+	proxyConf.UpstreamPasswordHook = func(username string, methods []string) (string, error) {
+		return upstreamPassword, nil
+	}
+	proxyConf.RouteUpstreamHook = func(ctx context.Context, meta HookMetadata) (*UpstreamRoute, error) {
+		return &UpstreamRoute{Host: "upstream", Auth: UpstreamAuthPassword}, nil
+	}
+	client, res, err := dialTestProxy(t, proxyConf, upstreamConf, &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+
+	if len(methods) == 0 || methods[len(methods)-1] != "password" {
+		t.Errorf("upstream saw methods %v, want a password login", methods)
+	}
+}
+
+func TestProxyMapUpstreamUser(t *testing.T) {
+	var upstreamUsers []string
+	upstreamConf := newTestUpstreamConfig()
+	upstreamConf.AuthLogCallback = func(conn ConnMetadata, method string, err error) {
+		upstreamUsers = append(upstreamUsers, conn.User())
+	}
+	proxyConf := newTestProxyConfig()
+	proxyConf.MapUpstreamUserHook = func(username string) (string, error) {
+		if username != "alice@proxy" {
+			return "", errors.New("unknown user")
+		}
+		return "testuser", nil
+	}
+	client, res, err := dialTestProxy(t, proxyConf, upstreamConf, &ClientConfig{
+		User: "alice@proxy",
+		Auth: []AuthMethod{
+			PublicKeys(testSigners["ed25519"]),
+			Password(upstreamPassword),
+		},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+
+	if len(upstreamUsers) == 0 {
+		t.Fatal("upstream saw no login")
+	}
+	for _, u := range upstreamUsers {
+		if u != "testuser" {
+			t.Errorf("upstream saw user %q, want testuser", u)
+		}
+	}
+
+	if _, _, err := dialTestProxy(t, proxyConf, upstreamConf, &ClientConfig{
+		User: "mallory",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	}); err == nil {
+		t.Error("login succeeded for a user without mapping")
+	}
+}
+
+func TestProxyUpstreamHostKeyCallback(t *testing.T) {
+	var hostnames []string
+	trusted := testPublicKeys["ecdsa"]
+	proxyConf := newTestProxyConfig()
+	proxyConf.UpstreamHostKeyCallback = func(hostname string, remote net.Addr, key PublicKey) error {
+		hostnames = append(hostnames, hostname)
+		if !bytes.Equal(key.Marshal(), trusted.Marshal()) {
+			return errors.New("host key mismatch")
+		}
+		return nil
+	}
+	proxyConf.RouteUpstreamHook = func(ctx context.Context, meta HookMetadata) (*UpstreamRoute, error) {
+		return &UpstreamRoute{Host: "db1.internal", Port: 2222, User: "testuser"}, nil
+	}
+	clientConf := proxyConf.ClientConfig
+	upstreamConf := newTestUpstreamConfig()
+	upstreamConf.AddHostKey(testSigners["ecdsa"])
+	client, res, err := dialTestProxy(t, proxyConf, upstreamConf, &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	client.Close()
+	if len(hostnames) != 1 || hostnames[0] != "db1.internal:2222" {
+		t.Errorf("got hostnames %q, want the route address", hostnames)
+	}
+	if proxyConf.ClientConfig != clientConf || clientConf.HostKeyCallback == nil {
+		t.Error("RouteUpstream changed the shared ClientConfig")
+	}
+
+	trusted = testPublicKeys["rsa"]
+	route, err := proxyConf.RouteUpstream(context.Background(), HookMetadata{User: "testuser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u1, u2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer u1.Close()
+	go serveTestUpstream(u1, upstreamConf)
+	if _, err := NewUpstreamConn(u2, route.ClientConfig); err == nil || !strings.Contains(err.Error(), "host key mismatch") {
+		t.Errorf("got %v, want the host key rejected", err)
+	}
+}
+
+// dialerFunc implements ContextDialer with a function.
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+func TestProxyServerUpstreamDialer(t *testing.T) {
+	dialed := make(chan string, 1)
+	proxyConf := newTestProxyConfig()
+	proxyConf.DestinationPort = 22
+	proxyConf.FindUpstreamHook = func(username string) (string, error) { return "upstream", nil }
+	proxyConf.UpstreamDialer = dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed <- addr
+		u1, u2, err := netPipe()
+		if err != nil {
+			return nil, err
+		}
+		go serveTestUpstream(u1, newTestUpstreamConfig())
+		return u2, nil
+	})
+	s := &ProxyServer{Config: proxyConf}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	client, err := dialTestProxyServer(l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+	if got := <-dialed; got != "upstream:22" {
+		t.Errorf("dialed %q, want upstream:22", got)
+	}
+}
@@ -0,0 +1,345 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SCPTransfer is a file copied with scp through the proxy.
+type SCPTransfer struct {
+	User string
+	// Upload is set for files copied to the upstream and unset for files
+	// copied from it.
+	Upload bool
+	// Target is the path given to scp on the upstream. Name is the name of
+	// the file, preceded by the directories of recursive copies.
+	Target string
+	Name   string
+	Mode   uint32
+	Size   int64
+	// SHA256 is the checksum of the data, set once the file was copied
+	// completely.
+	SHA256 []byte
+}
+
+// SCPPolicy inspects the scp sessions of proxied sessions, which run scp
+// with an exec request. Every file is reported to AuditCallback as an
+// AuditSCPTransfer event. Recent OpenSSH clients transfer files with the
+// sftp subsystem instead unless run with -O; see SFTPPolicy for those.
+type SCPPolicy struct {
+	// DenyUpload refuses all files copied to the upstream and DenyDownload
+	// all files copied from it.
+	DenyUpload   bool
+	DenyDownload bool
+	// MaxFileSize, if positive, refuses larger files.
+	MaxFileSize int64
+	// Hook decides about the files the options above allow. Files it
+	// returns an error for are refused.
+	Hook func(t SCPTransfer) error
+}
+
+var (
+	errSCPDenied     = errors.New("ssh: scp transfer denied by policy")
+	errSCPTooLarge   = errors.New("ssh: scp file too large")
+	errSCPIncomplete = errors.New("ssh: scp transfer incomplete")
+	errSCPHeader     = errors.New("ssh: malformed scp header")
+	errSCPLine       = errors.New("ssh: scp header too long")
+)
+
+// scpMaxLine bounds the header lines, which OpenSSH limits to 2048 bytes.
+const scpMaxLine = 4096
+
+// check returns an error if t is not allowed.
+func (s *SCPPolicy) check(t SCPTransfer) error {
+	if t.Upload && s.DenyUpload || !t.Upload && s.DenyDownload {
+		return errSCPDenied
+	}
+	if s.MaxFileSize > 0 && t.Size > s.MaxFileSize {
+		return errSCPTooLarge
+	}
+	if s.Hook != nil {
+		return s.Hook(t)
+	}
+	return nil
+}
+
+// parseSCPCommand reports whether command runs scp on the upstream, and
+// whether it receives files, with -t, or sends them, with -f.
+func parseSCPCommand(command string) (upload bool, target string, ok bool) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 || path.Base(fields[0]) != "scp" {
+		return false, "", false
+	}
+	i := 1
+	for ; i < len(fields) && strings.HasPrefix(fields[i], "-"); i++ {
+		if fields[i] == "--" {
+			i++
+			break
+		}
+		for _, c := range fields[i][1:] {
+			switch c {
+			case 't':
+				upload, ok = true, true
+			case 'f':
+				upload, ok = false, true
+			}
+		}
+	}
+	target = strings.Join(fields[i:], " ")
+	if len(target) >= 2 && target[0] == '\'' && target[len(target)-1] == '\'' {
+		target = target[1 : len(target)-1]
+	}
+	return upload, target, ok
+}
+
+// parseSCPHeader parses the "C" and "D" lines that announce a file or a
+// directory, like "C0644 1024 name".
+func parseSCPHeader(line []byte) (mode uint32, size int64, name string, err error) {
+	s := strings.TrimSuffix(string(line[1:]), "\n")
+	fields := strings.SplitN(s, " ", 3)
+	if len(fields) != 3 || len(fields[0]) != 4 || fields[2] == "" {
+		return 0, 0, "", errSCPHeader
+	}
+	m, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", errSCPHeader
+	}
+	for _, c := range fields[1] {
+		if c < '0' || c > '9' {
+			return 0, 0, "", errSCPHeader
+		}
+	}
+	if size, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return 0, 0, "", errSCPHeader
+	}
+	return uint32(m), size, fields[2], nil
+}
+
+// scpRelay follows the files sent by the source side of an scp session,
+// the downstream client for uploads and the upstream for downloads.
+type scpRelay struct {
+	p      *ProxyConn
+	ch     *proxyChannel
+	policy *SCPPolicy
+	upload bool
+	target string
+
+	mu sync.Mutex
+	// line is the header line being received, dirs the directories
+	// entered by recursive copies.
+	line []byte
+	dirs []string
+	// file is the file whose data is being received, and remaining the
+	// bytes of it still to come.
+	file      *SCPTransfer
+	remaining int64
+	hash      hash.Hash
+	finished  bool
+}
+
+// startSCP begins to inspect the channel of an scp exec request.
+func (p *ProxyConn) startSCP(msg *channelRequestMsg) {
+	var payload execPayload
+	if msg.Request != "exec" || Unmarshal(msg.RequestSpecificData, &payload) != nil {
+		return
+	}
+	upload, target, ok := parseSCPCommand(payload.Command)
+	if !ok {
+		return
+	}
+	p.channels.mu.Lock()
+	defer p.channels.mu.Unlock()
+	if ch, ok := p.channels.byUpstream[msg.PeersID]; ok && ch.scp == nil {
+		ch.scp = &scpRelay{p: p, ch: ch, policy: p.config.SCP, upload: upload, target: target}
+	}
+}
+
+// filterSCP starts the inspection of scp exec requests and passes the data
+// the source side of their channels sends through it. It returns the packet
+// to forward, or nil if nothing is to be forwarded.
+func (p *ProxyConn) filterSCP(dir relayDirection, packet []byte) ([]byte, error) {
+	switch packet[0] {
+	case msgChannelRequest:
+		var msg channelRequestMsg
+		if dir == toUpstream && Unmarshal(packet, &msg) == nil {
+			p.startSCP(&msg)
+		}
+		return packet, nil
+	case msgChannelData, msgChannelClose:
+	default:
+		return packet, nil
+	}
+
+	id, ok := recipient(packet)
+	if !ok {
+		return packet, nil
+	}
+	p.channels.mu.Lock()
+	ch := p.channels.byUpstream[id]
+	if dir == toDownstream {
+		ch = p.channels.byDownstream[id]
+	}
+	var r *scpRelay
+	if ch != nil {
+		r = ch.scp
+	}
+	p.channels.mu.Unlock()
+	if r == nil {
+		return packet, nil
+	}
+	if packet[0] == msgChannelClose {
+		r.finish()
+		return packet, nil
+	}
+	if r.upload != (dir == toUpstream) {
+		return packet, nil
+	}
+
+	var msg channelDataMsg
+	if Unmarshal(packet, &msg) != nil {
+		return packet, nil
+	}
+	out, err := r.source(msg.Rest)
+	if err != nil {
+		return nil, err
+	}
+	return p.rewriteData(dir, ch, packet, msg.Rest, out)
+}
+
+// source processes data sent by the source side. It returns the data to
+// forward to the sink.
+func (r *scpRelay) source(data []byte) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []byte
+	for len(data) > 0 {
+		switch {
+		case r.file != nil && r.remaining > 0:
+			n := len(data)
+			if int64(n) > r.remaining {
+				n = int(r.remaining)
+			}
+			r.hash.Write(data[:n])
+			r.remaining -= int64(n)
+			out = append(out, data[:n]...)
+			data = data[n:]
+
+		case r.file != nil:
+			// The data is followed by a zero byte, or by an error message
+			// if the source failed to read the file.
+			if data[0] == 0 {
+				out = append(out, 0)
+				data = data[1:]
+				r.done(nil)
+			} else {
+				r.done(errSCPIncomplete)
+			}
+
+		default:
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				if len(r.line)+len(data) > scpMaxLine {
+					return nil, errSCPLine
+				}
+				r.line = append(r.line, data...)
+				return out, nil
+			}
+			r.line = append(r.line, data[:i+1]...)
+			data = data[i+1:]
+			if len(r.line) > scpMaxLine {
+				return nil, errSCPLine
+			}
+			out = append(out, r.header(r.line)...)
+			r.line = r.line[:0]
+		}
+	}
+	return out, nil
+}
+
+// header handles a complete header line and returns what to forward in its
+// place. r.mu must be held.
+func (r *scpRelay) header(line []byte) []byte {
+	switch line[0] {
+	case 'C':
+	case 'D':
+		if _, _, name, err := parseSCPHeader(line); err == nil {
+			r.dirs = append(r.dirs, name)
+		}
+		return line
+	case 'E':
+		if len(r.dirs) > 0 {
+			r.dirs = r.dirs[:len(r.dirs)-1]
+		}
+		return line
+	default:
+		return line
+	}
+
+	t := SCPTransfer{User: r.p.User, Upload: r.upload, Target: r.target}
+	mode, size, name, err := parseSCPHeader(line)
+	t.Name = path.Join(append(r.dirs, name)...)
+	if err == nil {
+		t.Mode, t.Size = mode, size
+		err = r.policy.check(t)
+	}
+	if err == nil {
+		r.file, r.remaining, r.hash = &t, size, sha256.New()
+		return line
+	}
+
+	// Refused files are skipped: the source gets a warning in place of
+	// the acknowledgment and goes on with the next file, and so does the
+	// sink if it is the downstream client.
+	r.p.log(LogInfo, "scp transfer refused", "name", t.Name, "upload", t.Upload, "error", err)
+	r.p.audit(AuditEvent{Type: AuditSCPTransfer, Transfer: &t, Err: err})
+	warning := []byte(fmt.Sprintf("\x01scp: %s: %s\n", name, strings.TrimPrefix(err.Error(), "ssh: ")))
+	if r.upload {
+		r.p.writeToChannel(r.ch, warning)
+		return nil
+	}
+	r.p.writeToUpstream(r.ch, warning)
+	return warning
+}
+
+// done reports the file being received. r.mu must be held.
+func (r *scpRelay) done(err error) {
+	t := r.file
+	r.file = nil
+	if err == nil {
+		t.SHA256 = r.hash.Sum(nil)
+	}
+	r.p.log(LogInfo, "scp transfer", "name", t.Name, "upload", t.Upload, "size", t.Size, "error", err)
+	r.p.audit(AuditEvent{Type: AuditSCPTransfer, Transfer: t, Err: err})
+}
+
+// finish reports a file still being received when the session ends.
+func (r *scpRelay) finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.finished && r.file != nil {
+		r.done(errSCPIncomplete)
+	}
+	r.finished = true
+}
+
+// finishSCP ends the scp relays of a closing connection.
+func (p *ProxyConn) finishSCP() {
+	p.channels.mu.Lock()
+	var relays []*scpRelay
+	for _, ch := range p.channels.byDownstream {
+		if ch.scp != nil {
+			relays = append(relays, ch.scp)
+		}
+	}
+	p.channels.mu.Unlock()
+	for _, r := range relays {
+		r.finish()
+	}
+}
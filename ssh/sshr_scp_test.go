@@ -0,0 +1,240 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseSCPCommand(t *testing.T) {
+	for _, tt := range []struct {
+		command string
+		upload  bool
+		target  string
+		ok      bool
+	}{
+		{"scp -t /tmp", true, "/tmp", true},
+		{"scp -v -r -d -t -- 'dir with spaces'", true, "dir with spaces", true},
+		{"/usr/bin/scp -pf file", false, "file", true},
+		{"scp", false, "", false},
+		{"rsync --server -t .", false, "", false},
+	} {
+		upload, target, ok := parseSCPCommand(tt.command)
+		if upload != tt.upload || target != tt.target || ok != tt.ok {
+			t.Errorf("parseSCPCommand(%q) = %v, %q, %v, want %v, %q, %v", tt.command, upload, target, ok, tt.upload, tt.target, tt.ok)
+		}
+	}
+}
+
+// scpSession reads the acknowledgments of an scp session.
+type scpSession struct {
+	r *bufio.Reader
+}
+
+// ack reads an acknowledgment and the message following it, if any.
+func (s scpSession) ack() byte {
+	b, err := s.r.ReadByte()
+	if err != nil {
+		return 0xff
+	}
+	if b != 0 {
+		s.r.ReadString('\n')
+	}
+	return b
+}
+
+func TestProxySCPPolicy(t *testing.T) {
+	events := make(chan AuditEvent, 10)
+	proxyConf := newTestProxyConfig()
+	proxyConf.DestinationPort = 22
+	proxyConf.FindUpstreamHook = func(username string) (string, error) {
+		return "files.internal", nil
+	}
+	proxyConf.SCP = &SCPPolicy{MaxFileSize: 10}
+	proxyConf.AuditCallback = func(ev AuditEvent) {
+		if ev.Type == AuditSCPTransfer {
+			events <- ev
+		}
+	}
+
+	received := make(chan string, 10)
+	upstreamConf := newTestUpstreamConfig()
+	_, addr := serveTestProxy(t, proxyConf, func(c net.Conn) {
+		_, chans, reqs, err := NewServerConn(c, upstreamConf)
+		if err != nil {
+			return
+		}
+		go DiscardRequests(reqs)
+		for newCh := range chans {
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer ch.Close()
+				req := <-reqs
+				go DiscardRequests(reqs)
+				var cmd execPayload
+				Unmarshal(req.Payload, &cmd)
+				req.Reply(true, nil)
+				s := scpSession{bufio.NewReader(ch)}
+				switch cmd.Command {
+				case "scp -t /upload":
+					// Receive files until the client is done.
+					ch.Write([]byte{0})
+					for {
+						line, err := s.r.ReadString('\n')
+						if err != nil {
+							break
+						}
+						ch.Write([]byte{0})
+						_, size, name, err := parseSCPHeader([]byte(line))
+						if line[0] != 'C' || err != nil {
+							received <- line
+							continue
+						}
+						data := make([]byte, size+1)
+						io.ReadFull(s.r, data)
+						received <- name + ":" + string(data[:size])
+						ch.Write([]byte{0})
+					}
+				case "scp -f /download":
+					s.ack()
+					for _, f := range []string{"hello", "too large for the policy", "world"} {
+						io.WriteString(ch, "C0644 "+strconv.Itoa(len(f))+" file\n")
+						if s.ack() != 0 {
+							received <- "skipped " + f
+							continue
+						}
+						io.WriteString(ch, f+"\x00")
+						s.ack()
+					}
+				}
+				ch.SendRequest("exit-status", false, Marshal(exitStatusMsg{0}))
+			}()
+		}
+	})
+	client, err := dialTestProxyServer(addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	// Upload two files, of which the proxy refuses the second.
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	stdin, _ := session.StdinPipe()
+	stdout, _ := session.StdoutPipe()
+	if err := session.Start("scp -t /upload"); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	s := scpSession{bufio.NewReader(stdout)}
+	if b := s.ack(); b != 0 {
+		t.Fatalf("got %d to start, want 0", b)
+	}
+	io.WriteString(stdin, "C0644 5 small\n")
+	if b := s.ack(); b != 0 {
+		t.Fatalf("got %d to small file, want 0", b)
+	}
+	io.WriteString(stdin, "he")
+	io.WriteString(stdin, "llo\x00")
+	if b := s.ack(); b != 0 {
+		t.Fatalf("got %d after data, want 0", b)
+	}
+	io.WriteString(stdin, "C0644 11 big\n")
+	if b, _ := s.r.ReadByte(); b != 1 {
+		t.Fatalf("got %d to big file, want 1", b)
+	}
+	if msg, _ := s.r.ReadString('\n'); msg != "scp: big: scp file too large\n" {
+		t.Errorf("got warning %q", msg)
+	}
+	io.WriteString(stdin, "D0755 0 sub\n")
+	s.ack()
+	stdin.Close()
+	session.Wait()
+
+	if got := <-received; got != "small:hello" {
+		t.Errorf("upstream received %q", got)
+	}
+	if got := <-received; got != "D0755 0 sub\n" {
+		t.Errorf("upstream received %q after refused file", got)
+	}
+
+	// Download three files, of which the proxy refuses the second.
+	session, err = client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	stdin, _ = session.StdinPipe()
+	stdout, _ = session.StdoutPipe()
+	if err := session.Start("scp -f /download"); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	r := bufio.NewReader(stdout)
+	stdin.Write([]byte{0})
+	var got []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		got = append(got, line)
+		if line[0] != 'C' {
+			continue
+		}
+		_, size, _, _ := parseSCPHeader([]byte(line))
+		stdin.Write([]byte{0})
+		data := make([]byte, size+1)
+		io.ReadFull(r, data)
+		got = append(got, string(data[:size]))
+		stdin.Write([]byte{0})
+	}
+	session.Wait()
+	want := []string{"C0644 5 file\n", "hello", "\x01scp: file: scp file too large\n", "C0644 5 file\n", "world"}
+	if len(got) != len(want) {
+		t.Fatalf("downloaded %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("downloaded %q, want %q", got, want)
+			break
+		}
+	}
+	if got := <-received; got != "skipped too large for the policy" {
+		t.Errorf("upstream reported %q", got)
+	}
+
+	sum := func(s string) []byte {
+		h := sha256.Sum256([]byte(s))
+		return h[:]
+	}
+	for _, w := range []struct {
+		upload bool
+		name   string
+		size   int64
+		sum    []byte
+	}{
+		{true, "small", 5, sum("hello")},
+		{true, "big", 11, nil},
+		{false, "file", 5, sum("hello")},
+		{false, "file", 24, nil},
+		{false, "file", 5, sum("world")},
+	} {
+		select {
+		case ev := <-events:
+			tr := ev.Transfer
+			if tr == nil || tr.Upload != w.upload || tr.Name != w.name || tr.Size != w.size || !bytes.Equal(tr.SHA256, w.sum) || (ev.Err != nil) != (w.sum == nil) {
+				t.Errorf("got event %+v with transfer %+v, want %+v", ev, tr, w)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no event for %q", w.name)
+		}
+	}
+}
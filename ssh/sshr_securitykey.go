@@ -0,0 +1,56 @@
+package ssh
+
+import "errors"
+
+// Flags of security key (FIDO) signatures.
+const (
+	skFlagUserPresent  = 0x01
+	skFlagUserVerified = 0x04
+)
+
+// Options of authorized_keys entries and user certificates that relax or
+// tighten the flags required of security key signatures.
+const (
+	noTouchRequiredOption = "no-touch-required"
+	verifyRequiredOption  = "verify-required"
+)
+
+// isSecurityKey reports whether key, or the key of a certificate, is held by
+// a security key.
+func isSecurityKey(key PublicKey) bool {
+	switch keyAlgoOf(key.Type()) {
+	case KeyAlgoSKECDSA256, KeyAlgoSKED25519:
+		return true
+	}
+	return false
+}
+
+// checkSecurityKeySig returns the flags and counter of sig, a verified
+// signature of a security key, and an error if it lacks flags required by
+// opts, the options of the authorized_keys entry of key if any, or by the
+// certificate key. As in sshd, the user must touch the key unless both
+// opts and the certificate allow otherwise, and verify their identity to it
+// if either requires it.
+func checkSecurityKeySig(key PublicKey, opts *keyOptions, sig *Signature) (*skFields, error) {
+	var skf skFields
+	if err := Unmarshal(sig.Rest, &skf); err != nil {
+		return nil, err
+	}
+	var noTouch, verify bool
+	if opts != nil {
+		noTouch, verify = opts.noTouchRequired, opts.verifyRequired
+	}
+	if cert, ok := key.(*Certificate); ok {
+		_, allowed := cert.Extensions[noTouchRequiredOption]
+		_, required := cert.CriticalOptions[verifyRequiredOption]
+		noTouch = allowed && (opts == nil || noTouch)
+		verify = verify || required
+	}
+	if !noTouch && skf.Flags&skFlagUserPresent == 0 {
+		return nil, errors.New("ssh: security key signature without user presence")
+	}
+	if verify && skf.Flags&skFlagUserVerified == 0 {
+		return nil, errors.New("ssh: security key signature without user verification")
+	}
+	return &skf, nil
+}
@@ -0,0 +1,112 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"strings"
+	"testing"
+)
+
+// skTestSigner signs like a security key holding an Ed25519 key, with
+// fixed flags.
+type skTestSigner struct {
+	priv    ed25519.PrivateKey
+	pub     *skEd25519PublicKey
+	flags   byte
+	counter uint32
+}
+
+func newSKTestSigner(t *testing.T, flags byte) *skTestSigner {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &skTestSigner{priv: priv, pub: &skEd25519PublicKey{application: "ssh:", PublicKey: pub}, flags: flags}
+}
+
+func (s *skTestSigner) PublicKey() PublicKey { return s.pub }
+
+func (s *skTestSigner) Sign(rand io.Reader, data []byte) (*Signature, error) {
+	s.counter++
+	appDigest := sha256.Sum256([]byte(s.pub.application))
+	dataDigest := sha256.Sum256(data)
+	signed := Marshal(struct {
+		ApplicationDigest []byte `ssh:"rest"`
+		Flags             byte
+		Counter           uint32
+		MessageDigest     []byte `ssh:"rest"`
+	}{appDigest[:], s.flags, s.counter, dataDigest[:]})
+	return &Signature{
+		Format: KeyAlgoSKED25519,
+		Blob:   ed25519.Sign(s.priv, signed),
+		Rest:   Marshal(skFields{Flags: s.flags, Counter: s.counter}),
+	}, nil
+}
+
+func TestProxySecurityKeys(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		flags   byte
+		options string
+		ok      bool
+	}{
+		{"touched", skFlagUserPresent, "", true},
+		{"untouched", 0, "", false},
+		{"untouched allowed", 0, "no-touch-required ", true},
+		{"unverified", skFlagUserPresent, "verify-required ", false},
+		{"verified", skFlagUserPresent | skFlagUserVerified, "verify-required ", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			signer := newSKTestSigner(t, tc.flags)
+			var result AuthResult
+			proxyConf := newTestProxyConfig()
+			proxyConf.FetchAuthorizedKeysHook = func(username string) ([]byte, error) {
+				return []byte(tc.options + strings.TrimSpace(string(MarshalAuthorizedKey(signer.PublicKey()))) + "\n"), nil
+			}
+			proxyConf.OnAuthSuccess = func(p *ProxyConn, r AuthResult) error {
+				result = r
+				return nil
+			}
+			client, _, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+				User:            "testuser",
+				Auth:            []AuthMethod{PublicKeys(signer)},
+				HostKeyCallback: InsecureIgnoreHostKey(),
+			})
+			if !tc.ok {
+				if err == nil {
+					client.Close()
+					t.Fatal("logged in")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			if result.SecurityKeyCounter != signer.counter {
+				t.Errorf("got counter %d, want %d", result.SecurityKeyCounter, signer.counter)
+			}
+		})
+	}
+}
+
+func TestSecurityKeyCertOptions(t *testing.T) {
+	signer := newSKTestSigner(t, 0)
+	sig, err := signer.Sign(rand.Reader, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &Certificate{Key: signer.PublicKey(), Permissions: Permissions{Extensions: map[string]string{noTouchRequiredOption: ""}}}
+	if _, err := checkSecurityKeySig(cert, nil, sig); err != nil {
+		t.Errorf("certificate allowing no touch: %v", err)
+	}
+	if _, err := checkSecurityKeySig(cert, &keyOptions{}, sig); err == nil {
+		t.Error("accepted an untouched key whose authorized_keys entry requires touch")
+	}
+	cert.Extensions = nil
+	if _, err := checkSecurityKeySig(cert, &keyOptions{noTouchRequired: true}, sig); err == nil {
+		t.Error("accepted an untouched key whose certificate requires touch")
+	}
+}
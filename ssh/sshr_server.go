@@ -0,0 +1,497 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrProxyServerClosed is returned by ProxyServer.Serve and ListenAndServe
+// after the server was closed.
+var ErrProxyServerClosed = errors.New("ssh: proxy server closed")
+
+// ProxyServer accepts downstream connections and proxies each of them to
+// its upstream: it runs the downstream handshake, routes the user with
+// RouteUpstream, dials and handshakes with the upstream, authenticates and
+// relays until either side closes, each connection in its own goroutine.
+type ProxyServer struct {
+	// Config is used for every connection unless ConfigHook is set.
+	Config *ProxyConfig
+
+	// ConfigHook, if non-nil, returns the config for each new connection,
+	// for example ReloadableConfig.Config.
+	ConfigHook func() *ProxyConfig
+
+	// Dial connects to the upstream. If nil, the route's Dialer is used,
+	// or else a net.Dialer.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// HandshakeTimeout limits the time from accepting a connection until
+	// the user is logged in upstream. If zero, there is no limit.
+	HandshakeTimeout time.Duration
+
+	// UpstreamAttemptTimeout limits the dial and handshake with each
+	// upstream candidate, so that a hung upstream fails over or fails
+	// before HandshakeTimeout. If zero, only HandshakeTimeout applies.
+	UpstreamAttemptTimeout time.Duration
+
+	// DialTimeout limits each attempt to connect to the upstream. A failed
+	// attempt is retried DialRetries times, after DialBackoff, doubled for
+	// every retry, or 100ms if zero.
+	DialTimeout time.Duration
+	DialRetries int
+	DialBackoff time.Duration
+
+	// UpstreamKeepAlive is the TCP keepalive period of upstream
+	// connections. If zero, Go's default is used; if negative, keepalives
+	// are disabled. UpstreamNagle enables Nagle's algorithm, which Go
+	// disables with TCP_NODELAY.
+	UpstreamKeepAlive time.Duration
+	UpstreamNagle     bool
+
+	// FailoverHook, if non-nil, tells whether the next candidate is tried
+	// after err connecting to route. If nil, the next is tried after
+	// network errors, timeouts and connections closed during the
+	// handshake, but not after, for example, a rejected host key.
+	FailoverHook func(route *UpstreamRoute, err error) bool
+
+	// AcceptHook, if non-nil, is called with every accepted connection
+	// before the handshake. An error closes the connection.
+	AcceptHook func(c net.Conn) error
+
+	// AuthenticatedHook, if non-nil, is called once a connection is
+	// logged in upstream, before its traffic is relayed.
+	AuthenticatedHook func(p *ProxyConn)
+
+	// ClosedHook, if non-nil, is called when the relay of an
+	// authenticated connection ends, with the error returned by Wait.
+	ClosedHook func(p *ProxyConn, err error)
+
+	// ErrorHook, if non-nil, is called when a connection fails before it
+	// is authenticated.
+	ErrorHook func(c net.Conn, err error)
+
+	// MaxConns limits the connections served at once and
+	// MaxConnsPerSourceIP those from one address. MaxConnsPerUser limits
+	// the connections of one downstream user, counted from the user's first
+	// authentication request. Clients over a limit are sent a "too many
+	// connections" disconnect message. Zero means no limit.
+	MaxConns            int
+	MaxConnsPerSourceIP int
+	MaxConnsPerUser     int
+
+	// ProxyProtocol tells whether connections start with a PROXY protocol
+	// header, whose client address is then used as the remote address,
+	// for example in ConnMetadata, audit events and from= options. Headers
+	// are only accepted from the TrustedProxies networks, which must be set
+	// unless ProxyProtocol is ProxyProtocolOff: Serve fails without them.
+	ProxyProtocol  ProxyProtocolMode
+	TrustedProxies []*net.IPNet
+
+	// ShutdownMessage, if set, is sent to the downstream clients that
+	// Shutdown disconnects.
+	ShutdownMessage string
+
+	mu        sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]*ProxyConn
+	limits    connLimits
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// ListenAndServe listens on the TCP address addr, ":22" if empty, and
+// calls Serve.
+func (s *ProxyServer) ListenAndServe(addr string) error {
+	if addr == "" {
+		addr = ":22"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until it fails or the server is closed.
+// It closes l when it returns.
+func (s *ProxyServer) Serve(l net.Listener) error {
+	defer l.Close()
+	if s.ProxyProtocol != ProxyProtocolOff && len(s.TrustedProxies) == 0 {
+		return errNoTrustedProxies
+	}
+	if !s.trackListener(l, true) {
+		return ErrProxyServerClosed
+	}
+	defer s.trackListener(l, false)
+	if s.ProxyProtocol != ProxyProtocolOff {
+		l = NewProxyProtocolListener(l, s.ProxyProtocol, s.TrustedProxies)
+	}
+
+	var delay time.Duration
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrProxyServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// Back off like net/http, for example while out of file
+				// descriptors.
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		if !s.trackConn(c, true) {
+			c.Close()
+			return ErrProxyServerClosed
+		}
+		go func() {
+			defer s.wg.Done()
+			defer s.trackConn(c, false)
+			// Admission may wait for the PROXY protocol header that
+			// tells the source address.
+			if !s.admit(c) {
+				s.refuse(c)
+				return
+			}
+			defer s.release(c)
+			s.serveConn(c)
+		}()
+	}
+}
+
+func (s *ProxyServer) config() *ProxyConfig {
+	if s.ConfigHook != nil {
+		return s.ConfigHook()
+	}
+	return s.Config
+}
+
+func (s *ProxyServer) fail(conf *ProxyConfig, c net.Conn, err error) {
+	conf.log(LogWarn, "connection failed", "remote_addr", c.RemoteAddr().String(), "error", err)
+	if s.ErrorHook != nil {
+		s.ErrorHook(c, err)
+	}
+}
+
+// allowed checks c against conf.AccessControl. Connections it refuses are
+// closed.
+func (s *ProxyServer) allowed(conf *ProxyConfig, c net.Conn) bool {
+	if conf.AccessControl == nil {
+		return true
+	}
+	if err := conf.AccessControl.Check(c.RemoteAddr()); err != nil {
+		c.Close()
+		s.fail(conf, c, err)
+		return false
+	}
+	return true
+}
+
+func (s *ProxyServer) serveConn(c net.Conn) {
+	start := time.Now()
+	conf := s.config()
+	if !s.allowed(conf, c) {
+		return
+	}
+	if s.AcceptHook != nil {
+		if err := s.AcceptHook(c); err != nil {
+			c.Close()
+			s.fail(conf, c, err)
+			return
+		}
+	}
+	conf.log(LogDebug, "connection accepted", "remote_addr", c.RemoteAddr().String())
+	ctx, cancel := context.WithCancel(s.baseContext())
+	defer cancel()
+	ctx, span := conf.startSpan(ctx, spanConnection, SpanAttribute{"net.peer.addr", c.RemoteAddr().String()})
+	var err error
+	defer func() { endSpan(span, err) }()
+	hsCtx := ctx
+	if s.HandshakeTimeout > 0 {
+		deadline := time.Now().Add(s.HandshakeTimeout)
+		c.SetDeadline(deadline)
+		var hsCancel context.CancelFunc
+		hsCtx, hsCancel = context.WithDeadline(ctx, deadline)
+		defer hsCancel()
+	}
+
+	_, hsSpan := conf.startSpan(ctx, spanDownstreamHandshake)
+	serverConf, test := conf.ServerConfig, false
+	if conf.VersionTemplate != nil {
+		versioned := *serverConf
+		if err = conf.VersionTemplate.Apply(&versioned, nil); err != nil {
+			endSpan(hsSpan, err)
+			c.Close()
+			s.fail(conf, c, err)
+			return
+		}
+		serverConf = &versioned
+	}
+	if conf.AlgorithmRollout != nil {
+		serverConf, test = conf.AlgorithmRollout.serverConfig(serverConf)
+	}
+	downstream, err := NewDownstreamConnContext(hsCtx, c, serverConf, conf.HandshakeTimeouts)
+	if conf.AlgorithmRollout != nil {
+		conf.AlgorithmRollout.record(test, err == nil)
+	}
+	endSpan(hsSpan, err)
+	if err != nil {
+		s.fail(conf, c, err)
+		return
+	}
+	p, err := s.login(ctx, conf, c, downstream)
+	if err != nil {
+		conf.refuse(downstream, err)
+		downstream.transport.Close()
+		s.fail(conf, c, err)
+		return
+	}
+	span.SetAttributes(SpanAttribute{"ssh.user", p.User}, SpanAttribute{"ssh.upstream.host", p.DestinationHost})
+	c.SetDeadline(time.Time{})
+	p.Upstream.NetConn().SetDeadline(time.Time{})
+	if !s.trackProxyConn(c, p) {
+		// Logged in while shutting down.
+		s.disconnect(p)
+		s.fail(conf, c, ErrProxyServerClosed)
+		return
+	}
+	conf.Metrics.observeHandshake(p.DestinationHost, time.Since(start))
+
+	if s.AuthenticatedHook != nil {
+		s.AuthenticatedHook(p)
+	}
+	err = p.Wait()
+	if s.ClosedHook != nil {
+		s.ClosedHook(p, err)
+	}
+}
+
+// login connects the downstream user to the upstream.
+func (s *ProxyServer) login(ctx context.Context, conf *ProxyConfig, c net.Conn, downstream *connection) (*ProxyConn, error) {
+	authReq, err := downstream.GetAuthRequestMsg()
+	if err != nil {
+		return nil, err
+	}
+	if !s.admitUser(c, authReq.User) {
+		disconnectTooMany(downstream)
+		return nil, ErrTooManyConnections
+	}
+	route, err := conf.RouteUpstream(ctx, downstream.HookMetadata(authReq))
+	if err != nil {
+		return nil, noUpstreamError{err}
+	}
+
+	dialCtx := ctx
+	if s.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, s.HandshakeTimeout)
+		defer cancel()
+	}
+	upstream, route, err := s.connectUpstream(ctx, dialCtx, conf, route, authReq.User, downstream)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ProxyConn{
+		User:            authReq.User,
+		DestinationHost: route.Host,
+		Upstream:        upstream,
+		Downstream:      downstream,
+		Route:           route,
+	}
+	if err := p.AuthenticateProxyConnContext(ctx, authReq, conf); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// dialUpstream dials and handshakes with the upstream of route within
+// dialCtx.
+func (s *ProxyServer) dialUpstream(ctx, dialCtx context.Context, conf *ProxyConfig, route *UpstreamRoute, user string, downstream *connection) (*connection, error) {
+	dial := s.upstreamDialer(route)
+	start := time.Now()
+	_, span := conf.startSpan(ctx, spanUpstreamDial, SpanAttribute{"ssh.upstream.host", route.Host})
+	uc, err := route.Dial(dialCtx, dial)
+	endSpan(span, err)
+	conf.Metrics.observeDial(route.Host, time.Since(start), err)
+	if err != nil {
+		conf.log(LogError, "upstream dial failed", "user", user, "upstream", route.Address(), "error", err)
+		conf.audit(AuditEvent{Type: AuditUpstreamDialError, User: user, RemoteAddr: downstream.RemoteAddr(), Upstream: route.Host, Err: err})
+		return nil, &proxyError{cause: ErrUpstreamUnreachable, detail: route.Address(), err: err}
+	}
+	_, span = conf.startSpan(ctx, spanUpstreamHandshake, SpanAttribute{"ssh.upstream.host", route.Host})
+	upstream, err := NewUpstreamConnContext(dialCtx, uc, route.ClientConfig, conf.HandshakeTimeouts)
+	endSpan(span, err)
+	if err != nil && upstreamUnavailable(err) {
+		err = &proxyError{cause: ErrUpstreamUnreachable, detail: route.Address(), err: err}
+	}
+	return upstream, err
+}
+
+// Close closes the listeners and all connections immediately.
+func (s *ProxyServer) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	if s.cancel != nil {
+		s.cancel()
+	}
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+// shutdownPollInterval is the longest time Shutdown waits between looking
+// for idle connections.
+const shutdownPollInterval = 500 * time.Millisecond
+
+// Shutdown stops accepting connections and waits for the open ones to end.
+// Connections without open channels are disconnected as soon as they
+// become idle, and logins that complete meanwhile are disconnected
+// straight away. If ctx is done first, the remaining connections are
+// closed as by Close and the context's error is returned.
+func (s *ProxyServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	// Poll quickly at first, like net/http, so that servers without
+	// busy connections shut down at once.
+	interval := time.Millisecond
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		s.disconnectIdle()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		if interval *= 2; interval > shutdownPollInterval {
+			interval = shutdownPollInterval
+		}
+		timer.Reset(interval)
+	}
+}
+
+func (s *ProxyServer) disconnectIdle() {
+	var idle []*ProxyConn
+	s.mu.Lock()
+	for _, p := range s.conns {
+		if p != nil && p.channels.idle() {
+			idle = append(idle, p)
+		}
+	}
+	s.mu.Unlock()
+	for _, p := range idle {
+		s.disconnect(p)
+	}
+}
+
+func (s *ProxyServer) disconnect(p *ProxyConn) {
+	if s.ShutdownMessage == "" {
+		p.Close()
+		return
+	}
+	p.disconnect(disconnectByApplication, s.ShutdownMessage)
+}
+
+func (s *ProxyServer) baseContext() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+		if s.closed {
+			s.cancel()
+		}
+	}
+	return s.ctx
+}
+
+func (s *ProxyServer) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// trackListener adds or removes l. It reports false if the server is
+// closed.
+func (s *ProxyServer) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+// trackConn adds or removes c, which is served in a goroutine counted by
+// s.wg. It reports false if the server is closed.
+func (s *ProxyServer) trackConn(c net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.conns, c)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]*ProxyConn)
+	}
+	s.conns[c] = nil
+	s.wg.Add(1)
+	return true
+}
+
+// trackProxyConn records that c was logged in as p. It reports false if
+// the server is closed.
+func (s *ProxyServer) trackProxyConn(c net.Conn, p *ProxyConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[c] = p
+	return true
+}
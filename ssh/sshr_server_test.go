@@ -0,0 +1,207 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestProxyServer returns a server for proxyConf whose upstream
+// connections are served by serveTestUpstream, and the address it listens
+// on. Serve's result is sent on the returned channel.
+func newTestProxyServer(t *testing.T, proxyConf *ProxyConfig) (*ProxyServer, string, <-chan error) {
+	upstreamConf := newTestUpstreamConfig()
+	s := &ProxyServer{
+		Config: proxyConf,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			u1, u2, err := netPipe()
+			if err != nil {
+				return nil, err
+			}
+			go serveTestUpstream(u1, upstreamConf)
+			return u2, nil
+		},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(l) }()
+	return s, l.Addr().String(), served
+}
+
+// serveTestProxy runs a ProxyServer for proxyConf whose upstream
+// connections are handled by upstream, and returns its address.
+func serveTestProxy(t *testing.T, proxyConf *ProxyConfig, upstream func(c net.Conn)) (*ProxyServer, string) {
+	s := &ProxyServer{
+		Config: proxyConf,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			u1, u2, err := netPipe()
+			if err != nil {
+				return nil, err
+			}
+			go upstream(u1)
+			return u2, nil
+		},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return s, l.Addr().String()
+}
+
+func dialTestProxyServer(addr string) (*Client, error) {
+	return Dial("tcp", addr, &ClientConfig{
+		User:            "testuser",
+		Auth:            []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+}
+
+func TestProxyServer(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.DestinationPort = 22
+	proxyConf.FindUpstreamHook = func(username string) (string, error) {
+		if username != "testuser" {
+			return "", errors.New("no upstream")
+		}
+		return "upstream", nil
+	}
+	s, addr, served := newTestProxyServer(t, proxyConf)
+
+	var mu sync.Mutex
+	var authenticated, failed []string
+	closed := make(chan error, 1)
+	s.AuthenticatedHook = func(p *ProxyConn) {
+		mu.Lock()
+		defer mu.Unlock()
+		authenticated = append(authenticated, p.User+"@"+p.DestinationHost)
+	}
+	s.ClosedHook = func(p *ProxyConn, err error) { closed <- err }
+	s.ErrorHook = func(c net.Conn, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		failed = append(failed, err.Error())
+	}
+
+	client, err := dialTestProxyServer(addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	if got := runHello(t, client); got != "hello" {
+		t.Errorf("got %q, want hello", got)
+	}
+	client.Close()
+	<-closed
+
+	if _, err := Dial("tcp", addr, &ClientConfig{
+		User:            "nobody",
+		Auth:            []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}); err == nil {
+		t.Error("unroutable user logged in")
+	}
+
+	// An open connection is closed with the server.
+	client, err = dialTestProxyServer(addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if err := <-served; err != ErrProxyServerClosed {
+		t.Errorf("Serve returned %v, want ErrProxyServerClosed", err)
+	}
+	if err := client.Wait(); err == nil {
+		t.Error("client connection survived Close")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(authenticated) != 2 || authenticated[0] != "testuser@upstream" {
+		t.Errorf("got authenticated connections %q", authenticated)
+	}
+	if len(failed) != 1 || failed[0] != "no upstream" {
+		t.Errorf("got failures %q, want the routing error", failed)
+	}
+}
+
+func TestProxyServerShutdown(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.FindUpstreamHook = func(username string) (string, error) { return "upstream", nil }
+	s, addr, served := newTestProxyServer(t, proxyConf)
+	s.ShutdownMessage = "proxy is restarting"
+
+	idle, err := dialTestProxyServer(addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer idle.Close()
+	active, err := dialTestProxyServer(addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer active.Close()
+	session, err := active.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	if err := <-served; err != ErrProxyServerClosed {
+		t.Errorf("Serve returned %v, want ErrProxyServerClosed", err)
+	}
+	if err := idle.Wait(); err == nil || !strings.Contains(err.Error(), "proxy is restarting") {
+		t.Errorf("idle connection ended with %v, want the shutdown message", err)
+	}
+	if _, err := dialTestProxyServer(addr); err == nil {
+		t.Error("connected after Shutdown")
+	}
+
+	// The active connection is drained once its session ends.
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v with a session open", err)
+	default:
+	}
+	if err := session.Run("true"); err != nil {
+		t.Errorf("Run during shutdown: %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+}
+
+func TestProxyServerShutdownDeadline(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.FindUpstreamHook = func(username string) (string, error) { return "upstream", nil }
+	s, addr, _ := newTestProxyServer(t, proxyConf)
+
+	client, err := dialTestProxyServer(addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.NewSession(); err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+	if err := client.Wait(); err == nil {
+		t.Error("connection survived the deadline")
+	}
+}
@@ -0,0 +1,142 @@
+package ssh
+
+import (
+	"errors"
+	"sync"
+)
+
+// Disconnect reason codes from RFC 4253, section 11.1, used by the proxy.
+const (
+	disconnectProtocolError              = 2
+	disconnectServiceNotAvailable        = 7
+	disconnectByApplication              = 11
+	disconnectTooManyConnections         = 12
+	disconnectNoMoreAuthMethodsAvailable = 14
+)
+
+// ErrSessionNotFound is returned by SessionManager.TerminateSession for
+// unknown session IDs.
+var ErrSessionNotFound = errors.New("ssh: session not found")
+
+// SessionTerminator is implemented by SessionRegistry backends that can
+// deliver termination requests to the node holding a session.
+type SessionTerminator interface {
+	// RequestTermination asks node to terminate the session id.
+	RequestTermination(node, id string) error
+
+	// SubscribeTerminations calls fn with the ID of every session whose
+	// termination is requested on node, until stop is called.
+	SubscribeTerminations(node string, fn func(id string)) (stop func(), err error)
+}
+
+// SessionManager tracks the sessions established on this node and lets
+// administrators list and terminate sessions across all nodes sharing the
+// SessionRegistry of a ProxyConfig. Set it as ProxyConfig.Sessions.
+type SessionManager struct {
+	registry SessionRegistry
+	node     string
+	stop     func()
+
+	mu    sync.Mutex
+	local map[string]*ProxyConn
+}
+
+// NewSessionManager returns a manager for the node and registry configured in
+// conf. If the registry implements SessionTerminator, the manager subscribes
+// to termination requests for this node; call Close to unsubscribe.
+func NewSessionManager(conf *ProxyConfig) (*SessionManager, error) {
+	m := &SessionManager{
+		registry: conf.SessionRegistry,
+		node:     conf.NodeName,
+		local:    make(map[string]*ProxyConn),
+	}
+	if t, ok := m.registry.(SessionTerminator); ok {
+		stop, err := t.SubscribeTerminations(m.node, func(id string) {
+			m.terminateLocal(id)
+		})
+		if err != nil {
+			return nil, err
+		}
+		m.stop = stop
+	}
+	return m, nil
+}
+
+// Close stops listening for termination requests. Sessions are unaffected.
+func (m *SessionManager) Close() {
+	if m.stop != nil {
+		m.stop()
+	}
+}
+
+func (m *SessionManager) track(p *ProxyConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.local[p.ID()] = p
+}
+
+func (m *SessionManager) untrack(p *ProxyConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.local, p.ID())
+}
+
+// ListSessions returns the sessions of all nodes, or of this node only if no
+// SessionRegistry is configured.
+func (m *SessionManager) ListSessions() ([]SessionInfo, error) {
+	if m.registry != nil {
+		return m.registry.ListSessions()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sessions := make([]SessionInfo, 0, len(m.local))
+	for _, p := range m.local {
+		sessions = append(sessions, p.info)
+	}
+	return sessions, nil
+}
+
+// TerminateSession closes the session with the given ID, on whichever node
+// holds it. For remote sessions it returns once the request is delivered.
+func (m *SessionManager) TerminateSession(id string) error {
+	if m.terminateLocal(id) {
+		return nil
+	}
+
+	t, ok := m.registry.(SessionTerminator)
+	if !ok {
+		return ErrSessionNotFound
+	}
+	sessions, err := m.registry.ListSessions()
+	if err != nil {
+		return err
+	}
+	for _, info := range sessions {
+		if info.ID == id && info.Node != m.node {
+			return t.RequestTermination(info.Node, id)
+		}
+	}
+	return ErrSessionNotFound
+}
+
+func (m *SessionManager) terminateLocal(id string) bool {
+	m.mu.Lock()
+	p, ok := m.local[id]
+	m.mu.Unlock()
+	if !ok {
+		return false
+	}
+	p.disconnect(disconnectByApplication, "session terminated by administrator")
+	return true
+}
+
+// disconnect sends a disconnect message to the downstream client and
+// closes both legs of the connection.
+func (p *ProxyConn) disconnect(reason uint32, message string) {
+	p.Downstream.transport.writePacket(Marshal(&disconnectMsg{
+		Reason:  reason,
+		Message: message,
+	}))
+	p.Close()
+}
@@ -0,0 +1,91 @@
+package ssh
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClusterRegistry is a SessionRegistry shared by several nodes that
+// delivers termination requests synchronously.
+type testClusterRegistry struct {
+	testSessionRegistry
+
+	mu   sync.Mutex
+	subs map[string]func(id string)
+}
+
+func (r *testClusterRegistry) RequestTermination(node, id string) error {
+	r.mu.Lock()
+	fn := r.subs[node]
+	r.mu.Unlock()
+	if fn != nil {
+		fn(id)
+	}
+	return nil
+}
+
+func (r *testClusterRegistry) SubscribeTerminations(node string, fn func(id string)) (func(), error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.subs == nil {
+		r.subs = make(map[string]func(id string))
+	}
+	r.subs[node] = fn
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.subs, node)
+	}, nil
+}
+
+func TestSessionManagerTerminateRemote(t *testing.T) {
+	registry := &testClusterRegistry{}
+
+	node1 := newTestProxyConfig()
+	node1.NodeName = "node1"
+	node1.SessionRegistry = registry
+	m1, err := NewSessionManager(node1)
+	if err != nil {
+		t.Fatalf("NewSessionManager: %v", err)
+	}
+	defer m1.Close()
+	node1.Sessions = m1
+
+	node2 := &ProxyConfig{NodeName: "node2", SessionRegistry: registry}
+	m2, err := NewSessionManager(node2)
+	if err != nil {
+		t.Fatalf("NewSessionManager: %v", err)
+	}
+	defer m2.Close()
+
+	client, res, err := dialTestProxy(t, node1, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+	runHello(t, client)
+
+	sessions, err := m2.ListSessions()
+	if err != nil || len(sessions) != 1 || sessions[0].Node != "node1" {
+		t.Fatalf("ListSessions on node2 = %v, %v", sessions, err)
+	}
+	if err := m2.TerminateSession(sessions[0].ID); err != nil {
+		t.Fatalf("TerminateSession: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- client.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("terminated session still open")
+	}
+
+	if err := m2.TerminateSession("unknown"); err != ErrSessionNotFound {
+		t.Errorf("TerminateSession(unknown) = %v, want ErrSessionNotFound", err)
+	}
+}
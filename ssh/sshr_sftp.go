@@ -0,0 +1,506 @@
+package ssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh/proxysftp"
+)
+
+// SFTPOperation is an operation of an SFTP session relayed by the proxy.
+type SFTPOperation struct {
+	User string
+	// Op is "open", "opendir", "close", "remove", "rename", "mkdir",
+	// "rmdir", "setstat", "stat", "lstat", "realpath", "readlink" or
+	// "symlink", or the name of an extension such as
+	// "posix-rename@openssh.com".
+	Op string
+	// Path is the path operated on and NewPath the second path of renames
+	// and links: the new name of renames, and the link created by links,
+	// whose Path is the file they point to. Paths are cleaned and, once the
+	// upstream reported the working directory, absolute.
+	Path    string
+	NewPath string
+	// Flags are the proxysftp.Flag values of "open".
+	Flags uint32
+	// BytesRead and BytesWritten are set for "close" and count the bytes
+	// downloaded from and uploaded to the file.
+	BytesRead    int64
+	BytesWritten int64
+	// Err is set for operations the proxy refused.
+	Err error
+}
+
+// SFTPPolicy inspects the sftp subsystem of proxied sessions. Sessions that
+// run sftp-server with an exec request are not inspected, so CommandHook
+// should refuse those where the policy is meant to be enforced.
+type SFTPPolicy struct {
+	// Root returns the directory the operations of username are confined
+	// to, or "" to not confine them. Paths are checked as the client sends
+	// them; the upstream resolves symbolic links already in the tree.
+	Root func(username string) string
+	// Hook is called for the operations Root allows. An error refuses the
+	// operation, which the client sees fail with "permission denied".
+	Hook func(op SFTPOperation) error
+	// Log receives every operation, including refused ones and "close"
+	// with the bytes transferred.
+	Log func(op SFTPOperation)
+}
+
+var (
+	errSFTPOutsideRoot = errors.New("ssh: sftp path outside the allowed directory")
+	errSFTPPacket      = errors.New("ssh: sftp packet too long")
+)
+
+// sftpOps names the requests with path arguments.
+var sftpOps = map[byte]string{
+	proxysftp.TypeOpen:     "open",
+	proxysftp.TypeOpendir:  "opendir",
+	proxysftp.TypeRemove:   "remove",
+	proxysftp.TypeRename:   "rename",
+	proxysftp.TypeMkdir:    "mkdir",
+	proxysftp.TypeRmdir:    "rmdir",
+	proxysftp.TypeSetstat:  "setstat",
+	proxysftp.TypeStat:     "stat",
+	proxysftp.TypeLstat:    "lstat",
+	proxysftp.TypeRealpath: "realpath",
+	proxysftp.TypeReadlink: "readlink",
+	proxysftp.TypeSymlink:  "symlink",
+}
+
+// sftpHeadLimit is how much of packets that are relayed as they arrive is
+// kept to be decoded, enough for the fields up to the data of WRITE.
+const sftpHeadLimit = 1024
+
+// sftpStream follows the packets of one direction of an SFTP session.
+type sftpStream struct {
+	// pkt holds the bytes of the current packet: all of them if it is held
+	// back while it arrives, otherwise up to sftpHeadLimit.
+	pkt []byte
+	// size is the length of the current packet including its length field,
+	// or 0 while that is not known, and seen the bytes that arrived of it.
+	size int
+	seen int
+	hold bool
+}
+
+func (s *sftpStream) reset() {
+	s.pkt, s.size, s.seen, s.hold = s.pkt[:0], 0, 0, false
+}
+
+// sftpFile is a file or directory the client opened.
+type sftpFile struct {
+	op  SFTPOperation
+	dir bool
+}
+
+// sftpRelay inspects the SFTP session on a channel. Requests with paths are
+// held back until they arrived completely. A refused request is replaced by
+// an EXTENDED request the upstream does not know, which keeps the order of
+// the session intact, and the STATUS it fails with reports permission
+// denied to the client.
+type sftpRelay struct {
+	p      *ProxyConn
+	policy *SFTPPolicy
+	root   string
+
+	up, down sftpStream
+
+	mu sync.Mutex
+	// cwd is the working directory the upstream returned for realpath ".".
+	cwd       string
+	realpaths map[uint32]bool
+	opens     map[uint32]*sftpFile
+	reads     map[uint32]*sftpFile
+	files     map[string]*sftpFile
+	refused   map[uint32]bool
+	finished  bool
+}
+
+// startSFTP begins to inspect the channel of a sftp subsystem request.
+func (p *ProxyConn) startSFTP(msg *channelRequestMsg) {
+	var payload execPayload
+	if msg.Request != "subsystem" || Unmarshal(msg.RequestSpecificData, &payload) != nil || payload.Command != "sftp" {
+		return
+	}
+	r := &sftpRelay{
+		p:         p,
+		policy:    p.config.SFTP,
+		realpaths: make(map[uint32]bool),
+		opens:     make(map[uint32]*sftpFile),
+		reads:     make(map[uint32]*sftpFile),
+		files:     make(map[string]*sftpFile),
+		refused:   make(map[uint32]bool),
+	}
+	if r.policy.Root != nil {
+		if root := r.policy.Root(p.User); root != "" {
+			r.root = path.Clean("/" + root)
+		}
+	}
+	p.channels.mu.Lock()
+	defer p.channels.mu.Unlock()
+	if ch, ok := p.channels.byUpstream[msg.PeersID]; ok && ch.sftp == nil {
+		ch.sftp = r
+	}
+}
+
+// filterSFTP starts the SFTP relay of sftp subsystem requests and passes
+// the data of their channels through it. It returns the packet to forward,
+// or nil if nothing is to be forwarded.
+func (p *ProxyConn) filterSFTP(dir relayDirection, packet []byte) ([]byte, error) {
+	switch packet[0] {
+	case msgChannelRequest:
+		var msg channelRequestMsg
+		if dir == toUpstream && Unmarshal(packet, &msg) == nil {
+			p.startSFTP(&msg)
+		}
+		return packet, nil
+	case msgChannelData, msgChannelClose:
+	default:
+		return packet, nil
+	}
+
+	id, ok := recipient(packet)
+	if !ok {
+		return packet, nil
+	}
+	p.channels.mu.Lock()
+	ch := p.channels.byUpstream[id]
+	if dir == toDownstream {
+		ch = p.channels.byDownstream[id]
+	}
+	var r *sftpRelay
+	if ch != nil {
+		r = ch.sftp
+	}
+	p.channels.mu.Unlock()
+	if r == nil {
+		return packet, nil
+	}
+	if packet[0] == msgChannelClose {
+		r.finish()
+		return packet, nil
+	}
+
+	var msg channelDataMsg
+	if Unmarshal(packet, &msg) != nil {
+		return packet, nil
+	}
+	if dir == toDownstream {
+		// Responses are only modified in place.
+		return packet, r.responses(msg.Rest)
+	}
+	out, err := r.requests(msg.Rest)
+	if err != nil {
+		return nil, err
+	}
+	return p.rewriteData(dir, ch, packet, msg.Rest, out)
+}
+
+// holdsBack reports whether requests of type t are held back until they
+// arrived completely, so that they can be refused.
+func holdsBack(t byte) bool {
+	_, ok := sftpOps[t]
+	return ok || t == proxysftp.TypeExtended
+}
+
+// next feeds data to s. It returns the number of bytes it consumed from
+// data, and whether the current packet is complete. The header of a packet
+// is held back until its type is known; start is then called with the
+// type, and reports whether the packet is held back.
+func (s *sftpStream) next(data []byte, start func(t byte) bool) (int, bool, error) {
+	if s.size == 0 {
+		n := 5 - len(s.pkt)
+		if n > len(data) {
+			n = len(data)
+		}
+		s.pkt = append(s.pkt, data[:n]...)
+		s.seen += n
+		if len(s.pkt) < 5 {
+			return n, false, nil
+		}
+		length := binary.BigEndian.Uint32(s.pkt)
+		if length == 0 || length > proxysftp.MaxPacketLength {
+			return n, false, errSFTPPacket
+		}
+		s.size = 4 + int(length)
+		s.hold = start(s.pkt[4])
+		return n, s.seen == s.size, nil
+	}
+	n := s.size - s.seen
+	if n > len(data) {
+		n = len(data)
+	}
+	keep := n
+	if !s.hold && len(s.pkt)+keep > sftpHeadLimit {
+		keep = sftpHeadLimit - len(s.pkt)
+		if keep < 0 {
+			keep = 0
+		}
+	}
+	s.pkt = append(s.pkt, data[:keep]...)
+	s.seen += n
+	return n, s.seen == s.size, nil
+}
+
+// requests processes data the client sent. It returns the data to forward.
+func (r *sftpRelay) requests(data []byte) (out []byte, err error) {
+	s := &r.up
+	for len(data) > 0 {
+		headerDone := s.size != 0
+		n, complete, err := s.next(data, holdsBack)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case !headerDone && s.size != 0 && !s.hold:
+			// The header was held back until the type was known.
+			out = append(out, s.pkt...)
+		case headerDone && !s.hold:
+			out = append(out, data[:n]...)
+		}
+		data = data[n:]
+		if !complete {
+			continue
+		}
+		replacement := r.request(s.pkt)
+		switch {
+		case s.hold && replacement != nil:
+			out = append(out, replacement...)
+		case s.hold:
+			out = append(out, s.pkt...)
+		}
+		s.reset()
+	}
+	return out, nil
+}
+
+// responses processes data the upstream sent, rewriting the STATUS of
+// refused requests in place.
+func (r *sftpRelay) responses(data []byte) error {
+	s := &r.down
+	for len(data) > 0 {
+		offset := s.seen
+		n, complete, err := s.next(data, func(byte) bool { return false })
+		if err != nil {
+			return err
+		}
+		// The status code follows the type and ID; the ID arrived before.
+		const codeStart, codeEnd = 9, 13
+		if len(s.pkt) >= codeStart && s.pkt[4] == proxysftp.TypeStatus && offset < codeEnd && offset+n > codeStart {
+			r.mu.Lock()
+			refused := r.refused[binary.BigEndian.Uint32(s.pkt[5:9])]
+			r.mu.Unlock()
+			if refused {
+				var code [4]byte
+				binary.BigEndian.PutUint32(code[:], proxysftp.StatusPermissionDenied)
+				for i := codeStart; i < codeEnd; i++ {
+					if i >= offset && i < offset+n {
+						data[i-offset] = code[i-codeStart]
+					}
+				}
+			}
+		}
+		data = data[n:]
+		if complete {
+			r.response(s.pkt)
+			s.reset()
+		}
+	}
+	return nil
+}
+
+// resolve returns name cleaned and made absolute, or "" if it is relative
+// and the working directory is not known. r.mu must be held.
+func (r *sftpRelay) resolve(name string) string {
+	switch {
+	case strings.HasPrefix(name, "/"):
+		return path.Clean(name)
+	case r.cwd != "" && !strings.HasPrefix(name, "~"):
+		return path.Join(r.cwd, name)
+	}
+	return ""
+}
+
+func (r *sftpRelay) inRoot(name string) bool {
+	return r.root == "" || name != "" && (r.root == "/" || name == r.root || strings.HasPrefix(name, r.root+"/"))
+}
+
+// request handles a complete request. For a refused request it returns the
+// packet replacing it.
+func (r *sftpRelay) request(pkt []byte) []byte {
+	req, err := proxysftp.Parse(pkt[4:])
+	if err != nil {
+		if holdsBack(pkt[4]) && len(pkt) >= 9 {
+			// What the proxy cannot decode, it cannot check either.
+			return r.refuse(binary.BigEndian.Uint32(pkt[5:9]), SFTPOperation{User: r.p.User, Op: sftpOps[pkt[4]], Err: err})
+		}
+		return nil
+	}
+
+	r.mu.Lock()
+	switch req.Type {
+	case proxysftp.TypeWrite:
+		if f := r.files[req.Handle]; f != nil {
+			f.op.BytesWritten += int64(req.Length)
+		}
+		r.mu.Unlock()
+		return nil
+	case proxysftp.TypeRead:
+		if f := r.files[req.Handle]; f != nil {
+			r.reads[req.ID] = f
+		}
+		r.mu.Unlock()
+		return nil
+	case proxysftp.TypeClose:
+		f := r.files[req.Handle]
+		delete(r.files, req.Handle)
+		r.mu.Unlock()
+		if f != nil {
+			r.logClose(f)
+		}
+		return nil
+	}
+	if !holdsBack(req.Type) {
+		r.mu.Unlock()
+		return nil
+	}
+
+	op := SFTPOperation{User: r.p.User, Op: sftpOps[req.Type], Flags: req.Flags}
+	if req.Type == proxysftp.TypeExtended {
+		op.Op = req.Extension
+	}
+	resolved := make([]string, len(req.Paths))
+	for i, name := range req.Paths {
+		resolved[i] = r.resolve(name)
+	}
+	if req.Type == proxysftp.TypeSymlink && resolved[1] != "" && !strings.HasPrefix(req.Paths[0], "/") {
+		// A relative target is relative to the directory of the link.
+		resolved[0] = path.Join(path.Dir(resolved[1]), req.Paths[0])
+	}
+	names := [2]*string{&op.Path, &op.NewPath}
+	for i, name := range resolved {
+		if name == "" {
+			name = req.Paths[i]
+		}
+		*names[i] = name
+	}
+	// The working directory is no secret, and clients need it to find
+	// their way.
+	discovery := req.Type == proxysftp.TypeRealpath && (req.Paths[0] == "." || req.Paths[0] == "")
+	if r.root != "" && !discovery {
+		if req.Type == proxysftp.TypeExtended && !proxysftp.KnownExtension(req.Extension) {
+			err = errSFTPOutsideRoot
+		}
+		for _, name := range resolved {
+			if !r.inRoot(name) {
+				err = errSFTPOutsideRoot
+			}
+		}
+	}
+	if discovery {
+		r.realpaths[req.ID] = true
+	}
+	r.mu.Unlock()
+
+	if err == nil && r.policy.Hook != nil {
+		err = r.policy.Hook(op)
+	}
+	if err != nil {
+		op.Err = err
+		return r.refuse(req.ID, op)
+	}
+	if r.policy.Log != nil {
+		r.policy.Log(op)
+	}
+	if req.Type == proxysftp.TypeOpen || req.Type == proxysftp.TypeOpendir {
+		r.mu.Lock()
+		r.opens[req.ID] = &sftpFile{op: op, dir: req.Type == proxysftp.TypeOpendir}
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+// refuse reports the refused operation and returns the request replacing
+// that with the given ID.
+func (r *sftpRelay) refuse(id uint32, op SFTPOperation) []byte {
+	r.mu.Lock()
+	r.refused[id] = true
+	r.mu.Unlock()
+	r.p.log(LogInfo, "sftp operation refused", "op", op.Op, "path", op.Path, "error", op.Err)
+	if r.policy.Log != nil {
+		r.policy.Log(op)
+	}
+	return proxysftp.MarshalExtended(id, "", nil)
+}
+
+// response handles a complete response.
+func (r *sftpRelay) response(pkt []byte) {
+	resp, err := proxysftp.Parse(pkt[4:])
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch resp.Type {
+	case proxysftp.TypeHandle:
+		if f := r.opens[resp.ID]; f != nil {
+			r.files[resp.Handle] = f
+		}
+	case proxysftp.TypeData:
+		if f := r.reads[resp.ID]; f != nil {
+			f.op.BytesRead += int64(resp.Length)
+		}
+	case proxysftp.TypeName:
+		if r.realpaths[resp.ID] && len(resp.Names) > 0 && strings.HasPrefix(resp.Names[0], "/") {
+			r.cwd = path.Clean(resp.Names[0])
+		}
+	}
+	delete(r.opens, resp.ID)
+	delete(r.reads, resp.ID)
+	delete(r.realpaths, resp.ID)
+	delete(r.refused, resp.ID)
+}
+
+func (r *sftpRelay) logClose(f *sftpFile) {
+	if f.dir || r.policy.Log == nil {
+		return
+	}
+	op := f.op
+	op.Op = "close"
+	r.policy.Log(op)
+}
+
+// finish reports the files still open when the session ends.
+func (r *sftpRelay) finish() {
+	r.mu.Lock()
+	var files []*sftpFile
+	if !r.finished {
+		r.finished = true
+		for _, f := range r.files {
+			files = append(files, f)
+		}
+	}
+	r.mu.Unlock()
+	for _, f := range files {
+		r.logClose(f)
+	}
+}
+
+// finishSFTP ends the SFTP relays of a closing connection.
+func (p *ProxyConn) finishSFTP() {
+	p.channels.mu.Lock()
+	var relays []*sftpRelay
+	for _, ch := range p.channels.byDownstream {
+		if ch.sftp != nil {
+			relays = append(relays, ch.sftp)
+		}
+	}
+	p.channels.mu.Unlock()
+	for _, r := range relays {
+		r.finish()
+	}
+}
@@ -0,0 +1,233 @@
+package ssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh/proxysftp"
+)
+
+// sftpPacket encodes an SFTP packet of strings and uint32 and uint64 values.
+func sftpPacket(typ byte, id uint32, fields ...interface{}) []byte {
+	b := []byte{0, 0, 0, 0, typ}
+	b = appendU32(b, id)
+	for _, f := range fields {
+		switch f := f.(type) {
+		case string:
+			b = appendString(b, f)
+		case uint32:
+			b = appendU32(b, f)
+		case uint64:
+			b = appendU64(b, f)
+		}
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	return b
+}
+
+func readSFTPPacket(r io.Reader) (*proxysftp.Packet, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint32(length[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return proxysftp.Parse(b)
+}
+
+// serveTestSFTP answers the requests of an SFTP client well enough for the
+// tests, and records the requests it got.
+func serveTestSFTP(rw io.ReadWriter, mu *sync.Mutex, got *[]*proxysftp.Packet) {
+	for {
+		req, err := readSFTPPacket(rw)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		*got = append(*got, req)
+		mu.Unlock()
+		var resp []byte
+		switch req.Type {
+		case proxysftp.TypeInit:
+			resp = sftpPacket(proxysftp.TypeVersion, 3)
+		case proxysftp.TypeRealpath:
+			resp = sftpPacket(proxysftp.TypeName, req.ID, uint32(1), "/home/testuser", "", uint32(0))
+		case proxysftp.TypeOpen:
+			resp = sftpPacket(proxysftp.TypeHandle, req.ID, req.Paths[0])
+		case proxysftp.TypeRead:
+			if req.Offset > 0 {
+				resp = proxysftp.MarshalStatus(req.ID, proxysftp.StatusEOF, "EOF")
+			} else {
+				resp = sftpPacket(proxysftp.TypeData, req.ID, "hello")
+			}
+		case proxysftp.TypeExtended:
+			resp = proxysftp.MarshalStatus(req.ID, proxysftp.StatusOpUnsupported, "Unsupported")
+		default:
+			resp = proxysftp.MarshalStatus(req.ID, proxysftp.StatusOK, "Success")
+		}
+		if _, err := rw.Write(resp); err != nil {
+			return
+		}
+	}
+}
+
+func TestProxySFTPPolicy(t *testing.T) {
+	var mu sync.Mutex
+	var ops []SFTPOperation
+	var got []*proxysftp.Packet
+	proxyConf := newTestProxyConfig()
+	proxyConf.DestinationPort = 22
+	proxyConf.FindUpstreamHook = func(username string) (string, error) {
+		return "files.internal", nil
+	}
+	proxyConf.SFTP = &SFTPPolicy{
+		Root: func(username string) string { return "/home/" + username },
+		Hook: func(op SFTPOperation) error {
+			if op.Op == "remove" && op.Path == "/home/testuser/keep" {
+				return errors.New("keep is kept")
+			}
+			return nil
+		},
+		Log: func(op SFTPOperation) {
+			mu.Lock()
+			ops = append(ops, op)
+			mu.Unlock()
+		},
+	}
+	upstreamConf := newTestUpstreamConfig()
+	_, addr := serveTestProxy(t, proxyConf, func(c net.Conn) {
+		_, chans, reqs, err := NewServerConn(c, upstreamConf)
+		if err != nil {
+			return
+		}
+		go DiscardRequests(reqs)
+		for newCh := range chans {
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer ch.Close()
+				for req := range reqs {
+					req.Reply(req.Type == "subsystem", nil)
+					if req.Type == "subsystem" {
+						go serveTestSFTP(ch, &mu, &got)
+					}
+				}
+			}()
+		}
+	})
+	client, err := dialTestProxyServer(addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+	stdin, _ := session.StdinPipe()
+	stdout, _ := session.StdoutPipe()
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		t.Fatalf("RequestSubsystem: %v", err)
+	}
+
+	roundTrip := func(req []byte, want byte) *proxysftp.Packet {
+		t.Helper()
+		// Split requests, so that the proxy has to put them together.
+		for _, part := range [][]byte{req[:7], req[7:]} {
+			if _, err := stdin.Write(part); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+		}
+		resp, err := readSFTPPacket(stdout)
+		if err != nil {
+			t.Fatalf("reading response to %d: %v", req[4], err)
+		}
+		if resp.Type != want {
+			t.Fatalf("got response %+v to %d, want type %d", resp, req[4], want)
+		}
+		return resp
+	}
+	refused := func(req []byte) {
+		t.Helper()
+		if resp := roundTrip(req, proxysftp.TypeStatus); resp.Status != proxysftp.StatusPermissionDenied {
+			t.Errorf("got status %d to refused request %d, want permission denied", resp.Status, req[4])
+		}
+	}
+
+	roundTrip(sftpPacket(proxysftp.TypeInit, 3), proxysftp.TypeVersion)
+	roundTrip(sftpPacket(proxysftp.TypeRealpath, 1, "."), proxysftp.TypeName)
+	h := roundTrip(sftpPacket(proxysftp.TypeOpen, 2, "upload", uint32(proxysftp.FlagWrite|proxysftp.FlagCreate), uint32(0)), proxysftp.TypeHandle).Handle
+	roundTrip(sftpPacket(proxysftp.TypeWrite, 3, h, uint64(0), "0123456789"), proxysftp.TypeStatus)
+	roundTrip(sftpPacket(proxysftp.TypeClose, 4, h), proxysftp.TypeStatus)
+	refused(sftpPacket(proxysftp.TypeOpen, 5, "/etc/passwd", uint32(proxysftp.FlagRead), uint32(0)))
+	refused(sftpPacket(proxysftp.TypeRemove, 6, "../other/file"))
+	refused(sftpPacket(proxysftp.TypeRemove, 7, "keep"))
+	refused(sftpPacket(proxysftp.TypeSymlink, 8, "../../etc", "link"))
+	h = roundTrip(sftpPacket(proxysftp.TypeOpen, 9, "/home/testuser/download", uint32(proxysftp.FlagRead), uint32(0)), proxysftp.TypeHandle).Handle
+	roundTrip(sftpPacket(proxysftp.TypeRead, 10, h, uint64(0), uint32(32768)), proxysftp.TypeData)
+	roundTrip(sftpPacket(proxysftp.TypeRead, 11, h, uint64(5), uint32(32768)), proxysftp.TypeStatus)
+	roundTrip(sftpPacket(proxysftp.TypeClose, 12, h), proxysftp.TypeStatus)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, req := range got {
+		if req.Type != proxysftp.TypeExtended {
+			continue
+		}
+		if req.Extension != "" || req.ID < 5 || req.ID > 8 {
+			t.Errorf("upstream got extended request %+v", req)
+		}
+	}
+	if len(got) != 13 {
+		t.Errorf("upstream got %d requests, want 13", len(got))
+	}
+
+	want := []SFTPOperation{
+		{Op: "realpath", Path: "."},
+		{Op: "open", Path: "/home/testuser/upload", Flags: proxysftp.FlagWrite | proxysftp.FlagCreate},
+		{Op: "close", Path: "/home/testuser/upload", Flags: proxysftp.FlagWrite | proxysftp.FlagCreate, BytesWritten: 10},
+		{Op: "open", Path: "/etc/passwd", Flags: proxysftp.FlagRead, Err: errSFTPOutsideRoot},
+		{Op: "remove", Path: "/home/other/file", Err: errSFTPOutsideRoot},
+		{Op: "remove", Path: "/home/testuser/keep", Err: errors.New("keep is kept")},
+		{Op: "symlink", Path: "/etc", NewPath: "/home/testuser/link", Err: errSFTPOutsideRoot},
+		{Op: "open", Path: "/home/testuser/download", Flags: proxysftp.FlagRead},
+		{Op: "close", Path: "/home/testuser/download", Flags: proxysftp.FlagRead, BytesRead: 5},
+	}
+	if len(ops) != len(want) {
+		t.Fatalf("got operations %+v, want %+v", ops, want)
+	}
+	for i, op := range ops {
+		w := want[i]
+		if op.User != "testuser" || op.Op != w.Op || op.Path != w.Path || op.NewPath != w.NewPath || op.Flags != w.Flags ||
+			op.BytesRead != w.BytesRead || op.BytesWritten != w.BytesWritten || (op.Err == nil) != (w.Err == nil) {
+			t.Errorf("operation %d: got %+v, want %+v", i, op, w)
+		}
+	}
+}
+
+func TestProxySFTPOtherSessions(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.SFTP = &SFTPPolicy{Root: func(string) string { return "/nowhere" }}
+	client, _, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	// Sessions other than sftp are relayed untouched.
+	if out := runHello(t, client); out != "hello" {
+		t.Errorf("got %q, want hello", out)
+	}
+}
@@ -0,0 +1,168 @@
+package ssh
+
+import (
+	"encoding/hex"
+	"net"
+	"time"
+)
+
+// The interfaces in this file let a fleet of proxy instances share state, so
+// that limits, bans and the list of sessions are consistent across nodes.
+// Implementations must be safe for concurrent use. Errors returned by
+// RateLimiter and BanList deny the login.
+
+// RateLimiter decides whether another event identified by key is allowed.
+type RateLimiter interface {
+	Allow(key string) (bool, error)
+}
+
+// BanList reports whether logins identified by key are banned.
+type BanList interface {
+	Banned(key string) (bool, error)
+}
+
+// SessionInfo describes an established proxied session.
+type SessionInfo struct {
+	ID              string    `json:"id"`
+	Node            string    `json:"node,omitempty"`
+	User            string    `json:"user"`
+	DestinationHost string    `json:"destination_host"`
+	RemoteAddr      string    `json:"remote_addr"`
+	Started         time.Time `json:"started"`
+}
+
+// SessionRegistry keeps track of established sessions.
+type SessionRegistry interface {
+	Register(info SessionInfo) error
+	Unregister(id string) error
+	ListSessions() ([]SessionInfo, error)
+}
+
+// HookCache stores hook results for a limited time.
+type HookCache interface {
+	// Get returns the value stored for key, and whether it was found.
+	Get(key string) ([]byte, bool, error)
+	Set(key string, value []byte, ttl time.Duration) error
+}
+
+var (
+	errRateLimited error = authRejectedError("ssh: too many authentication attempts")
+	errBanned      error = authRejectedError("ssh: login banned")
+)
+
+// defaultHookCacheTTL is used if ProxyConfig.HookCacheTTL is unset.
+const defaultHookCacheTTL = time.Minute
+
+// sourceHost returns the host part of addr, or its full string form.
+func sourceHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// ID returns the identifier of the session in a SessionRegistry: the hex
+// encoded session ID of the downstream connection.
+func (p *ProxyConn) ID() string {
+	return hex.EncodeToString(p.Downstream.sessionID)
+}
+
+func (p *ProxyConn) sessionInfo() SessionInfo {
+	info := SessionInfo{
+		ID:              p.ID(),
+		User:            p.User,
+		DestinationHost: p.DestinationHost,
+		RemoteAddr:      p.Downstream.RemoteAddr().String(),
+		Started:         time.Now(),
+	}
+	if p.config != nil {
+		info.Node = p.config.NodeName
+	}
+	return info
+}
+
+// checkSharedLimits consults the configured BanList and RateLimiter before an
+// authentication attempt. Users are keyed as "user:<name>" and sources as
+// "ip:<host>".
+func (p *ProxyConn) checkSharedLimits(username string) error {
+	conf := p.config
+	keys := []string{"user:" + username, "ip:" + sourceHost(p.Downstream.RemoteAddr())}
+
+	if conf.BanList != nil {
+		for _, key := range keys {
+			banned, err := conf.BanList.Banned(key)
+			if err != nil {
+				return err
+			}
+			if banned {
+				return errBanned
+			}
+		}
+	}
+	if conf.AuthLockout != nil {
+		for _, key := range keys {
+			locked, err := conf.AuthLockout.Locked(key)
+			if err != nil {
+				return err
+			}
+			if locked {
+				return errLockedOut
+			}
+		}
+	}
+	if conf.AuthRateLimiter != nil {
+		for _, key := range keys {
+			ok, err := conf.AuthRateLimiter.Allow(key)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return errRateLimited
+			}
+		}
+	}
+	return nil
+}
+
+// cachedHook wraps a fetch hook with conf.KeyCache and conf.HookCache, if
+// configured.
+func cachedHook(conf *ProxyConfig, prefix string, hook func(string) ([]byte, error)) func(string) ([]byte, error) {
+	return localCachedHook(conf, prefix, sharedCachedHook(conf, prefix, hook))
+}
+
+// localCachedHook wraps a fetch hook with conf.KeyCache, if configured.
+func localCachedHook(conf *ProxyConfig, prefix string, hook func(string) ([]byte, error)) func(string) ([]byte, error) {
+	if conf.KeyCache == nil {
+		return hook
+	}
+	return func(username string) ([]byte, error) {
+		return conf.KeyCache.fetch(prefix+username, username, hook)
+	}
+}
+
+// sharedCachedHook wraps a fetch hook with conf.HookCache, if configured.
+func sharedCachedHook(conf *ProxyConfig, prefix string, hook func(string) ([]byte, error)) func(string) ([]byte, error) {
+	if conf.HookCache == nil {
+		return hook
+	}
+	ttl := conf.HookCacheTTL
+	if ttl <= 0 {
+		ttl = defaultHookCacheTTL
+	}
+	return func(username string) ([]byte, error) {
+		key := prefix + username
+		if data, ok, err := conf.HookCache.Get(key); err == nil && ok {
+			return data, nil
+		}
+		data, err := hook(username)
+		if err != nil {
+			return nil, err
+		}
+		conf.HookCache.Set(key, data, ttl)
+		return data, nil
+	}
+}
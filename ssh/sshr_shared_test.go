@@ -0,0 +1,133 @@
+package ssh
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testBanList map[string]bool
+
+func (b testBanList) Banned(key string) (bool, error) { return b[key], nil }
+
+type testSessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]SessionInfo
+}
+
+func (r *testSessionRegistry) Register(info SessionInfo) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions == nil {
+		r.sessions = make(map[string]SessionInfo)
+	}
+	r.sessions[info.ID] = info
+	return nil
+}
+
+func (r *testSessionRegistry) Unregister(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, id)
+	return nil
+}
+
+func (r *testSessionRegistry) ListSessions() ([]SessionInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var list []SessionInfo
+	for _, info := range r.sessions {
+		list = append(list, info)
+	}
+	return list, nil
+}
+
+type testHookCache struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func (c *testHookCache) Get(key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.data[key]
+	return data, ok, nil
+}
+
+func (c *testHookCache) Set(key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.data == nil {
+		c.data = make(map[string][]byte)
+	}
+	c.data[key] = value
+	return nil
+}
+
+func TestProxyHookCacheSkipsPrivateKeys(t *testing.T) {
+	cache := &testHookCache{}
+	proxyConf := newTestProxyConfig()
+	proxyConf.HookCache = cache
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	client.Close()
+
+	if _, ok, _ := cache.Get("authorized_keys:testuser"); !ok {
+		t.Error("authorized keys not cached")
+	}
+	for key := range cache.data {
+		if strings.HasPrefix(key, "private_key:") {
+			t.Errorf("private key cached as %q", key)
+		}
+	}
+}
+
+func TestProxyBanList(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.BanList = testBanList{"user:testuser": true}
+	_, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err == nil {
+		t.Fatal("banned user connected")
+	}
+	if res.err != errBanned {
+		t.Errorf("proxy error: got %v, want %v", res.err, errBanned)
+	}
+}
+
+func TestProxySessionRegistry(t *testing.T) {
+	registry := &testSessionRegistry{}
+	proxyConf := newTestProxyConfig()
+	proxyConf.NodeName = "node1"
+	proxyConf.SessionRegistry = registry
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	runHello(t, client)
+
+	sessions, _ := registry.ListSessions()
+	if len(sessions) != 1 || sessions[0].ID != res.conn.ID() || sessions[0].Node != "node1" {
+		t.Fatalf("got sessions %v", sessions)
+	}
+
+	client.Close()
+	for i := 0; i < 100; i++ {
+		if sessions, _ = registry.ListSessions(); len(sessions) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("session still registered after close: %v", sessions)
+}
@@ -0,0 +1,70 @@
+package ssh
+
+import "strings"
+
+// MultiAlgorithmSigner is an AlgorithmSigner that supports only some of the
+// signature algorithms of its key type, such as a KMS key that is bound to
+// one hash function. The proxy re-signs upstream requests with one of them
+// instead of the key type's default.
+type MultiAlgorithmSigner interface {
+	AlgorithmSigner
+
+	// Algorithms returns the supported signature algorithms, most
+	// preferred first.
+	Algorithms() []string
+}
+
+// setUpstreamExtensions records the extensions announced by the upstream.
+func (p *ProxyConn) setUpstreamExtensions(extensions map[string][]byte) {
+	if algs, ok := extensions["server-sig-algs"]; ok {
+		p.upstreamSigAlgs = strings.Split(string(algs), ",")
+	}
+}
+
+// acceptsSigAlgo reports whether the upstream is known to accept the
+// signature algorithm. Without server-sig-algs nothing is known.
+func (p *ProxyConn) acceptsSigAlgo(algo string) bool {
+	return contains(p.upstreamSigAlgs, algo)
+}
+
+// upstreamSigAlgo returns the signature algorithm signAgain uses with signer,
+// or "" for the signer's default. RSA keys sign with SHA-2 if the upstream
+// announced support for it, as OpenSSH 8.8 and later reject ssh-rsa.
+func (p *ProxyConn) upstreamSigAlgo(signer Signer) string {
+	if s, ok := signer.(MultiAlgorithmSigner); ok {
+		algos := s.Algorithms()
+		for _, algo := range algos {
+			if p.acceptsSigAlgo(algo) {
+				return algo
+			}
+		}
+		if len(algos) > 0 {
+			return algos[0]
+		}
+		return ""
+	}
+	if _, ok := signer.(AlgorithmSigner); !ok || keyAlgoOf(signer.PublicKey().Type()) != KeyAlgoRSA {
+		return ""
+	}
+	for _, algo := range []string{SigAlgoRSASHA2512, SigAlgoRSASHA2256} {
+		if p.acceptsSigAlgo(algo) {
+			return algo
+		}
+	}
+	return ""
+}
+
+// requestAlgo returns the algorithm announced in a publickey request for a
+// key of type keyType signing with sigAlgo, as defined by RFC 8332.
+func requestAlgo(keyType, sigAlgo string) string {
+	if !isRSASHA2(sigAlgo) {
+		return keyType
+	}
+	switch keyType {
+	case KeyAlgoRSA:
+		return sigAlgo
+	case CertAlgoRSAv01:
+		return certAlgoNames[sigAlgo]
+	}
+	return keyType
+}
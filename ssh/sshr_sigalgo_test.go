@@ -0,0 +1,138 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+// sha256OnlySigner signs like a KMS key that only supports rsa-sha2-256.
+type sha256OnlySigner struct {
+	AlgorithmSigner
+	formats []string
+}
+
+func (s *sha256OnlySigner) Algorithms() []string { return []string{SigAlgoRSASHA2256} }
+
+func (s *sha256OnlySigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*Signature, error) {
+	s.formats = append(s.formats, algorithm)
+	return s.AlgorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+}
+
+func TestProxyMultiAlgorithmSigner(t *testing.T) {
+	var upstreamErr error
+	upstreamConf := newTestUpstreamConfig()
+	upstreamConf.AuthLogCallback = func(conn ConnMetadata, method string, err error) {
+		if method == "publickey" {
+			upstreamErr = err
+		}
+	}
+	signer := &sha256OnlySigner{AlgorithmSigner: testSigners["rsa"].(AlgorithmSigner)}
+	proxyConf := newTestProxyConfig()
+	proxyConf.FetchSignerHook = func(username string) (Signer, error) {
+		return signer, nil
+	}
+
+	client, res, err := dialTestProxy(t, proxyConf, upstreamConf, &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v, upstream: %v", err, res.err, upstreamErr)
+	}
+	client.Close()
+	if len(signer.formats) != 1 || signer.formats[0] != SigAlgoRSASHA2256 {
+		t.Errorf("signed with %v, want [%s]", signer.formats, SigAlgoRSASHA2256)
+	}
+}
+
+func TestRequestAlgo(t *testing.T) {
+	for _, tc := range []struct{ keyType, sigAlgo, want string }{
+		{KeyAlgoRSA, "", KeyAlgoRSA},
+		{KeyAlgoRSA, SigAlgoRSASHA2512, SigAlgoRSASHA2512},
+		{CertAlgoRSAv01, SigAlgoRSASHA2256, CertSigAlgoRSASHA2256v01},
+		{KeyAlgoED25519, KeyAlgoED25519, KeyAlgoED25519},
+	} {
+		if got := requestAlgo(tc.keyType, tc.sigAlgo); got != tc.want {
+			t.Errorf("requestAlgo(%q, %q) = %q, want %q", tc.keyType, tc.sigAlgo, got, tc.want)
+		}
+	}
+}
+
+func TestClientOffersExtInfo(t *testing.T) {
+	a, b, err := netPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	conf := &ClientConfig{HostKeyCallback: InsecureIgnoreHostKey()}
+	conf.SetDefaults()
+	v := []byte("version")
+	client := newClientTransport(newTransport(a, rand.Reader, true), v, v, conf, "addr", a.RemoteAddr())
+	defer client.Close()
+
+	packet, err := newTransport(b, rand.Reader, false).readPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kexInit kexInitMsg
+	if err := Unmarshal(packet, &kexInit); err != nil {
+		t.Fatal(err)
+	}
+	if !contains(kexInit.KexAlgos, extInfoClient) {
+		t.Errorf("client offered key exchanges %v, want %s among them", kexInit.KexAlgos, extInfoClient)
+	}
+}
+
+func TestSendAuthReqExtInfo(t *testing.T) {
+	trC, trS, err := handshakePair(&ClientConfig{HostKeyCallback: InsecureIgnoreHostKey()}, "addr", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trC.Close()
+	defer trS.Close()
+
+	go func() {
+		if _, err := trS.readPacket(); err != nil {
+			return
+		}
+		var payload []byte
+		payload = appendString(payload, "server-sig-algs")
+		payload = appendString(payload, "ssh-ed25519,rsa-sha2-256")
+		trS.writePacket(Marshal(&extInfoMsg{NumExtensions: 1, Payload: payload}))
+		trS.writePacket(Marshal(&serviceAcceptMsg{serviceUserAuth}))
+	}()
+
+	c := &connection{transport: trC}
+	extensions, err := c.sendAuthReq()
+	if err != nil {
+		t.Fatalf("sendAuthReq: %v", err)
+	}
+	p := &ProxyConn{}
+	p.setUpstreamExtensions(extensions)
+	if len(p.upstreamSigAlgs) != 2 || p.upstreamSigAlgs[1] != SigAlgoRSASHA2256 {
+		t.Errorf("got server-sig-algs %q", p.upstreamSigAlgs)
+	}
+}
+
+func TestUpstreamSigAlgo(t *testing.T) {
+	kms := &sha256OnlySigner{AlgorithmSigner: testSigners["rsa"].(AlgorithmSigner)}
+	for _, tc := range []struct {
+		signer  Signer
+		sigAlgs []string
+		want    string
+	}{
+		{testSigners["rsa"], nil, ""},
+		{testSigners["rsa"], []string{SigAlgoRSA}, ""},
+		{testSigners["rsa"], []string{SigAlgoRSASHA2256}, SigAlgoRSASHA2256},
+		{testSigners["rsa"], []string{SigAlgoRSASHA2256, SigAlgoRSASHA2512}, SigAlgoRSASHA2512},
+		{testSigners["ed25519"], []string{SigAlgoRSASHA2512}, ""},
+		{kms, nil, SigAlgoRSASHA2256},
+		{kms, []string{SigAlgoRSASHA2512}, SigAlgoRSASHA2256},
+	} {
+		p := &ProxyConn{upstreamSigAlgs: tc.sigAlgs}
+		if got := p.upstreamSigAlgo(tc.signer); got != tc.want {
+			t.Errorf("upstreamSigAlgo(%s) with server-sig-algs %q = %q, want %q", tc.signer.PublicKey().Type(), tc.sigAlgs, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package ssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Phases of a ProxyConn, stored in ProxyConn.phase.
+const (
+	phaseHandshake int32 = iota
+	phaseAuth
+	phaseRelay
+	phaseClosed
+)
+
+var phaseNames = [...]string{"handshake", "auth", "relay", "closed"}
+
+// NegotiatedAlgorithms are the algorithms agreed on one leg of a proxied
+// connection. Read and write are seen from the proxy.
+type NegotiatedAlgorithms struct {
+	KeyExchange string `json:"kex"`
+	HostKey     string `json:"host_key"`
+	CipherRead  string `json:"cipher_read"`
+	CipherWrite string `json:"cipher_write"`
+	MACRead     string `json:"mac_read"`
+	MACWrite    string `json:"mac_write"`
+}
+
+func negotiated(t *handshakeTransport) NegotiatedAlgorithms {
+	algs := t.negotiatedAlgorithms()
+	if algs == nil {
+		return NegotiatedAlgorithms{}
+	}
+	return NegotiatedAlgorithms{
+		KeyExchange: algs.kex,
+		HostKey:     algs.hostKey,
+		CipherRead:  algs.r.Cipher,
+		CipherWrite: algs.w.Cipher,
+		MACRead:     algs.r.MAC,
+		MACWrite:    algs.w.MAC,
+	}
+}
+
+// SessionSnapshot is the state of a ProxyConn at one point in time, for
+// post-mortem analysis.
+type SessionSnapshot struct {
+	ID              string    `json:"id"`
+	User            string    `json:"user"`
+	DestinationHost string    `json:"destination_host"`
+	RemoteAddr      string    `json:"remote_addr"`
+	Phase           string    `json:"phase"`
+	Started         time.Time `json:"started,omitempty"`
+	Taken           time.Time `json:"taken"`
+
+	BytesUpstream   int64 `json:"bytes_upstream"`
+	BytesDownstream int64 `json:"bytes_downstream"`
+
+	// The type of the last message relayed in each direction.
+	LastUpstreamMsg   uint8 `json:"last_upstream_msg"`
+	LastDownstreamMsg uint8 `json:"last_downstream_msg"`
+
+	Downstream NegotiatedAlgorithms `json:"downstream"`
+	Upstream   NegotiatedAlgorithms `json:"upstream"`
+}
+
+// Snapshot returns the current state of p. It is safe to call at any time.
+func (p *ProxyConn) Snapshot() SessionSnapshot {
+	phase := atomic.LoadInt32(&p.phase)
+	s := SessionSnapshot{
+		ID:                p.ID(),
+		User:              p.User,
+		DestinationHost:   p.DestinationHost,
+		RemoteAddr:        p.Downstream.RemoteAddr().String(),
+		Phase:             phaseNames[phase],
+		Taken:             time.Now(),
+		BytesUpstream:     atomic.LoadInt64(&p.bytesUpstream),
+		BytesDownstream:   atomic.LoadInt64(&p.bytesDownstream),
+		LastUpstreamMsg:   uint8(atomic.LoadUint32(&p.lastUpstreamMsg)),
+		LastDownstreamMsg: uint8(atomic.LoadUint32(&p.lastDownstreamMsg)),
+		Downstream:        negotiated(p.Downstream.transport),
+		Upstream:          negotiated(p.Upstream.transport),
+	}
+	// p.info is assigned before the phase changes to relay.
+	if phase >= phaseRelay {
+		s.Started = p.info.Started
+	}
+	return s
+}
+
+func writeSnapshots(w io.Writer, snapshots []SessionSnapshot) error {
+	enc := json.NewEncoder(w)
+	for _, s := range snapshots {
+		if err := enc.Encode(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteSnapshots writes a snapshot of every session on this node to w, one
+// JSON object per line, for example on forced shutdown.
+func (m *SessionManager) WriteSnapshots(w io.Writer) error {
+	m.mu.Lock()
+	snapshots := make([]SessionSnapshot, 0, len(m.local))
+	for _, p := range m.local {
+		snapshots = append(snapshots, p.Snapshot())
+	}
+	m.mu.Unlock()
+	return writeSnapshots(w, snapshots)
+}
+
+// dumpOnPanic writes the panic value and snapshots to
+// ProxyConfig.SnapshotWriter if the calling goroutine panics, then continues
+// panicking. It must be deferred.
+func (p *ProxyConn) dumpOnPanic() {
+	if p.config == nil || p.config.SnapshotWriter == nil {
+		return
+	}
+	r := recover()
+	if r == nil {
+		return
+	}
+	w := p.config.SnapshotWriter
+	json.NewEncoder(w).Encode(struct {
+		Panic   string `json:"panic"`
+		Session string `json:"session"`
+	}{fmt.Sprint(r), p.ID()})
+	tracked := false
+	if m := p.config.Sessions; m != nil {
+		m.WriteSnapshots(w)
+		m.mu.Lock()
+		_, tracked = m.local[p.ID()]
+		m.mu.Unlock()
+	}
+	if !tracked {
+		writeSnapshots(w, []SessionSnapshot{p.Snapshot()})
+	}
+	panic(r)
+}
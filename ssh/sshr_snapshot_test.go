@@ -0,0 +1,78 @@
+package ssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestProxySnapshot(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	sessions, err := NewSessionManager(proxyConf)
+	if err != nil {
+		t.Fatalf("NewSessionManager: %v", err)
+	}
+	proxyConf.Sessions = sessions
+
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+	runHello(t, client)
+
+	s := res.conn.Snapshot()
+	if s.Phase != "relay" || s.User != "testuser" || s.BytesDownstream == 0 {
+		t.Errorf("got snapshot %+v", s)
+	}
+	if s.Downstream.KeyExchange == "" || s.Upstream.CipherWrite == "" {
+		t.Errorf("negotiated algorithms missing: %+v, %+v", s.Downstream, s.Upstream)
+	}
+	if s.LastDownstreamMsg == 0 || s.LastUpstreamMsg == 0 {
+		t.Errorf("last message types missing: %d, %d", s.LastUpstreamMsg, s.LastDownstreamMsg)
+	}
+
+	var buf bytes.Buffer
+	if err := sessions.WriteSnapshots(&buf); err != nil {
+		t.Fatalf("WriteSnapshots: %v", err)
+	}
+	var written SessionSnapshot
+	if err := json.Unmarshal(buf.Bytes(), &written); err != nil || written.ID != s.ID {
+		t.Errorf("WriteSnapshots wrote %q: %v", buf.String(), err)
+	}
+}
+
+func TestDumpOnPanic(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	var buf bytes.Buffer
+	p := &ProxyConn{
+		User:       "alice",
+		Downstream: &connection{sshConn: sshConn{conn: c1}, transport: newHandshakeTransport(nil, &Config{}, nil, nil)},
+		Upstream:   &connection{transport: newHandshakeTransport(nil, &Config{}, nil, nil)},
+		config:     &ProxyConfig{SnapshotWriter: &buf},
+	}
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Errorf("got panic %v, want the original one", r)
+			}
+		}()
+		defer p.dumpOnPanic()
+		panic("boom")
+	}()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"panic":"boom"`) || !strings.Contains(lines[1], `"user":"alice"`) {
+		t.Errorf("got dump %q", buf.String())
+	}
+}
@@ -0,0 +1,261 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errNoStepUpHook         = errors.New("ssh: step-up authentication is not configured")
+	errNoInteractiveChannel = errors.New("ssh: session has no interactive terminal to challenge")
+	errStepUpAborted        = errors.New("ssh: step-up challenge aborted by user")
+	errStepUpTimeout        = errors.New("ssh: step-up challenge timed out")
+	errSessionClosed        = errors.New("ssh: session closed during step-up challenge")
+)
+
+// defaultStepUpTimeout is used when ProxyConfig.StepUpTimeout is zero.
+const defaultStepUpTimeout = 2 * time.Minute
+
+// inputGrab diverts the keystrokes of one channel to the proxy while holding
+// back everything the upstream sends.
+type inputGrab struct {
+	mu     sync.Mutex
+	ch     *proxyChannel
+	input  chan []byte
+	resume chan struct{}
+}
+
+// start grabs the input of ch. It returns nil if a grab is already active.
+func (g *inputGrab) start(ch *proxyChannel) <-chan []byte {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resume != nil {
+		return nil
+	}
+	g.ch = ch
+	g.input = make(chan []byte, 16)
+	g.resume = make(chan struct{})
+	return g.input
+}
+
+func (g *inputGrab) stop() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	close(g.resume)
+	g.ch, g.input, g.resume = nil, nil, nil
+}
+
+// hold blocks while a grab is active.
+func (g *inputGrab) hold() {
+	g.mu.Lock()
+	resume := g.resume
+	g.mu.Unlock()
+	if resume != nil {
+		<-resume
+	}
+}
+
+// divert handles a packet sent by the downstream client while a grab may be
+// active. It reports whether the packet was consumed by the proxy.
+func (p *ProxyConn) divert(packet []byte) bool {
+	if len(packet) > 0 && packet[0] == msgChannelWindowAdjust {
+		return !p.channels.withholdAdjust(toUpstream, packet)
+	}
+	if len(packet) == 0 || packet[0] != msgChannelData {
+		return false
+	}
+	atomic.StoreInt64(&p.lastInput, time.Now().UnixNano())
+
+	g := &p.grab
+	g.mu.Lock()
+	ch, input := g.ch, g.input
+	g.mu.Unlock()
+	if ch == nil {
+		return false
+	}
+	var msg channelDataMsg
+	if err := Unmarshal(packet, &msg); err != nil || msg.PeersID != ch.upstreamID {
+		return false
+	}
+
+	// The upstream never sees these bytes, so the window they took up is
+	// returned to the client here.
+	p.Downstream.transport.writePacket(Marshal(&windowAdjustMsg{
+		PeersID:         ch.downstreamID,
+		AdditionalBytes: msg.Length,
+	}))
+	select {
+	case input <- append([]byte(nil), msg.Rest...):
+	default:
+	}
+	return true
+}
+
+// StepUp re-challenges the user of an established session with
+// ProxyConfig.StepUpHook. The prompts are written to the session's terminal
+// and the answers read from it; the upstream output is held back until the
+// challenge is over. Sessions without a pty cannot be challenged. If the
+// challenge fails for any reason the session is disconnected.
+func (p *ProxyConn) StepUp() error {
+	timeout := defaultStepUpTimeout
+	if p.config != nil && p.config.StepUpTimeout > 0 {
+		timeout = p.config.StepUpTimeout
+	}
+	err := p.stepUp("", time.After(timeout), nil)
+	if err != nil {
+		p.disconnect(disconnectByApplication, "step-up authentication failed")
+	}
+	return err
+}
+
+// stepUp runs the challenge after writing banner. It gives up when deadline
+// fires or done is closed.
+func (p *ProxyConn) stepUp(banner string, deadline <-chan time.Time, done <-chan struct{}) error {
+	if p.config == nil || p.config.StepUpHook == nil {
+		return errNoStepUpHook
+	}
+	ch := p.channels.interactive()
+	if ch == nil {
+		return errNoInteractiveChannel
+	}
+
+	input := p.grab.start(ch)
+	if input == nil {
+		// Another challenge is in progress; its outcome decides.
+		return nil
+	}
+	defer p.grab.stop()
+
+	t := &terminalPrompt{p: p, ch: ch, input: input, deadline: deadline, done: done}
+	if err := t.write(banner); err != nil {
+		return err
+	}
+	return p.config.StepUpHook(p.User, t.challenge)
+}
+
+// terminalPrompt implements a KeyboardInteractiveChallenge on top of a
+// grabbed terminal channel.
+type terminalPrompt struct {
+	p        *ProxyConn
+	ch       *proxyChannel
+	input    <-chan []byte
+	deadline <-chan time.Time
+	done     <-chan struct{}
+	buf      []byte
+}
+
+func (t *terminalPrompt) write(s string) error {
+	if s == "" {
+		return nil
+	}
+	return t.p.writeToChannel(t.ch, []byte(s))
+}
+
+func (t *terminalPrompt) challenge(user, instruction string, questions []string, echos []bool) ([]string, error) {
+	if err := t.write("\r\n" + instruction); err != nil {
+		return nil, err
+	}
+	if instruction != "" {
+		if err := t.write("\r\n"); err != nil {
+			return nil, err
+		}
+	}
+
+	answers := make([]string, len(questions))
+	for i, q := range questions {
+		if err := t.write(q); err != nil {
+			return nil, err
+		}
+		answer, err := t.readLine(i < len(echos) && echos[i])
+		if err != nil {
+			return nil, err
+		}
+		answers[i] = answer
+		if err := t.write("\r\n"); err != nil {
+			return nil, err
+		}
+	}
+	return answers, nil
+}
+
+// readLine reads a line of input, editing it and echoing it the way a
+// terminal in raw mode expects.
+func (t *terminalPrompt) readLine(echo bool) (string, error) {
+	var line []byte
+	for {
+		for len(t.buf) > 0 {
+			b := t.buf[0]
+			t.buf = t.buf[1:]
+			switch b {
+			case '\r', '\n':
+				if b == '\r' && len(t.buf) > 0 && t.buf[0] == '\n' {
+					t.buf = t.buf[1:]
+				}
+				return string(line), nil
+			case 3, 4: // ^C, ^D
+				return "", errStepUpAborted
+			case 8, 127: // backspace
+				if len(line) > 0 {
+					line = line[:len(line)-1]
+					if echo {
+						if err := t.write("\b \b"); err != nil {
+							return "", err
+						}
+					}
+				}
+			default:
+				line = append(line, b)
+				if echo {
+					if err := t.write(string(b)); err != nil {
+						return "", err
+					}
+				}
+			}
+		}
+
+		select {
+		case data := <-t.input:
+			t.buf = data
+		case <-t.deadline:
+			return "", errStepUpTimeout
+		case <-t.done:
+			return "", errSessionClosed
+		}
+	}
+}
+
+// watchIdle locks the terminal of the session once no input has been received
+// for after, until done is closed. Like a workstation screen lock, a locked
+// session waits for the user to answer the challenge for as long as it takes;
+// a wrong answer disconnects it.
+func (p *ProxyConn) watchIdle(after time.Duration, done <-chan struct{}) {
+	timer := time.NewTimer(after)
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&p.lastInput)))
+		if idle < after {
+			timer.Reset(after - idle)
+			continue
+		}
+		if p.channels.interactive() != nil {
+			banner := fmt.Sprintf("\r\nSession locked after %v of inactivity.", after)
+			if err := p.stepUp(banner, nil, done); err != nil {
+				if err != errSessionClosed {
+					p.disconnect(disconnectByApplication, "session unlock failed")
+				}
+				return
+			}
+		}
+		atomic.StoreInt64(&p.lastInput, time.Now().UnixNano())
+		timer.Reset(after)
+	}
+}
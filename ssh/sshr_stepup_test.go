@@ -0,0 +1,158 @@
+package ssh
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testShell is an interactive session through the proxy.
+type testShell struct {
+	stdin  io.Writer
+	stdout io.Reader
+}
+
+func startTestShell(t *testing.T, client *Client) *testShell {
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	t.Cleanup(func() { session.Close() })
+	if err := session.RequestPty("xterm", 24, 80, TerminalModes{}); err != nil {
+		t.Fatalf("RequestPty: %v", err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatalf("StdinPipe: %v", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatalf("StdoutPipe: %v", err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Shell: %v", err)
+	}
+	return &testShell{stdin: stdin, stdout: stdout}
+}
+
+// expect reads output until it ends with want.
+func (s *testShell) expect(t *testing.T, want string) {
+	var got []byte
+	buf := make([]byte, 256)
+	for !strings.HasSuffix(string(got), want) {
+		n, err := s.stdout.Read(buf)
+		if err != nil {
+			t.Fatalf("reading %q: got %q, %v", want, got, err)
+		}
+		got = append(got, buf[:n]...)
+	}
+}
+
+func stepUpTestConfig() *ProxyConfig {
+	proxyConf := newTestProxyConfig()
+	proxyConf.StepUpHook = func(username string, challenge KeyboardInteractiveChallenge) error {
+		answers, err := challenge(username, "Re-authentication required", []string{"Code: "}, []bool{false})
+		if err != nil {
+			return err
+		}
+		if answers[0] != "123456" {
+			return errors.New("wrong code")
+		}
+		return nil
+	}
+	return proxyConf
+}
+
+func TestProxyStepUp(t *testing.T) {
+	client, res, err := dialTestProxy(t, stepUpTestConfig(), newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+
+	shell := startTestShell(t, client)
+	shell.stdin.Write([]byte("a"))
+	shell.expect(t, "a")
+
+	stepUp := make(chan error, 1)
+	go func() { stepUp <- res.conn.StepUp() }()
+	shell.expect(t, "Code: ")
+	shell.stdin.Write([]byte("12345"))
+	shell.stdin.Write([]byte("7\x7f6\r"))
+	if err := <-stepUp; err != nil {
+		t.Fatalf("StepUp: %v", err)
+	}
+	shell.expect(t, "\r\n")
+
+	// Input reaches the upstream again once the challenge is over.
+	shell.stdin.Write([]byte("b"))
+	shell.expect(t, "b")
+}
+
+func TestProxyStepUpFailure(t *testing.T) {
+	client, res, err := dialTestProxy(t, stepUpTestConfig(), newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+
+	shell := startTestShell(t, client)
+	shell.stdin.Write([]byte("a"))
+	shell.expect(t, "a")
+
+	stepUp := make(chan error, 1)
+	go func() { stepUp <- res.conn.StepUp() }()
+	shell.expect(t, "Code: ")
+	shell.stdin.Write([]byte("000000\r"))
+	if err := <-stepUp; err == nil {
+		t.Fatal("StepUp with a wrong code succeeded")
+	}
+	if err := client.Wait(); err == nil {
+		t.Error("session not disconnected after a failed step-up")
+	}
+}
+
+func TestProxyStepUpWithoutPty(t *testing.T) {
+	client, res, err := dialTestProxy(t, stepUpTestConfig(), newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+	runHello(t, client)
+
+	if err := res.conn.StepUp(); err != errNoInteractiveChannel {
+		t.Errorf("got %v, want %v", err, errNoInteractiveChannel)
+	}
+}
+
+func TestProxyIdleLock(t *testing.T) {
+	proxyConf := stepUpTestConfig()
+	proxyConf.IdleLockAfter = 200 * time.Millisecond
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+
+	shell := startTestShell(t, client)
+	shell.expect(t, "inactivity.\r\nRe-authentication required\r\nCode: ")
+	shell.stdin.Write([]byte("123456\r"))
+	shell.expect(t, "\r\n")
+
+	shell.stdin.Write([]byte("a"))
+	shell.expect(t, "a")
+}
@@ -0,0 +1,609 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh/testdata"
+)
+
+// upstreamPassword is the password accepted by the test upstream server.
+const upstreamPassword = "upstream-secret"
+
+// newTestUpstreamConfig returns a server config that accepts testuser with
+// either the rsa test key or upstreamPassword.
+func newTestUpstreamConfig() *ServerConfig {
+	config := &ServerConfig{
+		PublicKeyCallback: func(conn ConnMetadata, key PublicKey) (*Permissions, error) {
+			if conn.User() == "testuser" && bytes.Equal(key.Marshal(), testPublicKeys["rsa"].Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("pubkey not acceptable")
+		},
+		PasswordCallback: func(conn ConnMetadata, pass []byte) (*Permissions, error) {
+			if conn.User() == "testuser" && string(pass) == upstreamPassword {
+				return nil, nil
+			}
+			return nil, errors.New("password not acceptable")
+		},
+	}
+	config.AddHostKey(testSigners["ecdsa"])
+	return config
+}
+
+// newTestProxyConfig returns a proxy config that authorizes the ecdsa test
+// key downstream and authenticates upstream with the rsa test key.
+func newTestProxyConfig() *ProxyConfig {
+	serverConfig := &ServerConfig{}
+	serverConfig.AddHostKey(testSigners["rsa"])
+	return &ProxyConfig{
+		ServerConfig: serverConfig,
+		ClientConfig: &ClientConfig{
+			HostKeyCallback: InsecureIgnoreHostKey(),
+		},
+		FetchAuthorizedKeysHook: func(username string) ([]byte, error) {
+			return MarshalAuthorizedKey(testPublicKeys["ecdsa"]), nil
+		},
+		FetchPrivateKeyHook: func(username string) ([]byte, error) {
+			return testdata.PEMBytes["rsa"], nil
+		},
+	}
+}
+
+// serveTestUpstream accepts a single connection and answers every exec
+// request on a session channel with "hello" and exit status 0. Shells echo
+// their input.
+func serveTestUpstream(c net.Conn, config *ServerConfig) {
+	_, chans, reqs, err := NewServerConn(c, config)
+	if err != nil {
+		return
+	}
+	go DiscardRequests(reqs)
+	for newCh := range chans {
+		ch, reqs, err := newCh.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer ch.Close()
+			for req := range reqs {
+				switch req.Type {
+				case "pty-req":
+					req.Reply(true, nil)
+				case "shell":
+					req.Reply(true, nil)
+					go io.Copy(ch, ch)
+				case "exec":
+					req.Reply(true, nil)
+					ch.Write([]byte("hello"))
+					ch.SendRequest("exit-status", false, Marshal(exitStatusMsg{0}))
+					return
+				default:
+					req.Reply(false, nil)
+				}
+			}
+		}()
+	}
+}
+
+// proxyTestResult holds the proxy side outcome of a test connection.
+type proxyTestResult struct {
+	conn *ProxyConn
+	err  error
+}
+
+// runTestProxy handles one downstream connection on c the way an sshr-style
+// proxy does, dialing upstream over a fresh pipe. With a RouteUpstreamHook,
+// the route's client config and user are used.
+func runTestProxy(c net.Conn, proxyConf *ProxyConfig, upstreamConf *ServerConfig, done chan<- proxyTestResult) {
+	downstream, err := NewDownstreamConn(c, proxyConf.ServerConfig)
+	if err != nil {
+		done <- proxyTestResult{err: err}
+		return
+	}
+	authReq, err := downstream.GetAuthRequestMsg()
+	if err != nil {
+		done <- proxyTestResult{err: err}
+		return
+	}
+	var route *UpstreamRoute
+	clientConf := proxyConf.ClientConfig
+	if proxyConf.RouteUpstreamHook != nil {
+		if route, err = proxyConf.RouteUpstream(context.Background(), downstream.HookMetadata(authReq)); err != nil {
+			done <- proxyTestResult{err: err}
+			return
+		}
+		clientConf = route.ClientConfig
+	}
+
+	u1, u2, err := netPipe()
+	if err != nil {
+		done <- proxyTestResult{err: err}
+		return
+	}
+	go serveTestUpstream(u1, upstreamConf)
+
+	upstream, err := NewUpstreamConn(u2, clientConf)
+	if err != nil {
+		done <- proxyTestResult{err: err}
+		return
+	}
+
+	p := &ProxyConn{
+		User:            authReq.User,
+		DestinationHost: "upstream",
+		Upstream:        upstream,
+		Downstream:      downstream,
+		Route:           route,
+	}
+	if err := p.AuthenticateProxyConn(authReq, proxyConf); err != nil {
+		p.Close()
+		done <- proxyTestResult{conn: p, err: err}
+		return
+	}
+	done <- proxyTestResult{conn: p}
+	p.Wait()
+}
+
+// dialTestProxy connects a downstream client through a proxy that uses
+// proxyConf and returns the client together with the proxy side result.
+func dialTestProxy(t *testing.T, proxyConf *ProxyConfig, upstreamConf *ServerConfig, clientConf *ClientConfig) (*Client, proxyTestResult, error) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+
+	done := make(chan proxyTestResult, 1)
+	go runTestProxy(c1, proxyConf, upstreamConf, done)
+
+	if clientConf.HostKeyCallback == nil {
+		clientConf.HostKeyCallback = InsecureIgnoreHostKey()
+	}
+	conn, chans, reqs, err := NewClientConn(c2, "proxy", clientConf)
+	if err != nil {
+		c2.Close()
+		return nil, <-done, err
+	}
+	return NewClient(conn, chans, reqs), <-done, nil
+}
+
+// runHello runs an exec request through client and returns its output.
+func runHello(t *testing.T, client *Client) string {
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+	out, err := session.Output("true")
+	if err != nil {
+		t.Fatalf("Output: %v", err)
+	}
+	return string(out)
+}
+
+func TestProxyPublicKeyBridge(t *testing.T) {
+	client, res, err := dialTestProxy(t, newTestProxyConfig(), newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+
+	if got := runHello(t, client); got != "hello" {
+		t.Errorf("got output %q, want %q", got, "hello")
+	}
+}
+
+func TestProxyPublicKeyNotAuthorized(t *testing.T) {
+	_, _, err := dialTestProxy(t, newTestProxyConfig(), newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ed25519"])},
+	})
+	if err == nil {
+		t.Fatal("client with an unauthorized key connected")
+	}
+}
+
+func TestProxyPasswordPassthrough(t *testing.T) {
+	client, res, err := dialTestProxy(t, newTestProxyConfig(), newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{Password(upstreamPassword)},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+
+	if got := runHello(t, client); got != "hello" {
+		t.Errorf("got output %q, want %q", got, "hello")
+	}
+}
+
+func TestProxyQoSClass(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.QoS = NewQoSThrottler(1<<20, nil)
+	proxyConf.QoSClassHook = func(username string) QoSClass {
+		return QoSBackground
+	}
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+
+	if res.conn.QoSClass != QoSBackground {
+		t.Errorf("got QoS class %v, want %v", res.conn.QoSClass, QoSBackground)
+	}
+	if got := runHello(t, client); got != "hello" {
+		t.Errorf("got output %q, want %q", got, "hello")
+	}
+}
+
+func TestProxyHomeDirHook(t *testing.T) {
+	home := t.TempDir()
+	if err := os.Mkdir(filepath.Join(home, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(home, ".ssh", "authorized_keys"), MarshalAuthorizedKey(testPublicKeys["ecdsa"]), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(home, ".ssh", "id_rsa"), testdata.PEMBytes["rsa"], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	proxyConf := newTestProxyConfig()
+	proxyConf.FetchAuthorizedKeysHook = nil
+	proxyConf.FetchPrivateKeyHook = nil
+	proxyConf.HomeDirHook = func(username string) (string, error) {
+		if username != "testuser" {
+			return "", errors.New("no such user")
+		}
+		return home, nil
+	}
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+
+	if got := runHello(t, client); got != "hello" {
+		t.Errorf("got output %q, want %q", got, "hello")
+	}
+
+	if _, err := userAuthorizedKeysFile.read(proxyConf, "nobody"); err == nil || !strings.Contains(err.Error(), "no such user") {
+		t.Errorf("got error %v for unresolvable user, want the hook's error", err)
+	}
+}
+
+// publicKeyRequest builds a downstream publickey request announcing algo for
+// key, signed with sig.
+func publicKeyRequest(t *testing.T, algo string, key PublicKey, sig *Signature) *userAuthRequestMsg {
+	s := Marshal(sig)
+	wrapped := make([]byte, stringLength(len(s)))
+	marshalString(wrapped, s)
+	var msg userAuthRequestMsg
+	if err := Unmarshal(Marshal(&publickeyAuthMsg{
+		User:     "testuser",
+		Service:  serviceSSH,
+		Method:   "publickey",
+		HasSig:   true,
+		Algoname: algo,
+		PubKey:   key.Marshal(),
+		Sig:      wrapped,
+	}), &msg); err != nil {
+		t.Fatal(err)
+	}
+	return &msg
+}
+
+func TestProxyRejectsAlgorithmKeyMismatch(t *testing.T) {
+	sig := &Signature{Format: KeyAlgoED25519, Blob: []byte("sig")}
+	for _, tc := range []struct {
+		algo string
+		key  PublicKey
+		ok   bool
+	}{
+		{KeyAlgoED25519, testPublicKeys["ed25519"], true},
+		{SigAlgoRSASHA2256, testPublicKeys["rsa"], true},
+		{CertSigAlgoRSASHA2512v01, testRSACert(t), true},
+		{SigAlgoRSASHA2512, testRSACert(t), false},
+		{CertSigAlgoRSASHA2256v01, testPublicKeys["rsa"], false},
+		{KeyAlgoECDSA256, testPublicKeys["ed25519"], false},
+		{SigAlgoRSASHA2512, testPublicKeys["ecdsa"], false},
+		{KeyAlgoRSA, testPublicKeys["dsa"], false},
+	} {
+		_, _, _, err := parsePublicKeyMsg(publicKeyRequest(t, tc.algo, tc.key, sig))
+		if (err == nil) != tc.ok {
+			t.Errorf("algorithm %s with %s key: got error %v, want ok %v", tc.algo, tc.key.Type(), err, tc.ok)
+		}
+	}
+}
+
+func TestProxyRejectsSignatureFormatMismatch(t *testing.T) {
+	p := &ProxyConn{}
+	for _, tc := range []struct {
+		algo   string
+		key    PublicKey
+		format string
+	}{
+		{KeyAlgoECDSA256, testPublicKeys["ecdsa"], SigAlgoRSASHA2256},
+		{KeyAlgoED25519, testPublicKeys["ed25519"], SigAlgoRSA},
+		{KeyAlgoRSA, testPublicKeys["rsa"], KeyAlgoED25519},
+		{KeyAlgoDSA, testPublicKeys["dsa"], KeyAlgoECDSA256},
+		// Announcing SHA-2 but signing with SHA-1 is a downgrade.
+		{SigAlgoRSASHA2512, testPublicKeys["rsa"], SigAlgoRSA},
+		{SigAlgoRSASHA2256, testPublicKeys["rsa"], SigAlgoRSASHA2512},
+		{CertSigAlgoRSASHA2256v01, testRSACert(t), SigAlgoRSA},
+	} {
+		sig := &Signature{Format: tc.format, Blob: []byte("sig")}
+		msg := publicKeyRequest(t, tc.algo, tc.key, sig)
+		if ok, err := p.VerifySignature(msg, tc.key, sig); ok || err == nil {
+			t.Errorf("%s signature for %s with %s key: got ok %v, err %v; want an error", tc.format, tc.algo, tc.key.Type(), ok, err)
+		}
+	}
+}
+
+func TestProxyDSAOptIn(t *testing.T) {
+	newConf := func() *ProxyConfig {
+		proxyConf := newTestProxyConfig()
+		proxyConf.FetchAuthorizedKeysHook = func(username string) ([]byte, error) {
+			return MarshalAuthorizedKey(testPublicKeys["dsa"]), nil
+		}
+		return proxyConf
+	}
+	clientConf := func() *ClientConfig {
+		return &ClientConfig{
+			User: "testuser",
+			Auth: []AuthMethod{PublicKeys(testSigners["dsa"])},
+		}
+	}
+
+	if _, _, err := dialTestProxy(t, newConf(), newTestUpstreamConfig(), clientConf()); err == nil {
+		t.Fatal("ssh-dss key accepted by default")
+	}
+
+	var warned []string
+	proxyConf := newConf()
+	proxyConf.AllowDSA = true
+	proxyConf.LegacyKeyHook = func(username string, key PublicKey) {
+		warned = append(warned, username+" "+key.Type())
+	}
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), clientConf())
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+	if len(warned) != 1 || warned[0] != "testuser "+KeyAlgoDSA {
+		t.Errorf("got legacy key events %v, want one for testuser", warned)
+	}
+}
+
+// taggedConn is a connection annotated by a PreHandshakeHook.
+type taggedConn struct {
+	net.Conn
+	tag string
+}
+
+func TestProxyPreHandshakeHook(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.ServerConfig.PreHandshakeHook = func(c net.Conn) (net.Conn, error) {
+		return &taggedConn{c, "measured"}, nil
+	}
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+	if c, ok := res.conn.Downstream.NetConn().(*taggedConn); !ok || c.tag != "measured" {
+		t.Errorf("got downstream conn %T, want the wrapped one", res.conn.Downstream.NetConn())
+	}
+
+	rejected := errors.New("blocked source")
+	proxyConf = newTestProxyConfig()
+	proxyConf.ServerConfig.PreHandshakeHook = func(c net.Conn) (net.Conn, error) {
+		return nil, rejected
+	}
+	_, res, err = dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err == nil || res.err != rejected {
+		t.Errorf("got client error %v, proxy error %v; want rejection", err, res.err)
+	}
+}
+
+func TestProxyContextHookCancelledOnDisconnect(t *testing.T) {
+	entered := make(chan struct{})
+	cancelled := make(chan error, 1)
+	proxyConf := newTestProxyConfig()
+	proxyConf.FetchAuthorizedKeysContextHook = func(ctx context.Context, meta HookMetadata) ([]byte, error) {
+		close(entered)
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return nil, ctx.Err()
+	}
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	go runTestProxy(c1, proxyConf, newTestUpstreamConfig(), make(chan proxyTestResult, 1))
+	go NewClientConn(c2, "proxy", &ClientConfig{
+		User:            "testuser",
+		Auth:            []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+
+	<-entered
+	c2.Close()
+	select {
+	case err := <-cancelled:
+		if err != context.Canceled {
+			t.Errorf("got context error %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("hook context not cancelled after the downstream dropped")
+	}
+}
+
+// countingSigner counts the signatures made by the wrapped signer.
+type countingSigner struct {
+	Signer
+	n int
+}
+
+func (s *countingSigner) Sign(rand io.Reader, data []byte) (*Signature, error) {
+	s.n++
+	return s.Signer.Sign(rand, data)
+}
+
+func TestProxyFetchSignerHook(t *testing.T) {
+	signer := &countingSigner{Signer: testSigners["rsa"]}
+	proxyConf := newTestProxyConfig()
+	proxyConf.FetchPrivateKeyHook = func(username string) ([]byte, error) {
+		t.Error("private key fetched although a signer is configured")
+		return nil, errors.New("unused")
+	}
+	proxyConf.FetchSignerHook = func(username string) (Signer, error) {
+		if username != "testuser" {
+			t.Errorf("signer fetched for %q", username)
+		}
+		return signer, nil
+	}
+
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	client.Close()
+	if signer.n != 1 {
+		t.Errorf("signer used %d times, want 1", signer.n)
+	}
+}
+
+func TestProxyMasterKeySigner(t *testing.T) {
+	signer := &countingSigner{Signer: testSigners["rsa"]}
+	proxyConf := newTestProxyConfig()
+	proxyConf.UseMasterKey = true
+	proxyConf.MasterKeyPath = "pkcs11:token=proxy;object=master"
+	proxyConf.MasterKeySigner = signer
+
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	client.Close()
+	if signer.n != 1 {
+		t.Errorf("master key signer used %d times, want 1", signer.n)
+	}
+
+	proxyConf.MasterKeySigner = nil
+	if _, err := fetchPrivateKey(context.Background(), proxyConf, HookMetadata{User: "testuser"}, true); err != errMasterKeyURI {
+		t.Errorf("got error %v for a PKCS #11 URI, want %v", err, errMasterKeyURI)
+	}
+}
+
+// testRSACert returns a user certificate for the rsa test key.
+func testRSACert(t *testing.T) *Certificate {
+	cert := &Certificate{Key: testPublicKeys["rsa"], CertType: UserCert, ValidPrincipals: []string{"testuser"}, ValidBefore: CertTimeInfinity}
+	if err := cert.SignCert(rand.Reader, testSigners["ecdsa"]); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestProxyVerifiesRSASHA2Signatures(t *testing.T) {
+	sessionID := []byte("session")
+	p := &ProxyConn{Downstream: &connection{transport: &handshakeTransport{sessionID: sessionID}}}
+	signer := testSigners["rsa"].(AlgorithmSigner)
+	for _, tc := range []struct {
+		algo, sigAlgo string
+		key           PublicKey
+	}{
+		{KeyAlgoRSA, SigAlgoRSA, testPublicKeys["rsa"]},
+		{KeyAlgoRSA, SigAlgoRSASHA2256, testPublicKeys["rsa"]},
+		{SigAlgoRSASHA2256, SigAlgoRSASHA2256, testPublicKeys["rsa"]},
+		{SigAlgoRSASHA2512, SigAlgoRSASHA2512, testPublicKeys["rsa"]},
+		{CertSigAlgoRSASHA2512v01, SigAlgoRSASHA2512, testRSACert(t)},
+	} {
+		req := userAuthRequestMsg{User: "testuser", Service: serviceSSH, Method: "publickey"}
+		sig, err := signer.SignWithAlgorithm(rand.Reader, buildDataSignedForAuth(sessionID, req, []byte(tc.algo), tc.key.Marshal()), tc.sigAlgo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := publicKeyRequest(t, tc.algo, tc.key, sig)
+		if _, _, _, err := parsePublicKeyMsg(msg); err != nil {
+			t.Errorf("%s request signed with %s: %v", tc.algo, tc.sigAlgo, err)
+			continue
+		}
+		if ok, err := p.VerifySignature(msg, tc.key, sig); !ok || err != nil {
+			t.Errorf("%s request signed with %s: got ok %v, err %v", tc.algo, tc.sigAlgo, ok, err)
+		}
+	}
+}
+
+// switchUserAuth authenticates with method as another user than the
+// client's.
+type switchUserAuth struct {
+	user  string
+	inner AuthMethod
+}
+
+func (a switchUserAuth) auth(session []byte, user string, c packetConn, rand io.Reader) (authResult, []string, error) {
+	return a.inner.auth(session, a.user, c, rand)
+}
+
+func (a switchUserAuth) method() string { return a.inner.method() }
+
+func TestProxyRejectsUserChange(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.FetchAuthorizedKeysHook = func(username string) ([]byte, error) {
+		if username == "mallory" {
+			return MarshalAuthorizedKey(testPublicKeys["ed25519"]), nil
+		}
+		return MarshalAuthorizedKey(testPublicKeys["ecdsa"]), nil
+	}
+	// The client's "none" request names testuser, the key request mallory.
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{switchUserAuth{"mallory", PublicKeys(testSigners["ed25519"])}},
+	})
+	if err == nil {
+		client.Close()
+		t.Fatal("logged in as testuser with mallory's key")
+	}
+	if res.err != errUserChanged {
+		t.Errorf("got proxy error %v, want %v", res.err, errUserChanged)
+	}
+}
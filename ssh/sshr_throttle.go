@@ -0,0 +1,184 @@
+package ssh
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// QoSClass identifies the relative bandwidth share that a proxied session is
+// entitled to when sessions compete for a shared QoSThrottler.
+type QoSClass int
+
+const (
+	// QoSInteractive is meant for operator shells and is the default class.
+	QoSInteractive QoSClass = iota
+	// QoSBulk is meant for file transfers started by users.
+	QoSBulk
+	// QoSBackground is meant for automation such as backup jobs.
+	QoSBackground
+)
+
+func (c QoSClass) String() string {
+	switch c {
+	case QoSInteractive:
+		return "interactive"
+	case QoSBulk:
+		return "bulk"
+	case QoSBackground:
+		return "background"
+	}
+	return fmt.Sprintf("QoSClass(%d)", int(c))
+}
+
+// DefaultQoSShares are the relative shares used by NewQoSThrottler when no
+// shares are given.
+var DefaultQoSShares = map[QoSClass]int{
+	QoSInteractive: 8,
+	QoSBulk:        3,
+	QoSBackground:  1,
+}
+
+// QoSThrottler divides a bandwidth budget between the QoS classes that have
+// active sessions, in proportion to their shares. Each direction has its
+// own budget, so a download does not slow down keystrokes. Classes without
+// active sessions do not hold back any bandwidth.
+type QoSThrottler struct {
+	rate   int64
+	shares map[QoSClass]int
+
+	mu      sync.Mutex
+	active  map[QoSClass]int
+	buckets map[QoSClass]*classBuckets
+}
+
+// classBuckets are the buckets shared by the sessions of a class.
+type classBuckets struct {
+	up, down *tokenBucket
+}
+
+// NewQoSThrottler returns a throttler that limits all sessions assigned to
+// it to bytesPerSecond in total in each direction. Classes missing from shares get a share of
+// one.
+func NewQoSThrottler(bytesPerSecond int64, shares map[QoSClass]int) *QoSThrottler {
+	if shares == nil {
+		shares = DefaultQoSShares
+	}
+	return &QoSThrottler{
+		rate:    bytesPerSecond,
+		shares:  shares,
+		active:  make(map[QoSClass]int),
+		buckets: make(map[QoSClass]*classBuckets),
+	}
+}
+
+func (q *QoSThrottler) share(class QoSClass) int {
+	if s, ok := q.shares[class]; ok && s > 0 {
+		return s
+	}
+	return 1
+}
+
+// join registers a session of the given class and returns the buckets the
+// traffic of the session to the upstream and to the downstream must draw
+// from. The caller must call leave when the session ends.
+func (q *QoSThrottler) join(class QoSClass) (up, down *tokenBucket) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.active[class]++
+	b, ok := q.buckets[class]
+	if !ok {
+		b = &classBuckets{up: newTokenBucket(0), down: newTokenBucket(0)}
+		q.buckets[class] = b
+	}
+	q.rebalance()
+	return b.up, b.down
+}
+
+func (q *QoSThrottler) leave(class QoSClass) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.active[class]--; q.active[class] <= 0 {
+		delete(q.active, class)
+	}
+	q.rebalance()
+}
+
+// rebalance recomputes the rates of the class buckets. q.mu must be held.
+func (q *QoSThrottler) rebalance() {
+	total := 0
+	for class := range q.active {
+		total += q.share(class)
+	}
+	for class, b := range q.buckets {
+		if _, ok := q.active[class]; !ok || total == 0 {
+			continue
+		}
+		rate := q.rate * int64(q.share(class)) / int64(total)
+		b.up.setRate(rate)
+		b.down.setRate(rate)
+	}
+}
+
+// tokenBucket is a byte-granular rate limiter. A rate of zero or less
+// disables limiting.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSecond int64) *tokenBucket {
+	b := &tokenBucket{last: time.Now()}
+	b.setRate(bytesPerSecond)
+	return b
+}
+
+// burst returns the bucket capacity: one second worth of traffic, but at
+// least one maximum sized packet.
+func (b *tokenBucket) burst() float64 {
+	if b.rate < maxPacket {
+		return maxPacket
+	}
+	return b.rate
+}
+
+func (b *tokenBucket) setRate(bytesPerSecond int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.rate = float64(bytesPerSecond)
+	if b.tokens > b.burst() {
+		b.tokens = b.burst()
+	}
+}
+
+// refill adds the tokens accumulated since the last call. b.mu must be held.
+func (b *tokenBucket) refill(now time.Time) {
+	if b.rate > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst() {
+			b.tokens = b.burst()
+		}
+	}
+	b.last = now
+}
+
+// reserve takes n tokens from the bucket and returns how long the caller
+// must wait before sending n bytes.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
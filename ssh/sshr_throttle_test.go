@@ -0,0 +1,56 @@
+package ssh
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketUnlimited(t *testing.T) {
+	b := newTokenBucket(0)
+	if d := b.reserve(1 << 30); d != 0 {
+		t.Errorf("unlimited bucket asked to wait %v", d)
+	}
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+	b := newTokenBucket(1 << 20)
+	b.tokens = 0
+	d := b.reserve(1 << 19)
+	if d < 400*time.Millisecond || d > 600*time.Millisecond {
+		t.Errorf("got delay %v for half a second of traffic", d)
+	}
+}
+
+func TestQoSThrottlerShares(t *testing.T) {
+	q := NewQoSThrottler(1200, map[QoSClass]int{
+		QoSInteractive: 2,
+		QoSBulk:        1,
+	})
+
+	interactive, _ := q.join(QoSInteractive)
+	if interactive.rate != 1200 {
+		t.Errorf("lone interactive session got rate %v, want 1200", interactive.rate)
+	}
+
+	bulk, _ := q.join(QoSBulk)
+	if interactive.rate != 800 || bulk.rate != 400 {
+		t.Errorf("got rates %v/%v, want 800/400", interactive.rate, bulk.rate)
+	}
+
+	q.leave(QoSInteractive)
+	if bulk.rate != 1200 {
+		t.Errorf("lone bulk session got rate %v, want 1200", bulk.rate)
+	}
+}
+
+func TestQoSThrottlerDirections(t *testing.T) {
+	q := NewQoSThrottler(1<<20, nil)
+	up, down := q.join(QoSInteractive)
+	if up == down {
+		t.Fatal("both directions share a bucket")
+	}
+	down.reserve(1 << 22)
+	if d := up.reserve(1); d > time.Millisecond {
+		t.Errorf("a download delayed upstream traffic by %v", d)
+	}
+}
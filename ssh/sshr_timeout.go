@@ -0,0 +1,87 @@
+package ssh
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// sessionLimit is a deadline enforced by watchTimeouts.
+type sessionLimit struct {
+	// deadline returns when the limit is reached.
+	deadline func() time.Time
+	warning  string
+	reason   string
+	// warned is the deadline the terminal was last warned about.
+	warned time.Time
+}
+
+// watchTimeouts disconnects the session once it was idle for
+// ProxyConfig.IdleTimeout or ran for MaxSessionDuration, until done is
+// closed. Interactive sessions are warned TimeoutWarning before.
+func (p *ProxyConn) watchTimeouts(done <-chan struct{}) {
+	conf := p.config
+	started := time.Now()
+	var limits []*sessionLimit
+	if conf.IdleTimeout > 0 {
+		limits = append(limits, &sessionLimit{
+			deadline: func() time.Time {
+				return time.Unix(0, atomic.LoadInt64(&p.lastActivity)).Add(conf.IdleTimeout)
+			},
+			warning: "Idle session disconnecting in %v.",
+			reason:  "idle timeout",
+		})
+	}
+	if conf.MaxSessionDuration > 0 {
+		end := started.Add(conf.MaxSessionDuration)
+		limits = append(limits, &sessionLimit{
+			deadline: func() time.Time { return end },
+			warning:  "Session reaching its maximum duration in %v.",
+			reason:   "maximum session duration reached",
+		})
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		next := time.Hour
+		for _, l := range limits {
+			deadline := l.deadline()
+			left := deadline.Sub(now)
+			if left <= 0 {
+				p.log(LogInfo, "session timed out", "reason", l.reason)
+				p.disconnect(disconnectByApplication, l.reason)
+				return
+			}
+			warn := conf.TimeoutWarning
+			if warn > 0 && left > warn {
+				left -= warn
+			} else if warn > 0 && !l.warned.Equal(deadline) {
+				l.warned = deadline
+				if ch := p.channels.interactive(); ch != nil {
+					msg := fmt.Sprintf(l.warning, roundRemaining(left))
+					p.writeToChannel(ch, []byte("\r\n"+msg+"\r\n"))
+				}
+			}
+			if left < next {
+				next = left
+			}
+		}
+		timer.Reset(next)
+	}
+}
+
+// roundRemaining rounds d for display, keeping sub-second warnings readable.
+func roundRemaining(d time.Duration) time.Duration {
+	if d >= time.Second {
+		return d.Round(time.Second)
+	}
+	return d.Round(100 * time.Millisecond)
+}
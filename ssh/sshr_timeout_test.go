@@ -0,0 +1,71 @@
+package ssh
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialTimeoutTestProxy connects a client to a proxy with proxyConf.
+func dialTimeoutTestProxy(t *testing.T, proxyConf *ProxyConfig) *Client {
+	client, _, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// waitDisconnect returns the error the client connection ended with.
+func waitDisconnect(t *testing.T, client *Client) error {
+	t.Helper()
+	c := make(chan error, 1)
+	go func() { c <- client.Wait() }()
+	select {
+	case err := <-c:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("session was not disconnected")
+	}
+	return nil
+}
+
+func TestProxyIdleTimeout(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.IdleTimeout = 400 * time.Millisecond
+	proxyConf.TimeoutWarning = 200 * time.Millisecond
+	client := dialTimeoutTestProxy(t, proxyConf)
+	start := time.Now()
+	shell := startTestShell(t, client)
+	shell.expect(t, "Idle session disconnecting in 200ms.\r\n")
+	err := waitDisconnect(t, client)
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Errorf("disconnected after %v, want 400ms", d)
+	}
+	if err == nil || !strings.Contains(err.Error(), "idle timeout") {
+		t.Errorf("got %v, want idle timeout disconnect", err)
+	}
+}
+
+func TestProxyMaxSessionDuration(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.IdleTimeout = time.Hour
+	proxyConf.MaxSessionDuration = 300 * time.Millisecond
+	client := dialTimeoutTestProxy(t, proxyConf)
+	startTestShell(t, client)
+
+	// Activity does not extend the session.
+	stop := time.NewTicker(50 * time.Millisecond)
+	defer stop.Stop()
+	go func() {
+		for range stop.C {
+			client.SendRequest("ping@example.com", false, nil)
+		}
+	}()
+	if err := waitDisconnect(t, client); err == nil || !strings.Contains(err.Error(), "maximum session duration") {
+		t.Errorf("got %v, want maximum session duration disconnect", err)
+	}
+}
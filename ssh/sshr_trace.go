@@ -0,0 +1,151 @@
+package ssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceRule selects downstream connections whose relayed messages are traced.
+// Empty criteria match anything, but at least one must be set.
+type TraceRule struct {
+	User string
+	// Network contains the source addresses the rule applies to.
+	Network *net.IPNet
+	// Expires, if set, ends tracing for the rule.
+	Expires time.Time
+}
+
+func (r *TraceRule) matches(username string, addr net.Addr, now time.Time) bool {
+	if !r.Expires.IsZero() && !now.Before(r.Expires) {
+		return false
+	}
+	if r.User != "" && r.User != username {
+		return false
+	}
+	if r.Network != nil {
+		tcp, ok := addr.(*net.TCPAddr)
+		if !ok || !r.Network.Contains(tcp.IP) {
+			return false
+		}
+	}
+	return true
+}
+
+// TraceEvent is one line written to TracePolicy.Sink. Payloads are never
+// traced, only the metadata of each message.
+type TraceEvent struct {
+	Time    time.Time `json:"time"`
+	Session string    `json:"session"`
+	User    string    `json:"user"`
+	// Direction is "upstream" or "downstream".
+	Direction string `json:"dir"`
+	Type      uint8  `json:"type"`
+	Length    int    `json:"len"`
+	// Channel is the recipient channel of channel messages.
+	Channel *uint32 `json:"channel,omitempty"`
+}
+
+// TracePolicy enables protocol tracing for the sessions matching one of its
+// rules. Rules can be changed at any time and apply to running sessions
+// immediately, so a single misbehaving client can be traced in production.
+// It is safe for concurrent use.
+type TracePolicy struct {
+	// Sink receives one JSON encoded TraceEvent per line.
+	Sink io.Writer
+
+	mu    sync.Mutex
+	rules atomic.Value // []TraceRule, replaced on update
+}
+
+var errTraceCriteria = errors.New("ssh: trace rule needs a user or network")
+
+// Enable adds a rule.
+func (t *TracePolicy) Enable(r TraceRule) error {
+	if r.User == "" && r.Network == nil {
+		return errTraceCriteria
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rules := append(t.load(), r)
+	t.rules.Store(rules)
+	return nil
+}
+
+// Disable removes the rules for which fn returns true.
+func (t *TracePolicy) Disable(fn func(r TraceRule) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var kept []TraceRule
+	for _, r := range t.load() {
+		if !fn(r) {
+			kept = append(kept, r)
+		}
+	}
+	t.rules.Store(kept)
+}
+
+// Rules returns the rules that have not expired.
+func (t *TracePolicy) Rules() []TraceRule {
+	now := time.Now()
+	var rules []TraceRule
+	for _, r := range t.load() {
+		if r.Expires.IsZero() || now.Before(r.Expires) {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// load returns the current rules. The result must not be modified.
+func (t *TracePolicy) load() []TraceRule {
+	rules, _ := t.rules.Load().([]TraceRule)
+	return rules[:len(rules):len(rules)]
+}
+
+// traced reports whether the messages of p are traced. It is called for every
+// relayed packet and does not lock.
+func (t *TracePolicy) traced(p *ProxyConn, now time.Time) bool {
+	rules := t.load()
+	for i := range rules {
+		if rules[i].matches(p.User, p.Downstream.RemoteAddr(), now) {
+			return true
+		}
+	}
+	return false
+}
+
+// trace writes an event for packet if p is traced.
+func (t *TracePolicy) trace(p *ProxyConn, dir relayDirection, packet []byte) {
+	now := time.Now()
+	if t.Sink == nil || !t.traced(p, now) {
+		return
+	}
+	e := TraceEvent{
+		Time:      now,
+		Session:   p.info.ID,
+		User:      p.User,
+		Direction: "upstream",
+		Type:      packet[0],
+		Length:    len(packet),
+	}
+	if dir == toDownstream {
+		e.Direction = "downstream"
+	}
+	if packet[0] > msgChannelOpen && packet[0] <= msgChannelFailure {
+		if id, ok := recipient(packet); ok {
+			e.Channel = &id
+		}
+	}
+
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(e)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Sink.Write(buf.Bytes())
+}
@@ -0,0 +1,99 @@
+package ssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTracePolicyRules(t *testing.T) {
+	var policy TracePolicy
+	if err := policy.Enable(TraceRule{}); err != errTraceCriteria {
+		t.Errorf("got error %v for a rule without criteria, want %v", err, errTraceCriteria)
+	}
+	policy.Enable(TraceRule{User: "alice"})
+	policy.Enable(TraceRule{User: "bob", Expires: time.Now().Add(-time.Second)})
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	policy.Enable(TraceRule{Network: loopback})
+	if got := len(policy.Rules()); got != 2 {
+		t.Errorf("got %d active rules, want 2", got)
+	}
+
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	remote := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	now := time.Now()
+	for _, tc := range []struct {
+		user string
+		addr net.Addr
+		want bool
+	}{
+		{"alice", remote, true},
+		{"bob", remote, false},
+		{"carol", local, true},
+		{"carol", remote, false},
+	} {
+		p := &ProxyConn{User: tc.user, Downstream: &connection{sshConn: sshConn{conn: &addrConn{remote: tc.addr}}}}
+		if got := policy.traced(p, now); got != tc.want {
+			t.Errorf("traced(%s, %v) = %v, want %v", tc.user, tc.addr, got, tc.want)
+		}
+	}
+
+	policy.Disable(func(r TraceRule) bool { return r.User == "alice" })
+	p := &ProxyConn{User: "alice", Downstream: &connection{sshConn: sshConn{conn: &addrConn{remote: remote}}}}
+	if policy.traced(p, now) {
+		t.Error("alice is still traced after Disable")
+	}
+}
+
+// addrConn is a net.Conn that only has a remote address.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestProxyTrace(t *testing.T) {
+	var sink bytes.Buffer
+	proxyConf := newTestProxyConfig()
+	proxyConf.Trace = &TracePolicy{Sink: &sink}
+	proxyConf.Trace.Enable(TraceRule{User: "testuser"})
+
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+	if got := runHello(t, client); got != "hello" {
+		t.Errorf("got output %q, want %q", got, "hello")
+	}
+
+	proxyConf.Trace.mu.Lock()
+	out := sink.String()
+	proxyConf.Trace.mu.Unlock()
+	if strings.Contains(out, "hello") {
+		t.Errorf("trace contains payload: %s", out)
+	}
+	var sawData bool
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		var e TraceEvent
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("bad trace line %q: %v", line, err)
+		}
+		if e.Session != res.conn.ID() || e.User != "testuser" {
+			t.Errorf("got event %+v for another session", e)
+		}
+		if e.Type == msgChannelData && e.Direction == "downstream" && e.Channel != nil {
+			sawData = true
+		}
+	}
+	if !sawData {
+		t.Errorf("no downstream channel data traced in %s", out)
+	}
+}
@@ -0,0 +1,73 @@
+package ssh
+
+import (
+	"context"
+	"io"
+)
+
+// tracerName is the instrumentation name passed to TracerProvider.Tracer.
+const tracerName = "golang.org/x/crypto/ssh"
+
+// TracerProvider returns the Tracer the proxy creates its spans with. It
+// mirrors the OpenTelemetry API, so an adapter around an OpenTelemetry
+// TracerProvider takes a few lines, without this package depending on it.
+type TracerProvider interface {
+	Tracer(name string) Tracer
+}
+
+// Tracer starts spans. The returned context carries the span, so that the
+// spans started with it are its children.
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...SpanAttribute) (context.Context, Span)
+}
+
+// Span is an operation traced by a Tracer.
+type Span interface {
+	SetAttributes(attrs ...SpanAttribute)
+	RecordError(err error)
+	End()
+}
+
+// SpanAttribute is a key and a string, int64 or bool value describing a
+// span.
+type SpanAttribute struct {
+	Key   string
+	Value interface{}
+}
+
+// The spans of the proxy are children of the span in the context of
+// AuthenticateProxyConnContext; ProxyServer starts one span per connection
+// that encloses them and adds the handshake and dial spans.
+const (
+	spanConnection          = "ssh.proxy.connection"
+	spanDownstreamHandshake = "ssh.proxy.downstream_handshake"
+	spanFindUpstream        = "ssh.proxy.find_upstream"
+	spanUpstreamDial        = "ssh.proxy.upstream_dial"
+	spanUpstreamHandshake   = "ssh.proxy.upstream_handshake"
+	spanAuthenticate        = "ssh.proxy.authenticate"
+	spanRelay               = "ssh.proxy.relay"
+)
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...SpanAttribute) {}
+func (noopSpan) RecordError(error)              {}
+func (noopSpan) End()                           {}
+
+// startSpan starts a span with the TracerProvider of conf, or returns a
+// span that does nothing if there is none.
+func (conf *ProxyConfig) startSpan(ctx context.Context, name string, attrs ...SpanAttribute) (context.Context, Span) {
+	if conf == nil || conf.TracerProvider == nil {
+		return ctx, noopSpan{}
+	}
+	return conf.TracerProvider.Tracer(tracerName).Start(ctx, name, attrs...)
+}
+
+// endSpan records err, if any, and ends span. io.EOF, with which every
+// relayed session ends, is not recorded.
+func endSpan(span Span, err error) {
+	if err != nil && err != io.EOF {
+		span.RecordError(err)
+	}
+	span.End()
+}
@@ -0,0 +1,125 @@
+package ssh
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testSpan struct {
+	name   string
+	parent *testSpan
+	attrs  map[string]interface{}
+	err    error
+	ended  bool
+}
+
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+type testSpanKey struct{}
+
+func (tr *testTracer) Tracer(name string) Tracer { return tr }
+
+func (tr *testTracer) Start(ctx context.Context, name string, attrs ...SpanAttribute) (context.Context, Span) {
+	s := &testSpan{name: name, attrs: make(map[string]interface{})}
+	s.parent, _ = ctx.Value(testSpanKey{}).(*testSpan)
+	tr.mu.Lock()
+	tr.spans = append(tr.spans, s)
+	tr.mu.Unlock()
+	span := &testSpanHandle{tr, s}
+	span.SetAttributes(attrs...)
+	return context.WithValue(ctx, testSpanKey{}, s), span
+}
+
+type testSpanHandle struct {
+	tr *testTracer
+	s  *testSpan
+}
+
+func (h *testSpanHandle) SetAttributes(attrs ...SpanAttribute) {
+	h.tr.mu.Lock()
+	defer h.tr.mu.Unlock()
+	for _, a := range attrs {
+		h.s.attrs[a.Key] = a.Value
+	}
+}
+
+func (h *testSpanHandle) RecordError(err error) {
+	h.tr.mu.Lock()
+	defer h.tr.mu.Unlock()
+	h.s.err = err
+}
+
+func (h *testSpanHandle) End() {
+	h.tr.mu.Lock()
+	defer h.tr.mu.Unlock()
+	h.s.ended = true
+}
+
+func TestProxyTracing(t *testing.T) {
+	tracer := &testTracer{}
+	proxyConf := newTestProxyConfig()
+	proxyConf.DestinationPort = 22
+	proxyConf.FindUpstreamHook = func(username string) (string, error) {
+		return "upstream", nil
+	}
+	proxyConf.TracerProvider = tracer
+	s, addr, _ := newTestProxyServer(t, proxyConf)
+	closed := make(chan struct{})
+	s.ClosedHook = func(p *ProxyConn, err error) { close(closed) }
+	defer s.Close()
+
+	client, err := dialTestProxyServer(addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	runHello(t, client)
+	client.Close()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("session did not end")
+	}
+	// The connection span ends after ClosedHook.
+	s.Close()
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	spans := make(map[string]*testSpan)
+	for _, span := range tracer.spans {
+		spans[span.name] = span
+	}
+	root := spans[spanConnection]
+	if root == nil || root.parent != nil {
+		t.Fatalf("no root connection span in %v", tracer.spans)
+	}
+	for _, name := range []string{spanDownstreamHandshake, spanFindUpstream, spanUpstreamDial, spanUpstreamHandshake, spanAuthenticate, spanRelay} {
+		span := spans[name]
+		if span == nil {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if span.parent != root {
+			t.Errorf("%s span is not a child of the connection span", name)
+		}
+		if !span.ended {
+			t.Errorf("%s span not ended", name)
+		}
+		if span.err != nil {
+			t.Errorf("%s span recorded %v", name, span.err)
+		}
+	}
+	if got := spans[spanAuthenticate].attrs["ssh.auth.method"]; got != "publickey" {
+		t.Errorf("authenticate span has method %v", got)
+	}
+	if got := spans[spanRelay].attrs["ssh.bytes_downstream"]; got == nil || got.(int64) == 0 {
+		t.Errorf("relay span has %v bytes downstream", got)
+	}
+	if !root.ended || root.attrs["ssh.user"] != "testuser" {
+		t.Errorf("connection span: ended %v, attributes %v", root.ended, root.attrs)
+	}
+}
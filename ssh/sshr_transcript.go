@@ -0,0 +1,148 @@
+package ssh
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"sync"
+	"time"
+)
+
+// TranscriptHead is the head of a transcript hash chain after a link was
+// sealed.
+type TranscriptHead struct {
+	SessionID string
+	// Seq numbers the links of a session, starting at 1.
+	Seq  uint64
+	Time time.Time
+	// Bytes is the amount of session data covered by this link.
+	Bytes int64
+	// Hash is SHA256(previous Hash || Seq || SHA256(link data)). The chain
+	// starts from SHA256("sshr-transcript" || SessionID).
+	Hash [sha256.Size]byte
+}
+
+// TranscriptChain computes the tamper-evident hash chain over the data of a
+// session. The proxy feeds it the payloads of the channel data and extended
+// data messages of all channels of the session, in both directions, in the
+// order it relays them. A verifier needs a capture of exactly these
+// payloads: it adds them in the same order and seals the chain whenever
+// the data added since the previous seal reaches the Bytes of the next
+// emitted head, whose Hash must then match. The output of a Recorder
+// cannot be verified this way, because it covers a single channel, keeps
+// input and output apart and may leave out input.
+type TranscriptChain struct {
+	mu     sync.Mutex
+	id     string
+	head   [sha256.Size]byte
+	seq    uint64
+	link   hash.Hash
+	nbytes int64
+}
+
+// NewTranscriptChain returns the chain for the session with the given ID.
+func NewTranscriptChain(sessionID string) *TranscriptChain {
+	return &TranscriptChain{
+		id:   sessionID,
+		head: sha256.Sum256([]byte("sshr-transcript" + sessionID)),
+		link: sha256.New(),
+	}
+}
+
+// Add appends session data to the current link. fromClient tells whether
+// the data was sent by the downstream client.
+func (c *TranscriptChain) Add(fromClient bool, data []byte) {
+	var frame [5]byte
+	if fromClient {
+		frame[0] = 1
+	}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.link.Write(frame[:])
+	c.link.Write(data)
+	c.nbytes += int64(len(data))
+}
+
+// Seal closes the current link and returns the new head of the chain.
+func (c *TranscriptChain) Seal(now time.Time) TranscriptHead {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq++
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], c.seq)
+	h := sha256.New()
+	h.Write(c.head[:])
+	h.Write(seq[:])
+	h.Write(c.link.Sum(nil))
+	copy(c.head[:], h.Sum(nil))
+
+	head := TranscriptHead{
+		SessionID: c.id,
+		Seq:       c.seq,
+		Time:      now,
+		Bytes:     c.nbytes,
+		Hash:      c.head,
+	}
+	c.link.Reset()
+	c.nbytes = 0
+	return head
+}
+
+// channelPayload returns the data carried by a channel data or extended
+// data packet.
+func channelPayload(packet []byte) ([]byte, bool) {
+	var off int
+	switch {
+	case len(packet) > 0 && packet[0] == msgChannelData:
+		off = 5
+	case len(packet) > 0 && packet[0] == msgChannelExtendedData:
+		off = 9
+	default:
+		return nil, false
+	}
+	if len(packet) < off+4 {
+		return nil, false
+	}
+	n := binary.BigEndian.Uint32(packet[off:])
+	if uint32(len(packet)-off-4) < n {
+		return nil, false
+	}
+	return packet[off+4 : off+4+int(n)], true
+}
+
+// recordTranscript adds a relayed packet to the transcript of p, if any.
+func (p *ProxyConn) recordTranscript(dir relayDirection, packet []byte) {
+	if p.transcript == nil {
+		return
+	}
+	if data, ok := channelPayload(packet); ok {
+		p.transcript.Add(dir == toUpstream, data)
+	}
+}
+
+// watchTranscript emits a transcript head every interval until done is
+// closed, and a final one when the session ends.
+func (p *ProxyConn) watchTranscript(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			p.emitTranscriptHead(p.transcript.Seal(time.Now()))
+			return
+		case now := <-ticker.C:
+			p.emitTranscriptHead(p.transcript.Seal(now))
+		}
+	}
+}
+
+// emitTranscriptHead reports head to TranscriptHook and AuditCallback.
+func (p *ProxyConn) emitTranscriptHead(head TranscriptHead) {
+	if p.config.TranscriptHook != nil {
+		p.config.TranscriptHook(head)
+	}
+	p.audit(AuditEvent{Type: AuditTranscriptHead, Time: head.Time, Transcript: &head})
+}
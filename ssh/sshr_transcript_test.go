@@ -0,0 +1,92 @@
+package ssh
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTranscriptChain(t *testing.T) {
+	record := func(data ...string) TranscriptHead {
+		c := NewTranscriptChain("session")
+		c.Add(true, []byte("ls\r"))
+		c.Seal(time.Time{})
+		for _, d := range data {
+			c.Add(false, []byte(d))
+		}
+		return c.Seal(time.Time{})
+	}
+
+	head := record("file1\r\n", "file2\r\n")
+	if head.Seq != 2 || head.Bytes != 14 {
+		t.Errorf("got Seq %d, Bytes %d; want 2, 14", head.Seq, head.Bytes)
+	}
+	if record("file1\r\n", "file2\r\n").Hash != head.Hash {
+		t.Error("chain is not deterministic")
+	}
+	if record("file1\r\n", "file3\r\n").Hash == head.Hash {
+		t.Error("modified transcript has the same head")
+	}
+	if record("file1\r\nfile2\r\n").Hash == head.Hash {
+		t.Error("transcript with merged frames has the same head")
+	}
+}
+
+func TestProxyTranscriptHook(t *testing.T) {
+	heads := make(chan TranscriptHead, 10)
+	proxyConf := newTestProxyConfig()
+	proxyConf.TranscriptHook = func(head TranscriptHead) { heads <- head }
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	runHello(t, client)
+	client.Close()
+
+	var head TranscriptHead
+	select {
+	case head = <-heads:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no transcript head reported at the end of the session")
+	}
+
+	want := NewTranscriptChain(res.conn.ID())
+	want.Add(false, []byte("hello"))
+	if head.SessionID != res.conn.ID() || head.Hash != want.Seal(time.Time{}).Hash {
+		t.Errorf("transcript head %+v does not match the relayed data", head)
+	}
+}
+
+func TestProxyTranscriptAudit(t *testing.T) {
+	heads := make(chan *TranscriptHead, 10)
+	proxyConf := newTestProxyConfig()
+	proxyConf.TranscriptInterval = time.Hour
+	proxyConf.AuditCallback = func(ev AuditEvent) {
+		if ev.Type == AuditTranscriptHead {
+			heads <- ev.Transcript
+		}
+	}
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	runHello(t, client)
+	client.Close()
+
+	var head *TranscriptHead
+	select {
+	case head = <-heads:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no transcript head audited at the end of the session")
+	}
+	want := NewTranscriptChain(res.conn.ID())
+	want.Add(false, []byte("hello"))
+	if head.Seq != 1 || head.Bytes != 5 || head.Hash != want.Seal(time.Time{}).Hash {
+		t.Errorf("audited transcript head %+v does not match the relayed data", head)
+	}
+}
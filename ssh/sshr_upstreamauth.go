@@ -0,0 +1,159 @@
+package ssh
+
+import (
+	"fmt"
+	"strings"
+)
+
+// UpstreamAuthError is reported to AuthLogHook when the upstream server
+// refuses the bridged authentication request. It matches
+// ErrAuthRejected with errors.Is.
+type UpstreamAuthError struct {
+	// Methods are the methods the upstream advertised in its failure message.
+	Methods        []string
+	PartialSuccess bool
+}
+
+func (e *UpstreamAuthError) Error() string {
+	return fmt.Sprintf("%v, it accepts [%s]", errUpstreamAuthRejected, strings.Join(e.Methods, " "))
+}
+
+func (e *UpstreamAuthError) Is(target error) bool {
+	return target == errUpstreamAuthRejected || target == ErrAuthRejected
+}
+
+// upstreamRejected handles an authentication failure message from the
+// upstream. It remembers the advertised methods and returns either a request
+// to retry with, if another signer or a fallback applies, or the failure to
+// forward downstream.
+// The forwarded failure always offers publickey, which the proxy accepts
+// whatever the upstream does.
+func (p *ProxyConn) upstreamRejected(packet []byte) (retry, forward []byte, err error) {
+	var failure userAuthFailureMsg
+	if err := Unmarshal(packet, &failure); err != nil {
+		return nil, nil, err
+	}
+	p.upstreamMethods = append([]string{}, failure.Methods...)
+	p.upstreamFailure = &UpstreamAuthError{Methods: failure.Methods, PartialSuccess: failure.PartialSuccess}
+
+	if p.bridgedMethod == "publickey" {
+		for len(p.spareSigners) > 0 {
+			signer := p.spareSigners[0]
+			p.spareSigners = p.spareSigners[1:]
+			if req, err := p.signAgain(p.upstreamUser(), new(userAuthRequestMsg), signer); err == nil {
+				return Marshal(req), nil, nil
+			}
+		}
+		if req := p.upstreamPasswordRequest(); req != nil {
+			p.bridgedMethod = "password"
+			return Marshal(req), nil, nil
+		}
+	}
+	return nil, downstreamFailure(failure), nil
+}
+
+// downstreamFailure returns the failure message forwarded for an upstream
+// failure, with publickey added to its methods.
+func downstreamFailure(failure userAuthFailureMsg) []byte {
+	if !contains(failure.Methods, "publickey") {
+		failure.Methods = append([]string{"publickey"}, failure.Methods...)
+	}
+	return Marshal(&failure)
+}
+
+// upstreamAccepts reports whether the upstream may accept method. Until the
+// upstream advertised its methods, any method may work.
+func (p *ProxyConn) upstreamAccepts(method string) bool {
+	return p.upstreamMethods == nil || contains(p.upstreamMethods, method)
+}
+
+// upstreamPasswordRequest returns a password request for the upstream if it
+// accepts passwords and UpstreamPasswordHook provides one, or else nil.
+func (p *ProxyConn) upstreamPasswordRequest() *userAuthRequestMsg {
+	if p.upstreamMethods == nil || !p.upstreamAccepts("password") {
+		return nil
+	}
+	return p.passwordRequest()
+}
+
+// passwordRequest returns a password request with the password from
+// UpstreamPasswordContextHook or UpstreamPasswordHook, or nil if there is
+// none.
+func (p *ProxyConn) passwordRequest() *userAuthRequestMsg {
+	var password string
+	var err error
+	switch conf := p.config; {
+	case conf.UpstreamPasswordContextHook != nil:
+		password, err = conf.UpstreamPasswordContextHook(p.ctx, p.hookMetadata(p.downstreamKey), p.upstreamUser(), p.upstreamMethods)
+	case conf.UpstreamPasswordHook != nil:
+		password, err = conf.UpstreamPasswordHook(p.upstreamUser(), p.upstreamMethods)
+	default:
+		return nil
+	}
+	if err != nil {
+		return nil
+	}
+
+	return newPasswordRequest(p.upstreamUser(), password)
+}
+
+// probeUpstream sends a "none" request to the upstream to learn the methods
+// it accepts, like OpenSSH clients do. It reports whether the upstream
+// accepted the user without authentication.
+func (p *ProxyConn) probeUpstream() (bool, error) {
+	p.announcedUser = p.upstreamUser()
+	if err := p.Upstream.transport.writePacket(Marshal(noneAuthMsg(p.announcedUser))); err != nil {
+		return false, err
+	}
+	for {
+		packet, err := p.Upstream.transport.readPacket()
+		if err != nil {
+			return false, err
+		}
+		switch packet[0] {
+		case msgExtInfo:
+			extensions, err := parseExtInfo(packet)
+			if err != nil {
+				return false, err
+			}
+			p.setUpstreamExtensions(extensions)
+		case msgUserAuthSuccess:
+			return true, nil
+		case msgUserAuthBanner:
+			if err := p.relayUpstreamBanner(packet); err != nil {
+				return false, err
+			}
+		case msgUserAuthFailure:
+			var failure userAuthFailureMsg
+			if err := Unmarshal(packet, &failure); err != nil {
+				return false, err
+			}
+			p.upstreamMethods = append([]string{}, failure.Methods...)
+			return false, nil
+		default:
+			return false, unexpectedMessageError(msgUserAuthFailure, packet[0])
+		}
+	}
+}
+
+// upstreamAuthError returns the error reported for the last rejection by the
+// upstream.
+func (p *ProxyConn) upstreamAuthError() error {
+	if p.upstreamFailure == nil {
+		return errUpstreamAuthRejected
+	}
+	return p.upstreamFailure
+}
+
+// relayInfoResponse forwards the downstream answer to a keyboard-interactive
+// info request of the upstream.
+func (p *ProxyConn) relayInfoResponse() error {
+	packet, err := p.Downstream.transport.readPacket()
+	if err != nil {
+		return err
+	}
+	if packet[0] != msgUserAuthInfoResponse {
+		return unexpectedMessageError(msgUserAuthInfoResponse, packet[0])
+	}
+	return p.Upstream.transport.writePacket(packet)
+}
@@ -0,0 +1,188 @@
+package ssh
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/ssh/testdata"
+)
+
+// newRejectedKeyProxyConfig returns a proxy config whose upstream key is not
+// authorized by the test upstream.
+func newRejectedKeyProxyConfig() *ProxyConfig {
+	proxyConf := newTestProxyConfig()
+	proxyConf.FetchPrivateKeyHook = func(username string) ([]byte, error) {
+		return testdata.PEMBytes["ed25519"], nil
+	}
+	return proxyConf
+}
+
+func TestProxyUpstreamRejectionReported(t *testing.T) {
+	var logged []error
+	proxyConf := newRejectedKeyProxyConfig()
+	proxyConf.AuthLogHook = func(username, method string, err error) {
+		logged = append(logged, err)
+	}
+	_, _, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err == nil {
+		t.Fatal("login succeeded with a key the upstream does not accept")
+	}
+
+	if len(logged) == 0 {
+		t.Fatal("no audit event")
+	}
+	var upstreamErr *UpstreamAuthError
+	if !errors.As(logged[0], &upstreamErr) || !errors.Is(logged[0], errUpstreamAuthRejected) {
+		t.Fatalf("got error %v, want an UpstreamAuthError", logged[0])
+	}
+	if !contains(upstreamErr.Methods, "password") {
+		t.Errorf("got advertised methods %v, want password among them", upstreamErr.Methods)
+	}
+}
+
+func TestProxyUpstreamPasswordFallback(t *testing.T) {
+	var offered []string
+	proxyConf := newRejectedKeyProxyConfig()
+	proxyConf.UpstreamPasswordHook = func(username string, methods []string) (string, error) {
+		offered = methods
+		return upstreamPassword, nil
+	}
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+
+	if !contains(offered, "password") {
+		t.Errorf("hook got methods %v, want password among them", offered)
+	}
+	if got := runHello(t, client); got != "hello" {
+		t.Errorf("got output %q, want %q", got, "hello")
+	}
+}
+
+func TestProxyUpstreamPasswordFallbackNeedsVerifiedKey(t *testing.T) {
+	proxyConf := newRejectedKeyProxyConfig()
+	proxyConf.UpstreamPasswordHook = func(username string, methods []string) (string, error) {
+		t.Error("fallback offered for a key that is not authorized")
+		return upstreamPassword, nil
+	}
+	_, _, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ed25519"])},
+	})
+	if err == nil {
+		t.Fatal("login succeeded with an unauthorized key")
+	}
+}
+
+func TestProxyProbeUpstreamMethods(t *testing.T) {
+	var attempts []string
+	upstreamConf := &ServerConfig{
+		PasswordCallback: func(conn ConnMetadata, pass []byte) (*Permissions, error) {
+			if string(pass) == upstreamPassword {
+				return nil, nil
+			}
+			return nil, errors.New("password not acceptable")
+		},
+		AuthLogCallback: func(conn ConnMetadata, method string, err error) {
+			attempts = append(attempts, method)
+		},
+	}
+	upstreamConf.AddHostKey(testSigners["ecdsa"])
+
+	proxyConf := newTestProxyConfig()
+	proxyConf.ProbeUpstreamMethods = true
+	proxyConf.UpstreamPasswordHook = func(username string, methods []string) (string, error) {
+		return upstreamPassword, nil
+	}
+	client, res, err := dialTestProxy(t, proxyConf, upstreamConf, &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+
+	if got := runHello(t, client); got != "hello" {
+		t.Errorf("got output %q, want %q", got, "hello")
+	}
+	if want := []string{"none", "password"}; len(attempts) != len(want) || attempts[0] != want[0] || attempts[1] != want[1] {
+		t.Errorf("upstream saw attempts %v, want %v", attempts, want)
+	}
+}
+
+func TestProxyProbeUpstreamPublicKey(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.ProbeUpstreamMethods = true
+	client, res, err := dialTestProxy(t, proxyConf, newTestUpstreamConfig(), &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+
+	if !contains(res.conn.upstreamMethods, "publickey") {
+		t.Errorf("got probed methods %v, want publickey among them", res.conn.upstreamMethods)
+	}
+	if got := runHello(t, client); got != "hello" {
+		t.Errorf("got output %q, want %q", got, "hello")
+	}
+}
+
+func TestProxyKeyboardInteractiveRelay(t *testing.T) {
+	upstreamConf := newTestUpstreamConfig()
+	upstreamConf.KeyboardInteractiveCallback = func(conn ConnMetadata, challenge KeyboardInteractiveChallenge) (*Permissions, error) {
+		for round, want := range []string{"123456", "654321"} {
+			answers, err := challenge("upstream", "round "+string(rune('1'+round)), []string{"OTP: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) != 1 || answers[0] != want {
+				return nil, errors.New("wrong one-time password")
+			}
+		}
+		return nil, nil
+	}
+
+	var prompts []string
+	answer := func(codes ...string) KeyboardInteractiveChallenge {
+		return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			prompts = append(prompts, instruction)
+			code := codes[0]
+			codes = codes[1:]
+			return []string{code}, nil
+		}
+	}
+	client, res, err := dialTestProxy(t, newTestProxyConfig(), upstreamConf, &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{KeyboardInteractive(answer("123456", "654321"))},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+	if len(prompts) != 2 {
+		t.Errorf("got prompts %q, want two rounds", prompts)
+	}
+	if got := runHello(t, client); got != "hello" {
+		t.Errorf("got output %q, want %q", got, "hello")
+	}
+
+	_, _, err = dialTestProxy(t, newTestProxyConfig(), upstreamConf, &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{KeyboardInteractive(answer("123456", "000000"))},
+	})
+	if err == nil {
+		t.Error("login succeeded with a wrong one-time password")
+	}
+}
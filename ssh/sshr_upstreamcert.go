@@ -0,0 +1,100 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+const defaultUpstreamCertTTL = 5 * time.Minute
+
+// UpstreamCA issues short-lived user certificates for upstream logins, so
+// the proxy needs no long-lived per-user private keys: upstream servers only
+// trust the CA key, for example through TrustedUserCAKeys. Its Sign method
+// can be used as ProxyConfig.CertSignerHook.
+type UpstreamCA struct {
+	// Signer holds the CA key.
+	Signer Signer
+
+	// TTL of issued certificates. If zero, 5 minutes are used.
+	TTL time.Duration
+
+	// Extensions of issued certificates. If nil, the permit-* extensions
+	// ssh-keygen grants by default are used.
+	Extensions map[string]string
+
+	// Rand is the source of nonces and serials. If nil, crypto/rand is used.
+	Rand io.Reader
+
+	// Clock returns the current time. If nil, time.Now is used.
+	Clock func() time.Time
+}
+
+var defaultCertExtensions = map[string]string{
+	"permit-X11-forwarding":   "",
+	"permit-agent-forwarding": "",
+	"permit-port-forwarding":  "",
+	"permit-pty":              "",
+	"permit-user-rc":          "",
+}
+
+// Sign issues a certificate for key with username as its only principal.
+func (ca *UpstreamCA) Sign(username string, key PublicKey) (*Certificate, error) {
+	rnd, clock := ca.Rand, ca.Clock
+	if rnd == nil {
+		rnd = rand.Reader
+	}
+	if clock == nil {
+		clock = time.Now
+	}
+	ttl := ca.TTL
+	if ttl <= 0 {
+		ttl = defaultUpstreamCertTTL
+	}
+	extensions := ca.Extensions
+	if extensions == nil {
+		extensions = defaultCertExtensions
+	}
+
+	var serial [8]byte
+	if _, err := io.ReadFull(rnd, serial[:]); err != nil {
+		return nil, err
+	}
+	now := clock()
+	cert := &Certificate{
+		Key:             key,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        UserCert,
+		KeyId:           username,
+		ValidPrincipals: []string{username},
+		// Allow for clock skew between the proxy and the upstream.
+		ValidAfter:  uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore: uint64(now.Add(ttl).Unix()),
+		Permissions: Permissions{Extensions: extensions},
+	}
+	if err := cert.SignCert(rnd, ca.Signer); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// newCertSigner returns a signer for a fresh key certified for username by
+// CertSignerHook.
+func newCertSigner(conf *ProxyConfig, username string) (Signer, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := NewSignerFromKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := conf.CertSignerHook(username, signer.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+	return NewCertSigner(cert, signer)
+}
@@ -0,0 +1,64 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUpstreamCASign(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	ca := &UpstreamCA{
+		Signer: testSigners["rsa"],
+		TTL:    time.Minute,
+		Clock:  func() time.Time { return now },
+	}
+	cert, err := ca.Sign("deploy", testPublicKeys["ed25519"])
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	checker := CertChecker{Clock: func() time.Time { return now }}
+	if err := checker.CheckCert("deploy", cert); err != nil {
+		t.Errorf("CheckCert: %v", err)
+	}
+	if cert.Signature.Format != SigAlgoRSASHA2512 {
+		t.Errorf("got CA signature format %q, want %q", cert.Signature.Format, SigAlgoRSASHA2512)
+	}
+	checker.Clock = func() time.Time { return now.Add(2 * time.Minute) }
+	if err := checker.CheckCert("deploy", cert); err == nil {
+		t.Error("certificate valid after its TTL")
+	}
+	if _, ok := cert.Extensions["permit-pty"]; !ok {
+		t.Errorf("got extensions %v, want the defaults", cert.Extensions)
+	}
+}
+
+func TestProxyUpstreamCert(t *testing.T) {
+	checker := &CertChecker{
+		IsUserAuthority: func(auth PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), testPublicKeys["ecdsa"].Marshal())
+		},
+	}
+	upstreamConf := newTestUpstreamConfig()
+	upstreamConf.PublicKeyCallback = checker.Authenticate
+
+	proxyConf := newTestProxyConfig()
+	proxyConf.FetchPrivateKeyHook = func(username string) ([]byte, error) {
+		t.Error("private key fetched although certificates are issued")
+		return nil, errors.New("unused")
+	}
+	proxyConf.CertSignerHook = (&UpstreamCA{Signer: testSigners["ecdsa"]}).Sign
+
+	client, res, err := dialTestProxy(t, proxyConf, upstreamConf, &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"])},
+	})
+	if err != nil {
+		t.Fatalf("client: %v, proxy: %v", err, res.err)
+	}
+	defer client.Close()
+	if got := runHello(t, client); got != "hello" {
+		t.Errorf("got output %q, want %q", got, "hello")
+	}
+}
@@ -0,0 +1,127 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// VersionData is passed to the templates of a VersionTemplate.
+type VersionData struct {
+	// Build is the build version of the proxy.
+	Build string
+	// Tag is an opaque deployment tag, for example a region or a fleet.
+	Tag string
+	// Leg is "downstream" for the server version and "upstream" for the
+	// client version.
+	Leg string
+}
+
+// VersionTemplate renders the version strings the proxy announces on both
+// legs, so fleets can tell proxy versions apart on the wire. The rendered
+// strings have the form "SSH-2.0-<software> <comments>".
+type VersionTemplate struct {
+	// Software is the template of the software version, for example
+	// "sshr_{{.Build}}". It must render to printable ASCII without spaces
+	// or minus signs.
+	Software string
+	// Comments is the optional template of the comments, for example
+	// "{{.Tag}}".
+	Comments string
+
+	Build string
+	Tag   string
+}
+
+// maxVersionLength is the maximum length of a version string, excluding the
+// terminating CR LF, by RFC 4253, section 4.2.
+const maxVersionLength = 253
+
+// Version renders the version string for leg.
+func (t *VersionTemplate) Version(leg string) (string, error) {
+	data := VersionData{Build: t.Build, Tag: t.Tag, Leg: leg}
+	software, err := renderVersionPart("software", t.Software, data)
+	if err != nil {
+		return "", err
+	}
+	if strings.IndexByte(software, ' ') >= 0 {
+		return "", fmt.Errorf("ssh: software version %q contains a space", software)
+	}
+	comments, err := renderVersionPart("comments", t.Comments, data)
+	if err != nil {
+		return "", err
+	}
+	v := "SSH-2.0-" + software
+	if comments != "" {
+		v += " " + comments
+	}
+	if err := ValidateVersion(v); err != nil {
+		return "", err
+	}
+	return v, nil
+}
+
+func renderVersionPart(name, text string, data VersionData) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("ssh: version %s template: %v", name, err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("ssh: version %s template: %v", name, err)
+	}
+	return b.String(), nil
+}
+
+// Apply sets the server version of server and the client version of client,
+// either of which may be nil.
+func (t *VersionTemplate) Apply(server *ServerConfig, client *ClientConfig) error {
+	if server != nil {
+		v, err := t.Version("downstream")
+		if err != nil {
+			return err
+		}
+		server.ServerVersion = v
+	}
+	if client != nil {
+		v, err := t.Version("upstream")
+		if err != nil {
+			return err
+		}
+		client.ClientVersion = v
+	}
+	return nil
+}
+
+var errVersionSoftware = errors.New("ssh: version string needs a software version")
+
+// ValidateVersion checks that v is a valid SSH 2.0 version string, without
+// the terminating CR LF, as described in RFC 4253, section 4.2.
+func ValidateVersion(v string) error {
+	if len(v) > maxVersionLength {
+		return fmt.Errorf("ssh: version string is %d bytes long, more than %d", len(v), maxVersionLength)
+	}
+	rest := strings.TrimPrefix(v, "SSH-2.0-")
+	if rest == v {
+		return fmt.Errorf("ssh: version string %q does not start with SSH-2.0-", v)
+	}
+	software, comments := rest, ""
+	if i := strings.IndexByte(rest, ' '); i >= 0 {
+		software, comments = rest[:i], rest[i+1:]
+	}
+	if software == "" {
+		return errVersionSoftware
+	}
+	for i := 0; i < len(software); i++ {
+		if c := software[i]; c < 0x21 || c > 0x7e || c == '-' {
+			return fmt.Errorf("ssh: invalid character %q in software version %q", c, software)
+		}
+	}
+	for i := 0; i < len(comments); i++ {
+		if c := comments[i]; c < 0x20 || c > 0x7e {
+			return fmt.Errorf("ssh: invalid character %q in version comments %q", c, comments)
+		}
+	}
+	return nil
+}
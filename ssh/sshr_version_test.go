@@ -0,0 +1,99 @@
+package ssh
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestVersionTemplate(t *testing.T) {
+	tmpl := &VersionTemplate{
+		Software: "sshr_{{.Build}}",
+		Comments: "{{.Tag}} {{.Leg}}",
+		Build:    "1.4.2",
+		Tag:      "eu-west",
+	}
+	server, client := &ServerConfig{}, &ClientConfig{}
+	if err := tmpl.Apply(server, client); err != nil {
+		t.Fatal(err)
+	}
+	if want := "SSH-2.0-sshr_1.4.2 eu-west downstream"; server.ServerVersion != want {
+		t.Errorf("got server version %q, want %q", server.ServerVersion, want)
+	}
+	if want := "SSH-2.0-sshr_1.4.2 eu-west upstream"; client.ClientVersion != want {
+		t.Errorf("got client version %q, want %q", client.ClientVersion, want)
+	}
+
+	for _, bad := range []*VersionTemplate{
+		{Software: "sshr-{{.Build}}", Build: "1"},
+		{Software: "sshr {{.Build}}", Build: "1"},
+		{Software: "{{.Build}}"},
+		{Software: "sshr_{{.Nope}}"},
+		{Software: "sshr_{{.Build", Build: "1"},
+		{Software: "sshr", Comments: "{{.Tag}}", Tag: "tab\there"},
+		{Software: "sshr", Comments: strings.Repeat("x", 250)},
+	} {
+		if _, err := bad.Version("downstream"); err == nil {
+			t.Errorf("template %+v: got no error", bad)
+		}
+	}
+}
+
+func TestValidateVersion(t *testing.T) {
+	for v, ok := range map[string]bool{
+		"SSH-2.0-OpenSSH_8.9p1 Ubuntu-3": true,
+		"SSH-2.0-Go":                     true,
+		"SSH-1.99-Go":                    false,
+		"SSH-2.0-":                       false,
+		"SSH-2.0-Go\r\n":                 false,
+		"SSH-2.0-Gö":                     false,
+	} {
+		if err := ValidateVersion(v); (err == nil) != ok {
+			t.Errorf("ValidateVersion(%q) = %v, want ok %v", v, err, ok)
+		}
+	}
+}
+
+func TestProxyServerVersionTemplate(t *testing.T) {
+	proxyConf := newTestProxyConfig()
+	proxyConf.FindUpstreamHook = func(username string) (string, error) { return "upstream", nil }
+	proxyConf.VersionTemplate = &VersionTemplate{Software: "sshr_{{.Build}}", Comments: "{{.Leg}}", Build: "1.4.2"}
+	upstreamVersion := make(chan string, 1)
+	upstreamConf := newTestUpstreamConfig()
+	upstreamConf.AuthLogCallback = func(conn ConnMetadata, method string, err error) {
+		select {
+		case upstreamVersion <- string(conn.ClientVersion()):
+		default:
+		}
+	}
+	s := &ProxyServer{
+		Config: proxyConf,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			u1, u2, err := netPipe()
+			if err != nil {
+				return nil, err
+			}
+			go serveTestUpstream(u1, upstreamConf)
+			return u2, nil
+		},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	client, err := dialTestProxyServer(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if got, want := string(client.ServerVersion()), "SSH-2.0-sshr_1.4.2 downstream"; got != want {
+		t.Errorf("got server version %q, want %q", got, want)
+	}
+	if got, want := <-upstreamVersion, "SSH-2.0-sshr_1.4.2 upstream"; got != want {
+		t.Errorf("got client version %q upstream, want %q", got, want)
+	}
+}
@@ -0,0 +1,70 @@
+package ssh
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+var errX11Denied = errors.New("ssh: X11 forwarding denied by policy")
+
+// x11Restricted reports whether X11 forwarding is subject to a policy.
+func (conf *ProxyConfig) x11Restricted() bool {
+	return conf.DenyX11Forwarding || conf.X11Hook != nil
+}
+
+// x11Allowed returns an error if the user of p may not forward X11.
+func (p *ProxyConn) x11Allowed() error {
+	if p.config.X11Hook != nil {
+		return p.config.X11Hook(p.User)
+	}
+	if p.config.DenyX11Forwarding {
+		return errX11Denied
+	}
+	return nil
+}
+
+// filterX11 reports x11-req requests as AuditX11Forwarding events and
+// refuses those of users who may not forward X11. With a policy, X11
+// channels the upstream opens are refused unless a request was allowed. It
+// reports whether the packet was consumed.
+func (p *ProxyConn) filterX11(dir relayDirection, packet []byte) bool {
+	switch {
+	case packet[0] == msgChannelRequest && dir == toUpstream:
+		var msg channelRequestMsg
+		if Unmarshal(packet, &msg) != nil || msg.Request != "x11-req" {
+			return false
+		}
+		var err error
+		if p.config.x11Restricted() {
+			err = p.x11Allowed()
+		}
+		p.audit(AuditEvent{Type: AuditX11Forwarding, Err: err})
+		if err == nil {
+			atomic.StoreInt32(&p.x11Requested, 1)
+			return false
+		}
+		p.log(LogInfo, "X11 forwarding refused", "error", err)
+		if msg.WantReply {
+			p.channels.mu.Lock()
+			ch, ok := p.channels.byUpstream[msg.PeersID]
+			p.channels.mu.Unlock()
+			if ok {
+				p.Downstream.transport.writePacket(Marshal(&channelRequestFailureMsg{PeersID: ch.downstreamID}))
+			}
+		}
+		return true
+
+	case packet[0] == msgChannelOpen && dir == toDownstream:
+		var msg channelOpenMsg
+		if !p.config.x11Restricted() || Unmarshal(packet, &msg) != nil || msg.ChanType != "x11" || atomic.LoadInt32(&p.x11Requested) != 0 {
+			return false
+		}
+		p.Upstream.transport.writePacket(Marshal(&channelOpenFailureMsg{
+			PeersID: msg.PeersID,
+			Reason:  Prohibited,
+			Message: "X11 forwarding was not requested",
+		}))
+		return true
+	}
+	return false
+}
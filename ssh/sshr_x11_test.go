@@ -0,0 +1,62 @@
+package ssh
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestProxyX11Hook(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		events := make(chan AuditEvent, 20)
+		proxyConf := newTestProxyConfig()
+		proxyConf.DestinationPort = 22
+		proxyConf.FindUpstreamHook = func(username string) (string, error) {
+			return "upstream", nil
+		}
+		proxyConf.AuditCallback = func(ev AuditEvent) {
+			if ev.Type == AuditX11Forwarding {
+				events <- ev
+			}
+		}
+		var users []string
+		proxyConf.X11Hook = func(username string) error {
+			users = append(users, username)
+			if !allow {
+				return errors.New("no X11 for " + username)
+			}
+			return nil
+		}
+		s, addr, _ := newTestProxyServer(t, proxyConf)
+		client, err := dialTestProxyServer(addr)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatalf("NewSession: %v", err)
+		}
+		// The test upstream refuses x11-req too, so the reply does not
+		// tell whether the proxy relayed it.
+		session.SendRequest("x11-req", true, Marshal(&struct {
+			SingleConnection bool
+			AuthProtocol     string
+			AuthCookie       string
+			ScreenNumber     uint32
+		}{false, "MIT-MAGIC-COOKIE-1", "00112233445566778899aabbccddeeff", 0}))
+
+		select {
+		case ev := <-events:
+			if ev.User != "testuser" || (ev.Err == nil) != allow {
+				t.Errorf("allow %v: got event %+v", allow, ev)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("allow %v: no audit event", allow)
+		}
+		if len(users) != 1 || users[0] != "testuser" {
+			t.Errorf("allow %v: hook called for %v", allow, users)
+		}
+		client.Close()
+		s.Close()
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || plan9
+// +build aix darwin dragonfly freebsd linux netbsd openbsd plan9
+
+package test
+
+// Key exchange interoperability tests with the OpenSSH client.
+
+import (
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// serveOneExec accepts a connection on l with config and answers its first
+// exec request with exit status 0.
+func serveOneExec(l net.Listener, config *ssh.ServerConfig, errs chan<- error) {
+	c, err := l.Accept()
+	if err != nil {
+		errs <- err
+		return
+	}
+	defer c.Close()
+	conn, chans, reqs, err := ssh.NewServerConn(c, config)
+	if err != nil {
+		errs <- err
+		return
+	}
+	defer conn.Close()
+	errs <- nil
+	go ssh.DiscardRequests(reqs)
+	for newCh := range chans {
+		ch, reqs, err := newCh.Accept()
+		if err != nil {
+			return
+		}
+		for req := range reqs {
+			req.Reply(req.Type == "exec", nil)
+			if req.Type == "exec" {
+				ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+				ch.Close()
+			}
+		}
+	}
+}
+
+// TestKexOpenSSHClient checks that the OpenSSH client completes key
+// exchanges with the server, which for the KEM based ones verifies the Go
+// encapsulation against the reference implementation OpenSSH ships.
+func TestKexOpenSSHClient(t *testing.T) {
+	sshBin, err := exec.LookPath("ssh")
+	if err != nil {
+		t.Skip("skipping test: ssh not found")
+	}
+	out, _ := exec.Command(sshBin, "-Q", "kex").Output()
+	supported := strings.Fields(string(out))
+
+	for _, kex := range []string{"curve25519-sha256", "sntrup761x25519-sha512@openssh.com"} {
+		t.Run(kex, func(t *testing.T) {
+			if !contains(supported, kex) {
+				t.Skipf("skipping test: ssh does not support %s", kex)
+			}
+			config := &ssh.ServerConfig{
+				Config:       ssh.Config{KeyExchanges: []string{kex}},
+				NoClientAuth: true,
+			}
+			config.AddHostKey(testSigners["ecdsa"])
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			errs := make(chan error, 1)
+			go serveOneExec(l, config, errs)
+
+			cmd := exec.Command(sshBin, "-F", "/dev/null",
+				"-o", "KexAlgorithms="+kex,
+				"-o", "BatchMode=yes",
+				"-o", "StrictHostKeyChecking=no",
+				"-o", "UserKnownHostsFile=/dev/null",
+				"-p", strconv.Itoa(l.Addr().(*net.TCPAddr).Port),
+				"127.0.0.1", "true")
+			out, err := cmd.CombinedOutput()
+			if err := <-errs; err != nil {
+				t.Fatalf("server handshake: %v\nssh: %s", err, out)
+			}
+			if err != nil {
+				t.Fatalf("ssh: %v\n%s", err, out)
+			}
+		})
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
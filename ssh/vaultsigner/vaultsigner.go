@@ -0,0 +1,332 @@
+// Package vaultsigner obtains upstream credentials for the ssh proxy from
+// the SSH secrets engine of HashiCorp Vault. In CA mode, Vault signs user
+// certificates: SignCert fits ssh.ProxyConfig.CertSignerHook, and Signer,
+// which caches a certified key per user, fits FetchSignerHook. In OTP mode,
+// Vault issues one-time passwords that PasswordHook hands to
+// UpstreamPasswordHook.
+//
+// The client token is looked up on first use and renewed with renew-self
+// whenever less than a third of its TTL remains, so long-running proxies
+// keep working with periodic tokens. The deprecated dynamic keys mode is not
+// supported.
+package vaultsigner
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+var defaultHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// Client talks to one role of an SSH secrets engine.
+type Client struct {
+	// Addr is the address of Vault, such as "https://vault:8200".
+	Addr string
+
+	// Token authenticates the requests.
+	Token string
+
+	// Namespace, if set, is sent as X-Vault-Namespace.
+	Namespace string
+
+	// Mount is the path of the secrets engine. If empty, "ssh" is used.
+	Mount string
+
+	// Role is the role that signs certificates or issues passwords.
+	Role string
+
+	// TTL requested for certificates. If zero, the role's default is used.
+	TTL time.Duration
+
+	// Extensions requested for certificates. If nil, the role's defaults
+	// are used.
+	Extensions map[string]string
+
+	// HTTPClient is used for requests. If nil, a client with a timeout of
+	// ten seconds is used.
+	HTTPClient *http.Client
+
+	// Clock returns the current time. If nil, time.Now is used.
+	Clock func() time.Time
+
+	mu sync.Mutex
+	// The token's state, learned by lookup-self and renew-self. A zero
+	// tokenExpiry means the token does not expire.
+	tokenKnown     bool
+	tokenRenewable bool
+	tokenTTL       time.Duration
+	tokenExpiry    time.Time
+	signers        map[string]*cachedSigner
+}
+
+// cachedSigner is a certified key of one user.
+type cachedSigner struct {
+	signer    ssh.Signer
+	refreshAt time.Time
+}
+
+func (c *Client) now() time.Time {
+	if c.Clock != nil {
+		return c.Clock()
+	}
+	return time.Now()
+}
+
+func (c *Client) mount() string {
+	if c.Mount == "" {
+		return "ssh"
+	}
+	return strings.Trim(c.Mount, "/")
+}
+
+// response is the envelope of Vault API responses.
+type response struct {
+	Data   json.RawMessage `json:"data"`
+	Auth   *authInfo       `json:"auth"`
+	Errors []string        `json:"errors"`
+}
+
+type authInfo struct {
+	LeaseDuration int64 `json:"lease_duration"`
+	Renewable     bool  `json:"renewable"`
+}
+
+// do sends a request to path and decodes the data of the response into out.
+func (c *Client) do(method, path string, in, out interface{}) (*response, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(c.Addr, "/")+"/v1/"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", c.Token)
+	if c.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.Namespace)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = defaultHTTPClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	var r response
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &r); err != nil {
+			return nil, fmt.Errorf("vaultsigner: %s: malformed response: %v", path, err)
+		}
+	}
+	if resp.StatusCode/100 != 2 {
+		if len(r.Errors) > 0 {
+			return nil, fmt.Errorf("vaultsigner: %s: %s: %s", path, resp.Status, strings.Join(r.Errors, "; "))
+		}
+		return nil, fmt.Errorf("vaultsigner: %s: %s", path, resp.Status)
+	}
+	if out != nil {
+		if len(r.Data) == 0 {
+			return nil, fmt.Errorf("vaultsigner: %s: response has no data", path)
+		}
+		if err := json.Unmarshal(r.Data, out); err != nil {
+			return nil, fmt.Errorf("vaultsigner: %s: malformed data: %v", path, err)
+		}
+	}
+	return &r, nil
+}
+
+// RenewToken renews the client token with renew-self.
+func (c *Client) RenewToken() error {
+	resp, err := c.do("POST", "auth/token/renew-self", struct{}{}, nil)
+	if err != nil {
+		return err
+	}
+	if resp.Auth == nil {
+		return errors.New("vaultsigner: renew-self returned no auth")
+	}
+	c.mu.Lock()
+	c.setToken(resp.Auth.Renewable, time.Duration(resp.Auth.LeaseDuration)*time.Second)
+	c.mu.Unlock()
+	return nil
+}
+
+// setToken records the token's TTL. c.mu must be held.
+func (c *Client) setToken(renewable bool, ttl time.Duration) {
+	c.tokenKnown = true
+	c.tokenRenewable = renewable
+	c.tokenTTL = ttl
+	c.tokenExpiry = time.Time{}
+	if ttl > 0 {
+		c.tokenExpiry = c.now().Add(ttl)
+	}
+}
+
+// checkToken looks up the token on first use and renews it when less than
+// a third of its TTL remains.
+func (c *Client) checkToken() error {
+	c.mu.Lock()
+	known := c.tokenKnown
+	renew := c.tokenRenewable && !c.tokenExpiry.IsZero() && c.tokenExpiry.Sub(c.now()) < c.tokenTTL/3
+	c.mu.Unlock()
+
+	if !known {
+		var info struct {
+			TTL       int64 `json:"ttl"`
+			Renewable bool  `json:"renewable"`
+		}
+		if _, err := c.do("GET", "auth/token/lookup-self", nil, &info); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.setToken(info.Renewable, time.Duration(info.TTL)*time.Second)
+		c.mu.Unlock()
+		return nil
+	}
+	if renew {
+		return c.RenewToken()
+	}
+	return nil
+}
+
+// SignCert has Vault sign key for username, the only principal of the
+// certificate. Its signature fits ssh.ProxyConfig.CertSignerHook.
+func (c *Client) SignCert(username string, key ssh.PublicKey) (*ssh.Certificate, error) {
+	if err := c.checkToken(); err != nil {
+		return nil, err
+	}
+	req := struct {
+		PublicKey       string            `json:"public_key"`
+		CertType        string            `json:"cert_type"`
+		ValidPrincipals string            `json:"valid_principals"`
+		TTL             string            `json:"ttl,omitempty"`
+		Extensions      map[string]string `json:"extensions,omitempty"`
+	}{
+		PublicKey:       string(ssh.MarshalAuthorizedKey(key)),
+		CertType:        "user",
+		ValidPrincipals: username,
+		Extensions:      c.Extensions,
+	}
+	if c.TTL > 0 {
+		req.TTL = c.TTL.String()
+	}
+	var data struct {
+		SignedKey string `json:"signed_key"`
+	}
+	if _, err := c.do("POST", c.mount()+"/sign/"+c.Role, req, &data); err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(data.SignedKey))
+	if err != nil {
+		return nil, fmt.Errorf("vaultsigner: malformed signed key: %v", err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("vaultsigner: signed key is not a certificate")
+	}
+	if !bytes.Equal(cert.Key.Marshal(), key.Marshal()) {
+		return nil, errors.New("vaultsigner: certificate issued for another key")
+	}
+	return cert, nil
+}
+
+// Signer returns a signer for a key certified for username. The key and
+// certificate are reused until two thirds of the certificate's lifetime
+// have passed. Its signature fits ssh.ProxyConfig.FetchSignerHook.
+func (c *Client) Signer(username string) (ssh.Signer, error) {
+	now := c.now()
+	c.mu.Lock()
+	cached, ok := c.signers[username]
+	c.mu.Unlock()
+	if ok && now.Before(cached.refreshAt) {
+		return cached.signer, nil
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := c.SignCert(username, key.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewCertSigner(cert, key)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshAt := now
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		refreshAt = now.Add(time.Unix(int64(cert.ValidBefore), 0).Sub(now) * 2 / 3)
+	}
+	c.mu.Lock()
+	if c.signers == nil {
+		c.signers = make(map[string]*cachedSigner)
+	}
+	c.signers[username] = &cachedSigner{signer, refreshAt}
+	c.mu.Unlock()
+	return signer, nil
+}
+
+// OTP has Vault issue a one-time password for username on the host at ip.
+// The host must run vault-ssh-helper to verify it.
+func (c *Client) OTP(username, ip string) (string, error) {
+	if err := c.checkToken(); err != nil {
+		return "", err
+	}
+	req := struct {
+		Username string `json:"username"`
+		IP       string `json:"ip"`
+	}{username, ip}
+	var data struct {
+		Key     string `json:"key"`
+		KeyType string `json:"key_type"`
+	}
+	if _, err := c.do("POST", c.mount()+"/creds/"+c.Role, req, &data); err != nil {
+		return "", err
+	}
+	if data.KeyType != "otp" || data.Key == "" {
+		return "", fmt.Errorf("vaultsigner: role %q issued %q credentials, not an OTP", c.Role, data.KeyType)
+	}
+	return data.Key, nil
+}
+
+// PasswordHook returns an ssh.ProxyConfig.UpstreamPasswordHook that logs
+// users in with an OTP. ip returns the address of the user's upstream.
+func (c *Client) PasswordHook(ip func(username string) (string, error)) func(username string, methods []string) (string, error) {
+	return func(username string, methods []string) (string, error) {
+		addr, err := ip(username)
+		if err != nil {
+			return "", err
+		}
+		return c.OTP(username, addr)
+	}
+}
@@ -0,0 +1,186 @@
+package vaultsigner
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/testdata"
+)
+
+// fakeVault serves the endpoints of the token and SSH secrets engine APIs
+// used by Client.
+type fakeVault struct {
+	t       *testing.T
+	ca      ssh.Signer
+	now     time.Time
+	tokenID string
+
+	mu      sync.Mutex
+	signs   int
+	renews  int
+	lookups int
+}
+
+func (v *fakeVault) reply(w http.ResponseWriter, status int, body interface{}) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if r.Header.Get("X-Vault-Token") != v.tokenID {
+		v.reply(w, http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+		return
+	}
+
+	switch r.URL.Path {
+	case "/v1/auth/token/lookup-self":
+		v.lookups++
+		v.reply(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"ttl": 3600, "renewable": true}})
+
+	case "/v1/auth/token/renew-self":
+		v.renews++
+		v.reply(w, http.StatusOK, map[string]interface{}{"auth": map[string]interface{}{"lease_duration": 3600, "renewable": true}})
+
+	case "/v1/ssh-client/sign/proxy":
+		var req struct {
+			PublicKey       string `json:"public_key"`
+			CertType        string `json:"cert_type"`
+			ValidPrincipals string `json:"valid_principals"`
+			TTL             string `json:"ttl"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.CertType != "user" {
+			v.reply(w, http.StatusBadRequest, map[string]interface{}{"errors": []string{"bad request"}})
+			return
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.PublicKey))
+		if err != nil {
+			v.t.Errorf("malformed public key: %v", err)
+			return
+		}
+		ttl, _ := time.ParseDuration(req.TTL)
+		cert := &ssh.Certificate{
+			Key:             key,
+			CertType:        ssh.UserCert,
+			ValidPrincipals: []string{req.ValidPrincipals},
+			ValidAfter:      uint64(v.now.Add(-30 * time.Second).Unix()),
+			ValidBefore:     uint64(v.now.Add(ttl).Unix()),
+		}
+		if err := cert.SignCert(rand.Reader, v.ca); err != nil {
+			v.t.Errorf("SignCert: %v", err)
+			return
+		}
+		v.signs++
+		v.reply(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"signed_key": string(ssh.MarshalAuthorizedKey(cert))}})
+
+	case "/v1/ssh-client/creds/otp":
+		var req struct {
+			Username string `json:"username"`
+			IP       string `json:"ip"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		v.reply(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+			"key": "otp-" + req.Username + "-" + req.IP, "key_type": "otp",
+		}})
+
+	default:
+		v.reply(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+	}
+}
+
+func newFakeVault(t *testing.T) (*fakeVault, *httptest.Server) {
+	ca, err := ssh.ParsePrivateKey(testdata.PEMBytes["ecdsa"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &fakeVault{t: t, ca: ca, now: time.Now(), tokenID: "s.test"}
+	srv := httptest.NewServer(v)
+	t.Cleanup(srv.Close)
+	return v, srv
+}
+
+func TestSignCert(t *testing.T) {
+	v, srv := newFakeVault(t)
+	c := &Client{Addr: srv.URL, Token: v.tokenID, Mount: "ssh-client", Role: "proxy", TTL: 10 * time.Minute}
+
+	key, err := ssh.ParsePrivateKey(testdata.PEMBytes["ed25519"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := c.SignCert("deploy", key.PublicKey())
+	if err != nil {
+		t.Fatalf("SignCert: %v", err)
+	}
+	checker := ssh.CertChecker{}
+	if err := checker.CheckCert("deploy", cert); err != nil {
+		t.Errorf("CheckCert: %v", err)
+	}
+
+	c.Token = "s.wrong"
+	c.tokenKnown = false
+	if _, err := c.SignCert("deploy", key.PublicKey()); err == nil {
+		t.Error("SignCert succeeded with a rejected token")
+	}
+}
+
+func TestSignerCached(t *testing.T) {
+	v, srv := newFakeVault(t)
+	now := v.now
+	c := &Client{
+		Addr: srv.URL, Token: v.tokenID, Mount: "ssh-client", Role: "proxy", TTL: 30 * time.Minute,
+		Clock: func() time.Time { return now },
+	}
+
+	s1, err := c.Signer("deploy")
+	if err != nil {
+		t.Fatalf("Signer: %v", err)
+	}
+	if _, ok := s1.PublicKey().(*ssh.Certificate); !ok {
+		t.Fatalf("got %T, want a certificate signer", s1.PublicKey())
+	}
+	s2, _ := c.Signer("deploy")
+	if s1 != s2 || v.signs != 1 {
+		t.Errorf("signer not cached: %d certificates signed", v.signs)
+	}
+
+	now = now.Add(25 * time.Minute)
+	if s3, _ := c.Signer("deploy"); s3 == s1 || v.signs != 2 {
+		t.Errorf("signer not refreshed: %d certificates signed", v.signs)
+	}
+}
+
+func TestTokenRenewal(t *testing.T) {
+	v, srv := newFakeVault(t)
+	now := v.now
+	c := &Client{
+		Addr: srv.URL, Token: v.tokenID, Mount: "ssh-client", Role: "otp",
+		Clock: func() time.Time { return now },
+	}
+
+	hook := c.PasswordHook(func(username string) (string, error) { return "192.0.2.10", nil })
+	password, err := hook("deploy", []string{"password"})
+	if err != nil {
+		t.Fatalf("PasswordHook: %v", err)
+	}
+	if password != "otp-deploy-192.0.2.10" {
+		t.Errorf("got password %q", password)
+	}
+	if v.lookups != 1 || v.renews != 0 {
+		t.Errorf("got %d lookups and %d renewals, want 1 and 0", v.lookups, v.renews)
+	}
+
+	now = now.Add(50 * time.Minute)
+	if _, err := c.OTP("deploy", "192.0.2.10"); err != nil {
+		t.Fatalf("OTP: %v", err)
+	}
+	if v.lookups != 1 || v.renews != 1 {
+		t.Errorf("got %d lookups and %d renewals, want 1 and 1", v.lookups, v.renews)
+	}
+}